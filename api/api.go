@@ -9,6 +9,8 @@ import (
 	"github.com/netrack/openflow"
 	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 	"os"
 	"runtime"
@@ -17,6 +19,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/ciena/oftee/datapath"
 	"github.com/ciena/oftee/injector"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
@@ -35,10 +38,68 @@ const (
 )
 
 // DPIDMapping is used to associate a DPID with an injecting packet processor
+// and the device connection (session) from which the DPID was learned
 type DPIDMapping struct {
-	Action MappingAction
-	DPID   uint64
-	Inject injector.Injector
+	Action  MappingAction
+	DPID    uint64
+	Inject  injector.Injector
+	Session Session
+
+	// Version the OpenFlow version of the device, if known
+	Version uint8
+}
+
+// SessionStats statistics for a single device connection
+type SessionStats struct {
+	RemoteAddr string    `json:"remote_addr"`
+	Version    string    `json:"of_version,omitempty"`
+	Connected  time.Time `json:"connected"`
+	Duration   string    `json:"duration"`
+	Messages   uint64    `json:"messages"`
+	PacketIns  uint64    `json:"packet_ins"`
+	Bytes      uint64    `json:"bytes"`
+	Reason     string    `json:"reason,omitempty"`
+
+	// The messages received from the device by type, the packet ins
+	// tee-ed, i.e. not suppressed by a hook or the tee state, the packet
+	// outs injected to the device via the API and the bytes sent to it
+	MessageTypes  map[string]uint64 `json:"message_types,omitempty"`
+	TeedPacketIns uint64            `json:"teed_packet_ins"`
+	PacketOuts    uint64            `json:"packet_outs"`
+	BytesSent     uint64            `json:"bytes_sent"`
+
+	// The connection to the SDN controller, re-established when it fails
+	ControllerReconnects uint64 `json:"controller_reconnects,omitempty"`
+	ControllerDropped    uint64 `json:"controller_dropped,omitempty"`
+}
+
+// Session a device connection that can be forcibly disconnected
+type Session interface {
+	// Disconnect closes the device connection, waits for it to be
+	// cleaned up and returns its final statistics
+	Disconnect(reason string) SessionStats
+}
+
+// StatsSession a session that reports its current statistics while connected
+type StatsSession interface {
+	Stats() SessionStats
+}
+
+// ControllerSession a session that reports the SDN controller to which it is
+// proxied, if it is one of several
+type ControllerSession interface {
+	Controller() string
+}
+
+// activeController returns the SDN controller to which the latest of the
+// sessions that reports it is proxied, if any
+func activeController(sessions []Session) string {
+	for i := len(sessions) - 1; i >= 0; i-- {
+		if session, ok := sessions[i].(ControllerSession); ok {
+			return session.Controller()
+		}
+	}
+	return ""
 }
 
 // API maintains the configuration and runtime information for the API
@@ -49,31 +110,177 @@ type API struct {
 	MemProfile string
 	CPUProfile string
 
-	injectors map[uint64]injector.Injector
-	router    *mux.Router
-	serveMux  *http.ServeMux
-	lock      sync.RWMutex
+	// StaleGracePeriod is how long a device mapping is kept after its
+	// injector becomes unhealthy before it is removed. Stale mappings are
+	// not removed if zero.
+	StaleGracePeriod time.Duration
+
+	// SweepInterval is the interval at which stale device mappings are
+	// looked for, defaults to DefaultSweepInterval
+	SweepInterval time.Duration
+
+	// Config is the effective configuration, with secrets redacted,
+	// returned by the API
+	Config interface{}
+
+	// EndpointStats returns the statistics of the end points that count
+	// the messages they match, if set
+	EndpointStats func() interface{}
+
+	// AddEndpoint establishes an end point from the terms of its
+	// specification, by name, and returns it with the ID it is assigned,
+	// if set
+	AddEndpoint func(terms map[string]string) (interface{}, error)
+
+	// RemoveEndpoint removes the end point with the given ID, returning it,
+	// or false if there is no such end point, if set
+	RemoveEndpoint func(id string) (interface{}, bool)
+
+	// PromoteEndpoint replaces the shadow end point with the given ID by
+	// one that delivers, keeping its criteria, and returns it, or false
+	// if there is no such end point, if set
+	PromoteEndpoint func(id string) (interface{}, bool, error)
+
+	// BufferStats returns the memory held by the buffers of the device
+	// connections, if set
+	BufferStats func() interface{}
+
+	// Reload reloads the configuration, or only returns the changes a
+	// reload would make if dryRun, if set
+	Reload func(dryRun bool) (interface{}, error)
+
+	// ReloadStats returns the outcomes of the configuration reloads, if
+	// set
+	ReloadStats func() interface{}
+
+	// PeakStats returns the high-water marks of the process, if set
+	PeakStats func() interface{}
+
+	// ResetPeaks resets the high-water marks, returning them as they were,
+	// if set
+	ResetPeaks func() interface{}
+
+	// Gauges returns the metrics exposed in the Prometheus text format, if
+	// set
+	Gauges func() []Gauge
+
+	// HookStats returns the number of times each hook panicked, if set
+	HookStats func() interface{}
+
+	// CompareStats returns the divergence of the compare groups of end
+	// points, if set
+	CompareStats func() interface{}
+
+	// Readiness returns whether the process is ready, and the state of its
+	// subsystems, if set
+	Readiness func() (bool, interface{})
+
+	// Health returns whether the process is alive, and the state of its
+	// listener for devices, if set
+	Health func() (bool, interface{})
+
+	// Drain stops accepting connections from devices, leaving those
+	// connected alive, and returns the drain state, if set
+	Drain func() interface{}
+
+	// Envelope wraps a packet in, as tee-ed to the end points, in a JSON
+	// envelope for the subscribers to streams with `encode=json`, if set
+	Envelope func(message []byte) []byte
+
+	// MessageTypes the types of the messages that can be injected via
+	// `/oftee/{dpid}/message`, none if empty
+	MessageTypes map[openflow.Type]bool
+
+	// Auth the bearer token required by the sensitive endpoints, i.e.
+	// `/oftee/{dpid}/flows`, which are disabled if empty
+	Auth string
+
+	injectors    map[uint64]injector.Injector
+	versions     map[uint64]uint8
+	sessions     map[uint64][]Session
+	owners       map[uint64]Session
+	tee          map[uint64]*teeState
+	unhealthy    map[uint64]time.Time
+	ports        map[uint64]map[uint32]PortInfo
+	replays      map[string]*replay
+	observations map[uint64]*observation
+	subscribers  map[*subscriber]struct{}
+	errors       map[uint64]map[string]uint64
+	xids         xidTracker
+	observing    int32
+	suspended    int32
+	streaming    int32
+	streamBits   uint64
+	replayID     uint64
+	router       *mux.Router
+	serveMux     *http.ServeMux
+	lock         sync.RWMutex
+}
+
+// DisconnectResponse is used to create a HTTP response that contains the
+// number of, and final statistics of, the disconnected device connections
+type DisconnectResponse struct {
+	Disconnected int            `json:"disconnected"`
+	Sessions     []SessionStats `json:"sessions"`
+}
+
+// TeeRequest is used to parse a HTTP request to enable or disable the tee-ing
+// of packet in messages from a device. When disabled with a TTL, i.e. `30m`,
+// tee-ing is re-enabled once the TTL expires.
+type TeeRequest struct {
+	Enabled *bool  `json:"enabled"`
+	TTL     string `json:"ttl,omitempty"`
+}
+
+// TeeStatus is the tee-ing state of a device
+type TeeStatus struct {
+	Enabled    bool       `json:"enabled"`
+	Until      *time.Time `json:"until,omitempty"`
+	Suppressed uint64     `json:"suppressed"`
+}
+
+// DeviceResponse is used to create a HTTP response that describes a device.
+// `Errors` counts the error messages received from the device by their type
+// and code, i.e. `ErrCodeBadActionOutPort`. `Handshake` is that of the
+// latest connection of the device.
+type DeviceResponse struct {
+	DPID        string            `json:"dpid"`
+	Connections int               `json:"connections"`
+	Tee         TeeStatus         `json:"tee"`
+	Errors      map[string]uint64 `json:"errors,omitempty"`
+	Handshake   *Handshake        `json:"handshake,omitempty"`
+
+	// Controller the SDN controller to which the latest connection of the
+	// device is proxied, when failing over between controllers
+	Controller string `json:"controller,omitempty"`
+
+	// Sessions the current statistics of the connections of the device
+	Sessions []SessionStats `json:"sessions,omitempty"`
 }
 
 // DevicesResponse is used to create a HTTP response that lists all the known DPIDs
+// along with the OpenFlow version of each device, by DPID, once it is known
 type DevicesResponse struct {
-	Devices []string `json:"devices"`
+	Devices  []string          `json:"devices"`
+	Versions map[string]string `json:"versions,omitempty"`
 }
 
-// ListDevicesHandler returns a list of DPIDs known to the system as a JSON array
+// ListDevicesHandler returns a list of DPIDs known to the system as a JSON array.
+// When the `connected=true` query parameter is specified only the devices
+// whose injector is healthy are returned.
 func (api *API) ListDevicesHandler(resp http.ResponseWriter, req *http.Request) {
+	connected, err := queryBool(req, "connected")
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Create the response object
-	api.lock.RLock()
+	devices := api.devices(connected)
 	data := DevicesResponse{
-		Devices: make([]string, len(api.injectors)),
-	}
-	i := 0
-	for key := range api.injectors {
-		data.Devices[i] = fmt.Sprintf("of:0x%016x", key)
-		i++
+		Devices:  devices,
+		Versions: api.versionNames(devices),
 	}
-	api.lock.RUnlock()
 
 	// Convert it to bytes and return it
 	bytes, err := json.Marshal(data)
@@ -150,99 +357,588 @@ func (api *API) StopCPUProfileHandler(resp http.ResponseWriter, req *http.Reques
 	pprof.StopCPUProfile()
 }
 
-// PacketOutHandler handles an HTTP request to packet out to a given switch port. The payload to
-// the request should be the []byte of a OpenFlow packet out message, including
-// the open flow header, the packet out header, and the packet.
-func (api *API) PacketOutHandler(resp http.ResponseWriter, req *http.Request) {
+// writeJSON writes a value as the JSON body of a HTTP response
+func writeJSON(resp http.ResponseWriter, code int, value interface{}) {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		http.Error(resp,
+			fmt.Sprintf("Unable to marshal response : %s", err.Error()),
+			http.StatusInternalServerError)
+		return
+	}
+	resp.WriteHeader(code)
+	if _, err = resp.Write(bytes); err != nil {
+		log.
+			WithError(err).
+			Error("Unable to write HTTP response")
+	}
+}
+
+// ConfigHandler returns the effective configuration as a JSON object
+func (api *API) ConfigHandler(resp http.ResponseWriter, req *http.Request) {
+	api.lock.RLock()
+	config := api.Config
+	api.lock.RUnlock()
+	if config == nil {
+		http.Error(resp, "Configuration not available", http.StatusNotFound)
+		return
+	}
+	writeJSON(resp, http.StatusOK, config)
+}
+
+// SetConfig replaces the effective configuration returned by the API, i.e.
+// once the configuration is reloaded
+func (api *API) SetConfig(config interface{}) {
+	api.lock.Lock()
+	api.Config = config
+	api.lock.Unlock()
+}
+
+// ReloadHandler reloads the configuration and returns the changes made, or
+// with `dry_run=true` only returns the changes that would be made
+func (api *API) ReloadHandler(resp http.ResponseWriter, req *http.Request) {
+	if api.Reload == nil {
+		http.Error(resp, "Reload not available", http.StatusNotFound)
+		return
+	}
+	var dryRun bool
+	if value := req.URL.Query().Get("dry_run"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			http.Error(resp, fmt.Sprintf("Invalid dry_run '%s'", value), http.StatusBadRequest)
+			return
+		}
+	}
+	diff, err := api.Reload(dryRun)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(resp, http.StatusOK, diff)
+}
+
+// EndpointsResponse is used to create a HTTP response that lists the
+// statistics of the end points
+type EndpointsResponse struct {
+	Endpoints interface{} `json:"endpoints"`
+}
+
+// EndpointsHandler returns the statistics of the end points that count the
+// messages they match, i.e. shadow end points and those with a standby
+func (api *API) EndpointsHandler(resp http.ResponseWriter, req *http.Request) {
+	writeJSON(resp, http.StatusOK, api.endpoints())
+}
+
+// endpoints returns the statistics of the end points, if any
+func (api *API) endpoints() EndpointsResponse {
+	if api.EndpointStats == nil {
+		return EndpointsResponse{Endpoints: []interface{}{}}
+	}
+	return EndpointsResponse{Endpoints: api.EndpointStats()}
+}
+
+// AddEndpointHandler handles an HTTP request to add an end point. The body is
+// a JSON object of the terms of the end point's specification, by name, the
+// action and any match terms or options, whose values are strings, numbers or
+// booleans. The end point is returned with the ID it is assigned.
+func (api *API) AddEndpointHandler(resp http.ResponseWriter, req *http.Request) {
 	defer api.close(req.Body)
+	if api.AddEndpoint == nil {
+		http.Error(resp, "Adding end points not available", http.StatusNotFound)
+		return
+	}
+	var body map[string]interface{}
+	decoder := json.NewDecoder(req.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(resp, fmt.Sprintf("Invalid end point: %s", err), http.StatusBadRequest)
+		return
+	}
+	terms := make(map[string]string, len(body))
+	for name, value := range body {
+		switch value.(type) {
+		case string, json.Number, bool:
+			terms[name] = fmt.Sprint(value)
+		default:
+			http.Error(resp, fmt.Sprintf("Invalid value for term '%s'", name), http.StatusBadRequest)
+			return
+		}
+	}
+	endpoint, err := api.AddEndpoint(terms)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(resp, http.StatusCreated, endpoint)
+}
 
-	// Parse the URL for the target device's DPID
+// RemoveEndpointHandler handles an HTTP request to remove an end point,
+// returning its final statistics
+func (api *API) RemoveEndpointHandler(resp http.ResponseWriter, req *http.Request) {
+	if api.RemoveEndpoint == nil {
+		http.Error(resp, "Removing end points not available", http.StatusNotFound)
+		return
+	}
+	id := mux.Vars(req)["id"]
+	endpoint, ok := api.RemoveEndpoint(id)
+	if !ok {
+		http.Error(resp, fmt.Sprintf("End point not found, '%s'", id), http.StatusNotFound)
+		return
+	}
+	writeJSON(resp, http.StatusOK, endpoint)
+}
+
+// UpdateEndpointHandler handles an HTTP request to update an end point. The
+// body is a JSON object of the terms to change, of which only `shadow` may be
+// set to `false`, which replaces a shadow end point by one that delivers the
+// messages it matches. The end point is returned.
+func (api *API) UpdateEndpointHandler(resp http.ResponseWriter, req *http.Request) {
+	defer api.close(req.Body)
+	if api.PromoteEndpoint == nil {
+		http.Error(resp, "Updating end points not available", http.StatusNotFound)
+		return
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(resp, fmt.Sprintf("Invalid end point update: %s", err), http.StatusBadRequest)
+		return
+	}
+	if shadow, ok := body["shadow"]; len(body) != 1 || !ok || shadow != false {
+		http.Error(resp, "Invalid end point update, only '{\"shadow\": false}' is supported", http.StatusBadRequest)
+		return
+	}
+	id := mux.Vars(req)["id"]
+	endpoint, ok, err := api.PromoteEndpoint(id)
+	switch {
+	case err != nil:
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+	case !ok:
+		http.Error(resp, fmt.Sprintf("End point not found, '%s'", id), http.StatusNotFound)
+	default:
+		writeJSON(resp, http.StatusOK, endpoint)
+	}
+}
+
+// StatsResponse is used to create a HTTP response that reports the
+// resources used by the process
+type StatsResponse struct {
+	Buffers interface{} `json:"buffers"`
+	Reloads interface{} `json:"reloads,omitempty"`
+	Peaks   interface{} `json:"peaks,omitempty"`
+	Hooks   interface{} `json:"hooks,omitempty"`
+	Compare interface{} `json:"compare,omitempty"`
+}
+
+// StatsHandler returns the memory held by the buffers of the device
+// connections
+func (api *API) StatsHandler(resp http.ResponseWriter, req *http.Request) {
+	if api.BufferStats == nil {
+		http.Error(resp, "Statistics not available", http.StatusNotFound)
+		return
+	}
+	writeJSON(resp, http.StatusOK, api.stats())
+}
+
+// stats returns the resources used by the process, which requires
+// `BufferStats`
+func (api *API) stats() StatsResponse {
+	stats := StatsResponse{Buffers: api.BufferStats()}
+	if api.ReloadStats != nil {
+		stats.Reloads = api.ReloadStats()
+	}
+	if api.PeakStats != nil {
+		stats.Peaks = api.PeakStats()
+	}
+	if api.HookStats != nil {
+		stats.Hooks = api.HookStats()
+	}
+	if api.CompareStats != nil {
+		stats.Compare = api.CompareStats()
+	}
+	return stats
+}
+
+// GetDeviceHandler returns the description of a single device
+func (api *API) GetDeviceHandler(resp http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
-	log.WithFields(log.Fields{
-		"dpid": vars["dpid"],
-	}).Debug("Packet out request recieved")
-	dpid, err := strconv.ParseUint(vars["dpid"], 0, 64)
+	dpid, _, err := api.injector(vars["dpid"])
 	if err != nil {
-		log.WithFields(log.Fields{
-			"dpid": vars["dpid"],
-		}).Warn("PacketOut rejected: Unable to parse given DPID")
-		http.Error(resp, fmt.Sprintf("DPID doesn't reference a device, '%s' : %s", vars["dpid"], err), http.StatusNotFound)
+		http.Error(resp, err.Error(), http.StatusNotFound)
 		return
 	}
+	writeJSON(resp, http.StatusOK, api.device(dpid))
+}
+
+// device returns the description of a device
+func (api *API) device(dpid uint64) DeviceResponse {
 	api.lock.RLock()
-	inject, ok := api.injectors[uint64(dpid)]
+	sessions := api.sessions[dpid]
+	connections := len(sessions)
+	handshake := latestHandshake(sessions)
+	controller := activeController(sessions)
+	stats := sessionStats(sessions)
+	errors := api.deviceErrors(dpid)
 	api.lock.RUnlock()
+	return DeviceResponse{
+		DPID:        datapath.Format(dpid),
+		Connections: connections,
+		Tee:         api.teeStatus(dpid),
+		Errors:      errors,
+		Handshake:   handshake,
+		Controller:  controller,
+		Sessions:    stats,
+	}
+}
+
+// sessionStats returns the current statistics of those sessions that report
+// them
+func sessionStats(sessions []Session) []SessionStats {
+	var stats []SessionStats
+	for _, session := range sessions {
+		if session, ok := session.(StatsSession); ok {
+			stats = append(stats, session.Stats())
+		}
+	}
+	return stats
+}
+
+// queryBool parses an optional boolean query parameter
+func queryBool(req *http.Request, name string) (bool, error) {
+	value := req.URL.Query().Get(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid value for '%s', '%s' : %s", name, value, err)
+	}
+	return b, nil
+}
+
+// devices returns the DPIDs of the known devices, formatted as strings. If
+// connected is true only the devices whose injector is healthy are returned.
+func (api *API) devices(connected bool) []string {
+	api.lock.RLock()
+	defer api.lock.RUnlock()
+	devices := make([]string, 0, len(api.injectors))
+	for key, inject := range api.injectors {
+		if connected && !inject.Healthy() {
+			continue
+		}
+		devices = append(devices, datapath.Format(key))
+	}
+	return devices
+}
 
-	// If DPID doesn't exist in mapping, then 404
+// injector returns the packet injector for the device referenced by the
+// given DPID, which is parsed as a number, i.e. `0x1`, along with the parsed
+// DPID
+func (api *API) injector(value string) (uint64, injector.Injector, error) {
+	dpid, err := datapath.Parse(value)
+	if err != nil {
+		return 0, nil, fmt.Errorf("DPID doesn't reference a device, '%s' : %s", value, err)
+	}
+	api.lock.RLock()
+	inject, ok := api.injectors[dpid]
+	api.lock.RUnlock()
 	if !ok {
-		log.WithFields(log.Fields{
-			"dpid": vars["dpid"],
-		}).Warn("PacketOut rejected: Unable to find packet injector for DPID, unknown device")
-		http.Error(resp, fmt.Sprintf("DPID not found, '%s'", vars["dpid"]), http.StatusNotFound)
-		return
+		return 0, nil, fmt.Errorf("DPID not found, '%s'", value)
+	}
+	return dpid, inject, nil
+}
+
+// version returns the OpenFlow version of a device, zero if unknown
+func (api *API) version(dpid uint64) uint8 {
+	api.lock.RLock()
+	defer api.lock.RUnlock()
+	return api.versions[dpid]
+}
+
+// versionNames returns the names of the OpenFlow versions of the listed
+// devices, i.e. `1.3`, by DPID, nil if none are known
+func (api *API) versionNames(devices []string) map[string]string {
+	var names map[string]string
+	for _, device := range devices {
+		dpid, err := datapath.Parse(device)
+		if err != nil {
+			continue
+		}
+		if version := api.version(dpid); version != 0 {
+			if names == nil {
+				names = make(map[string]string, len(devices))
+			}
+			names[device] = VersionName(version)
+		}
+	}
+	return names
+}
+
+// validateMessage validates an OpenFlow message before it is injected to a
+// device of the given version, if known. These are simple validations, so
+// that they don't slow the processing of packets too much.
+func validateMessage(data []byte, version uint8) error {
+	// Verify at least enough bytes to include OF header
+	if len(data) < 8 { // len of OF header
+		return fmt.Errorf("Specified OpenFlow packet is invalid, smaller than minimum size: %d",
+			len(data))
 	}
 
-	// Read the OpenFlow message from the body
-	data, err := ioutil.ReadAll(req.Body)
+	// Verify the version and the len specified in OF header and bytes
+	// read match
+	if version != 0 && data[0] != version {
+		return fmt.Errorf("Specified OpenFlow message version does not match the device: 0x%02x != 0x%02x",
+			data[0], version)
+	}
+	specifiedSize := binary.BigEndian.Uint16(data[2:4])
+	if specifiedSize != uint16(len(data)) {
+		return fmt.Errorf("Specified packet actual len does not match len in OpenFlow header: %d != %d",
+			specifiedSize, len(data))
+	}
+	return nil
+}
+
+// validatePacketOut validates an OpenFlow packet out message before it is
+// injected to a device of the given version, if known
+func validatePacketOut(data []byte, version uint8) error {
+	if err := validateMessage(data, version); err != nil {
+		return err
+	}
+	if openflow.Type(data[1]) != openflow.TypePacketOut {
+		return fmt.Errorf("Specified OpenFlow message is not a packet out: 0x%0x",
+			uint8(data[1]))
+	}
+	return nil
+}
+
+// PacketOutHandler handles an HTTP request to packet out to a given switch port. The payload to
+// the request should be the []byte of a OpenFlow packet out message, including
+// the open flow header, the packet out header, and the packet. Or, as
+// `application/json`, a `PacketOutRequest` from which the packet out is built
+// for the OpenFlow version of the device.
+//
+// If `API_AUTH` is set the request must carry it, as `Authorization: Bearer
+// <token>`. With the `confirm=true` query parameter the packet out is followed
+// by a barrier request and the response waits for the device to accept it,
+// with `200 OK`, or reject it, with `422 Unprocessable Entity` and the error,
+// limited by `timeout`, which defaults to `PacketOutConfirmTimeout`, after
+// which it is `504 Gateway Timeout`.
+func (api *API) PacketOutHandler(resp http.ResponseWriter, req *http.Request) {
+	defer api.close(req.Body)
+
+	// Parse the URL for the target device's DPID
+	vars := mux.Vars(req)
+	confirm, timeout, err := waitOptions(req, "confirm", PacketOutConfirmTimeout)
 	if err != nil {
 		log.
 			WithError(err).
 			WithFields(log.Fields{
 				"dpid": vars["dpid"],
 			}).
-			Warn("PacketOut rejected: Unable to read message from client")
-		http.Error(resp, err.Error(), http.StatusInternalServerError)
+			Warn("PacketOut rejected: invalid timeout")
+		http.Error(resp, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Validate the packet in. These are simple validations, so that
-	// the don't slow the processing of packets too much.
+	// Build the packet out from its JSON description, for the version of
+	// the device, or read it from the body
+	build := func(version uint8) ([]byte, error) {
+		if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "application/json" {
+			data, err := decodePacketOut(req.Body, version)
+			if err != nil {
+				return nil, &packetOutError{code: http.StatusBadRequest, reason: "invalid JSON packet out", err: err}
+			}
+			return data, nil
+		}
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, &packetOutError{code: http.StatusInternalServerError, reason: "Unable to read message from client", err: err}
+		}
+		return data, nil
+	}
+	result, err := api.packetOut(req.Context(), bearerToken(req.Header.Get("Authorization")), vars["dpid"], build, confirm, timeout)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if e, ok := err.(*packetOutError); ok {
+			code = e.code
+		}
+		if code == http.StatusUnauthorized {
+			resp.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		http.Error(resp, err.Error(), code)
+		return
+	}
+	if result == nil {
+		return
+	}
+	code := http.StatusOK
+	if !result.Complete {
+		code = http.StatusGatewayTimeout
+	}
+	if result.rejected() {
+		code = http.StatusUnprocessableEntity
+	}
+	writeJSON(resp, code, result)
+}
 
-	// Verify at least enough bytes to includ OF header
-	if len(data) < 8 { // len of OF header
-		log.
-			WithFields(log.Fields{
-				"dpid": vars["dpid"],
-				"len":  len(data),
-			}).
-			Warn("PacketOut rejected: smaller than minimum size")
-		http.Error(resp,
-			fmt.Sprintf("Specified OpenFlow packet is invalid, smaller than minimum size: %d",
-				len(data)), http.StatusBadRequest)
+// DisconnectHandler handles an HTTP request to forcibly disconnect a device.
+// All the connections from the device are closed, which triggers the normal
+// cleanup, and the final statistics of the connections are returned. The
+// device is expected to reconnect on its own.
+//
+// Disconnecting disrupts the device, so the request must carry the
+// `API_AUTH` token, see `FlowsHandler`. Every request is logged, with the
+// `audit` field set to `disconnect`, along with its `reason`.
+func (api *API) DisconnectHandler(resp http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	reason := req.URL.Query().Get("reason")
+	audit := log.WithFields(log.Fields{
+		"audit":  "disconnect",
+		"client": req.RemoteAddr,
+		"dpid":   vars["dpid"],
+		"reason": reason,
+	})
+	if !api.authorize(resp, req, audit, "Disconnect") {
+		return
+	}
+	dpid, err := datapath.Parse(vars["dpid"])
+	if err != nil {
+		audit.
+			WithError(err).
+			Warn("Disconnect rejected: invalid DPID")
+		http.Error(resp, fmt.Sprintf("DPID doesn't reference a device, '%s' : %s", vars["dpid"], err), http.StatusNotFound)
+		return
+	}
+	audit = audit.WithField("dpid", datapath.Format(dpid))
+	api.lock.RLock()
+	sessions := append([]Session(nil), api.sessions[dpid]...)
+	api.lock.RUnlock()
+	if len(sessions) == 0 {
+		audit.Warn("Disconnect rejected: no connections for DPID, unknown device")
+		http.Error(resp, fmt.Sprintf("DPID not found, '%s'", vars["dpid"]), http.StatusNotFound)
 		return
 	}
 
-	// Verify OFP type and len specified in OF header and bytes read match
-	if openflow.Type(data[1]) != openflow.TypePacketOut {
-		log.
-			WithFields(log.Fields{
-				"dpid": vars["dpid"],
-				"type": fmt.Sprintf("0x%0x", uint8(data[1])),
-			}).
-			Warn("PacketOut rejected: not Open Flow packet out message")
-		http.Error(resp,
-			fmt.Sprintf("Specified OpenFlow message is not a packet out: 0x%0x",
-				uint8(data[1])), http.StatusBadRequest)
+	writeJSON(resp, http.StatusAccepted, api.disconnect(audit, dpid, sessions, reason))
+}
+
+// DisconnectDeviceHandler handles an HTTP request to close the connections
+// from a device, i.e. so that it reconnects to another instance during
+// maintenance. Unlike `DisconnectHandler` a device without connections is
+// not an error, none are disconnected, so the request can be repeated. The
+// request is authorized, and audited, as `DisconnectHandler`'s.
+func (api *API) DisconnectDeviceHandler(resp http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	reason := req.URL.Query().Get("reason")
+	audit := log.WithFields(log.Fields{
+		"audit":  "disconnect",
+		"client": req.RemoteAddr,
+		"dpid":   vars["dpid"],
+		"reason": reason,
+	})
+	if !api.authorize(resp, req, audit, "Disconnect") {
 		return
 	}
-	specifiedSize := binary.BigEndian.Uint16(data[2:4])
+	dpid, err := datapath.Parse(vars["dpid"])
+	if err != nil {
+		audit.
+			WithError(err).
+			Warn("Disconnect rejected: invalid DPID")
+		http.Error(resp, fmt.Sprintf("DPID doesn't reference a device, '%s' : %s", vars["dpid"], err), http.StatusNotFound)
+		return
+	}
+	audit = audit.WithField("dpid", datapath.Format(dpid))
+	api.lock.RLock()
+	sessions := append([]Session(nil), api.sessions[dpid]...)
+	api.lock.RUnlock()
+	writeJSON(resp, http.StatusOK, api.disconnect(audit, dpid, sessions, reason))
+}
 
-	if specifiedSize != uint16(len(data)) {
-		log.
-			WithFields(log.Fields{
-				"dpid":     vars["dpid"],
-				"expected": specifiedSize,
-				"actual":   len(data),
-			}).
-			Warn("PacketOut rejected: actuall len does not match len in OpenFlow header")
-		http.Error(resp,
-			fmt.Sprintf("Specified packet actual len does not match len in OpenFlow header: %d != %d",
-				specifiedSize, len(data)), http.StatusBadRequest)
+// disconnect closes the given connections from a device, returning their
+// final statistics. The disconnect is logged to the audit trail, even if
+// there are no connections to close.
+func (api *API) disconnect(audit *log.Entry, dpid uint64, sessions []Session, reason string) DisconnectResponse {
+	data := DisconnectResponse{
+		Disconnected: len(sessions),
+		Sessions:     make([]SessionStats, len(sessions)),
+	}
+	audit.
+		WithFields(log.Fields{
+			"connections": len(sessions),
+		}).
+		Info("Disconnect")
+	if len(sessions) == 0 {
+		return data
+	}
+	log.WithFields(log.Fields{
+		"dpid":        datapath.Format(dpid),
+		"reason":      reason,
+		"connections": len(sessions),
+	}).Info("Forcibly disconnecting device")
+	for i, session := range sessions {
+		data.Sessions[i] = session.Disconnect(reason)
+	}
+	return data
+}
+
+// DrainHandler handles an HTTP request to stop accepting connections from
+// devices, while those connected are left alive, returning the drain state.
+// Draining can't be undone, short of restarting the process, so the request
+// can be repeated. The request must carry the `API_AUTH` token, see
+// `FlowsHandler`, and is logged with the `audit` field set to `drain`.
+func (api *API) DrainHandler(resp http.ResponseWriter, req *http.Request) {
+	audit := log.WithFields(log.Fields{
+		"audit":  "drain",
+		"client": req.RemoteAddr,
+	})
+	if !api.authorize(resp, req, audit, "Drain") {
 		return
 	}
+	if api.Drain == nil {
+		audit.Warn("Drain rejected: draining not available")
+		http.Error(resp, "Draining not available", http.StatusNotFound)
+		return
+	}
+	audit.Info("Drain")
+	writeJSON(resp, http.StatusOK, api.Drain())
+}
 
-	// Inject the packet
-	inject.Inject(data)
+// TeeHandler handles an HTTP request to enable or disable the tee-ing of
+// packet in messages from a device. The setting is keyed by DPID, so it
+// applies to devices that are not, or not yet, connected and survives
+// reconnects. Proxying to the SDN controller is not affected.
+func (api *API) TeeHandler(resp http.ResponseWriter, req *http.Request) {
+	defer api.close(req.Body)
+
+	vars := mux.Vars(req)
+	dpid, err := datapath.Parse(vars["dpid"])
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("DPID doesn't reference a device, '%s' : %s", vars["dpid"], err), http.StatusNotFound)
+		return
+	}
+	var teeReq TeeRequest
+	if err = json.NewDecoder(req.Body).Decode(&teeReq); err != nil {
+		http.Error(resp, fmt.Sprintf("Unable to parse tee request : %s", err), http.StatusBadRequest)
+		return
+	}
+	if teeReq.Enabled == nil {
+		http.Error(resp, "Tee request must specify 'enabled'", http.StatusBadRequest)
+		return
+	}
+	var ttl time.Duration
+	if teeReq.TTL != "" {
+		if ttl, err = time.ParseDuration(teeReq.TTL); err != nil || ttl <= 0 {
+			http.Error(resp, fmt.Sprintf("Invalid tee TTL '%s'", teeReq.TTL), http.StatusBadRequest)
+			return
+		}
+	}
+
+	api.SetTee(dpid, *teeReq.Enabled, ttl)
+	log.WithFields(log.Fields{
+		"dpid":    datapath.Format(dpid),
+		"enabled": *teeReq.Enabled,
+		"ttl":     teeReq.TTL,
+	}).Info("Device tee state changed")
+	writeJSON(resp, http.StatusOK, api.teeStatus(dpid))
 }
 
 // close wraps an io.Closer.Close call so that any error can be logged
@@ -254,6 +950,33 @@ func (api *API) close(c io.Closer) {
 	}
 }
 
+// removeMapping removes the session of a deleted mapping. The injector, and
+// the state learned from the device, is only removed when it is the one
+// currently mapped, as another connection from the same device may have
+// replaced it.
+func (api *API) removeMapping(mapping DPIDMapping) {
+	sessions := api.sessions[mapping.DPID][:0]
+	for _, session := range api.sessions[mapping.DPID] {
+		if session != mapping.Session {
+			sessions = append(sessions, session)
+		}
+	}
+	if len(sessions) == 0 {
+		delete(api.sessions, mapping.DPID)
+	} else {
+		api.sessions[mapping.DPID] = sessions
+	}
+	if mapping.Inject == nil || api.injectors[mapping.DPID] == mapping.Inject {
+		delete(api.injectors, mapping.DPID)
+		delete(api.versions, mapping.DPID)
+		delete(api.owners, mapping.DPID)
+		delete(api.unhealthy, mapping.DPID)
+		delete(api.ports, mapping.DPID)
+		delete(api.errors, mapping.DPID)
+		api.xids.forget(mapping.DPID)
+	}
+}
+
 // Loop that listens for updates of DPID mappings
 func (api *API) dpidMappingUpdates() {
 	for {
@@ -262,21 +985,29 @@ func (api *API) dpidMappingUpdates() {
 		switch mapping.Action {
 		case MapActionAdd:
 			log.WithFields(log.Fields{
-				"dpid": fmt.Sprintf("0x%016x", mapping.DPID),
+				"dpid": datapath.Format(mapping.DPID),
 			}).Debug("Adding device mapping")
 			api.lock.Lock()
 			api.injectors[mapping.DPID] = mapping.Inject
+			api.versions[mapping.DPID] = mapping.Version
+			delete(api.unhealthy, mapping.DPID)
+			if mapping.Session != nil {
+				api.sessions[mapping.DPID] = append(api.sessions[mapping.DPID], mapping.Session)
+				api.owners[mapping.DPID] = mapping.Session
+			} else {
+				delete(api.owners, mapping.DPID)
+			}
 			api.lock.Unlock()
 		case MapActionDelete:
 			log.WithFields(log.Fields{
-				"dpid": fmt.Sprintf("0x%016x", mapping.DPID),
+				"dpid": datapath.Format(mapping.DPID),
 			}).Debug("Deleting device mapping")
 			api.lock.Lock()
-			delete(api.injectors, mapping.DPID)
+			api.removeMapping(mapping)
 			api.lock.Unlock()
 		default:
 			log.WithFields(log.Fields{
-				"dpid":   fmt.Sprintf("0x%016x", mapping.DPID),
+				"dpid":   datapath.Format(mapping.DPID),
 				"action": mapping.Action,
 			}).Warn("Received unknown device mapping action")
 		}
@@ -292,6 +1023,17 @@ func NewAPI(listenOn string, cpuProfile string, memProfile string) *API {
 		router:              mux.NewRouter(),
 		serveMux:            http.NewServeMux(),
 		injectors:           make(map[uint64]injector.Injector),
+		versions:            make(map[uint64]uint8),
+		sessions:            make(map[uint64][]Session),
+		owners:              make(map[uint64]Session),
+		tee:                 make(map[uint64]*teeState),
+		unhealthy:           make(map[uint64]time.Time),
+		ports:               make(map[uint64]map[uint32]PortInfo),
+		replays:             make(map[string]*replay),
+		observations:        make(map[uint64]*observation),
+		subscribers:         make(map[*subscriber]struct{}),
+		errors:              make(map[uint64]map[string]uint64),
+		xids:                newXIDTracker(),
 		DPIDMappingListener: make(chan DPIDMapping, 100),
 	}
 
@@ -304,38 +1046,146 @@ func NewAPI(listenOn string, cpuProfile string, memProfile string) *API {
 	api.router.
 		HandleFunc("/oftee/profile/mem", api.MemProfileHandler).
 		Methods("POST")
+	api.router.
+		HandleFunc("/oftee/config", api.ConfigHandler).
+		Methods("GET")
+	api.router.
+		HandleFunc("/oftee/endpoints", api.EndpointsHandler).
+		Methods("GET")
+	api.router.
+		HandleFunc("/oftee/endpoints", api.AddEndpointHandler).
+		Methods("POST")
+	api.router.
+		HandleFunc("/oftee/endpoints/{id}", api.RemoveEndpointHandler).
+		Methods("DELETE")
+	api.router.
+		HandleFunc("/oftee/endpoints/{id}", api.UpdateEndpointHandler).
+		Methods("PATCH")
+	api.router.
+		HandleFunc("/oftee/reload", api.ReloadHandler).
+		Methods("POST")
+	api.router.
+		HandleFunc("/oftee/drain", api.DrainHandler).
+		Methods("POST")
+	api.router.
+		HandleFunc("/oftee/stats", api.StatsHandler).
+		Methods("GET")
+	api.router.
+		HandleFunc("/oftee/stats/peaks", api.ResetPeaksHandler).
+		Methods("DELETE")
+	api.router.
+		HandleFunc("/oftee/metrics", api.MetricsHandler).
+		Methods("GET")
+	api.router.
+		HandleFunc("/metrics", api.MetricsHandler).
+		Methods("GET")
+	api.router.
+		HandleFunc("/oftee/observe", api.ObserveHandler).
+		Methods("GET")
+	api.router.
+		HandleFunc("/oftee/stream", api.StreamHandler).
+		Methods("GET")
+	api.router.
+		HandleFunc("/oftee/{dpid}/stream", api.StreamHandler).
+		Methods("GET")
+	api.router.
+		HandleFunc("/oftee/{dpid}/connection", api.DisconnectHandler).
+		Methods("DELETE")
+	api.router.
+		HandleFunc("/oftee/{dpid}/ports", api.ListPortsHandler).
+		Methods("GET")
+	api.router.
+		HandleFunc("/oftee/{dpid}/replay", api.ReplayHandler).
+		Methods("POST")
+	api.router.
+		HandleFunc("/oftee/{dpid}/replay/{id}", api.ReplayStatusHandler).
+		Methods("GET")
+	api.router.
+		HandleFunc("/oftee/{dpid}/message", api.MessageHandler).
+		Methods("POST")
+	api.router.
+		HandleFunc("/oftee/{dpid}/tee", api.TeeHandler).
+		Methods("PUT")
+	api.router.
+		HandleFunc("/oftee/{dpid}/flows", api.FlowsHandler).
+		Methods("GET")
+	api.router.
+		HandleFunc("/oftee/{dpid}/flow", api.FlowModHandler).
+		Methods("POST", "DELETE")
+	api.router.
+		HandleFunc("/oftee/{dpid}", api.GetDeviceHandler).
+		Methods("GET")
+	api.router.
+		HandleFunc("/oftee/{dpid}", api.DisconnectDeviceHandler).
+		Methods("DELETE")
 	api.router.
 		HandleFunc("/oftee/{dpid}", api.PacketOutHandler).
 		Methods("POST").
 		Headers("Content-type", "application/octet-stream")
+	api.router.
+		HandleFunc("/oftee/{dpid}", api.PacketOutHandler).
+		Methods("POST").
+		HeadersRegexp("Content-type", "^application/json")
 	api.router.
 		HandleFunc("/oftee", api.ListDevicesHandler).
 		Methods("GET")
+	api.router.
+		HandleFunc("/readyz", api.ReadyHandler).
+		Methods("GET")
+	api.router.
+		HandleFunc("/healthz", api.HealthHandler).
+		Methods("GET")
 	api.serveMux.Handle("/", api.router)
 	return api
 }
 
+// ServeHTTP dispatches an HTTP request to the API handlers
+func (api *API) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	api.serveMux.ServeHTTP(resp, req)
+}
+
 // ListenAndServe implements the API service loop
 func (api *API) ListenAndServe() {
+	api.Start()
+	listener, err := net.Listen("tcp", api.ListenOn)
+	if err != nil {
+		log.
+			WithFields(log.Fields{
+				"connect-point": api.ListenOn,
+			}).
+			WithError(err).
+			Fatal("Unable to listen for REST API requests")
+	}
+	log.Fatal(api.Serve(listener))
+}
+
+// Start starts tracking the devices, their DPID mappings and the removal of
+// stale devices, which doesn't depend on serving API requests
+func (api *API) Start() {
 
 	// TODO It is good Go practice to handle structures that arrive
 	// "unitialized". This should be done here, so NewAPI does not "have" to
 	// be called.
 
+	// Start the DPID update listener
+	log.Debug("Start API listening for device DPID information")
+	go api.dpidMappingUpdates()
+	if api.StaleGracePeriod > 0 {
+		go api.sweep()
+	}
+}
+
+// Serve serves API requests on the given listener until it fails
+func (api *API) Serve(listener net.Listener) error {
 	srv := &http.Server{
-		Addr:    api.ListenOn,
 		Handler: api.serveMux,
 		// Good practice: enforce timeouts for servers you create!
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
 
-	// Start the DPID update listener
-	log.Debug("Start API listening for device DPID information")
-	go api.dpidMappingUpdates()
-
 	log.WithFields(log.Fields{
-		"connect-point": api.ListenOn,
+		"connect-point": listener.Addr().String(),
 	}).Debug("Listening for REST API requests")
-	log.Fatal(srv.ListenAndServe())
+	return srv.Serve(listener)
 }
@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -11,12 +12,15 @@ import (
 	"io"
 	"net"
 	"net/http/httptest"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
 
 type DeviceList struct {
-	Devices []string `json:"devices"`
+	Devices  []string          `json:"devices"`
+	Versions map[string]string `json:"versions"`
 }
 
 func TestPacketOutNoDPID(t *testing.T) {
@@ -45,13 +49,43 @@ func TestPacketOutUnknownDPID(t *testing.T) {
 	}
 }
 
+func TestPacketOutUnauthorized(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.Auth = "secret"
+	mock := &MockInjector{}
+	api.injectors[0x1] = mock
+	packetOut := func(authorization string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "http://example.com/oftee/0x1", bytes.NewReader(ofMessage(openflow.TypePacketOut, 0, make([]byte, 16))))
+		req.Header.Add("Content-type", "application/octet-stream")
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		api.serveMux.ServeHTTP(resp, req)
+		return resp
+	}
+
+	for _, authorization := range []string{"", "Bearer wrong"} {
+		if resp := packetOut(authorization); resp.Code != 401 || resp.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("Expected 401 for authorization '%s', got %d", authorization, resp.Code)
+		}
+	}
+	if len(mock.Messages) != 0 {
+		t.Errorf("Expected no messages injected, found %d", len(mock.Messages))
+	}
+	if resp := packetOut("Bearer secret"); resp.Code != 200 || len(mock.Messages) != 1 {
+		t.Errorf("Expected packet out injected with the token, got %d", resp.Code)
+	}
+}
+
 type MockInjector struct {
-	DPID     uint64
-	Messages [][]byte
+	DPID      uint64
+	Messages  [][]byte
+	Unhealthy bool
 }
 
 func (*MockInjector) Stop() {}
-func (m *MockInjector) Inject(message []byte) {
+func (m *MockInjector) Inject(ctx context.Context, message []byte) {
 	m.Messages = append(m.Messages, message)
 }
 func (m *MockInjector) SetDPID(dpid uint64) {
@@ -63,6 +97,10 @@ func (*MockInjector) GetDPID() uint64 {
 func (*MockInjector) Copy(w io.Writer, r io.Reader) (int64, error) {
 	return 0, nil
 }
+func (m *MockInjector) Healthy() bool {
+	return !m.Unhealthy
+}
+func (*MockInjector) SetLog(*log.Entry) {}
 
 func TestPacketOutKnownDPID(t *testing.T) {
 	log.SetLevel(log.DebugLevel)
@@ -265,9 +303,10 @@ func TestListDevices(t *testing.T) {
 	}
 
 	api.DPIDMappingListener <- DPIDMapping{
-		Action: MapActionAdd,
-		DPID:   0x1,
-		Inject: mock,
+		Action:  MapActionAdd,
+		DPID:    0x1,
+		Inject:  mock,
+		Version: ofVersion13,
 	}
 	// Wait for message to be processed
 	for len(api.DPIDMappingListener) > 0 {
@@ -290,4 +329,337 @@ func TestListDevices(t *testing.T) {
 	if len(list.Devices) != 1 {
 		t.Errorf("Expected 1 devices, got %d", len(list.Devices))
 	}
+	if version := list.Versions["of:0x0000000000000001"]; version != "1.3" {
+		t.Errorf("Expected the device of OpenFlow version 1.3, got '%s'", version)
+	}
+}
+
+type MockSession struct {
+	Reason string
+}
+
+func (m *MockSession) Disconnect(reason string) SessionStats {
+	m.Reason = reason
+	return SessionStats{RemoteAddr: "mock", Reason: reason}
+}
+
+// statsSession a session that reports fixed statistics
+type statsSession struct {
+	MockSession
+	stats SessionStats
+}
+
+func (s *statsSession) Stats() SessionStats {
+	return s.stats
+}
+
+func TestGetDeviceSessionStats(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.injectors[0x1] = &MockInjector{}
+	stats := SessionStats{RemoteAddr: "10.0.0.1:5000", Version: "1.3", MessageTypes: map[string]uint64{"packet_in": 2}, PacketIns: 2, PacketOuts: 1}
+	api.sessions[0x1] = []Session{&MockSession{}, &statsSession{stats: stats}}
+
+	// Only the sessions that report statistics are included
+	resp := httptest.NewRecorder()
+	api.serveMux.ServeHTTP(resp, httptest.NewRequest("GET", "/oftee/0x1", nil))
+	var device DeviceResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &device); err != nil {
+		t.Fatal(err)
+	}
+	if device.Connections != 2 || !reflect.DeepEqual(device.Sessions, []SessionStats{stats}) {
+		t.Errorf("Expected the statistics of the session %+v, got %s", stats, resp.Body)
+	}
+}
+
+func TestDisconnectAllSessions(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	go api.dpidMappingUpdates()
+
+	mock := &MockInjector{DPID: 0x1}
+	sessions := []*MockSession{{}, {}}
+	for _, session := range sessions {
+		api.DPIDMappingListener <- DPIDMapping{
+			Action:  MapActionAdd,
+			DPID:    0x1,
+			Inject:  mock,
+			Session: session,
+		}
+	}
+	for len(api.DPIDMappingListener) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest("DELETE", "http://example.com/oftee/0x1/connection?reason=wedged", nil)
+	req.Header.Add("Authorization", "Bearer secret")
+	api.Auth = "secret"
+	api.serveMux.ServeHTTP(resp, req)
+	if resp.Code != 202 {
+		t.Fatalf("Incorrect response code, expected 202, got %d", resp.Code)
+	}
+	var data DisconnectResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Sessions) != 2 {
+		t.Errorf("Expected statistics for 2 sessions, got %d", len(data.Sessions))
+	}
+	for _, session := range sessions {
+		if session.Reason != "wedged" {
+			t.Errorf("Expected session to be disconnected with reason 'wedged', got '%s'", session.Reason)
+		}
+	}
+}
+
+func TestDisconnectUnknownDPID(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.Auth = "secret"
+
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest("DELETE", "http://example.com/oftee/0x1/connection", nil)
+	req.Header.Add("Authorization", "Bearer secret")
+	api.serveMux.ServeHTTP(resp, req)
+	if resp.Code != 404 {
+		t.Errorf("Incorrect response code, expected 404, got %d", resp.Code)
+	}
+}
+
+func TestDisconnectUnauthorized(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	session := &MockSession{Reason: "connected"}
+	api.sessions[0x1] = []Session{session}
+
+	// Disabled without a token, and rejected without the token
+	for _, token := range []string{"", "secret"} {
+		api.Auth = token
+		for header, expected := range map[string]int{"": 403, "Bearer wrong": 403} {
+			if token != "" {
+				expected = 401
+			}
+			resp := httptest.NewRecorder()
+			req := httptest.NewRequest("DELETE", "/oftee/0x1/connection?reason=wedged", nil)
+			if header != "" {
+				req.Header.Add("Authorization", header)
+			}
+			api.serveMux.ServeHTTP(resp, req)
+			if resp.Code != expected {
+				t.Errorf("Token '%s', Authorization '%s': expected %d, got %d", token, header, expected, resp.Code)
+			}
+		}
+	}
+	if session.Reason != "connected" {
+		t.Errorf("Expected the session left connected, disconnected with reason '%s'", session.Reason)
+	}
+}
+
+// auditRecorder a logrus hook that records the fields of the lines logged to
+// the audit trail, until stopped, as a hook can't be removed
+type auditRecorder struct {
+	lock    sync.Mutex
+	stopped bool
+	audited []log.Fields
+}
+
+func (r *auditRecorder) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (r *auditRecorder) Fire(entry *log.Entry) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := entry.Data["audit"]; ok && !r.stopped {
+		data := make(log.Fields, len(entry.Data))
+		for k, v := range entry.Data {
+			data[k] = v
+		}
+		r.audited = append(r.audited, data)
+	}
+	return nil
+}
+
+// stop stops recording, returning the fields of the lines recorded
+func (r *auditRecorder) stop() []log.Fields {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.stopped = true
+	return r.audited
+}
+
+func TestDisconnectAudited(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.Auth = "secret"
+	api.sessions[0x1] = []Session{&MockSession{}}
+	recorder := &auditRecorder{}
+	log.AddHook(recorder)
+	defer recorder.stop()
+
+	req := httptest.NewRequest("DELETE", "/oftee/0x1/connection?reason=wedged", nil)
+	req.Header.Add("Authorization", "Bearer secret")
+	api.serveMux.ServeHTTP(httptest.NewRecorder(), req)
+	audited := recorder.stop()
+	if len(audited) != 1 || audited[0]["audit"] != "disconnect" || audited[0]["reason"] != "wedged" || audited[0]["connections"] != 1 || audited[0]["dpid"] != "of:0x0000000000000001" {
+		t.Errorf("Expected the disconnect audited with its reason and DPID, got %v", audited)
+	}
+}
+
+func TestDisconnectDevice(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.Auth = "secret"
+	api.sessions[0x1] = []Session{&MockSession{}, &MockSession{}}
+
+	// A device without connections is not an error, none are disconnected
+	for path, expected := range map[string]int{"/oftee/0x1": 2, "/oftee/0x2": 0} {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("DELETE", path, nil)
+		req.Header.Add("Authorization", "Bearer secret")
+		api.serveMux.ServeHTTP(resp, req)
+		if resp.Code != 200 {
+			t.Errorf("%s: incorrect response code, expected 200, got %d", path, resp.Code)
+			continue
+		}
+		var data DisconnectResponse
+		if err := json.Unmarshal(resp.Body.Bytes(), &data); err != nil {
+			t.Fatal(err)
+		}
+		if data.Disconnected != expected || len(data.Sessions) != expected {
+			t.Errorf("%s: expected %d disconnected, got %+v", path, expected, data)
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.Auth = "secret"
+	drain := func() *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/oftee/drain", nil)
+		req.Header.Add("Authorization", "Bearer secret")
+		api.serveMux.ServeHTTP(resp, req)
+		return resp
+	}
+	if resp := drain(); resp.Code != 404 {
+		t.Errorf("Expected draining not available, got %d", resp.Code)
+	}
+
+	drains := 0
+	api.Drain = func() interface{} {
+		drains++
+		return map[string]int{"connections": 3}
+	}
+	if resp := drain(); resp.Code != 200 || drains != 1 || resp.Body.String() != `{"connections":3}` {
+		t.Errorf("Expected the drain state, got %d %s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestDisconnectDeviceAndDrainUnauthorized(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	session := &MockSession{Reason: "connected"}
+	api.sessions[0x1] = []Session{session}
+	api.Drain = func() interface{} {
+		t.Error("Unexpected drain")
+		return nil
+	}
+
+	// Disabled without a token, and rejected without the token
+	for _, token := range []string{"", "secret"} {
+		api.Auth = token
+		for _, request := range []struct{ method, path string }{{"DELETE", "/oftee/0x1"}, {"POST", "/oftee/drain"}} {
+			expected := 403
+			if token != "" {
+				expected = 401
+			}
+			for _, header := range []string{"", "Bearer wrong"} {
+				resp := httptest.NewRecorder()
+				req := httptest.NewRequest(request.method, request.path, nil)
+				if header != "" {
+					req.Header.Add("Authorization", header)
+				}
+				api.serveMux.ServeHTTP(resp, req)
+				if resp.Code != expected {
+					t.Errorf("%s %s, token '%s', Authorization '%s': expected %d, got %d",
+						request.method, request.path, token, header, expected, resp.Code)
+				}
+				if expected == 401 && resp.Header().Get("WWW-Authenticate") != "Bearer" {
+					t.Errorf("%s %s: expected a bearer token challenge", request.method, request.path)
+				}
+			}
+		}
+	}
+	if session.Reason != "connected" {
+		t.Errorf("Expected the session left connected, disconnected with reason '%s'", session.Reason)
+	}
+}
+
+func TestRemoveMappingKeepsOtherSessions(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	first, second := &MockSession{}, &MockSession{}
+	mock := &MockInjector{}
+	api.injectors[0x1] = mock
+	api.sessions[0x1] = []Session{first, second}
+
+	api.removeMapping(DPIDMapping{Action: MapActionDelete, DPID: 0x1, Inject: &MockInjector{}, Session: first})
+	if len(api.sessions[0x1]) != 1 || api.sessions[0x1][0] != second {
+		t.Errorf("Expected only the second session to remain, got %v", api.sessions[0x1])
+	}
+	if api.injectors[0x1] != mock {
+		t.Error("Injector replaced by another connection should not be removed")
+	}
+
+	api.removeMapping(DPIDMapping{Action: MapActionDelete, DPID: 0x1, Inject: mock, Session: second})
+	if _, ok := api.sessions[0x1]; ok {
+		t.Error("Expected sessions to be removed")
+	}
+	if _, ok := api.injectors[0x1]; ok {
+		t.Error("Expected injector to be removed")
+	}
+}
+
+func TestGetDeviceDPIDForms(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.injectors[0x1] = &MockInjector{}
+
+	for _, form := range []string{"of:0x0000000000000001", "0x1", "1", "00:00:00:00:00:00:00:01"} {
+		resp := httptest.NewRecorder()
+		api.serveMux.ServeHTTP(resp, httptest.NewRequest("GET", "/oftee/"+form, nil))
+		if resp.Code != 200 {
+			t.Errorf("Incorrect response code for '%s', expected 200, got %d", form, resp.Code)
+			continue
+		}
+		var device DeviceResponse
+		if err := json.NewDecoder(resp.Body).Decode(&device); err != nil {
+			t.Fatal(err)
+		}
+		if device.DPID != "of:0x0000000000000001" {
+			t.Errorf("Expected canonical DPID for '%s', got '%s'", form, device.DPID)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+
+	// Not available until set
+	resp := httptest.NewRecorder()
+	api.serveMux.ServeHTTP(resp, httptest.NewRequest("GET", "http://example.com:4242/oftee/stats", nil))
+	if resp.Code != 404 {
+		t.Errorf("Incorrect response code, expected 404, got %d", resp.Code)
+	}
+
+	api.BufferStats = func() interface{} {
+		return map[string]int{"total_bytes": 256}
+	}
+	resp = httptest.NewRecorder()
+	api.serveMux.ServeHTTP(resp, httptest.NewRequest("GET", "http://example.com:4242/oftee/stats", nil))
+	if resp.Code != 200 {
+		t.Fatalf("Incorrect response code, expected 200, got %d", resp.Code)
+	}
+	stats := struct {
+		Buffers map[string]int `json:"buffers"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("Failed to decode response : %s", err)
+	}
+	if stats.Buffers["total_bytes"] != 256 {
+		t.Errorf("Incorrect statistics %v", stats.Buffers)
+	}
 }
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/ciena/oftee/datapath"
+	log "github.com/sirupsen/logrus"
+)
+
+// The transaction IDs, xids, of the messages injected via the API are
+// rewritten with ones allocated from a reserved range, so that the replies
+// and errors a device returns for them are recognized and not proxied to the
+// SDN controller, which never sent them. An SDN controller is expected not to
+// use xids in this range, which is set by `SetInjectXIDRange`.
+const (
+	// InjectXIDBase first xid of the default range reserved for injected
+	// messages
+	InjectXIDBase uint32 = 0xfff00000
+
+	// InjectXIDRange number of xids in the default range reserved for
+	// injected messages, which extends to 0xffffffff
+	InjectXIDRange uint32 = 0x100000
+
+	// XIDTrackSize number of the most recently injected messages whose
+	// xids are tracked, so that an error can be attributed to the
+	// operation that injected the message
+	XIDTrackSize = 4096
+)
+
+// SetInjectXIDRange sets the range of `size` xids from `base` reserved for
+// the messages injected via the API. The range must hold at least two xids,
+// a message and the barrier request that follows it when waited for, and
+// must not extend beyond 0xffffffff. Set before the API is started.
+func (api *API) SetInjectXIDRange(base, size uint32) error {
+	if size < 2 || uint64(base)+uint64(size) > 1<<32 {
+		return fmt.Errorf("invalid range of %d xids from 0x%08x, expected at least 2 xids that end at 0xffffffff or before", size, base)
+	}
+	api.xids.lock.Lock()
+	api.xids.base, api.xids.size = base, size
+	api.xids.lock.Unlock()
+	return nil
+}
+
+// IsInjectedXID returns true if the xid is in the range reserved for the
+// messages injected via the API
+func (api *API) IsInjectedXID(xid uint32) bool {
+	if api == nil {
+		return false
+	}
+	api.xids.lock.Lock()
+	defer api.xids.lock.Unlock()
+	return xid >= api.xids.base && xid-api.xids.base < api.xids.size
+}
+
+// xidEntry an injected message, by device and xid, and the replay that
+// injected it, or the request waiting for its replies, if any
+type xidEntry struct {
+	dpid   uint64
+	xid    uint32
+	replay *replay
+	waiter *replyWaiter
+}
+
+// xidTracker allocates the xids of the messages injected to each device, in
+// order from the reserved range, and tracks the most recent. Each xid is kept
+// in a slot chosen by its value and its device, so it is overwritten once
+// about `XIDTrackSize` more have been allocated.
+type xidTracker struct {
+	lock    sync.Mutex
+	base    uint32
+	size    uint32
+	next    map[uint64]uint32
+	entries [XIDTrackSize]xidEntry
+}
+
+// newXIDTracker returns a tracker allocating from the default range
+func newXIDTracker() xidTracker {
+	return xidTracker{
+		base: InjectXIDBase,
+		size: InjectXIDRange,
+		next: make(map[uint64]uint32),
+	}
+}
+
+// xidSlot returns the slot in which the xid of a message injected to a device
+// is tracked
+func xidSlot(dpid uint64, xid uint32) int {
+	return int((xid ^ uint32(dpid) ^ uint32(dpid>>32)) % XIDTrackSize)
+}
+
+// stamp allocates the next xid of a device to an OpenFlow message,
+// overwriting the xid in its header, and records the replay that injected
+// it, if any
+func (t *xidTracker) stamp(dpid uint64, message []byte, r *replay) uint32 {
+	return t.track(message, xidEntry{dpid: dpid, replay: r})
+}
+
+// stampWaiter allocates the next xid of a device to an OpenFlow message,
+// overwriting the xid in its header, and records the request waiting for its
+// replies
+func (t *xidTracker) stampWaiter(dpid uint64, message []byte, w *replyWaiter) uint32 {
+	return t.track(message, xidEntry{dpid: dpid, waiter: w})
+}
+
+// track allocates the next xid of the device of the entry to an OpenFlow
+// message and records the entry for it
+func (t *xidTracker) track(message []byte, entry xidEntry) uint32 {
+	t.lock.Lock()
+	next := t.next[entry.dpid] % t.size
+	xid := t.base + next
+	t.next[entry.dpid] = (next + 1) % t.size
+	entry.xid = xid
+	t.entries[xidSlot(entry.dpid, xid)] = entry
+	t.lock.Unlock()
+	if len(message) >= 8 {
+		binary.BigEndian.PutUint32(message[4:8], xid)
+	}
+	return xid
+}
+
+// forget stops allocating the xids of a device in order, once it is removed
+func (t *xidTracker) forget(dpid uint64) {
+	t.lock.Lock()
+	delete(t.next, dpid)
+	t.lock.Unlock()
+}
+
+// entry returns the entry of the message injected to a device with the given
+// xid, the zero entry if it is no longer tracked
+func (t *xidTracker) entry(dpid uint64, xid uint32) xidEntry {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if entry := t.entries[xidSlot(dpid, xid)]; entry.dpid == dpid && entry.xid == xid {
+		return entry
+	}
+	return xidEntry{}
+}
+
+// lookup returns the replay that injected the message to a device with the
+// given xid, nil if it was not injected by a replay or is no longer tracked
+func (t *xidTracker) lookup(dpid uint64, xid uint32) *replay {
+	return t.entry(dpid, xid).replay
+}
+
+// waiter returns the request waiting for the replies to the message injected
+// to a device with the given xid, nil if there is none or it is no longer
+// tracked
+func (t *xidTracker) waiter(dpid uint64, xid uint32) *replyWaiter {
+	return t.entry(dpid, xid).waiter
+}
+
+// DeviceError counts an error message received from a device, by its class,
+// i.e. `ErrCodeBadActionOutPort`. Returns true if the error is for a message
+// injected via the API, in which case it is recorded against the replay that
+// injected it, if any, and must not be proxied to the SDN controller.
+func (api *API) DeviceError(dpid uint64, xid uint32, class string) bool {
+	if api == nil {
+		return false
+	}
+	api.lock.Lock()
+	counts, ok := api.errors[dpid]
+	if !ok {
+		counts = make(map[string]uint64)
+		api.errors[dpid] = counts
+	}
+	counts[class]++
+	api.lock.Unlock()
+
+	if !api.IsInjectedXID(xid) {
+		return false
+	}
+	if r := api.xids.lookup(dpid, xid); r != nil {
+		r.recordError(class)
+		log.
+			WithFields(log.Fields{
+				"dpid":   datapath.Format(dpid),
+				"replay": r.id,
+				"xid":    xid,
+				"error":  class,
+			}).
+			Debug("Recorded device error against replay")
+	}
+	return true
+}
+
+// deviceErrors returns a copy of the counts of the errors received from a
+// device, nil if there were none. The caller must hold the lock.
+func (api *API) deviceErrors(dpid uint64) map[string]uint64 {
+	if len(api.errors[dpid]) == 0 {
+		return nil
+	}
+	counts := make(map[string]uint64, len(api.errors[dpid]))
+	for class, count := range api.errors[dpid] {
+		counts[class] = count
+	}
+	return counts
+}
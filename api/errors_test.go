@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDeviceErrors(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.injectors[0x1] = &MockInjector{}
+
+	// An error for a message from the SDN controller is proxied to it
+	if api.DeviceError(0x1, 0x1234, "ErrCodeFlowModFailedTableFull") {
+		t.Error("Expected error for controller message not to be claimed")
+	}
+
+	// An error for a message injected by a replay is recorded against it
+	r := &replay{xids: &api.xids, state: ReplayStateRunning}
+	message := make([]byte, 8)
+	xid := api.xids.stamp(0x1, message, r)
+	if !api.IsInjectedXID(xid) || binary.BigEndian.Uint32(message[4:]) != xid {
+		t.Fatalf("Expected xid from the reserved range written to the message, got 0x%08x", xid)
+	}
+	if !api.DeviceError(0x1, xid, "ErrCodeBadActionOutPort") {
+		t.Error("Expected error for injected message to be claimed")
+	}
+	if status := r.Status(); status.Errors != 1 || status.LastError != "ErrCodeBadActionOutPort" {
+		t.Errorf("Expected error recorded against replay, got %+v", status)
+	}
+
+	// Once no longer tracked an error for an injected message is still
+	// not proxied, but can't be attributed
+	for i := 0; i < XIDTrackSize; i++ {
+		api.xids.stamp(0x1, make([]byte, 8), nil)
+	}
+	if !api.DeviceError(0x1, xid, "ErrCodeBadActionOutPort") || r.Status().Errors != 1 {
+		t.Error("Expected untracked injected error to be claimed but not attributed")
+	}
+
+	resp := httptest.NewRecorder()
+	api.serveMux.ServeHTTP(resp, httptest.NewRequest("GET", "http://example.com/oftee/0x1", nil))
+	var device DeviceResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &device); err != nil {
+		t.Fatal(err)
+	}
+	if len(device.Errors) != 2 || device.Errors["ErrCodeBadActionOutPort"] != 2 ||
+		device.Errors["ErrCodeFlowModFailedTableFull"] != 1 {
+		t.Errorf("Incorrect device error counts, got %+v", device.Errors)
+	}
+}
+
+func TestInjectedXIDsWrap(t *testing.T) {
+	xids := newXIDTracker()
+	xids.next[0x1] = InjectXIDRange - 1
+	if xid := xids.stamp(0x1, nil, nil); xid != 0xffffffff {
+		t.Errorf("Expected last xid of the range, got 0x%08x", xid)
+	}
+	if xid := xids.stamp(0x1, nil, nil); xid != InjectXIDBase {
+		t.Errorf("Expected xids to wrap to the start of the range, got 0x%08x", xid)
+	}
+}
+
+func TestInjectXIDRange(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	for _, invalid := range [][2]uint32{{0x1000, 1}, {0xffffff00, 0x101}} {
+		if err := api.SetInjectXIDRange(invalid[0], invalid[1]); err == nil {
+			t.Errorf("Expected range of %d xids from 0x%08x rejected", invalid[1], invalid[0])
+		}
+	}
+	if err := api.SetInjectXIDRange(0x1000, 0x100); err != nil {
+		t.Fatal(err)
+	}
+	if api.IsInjectedXID(0xfff00000) || api.IsInjectedXID(0xfff) || !api.IsInjectedXID(0x1000) || !api.IsInjectedXID(0x10ff) || api.IsInjectedXID(0x1100) {
+		t.Error("Expected only the xids of the configured range to be injected")
+	}
+
+	// Each device is allocated xids in order from the start of the range,
+	// and an error is only attributed to the device to which the message
+	// was injected
+	r := &replay{state: ReplayStateRunning}
+	for _, dpid := range []uint64{0x1, 0x2} {
+		if xid := api.xids.stamp(dpid, nil, nil); xid != 0x1000 {
+			t.Errorf("Expected first xid of the range for device 0x%x, got 0x%08x", dpid, xid)
+		}
+	}
+	xid := api.xids.stamp(0x1, nil, r)
+	if xid != 0x1001 || api.xids.lookup(0x2, xid) != nil || api.xids.lookup(0x1, xid) != r {
+		t.Errorf("Expected xid 0x1001 tracked for device 0x1 alone, got 0x%08x", xid)
+	}
+}
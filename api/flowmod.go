@@ -0,0 +1,445 @@
+package api
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/datapath"
+	"github.com/gorilla/mux"
+	"github.com/netrack/openflow"
+	log "github.com/sirupsen/logrus"
+)
+
+// Flow mod commands, the same for every OpenFlow version
+const (
+	ofFlowModAdd    = 0
+	ofFlowModDelete = 3
+)
+
+// dlAddrExact the mask of an Ethernet address matched exactly
+var dlAddrExact = [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// FlowModRequest the JSON body of a flow request, from which a flow mod is
+// built for the OpenFlow version of the device. `Match` holds match terms, as
+// those of an end point, by name, i.e. `{"dl_type": "eapol", "in_port":
+// "3"}`, and `Actions` the actions applied to the packets that match, i.e.
+// `["output:controller", "set_vlan:100"]`, none to drop them. `Table` is only
+// supported by OpenFlow 1.3.
+type FlowModRequest struct {
+	Table       uint8             `json:"table"`
+	Priority    uint16            `json:"priority"`
+	IdleTimeout uint16            `json:"idle_timeout"`
+	HardTimeout uint16            `json:"hard_timeout"`
+	Match       map[string]string `json:"match"`
+	Actions     []string          `json:"actions"`
+}
+
+// decodeFlowMod decodes a JSON flow request and builds the flow mod, with
+// the given command, for a device of the given version
+func decodeFlowMod(body io.Reader, command uint8, version uint8) ([]byte, error) {
+	var request FlowModRequest
+	if err := json.NewDecoder(body).Decode(&request); err != nil {
+		return nil, fmt.Errorf("invalid JSON flow: %s", err)
+	}
+	return buildFlowMod(&request, command, version)
+}
+
+// flowMatch parses the match terms of a flow request, rejecting those that
+// can't be expressed in a flow match of the given version, or whose
+// prerequisites aren't matched as OpenFlow requires
+func flowMatch(terms map[string]string, version uint8) (criteria.Criteria, error) {
+	var match criteria.Criteria
+	names := make([]string, 0, len(terms))
+	for name := range terms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		term, ok, err := criteria.ParseTerm(name, terms[name])
+		if err == nil && !ok {
+			err = errors.New("unknown match term")
+		}
+		if err == nil {
+			err = match.Merge(term)
+		}
+		if err != nil {
+			return match, fmt.Errorf("match %s: %s", name, err)
+		}
+	}
+
+	unsupported := uint64(criteria.BitPppoeCode | criteria.BitOFType | criteria.BitDPID)
+	if version == ofVersion10 {
+		unsupported |= criteria.BitICMPv6Type
+	}
+	switch {
+	case match.Set&unsupported != 0 || len(match.Or) > 0 || len(match.Not) > 0:
+		return match, fmt.Errorf("match terms can't be expressed by an OpenFlow 0x%02x flow", version)
+	case match.Set&criteria.BitInPort != 0 && match.InPort != match.InPortMax:
+		return match, errors.New("match in_port must be a single port, not a range")
+	case version == ofVersion10 && match.Set&criteria.BitInPort != 0 && match.InPort > 0xff00:
+		return match, fmt.Errorf("match in_port %d out of range for OpenFlow 1.0", match.InPort)
+	case version == ofVersion10 && (match.Set&criteria.BitDLSrc != 0 && match.DlSrcMask != dlAddrExact ||
+		match.Set&criteria.BitDLDst != 0 && match.DlDstMask != dlAddrExact):
+		return match, errors.New("masked Ethernet addresses can't be matched by an OpenFlow 1.0 flow")
+	case match.Set&(criteria.BitNwSrc|criteria.BitNwDst) != 0 && (match.Set&criteria.BitDLType == 0 || match.DlType != 0x0800):
+		return match, errors.New("match nw_src and nw_dst require dl_type=ipv4")
+	case match.Set&criteria.BitNwProto != 0 && (match.Set&criteria.BitDLType == 0 || match.DlType != 0x0800 && match.DlType != 0x86dd):
+		return match, errors.New("match nw_proto requires dl_type=ipv4 or dl_type=ipv6")
+	case match.Set&criteria.BitsTransport != 0 && (match.Set&criteria.BitNwProto == 0 || transportFields(match.NwProto, version) == 0):
+		return match, errors.New("match tp_src and tp_dst require nw_proto=tcp or nw_proto=udp, or nw_proto=sctp for OpenFlow 1.3")
+	case match.Set&criteria.BitICMPv6Type != 0 && (match.Set&criteria.BitNwProto == 0 || match.NwProto != 58):
+		return match, errors.New("match icmpv6_type requires nw_proto=58")
+	}
+	return match, nil
+}
+
+// transportFields returns the OXM field of the source port of the transport
+// protocol, the destination port being the next, zero if the ports of the
+// protocol can't be matched by a flow of the given version
+func transportFields(proto uint8, version uint8) uint8 {
+	switch {
+	case proto == 6:
+		return 13
+	case proto == 17:
+		return 15
+	case proto == 132 && version == ofVersion13:
+		return 17
+	}
+	return 0
+}
+
+// flowActions builds the actions of a flow request for a device of the given
+// version
+func flowActions(actions []string, version uint8) ([]byte, error) {
+	var encoded []byte
+	for _, action := range actions {
+		kind := strings.SplitN(action, ":", 2)
+		name, arg := strings.ToLower(kind[0]), ""
+		if len(kind) == 2 {
+			arg = kind[1]
+		}
+		var buf []byte
+		switch {
+		case name == "output" && arg != "":
+			port, err := versionPort(arg, version)
+			if err != nil {
+				return nil, fmt.Errorf("action '%s': %s", action, err)
+			}
+			if version == ofVersion10 {
+				buf = make([]byte, 8)
+				binary.BigEndian.PutUint16(buf[4:], uint16(port))
+				binary.BigEndian.PutUint16(buf[6:], 0xffff) // whole frame
+			} else {
+				buf = make([]byte, 16)
+				binary.BigEndian.PutUint32(buf[4:], port)
+				binary.BigEndian.PutUint16(buf[8:], 0xffff) // whole frame
+			}
+		case (name == "set_vlan" || name == "set_vlan_vid") && arg != "":
+			vlan, err := criteria.ParseDlVlan(arg)
+			if err != nil {
+				return nil, fmt.Errorf("action '%s': %s", action, err)
+			}
+			if version == ofVersion10 {
+				buf = make([]byte, 8)
+				binary.BigEndian.PutUint16(buf, 1)
+				binary.BigEndian.PutUint16(buf[4:], vlan)
+			} else {
+				// A set field of the VLAN ID, with its present bit
+				buf = make([]byte, 16)
+				binary.BigEndian.PutUint16(buf, 25)
+				copy(buf[4:], []byte{0x80, 0x00, 6 << 1, 2})
+				binary.BigEndian.PutUint16(buf[8:], vlan|0x1000)
+			}
+		case (name == "pop_vlan" || name == "strip_vlan") && arg == "":
+			buf = make([]byte, 8)
+			binary.BigEndian.PutUint16(buf, 18)
+			if version == ofVersion10 {
+				binary.BigEndian.PutUint16(buf, 3)
+			}
+		case name == "group" && arg != "" && version == ofVersion13:
+			group, err := strconv.ParseUint(arg, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("action '%s': invalid group '%s'", action, arg)
+			}
+			buf = make([]byte, 8)
+			binary.BigEndian.PutUint16(buf, 22)
+			binary.BigEndian.PutUint32(buf[4:], uint32(group))
+		default:
+			return nil, fmt.Errorf("unsupported action '%s', expected output:{port}, set_vlan:{vid}, pop_vlan or, for OpenFlow 1.3, group:{id}", action)
+		}
+		binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)))
+		encoded = append(encoded, buf...)
+	}
+	return encoded, nil
+}
+
+// match10 builds the OpenFlow 1.0 match of the given criteria, whose fields
+// are at the offsets of `match10Fields`
+func match10(match criteria.Criteria) []byte {
+	buf := make([]byte, 40)
+	wildcards := uint32(0x3fffff) // wildcard all
+	set := func(bit uint64, wildcard uint32) bool {
+		if match.Set&bit == 0 {
+			return false
+		}
+		wildcards &^= wildcard
+		return true
+	}
+	if set(criteria.BitInPort, 1<<0) {
+		binary.BigEndian.PutUint16(buf[4:], uint16(match.InPort))
+	}
+	if set(criteria.BitDLSrc, 1<<2) {
+		copy(buf[6:], match.DlSrc[:])
+	}
+	if set(criteria.BitDLDst, 1<<3) {
+		copy(buf[12:], match.DlDst[:])
+	}
+	if set(criteria.BitDLVlan, 1<<1) {
+		binary.BigEndian.PutUint16(buf[18:], match.DlVlan)
+	}
+	if set(criteria.BitDLType, 1<<4) {
+		binary.BigEndian.PutUint16(buf[22:], match.DlType)
+	}
+	if set(criteria.BitNwProto, 1<<5) {
+		buf[25] = match.NwProto
+	}
+	if match.Set&criteria.BitNwSrc != 0 {
+		ones, _ := match.NwSrc.Mask.Size()
+		wildcards = wildcards&^(0x3f<<8) | uint32(32-ones)<<8
+		copy(buf[28:], match.NwSrc.IP.To4())
+	}
+	if match.Set&criteria.BitNwDst != 0 {
+		ones, _ := match.NwDst.Mask.Size()
+		wildcards = wildcards&^(0x3f<<14) | uint32(32-ones)<<14
+		copy(buf[32:], match.NwDst.IP.To4())
+	}
+	if set(criteria.BitTpSrc, 1<<6) {
+		binary.BigEndian.PutUint16(buf[36:], match.TpSrc)
+	}
+	if set(criteria.BitTpDst, 1<<7) {
+		binary.BigEndian.PutUint16(buf[38:], match.TpDst)
+	}
+	binary.BigEndian.PutUint32(buf, wildcards)
+	return buf
+}
+
+// oxm appends an OpenFlow basic OXM field, with its mask if given, to buf
+func oxm(buf []byte, field uint8, value, mask []byte) []byte {
+	header := []byte{0x80, 0x00, field << 1, uint8(len(value))}
+	if mask != nil {
+		header[2] |= 1
+		header[3] += uint8(len(mask))
+	}
+	return append(append(append(buf, header...), value...), mask...)
+}
+
+// match13 builds the OpenFlow 1.3 OXM match of the given criteria, padded to
+// a multiple of 8 bytes, prerequisites before the fields that require them
+func match13(match criteria.Criteria) []byte {
+	fields := make([]byte, 4)
+	u16 := func(n uint16) []byte {
+		return []byte{byte(n >> 8), byte(n)}
+	}
+	if match.Set&criteria.BitInPort != 0 {
+		port := make([]byte, 4)
+		binary.BigEndian.PutUint32(port, match.InPort)
+		fields = oxm(fields, 0, port, nil)
+	}
+	for _, addr := range []struct {
+		bit         uint64
+		field       uint8
+		value, mask [6]byte
+	}{
+		{criteria.BitDLDst, 3, match.DlDst, match.DlDstMask},
+		{criteria.BitDLSrc, 4, match.DlSrc, match.DlSrcMask},
+	} {
+		if match.Set&addr.bit == 0 {
+			continue
+		}
+		var mask []byte
+		if addr.mask != dlAddrExact {
+			mask = append([]byte(nil), addr.mask[:]...)
+		}
+		fields = oxm(fields, addr.field, append([]byte(nil), addr.value[:]...), mask)
+	}
+	if match.Set&criteria.BitDLType != 0 {
+		fields = oxm(fields, 5, u16(match.DlType), nil)
+	}
+	if match.Set&criteria.BitDLVlan != 0 {
+		fields = oxm(fields, 6, u16(match.DlVlan|0x1000), nil)
+	}
+	if match.Set&criteria.BitNwProto != 0 {
+		fields = oxm(fields, 10, []byte{match.NwProto}, nil)
+	}
+	for _, prefix := range []struct {
+		bit   uint64
+		field uint8
+		value []byte
+		mask  net.IPMask
+	}{
+		{criteria.BitNwSrc, 11, match.NwSrc.IP.To4(), match.NwSrc.Mask},
+		{criteria.BitNwDst, 12, match.NwDst.IP.To4(), match.NwDst.Mask},
+	} {
+		if match.Set&prefix.bit == 0 {
+			continue
+		}
+		var mask []byte
+		if ones, _ := prefix.mask.Size(); ones != 32 {
+			mask = append([]byte(nil), prefix.mask...)
+		}
+		fields = oxm(fields, prefix.field, append([]byte(nil), prefix.value...), mask)
+	}
+	if match.Set&criteria.BitTpSrc != 0 {
+		fields = oxm(fields, transportFields(match.NwProto, ofVersion13), u16(match.TpSrc), nil)
+	}
+	if match.Set&criteria.BitTpDst != 0 {
+		fields = oxm(fields, transportFields(match.NwProto, ofVersion13)+1, u16(match.TpDst), nil)
+	}
+	if match.Set&criteria.BitICMPv6Type != 0 {
+		fields = oxm(fields, 29, []byte{match.ICMPv6Type}, nil)
+	}
+	binary.BigEndian.PutUint16(fields, 1) // OXM match
+	binary.BigEndian.PutUint16(fields[2:], uint16(len(fields)))
+	return append(fields, make([]byte, (8-len(fields)%8)%8)...)
+}
+
+// buildFlowMod builds the OpenFlow flow mod, adding or deleting the flows of
+// a request, for a device of the given version, whose transaction ID is left
+// for the caller to set. A delete removes every flow that matches, whatever
+// its actions and priority.
+func buildFlowMod(request *FlowModRequest, command uint8, version uint8) ([]byte, error) {
+	switch version {
+	case 0:
+		return nil, errors.New("the OpenFlow version of the device is not yet known")
+	case ofVersion10:
+		if request.Table != 0 {
+			return nil, errors.New("table can't be set for an OpenFlow 1.0 flow")
+		}
+	case ofVersion13:
+	default:
+		return nil, fmt.Errorf("flows can't be built for OpenFlow version 0x%02x", version)
+	}
+	match, err := flowMatch(request.Match, version)
+	if err != nil {
+		return nil, err
+	}
+	var actions []byte
+	if command == ofFlowModAdd {
+		if actions, err = flowActions(request.Actions, version); err != nil {
+			return nil, err
+		}
+	}
+
+	var message []byte
+	if version == ofVersion10 {
+		message = make([]byte, 72)
+		copy(message[8:], match10(match))
+		binary.BigEndian.PutUint16(message[56:], uint16(command))
+		binary.BigEndian.PutUint16(message[58:], request.IdleTimeout)
+		binary.BigEndian.PutUint16(message[60:], request.HardTimeout)
+		binary.BigEndian.PutUint16(message[62:], request.Priority)
+		binary.BigEndian.PutUint32(message[64:], 0xffffffff) // no buffer
+		binary.BigEndian.PutUint16(message[68:], 0xffff)     // any port
+		message = append(message, actions...)
+	} else {
+		message = make([]byte, 48)
+		message[24] = request.Table
+		message[25] = command
+		binary.BigEndian.PutUint16(message[26:], request.IdleTimeout)
+		binary.BigEndian.PutUint16(message[28:], request.HardTimeout)
+		binary.BigEndian.PutUint16(message[30:], request.Priority)
+		binary.BigEndian.PutUint32(message[32:], 0xffffffff) // no buffer
+		binary.BigEndian.PutUint32(message[36:], 0xffffffff) // any port
+		binary.BigEndian.PutUint32(message[40:], 0xffffffff) // any group
+		message = append(message, match13(match)...)
+		if len(actions) > 0 {
+			instruction := make([]byte, 8)
+			binary.BigEndian.PutUint16(instruction, 4) // apply actions
+			binary.BigEndian.PutUint16(instruction[2:], uint16(8+len(actions)))
+			message = append(append(message, instruction...), actions...)
+		}
+	}
+	if len(message) > 0xffff {
+		return nil, fmt.Errorf("flow of %d bytes too large for a flow mod", len(message))
+	}
+	message[0] = version
+	message[1] = uint8(openflow.TypeFlowMod)
+	binary.BigEndian.PutUint16(message[2:], uint16(len(message)))
+	return message, nil
+}
+
+// FlowModHandler handles an HTTP request to add, on a `POST`, or delete, on a
+// `DELETE`, the flows of a device described by a JSON `FlowModRequest`. The
+// flow mod is built for the OpenFlow version of the device and injected with
+// an xid from the reserved range, so that its replies are not proxied to the
+// SDN controller. As with the message API, `flow_mod` must be one of the
+// `MessageTypes`, and `wait=true` waits, within `timeout`, for the replies,
+// i.e. an error for a flow the device rejects. If `API_AUTH` is set the
+// request must carry it, as a packet out must. Every request is logged, with
+// the `audit` field set to `flow`.
+func (api *API) FlowModHandler(resp http.ResponseWriter, req *http.Request) {
+	defer api.close(req.Body)
+	vars := mux.Vars(req)
+	audit := log.WithFields(log.Fields{
+		"audit":  "flow",
+		"client": req.RemoteAddr,
+		"dpid":   vars["dpid"],
+		"method": req.Method,
+	})
+	if !api.authenticate(resp, req, audit, "Flow") {
+		return
+	}
+
+	// Parse the wait options before anything is injected
+	wait, timeout, err := waitOptions(req, "wait", MessageWaitTimeout)
+	if err != nil {
+		audit.
+			WithError(err).
+			Warn("Flow rejected: invalid timeout")
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dpid, inject, err := api.injector(vars["dpid"])
+	if err != nil {
+		audit.
+			WithError(err).
+			Warn("Flow rejected: Unable to find packet injector for DPID, unknown device")
+		http.Error(resp, err.Error(), http.StatusNotFound)
+		return
+	}
+	audit = audit.WithField("dpid", datapath.Format(dpid))
+	if !inject.Healthy() {
+		audit.Warn("Flow rejected: device is not connected")
+		http.Error(resp, fmt.Sprintf("DPID not connected, '%s'", vars["dpid"]), http.StatusNotFound)
+		return
+	}
+	if !api.MessageTypes[openflow.TypeFlowMod] {
+		audit.Warn("Flow rejected: message type not allowed")
+		http.Error(resp, fmt.Sprintf("message type '%s' not allowed", openflow.TypeFlowMod), http.StatusForbidden)
+		return
+	}
+
+	command := uint8(ofFlowModAdd)
+	if req.Method == http.MethodDelete {
+		command = ofFlowModDelete
+	}
+	data, err := decodeFlowMod(req.Body, command, api.version(dpid))
+	if err != nil {
+		audit.
+			WithError(err).
+			Warn("Flow rejected: invalid flow")
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	api.injectMessage(resp, req, audit.WithField("length", len(data)), dpid, inject, data, wait, timeout)
+}
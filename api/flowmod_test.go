@@ -0,0 +1,154 @@
+package api
+
+import (
+	"encoding/binary"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/netrack/openflow"
+)
+
+func TestBuildFlowMod13(t *testing.T) {
+	message, err := buildFlowMod(&FlowModRequest{
+		Table:       1,
+		Priority:    100,
+		IdleTimeout: 30,
+		Match:       map[string]string{"in_port": "3", "dl_type": "eapol", "dl_src": "00:11:22:00:00:00/ff:ff:ff:00:00:00"},
+		Actions:     []string{"set_vlan:100", "output:controller"},
+	}, ofFlowModAdd, ofVersion13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message[0] != ofVersion13 || openflow.Type(message[1]) != openflow.TypeFlowMod || int(binary.BigEndian.Uint16(message[2:])) != len(message) {
+		t.Fatalf("Expected an OpenFlow 1.3 flow mod, got %02x", message)
+	}
+	if message[24] != 1 || message[25] != ofFlowModAdd || binary.BigEndian.Uint16(message[26:]) != 30 || binary.BigEndian.Uint16(message[30:]) != 100 {
+		t.Errorf("Incorrect table, command, timeouts or priority, got %02x", message[:48])
+	}
+
+	// The match and actions are those of a flow in a flow table snapshot
+	matchLen := int(binary.BigEndian.Uint16(message[50:]))
+	if match := strings.Join(decodeOXM(message[52:48+matchLen]), ";"); match != "in_port=3;dl_src=00:11:22:00:00:00/ff:ff:ff:00:00:00;dl_type=0x888e" {
+		t.Errorf("Incorrect match, got %s", match)
+	}
+	expected := []string{"apply_actions(set_field:dl_vlan=100,output:controller)"}
+	if instructions := decodeInstructions(message[48+(matchLen+7)/8*8:]); !reflect.DeepEqual(instructions, expected) {
+		t.Errorf("Expected instructions %v, got %v", expected, instructions)
+	}
+
+	// A delete has the same match, but no instructions
+	deletion, err := buildFlowMod(&FlowModRequest{Match: map[string]string{"in_port": "3"}, Actions: []string{"output:1"}}, ofFlowModDelete, ofVersion13)
+	if err != nil || deletion[25] != ofFlowModDelete || len(deletion) != 48+16 {
+		t.Errorf("Expected a delete of the match alone, got %02x (%v)", deletion, err)
+	}
+}
+
+func TestBuildFlowMod10(t *testing.T) {
+	message, err := buildFlowMod(&FlowModRequest{
+		Priority: 10,
+		Match:    map[string]string{"dl_type": "ipv4", "nw_src": "10.0.0.0/8", "nw_proto": "udp", "tp_dst": "67"},
+		Actions:  []string{"strip_vlan", "output:1"},
+	}, ofFlowModAdd, ofVersion10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message[0] != ofVersion10 || openflow.Type(message[1]) != openflow.TypeFlowMod || int(binary.BigEndian.Uint16(message[2:])) != len(message) {
+		t.Fatalf("Expected an OpenFlow 1.0 flow mod, got %02x", message)
+	}
+	if match := decodeMatch10(message[8:48]); match != "dl_type=0x0800;nw_proto=17;tp_dst=67;nw_src=10.0.0.0/8" {
+		t.Errorf("Incorrect match, got %s", match)
+	}
+	if actions := decodeActions(message[72:], ofVersion10); !reflect.DeepEqual(actions, []string{"strip_vlan", "output:1"}) {
+		t.Errorf("Incorrect actions, got %v", actions)
+	}
+	if binary.BigEndian.Uint16(message[62:]) != 10 || binary.BigEndian.Uint32(message[64:]) != 0xffffffff {
+		t.Errorf("Incorrect priority or buffer, got %02x", message[56:72])
+	}
+}
+
+func TestBuildFlowModInvalid(t *testing.T) {
+	for reason, test := range map[string]struct {
+		request FlowModRequest
+		version uint8
+	}{
+		"not yet known":            {FlowModRequest{}, 0},
+		"table can't be set":       {FlowModRequest{Table: 1}, ofVersion10},
+		"unknown match term":       {FlowModRequest{Match: map[string]string{"colour": "red"}}, ofVersion13},
+		"can't be expressed":       {FlowModRequest{Match: map[string]string{"pppoe_code": "padi"}}, ofVersion13},
+		"expressed by an OpenFlow": {FlowModRequest{Match: map[string]string{"dl_type!": "lldp"}}, ofVersion13},
+		"not a range":              {FlowModRequest{Match: map[string]string{"in_port": "1-8"}}, ofVersion13},
+		"masked Ethernet":          {FlowModRequest{Match: map[string]string{"dl_dst": "01:00:00:00:00:00/01:00:00:00:00:00"}}, ofVersion10},
+		"require dl_type=ipv4":     {FlowModRequest{Match: map[string]string{"nw_dst": "10.0.0.1"}}, ofVersion13},
+		"require nw_proto=tcp":     {FlowModRequest{Match: map[string]string{"dl_type": "ipv4", "tp_dst": "80"}}, ofVersion13},
+		"unsupported action":       {FlowModRequest{Actions: []string{"flood"}}, ofVersion13},
+		"unsupported action 'gr":   {FlowModRequest{Actions: []string{"group:1"}}, ofVersion10},
+		"action 'output:0'":        {FlowModRequest{Actions: []string{"output:0"}}, ofVersion13},
+		"flows can't be built for": {FlowModRequest{}, 0x05},
+	} {
+		if _, err := buildFlowMod(&test.request, ofFlowModAdd, test.version); err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("Expected %+v rejected with '%s', got %v", test.request, reason, err)
+		}
+	}
+}
+
+func TestFlowModHandler(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	mock := &MockInjector{DPID: 0x1}
+	api.injectors[0x1] = mock
+	api.versions[0x1] = ofVersion13
+	flow := func(method, dpid, body string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		api.serveMux.ServeHTTP(resp, httptest.NewRequest(method, "http://example.com/oftee/"+dpid+"/flow", strings.NewReader(body)))
+		return resp
+	}
+	body := `{"priority": 100, "match": {"dl_type": "eapol"}, "actions": ["output:controller"]}`
+
+	// Flow mods are injected only if allowed by the message API types
+	if resp := flow("POST", "0x1", body); resp.Code != 403 {
+		t.Errorf("Expected flow mods not allowed, got %d %s", resp.Code, resp.Body)
+	}
+	api.MessageTypes = map[openflow.Type]bool{openflow.TypeFlowMod: true}
+	for _, method := range []string{"POST", "DELETE"} {
+		if resp := flow(method, "0x1", body); resp.Code != 202 || !strings.Contains(resp.Body.String(), `"xid"`) {
+			t.Errorf("Expected %s flow injected, got %d %s", method, resp.Code, resp.Body)
+		}
+	}
+	if len(mock.Messages) != 2 || mock.Messages[0][25] != ofFlowModAdd || mock.Messages[1][25] != ofFlowModDelete {
+		t.Fatalf("Expected a flow added and deleted, got %02x", mock.Messages)
+	}
+	if xid := binary.BigEndian.Uint32(mock.Messages[0][4:]); !api.IsInjectedXID(xid) {
+		t.Errorf("Expected an injected transaction ID, got 0x%08x", xid)
+	}
+
+	// Invalid flows and unknown devices are rejected, and nothing injected
+	for _, test := range []struct {
+		dpid, body string
+		code       int
+	}{
+		{"0x1", `{"match": {"in_port": "1-8"}}`, 400},
+		{"0x1", `{"actions": "output:1"}`, 400},
+		{"0x2", body, 404},
+	} {
+		if resp := flow("POST", test.dpid, test.body); resp.Code != test.code {
+			t.Errorf("Expected %s rejected with %d, got %d %s", test.body, test.code, resp.Code, resp.Body)
+		}
+	}
+	if len(mock.Messages) != 2 {
+		t.Errorf("Expected no invalid flow injected, got %d", len(mock.Messages))
+	}
+
+	// With API_AUTH set a flow must carry the token
+	api.Auth = "secret"
+	if resp := flow("POST", "0x1", body); resp.Code != 401 || resp.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("Expected flow without the token rejected, got %d %s", resp.Code, resp.Body)
+	}
+	req := httptest.NewRequest("POST", "http://example.com/oftee/0x1/flow", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp := httptest.NewRecorder()
+	api.serveMux.ServeHTTP(resp, req)
+	if resp.Code != 202 || len(mock.Messages) != 3 {
+		t.Errorf("Expected flow injected with the token, got %d %s", resp.Code, resp.Body)
+	}
+}
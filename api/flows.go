@@ -0,0 +1,645 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ciena/oftee/datapath"
+	"github.com/gorilla/mux"
+	"github.com/netrack/openflow"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// FlowsMaxBytes the size of the flow stats replies, from a device,
+	// beyond which the flows of a flow table snapshot are truncated
+	FlowsMaxBytes = 16 << 20
+
+	// DefaultFlowsLimit the default number of flows returned by
+	// `/oftee/{dpid}/flows`
+	DefaultFlowsLimit = 1000
+)
+
+// FlowEntry a flow in the flow tables of a device. `Match` is rendered as ';'
+// separated terms, as the match terms of an end point, and `Instructions`
+// summarizes the instructions, or for OpenFlow 1.0 the actions, of the flow.
+type FlowEntry struct {
+	Table        uint8    `json:"table"`
+	Priority     uint16   `json:"priority"`
+	Cookie       string   `json:"cookie"`
+	Match        string   `json:"match"`
+	Instructions []string `json:"instructions"`
+	IdleTimeout  uint16   `json:"idle_timeout"`
+	HardTimeout  uint16   `json:"hard_timeout"`
+	DurationSec  uint32   `json:"duration_sec"`
+	PacketCount  uint64   `json:"packet_count"`
+	ByteCount    uint64   `json:"byte_count"`
+}
+
+// FlowsResponse is used to create a HTTP response with the flows of a device,
+// those from `Offset` of the `Total` received. `Complete` is false if the
+// device did not send all the flows before the wait timed out and
+// `Truncated` is true if it sent more than `FlowsMaxBytes` of them.
+type FlowsResponse struct {
+	DPID      string      `json:"dpid"`
+	Version   uint8       `json:"version"`
+	Complete  bool        `json:"complete"`
+	Truncated bool        `json:"truncated,omitempty"`
+	Total     int         `json:"total"`
+	Offset    int         `json:"offset"`
+	Flows     []FlowEntry `json:"flows"`
+}
+
+// The OpenFlow 1.3 version, the OpenFlow 1.0 stats request type, and the flow
+// stats type of the multipart, or stats, messages of every version
+const (
+	ofVersion13 = 0x04
+
+	ofTypeStatsRequest10 openflow.Type = 16
+	ofStatsFlow                        = 1
+)
+
+// flowStatsRequest builds a request for the flows of every table of a device
+// of the given version, without restricting their match or output
+func flowStatsRequest(version uint8) ([]byte, error) {
+	request := make([]byte, 56)
+	request[0] = version
+	binary.BigEndian.PutUint16(request[2:4], uint16(len(request)))
+	switch version {
+	case ofVersion10:
+		request[1] = uint8(ofTypeStatsRequest10)
+		binary.BigEndian.PutUint16(request[8:], ofStatsFlow)
+		binary.BigEndian.PutUint32(request[12:], 0x3fffff) // wildcard all
+		request[52] = 0xff                                 // all tables
+		binary.BigEndian.PutUint16(request[54:], 0xffff)   // any port
+	case ofVersion13:
+		request[1] = uint8(openflow.TypeMultipartRequest)
+		binary.BigEndian.PutUint16(request[8:], ofStatsFlow)
+		request[16] = 0xff                                   // all tables
+		binary.BigEndian.PutUint32(request[20:], 0xffffffff) // any port
+		binary.BigEndian.PutUint32(request[24:], 0xffffffff) // any group
+		binary.BigEndian.PutUint16(request[48:], 1)          // OXM match
+		binary.BigEndian.PutUint16(request[50:], 4)          // no fields
+	default:
+		return nil, fmt.Errorf("flow stats of OpenFlow version 0x%02x not supported", version)
+	}
+	return request, nil
+}
+
+// decodeFlows decodes the flows of a flow stats reply
+func decodeFlows(message []byte) ([]FlowEntry, error) {
+	if len(message) < 8 || int(binary.BigEndian.Uint16(message[2:4])) != len(message) {
+		return nil, errors.New("invalid message length")
+	}
+	var flows []FlowEntry
+	switch {
+	case message[0] == ofVersion10 && openflow.Type(message[1]) == ofTypeStatsReply10:
+		if len(message) < 12 || binary.BigEndian.Uint16(message[8:]) != ofStatsFlow {
+			return nil, errors.New("not a flow stats reply")
+		}
+		for body := message[12:]; len(body) > 0; {
+			length := flowStatsLen(body, 88)
+			if length == 0 {
+				return nil, errors.New("invalid flow stats length")
+			}
+			flows = append(flows, decodeFlow10(body[:length]))
+			body = body[length:]
+		}
+	case message[0] == ofVersion13 && openflow.Type(message[1]) == openflow.TypeMultipartReply:
+		if len(message) < 16 || binary.BigEndian.Uint16(message[8:]) != ofStatsFlow {
+			return nil, errors.New("not a flow stats reply")
+		}
+		for body := message[16:]; len(body) > 0; {
+			length := flowStatsLen(body, 56)
+			if length == 0 {
+				return nil, errors.New("invalid flow stats length")
+			}
+			flow, err := decodeFlow13(body[:length])
+			if err != nil {
+				return nil, err
+			}
+			flows = append(flows, flow)
+			body = body[length:]
+		}
+	default:
+		return nil, fmt.Errorf("unexpected %s reply", openflow.Type(message[1]))
+	}
+	return flows, nil
+}
+
+// flowStatsLen returns the length of the flow stats at the start of body,
+// zero if it is invalid
+func flowStatsLen(body []byte, min int) int {
+	if len(body) < 2 {
+		return 0
+	}
+	length := int(binary.BigEndian.Uint16(body))
+	if length < min || length > len(body) {
+		return 0
+	}
+	return length
+}
+
+// decodeFlow10 decodes OpenFlow 1.0 flow stats
+func decodeFlow10(stats []byte) FlowEntry {
+	return FlowEntry{
+		Table:        stats[2],
+		Match:        decodeMatch10(stats[4:44]),
+		DurationSec:  binary.BigEndian.Uint32(stats[44:]),
+		Priority:     binary.BigEndian.Uint16(stats[52:]),
+		IdleTimeout:  binary.BigEndian.Uint16(stats[54:]),
+		HardTimeout:  binary.BigEndian.Uint16(stats[56:]),
+		Cookie:       fmt.Sprintf("0x%016x", binary.BigEndian.Uint64(stats[64:])),
+		PacketCount:  binary.BigEndian.Uint64(stats[72:]),
+		ByteCount:    binary.BigEndian.Uint64(stats[80:]),
+		Instructions: []string{"apply_actions(" + strings.Join(decodeActions(stats[88:], ofVersion10), ",") + ")"},
+	}
+}
+
+// decodeFlow13 decodes OpenFlow 1.3 flow stats
+func decodeFlow13(stats []byte) (FlowEntry, error) {
+	flow := FlowEntry{
+		Table:       stats[2],
+		DurationSec: binary.BigEndian.Uint32(stats[4:]),
+		Priority:    binary.BigEndian.Uint16(stats[12:]),
+		IdleTimeout: binary.BigEndian.Uint16(stats[14:]),
+		HardTimeout: binary.BigEndian.Uint16(stats[16:]),
+		Cookie:      fmt.Sprintf("0x%016x", binary.BigEndian.Uint64(stats[24:])),
+		PacketCount: binary.BigEndian.Uint64(stats[32:]),
+		ByteCount:   binary.BigEndian.Uint64(stats[40:]),
+	}
+	matchLen := int(binary.BigEndian.Uint16(stats[50:]))
+	padded := (matchLen + 7) / 8 * 8
+	if matchLen < 4 || 48+padded > len(stats) {
+		return flow, errors.New("invalid flow match length")
+	}
+	flow.Match = strings.Join(decodeOXM(stats[52:48+matchLen]), ";")
+	flow.Instructions = decodeInstructions(stats[48+padded:])
+	return flow, nil
+}
+
+// match10Fields the fields of an OpenFlow 1.0 match, by their wildcard bit,
+// offset and length
+var match10Fields = []struct {
+	name     string
+	wildcard uint32
+	offset   int
+	length   int
+}{
+	{"in_port", 1 << 0, 4, 2},
+	{"dl_src", 1 << 2, 6, 6},
+	{"dl_dst", 1 << 3, 12, 6},
+	{"dl_vlan", 1 << 1, 18, 2},
+	{"dl_vlan_pcp", 1 << 20, 20, 1},
+	{"dl_type", 1 << 4, 22, 2},
+	{"nw_tos", 1 << 21, 24, 1},
+	{"nw_proto", 1 << 5, 25, 1},
+	{"tp_src", 1 << 6, 36, 2},
+	{"tp_dst", 1 << 7, 38, 2},
+}
+
+// decodeMatch10 renders an OpenFlow 1.0 match
+func decodeMatch10(match []byte) string {
+	wildcards := binary.BigEndian.Uint32(match)
+	var terms []string
+	for _, field := range match10Fields {
+		if wildcards&field.wildcard == 0 {
+			terms = append(terms, field.name+"="+formatField(field.name, match[field.offset:field.offset+field.length]))
+		}
+	}
+	for i, name := range []string{"nw_src", "nw_dst"} {
+		// The number of wildcarded low order bits of the address
+		bits := int(wildcards>>uint(8+6*i)) & 0x3f
+		if bits >= 32 {
+			continue
+		}
+		term := name + "=" + net.IP(match[28+4*i:32+4*i]).String()
+		if bits > 0 {
+			term += fmt.Sprintf("/%d", 32-bits)
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, ";")
+}
+
+// oxmFields the names of the OpenFlow basic OXM fields, by field number
+var oxmFields = map[uint8]string{
+	0:  "in_port",
+	1:  "in_phy_port",
+	2:  "metadata",
+	3:  "dl_dst",
+	4:  "dl_src",
+	5:  "dl_type",
+	6:  "dl_vlan",
+	7:  "dl_vlan_pcp",
+	8:  "ip_dscp",
+	9:  "ip_ecn",
+	10: "nw_proto",
+	11: "nw_src",
+	12: "nw_dst",
+	13: "tcp_src",
+	14: "tcp_dst",
+	15: "udp_src",
+	16: "udp_dst",
+	17: "sctp_src",
+	18: "sctp_dst",
+	19: "icmp_type",
+	20: "icmp_code",
+	21: "arp_op",
+	22: "arp_spa",
+	23: "arp_tpa",
+	24: "arp_sha",
+	25: "arp_tha",
+	26: "ipv6_src",
+	27: "ipv6_dst",
+	28: "ipv6_label",
+	29: "icmpv6_type",
+	30: "icmpv6_code",
+	31: "nd_target",
+	32: "nd_sll",
+	33: "nd_tll",
+	34: "mpls_label",
+	35: "mpls_tc",
+	36: "mpls_bos",
+	37: "pbb_isid",
+	38: "tunnel_id",
+	39: "ipv6_exthdr",
+}
+
+// decodeOXM renders the OXM fields of an OpenFlow 1.3 match as terms, those
+// with a mask as `name=value/mask`
+func decodeOXM(fields []byte) []string {
+	var terms []string
+	for len(fields) >= 4 {
+		class := binary.BigEndian.Uint16(fields)
+		field := fields[2] >> 1
+		hasMask := fields[2]&1 == 1
+		length := int(fields[3])
+		if 4+length > len(fields) {
+			terms = append(terms, fmt.Sprintf("truncated=%x", fields))
+			break
+		}
+		value := fields[4 : 4+length]
+		var mask []byte
+		if hasMask {
+			mask = value[length/2:]
+			value = value[:length/2]
+		}
+		name, ok := oxmFields[field]
+		if class != 0x8000 || !ok {
+			name = fmt.Sprintf("oxm_0x%04x_%d", class, field)
+		}
+		term := name + "=" + formatField(name, value)
+		if mask != nil {
+			term += "/" + formatField(name, mask)
+		}
+		terms = append(terms, term)
+		fields = fields[4+length:]
+	}
+	return terms
+}
+
+// formatField renders the value of a match field, addresses as addresses,
+// the ethernet type in hex and numbers in decimal
+func formatField(name string, value []byte) string {
+	switch {
+	case len(value) == 6 && (strings.HasPrefix(name, "dl_") || strings.HasPrefix(name, "arp_") || strings.HasPrefix(name, "nd_")):
+		return net.HardwareAddr(value).String()
+	case len(value) == 4 && (strings.HasPrefix(name, "nw_") || strings.HasPrefix(name, "arp_")):
+		return net.IP(value).String()
+	case len(value) == 16:
+		return net.IP(value).String()
+	case name == "dl_type" && len(value) == 2:
+		return fmt.Sprintf("0x%04x", binary.BigEndian.Uint16(value))
+	case name == "dl_vlan" && len(value) == 2:
+		// OpenFlow 1.3 sets the present bit of a tagged VLAN
+		return strconv.Itoa(int(binary.BigEndian.Uint16(value) & 0x0fff))
+	case len(value) <= 8:
+		var n uint64
+		for _, b := range value {
+			n = n<<8 | uint64(b)
+		}
+		return strconv.FormatUint(n, 10)
+	}
+	return fmt.Sprintf("0x%x", value)
+}
+
+// decodeInstructions summarizes OpenFlow 1.3 instructions
+func decodeInstructions(instructions []byte) []string {
+	summary := []string{}
+	for len(instructions) >= 4 {
+		kind := binary.BigEndian.Uint16(instructions)
+		length := int(binary.BigEndian.Uint16(instructions[2:]))
+		if length < 4 || length > len(instructions) {
+			summary = append(summary, "truncated")
+			break
+		}
+		body := instructions[4:length]
+		switch {
+		case kind == 1 && len(body) >= 1:
+			summary = append(summary, fmt.Sprintf("goto_table:%d", body[0]))
+		case kind == 2 && len(body) >= 20:
+			summary = append(summary, fmt.Sprintf("write_metadata:0x%x/0x%x",
+				binary.BigEndian.Uint64(body[4:]), binary.BigEndian.Uint64(body[12:])))
+		case kind == 3 && len(body) >= 4:
+			summary = append(summary, "write_actions("+strings.Join(decodeActions(body[4:], ofVersion13), ",")+")")
+		case kind == 4 && len(body) >= 4:
+			summary = append(summary, "apply_actions("+strings.Join(decodeActions(body[4:], ofVersion13), ",")+")")
+		case kind == 5:
+			summary = append(summary, "clear_actions")
+		case kind == 6 && len(body) >= 4:
+			summary = append(summary, fmt.Sprintf("meter:%d", binary.BigEndian.Uint32(body)))
+		default:
+			summary = append(summary, fmt.Sprintf("instruction:%d", kind))
+		}
+		instructions = instructions[length:]
+	}
+	return summary
+}
+
+// actionNames the names of the actions, without arguments or whose
+// arguments are not summarized, by version and type
+var actionNames = map[uint8]map[uint16]string{
+	ofVersion10: {
+		1: "set_vlan_vid", 2: "set_vlan_pcp", 3: "strip_vlan", 4: "set_dl_src",
+		5: "set_dl_dst", 6: "set_nw_src", 7: "set_nw_dst", 8: "set_nw_tos",
+		9: "set_tp_src", 10: "set_tp_dst", 11: "enqueue",
+	},
+	ofVersion13: {
+		11: "copy_ttl_out", 12: "copy_ttl_in", 15: "set_mpls_ttl", 16: "dec_mpls_ttl",
+		17: "push_vlan", 18: "pop_vlan", 19: "push_mpls", 20: "pop_mpls",
+		21: "set_queue", 23: "set_nw_ttl", 24: "dec_nw_ttl", 26: "push_pbb",
+		27: "pop_pbb", 0xffff: "experimenter",
+	},
+}
+
+// decodeActions summarizes the actions of the given version, outputs with
+// their port, groups with their id and set fields with the field set
+func decodeActions(actions []byte, version uint8) []string {
+	var summary []string
+	for len(actions) >= 4 {
+		kind := binary.BigEndian.Uint16(actions)
+		length := int(binary.BigEndian.Uint16(actions[2:]))
+		if length < 4 || length > len(actions) {
+			summary = append(summary, "truncated")
+			break
+		}
+		body := actions[4:length]
+		switch {
+		case kind == 0 && version == ofVersion10 && len(body) >= 2:
+			summary = append(summary, "output:"+formatPort(uint32(binary.BigEndian.Uint16(body)), version))
+		case kind == 0 && len(body) >= 4:
+			summary = append(summary, "output:"+formatPort(binary.BigEndian.Uint32(body), version))
+		case kind == 22 && version == ofVersion13 && len(body) >= 4:
+			summary = append(summary, fmt.Sprintf("group:%d", binary.BigEndian.Uint32(body)))
+		case kind == 25 && version == ofVersion13:
+			// A set field is padded to a multiple of 8 bytes after its
+			// one field
+			if len(body) >= 4 && 4+int(body[3]) <= len(body) {
+				body = body[:4+int(body[3])]
+			}
+			summary = append(summary, "set_field:"+strings.Join(decodeOXM(body), ";"))
+		default:
+			name, ok := actionNames[version][kind]
+			if !ok {
+				name = fmt.Sprintf("action:%d", kind)
+			}
+			summary = append(summary, name)
+		}
+		actions = actions[length:]
+	}
+	return summary
+}
+
+// formatPort renders a port number, the reserved ports by name
+func formatPort(port uint32, version uint8) string {
+	if version == ofVersion10 && port >= 0xfff8 {
+		port |= 0xffff0000
+	}
+	switch port {
+	case 0xfffffff8:
+		return "in_port"
+	case 0xfffffff9:
+		return "table"
+	case 0xfffffffa:
+		return "normal"
+	case 0xfffffffb:
+		return "flood"
+	case 0xfffffffc:
+		return "all"
+	case 0xfffffffd:
+		return "controller"
+	case 0xfffffffe:
+		return "local"
+	case 0xffffffff:
+		return "any"
+	}
+	return strconv.FormatUint(uint64(port), 10)
+}
+
+// bearerToken returns the token of an `Authorization: Bearer <token>` value
+func bearerToken(authorization string) string {
+	return strings.TrimPrefix(authorization, "Bearer ")
+}
+
+// validToken returns true if a token is the one required by the sensitive
+// endpoints, compared in constant time
+func (api *API) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(api.Auth)) == 1
+}
+
+// authorized returns true if a request carries the bearer token required by
+// the sensitive endpoints
+func (api *API) authorized(req *http.Request) bool {
+	return api.validToken(bearerToken(req.Header.Get("Authorization")))
+}
+
+// authorize checks that a request to a sensitive endpoint carries the
+// `API_AUTH` token, returning false, having answered `403 Forbidden` if no
+// token is configured or `401 Unauthorized` if the request doesn't carry it,
+// if it doesn't. The rejection is logged to the audit trail as that of the
+// action, i.e. `Disconnect`.
+func (api *API) authorize(resp http.ResponseWriter, req *http.Request, audit *log.Entry, action string) bool {
+	if api.Auth == "" {
+		audit.Warnf("%s rejected: API disabled", action)
+		http.Error(resp, "API disabled, no API authorization configured", http.StatusForbidden)
+		return false
+	}
+	if !api.authorized(req) {
+		audit.Warnf("%s rejected: not authorized", action)
+		resp.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(resp, "not authorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// authenticate checks that a request to inject a message carries the
+// `API_AUTH` token if one is configured, as a packet out must, returning
+// false, having answered `401 Unauthorized`, if it doesn't. The rejection is
+// logged to the audit trail as that of the action, i.e. `Message`.
+func (api *API) authenticate(resp http.ResponseWriter, req *http.Request, audit *log.Entry, action string) bool {
+	if api.Auth != "" && !api.authorized(req) {
+		audit.Warnf("%s rejected: not authorized", action)
+		resp.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(resp, "not authorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// FlowsHandler handles an HTTP request for a snapshot of the flow tables of a
+// device. A flow stats request, for every table, is injected to the device
+// with an xid from the reserved range, so that its replies are not proxied to
+// the SDN controller, followed by a barrier request and the flows received
+// before the reply to the barrier are returned.
+//
+// Flow tables are sensitive, so the request must carry the `API_AUTH` token,
+// as `Authorization: Bearer <token>`, and the endpoint is disabled without
+// one. The flows are paged with the `offset` and `limit`, which defaults to
+// `DefaultFlowsLimit`, query parameters and the wait is limited by `timeout`,
+// which defaults to `MessageWaitTimeout`. Every request is logged, with the
+// `audit` field set to `flows`.
+func (api *API) FlowsHandler(resp http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	audit := log.WithFields(log.Fields{
+		"audit":  "flows",
+		"client": req.RemoteAddr,
+		"dpid":   vars["dpid"],
+	})
+	if api.Auth == "" {
+		audit.Warn("Flows rejected: flow table API disabled")
+		http.Error(resp, "flow table API disabled, no API authorization configured", http.StatusForbidden)
+		return
+	}
+	if !api.authorized(req) {
+		audit.Warn("Flows rejected: not authorized")
+		resp.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(resp, "not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Parse the options before anything is injected
+	query := req.URL.Query()
+	timeout := MessageWaitTimeout
+	if value := query.Get("timeout"); value != "" {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			audit.
+				WithFields(log.Fields{
+					"timeout": value,
+				}).
+				Warn("Flows rejected: invalid timeout")
+			http.Error(resp, fmt.Sprintf("invalid timeout '%s', expected a positive duration", value), http.StatusBadRequest)
+			return
+		}
+	}
+	offset, limit := 0, DefaultFlowsLimit
+	for name, value := range map[string]*int{"offset": &offset, "limit": &limit} {
+		if query.Get(name) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(query.Get(name))
+		if err != nil || n < 0 || name == "limit" && n == 0 {
+			audit.
+				WithFields(log.Fields{
+					name: query.Get(name),
+				}).
+				Warnf("Flows rejected: invalid %s", name)
+			http.Error(resp, fmt.Sprintf("invalid %s '%s'", name, query.Get(name)), http.StatusBadRequest)
+			return
+		}
+		*value = n
+	}
+
+	dpid, inject, err := api.injector(vars["dpid"])
+	if err != nil {
+		audit.
+			WithError(err).
+			Warn("Flows rejected: Unable to find packet injector for DPID, unknown device")
+		http.Error(resp, err.Error(), http.StatusNotFound)
+		return
+	}
+	audit = audit.WithField("dpid", datapath.Format(dpid))
+	if !inject.Healthy() {
+		audit.Warn("Flows rejected: device is not connected")
+		http.Error(resp, fmt.Sprintf("DPID not connected, '%s'", vars["dpid"]), http.StatusNotFound)
+		return
+	}
+	version := api.version(dpid)
+	request, err := flowStatsRequest(version)
+	if err != nil {
+		audit.
+			WithError(err).
+			Warn("Flows rejected: unsupported OpenFlow version")
+		http.Error(resp, err.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	w := &replyWaiter{maxBytes: FlowsMaxBytes, done: make(chan struct{})}
+	api.inject(req.Context(), dpid, inject, request, w)
+	audit = audit.WithFields(log.Fields{
+		"xid": w.message,
+	})
+	audit.Debug("Flow stats requested, waiting for replies")
+
+	result := FlowsResponse{
+		DPID:     datapath.Format(dpid),
+		Version:  version,
+		Complete: w.wait(timeout),
+		Offset:   offset,
+		Flows:    []FlowEntry{},
+	}
+	replies := w.result()
+	w.lock.Lock()
+	result.Truncated = w.truncated
+	w.lock.Unlock()
+	var flows []FlowEntry
+	for _, reply := range replies {
+		if reply.Error != "" || openflow.Type(reply.Data[1]) == openflow.TypeError {
+			audit.
+				WithFields(log.Fields{
+					"error": reply.Error,
+				}).
+				Warn("Flows failed: device replied with an error")
+			http.Error(resp, fmt.Sprintf("device replied with error '%s'", reply.Error), http.StatusBadGateway)
+			return
+		}
+		decoded, err := decodeFlows(reply.Data)
+		if err != nil {
+			audit.
+				WithError(err).
+				Warn("Flows failed: invalid flow stats reply")
+			http.Error(resp, fmt.Sprintf("invalid flow stats reply: %s", err), http.StatusBadGateway)
+			return
+		}
+		flows = append(flows, decoded...)
+	}
+	result.Total = len(flows)
+	if offset < len(flows) {
+		flows = flows[offset:]
+		if len(flows) > limit {
+			flows = flows[:limit]
+		}
+		result.Flows = flows
+	}
+	audit.
+		WithFields(log.Fields{
+			"complete":  result.Complete,
+			"truncated": result.Truncated,
+			"flows":     result.Total,
+		}).
+		Info("Flows returned")
+	code := http.StatusOK
+	if !result.Complete {
+		code = http.StatusGatewayTimeout
+	}
+	writeJSON(resp, code, result)
+}
@@ -0,0 +1,207 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/netrack/openflow"
+)
+
+// flowStats13 builds OpenFlow 1.3 flow stats, matching an in port and EAPOL,
+// that output to the controller
+func flowStats13(priority uint16) []byte {
+	stats := make([]byte, 48)
+	stats[2] = 1
+	binary.BigEndian.PutUint32(stats[4:], 60)
+	binary.BigEndian.PutUint16(stats[12:], priority)
+	binary.BigEndian.PutUint64(stats[24:], 0xabc)
+	binary.BigEndian.PutUint64(stats[32:], 12)
+	binary.BigEndian.PutUint64(stats[40:], 768)
+	match := []byte{
+		0x00, 0x01, 0x00, 0x1e, // OXM match
+		0x80, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x03, // in_port=3
+		0x80, 0x00, 0x0a, 0x02, 0x88, 0x8e, // dl_type=0x888e
+		0x80, 0x00, 0x19, 0x08, 10, 0, 0, 0, 255, 0, 0, 0, // nw_dst masked
+		0x00, 0x00, // padding
+	}
+	instructions := []byte{
+		0x00, 0x04, 0x00, 0x18, 0x00, 0x00, 0x00, 0x00, // apply actions
+		0x00, 0x00, 0x00, 0x10, 0xff, 0xff, 0xff, 0xfd, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // output
+		0x00, 0x01, 0x00, 0x08, 0x02, 0x00, 0x00, 0x00, // goto table
+	}
+	stats = append(append(stats, match...), instructions...)
+	binary.BigEndian.PutUint16(stats, uint16(len(stats)))
+	return stats
+}
+
+// flowStats10 builds OpenFlow 1.0 flow stats, matching ARP from a subnet,
+// that flood
+func flowStats10() []byte {
+	stats := make([]byte, 88)
+	stats[2] = 0
+	binary.BigEndian.PutUint32(stats[4:], 0x3fffff&^(1<<4)&^(0x3f<<8)|8<<8)
+	binary.BigEndian.PutUint16(stats[26:], 0x0806)
+	copy(stats[32:], []byte{192, 168, 1, 0})
+	binary.BigEndian.PutUint16(stats[52:], 100)
+	binary.BigEndian.PutUint64(stats[80:], 64)
+	stats = append(stats, 0x00, 0x00, 0x00, 0x08, 0xff, 0xfb, 0x00, 0x00)
+	binary.BigEndian.PutUint16(stats, uint16(len(stats)))
+	return stats
+}
+
+// flowsInjector a device that replies to a flow stats request with the given
+// replies, and to the barrier request that follows it
+type flowsInjector struct {
+	MockInjector
+	api     *API
+	replies [][]byte
+}
+
+func (i *flowsInjector) Inject(ctx context.Context, message []byte) {
+	i.MockInjector.Inject(ctx, message)
+	xid := binary.BigEndian.Uint32(message[4:8])
+	switch {
+	case message[1] == uint8(openflow.TypeMultipartRequest) || message[0] == ofVersion10 && message[1] == uint8(ofTypeStatsRequest10):
+		for _, reply := range i.replies {
+			reply = append([]byte(nil), reply...)
+			binary.BigEndian.PutUint32(reply[4:8], xid)
+			i.api.Reply(0x1, reply)
+		}
+	default:
+		reply := barrierRequest(message[0])
+		reply[1]++
+		binary.BigEndian.PutUint32(reply[4:8], xid)
+		i.api.Reply(0x1, reply)
+	}
+}
+
+func getFlows(api *API, query, token string) (*httptest.ResponseRecorder, FlowsResponse) {
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://example.com/oftee/0x1/flows"+query, nil)
+	if token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
+	api.serveMux.ServeHTTP(resp, req)
+	var result FlowsResponse
+	json.Unmarshal(resp.Body.Bytes(), &result)
+	return resp, result
+}
+
+func TestFlowsOF13(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	device := &flowsInjector{api: api}
+	api.injectors[0x1] = device
+	api.versions[0x1] = ofVersion13
+
+	// The endpoint is disabled without a token, and requires it once set
+	if resp, _ := getFlows(api, "", "secret"); resp.Code != 403 {
+		t.Errorf("Expected flows API disabled, got %d", resp.Code)
+	}
+	api.Auth = "secret"
+	for _, token := range []string{"", "wrong"} {
+		if resp, _ := getFlows(api, "", token); resp.Code != 401 {
+			t.Errorf("Expected token '%s' not authorized, got %d", token, resp.Code)
+		}
+	}
+
+	// The flows of a reply split across messages are assembled
+	more := ofMessage(openflow.TypeMultipartReply, 0, append([]byte{0, 1, 0, 1, 0, 0, 0, 0}, flowStats13(10)...))
+	last := ofMessage(openflow.TypeMultipartReply, 0, append(append([]byte{0, 1, 0, 0, 0, 0, 0, 0}, flowStats13(20)...), flowStats13(30)...))
+	device.replies = [][]byte{more, last}
+	resp, result := getFlows(api, "", "secret")
+	if resp.Code != 200 || !result.Complete || result.Total != 3 || len(result.Flows) != 3 {
+		t.Fatalf("Expected 3 flows, got %d %s", resp.Code, resp.Body)
+	}
+	expected := FlowEntry{
+		Table:        1,
+		Priority:     10,
+		Cookie:       "0x0000000000000abc",
+		Match:        "in_port=3;dl_type=0x888e;nw_dst=10.0.0.0/255.0.0.0",
+		Instructions: []string{"apply_actions(output:controller)", "goto_table:2"},
+		DurationSec:  60,
+		PacketCount:  12,
+		ByteCount:    768,
+	}
+	if !reflect.DeepEqual(result.Flows[0], expected) {
+		t.Errorf("Expected flow %+v, got %+v", expected, result.Flows[0])
+	}
+	request := device.Messages[0]
+	if request[1] != uint8(openflow.TypeMultipartRequest) || binary.BigEndian.Uint16(request[8:]) != ofStatsFlow ||
+		request[16] != 0xff || !api.IsInjectedXID(binary.BigEndian.Uint32(request[4:8])) {
+		t.Errorf("Expected flow stats request for all tables, got %x", request)
+	}
+
+	// The flows are paged
+	if resp, result = getFlows(api, "?offset=1&limit=1", "secret"); resp.Code != 200 ||
+		result.Total != 3 || len(result.Flows) != 1 || result.Flows[0].Priority != 20 {
+		t.Errorf("Expected second flow, got %d %s", resp.Code, resp.Body)
+	}
+	if resp, result = getFlows(api, "?offset=5", "secret"); resp.Code != 200 || len(result.Flows) != 0 {
+		t.Errorf("Expected no flows beyond the total, got %d %s", resp.Code, resp.Body)
+	}
+	for _, query := range []string{"?limit=0", "?offset=-1", "?timeout=never"} {
+		if resp, _ = getFlows(api, query, "secret"); resp.Code != 400 {
+			t.Errorf("Expected '%s' rejected, got %d", query, resp.Code)
+		}
+	}
+
+	// An error reply fails the request
+	device.replies = [][]byte{ofMessage(openflow.TypeError, 0, []byte{0, 1, 0, 2, 0, 0, 0, 0})}
+	if resp, _ = getFlows(api, "", "secret"); resp.Code != 502 {
+		t.Errorf("Expected error reply to fail, got %d %s", resp.Code, resp.Body)
+	}
+
+	// A device that doesn't complete the replies times out
+	api.injectors[0x1] = &MockInjector{}
+	if resp, result = getFlows(api, "?timeout=20ms", "secret"); resp.Code != 504 || result.Complete {
+		t.Errorf("Expected flows to time out, got %d %s", resp.Code, resp.Body)
+	}
+
+	// Devices whose version can't be requested are rejected
+	api.versions[0x1] = 0x05
+	if resp, _ = getFlows(api, "", "secret"); resp.Code != 501 {
+		t.Errorf("Expected unsupported version rejected, got %d", resp.Code)
+	}
+}
+
+func TestFlowsOF10(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.Auth = "secret"
+	reply := ofMessage(ofTypeStatsReply10, 0, append([]byte{0, 1, 0, 0}, flowStats10()...))
+	reply[0] = ofVersion10
+	device := &flowsInjector{api: api, replies: [][]byte{reply}}
+	api.injectors[0x1] = device
+	api.versions[0x1] = ofVersion10
+
+	resp, result := getFlows(api, "", "secret")
+	if resp.Code != 200 || !result.Complete || len(result.Flows) != 1 {
+		t.Fatalf("Expected 1 flow, got %d %s", resp.Code, resp.Body)
+	}
+	expected := FlowEntry{
+		Priority:     100,
+		Cookie:       "0x0000000000000000",
+		Match:        "dl_type=0x0806;nw_src=192.168.1.0/24",
+		Instructions: []string{"apply_actions(output:flood)"},
+		ByteCount:    64,
+	}
+	if !reflect.DeepEqual(result.Flows[0], expected) {
+		t.Errorf("Expected flow %+v, got %+v", expected, result.Flows[0])
+	}
+	if request := device.Messages[0]; request[0] != ofVersion10 || request[1] != uint8(ofTypeStatsRequest10) ||
+		device.Messages[1][1] != uint8(ofTypeBarrierRequest10) {
+		t.Errorf("Expected OpenFlow 1.0 stats and barrier requests, got %x", device.Messages)
+	}
+}
+
+func TestFlowsTruncated(t *testing.T) {
+	w := &replyWaiter{message: 1, barrier: 2, maxBytes: 100, done: make(chan struct{})}
+	w.add(1, make([]byte, 60))
+	w.add(1, make([]byte, 60))
+	if !w.add(2, make([]byte, 8)) || !w.truncated || len(w.result()) != 1 {
+		t.Errorf("Expected replies beyond the size truncated, got %d", len(w.result()))
+	}
+}
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ciena/oftee/api/pb"
+	"github.com/ciena/oftee/datapath"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// managementServer implements the gRPC management service using the same
+// device registry and injectors as the REST API, so that the two can't
+// diverge
+type managementServer struct {
+	api *API
+}
+
+// ListDevices lists the DPIDs of the connected devices
+func (s *managementServer) ListDevices(ctx context.Context, req *pb.ListDevicesRequest) (*pb.ListDevicesResponse, error) {
+	return &pb.ListDevicesResponse{Devices: s.api.devices(req.Connected)}, nil
+}
+
+// GetDevice returns a single connected device
+func (s *managementServer) GetDevice(ctx context.Context, req *pb.GetDeviceRequest) (*pb.Device, error) {
+	dpid, _, err := s.api.injector(req.Dpid)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	device := s.api.device(dpid)
+	return &pb.Device{
+		Dpid:          device.DPID,
+		Connections:   uint32(device.Connections),
+		TeeEnabled:    device.Tee.Enabled,
+		TeeSuppressed: device.Tee.Suppressed,
+	}, nil
+}
+
+// PacketOut injects an OpenFlow packet out message to a device, as the REST
+// API does, the token of `API_AUTH` being that of the `authorization`
+// metadata. A confirmed packet out returns the replies of the device, i.e.
+// the error if it rejected it.
+func (s *managementServer) PacketOut(ctx context.Context, req *pb.PacketOutRequest) (*pb.PacketOutResponse, error) {
+	log.WithFields(log.Fields{
+		"dpid": req.Dpid,
+	}).Debug("Packet out request recieved")
+	timeout := PacketOutConfirmTimeout
+	if req.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(req.Timeout); err != nil || timeout <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid timeout '%s', expected a positive duration", req.Timeout)
+		}
+	}
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md["authorization"]) > 0 {
+		token = bearerToken(md["authorization"][0])
+	}
+	build := func(uint8) ([]byte, error) {
+		return req.Message, nil
+	}
+	result, err := s.api.packetOut(ctx, token, req.Dpid, build, req.Confirm, timeout)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if result == nil {
+		return &pb.PacketOutResponse{}, nil
+	}
+	response := &pb.PacketOutResponse{Xid: result.XID, Complete: result.Complete}
+	for _, reply := range result.Replies {
+		response.Replies = append(response.Replies, &pb.Reply{
+			Type:  reply.Type,
+			Xid:   reply.XID,
+			Error: reply.Error,
+			Data:  reply.Data,
+		})
+	}
+	return response, nil
+}
+
+// grpcError converts the error of a rejected packet out to the gRPC status
+// equivalent to the HTTP status with which the REST API answers it
+func grpcError(err error) error {
+	code := codes.Internal
+	if e, ok := err.(*packetOutError); ok {
+		switch e.code {
+		case http.StatusBadRequest:
+			code = codes.InvalidArgument
+		case http.StatusUnauthorized:
+			code = codes.Unauthenticated
+		case http.StatusNotFound:
+			code = codes.NotFound
+		}
+	}
+	return status.Error(code, err.Error())
+}
+
+// ManageEndpoints adds, or removes, an end point, as the REST API does, and
+// returns the statistics of the end points. A request that does neither only
+// returns the statistics.
+func (s *managementServer) ManageEndpoints(ctx context.Context, req *pb.ManageEndpointsRequest) (*pb.ManageEndpointsResponse, error) {
+	var endpoint interface{}
+	switch {
+	case len(req.Add) > 0 && req.Remove != "":
+		return nil, status.Error(codes.InvalidArgument, "either add or remove an end point, not both")
+	case len(req.Add) > 0:
+		if s.api.AddEndpoint == nil {
+			return nil, status.Error(codes.Unimplemented, "Adding end points not available")
+		}
+		var err error
+		if endpoint, err = s.api.AddEndpoint(req.Add); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	case req.Remove != "":
+		if s.api.RemoveEndpoint == nil {
+			return nil, status.Error(codes.Unimplemented, "Removing end points not available")
+		}
+		var ok bool
+		if endpoint, ok = s.api.RemoveEndpoint(req.Remove); !ok {
+			return nil, status.Errorf(codes.NotFound, "End point not found, '%s'", req.Remove)
+		}
+	}
+	response := &pb.ManageEndpointsResponse{}
+	var err error
+	if endpoint != nil {
+		if response.Endpoint, err = json.Marshal(endpoint); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if response.Endpoints, err = json.Marshal(s.api.endpoints()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return response, nil
+}
+
+// GetStats returns the resources used by the process, as the REST API does
+func (s *managementServer) GetStats(ctx context.Context, req *pb.GetStatsRequest) (*pb.Stats, error) {
+	if s.api.BufferStats == nil {
+		return nil, status.Error(codes.Unimplemented, "Statistics not available")
+	}
+	stats, err := json.Marshal(s.api.stats())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.Stats{Json: stats}, nil
+}
+
+// SubscribePacketIns streams the packet ins from a device, or from all
+// devices if the request has no DPID, that match the criteria of the request,
+// as the websocket of the REST API does. A subscriber that doesn't keep up is
+// disconnected with `ResourceExhausted`.
+func (s *managementServer) SubscribePacketIns(req *pb.SubscribePacketInsRequest, stream pb.Management_SubscribePacketInsServer) error {
+	var dpid uint64
+	all := req.Dpid == ""
+	if !all {
+		var err error
+		if dpid, _, err = s.api.injector(req.Dpid); err != nil {
+			return status.Error(codes.NotFound, err.Error())
+		}
+	}
+	query := url.Values{}
+	for name, value := range req.Criteria {
+		query.Set(name, value)
+	}
+	query.Set("encode", "binary")
+	match, _, err := streamCriteria(query)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Unable to parse stream request : %s", err)
+	}
+	if req.Json && s.api.Envelope == nil {
+		return status.Error(codes.InvalidArgument, "JSON encoding of streamed packet ins is not supported")
+	}
+
+	subscriber := newSubscriber(dpid, all, match, req.Json)
+	logger := log.WithFields(log.Fields{
+		"criteria": match.String(),
+	})
+	if remote, ok := peer.FromContext(stream.Context()); ok {
+		logger = logger.WithField("remote", remote.Addr.String())
+	}
+	if !all {
+		logger = logger.WithField("dpid", datapath.Format(dpid))
+	}
+	logger.Info("Streaming packet ins")
+	s.api.subscribe(subscriber)
+	defer s.api.unsubscribe(subscriber)
+	for {
+		select {
+		case message := <-subscriber.queue:
+			if subscriber.json {
+				message = s.api.Envelope(message)
+			}
+			if err := stream.Send(&pb.StreamedPacketIn{Message: message}); err != nil {
+				logger.
+					WithError(err).
+					Info("Stopped streaming packet ins, unable to write to subscriber")
+				return err
+			}
+		case <-subscriber.slow:
+			logger.Warn("Disconnecting slow subscriber to streamed packet ins")
+			return status.Error(codes.ResourceExhausted, "packet ins not read fast enough, some were dropped")
+		case <-stream.Context().Done():
+			logger.Info("Stopped streaming packet ins, closed by subscriber")
+			return nil
+		}
+	}
+}
+
+// RegisterGRPC registers the gRPC management service with the given server
+func (api *API) RegisterGRPC(server *grpc.Server) {
+	pb.RegisterManagementServer(server, &managementServer{api: api})
+}
+
+// GRPCServe implements the gRPC API service loop on the given listener.
+// The DPID mapping updates are processed by `ListenAndServe`, which must
+// also be running.
+func (api *API) GRPCServe(listener net.Listener) error {
+	server := grpc.NewServer()
+	api.RegisterGRPC(server)
+	log.WithFields(log.Fields{
+		"connect-point": listener.Addr().String(),
+	}).Debug("Listening for gRPC API requests")
+	return server.Serve(listener)
+}
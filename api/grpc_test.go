@@ -0,0 +1,299 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/api/pb"
+	"github.com/ciena/oftee/criteria"
+	"github.com/netrack/openflow"
+	"github.com/netrack/openflow/ofp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// grpcClient starts the gRPC management service for the API on an in
+// memory listener and returns a client connected to it
+func grpcClient(t *testing.T, api *API) (pb.ManagementClient, func()) {
+	listener := bufconn.Listen(1024 * 1024)
+	go api.GRPCServe(listener)
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+			return listener.Dial()
+		}),
+		grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pb.NewManagementClient(conn), func() {
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func packetOut(t *testing.T) []byte {
+	message := &bytes.Buffer{}
+	packet := &bytes.Buffer{}
+	po := ofp.PacketOut{
+		Buffer:  ofp.NoBuffer,
+		InPort:  2,
+		Actions: ofp.Actions{&ofp.ActionOutput{Port: 2, MaxLen: ofp.ContentLenNoBuffer}},
+	}
+	req := openflow.NewRequest(openflow.TypePacketOut, packet)
+	if _, err := po.WriteTo(packet); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := req.WriteTo(message); err != nil {
+		t.Fatal(err)
+	}
+	return message.Bytes()
+}
+
+func TestGRPCRoundTrip(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	mock := &MockInjector{}
+	api.injectors[0x1] = mock
+	client, done := grpcClient(t, api)
+	defer done()
+	ctx := context.Background()
+
+	devices, err := client.ListDevices(ctx, &pb.ListDevicesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices.Devices) != 1 || devices.Devices[0] != "of:0x0000000000000001" {
+		t.Errorf("Incorrect device list, got %v", devices.Devices)
+	}
+
+	device, err := client.GetDevice(ctx, &pb.GetDeviceRequest{Dpid: "0x1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Dpid != "of:0x0000000000000001" {
+		t.Errorf("Incorrect device, got %s", device.Dpid)
+	}
+	if _, err = client.GetDevice(ctx, &pb.GetDeviceRequest{Dpid: "0x2"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected not found for unknown device, got %v", err)
+	}
+
+	if _, err = client.PacketOut(ctx, &pb.PacketOutRequest{Dpid: "0x1", Message: packetOut(t)}); err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.Messages) != 1 {
+		t.Errorf("Expected 1 message, found %d", len(mock.Messages))
+	}
+}
+
+func TestGRPCPacketOutInvalid(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	mock := &MockInjector{}
+	api.injectors[0x1] = mock
+	client, done := grpcClient(t, api)
+	defer done()
+	ctx := context.Background()
+
+	message := packetOut(t)
+	for _, req := range []*pb.PacketOutRequest{
+		{Dpid: "0x1", Message: message[:4]},
+		{Dpid: "0x1", Message: message[:len(message)-1]},
+	} {
+		if _, err := client.PacketOut(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected invalid argument, got %v", err)
+		}
+	}
+	if _, err := client.PacketOut(ctx, &pb.PacketOutRequest{Dpid: "0x2", Message: message}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected not found for unknown device, got %v", err)
+	}
+	if len(mock.Messages) != 0 {
+		t.Errorf("Expected no messages injected, found %d", len(mock.Messages))
+	}
+}
+
+func TestGRPCPacketOutConfirmAndAuth(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.Auth = "secret"
+	device := &replyingInjector{api: api}
+	api.injectors[0x1] = device
+	client, done := grpcClient(t, api)
+	defer done()
+	ctx := context.Background()
+	authorized := metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", "Bearer secret"))
+
+	// Packet outs require the token once it is configured, as they do via
+	// the REST API
+	message := packetOut(t)
+	if _, err := client.PacketOut(ctx, &pb.PacketOutRequest{Dpid: "0x1", Message: message}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected unauthenticated without the token, got %v", err)
+	}
+	wrong := metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", "Bearer wrong"))
+	if _, err := client.PacketOut(wrong, &pb.PacketOutRequest{Dpid: "0x1", Message: message}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected unauthenticated with the wrong token, got %v", err)
+	}
+	if len(device.Messages) != 0 {
+		t.Errorf("Expected no messages injected, found %d", len(device.Messages))
+	}
+
+	// Confirmed once the reply to the barrier that follows it arrives
+	result, err := client.PacketOut(authorized, &pb.PacketOutRequest{Dpid: "0x1", Message: message, Confirm: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Complete || !api.IsInjectedXID(result.Xid) || len(result.Replies) != 0 {
+		t.Errorf("Expected packet out confirmed, got %+v", result)
+	}
+	if len(device.Messages) != 2 || openflow.Type(device.Messages[1][1]) != openflow.TypeBarrierRequest {
+		t.Errorf("Expected packet out followed by a barrier request, got %d messages", len(device.Messages))
+	}
+
+	// Rejected with the error from the device
+	device.rejectPacketOuts = true
+	if result, err = client.PacketOut(authorized, &pb.PacketOutRequest{Dpid: "0x1", Message: message, Confirm: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Replies) != 1 || result.Replies[0].Error != "ErrCodeBadActionOutPort" {
+		t.Errorf("Expected packet out rejected, got %+v", result)
+	}
+
+	// Timed out if the device doesn't reply, and not injected if it isn't
+	// connected
+	mock := &MockInjector{}
+	api.injectors[0x1] = mock
+	if result, err = client.PacketOut(authorized, &pb.PacketOutRequest{Dpid: "0x1", Message: message, Confirm: true, Timeout: "20ms"}); err != nil || result.Complete {
+		t.Errorf("Expected confirmation to time out, got %+v %v", result, err)
+	}
+	if _, err = client.PacketOut(authorized, &pb.PacketOutRequest{Dpid: "0x1", Message: message, Timeout: "never"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected invalid timeout rejected, got %v", err)
+	}
+	mock.Unhealthy = true
+	if _, err = client.PacketOut(authorized, &pb.PacketOutRequest{Dpid: "0x1", Message: message}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected not found for a device that isn't connected, got %v", err)
+	}
+	if len(mock.Messages) != 2 {
+		t.Errorf("Expected only the timed out packet out and its barrier injected, found %d", len(mock.Messages))
+	}
+}
+
+func TestGRPCManageEndpointsAndStats(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	endpoints := map[string]map[string]string{}
+	api.AddEndpoint = func(terms map[string]string) (interface{}, error) {
+		if terms["action"] == "" {
+			return nil, errors.New("no action")
+		}
+		endpoints["1"] = terms
+		return map[string]interface{}{"id": "1", "terms": terms}, nil
+	}
+	api.RemoveEndpoint = func(id string) (interface{}, bool) {
+		terms, ok := endpoints[id]
+		delete(endpoints, id)
+		return terms, ok
+	}
+	api.EndpointStats = func() interface{} {
+		return endpoints
+	}
+	client, done := grpcClient(t, api)
+	defer done()
+	ctx := context.Background()
+
+	if _, err := client.GetStats(ctx, &pb.GetStatsRequest{}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected statistics not available, got %v", err)
+	}
+	api.BufferStats = func() interface{} {
+		return map[string]int{"held": 42}
+	}
+	stats, err := client.GetStats(ctx, &pb.GetStatsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stats.Json) != `{"buffers":{"held":42}}` {
+		t.Errorf("Incorrect statistics, got %s", stats.Json)
+	}
+
+	added, err := client.ManageEndpoints(ctx, &pb.ManageEndpointsRequest{Add: map[string]string{"action": "tcp://collector:9000", "dl_type": "0x888e"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(added.Endpoint) != `{"id":"1","terms":{"action":"tcp://collector:9000","dl_type":"0x888e"}}` ||
+		string(added.Endpoints) != `{"endpoints":{"1":{"action":"tcp://collector:9000","dl_type":"0x888e"}}}` {
+		t.Errorf("Incorrect end point added, got %s %s", added.Endpoint, added.Endpoints)
+	}
+	if _, err = client.ManageEndpoints(ctx, &pb.ManageEndpointsRequest{Add: map[string]string{"dl_type": "0x888e"}}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected invalid end point rejected, got %v", err)
+	}
+	if _, err = client.ManageEndpoints(ctx, &pb.ManageEndpointsRequest{Add: map[string]string{"action": "tcp://collector:9000"}, Remove: "1"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected adding and removing rejected, got %v", err)
+	}
+	removed, err := client.ManageEndpoints(ctx, &pb.ManageEndpointsRequest{Remove: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(removed.Endpoint) != `{"action":"tcp://collector:9000","dl_type":"0x888e"}` || string(removed.Endpoints) != `{"endpoints":{}}` {
+		t.Errorf("Incorrect end point removed, got %s %s", removed.Endpoint, removed.Endpoints)
+	}
+	if _, err = client.ManageEndpoints(ctx, &pb.ManageEndpointsRequest{Remove: "1"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected not found for unknown end point, got %v", err)
+	}
+}
+
+func TestGRPCSubscribePacketIns(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.injectors[0x1] = &MockInjector{}
+	client, done := grpcClient(t, api)
+	defer done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if stream, err := client.SubscribePacketIns(ctx, &pb.SubscribePacketInsRequest{Criteria: map[string]string{"no_such_term": "1"}}); err == nil {
+		if _, err = stream.Recv(); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected unknown match term rejected, got %v", err)
+		}
+	}
+	if stream, err := client.SubscribePacketIns(ctx, &pb.SubscribePacketInsRequest{Dpid: "0x2"}); err == nil {
+		if _, err = stream.Recv(); status.Code(err) != codes.NotFound {
+			t.Errorf("Expected not found for unknown device, got %v", err)
+		}
+	}
+
+	stream, err := client.SubscribePacketIns(ctx, &pb.SubscribePacketInsRequest{Dpid: "0x1", Criteria: map[string]string{"dl_type": "0x888e"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !api.Streaming() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the subscriber to be subscribed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Only the packet in from the device that matches is streamed
+	eapol := criteria.Criteria{Set: criteria.BitDLType, DlType: 0x888e}
+	arp := criteria.Criteria{Set: criteria.BitDLType, DlType: 0x0806}
+	api.Publish(0x1, arp, []byte("arp"))
+	api.Publish(0x2, eapol, []byte("other"))
+	api.Publish(0x1, eapol, []byte("eapol"))
+	received, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(received.Message) != "eapol" {
+		t.Errorf("Expected the matching packet in streamed, got %q", received.Message)
+	}
+
+	// The subscriber is removed once it cancels the stream
+	cancel()
+	deadline = time.Now().Add(2 * time.Second)
+	for api.Streaming() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the subscriber to be unsubscribed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
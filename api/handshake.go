@@ -0,0 +1,279 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/netrack/openflow/ofp"
+)
+
+// The handshake of a device connection is snooped as its messages pass
+// through, they are never modified. The hellos exchanged give the version
+// negotiated, i.e. the highest version in both version bitmaps, or else the
+// lower of the versions of the hellos. The features reply gives the
+// capabilities, named by the version of the reply, and the tables and buffers
+// of the device, while the last set config sent by the controller gives the
+// miss send length and fragment handling.
+
+const (
+	ofTypeHello       = 0
+	ofHelloBitmap     = 1
+	ofTypeSetConfig   = 9
+	ofConfigFragMask  = 0x3
+	ofConfigTTLToCtrl = 0x4
+)
+
+// Handshake what a device and its controller negotiated, as observed, the
+// fields not yet observed are omitted
+type Handshake struct {
+	Version           string   `json:"of_version,omitempty"`
+	DeviceVersion     string   `json:"device_version,omitempty"`
+	ControllerVersion string   `json:"controller_version,omitempty"`
+	Capabilities      []string `json:"capabilities,omitempty"`
+	Tables            *uint8   `json:"tables,omitempty"`
+	Buffers           *uint32  `json:"buffers,omitempty"`
+	MissSendLen       *uint16  `json:"miss_send_len,omitempty"`
+	ConfigFlags       string   `json:"config_flags,omitempty"`
+}
+
+// HandshakeSession a session that snoops its handshake
+type HandshakeSession interface {
+	Handshake() *Handshake
+}
+
+// capabilities10 names of the capabilities of an OpenFlow 1.0 device
+var capabilities10 = map[uint32]string{
+	1 << 0: "flow_stats",
+	1 << 1: "table_stats",
+	1 << 2: "port_stats",
+	1 << 3: "stp",
+	1 << 5: "ip_reasm",
+	1 << 6: "queue_stats",
+	1 << 7: "arp_match_ip",
+}
+
+// capabilities13 names of the capabilities of devices of later versions
+var capabilities13 = map[uint32]string{
+	1 << 0: "flow_stats",
+	1 << 1: "table_stats",
+	1 << 2: "port_stats",
+	1 << 3: "group_stats",
+	1 << 5: "ip_reasm",
+	1 << 6: "queue_stats",
+	1 << 8: "port_blocked",
+}
+
+// fragHandling names of the fragment handling of a switch config
+var fragHandling = []string{"frag_normal", "frag_drop", "frag_reasm", "frag_mask"}
+
+// VersionName returns the name of an OpenFlow wire version, i.e. `1.3`
+func VersionName(version uint8) string {
+	if version >= 1 && version <= 6 {
+		return fmt.Sprintf("1.%d", version-1)
+	}
+	return fmt.Sprintf("0x%02x", version)
+}
+
+// HandshakeTracker records the handshake of a device connection. The zero
+// value is ready to use.
+type HandshakeTracker struct {
+	lock       sync.Mutex
+	versions   [2]uint8
+	bitmaps    [2]uint32
+	features   *ofp.SwitchFeatures
+	feature    uint8
+	config     bool
+	flags      uint16
+	missLength uint16
+}
+
+// Hello records a hello, header included, sent by the device, or by the
+// controller
+func (h *HandshakeTracker) Hello(device bool, message []byte) {
+	if len(message) < 8 || message[1] != ofTypeHello {
+		return
+	}
+	var bitmap uint32
+	for elements := message[8:]; len(elements) >= 4; {
+		length := int(binary.BigEndian.Uint16(elements[2:]))
+		if length < 4 || length > len(elements) {
+			break
+		}
+		if binary.BigEndian.Uint16(elements) == ofHelloBitmap && length >= 8 {
+			bitmap = binary.BigEndian.Uint32(elements[4:])
+		}
+		// Elements are padded to a multiple of 8 bytes
+		length = (length + 7) / 8 * 8
+		if length > len(elements) {
+			break
+		}
+		elements = elements[length:]
+	}
+	side := 1
+	if device {
+		side = 0
+	}
+	h.lock.Lock()
+	h.versions[side], h.bitmaps[side] = message[0], bitmap
+	h.lock.Unlock()
+}
+
+// Features records the features reply of the device
+func (h *HandshakeTracker) Features(version uint8, features ofp.SwitchFeatures) {
+	h.lock.Lock()
+	h.features, h.feature = &features, version
+	h.lock.Unlock()
+}
+
+// SetConfig records a set config, header included, sent by the controller
+func (h *HandshakeTracker) SetConfig(message []byte) {
+	if len(message) < 12 || message[1] != ofTypeSetConfig {
+		return
+	}
+	h.lock.Lock()
+	h.config = true
+	h.flags = binary.BigEndian.Uint16(message[8:])
+	h.missLength = binary.BigEndian.Uint16(message[10:])
+	h.lock.Unlock()
+}
+
+// Snoop records a message sent by the controller, if it is part of the
+// handshake
+func (h *HandshakeTracker) Snoop(message []byte) {
+	if len(message) < 8 {
+		return
+	}
+	switch message[1] {
+	case ofTypeHello:
+		h.Hello(false, message)
+	case ofTypeSetConfig:
+		h.SetConfig(message)
+	}
+}
+
+// Handshake returns what has been observed of the handshake, nil if nothing
+func (h *HandshakeTracker) Handshake() *Handshake {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.versions[0] == 0 && h.versions[1] == 0 && h.features == nil && !h.config {
+		return nil
+	}
+	handshake := &Handshake{}
+	if h.versions[0] != 0 {
+		handshake.DeviceVersion = VersionName(h.versions[0])
+	}
+	if h.versions[1] != 0 {
+		handshake.ControllerVersion = VersionName(h.versions[1])
+	}
+	if version := h.negotiated(); version != 0 {
+		handshake.Version = VersionName(version)
+	}
+	if h.features != nil {
+		names := capabilities13
+		if h.feature == ofVersion10 {
+			names = capabilities10
+		}
+		handshake.Capabilities = capabilityNames(uint32(h.features.Capabilities), names)
+		tables, buffers := h.features.NumTables, h.features.NumBuffers
+		handshake.Tables, handshake.Buffers = &tables, &buffers
+	}
+	if h.config {
+		length := h.missLength
+		handshake.MissSendLen = &length
+		handshake.ConfigFlags = fragHandling[h.flags&ofConfigFragMask]
+		if h.flags&ofConfigTTLToCtrl != 0 {
+			handshake.ConfigFlags += "|invalid_ttl_to_controller"
+		}
+	}
+	return handshake
+}
+
+// Version returns the OpenFlow version in use by the connection, that
+// negotiated by the hellos, otherwise that of the features reply, zero until
+// either has been observed
+func (h *HandshakeTracker) Version() uint8 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if version := h.negotiated(); version != 0 {
+		return version
+	}
+	return h.feature
+}
+
+// negotiated returns the version negotiated by the hellos, zero until both
+// have been observed
+func (h *HandshakeTracker) negotiated() uint8 {
+	if h.versions[0] == 0 || h.versions[1] == 0 {
+		return 0
+	}
+	if common := h.bitmaps[0] & h.bitmaps[1]; common != 0 {
+		for version := uint8(31); ; version-- {
+			if common&(1<<version) != 0 {
+				return version
+			}
+		}
+	}
+	if h.versions[0] < h.versions[1] {
+		return h.versions[0]
+	}
+	return h.versions[1]
+}
+
+// capabilityNames names the capabilities set in a bitmap, those unknown by
+// their bit
+func capabilityNames(bitmap uint32, names map[uint32]string) []string {
+	result := []string{}
+	for bit := uint(0); bit < 32; bit++ {
+		if bitmap&(1<<bit) == 0 {
+			continue
+		}
+		if name, ok := names[1<<bit]; ok {
+			result = append(result, name)
+		} else {
+			result = append(result, fmt.Sprintf("0x%x", uint32(1)<<bit))
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// latestHandshake returns the handshake of the latest of the sessions that
+// snoops its handshake, if any
+func latestHandshake(sessions []Session) *Handshake {
+	for i := len(sessions) - 1; i >= 0; i-- {
+		if session, ok := sessions[i].(HandshakeSession); ok {
+			return session.Handshake()
+		}
+	}
+	return nil
+}
+
+// HandshakeGauges returns the number of devices by the OpenFlow version
+// negotiated by their latest connection
+func (api *API) HandshakeGauges() []Gauge {
+	counts := make(map[string]int)
+	api.lock.RLock()
+	for _, sessions := range api.sessions {
+		if handshake := latestHandshake(sessions); handshake != nil && handshake.Version != "" {
+			counts[handshake.Version]++
+		}
+	}
+	api.lock.RUnlock()
+	versions := make([]string, 0, len(counts))
+	for version := range counts {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	gauges := make([]Gauge, 0, len(versions))
+	for _, version := range versions {
+		gauges = append(gauges, Gauge{
+			Name:   "oftee_devices",
+			Help:   "Connected devices by the OpenFlow version negotiated",
+			Labels: map[string]string{"of_version": version},
+			Value:  float64(counts[version]),
+		})
+	}
+	return gauges
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/netrack/openflow/ofp"
+)
+
+// handshakeSession a session whose handshake is snooped from fixtures
+type handshakeSession struct {
+	MockSession
+	HandshakeTracker
+}
+
+// snoopHandshake feeds a handshake, hellos from the device and the
+// controller, a features reply and set config, to a tracker
+func snoopHandshake(t *testing.T, h *HandshakeTracker, device, controller, features, config []byte) {
+	h.Hello(true, device)
+	h.Snoop(controller)
+	var reply ofp.SwitchFeatures
+	if _, err := reply.ReadFrom(bytes.NewReader(features[8:])); err != nil {
+		t.Fatal(err)
+	}
+	h.Features(features[0], reply)
+	h.Snoop(config)
+}
+
+func TestHandshakeOF10(t *testing.T) {
+	var h HandshakeTracker
+	if h.Handshake() != nil || h.Version() != 0 {
+		t.Error("Expected no handshake before any message")
+	}
+	snoopHandshake(t, &h,
+		[]byte{0x01, 0x00, 0x00, 0x08, 0, 0, 0, 1},
+		[]byte{0x01, 0x00, 0x00, 0x08, 0, 0, 0, 2},
+		[]byte{0x01, 0x06, 0x00, 0x20, 0, 0, 0, 3,
+			0, 0, 0, 0, 0, 0, 0, 1, // dpid
+			0, 0, 1, 0, // buffers
+			1, 0, 0, 0, // tables
+			0, 0, 0x01, 0x87, // flow, table and port stats, arp and a reserved bit
+			0, 0, 0x0f, 0xff}, // actions
+		[]byte{0x01, 0x09, 0x00, 0x0c, 0, 0, 0, 4, 0x00, 0x01, 0x00, 0x80})
+
+	tables, buffers, missSendLen := uint8(1), uint32(256), uint16(128)
+	expected := &Handshake{
+		Version:           "1.0",
+		DeviceVersion:     "1.0",
+		ControllerVersion: "1.0",
+		Capabilities:      []string{"0x100", "arp_match_ip", "flow_stats", "port_stats", "table_stats"},
+		Tables:            &tables,
+		Buffers:           &buffers,
+		MissSendLen:       &missSendLen,
+		ConfigFlags:       "frag_drop",
+	}
+	if handshake := h.Handshake(); !reflect.DeepEqual(handshake, expected) {
+		t.Errorf("Expected handshake %+v, got %+v", expected, handshake)
+	}
+
+	// Without the hellos the version is that of the features reply
+	var features HandshakeTracker
+	features.Features(ofVersion13, ofp.SwitchFeatures{})
+	if h.Version() != ofVersion10 || features.Version() != ofVersion13 {
+		t.Errorf("Expected versions 1.0 and 1.3, got 0x%02x and 0x%02x", h.Version(), features.Version())
+	}
+}
+
+func TestHandshakeOF13(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.injectors[0x1] = &MockInjector{}
+	session := &handshakeSession{}
+	api.sessions[0x1] = []Session{&MockSession{}, session}
+
+	// The device offers 1.0 and 1.5, the controller 1.0 and 1.3, so only
+	// the version bitmaps show that 1.0 is negotiated
+	snoopHandshake(t, &session.HandshakeTracker,
+		[]byte{0x06, 0x00, 0x00, 0x10, 0, 0, 0, 1, 0x00, 0x01, 0x00, 0x08, 0x00, 0x00, 0x00, 0x42},
+		[]byte{0x04, 0x00, 0x00, 0x10, 0, 0, 0, 2, 0x00, 0x01, 0x00, 0x08, 0x00, 0x00, 0x00, 0x12},
+		[]byte{0x04, 0x06, 0x00, 0x20, 0, 0, 0, 3,
+			0, 0, 0, 0, 0, 0, 0, 1, // dpid
+			0, 0, 0, 0, // buffers
+			254, 0, 0, 0, // tables, auxiliary ID
+			0, 0, 0x01, 0x4f, // flow, table, port, group and queue stats, port blocked
+			0, 0, 0, 0},
+		[]byte{0x04, 0x09, 0x00, 0x0c, 0, 0, 0, 4, 0x00, 0x00, 0xff, 0xff})
+
+	resp := httptest.NewRecorder()
+	api.serveMux.ServeHTTP(resp, httptest.NewRequest("GET", "http://example.com/oftee/0x1", nil))
+	var device DeviceResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &device); err != nil {
+		t.Fatal(err)
+	}
+	tables, buffers, missSendLen := uint8(254), uint32(0), uint16(0xffff)
+	expected := &Handshake{
+		Version:           "1.0",
+		DeviceVersion:     "1.5",
+		ControllerVersion: "1.3",
+		Capabilities:      []string{"flow_stats", "group_stats", "port_blocked", "port_stats", "queue_stats", "table_stats"},
+		Tables:            &tables,
+		Buffers:           &buffers,
+		MissSendLen:       &missSendLen,
+		ConfigFlags:       "frag_normal",
+	}
+	if !reflect.DeepEqual(device.Handshake, expected) {
+		t.Errorf("Expected handshake %+v, got %s", expected, resp.Body)
+	}
+
+	// Devices are counted by the version negotiated
+	expectedGauges := []Gauge{{
+		Name:   "oftee_devices",
+		Help:   "Connected devices by the OpenFlow version negotiated",
+		Labels: map[string]string{"of_version": "1.0"},
+		Value:  1,
+	}}
+	if gauges := api.HandshakeGauges(); !reflect.DeepEqual(gauges, expectedGauges) {
+		t.Errorf("Expected gauges %+v, got %+v", expectedGauges, gauges)
+	}
+}
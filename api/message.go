@@ -0,0 +1,462 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ciena/oftee/datapath"
+	"github.com/ciena/oftee/injector"
+	"github.com/gorilla/mux"
+	"github.com/netrack/openflow"
+	"github.com/netrack/openflow/ofp"
+	log "github.com/sirupsen/logrus"
+)
+
+// MessageWaitTimeout the default maximum time to wait for the replies to a
+// message injected with `wait=true`
+const MessageWaitTimeout = 5 * time.Second
+
+// PacketOutConfirmTimeout the default maximum time to wait for a device to
+// confirm a packet out injected with `confirm=true`
+const PacketOutConfirmTimeout = 2 * time.Second
+
+// messageTypes the controller-to-switch messages, by name, that can be
+// allowed to be injected via `/oftee/{dpid}/message`
+var messageTypes = map[string]openflow.Type{
+	"features_request":         openflow.TypeFeaturesRequest,
+	"get_config_request":       openflow.TypeGetConfigRequest,
+	"set_config":               openflow.TypeSetConfig,
+	"packet_out":               openflow.TypePacketOut,
+	"flow_mod":                 openflow.TypeFlowMod,
+	"group_mod":                openflow.TypeGroupMod,
+	"port_mod":                 openflow.TypePortMod,
+	"table_mod":                openflow.TypeTableMod,
+	"multipart_request":        openflow.TypeMultipartRequest,
+	"barrier_request":          openflow.TypeBarrierRequest,
+	"queue_get_config_request": openflow.TypeQueueGetConfigRequest,
+	"role_request":             openflow.TypeRoleRequest,
+	"get_async_request":        openflow.TypeAsynchRequest,
+	"set_async":                openflow.TypeSetAsync,
+	"meter_mod":                openflow.TypeMeterMod,
+}
+
+// replyTypes the messages a device sends in reply to a controller-to-switch
+// message. Those with the xid of an injected message are not proxied to the
+// SDN controller, which never sent the request.
+var replyTypes = map[openflow.Type]bool{
+	openflow.TypeError:               true,
+	openflow.TypeGetConfigReply:      true,
+	openflow.TypeMultipartReply:      true,
+	openflow.TypeBarrierReply:        true,
+	openflow.TypeQueueGetConfigReply: true,
+	openflow.TypeRoleReply:           true,
+	openflow.TypeAsyncReply:          true,
+}
+
+// OpenFlow 1.0 numbers its messages differently, from port mod on, so its
+// replies, and barrier request, have their own types
+const (
+	ofVersion10 = 0x01
+
+	ofTypeStatsReply10     openflow.Type = 17
+	ofTypeBarrierRequest10 openflow.Type = 18
+	ofTypeBarrierReply10   openflow.Type = 19
+)
+
+// replyTypes10 the messages an OpenFlow 1.0 device sends in reply to a
+// controller-to-switch message
+var replyTypes10 = map[openflow.Type]bool{
+	openflow.TypeError:          true,
+	openflow.TypeGetConfigReply: true,
+	ofTypeStatsReply10:          true,
+	ofTypeBarrierReply10:        true,
+	21:                          true, // queue get config reply
+}
+
+// IsReply returns true if a message of the given type, and OpenFlow version,
+// is sent by a device in reply to a controller-to-switch message
+func IsReply(version uint8, msgType openflow.Type) bool {
+	if version == ofVersion10 {
+		return replyTypes10[msgType]
+	}
+	return replyTypes[msgType]
+}
+
+// ParseMessageTypes parses the names of the message types that can be
+// injected via `/oftee/{dpid}/message`, i.e. `meter_mod`
+func ParseMessageTypes(names []string) (map[openflow.Type]bool, error) {
+	types := make(map[openflow.Type]bool, len(names))
+	for _, name := range names {
+		t, ok := messageTypes[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			known := make([]string, 0, len(messageTypes))
+			for k := range messageTypes {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown message type '%s', expected one of %s", name, strings.Join(known, ", "))
+		}
+		types[t] = true
+	}
+	return types, nil
+}
+
+// MessageReply a message a device sent in reply to an injected message. For
+// an error `Error` is its class, i.e. `ErrCodeBadActionOutPort`.
+type MessageReply struct {
+	Type  string `json:"type"`
+	XID   uint32 `json:"xid"`
+	Error string `json:"error,omitempty"`
+	Data  []byte `json:"data"`
+}
+
+// MessageResponse is used to create a HTTP response for an injected message,
+// with its replies when waited for. `Complete` is false if the device did not
+// complete processing the message before the wait timed out.
+type MessageResponse struct {
+	XID      uint32         `json:"xid"`
+	Complete bool           `json:"complete"`
+	Replies  []MessageReply `json:"replies,omitempty"`
+}
+
+// replyWaiter collects the replies to an injected message, which are
+// complete once the reply to the barrier request that follows it arrives. If
+// `maxBytes` is set replies beyond that size are discarded and the replies
+// marked as truncated.
+type replyWaiter struct {
+	lock      sync.Mutex
+	message   uint32
+	barrier   uint32
+	replies   []MessageReply
+	maxBytes  int
+	size      int
+	truncated bool
+	done      chan struct{}
+}
+
+// add records a reply, returning true if it completes the replies
+func (w *replyWaiter) add(xid uint32, message []byte) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	select {
+	case <-w.done:
+		return false
+	default:
+	}
+	if xid == w.message && w.maxBytes > 0 && w.size+len(message) > w.maxBytes {
+		w.truncated = true
+	} else if xid == w.message {
+		w.size += len(message)
+		reply := MessageReply{
+			Type: openflow.Type(message[1]).String(),
+			XID:  xid,
+			Data: append([]byte(nil), message...),
+		}
+		if openflow.Type(message[1]) == openflow.TypeError {
+			var e ofp.Error
+			if _, err := e.ReadFrom(bytes.NewReader(message[8:])); err == nil {
+				reply.Error = e.String()
+			}
+		}
+		w.replies = append(w.replies, reply)
+	}
+	if xid == w.barrier {
+		close(w.done)
+		return true
+	}
+	return false
+}
+
+// wait waits for the replies to be complete, returning false if they are not
+// before the timeout expires
+func (w *replyWaiter) wait(timeout time.Duration) bool {
+	select {
+	case <-w.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// result returns the replies received so far
+func (w *replyWaiter) result() []MessageReply {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]MessageReply(nil), w.replies...)
+}
+
+// Reply delivers a message received from a device that is a reply, by its
+// type, to a message injected via the API to the request waiting for it, if
+// any. Returns true if the reply is for an injected message, in which case it
+// must not be proxied to the SDN controller.
+func (api *API) Reply(dpid uint64, message []byte) bool {
+	if api == nil || len(message) < 8 || !IsReply(message[0], openflow.Type(message[1])) {
+		return false
+	}
+	xid := binary.BigEndian.Uint32(message[4:8])
+	if !api.IsInjectedXID(xid) {
+		return false
+	}
+	if w := api.xids.waiter(dpid, xid); w != nil && w.add(xid, message) {
+		log.
+			WithFields(log.Fields{
+				"dpid": datapath.Format(dpid),
+				"xid":  xid,
+			}).
+			Debug("Received all replies to injected message")
+	}
+	return true
+}
+
+// barrierRequest builds a barrier request of the given version
+func barrierRequest(version uint8) []byte {
+	barrier := make([]byte, 8)
+	barrier[0] = version
+	barrier[1] = uint8(openflow.TypeBarrierRequest)
+	if version == ofVersion10 {
+		barrier[1] = uint8(ofTypeBarrierRequest10)
+	}
+	binary.BigEndian.PutUint16(barrier[2:4], 8)
+	return barrier
+}
+
+// inject injects a message to a device, with an xid from the reserved range,
+// followed by a barrier request, unless it is one, so that the waiter
+// collects its replies
+func (api *API) inject(ctx context.Context, dpid uint64, inject injector.Injector, data []byte, w *replyWaiter) {
+	msgType := openflow.Type(data[1])
+	w.lock.Lock()
+	w.message = api.xids.stampWaiter(dpid, data, w)
+	w.barrier = w.message
+	var barrier []byte
+	if !(msgType == openflow.TypeBarrierRequest || data[0] == ofVersion10 && msgType == ofTypeBarrierRequest10) {
+		barrier = barrierRequest(data[0])
+		w.barrier = api.xids.stampWaiter(dpid, barrier, w)
+	}
+	w.lock.Unlock()
+	inject.Inject(ctx, data)
+	if barrier != nil {
+		inject.Inject(ctx, barrier)
+	}
+}
+
+// MessageHandler handles an HTTP request to inject an arbitrary OpenFlow
+// message, of one of the allowed controller-to-switch types, to a device. The
+// payload is the message, including its header. The message is given an xid
+// from the reserved range, and its replies are not proxied to the SDN
+// controller.
+//
+// With the `wait=true` query parameter the message is followed by a barrier
+// request and the replies to the message, including errors, received before
+// the reply to the barrier are returned. The wait is limited by `timeout`,
+// i.e. `2s`, which defaults to `MessageWaitTimeout`. If `API_AUTH` is set the
+// request must carry it, as a packet out must. Every request is logged, with
+// the `audit` field set to `message`.
+func (api *API) MessageHandler(resp http.ResponseWriter, req *http.Request) {
+	defer api.close(req.Body)
+	vars := mux.Vars(req)
+	audit := log.WithFields(log.Fields{
+		"audit":  "message",
+		"client": req.RemoteAddr,
+		"dpid":   vars["dpid"],
+	})
+	if !api.authenticate(resp, req, audit, "Message") {
+		return
+	}
+
+	// Parse the wait options before anything is injected
+	wait, timeout, err := waitOptions(req, "wait", MessageWaitTimeout)
+	if err != nil {
+		audit.
+			WithFields(log.Fields{
+				"timeout": req.URL.Query().Get("timeout"),
+			}).
+			Warn("Message rejected: invalid timeout")
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dpid, inject, err := api.injector(vars["dpid"])
+	if err != nil {
+		audit.
+			WithError(err).
+			Warn("Message rejected: Unable to find packet injector for DPID, unknown device")
+		http.Error(resp, err.Error(), http.StatusNotFound)
+		return
+	}
+	audit = audit.WithField("dpid", datapath.Format(dpid))
+	if !inject.Healthy() {
+		audit.Warn("Message rejected: device is not connected")
+		http.Error(resp, fmt.Sprintf("DPID not connected, '%s'", vars["dpid"]), http.StatusNotFound)
+		return
+	}
+
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		audit.
+			WithError(err).
+			Warn("Message rejected: Unable to read message from client")
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = validateMessage(data, api.version(dpid)); err != nil {
+		audit.
+			WithError(err).
+			Warn("Message rejected: invalid OpenFlow message")
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msgType := openflow.Type(data[1])
+	audit = audit.WithFields(log.Fields{
+		"of_message": msgType.String(),
+		"length":     len(data),
+	})
+	if !api.MessageTypes[msgType] {
+		audit.Warn("Message rejected: message type not allowed")
+		http.Error(resp, fmt.Sprintf("message type '%s' not allowed", msgType), http.StatusForbidden)
+		return
+	}
+	api.injectMessage(resp, req, audit, dpid, inject, data, wait, timeout)
+}
+
+// waitOptions parses the boolean query parameter, i.e. `wait`, that requests
+// to wait for the device to process an injected message, and the `timeout`
+// of the wait, which defaults to the given timeout
+func waitOptions(req *http.Request, name string, timeout time.Duration) (bool, time.Duration, error) {
+	if value := req.URL.Query().Get("timeout"); value != "" {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			return false, 0, fmt.Errorf("invalid timeout '%s', expected a positive duration", value)
+		}
+	}
+	return req.URL.Query().Get(name) == "true", timeout, nil
+}
+
+// injectMessage injects a message, with an xid from the reserved range, and
+// responds with its xid or, when waiting, with its replies, followed by a
+// barrier request
+func (api *API) injectMessage(resp http.ResponseWriter, req *http.Request, audit *log.Entry, dpid uint64, inject injector.Injector, data []byte, wait bool, timeout time.Duration) {
+	if !wait {
+		xid := api.xids.stamp(dpid, data, nil)
+		inject.Inject(req.Context(), data)
+		audit.
+			WithFields(log.Fields{
+				"xid": xid,
+			}).
+			Info("Message injected")
+		writeJSON(resp, http.StatusAccepted, MessageResponse{XID: xid})
+		return
+	}
+	w := &replyWaiter{done: make(chan struct{})}
+	api.inject(req.Context(), dpid, inject, data, w)
+	audit = audit.WithFields(log.Fields{
+		"xid": w.message,
+	})
+	audit.Info("Message injected, waiting for replies")
+
+	result := MessageResponse{XID: w.message, Complete: w.wait(timeout)}
+	result.Replies = w.result()
+	audit.
+		WithFields(log.Fields{
+			"complete": result.Complete,
+			"replies":  len(result.Replies),
+		}).
+		Info("Message replies returned")
+	code := http.StatusOK
+	if !result.Complete {
+		code = http.StatusGatewayTimeout
+	}
+	writeJSON(resp, code, result)
+}
+
+// packetOutError the reason a packet out was rejected, with the HTTP status
+// with which the REST API answers it
+type packetOutError struct {
+	code   int
+	reason string
+	err    error
+}
+
+func (e *packetOutError) Error() string {
+	return e.err.Error()
+}
+
+// packetOut injects a packet out to a device, for both the REST and the gRPC
+// API. The request must carry the `API_AUTH` token, if one is configured, and
+// the device must be connected. The packet out is then built by `build` for the
+// OpenFlow version of the device, and validated, before it is injected with an
+// xid from the reserved range, so that an error for it is not proxied to the
+// SDN controller.
+//
+// With `confirm` the packet out is followed by a barrier request and the
+// result, once the device has processed it or the timeout expires, holds its
+// replies, i.e. the error if the device rejected it. Otherwise the result is
+// nil. A rejected packet out is logged and its error is a `*packetOutError`.
+func (api *API) packetOut(ctx context.Context, token string, value string, build func(version uint8) ([]byte, error), confirm bool, timeout time.Duration) (*MessageResponse, error) {
+	logger := log.WithFields(log.Fields{
+		"dpid": value,
+	})
+	reject := func(code int, reason string, err error) error {
+		logger.WithError(err).Warnf("PacketOut rejected: %s", reason)
+		return &packetOutError{code: code, reason: reason, err: err}
+	}
+	if api.Auth != "" && !api.validToken(token) {
+		return nil, reject(http.StatusUnauthorized, "not authorized", errors.New("not authorized"))
+	}
+	dpid, inject, err := api.injector(value)
+	if err != nil {
+		return nil, reject(http.StatusNotFound, "Unable to find packet injector for DPID, unknown device", err)
+	}
+	logger = logger.WithField("dpid", datapath.Format(dpid))
+	logger.Debug("Packet out request recieved")
+	if !inject.Healthy() {
+		return nil, reject(http.StatusNotFound, "device is not connected", fmt.Errorf("DPID not connected, '%s'", value))
+	}
+	data, err := build(api.version(dpid))
+	if e, ok := err.(*packetOutError); ok {
+		return nil, reject(e.code, e.reason, e.err)
+	} else if err != nil {
+		return nil, reject(http.StatusBadRequest, "invalid packet out", err)
+	}
+	if err = validatePacketOut(data, api.version(dpid)); err != nil {
+		return nil, reject(http.StatusBadRequest, "invalid OpenFlow packet out message", err)
+	}
+
+	if !confirm {
+		api.xids.stamp(dpid, data, nil)
+		inject.Inject(ctx, data)
+		return nil, nil
+	}
+	w := &replyWaiter{done: make(chan struct{})}
+	api.inject(ctx, dpid, inject, data, w)
+	result := &MessageResponse{XID: w.message, Complete: w.wait(timeout)}
+	result.Replies = w.result()
+	logger.
+		WithFields(log.Fields{
+			"xid":      result.XID,
+			"complete": result.Complete,
+			"replies":  len(result.Replies),
+		}).
+		Debug("Packet out confirmed")
+	return result, nil
+}
+
+// rejected returns true if the device rejected a confirmed packet out, replying
+// with an error
+func (r *MessageResponse) rejected() bool {
+	for _, reply := range r.Replies {
+		if reply.Type == openflow.TypeError.String() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/netrack/openflow"
+	"github.com/netrack/openflow/ofp"
+)
+
+// ofMessage builds an OpenFlow 1.3 message of the given type and body
+func ofMessage(msgType openflow.Type, xid uint32, body []byte) []byte {
+	message := make([]byte, 8, 8+len(body))
+	message[0] = 0x04
+	message[1] = uint8(msgType)
+	binary.BigEndian.PutUint16(message[2:4], uint16(8+len(body)))
+	binary.BigEndian.PutUint32(message[4:8], xid)
+	return append(message, body...)
+}
+
+// replyingInjector a device that replies to a meter mod with an error, and
+// to a barrier request, as it is injected. If `rejectPacketOuts` it also
+// replies to packet outs with an error.
+type replyingInjector struct {
+	MockInjector
+	api              *API
+	rejectPacketOuts bool
+}
+
+func (i *replyingInjector) Inject(ctx context.Context, message []byte) {
+	i.MockInjector.Inject(ctx, message)
+	xid := binary.BigEndian.Uint32(message[4:8])
+	switch openflow.Type(message[1]) {
+	case openflow.TypeMeterMod:
+		body := &bytes.Buffer{}
+		e := ofp.Error{Type: ofp.ErrTypeMeterModFailed, Code: ofp.ErrCodeMeterModFailedUnknownMeter, Data: message[:8]}
+		e.WriteTo(body)
+		i.api.Reply(0x1, ofMessage(openflow.TypeError, xid, body.Bytes()))
+	case openflow.TypePacketOut:
+		if i.rejectPacketOuts {
+			body := &bytes.Buffer{}
+			e := ofp.Error{Type: ofp.ErrTypeBadAction, Code: ofp.ErrCodeBadActionOutPort, Data: message[:8]}
+			e.WriteTo(body)
+			i.api.Reply(0x1, ofMessage(openflow.TypeError, xid, body.Bytes()))
+		}
+	case openflow.TypeBarrierRequest:
+		i.api.Reply(0x1, ofMessage(openflow.TypeBarrierReply, xid, nil))
+	}
+}
+
+func postMessage(api *API, query string, message []byte) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "http://example.com/oftee/0x1/message"+query, bytes.NewReader(message))
+	req.Header.Add("Content-type", "application/octet-stream")
+	api.serveMux.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestMessageValidation(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	mock := &MockInjector{}
+	api.injectors[0x1] = mock
+	api.versions[0x1] = 0x04
+	meterMod := ofMessage(openflow.TypeMeterMod, 0, make([]byte, 8))
+
+	// The message API is disabled unless types are allowed
+	if resp := postMessage(api, "", meterMod); resp.Code != 403 {
+		t.Errorf("Expected message API disabled, got %d", resp.Code)
+	}
+	var err error
+	if api.MessageTypes, err = ParseMessageTypes([]string{"meter_mod", "Group_Mod"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseMessageTypes([]string{"packet_in"}); err == nil {
+		t.Error("Expected switch-to-controller message type to be rejected")
+	}
+
+	other := ofMessage(openflow.TypeTableMod, 0, make([]byte, 8))
+	version := append([]byte(nil), meterMod...)
+	version[0] = 0x01
+	short := meterMod[:12]
+	for name, message := range map[string][]byte{"type": other, "version": version, "length": short} {
+		if resp := postMessage(api, "", message); resp.Code != 403 && resp.Code != 400 {
+			t.Errorf("Expected message with invalid %s rejected, got %d", name, resp.Code)
+		}
+	}
+	if len(mock.Messages) != 0 {
+		t.Errorf("Expected no messages injected, got %d", len(mock.Messages))
+	}
+
+	resp := postMessage(api, "", meterMod)
+	var result MessageResponse
+	if err = json.Unmarshal(resp.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != 202 || !api.IsInjectedXID(result.XID) || len(mock.Messages) != 1 ||
+		binary.BigEndian.Uint32(mock.Messages[0][4:]) != result.XID {
+		t.Errorf("Expected meter mod injected with a reserved xid, got %d %+v", resp.Code, result)
+	}
+}
+
+func TestMessageUnauthorized(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.Auth = "secret"
+	mock := &MockInjector{}
+	api.injectors[0x1] = mock
+	api.MessageTypes, _ = ParseMessageTypes([]string{"meter_mod"})
+	message := func(authorization string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "http://example.com/oftee/0x1/message", bytes.NewReader(ofMessage(openflow.TypeMeterMod, 0, make([]byte, 8))))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		api.serveMux.ServeHTTP(resp, req)
+		return resp
+	}
+
+	for _, authorization := range []string{"", "Bearer wrong"} {
+		if resp := message(authorization); resp.Code != 401 || resp.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("Expected 401 for authorization '%s', got %d", authorization, resp.Code)
+		}
+	}
+	if len(mock.Messages) != 0 {
+		t.Errorf("Expected no messages injected, found %d", len(mock.Messages))
+	}
+	if resp := message("Bearer secret"); resp.Code != 202 || len(mock.Messages) != 1 {
+		t.Errorf("Expected message injected with the token, got %d", resp.Code)
+	}
+}
+
+func TestMessageWait(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	device := &replyingInjector{api: api}
+	api.injectors[0x1] = device
+	api.MessageTypes, _ = ParseMessageTypes([]string{"meter_mod", "table_mod"})
+
+	// The error for the meter mod is returned once the barrier completes
+	resp := postMessage(api, "?wait=true", ofMessage(openflow.TypeMeterMod, 0, make([]byte, 8)))
+	var result MessageResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != 200 || !result.Complete || len(result.Replies) != 1 ||
+		result.Replies[0].Error != "ErrCodeMeterModFailedUnknownMeter" || result.Replies[0].XID != result.XID {
+		t.Errorf("Expected meter mod error returned, got %d %+v", resp.Code, result)
+	}
+	if len(device.Messages) != 2 || openflow.Type(device.Messages[1][1]) != openflow.TypeBarrierRequest {
+		t.Errorf("Expected meter mod followed by a barrier request, got %d messages", len(device.Messages))
+	}
+
+	// A message with no reply, whose barrier isn't answered, times out
+	api.injectors[0x1] = &MockInjector{}
+	resp = postMessage(api, "?wait=true&timeout=20ms", ofMessage(openflow.TypeTableMod, 0, make([]byte, 8)))
+	result = MessageResponse{}
+	if err := json.Unmarshal(resp.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != 504 || result.Complete || len(result.Replies) != 0 {
+		t.Errorf("Expected wait to time out, got %d %+v", resp.Code, result)
+	}
+
+	// A reply for an injected message that is no longer waited for is
+	// still claimed, a reply for a controller message isn't
+	if !api.Reply(0x1, ofMessage(openflow.TypeBarrierReply, result.XID, nil)) {
+		t.Error("Expected reply to injected message to be claimed")
+	}
+	if api.Reply(0x1, ofMessage(openflow.TypeBarrierReply, 0x1234, nil)) {
+		t.Error("Expected reply to controller message not to be claimed")
+	}
+	if api.Reply(0x1, ofMessage(openflow.TypeEchoRequest, InjectXIDBase, nil)) {
+		t.Error("Expected message that isn't a reply not to be claimed")
+	}
+}
+
+func TestPacketOutConfirm(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	device := &replyingInjector{api: api}
+	api.injectors[0x1] = device
+	packetOut := func(query string) (int, MessageResponse) {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "http://example.com/oftee/0x1"+query, bytes.NewReader(ofMessage(openflow.TypePacketOut, 0, make([]byte, 16))))
+		req.Header.Add("Content-type", "application/octet-stream")
+		api.serveMux.ServeHTTP(resp, req)
+		var result MessageResponse
+		if resp.Code != 400 {
+			if err := json.Unmarshal(resp.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.Code, result
+	}
+
+	// Accepted once the reply to the barrier that follows it arrives
+	if code, result := packetOut("?confirm=true"); code != 200 || !result.Complete || !api.IsInjectedXID(result.XID) {
+		t.Errorf("Expected packet out confirmed, got %d %+v", code, result)
+	}
+	if len(device.Messages) != 2 || openflow.Type(device.Messages[1][1]) != openflow.TypeBarrierRequest {
+		t.Errorf("Expected packet out followed by a barrier request, got %d messages", len(device.Messages))
+	}
+
+	// Rejected with the error from the device
+	device.rejectPacketOuts = true
+	if code, result := packetOut("?confirm=true"); code != 422 || len(result.Replies) != 1 || result.Replies[0].Error != "ErrCodeBadActionOutPort" {
+		t.Errorf("Expected packet out rejected, got %d %+v", code, result)
+	}
+
+	// Timed out if the device doesn't reply
+	mock := &MockInjector{}
+	api.injectors[0x1] = mock
+	if code, result := packetOut("?confirm=true&timeout=20ms"); code != 504 || result.Complete {
+		t.Errorf("Expected confirmation to time out, got %d %+v", code, result)
+	}
+	if code, _ := packetOut("?confirm=true&timeout=never"); code != 400 || len(mock.Messages) != 2 {
+		t.Errorf("Expected invalid timeout rejected, got %d", code)
+	}
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Gauge a single metric, exposed in the Prometheus text format. The gauges
+// of a metric that has labels, i.e. one per end point, follow each other and
+// share the name and help. A metric whose value only increases, i.e. the
+// messages proxied, is exposed as a counter.
+type Gauge struct {
+	Name    string
+	Help    string
+	Labels  map[string]string
+	Value   float64
+	Counter bool
+}
+
+// labelEscaper escapes the value of a label
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// labels renders the labels of a gauge, sorted by name
+func (g Gauge) labels() string {
+	if len(g.Labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(g.Labels))
+	for name := range g.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = fmt.Sprintf("%s=\"%s\"", name, labelEscaper.Replace(g.Labels[name]))
+	}
+	return "{" + strings.Join(names, ",") + "}"
+}
+
+// MetricsHandler returns the gauges in the Prometheus text exposition
+// format, so they can be scraped without a client library, at either
+// `/oftee/metrics` or the conventional `/metrics`
+func (api *API) MetricsHandler(resp http.ResponseWriter, req *http.Request) {
+	if api.Gauges == nil {
+		http.Error(resp, "Metrics not available", http.StatusNotFound)
+		return
+	}
+	var out bytes.Buffer
+	previous := ""
+	for _, gauge := range api.Gauges() {
+		if gauge.Name != previous {
+			kind := "gauge"
+			if gauge.Counter {
+				kind = "counter"
+			}
+			fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s %s\n", gauge.Name, gauge.Help, gauge.Name, kind)
+			previous = gauge.Name
+		}
+		fmt.Fprintf(&out, "%s%s %s\n", gauge.Name, gauge.labels(),
+			strconv.FormatFloat(gauge.Value, 'g', -1, 64))
+	}
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(out.Bytes())
+}
+
+// ResetPeaksHandler resets the high-water marks, returning them as they were
+// before the reset
+func (api *API) ResetPeaksHandler(resp http.ResponseWriter, req *http.Request) {
+	if api.ResetPeaks == nil {
+		http.Error(resp, "Statistics not available", http.StatusNotFound)
+		return
+	}
+	writeJSON(resp, http.StatusOK, api.ResetPeaks())
+}
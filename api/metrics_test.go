@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsLabels(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.Gauges = func() []Gauge {
+		return []Gauge{
+			{Name: "oftee_compare_divergent_messages", Help: "divergent", Labels: map[string]string{"group": "a"}, Value: 2},
+			{Name: "oftee_compare_divergent_messages", Help: "divergent", Labels: map[string]string{"group": `b"c`}, Value: 0},
+		}
+	}
+	resp := httptest.NewRecorder()
+	api.serveMux.ServeHTTP(resp, httptest.NewRequest("GET", "http://example.com/oftee/metrics", nil))
+
+	// The gauges of a metric share its help and type
+	expected := "# HELP oftee_compare_divergent_messages divergent\n" +
+		"# TYPE oftee_compare_divergent_messages gauge\n" +
+		"oftee_compare_divergent_messages{group=\"a\"} 2\n" +
+		"oftee_compare_divergent_messages{group=\"b\\\"c\"} 0\n"
+	if resp.Body.String() != expected {
+		t.Errorf("Expected metrics %q, got %q", expected, resp.Body.String())
+	}
+}
+
+func TestMetricsCounters(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.Gauges = func() []Gauge {
+		return []Gauge{
+			{Name: "oftee_device_bytes_received_total", Help: "received", Labels: map[string]string{"device": "of:0x0000000000000001"}, Value: 64, Counter: true},
+			{Name: "oftee_device_connections", Help: "connections", Value: 1},
+		}
+	}
+	resp := httptest.NewRecorder()
+	api.serveMux.ServeHTTP(resp, httptest.NewRequest("GET", "http://example.com/metrics", nil))
+
+	// Counters are typed as such, and exposed at the conventional path
+	expected := "# HELP oftee_device_bytes_received_total received\n" +
+		"# TYPE oftee_device_bytes_received_total counter\n" +
+		"oftee_device_bytes_received_total{device=\"of:0x0000000000000001\"} 64\n" +
+		"# HELP oftee_device_connections connections\n" +
+		"# TYPE oftee_device_connections gauge\n" +
+		"oftee_device_connections 1\n"
+	if resp.Body.String() != expected {
+		t.Errorf("Expected metrics %q, got %q", expected, resp.Body.String())
+	}
+}
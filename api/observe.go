@@ -0,0 +1,345 @@
+package api
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/datapath"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+// Limits of an observation of the packet ins of a device
+const (
+	// DefaultObserveDuration how long packet ins are observed if no
+	// duration is requested
+	DefaultObserveDuration = 30 * time.Second
+
+	// MaxObserveDuration longest duration for which packet ins may be
+	// observed
+	MaxObserveDuration = 5 * time.Minute
+
+	// ObserveSamples number of packets sampled, by reservoir sampling,
+	// from which VLANs and flows are summarized
+	ObserveSamples = 1024
+
+	// ObserveSnapLen number of bytes of each sampled packet that are kept,
+	// enough for the headers
+	ObserveSnapLen = 256
+
+	// ObserveClusters maximum number of distinct criteria counted, packets
+	// that would add a cluster beyond it are only counted in the total
+	ObserveClusters = 1024
+
+	// ObserveTop number of entries in each list of the summary
+	ObserveTop = 10
+)
+
+// EthertypeCount the number of packet ins of an Ethernet type
+type EthertypeCount struct {
+	DlType string `json:"dl_type"`
+	Count  uint64 `json:"count"`
+}
+
+// VLANCount the number of sampled packet ins tagged with a VLAN
+type VLANCount struct {
+	VLAN  uint16 `json:"vlan"`
+	Count uint64 `json:"count"`
+}
+
+// FlowCount the number of sampled packet ins of an IP protocol, and for TCP
+// and UDP, destination port
+type FlowCount struct {
+	NwProto uint8  `json:"nw_proto"`
+	TpDst   uint16 `json:"tp_dst,omitempty"`
+	Count   uint64 `json:"count"`
+}
+
+// Suggestion the match criteria of a cluster of packet ins, as end point
+// specification terms, and the number of packet ins it matched
+type Suggestion struct {
+	Criteria string `json:"criteria"`
+	Count    uint64 `json:"count"`
+}
+
+// ObserveResponse is used to create a HTTP response that summarizes the
+// packet ins observed from a device. Ethernet types and suggestions are
+// counted over all packet ins, VLANs and flows over the sampled packet ins.
+type ObserveResponse struct {
+	DPID        string           `json:"dpid"`
+	Duration    string           `json:"duration"`
+	Packets     uint64           `json:"packets"`
+	Sampled     int              `json:"sampled"`
+	Ethertypes  []EthertypeCount `json:"ethertypes"`
+	VLANs       []VLANCount      `json:"vlans"`
+	Flows       []FlowCount      `json:"flows"`
+	Suggestions []Suggestion     `json:"suggestions"`
+	Suspended   bool             `json:"suspended,omitempty"`
+}
+
+// clusterKey the values of the state criteria of a packet in by which they
+// are clustered, comparable so that clustering doesn't allocate
+type clusterKey struct {
+	set        uint64
+	dlType     uint16
+	icmpv6Type uint8
+	pppoeCode  uint8
+}
+
+// observation samples the packet ins of a device. Its memory is bounded by
+// the number of samples, their length and the number of clusters.
+type observation struct {
+	lock     sync.Mutex
+	packets  uint64
+	clusters map[clusterKey]uint64
+	samples  [][]byte
+	random   *rand.Rand
+
+	// suspended the samples were released, see `SuspendObservations`
+	suspended bool
+}
+
+// newObservation creates an empty observation
+func newObservation() *observation {
+	return &observation{
+		clusters: make(map[clusterKey]uint64),
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// add counts a packet in and samples it, replacing a random sample once the
+// reservoir is full so that each packet in is equally likely to be sampled
+func (o *observation) add(state criteria.Criteria, frame []byte) {
+	if len(frame) > ObserveSnapLen {
+		frame = frame[:ObserveSnapLen]
+	}
+	// Packet ins are not clustered by their Ethernet addresses, which would
+	// exhaust the clusters
+	key := clusterKey{set: state.Set &^ (criteria.BitDLSrc | criteria.BitDLDst), dlType: state.DlType, icmpv6Type: state.ICMPv6Type, pppoeCode: state.PppoeCode}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.packets++
+	if _, ok := o.clusters[key]; ok || len(o.clusters) < ObserveClusters {
+		o.clusters[key]++
+	}
+	switch {
+	case len(o.samples) < ObserveSamples:
+		o.samples = append(o.samples, append(make([]byte, 0, len(frame)), frame...))
+	default:
+		if i := o.random.Int63n(int64(o.packets)); i < ObserveSamples {
+			o.samples[i] = append(o.samples[i][:0], frame...)
+		}
+	}
+}
+
+// release releases the samples, which are not replaced while observations
+// are suspended
+func (o *observation) release() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.samples = nil
+	o.suspended = true
+}
+
+// summary summarizes the observed packet ins
+func (o *observation) summary() ObserveResponse {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	resp := ObserveResponse{
+		Packets:     o.packets,
+		Sampled:     len(o.samples),
+		Ethertypes:  []EthertypeCount{},
+		VLANs:       []VLANCount{},
+		Flows:       []FlowCount{},
+		Suggestions: []Suggestion{},
+		Suspended:   o.suspended,
+	}
+
+	ethertypes := make(map[uint16]uint64)
+	for key, count := range o.clusters {
+		ethertypes[key.dlType] += count
+		c := criteria.Criteria{
+			Set:        key.set,
+			DlType:     key.dlType,
+			ICMPv6Type: key.icmpv6Type,
+			PppoeCode:  key.pppoeCode,
+		}
+		resp.Suggestions = append(resp.Suggestions, Suggestion{Criteria: c.String(), Count: count})
+	}
+	for dlType, count := range ethertypes {
+		resp.Ethertypes = append(resp.Ethertypes, EthertypeCount{DlType: fmt.Sprintf("0x%04x", dlType), Count: count})
+	}
+
+	vlans := make(map[uint16]uint64)
+	flows := make(map[FlowCount]uint64)
+	for _, sample := range o.samples {
+		pkt := gopacket.NewPacket(sample, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		if dot1q, ok := pkt.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q); ok {
+			vlans[dot1q.VLANIdentifier]++
+		}
+		var flow FlowCount
+		switch ip := pkt.NetworkLayer().(type) {
+		case *layers.IPv4:
+			flow.NwProto = uint8(ip.Protocol)
+		case *layers.IPv6:
+			flow.NwProto = uint8(ip.NextHeader)
+		default:
+			continue
+		}
+		switch tp := pkt.TransportLayer().(type) {
+		case *layers.TCP:
+			flow.TpDst = uint16(tp.DstPort)
+		case *layers.UDP:
+			flow.TpDst = uint16(tp.DstPort)
+		}
+		flows[flow]++
+	}
+	for vlan, count := range vlans {
+		resp.VLANs = append(resp.VLANs, VLANCount{VLAN: vlan, Count: count})
+	}
+	for flow, count := range flows {
+		flow.Count = count
+		resp.Flows = append(resp.Flows, flow)
+	}
+
+	sort.Slice(resp.Ethertypes, func(i, j int) bool {
+		a, b := resp.Ethertypes[i], resp.Ethertypes[j]
+		return a.Count > b.Count || (a.Count == b.Count && a.DlType < b.DlType)
+	})
+	sort.Slice(resp.VLANs, func(i, j int) bool {
+		a, b := resp.VLANs[i], resp.VLANs[j]
+		return a.Count > b.Count || (a.Count == b.Count && a.VLAN < b.VLAN)
+	})
+	sort.Slice(resp.Flows, func(i, j int) bool {
+		a, b := resp.Flows[i], resp.Flows[j]
+		return a.Count > b.Count || (a.Count == b.Count &&
+			(a.NwProto < b.NwProto || (a.NwProto == b.NwProto && a.TpDst < b.TpDst)))
+	})
+	sort.Slice(resp.Suggestions, func(i, j int) bool {
+		a, b := resp.Suggestions[i], resp.Suggestions[j]
+		return a.Count > b.Count || (a.Count == b.Count && a.Criteria < b.Criteria)
+	})
+	if len(resp.Ethertypes) > ObserveTop {
+		resp.Ethertypes = resp.Ethertypes[:ObserveTop]
+	}
+	if len(resp.VLANs) > ObserveTop {
+		resp.VLANs = resp.VLANs[:ObserveTop]
+	}
+	if len(resp.Flows) > ObserveTop {
+		resp.Flows = resp.Flows[:ObserveTop]
+	}
+	if len(resp.Suggestions) > ObserveTop {
+		resp.Suggestions = resp.Suggestions[:ObserveTop]
+	}
+	return resp
+}
+
+// Observe samples a packet in from a device, if it is being observed. The
+// state is the criteria derived from the packet in for matching, so nothing
+// is decoded on the data path. When no device is being observed this is a
+// single atomic load.
+func (api *API) Observe(dpid uint64, state criteria.Criteria, frame []byte) {
+	if !api.Observing() {
+		return
+	}
+	api.lock.RLock()
+	o := api.observations[dpid]
+	api.lock.RUnlock()
+	if o != nil {
+		o.add(state, frame)
+	}
+}
+
+// Observing returns true while any device is observed, and observations are
+// not suspended, so the packet ins observed must be fully decoded
+func (api *API) Observing() bool {
+	return api != nil && atomic.LoadInt32(&api.observing) != 0 && atomic.LoadInt32(&api.suspended) == 0
+}
+
+// SuspendObservations suspends, or resumes, the sampling of packet ins by
+// observations, i.e. under memory pressure. The samples of the running
+// observations are released when suspended, so their summaries only cover
+// the packet ins observed while resumed, and are marked as suspended.
+func (api *API) SuspendObservations(suspend bool) {
+	if !suspend {
+		atomic.StoreInt32(&api.suspended, 0)
+		return
+	}
+	atomic.StoreInt32(&api.suspended, 1)
+	api.lock.RLock()
+	defer api.lock.RUnlock()
+	for _, o := range api.observations {
+		o.release()
+	}
+}
+
+// ObservationsSuspended returns true while observations are suspended
+func (api *API) ObservationsSuspended() bool {
+	return atomic.LoadInt32(&api.suspended) == 1
+}
+
+// ObserveHandler observes the packet ins from a device for the requested
+// duration and returns a summary of them, to help choose the match criteria
+// of an end point. Only one observation of a device may run at a time.
+func (api *API) ObserveHandler(resp http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if query.Get("dpid") == "" {
+		http.Error(resp, "Observation must specify 'dpid'", http.StatusBadRequest)
+		return
+	}
+	dpid, _, err := api.injector(query.Get("dpid"))
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusNotFound)
+		return
+	}
+	duration := DefaultObserveDuration
+	if value := query.Get("duration"); value != "" {
+		if duration, err = time.ParseDuration(value); err != nil || duration <= 0 || duration > MaxObserveDuration {
+			http.Error(resp, fmt.Sprintf("Invalid observation duration '%s', must be positive and at most %s",
+				value, MaxObserveDuration), http.StatusBadRequest)
+			return
+		}
+	}
+
+	o := newObservation()
+	api.lock.Lock()
+	if _, busy := api.observations[dpid]; busy {
+		api.lock.Unlock()
+		http.Error(resp, fmt.Sprintf("Device already being observed, '%s'", datapath.Format(dpid)), http.StatusConflict)
+		return
+	}
+	api.observations[dpid] = o
+	api.lock.Unlock()
+	atomic.AddInt32(&api.observing, 1)
+
+	log.WithFields(log.Fields{
+		"dpid":     datapath.Format(dpid),
+		"duration": duration,
+	}).Info("Observing packet ins")
+	started := time.Now()
+	timer := time.NewTimer(duration)
+	select {
+	case <-timer.C:
+	case <-req.Context().Done():
+		timer.Stop()
+	}
+
+	atomic.AddInt32(&api.observing, -1)
+	api.lock.Lock()
+	delete(api.observations, dpid)
+	api.lock.Unlock()
+
+	summary := o.summary()
+	summary.DPID = datapath.Format(dpid)
+	summary.Duration = time.Since(started).Round(time.Millisecond).String()
+	writeJSON(resp, http.StatusOK, summary)
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/criteria"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// buildFrame serializes the given layers into an Ethernet frame and derives
+// its state criteria as a packet in would be matched
+func buildFrame(t *testing.T, stack ...gopacket.SerializableLayer) ([]byte, criteria.Criteria) {
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, stack...); err != nil {
+		t.Fatal(err)
+	}
+	frame := buf.Bytes()
+	return frame, criteria.Criteria{Set: criteria.BitDLType, DlType: uint16(frame[12])<<8 | uint16(frame[13])}
+}
+
+func TestObserve(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.injectors[0x1] = &MockInjector{}
+
+	mac := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.IPv4zero, DstIP: net.IPv4bcast}
+	dhcp, dhcpState := buildFrame(t,
+		&layers.Ethernet{SrcMAC: mac, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv4},
+		ip, &layers.UDP{SrcPort: 68, DstPort: 67}, gopacket.Payload(make([]byte, 300)))
+	eapol, eapolState := buildFrame(t,
+		&layers.Ethernet{SrcMAC: mac, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeEAPOL},
+		gopacket.Payload(make([]byte, 46)))
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		resp := httptest.NewRecorder()
+		api.serveMux.ServeHTTP(resp, httptest.NewRequest("GET", "http://example.com/oftee/observe?dpid=0x1&duration=300ms", nil))
+		done <- resp
+	}()
+	for atomic.LoadInt32(&api.observing) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Only one observation of a device at a time
+	resp := httptest.NewRecorder()
+	api.serveMux.ServeHTTP(resp, httptest.NewRequest("GET", "http://example.com/oftee/observe?dpid=0x1", nil))
+	if resp.Code != 409 {
+		t.Errorf("Incorrect response code for concurrent observation, expected 409, got %d", resp.Code)
+	}
+
+	for i := 0; i < 50; i++ {
+		api.Observe(0x1, dhcpState, dhcp)
+	}
+	for i := 0; i < 30; i++ {
+		api.Observe(0x1, eapolState, eapol)
+		api.Observe(0x2, eapolState, eapol)
+	}
+
+	resp = <-done
+	if resp.Code != 200 {
+		t.Fatalf("Incorrect response code, expected 200, got %d", resp.Code)
+	}
+	var summary ObserveResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.DPID != "of:0x0000000000000001" || summary.Packets != 80 || summary.Sampled != 80 {
+		t.Errorf("Incorrect totals %+v", summary)
+	}
+	if len(summary.Ethertypes) != 2 || summary.Ethertypes[0] != (EthertypeCount{"0x8100", 50}) ||
+		summary.Ethertypes[1] != (EthertypeCount{"0x888e", 30}) {
+		t.Errorf("Incorrect ethertypes %+v", summary.Ethertypes)
+	}
+	if len(summary.VLANs) != 1 || summary.VLANs[0] != (VLANCount{100, 50}) {
+		t.Errorf("Incorrect VLANs %+v", summary.VLANs)
+	}
+	if len(summary.Flows) != 1 || summary.Flows[0] != (FlowCount{17, 67, 50}) {
+		t.Errorf("Incorrect flows %+v", summary.Flows)
+	}
+	if len(summary.Suggestions) != 2 || summary.Suggestions[1] != (Suggestion{"dl_type=0x888e", 30}) {
+		t.Errorf("Incorrect suggestions %+v", summary.Suggestions)
+	}
+
+	// Nothing is sampled once the observation has completed
+	api.Observe(0x1, eapolState, eapol)
+	if len(api.observations) != 0 {
+		t.Error("Expected observation removed once completed")
+	}
+}
+
+func TestObserveErrors(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.injectors[0x1] = &MockInjector{}
+
+	for query, code := range map[string]int{
+		"":                          400,
+		"?dpid=0x2":                 404,
+		"?dpid=0x1&duration=forver": 400,
+		"?dpid=0x1&duration=1h":     400,
+		"?dpid=0x1&duration=-1s":    400,
+	} {
+		resp := httptest.NewRecorder()
+		api.serveMux.ServeHTTP(resp, httptest.NewRequest("GET", "http://example.com/oftee/observe"+query, nil))
+		if resp.Code != code {
+			t.Errorf("Incorrect response code for '%s', expected %d, got %d", query, code, resp.Code)
+		}
+	}
+}
+
+func TestObserveBounded(t *testing.T) {
+	o := newObservation()
+	frame := make([]byte, 1500)
+	for i := 0; i < 10*ObserveSamples; i++ {
+		o.add(criteria.Criteria{Set: criteria.BitDLType, DlType: uint16(i)}, frame)
+	}
+	if o.packets != 10*ObserveSamples || len(o.samples) != ObserveSamples || len(o.clusters) != ObserveClusters {
+		t.Errorf("Expected %d samples and %d clusters, got %d and %d", ObserveSamples, ObserveClusters,
+			len(o.samples), len(o.clusters))
+	}
+	for _, sample := range o.samples {
+		if len(sample) != ObserveSnapLen {
+			t.Fatalf("Expected samples truncated to %d bytes, got %d", ObserveSnapLen, len(sample))
+		}
+	}
+	if summary := o.summary(); len(summary.Ethertypes) != ObserveTop || len(summary.Suggestions) != ObserveTop {
+		t.Errorf("Expected summary limited to %d entries, got %+v", ObserveTop, summary)
+	}
+}
+
+func TestObserveSuspended(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	o := newObservation()
+	api.observations[0x1] = o
+	api.observing = 1
+	state := criteria.Criteria{Set: criteria.BitDLType, DlType: 0x888e}
+	frame := make([]byte, 64)
+
+	// Suspending releases the samples, and nothing is sampled until
+	// resumed
+	api.Observe(0x1, state, frame)
+	api.SuspendObservations(true)
+	api.Observe(0x1, state, frame)
+	if o.packets != 1 || len(o.samples) != 0 || !api.ObservationsSuspended() {
+		t.Errorf("Expected the samples released while suspended, got %d packets and %d samples", o.packets, len(o.samples))
+	}
+	api.SuspendObservations(false)
+	api.Observe(0x1, state, frame)
+	if summary := o.summary(); summary.Packets != 2 || summary.Sampled != 1 || !summary.Suspended {
+		t.Errorf("Expected 1 sample once resumed, marked as suspended, got %+v", summary)
+	}
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/netrack/openflow"
+	"github.com/netrack/openflow/ofp"
+)
+
+// PacketOutRequest the JSON body of a packet out request, from which a packet
+// out is built for the OpenFlow version of the device. The frame is output to
+// `OutPort`, if given, and to the ports of the `output:{port}` actions, as if
+// received on `InPort`, by default `controller`.
+type PacketOutRequest struct {
+	OutPort PacketOutPort `json:"out_port"`
+	InPort  PacketOutPort `json:"in_port"`
+	Payload []byte        `json:"payload"`
+	Actions []string      `json:"actions"`
+}
+
+// PacketOutPort a port of a packet out request, either a number or the name
+// of a reserved port, i.e. `controller`
+type PacketOutPort string
+
+// UnmarshalJSON accepts a port as either a JSON number or string
+func (p *PacketOutPort) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*p = PacketOutPort(name)
+		return nil
+	}
+	var number uint32
+	if err := json.Unmarshal(data, &number); err != nil {
+		return fmt.Errorf("port must be a number or the name of a reserved port, got %s", data)
+	}
+	*p = PacketOutPort(strconv.FormatUint(uint64(number), 10))
+	return nil
+}
+
+// versionPort parses a port, see `parsePort`, of a device of the given
+// version. The reserved ports of OpenFlow 1.0 are the lower 16 bits of those of
+// OpenFlow 1.3.
+func versionPort(value string, version uint8) (uint32, error) {
+	port, err := parsePort(value)
+	if err != nil || version != ofVersion10 {
+		return uint32(port), err
+	}
+	switch {
+	case port >= ofp.PortIn:
+		return uint32(port) & 0xffff, nil
+	case port > 0xff00:
+		return 0, fmt.Errorf("port %d out of range for OpenFlow 1.0", port)
+	}
+	return uint32(port), nil
+}
+
+// decodePacketOut decodes a JSON packet out request and builds the packet out
+// for a device of the given version
+func decodePacketOut(body io.Reader, version uint8) ([]byte, error) {
+	var request PacketOutRequest
+	if err := json.NewDecoder(body).Decode(&request); err != nil {
+		return nil, fmt.Errorf("invalid JSON packet out: %s", err)
+	}
+	return buildJSONPacketOut(&request, version)
+}
+
+// packetOutLens returns the length of the header of a packet out, and of an
+// output action, for a device of the given version, if packet outs can be
+// built for it
+func packetOutLens(version uint8) (int, int, error) {
+	switch version {
+	case 0:
+		return 0, 0, errors.New("the OpenFlow version of the device is not yet known")
+	case ofVersion10:
+		return 16, 8, nil
+	case ofVersion13:
+		return 24, 16, nil
+	}
+	return 0, 0, fmt.Errorf("packet outs can't be built for OpenFlow version 0x%02x", version)
+}
+
+// buildJSONPacketOut builds the OpenFlow packet out of a request for a device
+// of the given version, whose transaction ID is left for the caller to set
+func buildJSONPacketOut(request *PacketOutRequest, version uint8) ([]byte, error) {
+	headerLen, outputLen, err := packetOutLens(version)
+	if err != nil {
+		return nil, err
+	}
+	if len(request.Payload) < 14 {
+		return nil, fmt.Errorf("payload must be a base64 encoded Ethernet frame, got %d bytes", len(request.Payload))
+	}
+	inPort := PacketOutPort("controller")
+	if request.InPort != "" {
+		inPort = request.InPort
+	}
+	in, err := versionPort(string(inPort), version)
+	if err != nil {
+		return nil, fmt.Errorf("in_port: %s", err)
+	}
+
+	// The out port is an output action, unless one already outputs to it
+	var outputs []uint32
+	for _, action := range request.Actions {
+		kind := strings.SplitN(action, ":", 2)
+		if len(kind) != 2 || strings.ToLower(kind[0]) != "output" {
+			return nil, fmt.Errorf("unsupported action '%s', only 'output:{port}' is supported", action)
+		}
+		port, err := versionPort(kind[1], version)
+		if err != nil {
+			return nil, fmt.Errorf("action '%s': %s", action, err)
+		}
+		outputs = append(outputs, port)
+	}
+	if request.OutPort != "" {
+		port, err := versionPort(string(request.OutPort), version)
+		if err != nil {
+			return nil, fmt.Errorf("out_port: %s", err)
+		}
+		found := false
+		for _, output := range outputs {
+			found = found || output == port
+		}
+		if !found {
+			outputs = append(outputs, port)
+		}
+	}
+	if len(outputs) == 0 {
+		return nil, errors.New("an out_port, or an output action, is required")
+	}
+
+	length := headerLen + len(outputs)*outputLen + len(request.Payload)
+	if length > 0xffff {
+		return nil, fmt.Errorf("payload of %d bytes too large for a packet out", len(request.Payload))
+	}
+	message := make([]byte, length)
+	message[0] = version
+	message[1] = uint8(openflow.TypePacketOut)
+	binary.BigEndian.PutUint16(message[2:], uint16(length))
+	binary.BigEndian.PutUint32(message[8:], 0xffffffff) // no buffer
+	actions := message[headerLen:]
+	for _, port := range outputs {
+		binary.BigEndian.PutUint16(actions[2:], uint16(outputLen))
+		if version == ofVersion10 {
+			binary.BigEndian.PutUint16(actions[4:], uint16(port))
+			binary.BigEndian.PutUint16(actions[6:], 0xffff) // whole frame
+		} else {
+			binary.BigEndian.PutUint32(actions[4:], port)
+			binary.BigEndian.PutUint16(actions[8:], 0xffff) // whole frame
+		}
+		actions = actions[outputLen:]
+	}
+	if version == ofVersion10 {
+		binary.BigEndian.PutUint16(message[12:], uint16(in))
+		binary.BigEndian.PutUint16(message[14:], uint16(len(outputs)*outputLen))
+	} else {
+		binary.BigEndian.PutUint32(message[12:], in)
+		binary.BigEndian.PutUint16(message[16:], uint16(len(outputs)*outputLen))
+	}
+	copy(actions, request.Payload)
+	return message, nil
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/netrack/openflow"
+	"github.com/netrack/openflow/ofp"
+)
+
+func jsonFrame() []byte {
+	frame := make([]byte, 60)
+	binary.BigEndian.PutUint16(frame[12:], 0x0806)
+	return frame
+}
+
+func TestBuildJSONPacketOut13(t *testing.T) {
+	// The same packet out the openflow package builds, but for the
+	// transaction ID
+	frame := jsonFrame()
+	message, err := buildJSONPacketOut(&PacketOutRequest{OutPort: "12", Payload: frame}, ofVersion13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := &bytes.Buffer{}
+	(&ofp.PacketOut{
+		Buffer:  ofp.NoBuffer,
+		InPort:  ofp.PortController,
+		Actions: ofp.Actions{&ofp.ActionOutput{Port: 12, MaxLen: ofp.ContentLenNoBuffer}},
+	}).WriteTo(body)
+	body.Write(frame)
+	packetOut := &bytes.Buffer{}
+	openflow.NewRequest(openflow.TypePacketOut, body).WriteTo(packetOut)
+	expected := packetOut.Bytes()
+	if !bytes.Equal(message[:4], expected[:4]) || !bytes.Equal(message[8:], expected[8:]) {
+		t.Errorf("Expected packet out %02x, got %02x", expected, message)
+	}
+	if err = validatePacketOut(message, ofVersion13); err != nil {
+		t.Errorf("Expected a valid packet out, got %v", err)
+	}
+
+	// The out port isn't repeated by the actions
+	message, err = buildJSONPacketOut(&PacketOutRequest{
+		OutPort: "12",
+		InPort:  "3",
+		Payload: frame,
+		Actions: []string{"output:12", "output:flood"},
+	}, ofVersion13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in, actions := binary.BigEndian.Uint32(message[12:]), binary.BigEndian.Uint16(message[16:]); in != 3 || actions != 32 {
+		t.Errorf("Expected in port 3 and 2 actions, got %d and %d bytes", in, actions)
+	}
+	if flood := ofp.PortNo(binary.BigEndian.Uint32(message[24+16+4:])); flood != ofp.PortFlood {
+		t.Errorf("Expected output to flood, got 0x%x", flood)
+	}
+}
+
+func TestBuildJSONPacketOut10(t *testing.T) {
+	frame := jsonFrame()
+	message, err := buildJSONPacketOut(&PacketOutRequest{OutPort: "2", Payload: frame}, ofVersion10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []byte{
+		0x01, 13, 0, byte(16 + 8 + len(frame)), 0, 0, 0, 0,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xfd, 0, 8, // no buffer, from controller
+		0, 0, 0, 8, 0, 2, 0xff, 0xff, // output:2
+	}
+	if !bytes.Equal(message[:len(header)], header) || !bytes.Equal(message[len(header):], frame) {
+		t.Errorf("Expected packet out %02x, got %02x", header, message)
+	}
+	if _, err = buildJSONPacketOut(&PacketOutRequest{OutPort: "65280", Payload: frame}, ofVersion10); err != nil {
+		t.Errorf("Expected the largest OpenFlow 1.0 port accepted, got %v", err)
+	}
+}
+
+func TestBuildJSONPacketOutInvalid(t *testing.T) {
+	frame := jsonFrame()
+	for _, invalid := range []struct {
+		request PacketOutRequest
+		version uint8
+		err     string
+	}{
+		{PacketOutRequest{OutPort: "1", Payload: frame}, 0, "not yet known"},
+		{PacketOutRequest{OutPort: "1", Payload: frame}, 0x05, "version 0x05"},
+		{PacketOutRequest{OutPort: "1"}, ofVersion13, "payload must be"},
+		{PacketOutRequest{OutPort: "1", Payload: frame[:10]}, ofVersion13, "got 10 bytes"},
+		{PacketOutRequest{Payload: frame}, ofVersion13, "out_port, or an output action, is required"},
+		{PacketOutRequest{OutPort: "0", Payload: frame}, ofVersion13, "out_port"},
+		{PacketOutRequest{OutPort: "65281", Payload: frame}, ofVersion10, "out of range for OpenFlow 1.0"},
+		{PacketOutRequest{InPort: "nowhere", OutPort: "1", Payload: frame}, ofVersion13, "in_port"},
+		{PacketOutRequest{Actions: []string{"drop"}, Payload: frame}, ofVersion13, "unsupported action 'drop'"},
+		{PacketOutRequest{Actions: []string{"output:x"}, Payload: frame}, ofVersion13, "action 'output:x'"},
+		{PacketOutRequest{OutPort: "1", Payload: make([]byte, 0xffff)}, ofVersion13, "too large"},
+	} {
+		if _, err := buildJSONPacketOut(&invalid.request, invalid.version); err == nil || !strings.Contains(err.Error(), invalid.err) {
+			t.Errorf("Expected error '%s' for %+v, got %v", invalid.err, invalid.request, err)
+		}
+	}
+}
+
+func TestPacketOutJSON(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	mock := &MockInjector{DPID: 0x1}
+	api.injectors[0x1] = mock
+	api.versions[0x1] = ofVersion13
+
+	payload := base64.StdEncoding.EncodeToString(jsonFrame())
+	for _, body := range []string{
+		`{"out_port": 12, "in_port": "controller", "payload": "` + payload + `", "actions": ["output:12"]}`,
+		`{"out_port": "flood", "payload": "` + payload + `"}`,
+	} {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "http://example.com:4242/oftee/0x1", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		api.serveMux.ServeHTTP(resp, req)
+		if resp.Code != 200 {
+			t.Errorf("Expected packet out %s injected, got %d %s", body, resp.Code, resp.Body)
+		}
+	}
+	if len(mock.Messages) != 2 || mock.Messages[0][0] != ofVersion13 || binary.BigEndian.Uint16(mock.Messages[0][16:]) != 16 {
+		t.Fatalf("Expected 2 OpenFlow 1.3 packet outs with one action, got %02x", mock.Messages)
+	}
+	if xid := binary.BigEndian.Uint32(mock.Messages[0][4:]); xid == 0 {
+		t.Error("Expected the packet out given a transaction ID")
+	}
+
+	// Invalid requests are rejected, with the reason
+	for body, reason := range map[string]string{
+		`{"out_port": 12, "payload": "not base64"}`:                              "invalid JSON packet out",
+		`{"out_port": [12], "payload": "` + payload + `"}`:                       "port must be a number",
+		`{"out_port": 12, "payload": "` + payload + `", "actions": ["group:1"]}`: "unsupported action",
+	} {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "http://example.com:4242/oftee/0x1", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		api.serveMux.ServeHTTP(resp, req)
+		if resp.Code != 400 || !strings.Contains(resp.Body.String(), reason) {
+			t.Errorf("Expected %s rejected with '%s', got %d %s", body, reason, resp.Code, resp.Body)
+		}
+	}
+	if len(mock.Messages) != 2 {
+		t.Errorf("Expected no invalid packet out injected, got %d", len(mock.Messages))
+	}
+}
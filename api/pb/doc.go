@@ -0,0 +1,6 @@
+// Package pb contains the protocol buffer definitions of the oftee gRPC
+// management API, and of the stream to gRPC tee end points, and the code
+// generated from them.
+package pb
+
+//go:generate protoc --go_out=plugins=grpc:. oftee.proto tee.proto
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ciena/oftee/datapath"
+	"github.com/gorilla/mux"
+	"github.com/netrack/openflow/ofp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MaxPortsPerDevice maximum number of ports tracked for a single
+	// device
+	MaxPortsPerDevice = 4096
+
+	// PortSize10 length of an OpenFlow 1.0 port description
+	PortSize10 = 48
+)
+
+// PortInfo describes a port of a device, as learned from the port
+// descriptions and port status messages sent by the device
+type PortInfo struct {
+	Number    uint32 `json:"number"`
+	Name      string `json:"name"`
+	HWAddr    string `json:"hw_addr"`
+	AdminDown bool   `json:"admin_down"`
+	LinkDown  bool   `json:"link_down"`
+	CurrSpeed uint32 `json:"curr_speed_kbps"`
+	MaxSpeed  uint32 `json:"max_speed_kbps"`
+}
+
+// PortsResponse is used to create a HTTP response that lists the ports of a
+// device
+type PortsResponse struct {
+	DPID  string     `json:"dpid"`
+	Ports []PortInfo `json:"ports"`
+}
+
+// NewPortInfo creates the port information from an OpenFlow port description
+func NewPortInfo(port *ofp.Port) PortInfo {
+	return PortInfo{
+		Number:    uint32(port.PortNo),
+		Name:      strings.TrimRight(port.Name, "\x00"),
+		HWAddr:    port.HWAddr.String(),
+		AdminDown: port.Config&ofp.PortConfigDown != 0,
+		LinkDown:  port.State&ofp.PortStateLinkDown != 0,
+		CurrSpeed: port.CurrSpeed,
+		MaxSpeed:  port.MaxSpeed,
+	}
+}
+
+// NewPortInfo10 creates the port information from an OpenFlow 1.0 port
+// description, of `PortSize10` bytes. OpenFlow 1.0 has no port speeds, so
+// they are those of the fastest of the current, and supported, features.
+func NewPortInfo10(data []byte) PortInfo {
+	return PortInfo{
+		Number:    uint32(binary.BigEndian.Uint16(data)),
+		Name:      strings.TrimRight(string(data[8:24]), "\x00"),
+		HWAddr:    net.HardwareAddr(data[2:8]).String(),
+		AdminDown: binary.BigEndian.Uint32(data[24:])&uint32(ofp.PortConfigDown) != 0,
+		LinkDown:  binary.BigEndian.Uint32(data[28:])&uint32(ofp.PortStateLinkDown) != 0,
+		CurrSpeed: speed10(binary.BigEndian.Uint32(data[32:])),
+		MaxSpeed:  speed10(binary.BigEndian.Uint32(data[40:])),
+	}
+}
+
+// NewPortInfos10 creates the port information from consecutive OpenFlow 1.0
+// port descriptions, i.e. those of a features reply
+func NewPortInfos10(data []byte) []PortInfo {
+	ports := make([]PortInfo, 0, len(data)/PortSize10)
+	for ; len(data) >= PortSize10; data = data[PortSize10:] {
+		ports = append(ports, NewPortInfo10(data))
+	}
+	return ports
+}
+
+// speed10 returns the speed, in kbps, of the fastest of the OpenFlow 1.0
+// port features, 0 if none
+func speed10(features uint32) uint32 {
+	switch {
+	case features&(1<<6) != 0:
+		return 10000000
+	case features&(1<<4|1<<5) != 0:
+		return 1000000
+	case features&(1<<2|1<<3) != 0:
+		return 100000
+	case features&(1<<0|1<<1) != 0:
+		return 10000
+	}
+	return 0
+}
+
+// UpdatePort adds or replaces a port of a device, returning false if it is
+// not tracked. Once the device has MaxPortsPerDevice ports, new ports are
+// ignored.
+func (api *API) UpdatePort(dpid uint64, port PortInfo) bool {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	ports, ok := api.ports[dpid]
+	if !ok {
+		ports = make(map[uint32]PortInfo)
+		api.ports[dpid] = ports
+	}
+	if _, ok = ports[port.Number]; !ok && len(ports) >= MaxPortsPerDevice {
+		log.WithFields(log.Fields{
+			"dpid": datapath.Format(dpid),
+			"port": port.Number,
+		}).Warn("Too many ports for device, not tracking port")
+		return false
+	}
+	ports[port.Number] = port
+	return true
+}
+
+// DeletePort removes a port of a device
+func (api *API) DeletePort(dpid uint64, number uint32) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	delete(api.ports[dpid], number)
+}
+
+// Port returns the information for a port of a device, if known
+func (api *API) Port(dpid uint64, number uint32) (PortInfo, bool) {
+	api.lock.RLock()
+	defer api.lock.RUnlock()
+	port, ok := api.ports[dpid][number]
+	return port, ok
+}
+
+// ListPortsHandler returns the ports of a device, ordered by port number
+func (api *API) ListPortsHandler(resp http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	dpid, _, err := api.injector(vars["dpid"])
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	api.lock.RLock()
+	data := PortsResponse{
+		DPID:  datapath.Format(dpid),
+		Ports: make([]PortInfo, 0, len(api.ports[dpid])),
+	}
+	for _, port := range api.ports[dpid] {
+		data.Ports = append(data.Ports, port)
+	}
+	api.lock.RUnlock()
+	sort.Slice(data.Ports, func(i, j int) bool {
+		return data.Ports[i].Number < data.Ports[j].Number
+	})
+	writeJSON(resp, http.StatusOK, data)
+}
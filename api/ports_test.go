@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestListPorts(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.injectors[0x1] = &MockInjector{}
+	for _, number := range []uint32{3, 1, 2} {
+		api.UpdatePort(0x1, PortInfo{Number: number, Name: "eth"})
+	}
+	api.UpdatePort(0x1, PortInfo{Number: 2, Name: "uplink"})
+	api.DeletePort(0x1, 3)
+
+	resp := httptest.NewRecorder()
+	api.serveMux.ServeHTTP(resp, httptest.NewRequest("GET", "http://example.com/oftee/0x1/ports", nil))
+	if resp.Code != 200 {
+		t.Fatalf("Incorrect response code, expected 200, got %d", resp.Code)
+	}
+	var data PortsResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Ports) != 2 || data.Ports[0].Number != 1 || data.Ports[1].Name != "uplink" {
+		t.Errorf("Incorrect ports, got %+v", data.Ports)
+	}
+
+	resp = httptest.NewRecorder()
+	api.serveMux.ServeHTTP(resp, httptest.NewRequest("GET", "http://example.com/oftee/0x2/ports", nil))
+	if resp.Code != 404 {
+		t.Errorf("Incorrect response code for unknown device, expected 404, got %d", resp.Code)
+	}
+}
+
+func TestPortsBounded(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	for i := 0; i < MaxPortsPerDevice; i++ {
+		api.UpdatePort(0x1, PortInfo{Number: uint32(i)})
+	}
+	if api.UpdatePort(0x1, PortInfo{Number: MaxPortsPerDevice}) {
+		t.Error("Expected a port beyond the limit not tracked")
+	}
+	if len(api.ports[0x1]) != MaxPortsPerDevice {
+		t.Errorf("Expected %d ports, got %d", MaxPortsPerDevice, len(api.ports[0x1]))
+	}
+	// Existing ports can still be updated
+	api.UpdatePort(0x1, PortInfo{Number: 0, Name: "updated"})
+	if port, _ := api.Port(0x1, 0); port.Name != "updated" {
+		t.Errorf("Expected existing port to be updated, got %+v", port)
+	}
+}
+
+func TestNewPortInfos10(t *testing.T) {
+	port := func(no uint16, name string, state, curr uint32) []byte {
+		data := make([]byte, PortSize10)
+		binary.BigEndian.PutUint16(data, no)
+		copy(data[2:], []byte{0, 0, 0, 0, 0, byte(no)})
+		copy(data[8:], name)
+		binary.BigEndian.PutUint32(data[28:], state)
+		binary.BigEndian.PutUint32(data[32:], curr)
+		binary.BigEndian.PutUint32(data[40:], 1<<6|curr)
+		return data
+	}
+
+	// Consecutive descriptions are decoded, a trailing partial one is not
+	data := append(port(1, "eth1", 0, 1<<5), port(2, "eth2", 1, 1<<3)...)
+	ports := NewPortInfos10(append(data, 0, 1))
+	expected := []PortInfo{
+		{Number: 1, Name: "eth1", HWAddr: "00:00:00:00:00:01", CurrSpeed: 1000000, MaxSpeed: 10000000},
+		{Number: 2, Name: "eth2", HWAddr: "00:00:00:00:00:02", LinkDown: true, CurrSpeed: 100000, MaxSpeed: 10000000},
+	}
+	if len(ports) != len(expected) || ports[0] != expected[0] || ports[1] != expected[1] {
+		t.Errorf("Expected ports %+v, got %+v", expected, ports)
+	}
+}
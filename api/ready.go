@@ -0,0 +1,39 @@
+package api
+
+import (
+	"net/http"
+)
+
+// ReadyHandler returns the state of the subsystems of the process, with a
+// 200 status if it is ready and a 503 if it is not, so that the process is
+// restarted, or taken out of service, by its supervisor rather than exiting
+// on the failure of a single subsystem
+func (api *API) ReadyHandler(resp http.ResponseWriter, req *http.Request) {
+	if api.Readiness == nil {
+		writeJSON(resp, http.StatusOK, map[string]interface{}{})
+		return
+	}
+	ready, state := api.Readiness()
+	if !ready {
+		writeJSON(resp, http.StatusServiceUnavailable, state)
+		return
+	}
+	writeJSON(resp, http.StatusOK, state)
+}
+
+// HealthHandler returns whether the process is alive, with a 200 status if
+// it is and a 503 if it is not, so that it is restarted by its supervisor.
+// Unlike readiness it doesn't depend on the SDN controller or the end
+// points, whose failures a restart wouldn't fix.
+func (api *API) HealthHandler(resp http.ResponseWriter, req *http.Request) {
+	if api.Health == nil {
+		writeJSON(resp, http.StatusOK, map[string]interface{}{})
+		return
+	}
+	alive, state := api.Health()
+	if !alive {
+		writeJSON(resp, http.StatusServiceUnavailable, state)
+		return
+	}
+	writeJSON(resp, http.StatusOK, state)
+}
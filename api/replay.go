@@ -0,0 +1,401 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciena/oftee/datapath"
+	"github.com/ciena/oftee/injector"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/gorilla/mux"
+	"github.com/netrack/openflow/ofp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Replay limits
+const (
+	// MaxReplayUpload maximum size, in bytes, of an uploaded pcap file and
+	// of the frames it contains, once decompressed
+	MaxReplayUpload = 32 << 20
+
+	// MaxReplayFrames maximum number of frames replayed from a pcap file,
+	// files with more frames are rejected
+	MaxReplayFrames = 100000
+
+	// MaxReplaySnaplen maximum snap length of an uploaded pcap file, which
+	// bounds the size of a single captured frame
+	MaxReplaySnaplen = 262144
+
+	// ReplayRetention how long the status of a completed asynchronous
+	// replay is kept so that it can be polled
+	ReplayRetention = 10 * time.Minute
+)
+
+// Replay timing modes
+const (
+	// ReplayModeBurst frames are sent as fast as the device accepts them
+	ReplayModeBurst = "burst"
+
+	// ReplayModeTimed frames are sent with the inter frame gaps of the
+	// capture
+	ReplayModeTimed = "timed"
+
+	// ReplayModeRate frames are sent at a fixed rate, frames per second
+	ReplayModeRate = "rate"
+)
+
+// Replay states
+const (
+	ReplayStateRunning  = "running"
+	ReplayStateComplete = "complete"
+	ReplayStateFailed   = "failed"
+)
+
+// ReplayStatus is used to create a HTTP response that reports the progress
+// or result of a pcap replay
+type ReplayStatus struct {
+	ID       string `json:"id,omitempty"`
+	DPID     string `json:"dpid"`
+	State    string `json:"state"`
+	Frames   int    `json:"frames"`
+	Sent     uint64 `json:"sent"`
+	Skipped  uint64 `json:"skipped"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+
+	// Errors counts the error messages the device returned for the
+	// packet outs, LastError is the type and code of the last of them
+	Errors    uint64 `json:"errors,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// replay is a pcap file being sent to a device as packet outs
+type replay struct {
+	id       string
+	dpid     uint64
+	version  uint8
+	port     PacketOutPort
+	mode     string
+	interval time.Duration
+	frames   [][]byte
+	times    []time.Time
+	inject   injector.Injector
+	xids     *xidTracker
+	started  time.Time
+	sent     uint64
+	skipped  uint64
+
+	lock      sync.Mutex
+	state     string
+	ended     time.Time
+	err       error
+	errors    uint64
+	lastError string
+}
+
+// Status returns the current progress of the replay
+func (r *replay) Status() ReplayStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	end := r.ended
+	if end.IsZero() {
+		end = time.Now()
+	}
+	status := ReplayStatus{
+		ID:       r.id,
+		DPID:     datapath.Format(r.dpid),
+		State:    r.state,
+		Frames:   len(r.frames),
+		Sent:     atomic.LoadUint64(&r.sent),
+		Skipped:  atomic.LoadUint64(&r.skipped),
+		Duration: end.Sub(r.started).String(),
+	}
+	if r.err != nil {
+		status.Error = r.err.Error()
+	}
+	status.Errors = r.errors
+	status.LastError = r.lastError
+	return status
+}
+
+// recordError counts an error message returned by the device for one of the
+// packet outs of the replay
+func (r *replay) recordError(class string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.errors++
+	r.lastError = class
+}
+
+// finish marks the replay as complete, or failed if an error is given
+func (r *replay) finish(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ended = time.Now()
+	r.err = err
+	r.state = ReplayStateComplete
+	if err != nil {
+		r.state = ReplayStateFailed
+	}
+}
+
+// expired returns true if the replay completed more than ReplayRetention ago
+func (r *replay) expired() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return !r.ended.IsZero() && time.Since(r.ended) > ReplayRetention
+}
+
+// buildPacketOut builds an OpenFlow packet out message, for a device of the
+// given version, that outputs a frame to a port
+func buildPacketOut(version uint8, port PacketOutPort, frame []byte) ([]byte, error) {
+	message, err := buildJSONPacketOut(&PacketOutRequest{OutPort: port, Payload: frame}, version)
+	if err != nil {
+		return nil, err
+	}
+	if err = validatePacketOut(message, version); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// run sends the frames of the replay to the device
+func (r *replay) run() {
+	var err error
+	for i, frame := range r.frames {
+		switch r.mode {
+		case ReplayModeTimed:
+			time.Sleep(time.Until(r.started.Add(r.times[i].Sub(r.times[0]))))
+		case ReplayModeRate:
+			time.Sleep(time.Until(r.started.Add(time.Duration(i) * r.interval)))
+		}
+		if !r.inject.Healthy() {
+			err = fmt.Errorf("device disconnected after %d frames", atomic.LoadUint64(&r.sent))
+			break
+		}
+		message, buildErr := buildPacketOut(r.version, r.port, frame)
+		if buildErr != nil {
+			atomic.AddUint64(&r.skipped, 1)
+			continue
+		}
+		r.xids.stamp(r.dpid, message, r)
+		r.inject.Inject(context.Background(), message)
+		atomic.AddUint64(&r.sent, 1)
+	}
+	r.finish(err)
+	status := r.Status()
+	log.WithFields(log.Fields{
+		"dpid":     status.DPID,
+		"sent":     status.Sent,
+		"skipped":  status.Skipped,
+		"duration": status.Duration,
+	}).WithError(err).Info("Replay finished")
+}
+
+// parsePort parses an output port, either a port number or the name of a
+// reserved port, i.e. `flood`
+func parsePort(value string) (ofp.PortNo, error) {
+	switch strings.ToLower(value) {
+	case "in":
+		return ofp.PortIn, nil
+	case "table":
+		return ofp.PortTable, nil
+	case "normal":
+		return ofp.PortNormal, nil
+	case "flood":
+		return ofp.PortFlood, nil
+	case "all":
+		return ofp.PortAll, nil
+	case "controller":
+		return ofp.PortController, nil
+	case "local":
+		return ofp.PortLocal, nil
+	}
+	port, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port '%s'", value)
+	}
+	if ofp.PortNo(port) > ofp.PortMax || port == 0 {
+		return 0, fmt.Errorf("port %d out of range", port)
+	}
+	return ofp.PortNo(port), nil
+}
+
+// readPcap reads the frames from a pcap file upload, either the raw request
+// body or the `file` part of a multipart form
+func readPcap(req *http.Request) ([][]byte, []time.Time, error) {
+	var reader io.Reader = req.Body
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-type")); mediaType == "multipart/form-data" {
+		parts, err := req.MultipartReader()
+		if err != nil {
+			return nil, nil, err
+		}
+		for {
+			part, err := parts.NextPart()
+			if err == io.EOF {
+				return nil, nil, fmt.Errorf("no 'file' part in upload")
+			} else if err != nil {
+				return nil, nil, err
+			}
+			if part.FormName() == "file" {
+				reader = part
+				break
+			}
+		}
+	}
+
+	pcap, err := pcapgo.NewReader(reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid pcap file: %s", err)
+	}
+	if pcap.LinkType() != layers.LinkTypeEthernet {
+		return nil, nil, fmt.Errorf("unsupported pcap link type '%s', only Ethernet is supported", pcap.LinkType())
+	}
+	if pcap.Snaplen() > MaxReplaySnaplen {
+		return nil, nil, fmt.Errorf("pcap snap length %d exceeds maximum of %d", pcap.Snaplen(), MaxReplaySnaplen)
+	}
+
+	var (
+		frames [][]byte
+		times  []time.Time
+		total  int
+	)
+	for {
+		data, ci, err := pcap.ReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("invalid pcap file: %s", err)
+		}
+		if len(frames) == MaxReplayFrames {
+			return nil, nil, fmt.Errorf("pcap file exceeds maximum of %d frames", MaxReplayFrames)
+		}
+		if total += len(data); total > MaxReplayUpload {
+			return nil, nil, fmt.Errorf("pcap frames exceed maximum of %d bytes", MaxReplayUpload)
+		}
+		frames = append(frames, data)
+		times = append(times, ci.Timestamp)
+	}
+	return frames, times, nil
+}
+
+// ReplayHandler handles an HTTP request to replay a pcap file, sending each
+// captured frame to the device as a packet out, built for the OpenFlow version
+// of the device, that outputs it to the port given by the `port` query
+// parameter. The `mode` query parameter selects the
+// timing of the frames, `burst` (default), `timed` or `rate`, the latter
+// sending `rate` frames per second. When `async=true` the replay continues in
+// the background and its progress can be polled.
+func (api *API) ReplayHandler(resp http.ResponseWriter, req *http.Request) {
+	defer api.close(req.Body)
+
+	vars := mux.Vars(req)
+	dpid, inject, err := api.injector(vars["dpid"])
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !inject.Healthy() {
+		http.Error(resp, fmt.Sprintf("DPID not connected, '%s'", vars["dpid"]), http.StatusNotFound)
+		return
+	}
+
+	// The packet outs are built for the version of the device
+	query := req.URL.Query()
+	r := &replay{
+		dpid:    dpid,
+		version: api.version(dpid),
+		port:    PacketOutPort(query.Get("port")),
+		mode:    strings.ToLower(query.Get("mode")),
+		inject:  inject,
+		xids:    &api.xids,
+		state:   ReplayStateRunning,
+	}
+	if _, _, err = packetOutLens(r.version); err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err = versionPort(string(r.port), r.version); err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.mode {
+	case "":
+		r.mode = ReplayModeBurst
+	case ReplayModeBurst, ReplayModeTimed:
+	case ReplayModeRate:
+		rate, err := strconv.ParseFloat(query.Get("rate"), 64)
+		if err != nil || rate <= 0 {
+			http.Error(resp, fmt.Sprintf("invalid rate '%s'", query.Get("rate")), http.StatusBadRequest)
+			return
+		}
+		r.interval = time.Duration(float64(time.Second) / rate)
+	default:
+		http.Error(resp, fmt.Sprintf("unknown mode '%s'", r.mode), http.StatusBadRequest)
+		return
+	}
+	async, err := queryBool(req, "async")
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(resp, req.Body, MaxReplayUpload)
+	if r.frames, r.times, err = readPcap(req); err != nil {
+		log.WithFields(log.Fields{
+			"dpid": datapath.Format(dpid),
+		}).WithError(err).Warn("Replay rejected: unable to read pcap file")
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.started = time.Now()
+	if !async {
+		r.run()
+		writeJSON(resp, http.StatusOK, r.Status())
+		return
+	}
+
+	api.lock.Lock()
+	for id, old := range api.replays {
+		if old.expired() {
+			delete(api.replays, id)
+		}
+	}
+	api.replayID++
+	r.id = strconv.FormatUint(api.replayID, 10)
+	api.replays[r.id] = r
+	api.lock.Unlock()
+
+	go r.run()
+	resp.Header().Set("Location", fmt.Sprintf("/oftee/%s/replay/%s", datapath.Format(dpid), r.id))
+	writeJSON(resp, http.StatusAccepted, r.Status())
+}
+
+// ReplayStatusHandler handles an HTTP request for the progress of an
+// asynchronous replay
+func (api *API) ReplayStatusHandler(resp http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	dpid, err := datapath.Parse(vars["dpid"])
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("DPID doesn't reference a device, '%s' : %s", vars["dpid"], err), http.StatusNotFound)
+		return
+	}
+	api.lock.RLock()
+	r, ok := api.replays[vars["id"]]
+	api.lock.RUnlock()
+	if !ok || r.dpid != dpid {
+		http.Error(resp, fmt.Sprintf("Unknown replay, '%s'", vars["id"]), http.StatusNotFound)
+		return
+	}
+	writeJSON(resp, http.StatusOK, r.Status())
+}
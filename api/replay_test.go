@@ -0,0 +1,181 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/netrack/openflow"
+	"github.com/netrack/openflow/ofp"
+)
+
+// pcapFile builds a pcap file containing frames of the given sizes, captured
+// 10ms apart
+func pcapFile(t *testing.T, linkType layers.LinkType, sizes ...int) []byte {
+	buf := &bytes.Buffer{}
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(MaxReplaySnaplen, linkType); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i, size := range sizes {
+		ci := gopacket.CaptureInfo{
+			Timestamp:     start.Add(time.Duration(i) * 10 * time.Millisecond),
+			CaptureLength: size,
+			Length:        size,
+		}
+		if err := w.WritePacket(ci, make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func replayRequest(api *API, url string, body []byte) (*httptest.ResponseRecorder, ReplayStatus) {
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", url, bytes.NewReader(body))
+	req.Header.Add("Content-type", "application/vnd.tcpdump.pcap")
+	api.serveMux.ServeHTTP(resp, req)
+	var status ReplayStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	return resp, status
+}
+
+func TestReplay(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	mock := &MockInjector{}
+	api.injectors[0x1] = mock
+	api.versions[0x1] = ofVersion13
+
+	// The 70000 byte frame can't fit in a packet out so is skipped
+	resp, status := replayRequest(api, "/oftee/0x1/replay?port=3", pcapFile(t, layers.LinkTypeEthernet, 60, 70000, 1500))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Incorrect response code, expected 200, got %d", resp.Code)
+	}
+	if status.State != ReplayStateComplete || status.Frames != 3 || status.Sent != 2 || status.Skipped != 1 {
+		t.Errorf("Incorrect replay status, got %+v", status)
+	}
+	if len(mock.Messages) != 2 {
+		t.Fatalf("Expected 2 packet outs, got %d", len(mock.Messages))
+	}
+
+	var (
+		header    openflow.Header
+		packetOut ofp.PacketOut
+	)
+	reader := bytes.NewReader(mock.Messages[1])
+	header.ReadFrom(reader)
+	packetOut.ReadFrom(reader)
+	if header.Type != openflow.TypePacketOut || int(header.Length) != len(mock.Messages[1]) {
+		t.Errorf("Incorrect packet out header, got %+v", header)
+	}
+	if len(packetOut.Actions) != 1 || packetOut.Actions[0].(*ofp.ActionOutput).Port != 3 {
+		t.Errorf("Incorrect packet out actions, got %+v", packetOut.Actions)
+	}
+}
+
+func TestReplayOpenFlow10(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	mock := &MockInjector{}
+	api.injectors[0x1] = mock
+	api.versions[0x1] = ofVersion10
+
+	resp, status := replayRequest(api, "/oftee/0x1/replay?port=flood", pcapFile(t, layers.LinkTypeEthernet, 60))
+	if resp.Code != http.StatusOK || status.Sent != 1 || len(mock.Messages) != 1 {
+		t.Fatalf("Expected 1 packet out, got %d %+v", resp.Code, status)
+	}
+
+	// The packet out has the OpenFlow 1.0 layout, outputting the frame to
+	// the 16 bit flood port, as if received from the controller
+	message := mock.Messages[0]
+	if message[0] != ofVersion10 || openflow.Type(message[1]) != openflow.TypePacketOut || len(message) != 16+8+60 {
+		t.Fatalf("Expected an OpenFlow 1.0 packet out, got %02x", message)
+	}
+	if err := validatePacketOut(message, ofVersion10); err != nil {
+		t.Error(err)
+	}
+	if inPort := binary.BigEndian.Uint16(message[12:]); inPort != 0xfffd {
+		t.Errorf("Expected in port controller, got 0x%x", inPort)
+	}
+	if port := binary.BigEndian.Uint16(message[16+4:]); port != 0xfffb {
+		t.Errorf("Expected output to flood, got 0x%x", port)
+	}
+}
+
+func TestReplayMultipartAsync(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	mock := &MockInjector{}
+	api.injectors[0x1] = mock
+	api.versions[0x1] = ofVersion13
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, _ := form.CreateFormFile("file", "sample.pcap")
+	part.Write(pcapFile(t, layers.LinkTypeEthernet, 60, 60, 60))
+	form.Close()
+
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/oftee/0x1/replay?port=flood&mode=timed&async=true", body)
+	req.Header.Add("Content-type", form.FormDataContentType())
+	api.serveMux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusAccepted {
+		t.Fatalf("Incorrect response code, expected 202, got %d", resp.Code)
+	}
+	location := resp.Header().Get("Location")
+
+	var status ReplayStatus
+	deadline := time.Now().Add(2 * time.Second)
+	for status.State != ReplayStateComplete && time.Now().Before(deadline) {
+		resp = httptest.NewRecorder()
+		api.serveMux.ServeHTTP(resp, httptest.NewRequest("GET", location, nil))
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Incorrect response code polling replay, expected 200, got %d", resp.Code)
+		}
+		json.NewDecoder(resp.Body).Decode(&status)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if status.State != ReplayStateComplete || status.Sent != 3 {
+		t.Fatalf("Incorrect replay status, got %+v", status)
+	}
+	if len(mock.Messages) != 3 {
+		t.Errorf("Expected 3 packet outs, got %d", len(mock.Messages))
+	}
+}
+
+func TestReplayRejected(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.injectors[0x1] = &MockInjector{}
+	api.injectors[0x2] = &MockInjector{Unhealthy: true}
+	api.injectors[0x4] = &MockInjector{}
+	api.versions[0x1] = ofVersion10
+	valid := pcapFile(t, layers.LinkTypeEthernet, 60)
+
+	for _, test := range []struct {
+		url  string
+		body []byte
+		code int
+	}{
+		{"/oftee/0x3/replay?port=1", valid, http.StatusNotFound},
+		{"/oftee/0x2/replay?port=1", valid, http.StatusNotFound},
+		{"/oftee/0x1/replay", valid, http.StatusBadRequest},
+		{"/oftee/0x1/replay?port=1&mode=warp", valid, http.StatusBadRequest},
+		{"/oftee/0x1/replay?port=1&mode=rate", valid, http.StatusBadRequest},
+		{"/oftee/0x1/replay?port=1", []byte("not a pcap file"), http.StatusBadRequest},
+		{"/oftee/0x1/replay?port=1", pcapFile(t, layers.LinkTypeRaw, 60), http.StatusBadRequest},
+		{"/oftee/0x1/replay?port=65281", valid, http.StatusBadRequest},
+		{"/oftee/0x4/replay?port=1", valid, http.StatusBadRequest},
+		{"/oftee/0x1/replay/1", nil, http.StatusMethodNotAllowed},
+	} {
+		if resp, _ := replayRequest(api, test.url, test.body); resp.Code != test.code {
+			t.Errorf("Incorrect response code for '%s', expected %d, got %d", test.url, test.code, resp.Code)
+		}
+	}
+}
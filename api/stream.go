@@ -0,0 +1,263 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/datapath"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+// StreamBuffer number of packet ins buffered for a subscriber to a stream,
+// that is disconnected once they are not read fast enough to keep it from
+// filling up
+const StreamBuffer = 256
+
+// subscriber receives the packet ins published from a device, or from all
+// devices, that match its criteria, over a websocket
+type subscriber struct {
+	dpid     uint64
+	all      bool
+	criteria criteria.Criteria
+	json     bool
+	queue    chan []byte
+
+	// slow closed once a packet in is dropped as the queue is full
+	slow    chan struct{}
+	slowing sync.Once
+}
+
+// newSubscriber creates a subscriber to the packet ins of a device, or of
+// all devices if `all`, that match the given criteria
+func newSubscriber(dpid uint64, all bool, match criteria.Criteria, json bool) *subscriber {
+	return &subscriber{
+		dpid:     dpid,
+		all:      all,
+		criteria: match,
+		json:     json,
+		queue:    make(chan []byte, StreamBuffer),
+		slow:     make(chan struct{}),
+	}
+}
+
+// offer queues a packet in to the subscriber, unless its queue is full when
+// it is marked as slow, so that it is disconnected rather than stalling the
+// device connection
+func (s *subscriber) offer(message []byte) {
+	select {
+	case s.queue <- message:
+	default:
+		s.slowing.Do(func() {
+			close(s.slow)
+		})
+	}
+}
+
+// subscribe adds a subscriber to the packet ins published
+func (api *API) subscribe(s *subscriber) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	api.subscribers[s] = struct{}{}
+	api.updateStreamBits()
+}
+
+// unsubscribe removes a subscriber from the packet ins published
+func (api *API) unsubscribe(s *subscriber) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	delete(api.subscribers, s)
+	api.updateStreamBits()
+}
+
+// updateStreamBits updates the values that must be decoded from the packet
+// ins published, those the subscribers match on. Called with the lock held.
+func (api *API) updateStreamBits() {
+	var bits uint64
+	for s := range api.subscribers {
+		bits |= s.criteria.Bits()
+	}
+	atomic.StoreUint64(&api.streamBits, bits)
+	atomic.StoreInt32(&api.streaming, int32(len(api.subscribers)))
+}
+
+// Streaming returns true while any subscriber is streaming packet ins
+func (api *API) Streaming() bool {
+	return api != nil && atomic.LoadInt32(&api.streaming) != 0
+}
+
+// StreamCriteriaBits returns the values the subscribers streaming packet ins
+// match on, so that they are decoded from the packet ins published
+func (api *API) StreamCriteriaBits() uint64 {
+	if !api.Streaming() {
+		return 0
+	}
+	return atomic.LoadUint64(&api.streamBits)
+}
+
+// Publish queues a packet in from a device to the subscribers whose
+// criteria match its state. The message is as tee-ed to the end points and
+// is copied, once, if any subscriber matches. A subscriber whose queue is
+// full is disconnected, publishing never blocks. When nothing is streamed
+// this is a single atomic load.
+func (api *API) Publish(dpid uint64, state criteria.Criteria, message []byte) {
+	if !api.Streaming() {
+		return
+	}
+	var copied []byte
+	api.lock.RLock()
+	defer api.lock.RUnlock()
+	for s := range api.subscribers {
+		if (!s.all && s.dpid != dpid) || !s.criteria.Match(state) {
+			continue
+		}
+		if copied == nil {
+			copied = append([]byte(nil), message...)
+		}
+		s.offer(copied)
+	}
+}
+
+// streamCriteria parses the match criteria of a stream from the query of its
+// request, with the same terms as an end point specification. The `encode`
+// parameter, `binary` or `json`, is not a match term.
+func streamCriteria(query url.Values) (criteria.Criteria, bool, error) {
+	var match criteria.Criteria
+	encodeJSON := false
+	for name, values := range query {
+		for _, value := range values {
+			if name == "encode" {
+				switch value {
+				case "binary":
+					encodeJSON = false
+				case "json":
+					encodeJSON = true
+				default:
+					return match, false, fmt.Errorf("invalid encode '%s', expected 'binary' or 'json'", value)
+				}
+				continue
+			}
+			condition, ok, err := criteria.ParseTerm(name, value)
+			if !ok {
+				return match, false, fmt.Errorf("unknown match term '%s'", name)
+			}
+			if err == nil {
+				err = match.Merge(condition)
+			}
+			if err != nil {
+				return match, false, fmt.Errorf("invalid match term '%s=%s' : %s", name, value, err)
+			}
+		}
+	}
+	return match, encodeJSON, nil
+}
+
+// StreamHandler upgrades the request to a websocket over which the packet
+// ins from a device, or from all devices when the request has no DPID, are
+// pushed as they are tee-ed, filtered by the match terms of the query, i.e.
+// `?dl_type=0x888e`. Each packet in is a binary frame, or a text frame
+// holding its JSON envelope with `?encode=json`. A subscriber that doesn't
+// keep up is disconnected.
+func (api *API) StreamHandler(resp http.ResponseWriter, req *http.Request) {
+	var dpid uint64
+	all := true
+	if value, ok := mux.Vars(req)["dpid"]; ok {
+		var err error
+		if dpid, _, err = api.injector(value); err != nil {
+			http.Error(resp, err.Error(), http.StatusNotFound)
+			return
+		}
+		all = false
+	}
+	match, encodeJSON, err := streamCriteria(req.URL.Query())
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("Unable to parse stream request : %s", err), http.StatusBadRequest)
+		return
+	}
+	if encodeJSON && api.Envelope == nil {
+		http.Error(resp, "JSON encoding of streamed packet ins is not supported", http.StatusBadRequest)
+		return
+	}
+
+	// The origin is not checked, as subscribers are applications rather
+	// than browsers
+	server := websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			api.stream(ws, newSubscriber(dpid, all, match, encodeJSON))
+		},
+	}
+	server.ServeHTTP(resp, req)
+}
+
+// stream pushes the packet ins published to a subscriber over its websocket
+// until the subscriber closes it or is too slow
+func (api *API) stream(ws *websocket.Conn, s *subscriber) {
+	logger := log.WithFields(log.Fields{
+		"remote":   ws.Request().RemoteAddr,
+		"criteria": s.criteria.String(),
+	})
+	if !s.all {
+		logger = logger.WithField("dpid", datapath.Format(s.dpid))
+	}
+	logger.Info("Streaming packet ins")
+
+	// The deadlines the API server set on the connection for the request
+	// would otherwise cut the stream short
+	ws.SetDeadline(time.Time{})
+
+	api.subscribe(s)
+	defer api.unsubscribe(s)
+
+	// Nothing is expected from the subscriber, it is read to process the
+	// control frames and to notice when it closes the websocket
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		io.Copy(ioutil.Discard, ws)
+	}()
+	defer func() {
+		ws.Close()
+		<-closed
+	}()
+
+	// A slow subscriber is disconnected even while a write to it is
+	// blocked, by expiring the deadlines of the connection
+	go func() {
+		select {
+		case <-s.slow:
+			logger.Warn("Disconnecting slow subscriber to streamed packet ins")
+			ws.SetDeadline(time.Now())
+		case <-closed:
+		}
+	}()
+
+	ws.PayloadType = websocket.BinaryFrame
+	if s.json {
+		ws.PayloadType = websocket.TextFrame
+	}
+	for {
+		select {
+		case message := <-s.queue:
+			if s.json {
+				message = api.Envelope(message)
+			}
+			if _, err := ws.Write(message); err != nil {
+				logger.
+					WithError(err).
+					Info("Stopped streaming packet ins, unable to write to subscriber")
+				return
+			}
+		case <-closed:
+			logger.Info("Stopped streaming packet ins, closed by subscriber")
+			return
+		}
+	}
+}
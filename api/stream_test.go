@@ -0,0 +1,162 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/criteria"
+	"golang.org/x/net/websocket"
+)
+
+// dialStream opens a websocket to stream packet ins from the API server and
+// waits for it to be subscribed
+func dialStream(t *testing.T, api *API, server *httptest.Server, path string) *websocket.Conn {
+	api.lock.RLock()
+	subscribed := len(api.subscribers)
+	api.lock.RUnlock()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+path, "", server.URL)
+	if err != nil {
+		t.Fatalf("Unable to stream '%s' : %v", path, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		api.lock.RLock()
+		n := len(api.subscribers)
+		api.lock.RUnlock()
+		if n > subscribed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Stream '%s' not subscribed", path)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return ws
+}
+
+// receive reads the next frame streamed, failing if none arrives in time
+func receive(t *testing.T, ws *websocket.Conn) []byte {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame []byte
+	if err := websocket.Message.Receive(ws, &frame); err != nil {
+		t.Fatalf("Unable to receive streamed packet in : %v", err)
+	}
+	return frame
+}
+
+func TestStream(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.injectors[0x1] = &MockInjector{}
+	api.injectors[0x2] = &MockInjector{}
+	api.Envelope = func(message []byte) []byte {
+		return append([]byte(`{"payload":`), append(message, '}')...)
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	eapol := criteria.Criteria{Set: criteria.BitDLType, DlType: 0x888e}
+	arp := criteria.Criteria{Set: criteria.BitDLType, DlType: 0x0806}
+	device := dialStream(t, api, server, "/oftee/0x1/stream?dl_type=0x888e")
+	defer device.Close()
+	all := dialStream(t, api, server, "/oftee/stream?encode=json")
+	defer all.Close()
+	if bits := api.StreamCriteriaBits(); bits != criteria.BitDLType {
+		t.Errorf("Expected the subscribers to require dl_type, got 0x%x", bits)
+	}
+
+	message := []byte("first")
+	api.Publish(0x1, arp, []byte("arp"))
+	api.Publish(0x2, eapol, []byte("other"))
+	api.Publish(0x1, eapol, message)
+	copy(message, "xxxxx")
+
+	// The device's stream only gets its EAPOL packet in, copied as it is
+	// published
+	if frame := receive(t, device); string(frame) != "first" {
+		t.Errorf("Expected the device's EAPOL packet in, got '%s'", frame)
+	}
+	for _, expected := range []string{"arp", "other", "first"} {
+		if frame := receive(t, all); string(frame) != `{"payload":`+expected+`}` {
+			t.Errorf("Expected the envelope of '%s', got '%s'", expected, frame)
+		}
+	}
+
+	// Once closed the subscriber is removed
+	device.Close()
+	all.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for api.Streaming() {
+		if time.Now().After(deadline) {
+			t.Fatal("Subscribers not removed once their streams were closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if bits := api.StreamCriteriaBits(); bits != 0 {
+		t.Errorf("Expected nothing to be required once not streaming, got 0x%x", bits)
+	}
+}
+
+func TestStreamDisconnectsSlowSubscriber(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.injectors[0x1] = &MockInjector{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	ws := dialStream(t, api, server, "/oftee/0x1/stream")
+	defer ws.Close()
+
+	// Publishing never blocks, the subscriber is disconnected once its
+	// buffer, and the connection, are full
+	payload := bytes.Repeat([]byte{0x1}, 64*1024)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100*StreamBuffer && api.Streaming(); i++ {
+			api.Publish(0x1, criteria.Criteria{}, payload)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publishing to a slow subscriber blocked")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for api.Streaming() {
+		if time.Now().After(deadline) {
+			t.Fatal("Slow subscriber not disconnected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.injectors[0x1] = &MockInjector{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	for _, tc := range []struct {
+		path string
+		code int
+	}{
+		{"/oftee/0x2/stream", http.StatusNotFound},
+		{"/oftee/0x1/stream?dl_type=bogus", http.StatusBadRequest},
+		{"/oftee/stream?colour=blue", http.StatusBadRequest},
+		{"/oftee/stream?encode=xml", http.StatusBadRequest},
+		{"/oftee/stream?encode=json", http.StatusBadRequest},
+		{"/oftee/stream", http.StatusBadRequest},
+	} {
+		resp, err := http.Get(server.URL + tc.path)
+		if err != nil {
+			t.Fatalf("Unable to request '%s' : %v", tc.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.code {
+			t.Errorf("Incorrect response code for '%s', expected %d, got %d", tc.path, tc.code, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"time"
+
+	"github.com/ciena/oftee/datapath"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultSweepInterval default interval at which stale device mappings are
+// looked for
+const DefaultSweepInterval = 5 * time.Second
+
+// sweep periodically removes stale device mappings
+func (api *API) sweep() {
+	interval := api.SweepInterval
+	if interval <= 0 {
+		interval = DefaultSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		api.sweepOnce(now)
+	}
+}
+
+// sweepOnce looks for device mappings whose injector has been unhealthy for
+// longer than the grace period and requests their removal. The removal is
+// via the mapping listener, so it is serialized with the mapping updates from
+// the device connections, and only removes the injector if it has not been
+// replaced by a new connection from the device in the meantime. The session
+// from which the injector was learned is removed with it. The tee-ing
+// state of devices whose TTL has expired is removed as well.
+func (api *API) sweepOnce(now time.Time) []DPIDMapping {
+	var stale []DPIDMapping
+
+	api.lock.Lock()
+	api.sweepTee(now)
+	for dpid, inject := range api.injectors {
+		if inject.Healthy() {
+			delete(api.unhealthy, dpid)
+			continue
+		}
+		since, ok := api.unhealthy[dpid]
+		if !ok {
+			api.unhealthy[dpid] = now
+			continue
+		}
+		if now.Sub(since) >= api.StaleGracePeriod {
+			stale = append(stale, DPIDMapping{
+				Action:  MapActionDelete,
+				DPID:    dpid,
+				Inject:  inject,
+				Session: api.owners[dpid],
+			})
+		}
+	}
+	api.lock.Unlock()
+
+	// Sent without holding the lock, as the listener needs it to process
+	// the mappings
+	for _, mapping := range stale {
+		log.WithFields(log.Fields{
+			"dpid": datapath.Format(mapping.DPID),
+		}).Info("Removing stale device mapping")
+		api.DPIDMappingListener <- mapping
+	}
+	return stale
+}
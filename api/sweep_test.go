@@ -0,0 +1,221 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// healthInjector is a mock injector whose health can be changed while it is
+// being used concurrently
+type healthInjector struct {
+	MockInjector
+	unhealthy int32
+	injected  int32
+}
+
+func (h *healthInjector) Healthy() bool {
+	return atomic.LoadInt32(&h.unhealthy) == 0
+}
+
+func (h *healthInjector) Inject(ctx context.Context, message []byte) {
+	atomic.AddInt32(&h.injected, 1)
+}
+
+func (h *healthInjector) fail() {
+	atomic.StoreInt32(&h.unhealthy, 1)
+}
+
+// waitMappings waits for the queued mapping updates to be processed
+func waitMappings(api *API) {
+	for len(api.DPIDMappingListener) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Let the last update be applied
+	time.Sleep(10 * time.Millisecond)
+	api.lock.Lock()
+	api.lock.Unlock()
+}
+
+func TestListConnectedDevices(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.injectors[0x1] = &MockInjector{}
+	api.injectors[0x2] = &MockInjector{Unhealthy: true}
+
+	for query, expected := range map[string]int{"": 2, "?connected=false": 2, "?connected=true": 1} {
+		resp := httptest.NewRecorder()
+		api.serveMux.ServeHTTP(resp, httptest.NewRequest("GET", "http://example.com/oftee"+query, nil))
+		var data DevicesResponse
+		if err := json.Unmarshal(resp.Body.Bytes(), &data); err != nil {
+			t.Fatal(err)
+		}
+		if len(data.Devices) != expected {
+			t.Errorf("Expected %d devices for '%s', got %v", expected, query, data.Devices)
+		}
+	}
+
+	resp := httptest.NewRecorder()
+	api.serveMux.ServeHTTP(resp, httptest.NewRequest("GET", "http://example.com/oftee?connected=maybe", nil))
+	if resp.Code != 400 {
+		t.Errorf("Incorrect response code, expected 400, got %d", resp.Code)
+	}
+}
+
+func TestPacketOutUnhealthy(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	mock := &MockInjector{Unhealthy: true}
+	api.injectors[0x1] = mock
+
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "http://example.com/oftee/0x1", bytes.NewReader(packetOut(t)))
+	req.Header.Add("Content-type", "application/octet-stream")
+	api.serveMux.ServeHTTP(resp, req)
+	if resp.Code != 404 {
+		t.Errorf("Incorrect response code, expected 404, got %d", resp.Code)
+	}
+	if len(mock.Messages) != 0 {
+		t.Errorf("Expected no messages, found %d", len(mock.Messages))
+	}
+}
+
+func TestSweepRemovesStaleMapping(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.StaleGracePeriod = time.Minute
+	go api.dpidMappingUpdates()
+
+	inject := &healthInjector{}
+	api.injectors[0x1] = inject
+	api.injectors[0x2] = &healthInjector{}
+	inject.fail()
+
+	now := time.Now()
+	if stale := api.sweepOnce(now); len(stale) != 0 {
+		t.Errorf("Expected no stale mappings when first unhealthy, got %v", stale)
+	}
+	if stale := api.sweepOnce(now.Add(30 * time.Second)); len(stale) != 0 {
+		t.Errorf("Expected no stale mappings within grace period, got %v", stale)
+	}
+	if stale := api.sweepOnce(now.Add(time.Minute)); len(stale) != 1 || stale[0].DPID != 0x1 {
+		t.Errorf("Expected stale mapping for 0x1, got %v", stale)
+	}
+	waitMappings(api)
+	if devices := api.devices(false); len(devices) != 1 || devices[0] != "of:0x0000000000000002" {
+		t.Errorf("Expected only 0x2 to remain, got %v", devices)
+	}
+}
+
+func TestSweepRemovesStaleSession(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.StaleGracePeriod = time.Minute
+	go api.dpidMappingUpdates()
+
+	inject := &healthInjector{}
+	api.DPIDMappingListener <- DPIDMapping{Action: MapActionAdd, DPID: 0x1, Inject: inject, Session: &MockSession{}}
+	waitMappings(api)
+	inject.fail()
+
+	now := time.Now()
+	api.sweepOnce(now)
+	if stale := api.sweepOnce(now.Add(time.Minute)); len(stale) != 1 || stale[0].Session == nil {
+		t.Fatalf("Expected a stale mapping with its session, got %v", stale)
+	}
+	waitMappings(api)
+	api.lock.RLock()
+	sessions, owned := len(api.sessions[0x1]), api.owners[0x1] != nil
+	api.lock.RUnlock()
+	if sessions != 0 || owned {
+		t.Errorf("Expected the stale session removed, %d remain", sessions)
+	}
+}
+
+func TestSweepKeepsReplacedMapping(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.StaleGracePeriod = time.Minute
+
+	old := &healthInjector{}
+	old.fail()
+	api.injectors[0x1] = old
+	now := time.Now()
+	api.sweepOnce(now)
+	stale := api.sweepOnce(now.Add(time.Minute))
+	if len(stale) != 1 {
+		t.Fatalf("Expected a stale mapping, got %v", stale)
+	}
+
+	// The device reconnects before the stale mapping is processed
+	replacement := &healthInjector{}
+	api.DPIDMappingListener <- DPIDMapping{Action: MapActionAdd, DPID: 0x1, Inject: replacement}
+	go api.dpidMappingUpdates()
+	waitMappings(api)
+	if _, inject, err := api.injector("0x1"); err != nil || inject != replacement {
+		t.Errorf("Expected replacement injector to remain, got %v (%v)", inject, err)
+	}
+}
+
+func TestSweepConcurrentWithUpdates(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.StaleGracePeriod = time.Nanosecond
+	go api.dpidMappingUpdates()
+	message := packetOut(t)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+					f(i)
+				}
+			}
+		}()
+	}
+
+	// Devices connecting, failing and disconnecting
+	run(func(i int) {
+		inject := &healthInjector{}
+		dpid := uint64(i % 4)
+		api.DPIDMappingListener <- DPIDMapping{Action: MapActionAdd, DPID: dpid, Inject: inject}
+		inject.fail()
+		if i%3 == 0 {
+			api.DPIDMappingListener <- DPIDMapping{Action: MapActionDelete, DPID: dpid, Inject: inject}
+		}
+	})
+	// The sweeper
+	run(func(int) {
+		api.sweepOnce(time.Now())
+	})
+	// Packet outs and device listings
+	run(func(i int) {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "http://example.com/oftee/0x1", bytes.NewReader(message))
+		req.Header.Add("Content-type", "application/octet-stream")
+		api.serveMux.ServeHTTP(resp, req)
+		if resp.Code != 200 && resp.Code != 404 {
+			t.Errorf("Unexpected response code %d", resp.Code)
+		}
+		api.devices(i%2 == 0)
+	})
+
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	// Once everything has failed, the sweeper removes all the mappings
+	waitMappings(api)
+	api.sweepOnce(time.Now())
+	api.sweepOnce(time.Now())
+	waitMappings(api)
+	if devices := api.devices(false); len(devices) != 0 {
+		t.Errorf("Expected all stale mappings to be removed, got %v", devices)
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// teeState tracks whether the tee-ing of packet in messages from a device is
+// disabled and how many were suppressed while it was
+type teeState struct {
+	disabled   bool
+	until      time.Time
+	suppressed uint64
+}
+
+// active returns true if the tee-ing of packet ins is disabled at the
+// given time
+func (s *teeState) active(now time.Time) bool {
+	return s.disabled && (s.until.IsZero() || now.Before(s.until))
+}
+
+// expired returns true if the tee-ing of packet ins was disabled with a TTL
+// that has expired at the given time
+func (s *teeState) expired(now time.Time) bool {
+	return s.disabled && !s.until.IsZero() && !now.Before(s.until)
+}
+
+// SetTee enables or disables the tee-ing of packet in messages from a device.
+// When disabling with a non zero TTL, tee-ing is re-enabled once it expires.
+func (api *API) SetTee(dpid uint64, enabled bool, ttl time.Duration) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	state, ok := api.tee[dpid]
+	if !ok {
+		if enabled {
+			return
+		}
+		state = &teeState{}
+		api.tee[dpid] = state
+	}
+	state.disabled = !enabled
+	state.until = time.Time{}
+	if !enabled && ttl > 0 {
+		state.until = time.Now().Add(ttl)
+	}
+}
+
+// TeeEnabled returns true if packet in messages from the device should be
+// tee-ed to the end points. When they should not, the message is counted as
+// suppressed.
+func (api *API) TeeEnabled(dpid uint64) bool {
+	api.lock.RLock()
+	state, ok := api.tee[dpid]
+	active := ok && state.active(time.Now())
+	api.lock.RUnlock()
+	if !active {
+		return true
+	}
+	atomic.AddUint64(&state.suppressed, 1)
+	return false
+}
+
+// teeStatus returns the tee-ing state of a device
+func (api *API) teeStatus(dpid uint64) TeeStatus {
+	api.lock.RLock()
+	defer api.lock.RUnlock()
+	state, ok := api.tee[dpid]
+	if !ok {
+		return TeeStatus{Enabled: true}
+	}
+	status := TeeStatus{
+		Enabled:    !state.active(time.Now()),
+		Suppressed: atomic.LoadUint64(&state.suppressed),
+	}
+	if !status.Enabled && !state.until.IsZero() {
+		until := state.until
+		status.Until = &until
+	}
+	return status
+}
+
+// sweepTee removes the tee-ing state of devices whose TTL has expired, so
+// the state of devices that never reconnect isn't kept. It is called with
+// the lock held.
+func (api *API) sweepTee(now time.Time) {
+	for dpid, state := range api.tee {
+		if state.expired(now) {
+			delete(api.tee, dpid)
+		}
+	}
+}
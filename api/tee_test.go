@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func putTee(api *API, dpid, body string) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "http://example.com/oftee/"+dpid+"/tee", strings.NewReader(body))
+	api.serveMux.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestTeeDisable(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.injectors[0x1] = &MockInjector{}
+
+	if resp := putTee(api, "0x1", `{"enabled":false}`); resp.Code != 200 {
+		t.Fatalf("Incorrect response code, expected 200, got %d", resp.Code)
+	}
+	for i := 0; i < 3; i++ {
+		if api.TeeEnabled(0x1) {
+			t.Error("Expected tee to be disabled")
+		}
+	}
+	if !api.TeeEnabled(0x2) {
+		t.Error("Expected tee to be enabled for other devices")
+	}
+
+	resp := httptest.NewRecorder()
+	api.serveMux.ServeHTTP(resp, httptest.NewRequest("GET", "http://example.com/oftee/0x1", nil))
+	var device DeviceResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &device); err != nil {
+		t.Fatal(err)
+	}
+	if device.Tee.Enabled || device.Tee.Suppressed != 3 {
+		t.Errorf("Incorrect device tee state, got %+v", device.Tee)
+	}
+
+	// Re-enabling keeps the count of suppressed messages
+	putTee(api, "0x1", `{"enabled":true}`)
+	if !api.TeeEnabled(0x1) {
+		t.Error("Expected tee to be enabled")
+	}
+	if status := api.teeStatus(0x1); !status.Enabled || status.Suppressed != 3 {
+		t.Errorf("Incorrect tee state after enable, got %+v", status)
+	}
+}
+
+func TestTeeDisableTTL(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+
+	// The device need not be connected
+	if resp := putTee(api, "0x1", `{"enabled":false,"ttl":"50ms"}`); resp.Code != 200 {
+		t.Fatalf("Incorrect response code, expected 200, got %d", resp.Code)
+	}
+	if status := api.teeStatus(0x1); status.Enabled || status.Until == nil {
+		t.Errorf("Expected tee disabled until TTL expires, got %+v", status)
+	}
+	if api.TeeEnabled(0x1) {
+		t.Error("Expected tee to be disabled")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !api.TeeEnabled(0x1) {
+		t.Error("Expected tee to be enabled after TTL expired")
+	}
+}
+
+func TestTeeBadRequest(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	for _, body := range []string{``, `{}`, `{"enabled":false,"ttl":"soon"}`, `{"enabled":false,"ttl":"-1m"}`} {
+		if resp := putTee(api, "0x1", body); resp.Code != 400 {
+			t.Errorf("Incorrect response code for '%s', expected 400, got %d", body, resp.Code)
+		}
+	}
+	if resp := putTee(api, "nope", `{"enabled":false}`); resp.Code != 404 {
+		t.Errorf("Incorrect response code for bad DPID, expected 404, got %d", resp.Code)
+	}
+}
+
+func TestTeeSweepExpired(t *testing.T) {
+	api := NewAPI(":4242", "", "")
+	api.SetTee(0x1, false, time.Millisecond)
+	api.SetTee(0x2, false, time.Hour)
+	api.SetTee(0x3, false, 0)
+
+	// Only the state whose TTL has expired is removed
+	api.sweepOnce(time.Now().Add(time.Minute))
+	api.lock.RLock()
+	_, expired := api.tee[0x1]
+	remaining := len(api.tee)
+	api.lock.RUnlock()
+	if expired || remaining != 2 {
+		t.Errorf("Expected only the expired tee state removed, %d remain", remaining)
+	}
+}
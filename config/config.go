@@ -0,0 +1,410 @@
+// Package config reads the structured configuration file of oftee, YAML or
+// JSON, into its settings and its end points. The settings are those of the
+// environment, named in lower case, i.e. `listen_on` sets `LISTEN_ON`, with
+// their values as they would be given in the environment, or as lists. The
+// end points are a list, each of which has a URL, the criteria it matches, as
+// a map of match terms, and its options, i.e.
+//
+//	listen_on: :8000
+//	proxy_to: onos:6653
+//	endpoints:
+//	  - name: ids
+//	    url: tcp://ids:9000
+//	    match:
+//	      dl_type: arp
+//	      in_port: 3
+//	    queue: 100
+//	    workers: 2
+//
+// Each error names the offending field, i.e. `endpoints[0].match.dl_type`.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ciena/oftee/criteria"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// FieldEndpoints the field of the end points
+	FieldEndpoints = "endpoints"
+
+	// FieldTeeTo the field of the end points as specifications, as the
+	// `TEE_TO` environment variable, which can't be given with the end
+	// points
+	FieldTeeTo = "tee_to"
+
+	// Fields of an end point, any other field is one of its options, the
+	// name of a term of an end point specification
+
+	// FieldName the name by which an end point is known
+	FieldName = "name"
+
+	// FieldURL the URL to which an end point tees, its action
+	FieldURL = "url"
+
+	// FieldMatch the match terms of an end point, by name
+	FieldMatch = "match"
+
+	// FieldQueue the size of the queue of an end point, in messages
+	FieldQueue = "queue"
+
+	// termAction the name of the term of a specification given by the URL
+	termAction = "action"
+)
+
+// FieldError an error in a field of a configuration file
+type FieldError struct {
+	Path  string
+	Field string
+	Err   error
+}
+
+// Error returns the error prefixed by the file and field
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Path, e.Field, e.Err)
+}
+
+// Setting a setting of the configuration file, by the name of the environment
+// variable that sets it, with its value as it would be given in the
+// environment
+type Setting struct {
+	Name  string
+	Value string
+	Field string
+}
+
+// Term a `name=value` term of an end point, and the field from which it was
+// read
+type Term struct {
+	Name  string
+	Value string
+	Field string
+}
+
+// Endpoint an end point of the configuration file. Its match terms and
+// options are ordered by name, an option that is a list, i.e. `header`, is
+// repeated.
+type Endpoint struct {
+	Name    string
+	URL     string
+	Match   []Term
+	Queue   int
+	Options []Term
+	Field   string
+}
+
+// Terms returns the terms of the end point, its match terms, queue size and
+// options, followed by its action, its URL
+func (e *Endpoint) Terms() []Term {
+	terms := make([]Term, 0, len(e.Match)+len(e.Options)+2)
+	terms = append(terms, e.Match...)
+	if e.Queue != 0 {
+		terms = append(terms, Term{FieldQueue, strconv.Itoa(e.Queue), e.Field + "." + FieldQueue})
+	}
+	terms = append(terms, e.Options...)
+	return append(terms, Term{termAction, e.URL, e.Field + "." + FieldURL})
+}
+
+// File a structured configuration file. The end points are only set if the
+// file has an `endpoints` field, even if empty.
+type File struct {
+	Path         string
+	Settings     []Setting
+	Endpoints    []Endpoint
+	HasEndpoints bool
+}
+
+// Structured returns true if the file is a structured configuration file, by
+// its extension, `.yaml`, `.yml` or `.json`
+func Structured(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// Read reads and parses a structured configuration file
+func Read(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(path, data)
+}
+
+// Parse parses the content of a structured configuration file, as JSON if the
+// file is a `.json` file and otherwise as YAML
+func Parse(path string, data []byte) (*File, error) {
+	var root node
+	var err error
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(data, &root)
+	} else {
+		err = yaml.Unmarshal(data, &root)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if root.kind != mapNode && !(root.kind == scalarNode && root.scalar == "") {
+		return nil, fmt.Errorf("%s: expected a map of settings and end points", path)
+	}
+
+	file := &File{Path: path}
+	fail := func(field string, err error) (*File, error) {
+		return nil, &FieldError{path, field, err}
+	}
+	for _, name := range root.names() {
+		value := root.fields[name]
+		switch {
+		case name == FieldEndpoints:
+			if _, ok := root.fields[FieldTeeTo]; ok {
+				return fail(FieldTeeTo, errors.New("can't be given with endpoints"))
+			}
+			if file.Endpoints, err = parseEndpoints(path, value); err != nil {
+				return nil, err
+			}
+			file.HasEndpoints = true
+		case !isName(name):
+			return fail(name, errors.New("invalid setting name, expected i.e. listen_on"))
+		default:
+			setting, err := value.joined()
+			if err != nil {
+				return fail(name, err)
+			}
+			file.Settings = append(file.Settings, Setting{strings.ToUpper(name), setting, name})
+		}
+	}
+	return file, nil
+}
+
+// parseEndpoints parses the list of end points
+func parseEndpoints(path string, list node) ([]Endpoint, error) {
+	if list.kind == scalarNode && list.scalar == "" {
+		return []Endpoint{}, nil
+	}
+	if list.kind != listNode {
+		return nil, &FieldError{path, FieldEndpoints, errors.New("expected a list of end points")}
+	}
+	endpoints := make([]Endpoint, len(list.list))
+	named := make(map[string]bool)
+	for i, item := range list.list {
+		endpoint := &endpoints[i]
+		endpoint.Field = fmt.Sprintf("%s[%d]", FieldEndpoints, i)
+		fail := func(field string, err error) ([]Endpoint, error) {
+			return nil, &FieldError{path, endpoint.Field + field, err}
+		}
+		if item.kind != mapNode {
+			return fail("", errors.New("expected a map of the url, match and options of the end point"))
+		}
+		if _, ok := item.fields[FieldURL]; !ok {
+			return fail("", errors.New("missing url"))
+		}
+		for _, name := range item.names() {
+			value := item.fields[name]
+			field := "." + name
+			switch name {
+			case FieldName, FieldURL, FieldQueue:
+				if value.kind != scalarNode || value.scalar == "" {
+					return fail(field, errors.New("expected a value"))
+				}
+			}
+			switch {
+			case name == FieldName:
+				if named[value.scalar] {
+					return fail(field, fmt.Errorf("duplicate end point name '%s'", value.scalar))
+				}
+				endpoint.Name, named[value.scalar] = value.scalar, true
+			case name == FieldURL:
+				if strings.Contains(value.scalar, ";") {
+					return fail(field, errors.New("can't contain ';'"))
+				}
+				endpoint.URL = value.scalar
+			case name == FieldQueue:
+				queue, err := strconv.Atoi(value.scalar)
+				if err != nil || queue < 0 {
+					return fail(field, fmt.Errorf("invalid queue size '%s', expected a number of messages", value.scalar))
+				}
+				endpoint.Queue = queue
+			case name == FieldMatch:
+				match, err := parseMatch(path, endpoint.Field+field, value)
+				if err != nil {
+					return nil, err
+				}
+				endpoint.Match = match
+			case name == termAction:
+				return fail(field, errors.New("the action of an end point is given by its url"))
+			case criteria.IsTerm(strings.TrimSuffix(name, "!")):
+				return fail(field, fmt.Errorf("match term '%s' must be given in match", name))
+			case !isName(name):
+				return fail(field, errors.New("invalid option name, expected i.e. workers"))
+			default:
+				options, err := parseOption(path, endpoint.Field+field, name, value)
+				if err != nil {
+					return nil, err
+				}
+				endpoint.Options = append(endpoint.Options, options...)
+			}
+		}
+	}
+	return endpoints, nil
+}
+
+// parseMatch parses the match terms of an end point, which may be negated,
+// i.e. `dl_type!: arp`
+func parseMatch(path, field string, match node) ([]Term, error) {
+	if match.kind != mapNode {
+		return nil, &FieldError{path, field, errors.New("expected a map of match terms, i.e. dl_type: arp")}
+	}
+	terms := make([]Term, 0, len(match.fields))
+	for _, name := range match.names() {
+		value := match.fields[name]
+		term := Term{name, value.scalar, field + "." + name}
+		var err error
+		switch {
+		case !criteria.IsTerm(strings.TrimSuffix(name, "!")):
+			err = fmt.Errorf("unknown match term '%s'", name)
+		case value.kind != scalarNode || value.scalar == "":
+			err = errors.New("expected a value")
+		case strings.Contains(value.scalar, ";"):
+			err = errors.New("can't contain ';'")
+		}
+		if err != nil {
+			return nil, &FieldError{path, term.Field, err}
+		}
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+// parseOption parses an option of an end point, a value or, for an option
+// that may be repeated, a list of values
+func parseOption(path, field, name string, value node) ([]Term, error) {
+	values := []node{value}
+	fields := []string{field}
+	if value.kind == listNode {
+		values = value.list
+		fields = make([]string, len(values))
+		for i := range fields {
+			fields[i] = fmt.Sprintf("%s[%d]", field, i)
+		}
+	}
+	terms := make([]Term, len(values))
+	for i, v := range values {
+		terms[i] = Term{name, v.scalar, fields[i]}
+		var err error
+		switch {
+		case v.kind != scalarNode || v.scalar == "":
+			err = errors.New("expected a value, or a list of values")
+		case strings.Contains(v.scalar, ";"):
+			err = errors.New("can't contain ';'")
+		}
+		if err != nil {
+			return nil, &FieldError{path, fields[i], err}
+		}
+	}
+	return terms, nil
+}
+
+// isName returns true if the given string can be the name of a setting or of
+// an option, in lower case
+func isName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r == '_' || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// Kinds of node
+const (
+	scalarNode = iota
+	listNode
+	mapNode
+)
+
+// node a value of a configuration file, either a scalar, as written, so that
+// i.e. `1.0` is not read as the number 1, a list or a map
+type node struct {
+	kind   int
+	scalar string
+	list   []node
+	fields map[string]node
+}
+
+// UnmarshalYAML reads a YAML value, a null value is an empty scalar
+func (n *node) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&n.scalar); err == nil {
+		return nil
+	}
+	if err := unmarshal(&n.list); err == nil {
+		n.kind = listNode
+		return nil
+	}
+	n.kind = mapNode
+	return unmarshal(&n.fields)
+}
+
+// UnmarshalJSON reads a JSON value, a null value is an empty scalar
+func (n *node) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(data, []byte("[")):
+		n.kind = listNode
+		return json.Unmarshal(data, &n.list)
+	case bytes.HasPrefix(data, []byte("{")):
+		n.kind = mapNode
+		return json.Unmarshal(data, &n.fields)
+	case bytes.HasPrefix(data, []byte(`"`)):
+		return json.Unmarshal(data, &n.scalar)
+	case !bytes.Equal(data, []byte("null")):
+		n.scalar = string(data)
+	}
+	return nil
+}
+
+// names returns the names of the fields of a map, ordered
+func (n *node) names() []string {
+	names := make([]string, 0, len(n.fields))
+	for name := range n.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// joined returns the value of a setting, a scalar or a list of scalars joined
+// by commas, as a list would be given in the environment
+func (n *node) joined() (string, error) {
+	switch n.kind {
+	case scalarNode:
+		return n.scalar, nil
+	case listNode:
+		values := make([]string, len(n.list))
+		for i, item := range n.list {
+			if item.kind != scalarNode {
+				return "", fmt.Errorf("expected a list of values, item %d is not a value", i)
+			}
+			if strings.Contains(item.scalar, ",") {
+				return "", fmt.Errorf("item %d of the list can't contain ','", i)
+			}
+			values[i] = item.scalar
+		}
+		return strings.Join(values, ","), nil
+	}
+	return "", errors.New("expected a value, or a list of values")
+}
@@ -0,0 +1,360 @@
+package connections
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Acknowledged delivery to a TCP end point, `ack=true`, lets both oftee and
+// the consumer detect messages that were silently lost, i.e. those written
+// to a connection that was reset before the consumer read them.
+//
+// Each message written to the end point is preceded by a 4 byte, big endian,
+// sequence number:
+//
+//	+--------------+----------------------+-------------------------------+
+//	| sequence (4) | OpenFlow context (12)| OpenFlow message (its length) |
+//	+--------------+----------------------+-------------------------------+
+//
+// Sequence numbers start at 1 when the end point is established and increase
+// by one per message, wrapping from 0xffffffff to 0. The consumer replies
+// with the 4 byte, big endian, sequence number of the highest contiguous
+// message it has received, its horizon. Acknowledgments are cumulative, a
+// consumer need not acknowledge every message.
+//
+// Messages that have not been acknowledged are kept in a replay window. When
+// the connection is re-established every message in the window is
+// retransmitted, with its original sequence number, so the consumer discards
+// those at or below its horizon. A consumer that receives a message after a
+// gap in the sequence closes the connection, so that the missing messages are
+// retransmitted. While the window is full messages are dropped, and counted,
+// without being assigned a sequence number, so the sequence never has gaps.
+//
+// `AckConsumer` is a reference implementation of the consumer.
+
+// AckHeaderLen is the length of the sequence number that precedes each
+// message, and of each acknowledgment
+const AckHeaderLen = 4
+
+// DefaultAckWindow is the number of unacknowledged messages kept for
+// retransmission if no window is given
+const DefaultAckWindow = 1024
+
+// AckStats the state of the replay window of an end point with acknowledged
+// delivery. `Lag` is the number of messages sent but not yet acknowledged
+// and `LagTime` how long ago the oldest of them was queued.
+type AckStats struct {
+	Sent          uint32 `json:"sent"`
+	Horizon       uint32 `json:"horizon"`
+	Lag           int    `json:"lag"`
+	LagTime       string `json:"lag_time,omitempty"`
+	Window        int    `json:"window"`
+	Retransmitted uint64 `json:"retransmitted"`
+}
+
+// ackEntry an unacknowledged message, framed with its sequence number
+type ackEntry struct {
+	framed []byte
+	queued time.Time
+}
+
+// replayWindow the messages sent to an end point that have not been
+// acknowledged, the sequence number of the first is one after the horizon
+type replayWindow struct {
+	lock          sync.Mutex
+	size          int
+	horizon       uint32
+	entries       []ackEntry
+	retransmitted uint64
+}
+
+// newReplayWindow creates a window of the given size, in messages
+func newReplayWindow(size int) *replayWindow {
+	return &replayWindow{size: size, entries: make([]ackEntry, 0, size)}
+}
+
+// add assigns the next sequence number to a message and returns it framed
+// for delivery, or false if the window is full
+func (w *replayWindow) add(message []byte, queued time.Time) ([]byte, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.entries) >= w.size {
+		return nil, false
+	}
+	framed := make([]byte, AckHeaderLen+len(message))
+	binary.BigEndian.PutUint32(framed, w.horizon+uint32(len(w.entries))+1)
+	copy(framed[AckHeaderLen:], message)
+	w.entries = append(w.entries, ackEntry{framed: framed, queued: queued})
+	return framed, true
+}
+
+// full returns true if no more messages can be added to the window
+func (w *replayWindow) full() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.entries) >= w.size
+}
+
+// acknowledge advances the horizon to the given sequence number, releasing
+// the messages up to it. Returns false if the sequence number is beyond the
+// last message sent.
+func (w *replayWindow) acknowledge(seq uint32) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	n := int(seq - w.horizon)
+	if n > len(w.entries) {
+		return false
+	}
+	w.horizon = seq
+	w.entries = w.entries[:copy(w.entries, w.entries[n:])]
+	return true
+}
+
+// pending returns the framed messages that have not been acknowledged, in
+// sequence order, and counts them as retransmitted
+func (w *replayWindow) pending() [][]byte {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	framed := make([][]byte, len(w.entries))
+	for i := range w.entries {
+		framed[i] = w.entries[i].framed
+	}
+	w.retransmitted += uint64(len(framed))
+	return framed
+}
+
+// stats returns the state of the window
+func (w *replayWindow) stats() *AckStats {
+	if w == nil {
+		return nil
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	stats := &AckStats{
+		Sent:          w.horizon + uint32(len(w.entries)),
+		Horizon:       w.horizon,
+		Lag:           len(w.entries),
+		Window:        w.size,
+		Retransmitted: w.retransmitted,
+	}
+	if len(w.entries) > 0 {
+		stats.LagTime = time.Since(w.entries[0].queued).Round(time.Millisecond).String()
+	}
+	return stats
+}
+
+// readAcks reads the acknowledgments from a connection until it fails, at
+// which point the connection is reported as broken so that it is
+// re-established and the unacknowledged messages retransmitted
+func (c *TCPConnection) readAcks(conn net.Conn) {
+	buf := make([]byte, AckHeaderLen)
+	for {
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			c.broken <- conn
+			return
+		}
+		if seq := binary.BigEndian.Uint32(buf); !c.window.acknowledge(seq) {
+			log.
+				WithFields(log.Fields{
+					"address": c.address,
+					"ack":     seq,
+				}).
+				Warn("Acknowledgment beyond the last message sent, ignoring")
+		}
+	}
+}
+
+// replay retransmits the unacknowledged messages over a re-established
+// connection, each is recorded to the journal again as it is sent again
+func (c *TCPConnection) replay() error {
+	pending := c.window.pending()
+	for _, framed := range pending {
+		if _, err := c.Write(framed); err != nil {
+			return err
+		}
+		c.Journal.Record(framed[AckHeaderLen:])
+	}
+	if len(pending) > 0 {
+		log.
+			WithFields(log.Fields{
+				"address": c.address,
+				"count":   len(pending),
+			}).
+			Info("Retransmitted unacknowledged messages")
+	}
+	return nil
+}
+
+// restore re-establishes a failed connection, retransmitting the
+// unacknowledged messages. If it can't be the connection is left unset and
+// another attempt is made after a backoff, as that of an end point without
+// acknowledgments, messages are kept in the window until then.
+func (c *TCPConnection) restore() <-chan time.Time {
+	if c.address == "" {
+		return nil
+	}
+	if err := c.reconnect(); err != nil {
+		log.
+			WithFields(log.Fields{
+				"address": c.address,
+			}).
+			WithError(err).
+			Warn("Unable to re-establish acknowledged end point connection, retrying")
+		if c.Connection != nil {
+			c.Connection.Close()
+		}
+		c.Connection = nil
+		atomic.StoreInt32(&c.connected, 0)
+		return c.retryAfter()
+	}
+	c.recovered()
+	return nil
+}
+
+// sendAcknowledged is the delivery loop of an end point with acknowledged
+// delivery
+func (c *TCPConnection) sendAcknowledged(refresh <-chan time.Time) {
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-c.stop:
+			c.closeConnection()
+			return
+		case <-refresh:
+			c.refresh()
+		case conn := <-c.broken:
+			// Only the current connection is re-established,
+			// the acknowledgments of a replaced connection
+			// end when it is closed
+			if conn == c.Connection && retry == nil {
+				log.
+					WithFields(log.Fields{
+						"address": c.address,
+					}).
+					Warn("Acknowledged end point connection closed, reconnecting")
+				retry = c.restore()
+			}
+		case <-retry:
+			retry = c.restore()
+		case message := <-c.queue:
+			atomic.StoreInt32(&c.delivering, 1)
+			atomic.AddUint64(&c.matches, 1)
+			atomic.AddUint64(&c.bytes, uint64(len(message)))
+			framed, ok := c.window.add(message, time.Now())
+			switch {
+			case !ok:
+				atomic.AddUint64(&c.dropped, 1)
+			case retry != nil:
+				// Kept in the window until the connection
+				// is re-established
+			case c.Connection == nil:
+				retry = c.restore()
+			default:
+				if _, err := c.Write(framed); err != nil {
+					atomic.AddUint64(&c.errors, 1)
+					log.
+						WithFields(log.Fields{
+							"address": c.address,
+						}).
+						WithError(err).
+						Warn("failed sending queued message, reconnecting")
+					retry = c.restore()
+				} else {
+					c.Journal.Record(message)
+					c.Compare.Record(message)
+				}
+			}
+			atomic.StoreInt32(&c.delivering, 0)
+			c.Budget.Done()
+		}
+	}
+}
+
+// AckConsumer is the reference implementation of a consumer of an end point
+// with acknowledged delivery. Each message is passed to `Deliver` once, in
+// sequence order, and acknowledged once it returns. Duplicates of delivered
+// messages, retransmitted after a reconnect, are discarded. The horizon is
+// kept across connections, so a consumer should be reused for each
+// connection from the same oftee.
+type AckConsumer struct {
+	Deliver func(seq uint32, message []byte) error
+	horizon uint32
+	started bool
+}
+
+// AckGapError is returned by `AckConsumer.Serve` when a message is received
+// after a gap in the sequence, meaning messages were lost
+type AckGapError struct {
+	Expected uint32
+	Received uint32
+}
+
+func (e *AckGapError) Error() string {
+	return fmt.Sprintf("sequence gap, expected %d, received %d", e.Expected, e.Received)
+}
+
+// Horizon returns the sequence number of the highest contiguous message
+// delivered
+func (a *AckConsumer) Horizon() uint32 {
+	return a.horizon
+}
+
+// Serve reads, delivers and acknowledges messages from a connection until
+// it fails, or a gap in the sequence is detected in which case the caller
+// should close the connection so that the missing messages are
+// retransmitted. The first message on a connection with sequence number 1
+// means oftee was restarted, so the horizon is reset.
+func (a *AckConsumer) Serve(conn io.ReadWriter) error {
+	var (
+		header = make([]byte, AckHeaderLen+12+8)
+		ack    = make([]byte, AckHeaderLen)
+		first  = true
+	)
+	for {
+		// The sequence number, the OpenFlow context and the
+		// OpenFlow header, which holds the length of the message
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(header[AckHeaderLen+12+2:]))
+		if length < 8 {
+			return fmt.Errorf("invalid OpenFlow message length %d", length)
+		}
+		message := make([]byte, 12+length)
+		copy(message, header[AckHeaderLen:])
+		if _, err := io.ReadFull(conn, message[12+8:]); err != nil {
+			return err
+		}
+		seq := binary.BigEndian.Uint32(header)
+		if first && (!a.started || seq == 1) {
+			a.horizon = seq - 1
+			a.started = true
+		}
+		first = false
+
+		switch delta := int32(seq - a.horizon); {
+		case delta <= 0:
+			// Retransmission of a message already delivered
+		case delta == 1:
+			if a.Deliver != nil {
+				if err := a.Deliver(seq, message); err != nil {
+					return err
+				}
+			}
+			a.horizon = seq
+		default:
+			return &AckGapError{Expected: a.horizon + 1, Received: seq}
+		}
+		binary.BigEndian.PutUint32(ack, a.horizon)
+		if _, err := WriteFull(conn, ack); err != nil {
+			return err
+		}
+	}
+}
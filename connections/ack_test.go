@@ -0,0 +1,212 @@
+package connections
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// teeEntry builds a tee stream entry, an OpenFlow context followed by an
+// OpenFlow message, carrying the given payload
+func teeEntry(payload string) []byte {
+	entry := make([]byte, 12+8+len(payload))
+	binary.BigEndian.PutUint64(entry, 0x1)
+	entry[12] = 0x04
+	entry[13] = 10
+	binary.BigEndian.PutUint16(entry[14:], uint16(8+len(payload)))
+	copy(entry[20:], payload)
+	return entry
+}
+
+// payloadOf returns the payload of a tee stream entry
+func payloadOf(entry []byte) string {
+	return string(entry[20:])
+}
+
+// received the messages delivered to a consumer
+type received struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (r *received) deliver(seq uint32, message []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.messages = append(r.messages, payloadOf(message))
+	return nil
+}
+
+func (r *received) wait(t *testing.T, count int) []string {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r.lock.Lock()
+		messages := append([]string(nil), r.messages...)
+		r.lock.Unlock()
+		if len(messages) >= count || time.Now().After(deadline) {
+			return messages
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAckRetransmitOnReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var got received
+	consumer := &AckConsumer{Deliver: got.deliver}
+	go func() {
+		// The first connection reads two messages without delivering
+		// or acknowledging them and is then reset, as if the
+		// consumer crashed, silently losing them
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		io.ReadFull(conn, make([]byte, 2*(AckHeaderLen+len(teeEntry("message-0")))))
+		conn.Close()
+
+		for {
+			if conn, err = listener.Accept(); err != nil {
+				return
+			}
+			consumer.Serve(conn)
+			conn.Close()
+		}
+	}()
+
+	c := (&TCPConnection{Ack: true}).Initialize()
+	if err = c.Dial(listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	go c.ListenAndSend()
+	for i := 0; i < 2; i++ {
+		c.GetQueue() <- teeEntry(fmt.Sprintf("message-%d", i))
+	}
+	// Wait for the reset connection to be re-established before queueing
+	// more, the lost messages are retransmitted first
+	if messages := got.wait(t, 2); len(messages) != 2 {
+		t.Fatalf("Expected unacknowledged messages retransmitted, got %v", messages)
+	}
+	for i := 2; i < 5; i++ {
+		c.GetQueue() <- teeEntry(fmt.Sprintf("message-%d", i))
+	}
+
+	messages := got.wait(t, 5)
+	if len(messages) != 5 {
+		t.Fatalf("Expected 5 messages, got %v", messages)
+	}
+	for i, message := range messages {
+		if message != fmt.Sprintf("message-%d", i) {
+			t.Errorf("Expected messages in order exactly once, got %v", messages)
+			break
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Stats().Ack.Lag != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := c.Stats(); stats.Ack.Horizon != 5 || stats.Ack.Sent != 5 || stats.Ack.Lag != 0 ||
+		stats.Ack.Retransmitted != 2 || stats.Matches != 5 {
+		t.Errorf("Incorrect stats %+v, %+v", stats, stats.Ack)
+	}
+}
+
+func TestAckWindowOverflow(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// The consumer reads, but never acknowledges, messages
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	c := (&TCPConnection{Ack: true, AckWindow: 2}).Initialize()
+	if err = c.Dial(listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	go c.ListenAndSend()
+	for i := 0; i < 5; i++ {
+		c.GetQueue() <- teeEntry("message")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Dropped() != 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := c.Stats(); stats.Dropped != 3 || stats.Ack.Sent != 2 || stats.Ack.Lag != 2 ||
+		stats.Ack.LagTime == "" {
+		t.Errorf("Expected 3 dropped and 2 unacknowledged messages, got %+v, %+v", stats, stats.Ack)
+	}
+}
+
+func TestAckConsumer(t *testing.T) {
+	framed := func(seq uint32, payload string) []byte {
+		header := make([]byte, AckHeaderLen)
+		binary.BigEndian.PutUint32(header, seq)
+		return append(header, teeEntry(payload)...)
+	}
+	serve := func(consumer *AckConsumer, messages ...[]byte) ([]uint32, error) {
+		oftee, conn := net.Pipe()
+		defer oftee.Close()
+		done := make(chan error, 1)
+		go func() {
+			done <- consumer.Serve(conn)
+			conn.Close()
+		}()
+		var acks []uint32
+		buf := make([]byte, AckHeaderLen)
+		for _, message := range messages {
+			oftee.Write(message)
+			if _, err := io.ReadFull(oftee, buf); err != nil {
+				break
+			}
+			acks = append(acks, binary.BigEndian.Uint32(buf))
+		}
+		oftee.Close()
+		return acks, <-done
+	}
+
+	var got received
+	consumer := &AckConsumer{Deliver: got.deliver}
+
+	// A retransmitted message is acknowledged, but not delivered again
+	acks, _ := serve(consumer, framed(1, "a"), framed(2, "b"), framed(2, "b"), framed(3, "c"))
+	if len(acks) != 4 || acks[2] != 2 || acks[3] != 3 || len(got.messages) != 3 {
+		t.Errorf("Expected duplicate discarded, got acks %v, messages %v", acks, got.messages)
+	}
+
+	// On a new connection the retransmissions at or below the horizon are
+	// discarded
+	acks, _ = serve(consumer, framed(2, "b"), framed(3, "c"), framed(4, "d"))
+	if len(acks) != 3 || acks[2] != 4 || len(got.messages) != 4 {
+		t.Errorf("Expected retransmissions discarded, got acks %v, messages %v", acks, got.messages)
+	}
+
+	// A gap means messages were lost
+	_, err := serve(consumer, framed(5, "e"), framed(7, "g"))
+	if gap, ok := err.(*AckGapError); !ok || gap.Expected != 6 || gap.Received != 7 {
+		t.Errorf("Expected sequence gap, got %v", err)
+	}
+
+	// Sequence 1 at the start of a connection means oftee restarted
+	got.messages = nil
+	acks, _ = serve(consumer, framed(1, "a"))
+	if len(acks) != 1 || acks[0] != 1 || len(got.messages) != 1 || consumer.Horizon() != 1 {
+		t.Errorf("Expected horizon reset, got acks %v, messages %v", acks, got.messages)
+	}
+}
@@ -0,0 +1,239 @@
+package connections
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Latency budget demotion strategies
+const (
+	// DemoteSample deliver only one in every `SampleRate` messages while
+	// demoted
+	DemoteSample = "sample"
+
+	// DemotePause deliver no messages while demoted
+	DemotePause = "pause"
+)
+
+// Latency budget defaults and limits
+const (
+	// DefaultBudgetWindow span of the sliding window over which the queue
+	// residency quantile is estimated
+	DefaultBudgetWindow = 10 * time.Second
+
+	// DefaultBudgetSampleRate one in how many messages are delivered by a
+	// demoted end point using the sample strategy
+	DefaultBudgetSampleRate = 10
+
+	// BudgetQuantile the quantile of the queue residency compared against
+	// the budget
+	BudgetQuantile = 0.99
+
+	// BudgetMinSamples minimum number of samples in the window before an
+	// end point is demoted
+	BudgetMinSamples = 20
+
+	// BudgetWindowSamples maximum number of samples kept in the window
+	BudgetWindowSamples = 1024
+
+	// BudgetRecovery fraction of the budget under which the quantile must
+	// fall before a demoted end point is restored
+	BudgetRecovery = 0.8
+)
+
+// BudgetEvent describes an end point being demoted, or restored, because of
+// its queue residency
+type BudgetEvent struct {
+	Endpoint string `json:"endpoint"`
+	Demoted  bool   `json:"demoted"`
+	Strategy string `json:"strategy"`
+	Budget   string `json:"budget"`
+	P99      string `json:"p99"`
+	Samples  int    `json:"samples"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+// Budget enforces a latency budget on an end point. It tracks how long each
+// message spends between being queued and its write to the end point
+// completing, its queue residency. When the 99th percentile of the residency
+// over the sliding `Window` exceeds `Limit` the end point is demoted, either
+// to delivering one in every `SampleRate` messages or to delivering none,
+// depending on the `Strategy`. Messages not delivered are dropped when they
+// are queued and counted. Once the 99th percentile falls below
+// `BudgetRecovery` of the limit, or too few messages are delivered to
+// estimate it, and the end point has been demoted for at least a window, it
+// is restored. While sampling is forced, see `ForceSampling`, an end point
+// that is not demoted delivers one in every `SampleRate` messages.
+//
+// Residency is attributed to messages in the order in which writes complete,
+// so with concurrent writers, i.e. an HTTP end point with multiple workers,
+// individual samples are approximate.
+type Budget struct {
+	Endpoint   string
+	Limit      time.Duration
+	Strategy   string
+	SampleRate int
+	Window     time.Duration
+
+	// Notify, if set, is called when the end point is demoted or restored
+	Notify func(BudgetEvent)
+
+	input    chan []byte
+	output   chan<- []byte
+	stamps   chan time.Time
+	window   *Window
+	demoted  int32
+	since    time.Time
+	received uint64
+	dropped  uint64
+}
+
+// ParseDemote parses a demotion strategy of the form `sample[:N]` or `pause`,
+// returning the strategy and the sample rate
+func ParseDemote(value string) (string, int, error) {
+	parts := strings.SplitN(strings.ToLower(value), ":", 2)
+	switch parts[0] {
+	case DemotePause:
+		if len(parts) == 1 {
+			return DemotePause, 0, nil
+		}
+	case DemoteSample:
+		if len(parts) == 1 {
+			return DemoteSample, DefaultBudgetSampleRate, nil
+		}
+		rate, err := strconv.Atoi(parts[1])
+		if err != nil || rate < 2 {
+			return "", 0, fmt.Errorf("invalid sample rate '%s', must be an integer greater than 1", parts[1])
+		}
+		return DemoteSample, rate, nil
+	}
+	return "", 0, fmt.Errorf("unknown demotion strategy '%s', expected 'sample[:N]' or 'pause'", value)
+}
+
+// Track starts enforcing the budget on messages delivered via the given
+// queue, which is read by at most `inFlight` concurrent writers. It returns
+// the channel on which messages are to be queued instead, each message
+// queued is timestamped before it is passed on to the queue.
+func (b *Budget) Track(queue chan<- []byte, inFlight int) chan<- []byte {
+	if b.Strategy == "" {
+		b.Strategy = DemoteSample
+	}
+	if b.SampleRate < 2 {
+		b.SampleRate = DefaultBudgetSampleRate
+	}
+	if b.Window <= 0 {
+		b.Window = DefaultBudgetWindow
+	}
+	b.input = make(chan []byte)
+	b.output = queue
+	// Holds a timestamp for each message in the queue, being written or
+	// about to be queued, so that it never blocks
+	b.stamps = make(chan time.Time, cap(queue)+inFlight+1)
+	b.window = NewWindow(b.Window, BudgetWindowSamples)
+	go b.forward()
+	return b.input
+}
+
+// Done records the completion of the write of the oldest message being
+// delivered. It MUST be called once for each message taken from the queue,
+// whether or not it was written.
+func (b *Budget) Done() {
+	if b == nil {
+		return
+	}
+	select {
+	case queued := <-b.stamps:
+		now := time.Now()
+		b.window.Add(now, now.Sub(queued))
+	default:
+	}
+}
+
+// Demoted returns true if the end point is currently demoted
+func (b *Budget) Demoted() bool {
+	return atomic.LoadInt32(&b.demoted) == 1
+}
+
+// Dropped returns the number of messages dropped while demoted
+func (b *Budget) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// forward timestamps and passes on queued messages, dropping those that are
+// not to be delivered while the end point is demoted, and periodically
+// evaluates the budget
+func (b *Budget) forward() {
+	interval := b.Window / 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			b.evaluate(now)
+		case message := <-b.input:
+			// Under memory pressure the end point samples even if
+			// it's not demoted
+			if demoted := b.Demoted(); demoted || SamplingForced() {
+				b.received++
+				if demoted && b.Strategy == DemotePause || b.received%uint64(b.SampleRate) != 0 {
+					atomic.AddUint64(&b.dropped, 1)
+					continue
+				}
+			}
+			b.stamps <- time.Now()
+			b.output <- message
+		}
+	}
+}
+
+// evaluate demotes or restores the end point based on the queue residency
+// over the window ending at the given time
+func (b *Budget) evaluate(now time.Time) {
+	p99, samples := b.window.Quantile(BudgetQuantile, now)
+	switch {
+	case !b.Demoted() && samples >= BudgetMinSamples && p99 > b.Limit:
+		b.since = now
+		b.received = 0
+		atomic.StoreInt32(&b.demoted, 1)
+	case b.Demoted() && now.Sub(b.since) >= b.Window &&
+		(samples < BudgetMinSamples || float64(p99) <= float64(b.Limit)*BudgetRecovery):
+		atomic.StoreInt32(&b.demoted, 0)
+	default:
+		return
+	}
+
+	event := BudgetEvent{
+		Endpoint: b.Endpoint,
+		Demoted:  b.Demoted(),
+		Strategy: b.Strategy,
+		Budget:   b.Limit.String(),
+		P99:      p99.String(),
+		Samples:  samples,
+		Dropped:  b.Dropped(),
+	}
+	entry := log.WithFields(log.Fields{
+		"endpoint": b.Endpoint,
+		"strategy": b.Strategy,
+		"budget":   event.Budget,
+		"p99":      event.P99,
+		"samples":  samples,
+		"dropped":  event.Dropped,
+	})
+	if event.Demoted {
+		entry.Warn("End point exceeded its latency budget, demoted")
+	} else {
+		entry.Info("End point latency recovered, restored")
+	}
+	if b.Notify != nil {
+		b.Notify(event)
+	}
+}
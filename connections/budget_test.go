@@ -0,0 +1,148 @@
+package connections
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseDemote(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		strategy string
+		rate     int
+		valid    bool
+	}{
+		{"pause", DemotePause, 0, true},
+		{"sample", DemoteSample, DefaultBudgetSampleRate, true},
+		{"Sample:100", DemoteSample, 100, true},
+		{"sample:1", "", 0, false},
+		{"sample:x", "", 0, false},
+		{"pause:2", "", 0, false},
+		{"drop", "", 0, false},
+	} {
+		strategy, rate, err := ParseDemote(test.value)
+		if (err == nil) != test.valid || strategy != test.strategy || rate != test.rate {
+			t.Errorf("Incorrect parse of '%s', got %s, %d, %v", test.value, strategy, rate, err)
+		}
+	}
+}
+
+// deliver consumes a budget's queue, taking the given time to write each
+// message, until stopped
+func deliver(b *Budget, queue chan []byte, delay *int64, delivered chan<- []byte, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case message := <-queue:
+			time.Sleep(time.Duration(atomic.LoadInt64(delay)))
+			b.Done()
+			delivered <- message
+		}
+	}
+}
+
+func TestBudgetDemoteAndRestore(t *testing.T) {
+	events := make(chan BudgetEvent, 10)
+	b := &Budget{
+		Endpoint:   "test",
+		Limit:      5 * time.Millisecond,
+		Strategy:   DemoteSample,
+		SampleRate: 5,
+		Window:     500 * time.Millisecond,
+		Notify:     func(e BudgetEvent) { events <- e },
+	}
+	queue := make(chan []byte, 100)
+	input := b.Track(queue, 1)
+	delivered := make(chan []byte, 1000)
+	stop := make(chan struct{})
+	defer func() { stop <- struct{}{} }()
+	delay := int64(10 * time.Millisecond)
+	go deliver(b, queue, &delay, delivered, stop)
+
+	// A slow end point is demoted once enough samples are collected
+	deadline := time.After(5 * time.Second)
+	for !b.Demoted() {
+		select {
+		case input <- []byte{0}:
+		case <-deadline:
+			t.Fatal("End point not demoted")
+		}
+	}
+	select {
+	case e := <-events:
+		if !e.Demoted || e.Endpoint != "test" || e.Strategy != DemoteSample || e.Samples < BudgetMinSamples {
+			t.Errorf("Incorrect demotion event, got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No demotion event")
+	}
+
+	// While demoted only one in five messages is delivered
+	atomic.StoreInt64(&delay, 0)
+	for len(delivered) > 0 || len(queue) > 0 {
+		select {
+		case <-delivered:
+		case <-time.After(time.Second):
+		}
+	}
+	before := b.Dropped()
+	for i := 0; i < 50; i++ {
+		input <- []byte{1}
+	}
+
+	// The forwarder counts the last drop after it has read the message, so
+	// the count is polled
+	polled := time.Now().Add(2 * time.Second)
+	for b.Dropped()-before < 40 && time.Now().Before(polled) {
+		time.Sleep(time.Millisecond)
+	}
+	if dropped := b.Dropped() - before; dropped != 40 {
+		t.Errorf("Expected 40 messages dropped while demoted, got %d", dropped)
+	}
+
+	// Once the latency recovers the end point is restored
+	select {
+	case e := <-events:
+		if e.Demoted {
+			t.Errorf("Expected restoration event, got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("End point not restored")
+	}
+	before = b.Dropped()
+	for i := 0; i < 10; i++ {
+		input <- []byte{2}
+	}
+	if b.Dropped() != before {
+		t.Error("Messages dropped after end point restored")
+	}
+}
+
+func TestBudgetPause(t *testing.T) {
+	b := &Budget{Limit: time.Millisecond, Strategy: DemotePause, Window: time.Second}
+	queue := make(chan []byte, 100)
+	input := b.Track(queue, 1)
+	for i := 0; i < BudgetMinSamples; i++ {
+		input <- []byte{0}
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < BudgetMinSamples; i++ {
+		<-queue
+		b.Done()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !b.Demoted() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !b.Demoted() {
+		t.Fatal("End point not demoted")
+	}
+	for i := 0; i < 10; i++ {
+		input <- []byte{1}
+	}
+	if len(queue) != 0 || b.Dropped() != 10 {
+		t.Errorf("Expected all messages dropped while paused, queued %d, dropped %d", len(queue), b.Dropped())
+	}
+}
@@ -0,0 +1,298 @@
+package connections
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// End points that share a compare group, `compare_group=`, are compared as
+// they deliver messages, i.e. while a consumer is migrated to a new end point
+// and both are fed in parallel. The hash of each message delivered by a member
+// is kept in the window of the group until every member has delivered it. A
+// message that a member has not delivered within the tolerance of the first
+// delivery is a divergence, counted against the group and against each member
+// that missed it, so members may deliver messages in a different order as
+// long as it is within the tolerance.
+//
+// The window holds at most `Size` messages, beyond which the oldest is
+// forgotten without being compared, and counted as overflowed, so that the
+// memory used is bounded even when a member stops delivering altogether.
+
+const (
+	// DefaultCompareWindow number of messages kept by a compare group
+	// while they wait for every member to deliver them
+	DefaultCompareWindow = 10000
+
+	// DefaultCompareTolerance time within which every member of a compare
+	// group must deliver a message
+	DefaultCompareTolerance = time.Second
+
+	// MaxCompareMembers number of end points that can share a compare
+	// group
+	MaxCompareMembers = 64
+)
+
+// CompareStats the messages compared by a compare group, and those that
+// diverged, with, for an end point, the messages it missed
+type CompareStats struct {
+	Group      string `json:"group"`
+	Members    int    `json:"members"`
+	Matched    uint64 `json:"matched"`
+	Divergent  uint64 `json:"divergent"`
+	Overflowed uint64 `json:"overflowed,omitempty"`
+	Waiting    int    `json:"waiting"`
+	Missed     uint64 `json:"missed,omitempty"`
+}
+
+// compareEntry a message delivered by some of the members of a group, the
+// members by bit
+type compareEntry struct {
+	hash     uint64
+	first    time.Time
+	seen     uint64
+	expected uint64
+	done     bool
+}
+
+// CompareGroup the window of messages shared by the members of a compare
+// group
+type CompareGroup struct {
+	Name      string
+	Tolerance time.Duration
+	Size      int
+
+	lock       sync.Mutex
+	members    []*CompareMember
+	pending    map[uint64][]*compareEntry
+	order      []*compareEntry
+	waiting    int
+	matched    uint64
+	divergent  uint64
+	overflowed uint64
+	start      sync.Once
+}
+
+// CompareMember the membership of an end point in a compare group, through
+// which it records the messages it delivers. A nil member records nothing,
+// so that connections that are not compared need not check.
+type CompareMember struct {
+	Group    *CompareGroup
+	Endpoint string
+	bit      uint64
+	missed   uint64
+}
+
+// Join adds an end point to the group, starting the comparison of the group
+// when its first member joins
+func (g *CompareGroup) Join(endpoint string) (*CompareMember, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, member := range g.members {
+		if member.Endpoint == endpoint {
+			return member, nil
+		}
+	}
+	if len(g.members) >= MaxCompareMembers {
+		return nil, fmt.Errorf("compare group '%s' already has %d members", g.Name, MaxCompareMembers)
+	}
+	member := &CompareMember{Group: g, Endpoint: endpoint, bit: 1 << uint(len(g.members))}
+	g.members = append(g.members, member)
+	g.start.Do(func() {
+		go g.compareEvery(g.tolerance() / 4)
+	})
+	return member, nil
+}
+
+// tolerance returns the tolerance of the group, or the default
+func (g *CompareGroup) tolerance() time.Duration {
+	if g.Tolerance <= 0 {
+		return DefaultCompareTolerance
+	}
+	return g.Tolerance
+}
+
+// Record records a message delivered by the end point
+func (m *CompareMember) Record(message []byte) {
+	if m == nil {
+		return
+	}
+	h := fnv.New64a()
+	h.Write(message)
+	m.Group.record(m.bit, h.Sum64(), time.Now())
+}
+
+// Stats returns the statistics of the group, with the messages the end point
+// missed, nil for a nil member
+func (m *CompareMember) Stats() *CompareStats {
+	if m == nil {
+		return nil
+	}
+	stats := m.Group.Stats()
+	stats.Missed = atomic.LoadUint64(&m.missed)
+	return &stats
+}
+
+// record records a message delivered by the member with the given bit,
+// completing the earliest entry for the message the member has not yet
+// delivered, or starting a new one
+func (g *CompareGroup) record(bit, hash uint64, now time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, entry := range g.pending[hash] {
+		if entry.seen&bit == 0 {
+			entry.seen |= bit
+			if entry.seen&entry.expected == entry.expected {
+				g.matched++
+				g.forget(entry)
+			}
+			return
+		}
+	}
+
+	var expected uint64
+	for _, member := range g.members {
+		expected |= member.bit
+	}
+	if expected == bit {
+		g.matched++
+		return
+	}
+	size := g.Size
+	if size <= 0 {
+		size = DefaultCompareWindow
+	}
+	for g.waiting >= size {
+		if oldest := g.pop(); oldest != nil {
+			g.overflowed++
+			g.forget(oldest)
+		}
+	}
+	entry := &compareEntry{hash: hash, first: now, seen: bit, expected: expected}
+	if g.pending == nil {
+		g.pending = make(map[uint64][]*compareEntry)
+	}
+	g.pending[hash] = append(g.pending[hash], entry)
+	g.order = append(g.order, entry)
+	g.waiting++
+}
+
+// pop removes the oldest entry from the order of the window, nil if it was
+// already forgotten
+func (g *CompareGroup) pop() *compareEntry {
+	entry := g.order[0]
+	g.order[0] = nil
+	g.order = g.order[1:]
+	if entry.done {
+		return nil
+	}
+	return entry
+}
+
+// forget removes an entry from the window
+func (g *CompareGroup) forget(entry *compareEntry) {
+	entry.done = true
+	g.waiting--
+	entries := g.pending[entry.hash]
+	for i, e := range entries {
+		if e == entry {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+	if len(entries) == 0 {
+		delete(g.pending, entry.hash)
+	} else {
+		g.pending[entry.hash] = entries
+	}
+}
+
+// compare counts the messages that were not delivered by every member
+// within the tolerance as divergent
+func (g *CompareGroup) compare(now time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	tolerance := g.tolerance()
+	for len(g.order) > 0 && (g.order[0].done || now.Sub(g.order[0].first) >= tolerance) {
+		entry := g.pop()
+		if entry == nil {
+			continue
+		}
+		g.divergent++
+		for _, member := range g.members {
+			if entry.expected&member.bit != 0 && entry.seen&member.bit == 0 {
+				atomic.AddUint64(&member.missed, 1)
+			}
+		}
+		g.forget(entry)
+	}
+}
+
+// compareEvery compares the window of the group at the given interval
+func (g *CompareGroup) compareEvery(interval time.Duration) {
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	for now := range ticker.C {
+		g.compare(now)
+	}
+}
+
+// Stats returns the statistics of the group
+func (g *CompareGroup) Stats() CompareStats {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return CompareStats{
+		Group:      g.Name,
+		Members:    len(g.members),
+		Matched:    g.matched,
+		Divergent:  g.divergent,
+		Overflowed: g.overflowed,
+		Waiting:    g.waiting,
+	}
+}
+
+// CompareGroups the compare groups, by name, so that end points established
+// at different times, or for each device connection, share the group
+type CompareGroups struct {
+	lock   sync.Mutex
+	groups map[string]*CompareGroup
+}
+
+// Get returns the named group, creating it with the given tolerance and
+// window size if needed
+func (g *CompareGroups) Get(name string, tolerance time.Duration, size int) *CompareGroup {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.groups == nil {
+		g.groups = make(map[string]*CompareGroup)
+	}
+	group, ok := g.groups[name]
+	if !ok {
+		group = &CompareGroup{Name: name, Tolerance: tolerance, Size: size}
+		g.groups[name] = group
+	}
+	return group
+}
+
+// Stats returns the statistics of every group, by name
+func (g *CompareGroups) Stats() []CompareStats {
+	g.lock.Lock()
+	groups := make([]*CompareGroup, 0, len(g.groups))
+	for _, group := range g.groups {
+		groups = append(groups, group)
+	}
+	g.lock.Unlock()
+	stats := make([]CompareStats, 0, len(groups))
+	for _, group := range groups {
+		stats = append(stats, group.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Group < stats[j].Group
+	})
+	return stats
+}
@@ -0,0 +1,83 @@
+package connections
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCompareGroupDivergence(t *testing.T) {
+	group := &CompareGroup{Name: "migration", Tolerance: time.Hour}
+	old, err := group.Join("tcp://old:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacement, _ := group.Join("tcp://new:9000")
+	if again, _ := group.Join("tcp://old:9000"); again != old {
+		t.Error("Expected an end point to join a group once")
+	}
+
+	// The replacement delivers the messages in a different order, and
+	// drops every tenth of them
+	var messages [][]byte
+	for i := 0; i < 100; i++ {
+		messages = append(messages, []byte(fmt.Sprintf("message %d", i)))
+		old.Record(messages[i])
+	}
+	dropped := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		if i%10 == 3 {
+			dropped++
+			continue
+		}
+		replacement.Record(messages[i])
+	}
+	if stats := group.Stats(); stats.Matched != 90 || stats.Waiting != dropped || stats.Divergent != 0 {
+		t.Errorf("Expected 90 messages matched, %d waiting, got %+v", dropped, stats)
+	}
+
+	// Once the tolerance expires the messages the replacement dropped
+	// diverge, and are forgotten
+	group.compare(time.Now().Add(time.Hour))
+	if stats := old.Stats(); stats.Divergent != uint64(dropped) || stats.Missed != 0 || stats.Waiting != 0 {
+		t.Errorf("Expected %d messages divergent, none missed by the old end point, got %+v", dropped, stats)
+	}
+	if stats := replacement.Stats(); stats.Missed != uint64(dropped) {
+		t.Errorf("Expected %d messages missed by the replacement, got %+v", dropped, stats)
+	}
+
+	// Identical messages are compared by their number
+	old.Record([]byte("keepalive"))
+	old.Record([]byte("keepalive"))
+	replacement.Record([]byte("keepalive"))
+	group.compare(time.Now().Add(time.Hour))
+	if stats := group.Stats(); stats.Matched != 91 || stats.Divergent != uint64(dropped)+1 {
+		t.Errorf("Expected a repeated message missed, got %+v", stats)
+	}
+
+	// A nil member records nothing
+	var none *CompareMember
+	none.Record([]byte("message"))
+	if none.Stats() != nil {
+		t.Error("Expected no stats for a nil member")
+	}
+}
+
+func TestCompareGroupWindow(t *testing.T) {
+	group := &CompareGroup{Name: "migration", Tolerance: time.Hour, Size: 10}
+	old, _ := group.Join("tcp://old:9000")
+	group.Join("tcp://new:9000")
+
+	// The replacement delivers nothing, so the window is bounded by
+	// forgetting the oldest messages
+	for i := 0; i < 25; i++ {
+		old.Record([]byte(fmt.Sprintf("message %d", i)))
+	}
+	if stats := group.Stats(); stats.Waiting != 10 || stats.Overflowed != 15 || stats.Divergent != 0 {
+		t.Errorf("Expected 10 messages waiting, 15 overflowed, got %+v", stats)
+	}
+	group.compare(time.Now())
+	if stats := group.Stats(); stats.Waiting != 10 {
+		t.Errorf("Expected messages within the tolerance still waiting, got %+v", stats)
+	}
+}
@@ -6,7 +6,13 @@
 package connections
 
 import (
+	"context"
 	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
 	"github.com/ciena/oftee/criteria"
 )
 
@@ -24,6 +30,108 @@ type Connection interface {
 	String() string
 }
 
+// WriteFull writes all of the given bytes, writing the remainder again after a
+// short write, until they are all written or the write fails. A writer that
+// makes no progress, writing nothing without an error, fails with
+// `io.ErrShortWrite`. Returns the number of bytes written.
+func WriteFull(w io.Writer, b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := w.Write(b[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// WriteContext writes all of the given bytes to the connection, see
+// `WriteFull`, abandoning the write once the context is done, by expiring the
+// write deadline of the connection. The context's deadline, if any, is also
+// applied to the write. The write deadline is cleared once the write
+// completes. Returns the context's error if the write was abandoned.
+func WriteContext(ctx context.Context, conn net.Conn, b []byte) (int, error) {
+	if ctx.Done() == nil {
+		return WriteFull(conn, b)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetWriteDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	n, err := WriteFull(conn, b)
+	close(stop)
+	<-exited
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil && ctx.Err() != nil {
+		return n, ctx.Err()
+	}
+	return n, err
+}
+
 // ErrUninitialized is the error thrown when the processing loop is invoked
 // against connection before a communications channel has been created
 var ErrUninitialized = errors.New("connection: attempt to listen on connection before it was initialized")
+
+// ErrUndelivered is the error returned when a connection is closed before the
+// messages queued to it could be delivered
+var ErrUndelivered = errors.New("connection: closed before the messages queued were delivered")
+
+// DefaultQueueSize is the number of messages that may be queued to an end
+// point, unless its `QueueSize` is set
+const DefaultQueueSize = 100
+
+// CloseTimeout is the maximum time a connection that is closed waits for the
+// messages queued to it to be delivered
+const CloseTimeout = 5 * time.Second
+
+// queueOf creates the queue of a connection, of the given size, or of
+// `DefaultQueueSize` if not set
+func queueOf(size int) chan []byte {
+	if size < 1 {
+		size = DefaultQueueSize
+	}
+	return make(chan []byte, size)
+}
+
+// dropOldest removes the oldest message from a full queue, so that a message
+// can be queued in its place, counting it as dropped. Messages are not
+// dropped from the queue of a connection with a latency budget, which drops
+// them according to its strategy, in which case false is returned.
+func dropOldest(queue chan []byte, budget *Budget, dropped *uint64) bool {
+	if budget != nil {
+		return false
+	}
+	select {
+	case <-queue:
+		atomic.AddUint64(dropped, 1)
+	default:
+	}
+	return true
+}
+
+// drain waits, up to `CloseTimeout`, for the messages queued to a connection
+// that is being closed to be delivered, see `Endpoints.Flush`, and then stops
+// its delivery loop
+func drain(conn Connection, stop chan struct{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), CloseTimeout)
+	defer cancel()
+	err := Endpoints{conn}.Flush(ctx)
+	close(stop)
+	if err != nil {
+		return ErrUndelivered
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package connections
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/criteria"
+)
+
+// shortConn a connection that writes at most `limit` bytes at a time,
+// reporting the short write without an error
+type shortConn struct {
+	net.Conn
+	limit  int
+	writes int
+}
+
+func (c *shortConn) Write(b []byte) (int, error) {
+	c.writes++
+	if len(b) > c.limit {
+		b = b[:c.limit]
+	}
+	return c.Conn.Write(b)
+}
+
+// blockingConn an end point that never drops messages, so queuing to it
+// blocks once its queue is full
+type blockingConn struct {
+	queue chan []byte
+}
+
+func (c *blockingConn) Match(criteria.Criteria) bool { return true }
+func (c *blockingConn) GetQueue() chan<- []byte      { return c.queue }
+func (c *blockingConn) ListenAndSend() error         { select {} }
+func (c *blockingConn) String() string               { return "blocking" }
+
+// stalledWriter a writer that makes no progress
+type stalledWriter struct{}
+
+func (stalledWriter) Write(b []byte) (int, error) {
+	return 0, nil
+}
+
+func TestWriteFullRetriesShortWrites(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := &shortConn{Conn: local, limit: 3}
+	c := &TCPConnection{Connection: conn}
+
+	message := []byte("a message longer than a single write")
+	received := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(remote)
+		received <- data
+	}()
+	if n, err := c.Write(message); err != nil || n != len(message) {
+		t.Errorf("Expected %d bytes written, got %d (%v)", len(message), n, err)
+	}
+	local.Close()
+	if data := <-received; !bytes.Equal(data, message) {
+		t.Errorf("Expected '%s' received, got '%s'", message, data)
+	}
+	if conn.writes != (len(message)+2)/3 {
+		t.Errorf("Expected %d writes, got %d", (len(message)+2)/3, conn.writes)
+	}
+}
+
+func TestWriteFullStalled(t *testing.T) {
+	if n, err := WriteFull(stalledWriter{}, []byte("message")); err != io.ErrShortWrite || n != 0 {
+		t.Errorf("Expected a short write, got %d (%v)", n, err)
+	}
+}
+
+func TestWriteFullClosed(t *testing.T) {
+	local, remote := net.Pipe()
+	conn := &shortConn{Conn: local, limit: 4}
+	go func() {
+		buf := make([]byte, 4)
+		io.ReadFull(remote, buf)
+		remote.Close()
+	}()
+	if n, err := WriteFull(conn, []byte("truncated message")); err == nil || n != 4 {
+		t.Errorf("Expected an error after 4 bytes written, got %d (%v)", n, err)
+	}
+}
+
+func TestWriteContextCancelled(t *testing.T) {
+	// The peer doesn't read, so the write blocks until the context is done
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := &TCPConnection{Connection: local}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := conn.WriteContext(ctx, []byte("abandoned")); err != context.Canceled {
+		t.Errorf("Expected the write abandoned, got %v", err)
+	}
+
+	// The deadline is cleared, so the connection can still be written
+	go io.ReadFull(remote, make([]byte, 7))
+	if n, err := conn.Write([]byte("message")); err != nil || n != 7 {
+		t.Errorf("Expected the message written, got %d (%v)", n, err)
+	}
+}
+
+func TestConditionalWriteCancelled(t *testing.T) {
+	// The end point is never delivered to and doesn't drop messages, so
+	// once its queue is full queuing blocks until the context is done
+	wedged := &blockingConn{queue: make(chan []byte, 1)}
+	wedged.queue <- []byte{}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	written, err := Endpoints{wedged}.ConditionalWrite(ctx, []byte("message"), criteria.Criteria{})
+	if err != context.Canceled || written[0] != 0 {
+		t.Errorf("Expected nothing written once cancelled, got %v (%v)", written, err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	// Flushed once the last message has been read, not once it has left
+	// the queue
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := (&TCPConnection{Connection: client}).Initialize()
+	go conn.ListenAndSend()
+	for i := 0; i < 3; i++ {
+		conn.GetQueue() <- []byte{byte(i)}
+	}
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		b := make([]byte, 1)
+		for i := 0; i < 3; i++ {
+			time.Sleep(10 * time.Millisecond)
+			io.ReadFull(server, b)
+		}
+	}()
+	if err := (Endpoints{conn}).Flush(context.Background()); err != nil {
+		t.Fatalf("Expected the end point flushed, got %v", err)
+	}
+	select {
+	case <-read:
+	default:
+		t.Error("Expected flushed only once every message was read")
+	}
+
+	// An end point that is never delivered to is never flushed
+	wedged := (&TCPConnection{}).Initialize()
+	wedged.queue <- []byte{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := (Endpoints{wedged}).Flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the flush to time out, got %v", err)
+	}
+}
+
+func TestConditionalWriteDropsOldest(t *testing.T) {
+	// The end point is never delivered to, so once its queue is full the
+	// oldest messages make room for the newest
+	wedged := (&TCPConnection{QueueSize: 2}).Initialize()
+	for i := 0; i < 5; i++ {
+		written, err := Endpoints{wedged}.ConditionalWrite(context.Background(), []byte{byte(i)}, criteria.Criteria{})
+		if err != nil || written[0] != 1 {
+			t.Fatalf("Expected message %d queued, got %v (%v)", i, written, err)
+		}
+	}
+	if first, second := <-wedged.queue, <-wedged.queue; first[0] != 3 || second[0] != 4 {
+		t.Errorf("Expected the newest messages queued, got %v and %v", first, second)
+	}
+	if dropped := wedged.Stats().Dropped; dropped != 3 {
+		t.Errorf("Expected 3 messages dropped, got %d", dropped)
+	}
+}
+
+func TestCloseFlushes(t *testing.T) {
+	client, server := net.Pipe()
+	conn := (&TCPConnection{Connection: client}).Initialize()
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- conn.ListenAndSend()
+	}()
+	conn.GetQueue() <- []byte("message")
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(server)
+		received <- data
+	}()
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Expected the end point closed, got %v", err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Expected delivery stopped cleanly, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected delivery stopped once closed")
+	}
+
+	// Its connection is closed, once the queued message is delivered
+	if data := <-received; string(data) != "message" {
+		t.Errorf("Expected the queued message delivered, got '%s'", data)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Expected closing again to do nothing, got %v", err)
+	}
+}
+
+func TestConditionalWriteCounts(t *testing.T) {
+	eapol := criteria.Criteria{Set: criteria.BitDLType, DlType: 0x888e}
+	eps := Endpoints{
+		(&TCPConnection{Criteria: eapol}).Initialize(),
+		(&TCPConnection{Criteria: criteria.Criteria{Set: criteria.BitDLType, DlType: 0x0806}}).Initialize(),
+	}
+	written, err := eps.ConditionalWrite(context.Background(), make([]byte, 42), eapol)
+	if err != nil || len(written) != 2 || written[0] != 42 || written[1] != 0 {
+		t.Errorf("Expected 42 bytes written to the first end point only, got %v (%v)", written, err)
+	}
+}
+
+func TestRequiredCriteriaBits(t *testing.T) {
+	eapol := (&ShadowConnection{Criteria: criteria.Criteria{Set: criteria.BitDLType, DlType: 0x888e}}).Initialize()
+	port := (&ShadowConnection{Criteria: criteria.Criteria{Set: criteria.BitInPort, InPort: 1}}).Initialize()
+	all := (&ShadowConnection{}).Initialize()
+	if bits := (Endpoints{all, port}).RequiredCriteriaBits(); bits != criteria.BitInPort {
+		t.Errorf("Expected only the port required, got 0x%x", bits)
+	}
+	throttled := &Throttled{Connection: eapol, Throttle: &Throttle{Sample: 2}}
+	if bits := (Endpoints{throttled, port}).RequiredCriteriaBits(); bits != criteria.BitDLType|criteria.BitInPort {
+		t.Errorf("Expected the Ethernet type and port required, got 0x%x", bits)
+	}
+	if bits := (Endpoints{}).RequiredCriteriaBits(); bits != criteria.BitEmpty {
+		t.Errorf("Expected nothing required without end points, got 0x%x", bits)
+	}
+
+	// What an end point whose criteria aren't known matches on can't be
+	// told, so everything is required
+	unknown := struct{ Connection }{all}
+	if bits := (Endpoints{all, unknown}).RequiredCriteriaBits(); bits&criteria.BitsPacket != criteria.BitsPacket {
+		t.Errorf("Expected every value required, got 0x%x", bits)
+	}
+}
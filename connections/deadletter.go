@@ -0,0 +1,74 @@
+package connections
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// deadLetterSeq sequences the dead letters written, so that those written at
+// the same time, to the same directory, by any end point, are distinct
+var deadLetterSeq uint64
+
+// DeadLetter describes a message an end point failed to deliver, written as
+// the JSON sidecar of the message, see `DeadLetters`
+type DeadLetter struct {
+	Time     time.Time `json:"time"`
+	Endpoint string    `json:"endpoint"`
+	Attempts int       `json:"attempts"`
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error"`
+}
+
+// DeadLetters a directory to which the messages an end point gave up
+// delivering are written, rather than dropped. Each message is written, as it
+// was queued, to a file named by the time and a sequence, i.e.
+// `20180901T120000.000000000Z-000001.msg`, followed by its sidecar, of the
+// same name ending in `.json`. The sidecar is renamed into place once
+// written, so a message whose sidecar exists is complete.
+type DeadLetters struct {
+	Dir     string
+	written uint64
+}
+
+// NewDeadLetters creates the dead letters of a directory, which is created if
+// it doesn't exist
+func NewDeadLetters(dir string) (*DeadLetters, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DeadLetters{Dir: dir}, nil
+}
+
+// Write writes a message, and its sidecar, to the directory
+func (d *DeadLetters) Write(message []byte, letter DeadLetter) error {
+	sidecar, err := json.Marshal(&letter)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(d.Dir, fmt.Sprintf("%s-%06d",
+		letter.Time.UTC().Format("20060102T150405.000000000Z"), atomic.AddUint64(&deadLetterSeq, 1)))
+	if err = ioutil.WriteFile(name+".msg", message, 0644); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(name+".json.tmp", sidecar, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(name+".json.tmp", name+".json"); err != nil {
+		return err
+	}
+	atomic.AddUint64(&d.written, 1)
+	return nil
+}
+
+// Written returns the number of messages written, none if nil
+func (d *DeadLetters) Written() uint64 {
+	if d == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&d.written)
+}
@@ -0,0 +1,70 @@
+package connections
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Symbolic names for the DSCP code points, as defined in RFC 2474, RFC 2597
+// and RFC 3246
+var dscpNames = map[string]int{
+	"default": 0,
+	"be":      0,
+	"cs0":     0,
+	"cs1":     8,
+	"af11":    10,
+	"af12":    12,
+	"af13":    14,
+	"cs2":     16,
+	"af21":    18,
+	"af22":    20,
+	"af23":    22,
+	"cs3":     24,
+	"af31":    26,
+	"af32":    28,
+	"af33":    30,
+	"cs4":     32,
+	"af41":    34,
+	"af42":    36,
+	"af43":    38,
+	"cs5":     40,
+	"ef":      46,
+	"cs6":     48,
+	"cs7":     56,
+}
+
+// ParseDSCP converts a DSCP specification into its numeric code point. The
+// value may either be a symbolic name, i.e. `cs6` or `ef`, or a number in
+// the range 0-63 expressed in any base accepted by `strconv.ParseUint`.
+func ParseDSCP(value string) (int, error) {
+	if dscp, ok := dscpNames[strings.ToLower(value)]; ok {
+		return dscp, nil
+	}
+	dscp, err := strconv.ParseUint(value, 0, 8)
+	if err != nil || dscp > 63 {
+		return 0, fmt.Errorf("invalid DSCP value '%s', expected a name or a number between 0 and 63", value)
+	}
+	return int(dscp), nil
+}
+
+// MarkDSCP sets the DSCP code point for all outbound traffic on the given
+// connection by setting IP_TOS (IPv4) or IPV6_TCLASS (IPv6) on the underlying
+// socket.
+func MarkDSCP(conn net.Conn, dscp int) error {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("unable to mark DSCP on non TCP connection to '%s'", conn.RemoteAddr())
+	}
+
+	// The DSCP occupies the upper six bits of the TOS / traffic class
+	// octet, the lower two are used for ECN
+	if addr.IP.To4() != nil {
+		return ipv4.NewConn(conn).SetTOS(dscp << 2)
+	}
+	return ipv6.NewConn(conn).SetTrafficClass(dscp << 2)
+}
@@ -0,0 +1,61 @@
+package connections
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+)
+
+func TestParseDSCP(t *testing.T) {
+	for value, expected := range map[string]int{
+		"cs6":  48,
+		"EF":   46,
+		"af41": 34,
+		"be":   0,
+		"46":   46,
+		"0x2e": 46,
+		"63":   63,
+	} {
+		dscp, err := ParseDSCP(value)
+		if err != nil {
+			t.Errorf("Unexpected error parsing '%s': %s", value, err)
+		}
+		if dscp != expected {
+			t.Errorf("Incorrect DSCP for '%s', expected %d, got %d", value, expected, dscp)
+		}
+	}
+}
+
+func TestParseBadDSCP(t *testing.T) {
+	for _, value := range []string{"", "64", "-1", "cs8", "expedited"} {
+		if _, err := ParseDSCP(value); err == nil {
+			t.Errorf("Expected error parsing '%s'", value)
+		}
+	}
+}
+
+func TestMarkDSCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err = MarkDSCP(conn, 46); err != nil {
+		t.Skipf("Platform does not support DSCP marking: %s", err)
+	}
+	tos, err := ipv4.NewConn(conn).TOS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tos != 46<<2 {
+		t.Errorf("Incorrect TOS read from socket, expected 0x%02x, got 0x%02x", 46<<2, tos)
+	}
+}
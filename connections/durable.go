@@ -0,0 +1,170 @@
+package connections
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/spool"
+	log "github.com/sirupsen/logrus"
+)
+
+// Delivery retry intervals of a durable end point, the interval doubles
+// after each failure up to the maximum
+const (
+	DurableRetryInterval    = 100 * time.Millisecond
+	DurableMaxRetryInterval = 30 * time.Second
+)
+
+// Deliverer is implemented by connections that can deliver a single message
+// and report whether the end point acknowledged it
+type Deliverer interface {
+	Deliver(message []byte) error
+}
+
+// DurableConnection is an end point with guaranteed, at-least-once,
+// delivery. Each message is appended to the `Spool` as it is queued, and
+// delivered from the spool by `Target`, retrying until it is acknowledged.
+// Messages that were not acknowledged when the process stopped are
+// redelivered from the spool when it is restarted, so an end point may
+// receive a message more than once.
+//
+// The queue is unbuffered, so that a queued message is spooled before the
+// next is matched, and the spool's sync policy applies back pressure to the
+// device connections.
+type DurableConnection struct {
+	Criteria criteria.Criteria
+	Target   Deliverer
+	Address  string
+	Spool    *spool.Spool
+	queue    chan []byte
+	matches  uint64
+	bytes    uint64
+	dropped  uint64
+}
+
+// Initialize makes sure private members, that can't function from zero
+// state, are set correctly
+func (c *DurableConnection) Initialize() *DurableConnection {
+	c.queue = make(chan []byte)
+	return c
+}
+
+// GetQueue returns the channel used to queue messages up for delivery
+func (c *DurableConnection) GetQueue() chan<- []byte {
+	return c.queue
+}
+
+// ListenAndSend spools the queued messages and delivers them from the spool
+func (c *DurableConnection) ListenAndSend() error {
+	if c.queue == nil {
+		log.
+			WithError(ErrUninitialized).
+			Error("MUST initialize connection before use")
+		return ErrUninitialized
+	}
+	go c.deliver()
+	for message := range c.queue {
+		atomic.AddUint64(&c.matches, 1)
+		atomic.AddUint64(&c.bytes, uint64(len(message)))
+		if _, err := c.Spool.Append(message); err != nil {
+			atomic.AddUint64(&c.dropped, 1)
+			log.
+				WithFields(log.Fields{
+					"target": c.Address,
+				}).
+				WithError(err).
+				Error("Unable to spool message for durable end point, dropping")
+		}
+	}
+	return nil
+}
+
+// deliver delivers the spooled messages in order, retrying each until it is
+// acknowledged
+func (c *DurableConnection) deliver() {
+	for {
+		seq, message, err := c.Spool.Next(nil)
+		if err == spool.ErrClosed {
+			return
+		}
+		if err != nil {
+			log.
+				WithFields(log.Fields{
+					"target": c.Address,
+				}).
+				WithError(err).
+				Error("Unable to read message from spool")
+			time.Sleep(DurableRetryInterval)
+			continue
+		}
+
+		retry := DurableRetryInterval
+		for {
+			if err = c.Target.Deliver(message); err == nil {
+				break
+			}
+			log.
+				WithFields(log.Fields{
+					"target": c.Address,
+					"retry":  retry,
+				}).
+				WithError(err).
+				Warn("Unable to deliver spooled message to durable end point, retrying")
+			time.Sleep(retry)
+			if retry *= 2; retry > DurableMaxRetryInterval {
+				retry = DurableMaxRetryInterval
+			}
+		}
+		if err = c.Spool.Ack(seq); err != nil {
+			log.
+				WithFields(log.Fields{
+					"target": c.Address,
+				}).
+				WithError(err).
+				Error("Unable to record acknowledgment in spool, message will be redelivered on restart")
+		}
+	}
+}
+
+// Match compares the end point's criteria against the given criteria
+func (c *DurableConnection) Match(state criteria.Criteria) bool {
+	return c.Criteria.Match(state)
+}
+
+// CriteriaBits returns the values the end point matches on
+func (c *DurableConnection) CriteriaBits() uint64 {
+	return c.Criteria.Bits()
+}
+
+// Stats returns the number of messages, and bytes, matched by the end point,
+// the state of its spool and, if its target has one, of its journal
+func (c *DurableConnection) Stats() EndpointStats {
+	stats := c.Spool.Stats()
+	endpoint := EndpointStats{
+		Endpoint: c.Address,
+		Matches:  atomic.LoadUint64(&c.matches),
+		Bytes:    atomic.LoadUint64(&c.bytes),
+		Dropped:  atomic.LoadUint64(&c.dropped),
+		Spool:    &stats,
+	}
+	switch target := c.Target.(type) {
+	case *HTTPConnection:
+		endpoint.TLS = target.TLSStats()
+		endpoint.Journal = target.Journal.Stats()
+		endpoint.Compare = target.Compare.Stats()
+	case *TCPConnection:
+		endpoint.Journal = target.Journal.Stats()
+		endpoint.Compare = target.Compare.Stats()
+	case *KafkaConnection:
+		endpoint.Journal = target.Journal.Stats()
+		endpoint.Compare = target.Compare.Stats()
+	}
+	return endpoint
+}
+
+func (c *DurableConnection) String() string {
+	stats := c.Spool.Stats()
+	return fmt.Sprintf("(%s, durable, %d)", c.Address, stats.Pending)
+}
@@ -0,0 +1,159 @@
+package connections
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/spool"
+)
+
+// recorder is a Deliverer that records the messages delivered to it, failing
+// while `fail` is set
+type recorder struct {
+	lock      sync.Mutex
+	fail      bool
+	attempts  int
+	delivered []string
+}
+
+func (r *recorder) Deliver(message []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.attempts++
+	if r.fail {
+		return errors.New("end point unavailable")
+	}
+	r.delivered = append(r.delivered, string(message))
+	return nil
+}
+
+func (r *recorder) state() (int, []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.attempts, append([]string(nil), r.delivered...)
+}
+
+func TestDurableRedeliveryAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The end point is unavailable, so nothing is acknowledged
+	s, err := spool.Open(dir, spool.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unavailable := &recorder{fail: true}
+	c := (&DurableConnection{Target: unavailable, Address: "unavailable", Spool: s}).Initialize()
+	go c.ListenAndSend()
+	for i := 0; i < 3; i++ {
+		c.GetQueue() <- []byte(fmt.Sprintf("lease-%d", i))
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for attempts, _ := unavailable.state(); attempts < 2 && time.Now().Before(deadline); attempts, _ = unavailable.state() {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := c.Stats(); stats.Matches != 3 || stats.Spool.Pending != 3 {
+		t.Errorf("Expected 3 messages pending, got %+v, %+v", stats, stats.Spool)
+	}
+	s.Close()
+
+	// After a restart the unacknowledged messages are delivered, in order
+	if s, err = spool.Open(dir, spool.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	available := &recorder{}
+	c = (&DurableConnection{Target: available, Address: "available", Spool: s}).Initialize()
+	go c.ListenAndSend()
+	c.GetQueue() <- []byte("lease-3")
+
+	deadline = time.Now().Add(2 * time.Second)
+	for _, delivered := available.state(); len(delivered) < 4 && time.Now().Before(deadline); _, delivered = available.state() {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, delivered := available.state(); fmt.Sprint(delivered) != "[lease-0 lease-1 lease-2 lease-3]" {
+		t.Errorf("Expected spooled messages redelivered in order, got %v", delivered)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for c.Stats().Spool.Pending != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := c.Stats(); stats.Spool.Pending != 0 {
+		t.Errorf("Expected all messages acknowledged, got %+v", stats.Spool)
+	}
+}
+
+func TestHTTPDeliverAcknowledgment(t *testing.T) {
+	var status = http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(status)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	c := (&HTTPConnection{Connection: *u}).Initialize()
+
+	if err := c.Deliver([]byte("lease")); err == nil {
+		t.Error("Expected a 503 response not to acknowledge delivery")
+	}
+	status = http.StatusNoContent
+	if err := c.Deliver([]byte("lease")); err != nil {
+		t.Errorf("Expected a 204 response to acknowledge delivery, got %v", err)
+	}
+}
+
+func TestKafkaDeliverAcknowledgment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	broker := newKafkaBroker(t, 1)
+	defer broker.close()
+	broker.lock.Lock()
+	broker.failing = true
+	broker.lock.Unlock()
+	target := (&KafkaConnection{Brokers: []string{broker.listener.Addr().String()}, Topic: "leases"}).Initialize()
+
+	// A record the leader of its partition doesn't acknowledge stays in the
+	// spool, and is retried until it does
+	if err = target.Deliver(kafkaPacketIn(1, 1)); err == nil {
+		t.Error("Expected a record the leader failed not to acknowledge delivery")
+	}
+	s, err := spool.Open(dir, spool.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := (&DurableConnection{Target: target, Address: "kafka", Spool: s}).Initialize()
+	go c.ListenAndSend()
+	c.GetQueue() <- kafkaPacketIn(1, 2)
+	time.Sleep(50 * time.Millisecond)
+	if stats := c.Stats(); stats.Spool.Pending != 1 || len(broker.produced()) != 0 {
+		t.Errorf("Expected the record pending, got %+v and %d produced", stats.Spool, len(broker.produced()))
+	}
+
+	broker.lock.Lock()
+	broker.failing = false
+	broker.lock.Unlock()
+	if records := waitRecords(t, broker, 1); records[0].headers[HeaderInPort] != "2" {
+		t.Errorf("Expected the spooled record produced, got %+v", records[0])
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Stats().Spool.Pending != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := c.Stats(); stats.Spool.Pending != 0 || target.Stats().Dropped != 0 {
+		t.Errorf("Expected the record acknowledged, and none dropped, got %+v and %+v", stats.Spool, target.Stats())
+	}
+}
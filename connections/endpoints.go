@@ -1,6 +1,11 @@
 package connections
 
 import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
 	"github.com/ciena/oftee/criteria"
 	log "github.com/sirupsen/logrus"
 )
@@ -8,6 +13,35 @@ import (
 // Endpoints represents a list (array) of connections
 type Endpoints []Connection
 
+// FlushInterval interval at which the end points are checked for messages
+// yet to be delivered while flushing, see `Endpoints.Flush`
+const FlushInterval = 10 * time.Millisecond
+
+// pending is implemented by the connections that report the messages queued
+// to them that are yet to be delivered, including those being delivered
+type pending interface {
+	Pending() int
+}
+
+// dropper is implemented by the connections that drop the oldest message
+// queued to them, rather than block, when their queue is full
+type dropper interface {
+	dropOldest() bool
+}
+
+// StateConnection is implemented by connections that keep a connection to
+// their end point established, and report whether it is, `StateConnected`,
+// or is being established, `StateConnecting`
+type StateConnection interface {
+	State() string
+}
+
+// matcher is implemented by the connections whose criteria are known, so
+// that only what they match on need be decoded from a packet
+type matcher interface {
+	CriteriaBits() uint64
+}
+
 // Iterates over all endpoint connections and write the given bytes to the
 // connection. If a write to an any single connection fails then processing
 // of the remaining writes is not attempted and an error is returned.
@@ -15,15 +49,35 @@ func (eps Endpoints) Write(b []byte) (n int, err error) {
 	for _, conn := range eps {
 		conn.GetQueue() <- b
 	}
-	return n, nil
+	return len(b), nil
 }
 
 // ConditionalWrite iterates over all endpoint connections and if the connection's criteria
 // matches the given state critera then write the given bytes to the connection.
 // If a write to an any single connection fails then processing of the
 // remaining writes is not attempted and an error is returned.
-func (eps Endpoints) ConditionalWrite(b []byte, state criteria.Criteria) (n int, err error) {
-	for _, conn := range eps {
+//
+// The number of bytes written to each end point, by its index, is returned,
+// zero for those that didn't match. A message is queued whole, so a matched
+// end point is written all of the bytes.
+//
+// The members of a transaction group, that match the state criteria, are
+// written all or nothing, see `TxnGroup`. An end point that is throttled is
+// written only the messages its throttle allows, see `Throttle`.
+//
+// While the queues are shrunk, see `SetQueueLimit`, an end point whose queue
+// is at the limit is written nothing, unless it is durable.
+//
+// Queuing to an end point whose queue is full drops the oldest message queued
+// to it, so that a slow end point doesn't stall the device. Of an end point
+// that doesn't drop messages, such as a durable one, one with a latency
+// budget or a member of a transaction group, queuing blocks until the message can be queued or the context is
+// done, in which case the context's error is returned and the remaining end
+// points are not written.
+func (eps Endpoints) ConditionalWrite(ctx context.Context, b []byte, state criteria.Criteria) (written []int, err error) {
+	written = make([]int, len(eps))
+	var decided []txnDecision
+	for i, conn := range eps {
 		if log.GetLevel() >= log.DebugLevel {
 			log.
 				WithFields(log.Fields{
@@ -32,9 +86,153 @@ func (eps Endpoints) ConditionalWrite(b []byte, state criteria.Criteria) (n int,
 				}).
 				Debug("Checking")
 		}
-		if conn.Match(state) {
-			conn.GetQueue() <- b
+		if !conn.Match(state) {
+			continue
+		}
+		member, isMember := conn.(*TxnMember)
+		if isMember && !eps.txnAccepts(&decided, member.Group, state) {
+			continue
+		}
+		if throttled, ok := conn.(*Throttled); ok && !throttled.Throttle.Allow(time.Now()) {
+			continue
+		}
+
+		// The members of a transaction group accepted the message, so
+		// each is written it, whatever was queued to it since
+		queue := conn.GetQueue()
+		if !isMember {
+			if limit := QueueLimit(); limit > 0 && len(queue) >= limit && !spooled(conn) {
+				atomic.AddUint64(&pressureDropped, 1)
+				continue
+			}
+			if enqueue(conn, queue, b) {
+				written[i] = len(b)
+				continue
+			}
+		}
+		select {
+		case queue <- b:
+			written[i] = len(b)
+		case <-ctx.Done():
+			return written, ctx.Err()
+		}
+	}
+	return written, nil
+}
+
+// RequiredCriteriaBits returns the union of the values the end points match
+// on, i.e. `criteria.BitDLType`, those that must be decoded from a packet in
+// for it to be matched, `criteria.BitEmpty` if they match every packet in. An
+// end point whose criteria aren't known requires every value.
+func (eps Endpoints) RequiredCriteriaBits() uint64 {
+	bits := uint64(criteria.BitEmpty)
+	for _, conn := range eps {
+		m, ok := unwrap(conn).(matcher)
+		if !ok {
+			return ^uint64(0)
+		}
+		bits |= m.CriteriaBits()
+	}
+	return bits
+}
+
+// States returns the state of the connection of each end point, by its
+// index, empty for those that don't report their state, see
+// `StateConnection`
+func (eps Endpoints) States() []string {
+	states := make([]string, len(eps))
+	for i, conn := range eps {
+		if s, ok := unwrap(conn).(StateConnection); ok {
+			states[i] = s.State()
+		}
+	}
+	return states
+}
+
+// Flush waits until the messages queued to the end points have been
+// delivered, or the context is done, in which case the context's error is
+// returned. Of an end point that doesn't report the messages it is delivering
+// only its queue is waited on. As a message is in flight between an end
+// point's queue and its delivery, the end points must be found without
+// messages to deliver twice in a row.
+func (eps Endpoints) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+	for settled := 1; ; settled++ {
+		for _, conn := range eps {
+			conn = unwrap(conn)
+			undelivered := len(conn.GetQueue())
+			if p, ok := conn.(pending); ok {
+				undelivered += p.Pending()
+			}
+			if undelivered > 0 {
+				settled = 0
+				break
+			}
+		}
+		if settled == 2 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close closes the end points that can be closed, see `TCPConnection.Close`,
+// returning the first error
+func (eps Endpoints) Close() error {
+	var first error
+	for _, conn := range eps {
+		if closer, ok := unwrap(conn).(io.Closer); ok {
+			if err := closer.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// enqueue queues the message to the connection, dropping the oldest message
+// queued while its queue is full. False is returned, and nothing queued, if
+// the connection doesn't drop messages.
+func enqueue(conn Connection, queue chan<- []byte, b []byte) bool {
+	d, ok := unwrap(conn).(dropper)
+	if !ok {
+		return false
+	}
+	for {
+		select {
+		case queue <- b:
+			return true
+		default:
+		}
+		if !d.dropOldest() {
+			return false
+		}
+	}
+}
+
+// spooled returns true if the connection spools the messages queued to it,
+// so never drops them
+func spooled(conn Connection) bool {
+	_, ok := unwrap(conn).(*DurableConnection)
+	return ok
+}
+
+// unwrap returns the connection of an end point that is a member of a
+// transaction group, or throttled
+func unwrap(conn Connection) Connection {
+	for {
+		switch wrapped := conn.(type) {
+		case *TxnMember:
+			conn = wrapped.Connection
+		case *Throttled:
+			conn = wrapped.Connection
+		default:
+			return conn
 		}
 	}
-	return n, nil
 }
@@ -0,0 +1,78 @@
+package connections
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ciena/oftee/datapath"
+	"github.com/ciena/oftee/packetin"
+)
+
+// Envelope is the JSON object in which each message is wrapped when tee-ed to
+// an HTTP, Kafka, or TCP, end point with `encode=json`, so that consumers
+// need not parse the context oftee prefixes to each message. The fields that
+// are not known are omitted, i.e. the DPID before the device handshake has
+// completed, and the port of a message other than a packet in. The payload is
+// the full OpenFlow message, or the packet of a raw end point, encoded as
+// base64. The enrichment of the port on which a packet in was received, if
+// any, is carried as an object of strings. The hop count is that of a message
+// received from a chained instance, omitted for one received from a device.
+type Envelope struct {
+	DPID       string            `json:"dpid,omitempty"`
+	InPort     *uint32           `json:"in_port,omitempty"`
+	Timestamp  string            `json:"timestamp"`
+	OFVersion  uint8             `json:"of_version,omitempty"`
+	Reason     string            `json:"reason,omitempty"`
+	Enrichment map[string]string `json:"enrichment,omitempty"`
+	Hops       uint32            `json:"hops,omitempty"`
+	Payload    []byte            `json:"payload"`
+}
+
+// envelope wraps a message, described by its metadata, in an `Envelope`
+// stamped with the time at which it is delivered
+func envelope(message []byte, metadata *Metadata, now time.Time) []byte {
+	wrapped := Envelope{
+		Timestamp:  now.UTC().Format(time.RFC3339Nano),
+		OFVersion:  metadata.OFVersion,
+		Enrichment: metadata.Enrichment,
+		Hops:       metadata.Hops,
+		Payload:    message,
+	}
+	if metadata.HasDPID {
+		wrapped.Payload = message[12:]
+		if metadata.DPID != 0 {
+			wrapped.DPID = datapath.Format(metadata.DPID)
+		}
+		wrapped.Reason = packetInReason(wrapped.Payload)
+	}
+	if metadata.HasInPort {
+		port := metadata.InPort
+		wrapped.InPort = &port
+	}
+
+	// Marshalling the envelope can't fail, its fields are all strings,
+	// numbers or bytes
+	encoded, _ := json.Marshal(&wrapped)
+	return encoded
+}
+
+// Wrap wraps a message, as it is tee-ed to the end points, in an `Envelope`
+// stamped with the current time, i.e. for the packet ins streamed by the API.
+// When `raw` is set the message is a raw packet, without a context.
+func Wrap(message []byte, raw bool) []byte {
+	return envelope(message, metadataOf(message, raw), time.Now())
+}
+
+// packetInReason returns the name, or number, of the reason for which an
+// OpenFlow 1.0, or 1.3 and later, packet in was sent, empty for other
+// messages
+func packetInReason(message []byte) string {
+	if len(message) < 8 {
+		return ""
+	}
+	packetIn, err := packetin.Decode(message[0], message)
+	if err != nil {
+		return ""
+	}
+	return packetIn.ReasonName()
+}
@@ -0,0 +1,108 @@
+package connections
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// packetIn returns an OpenFlow 1.3 packet in, for the given reason, of an
+// EAPOL frame, prefixed by the context of the device and port
+func packetIn(dpid uint64, port uint32, reason byte) []byte {
+	frame := make([]byte, 14)
+	binary.BigEndian.PutUint16(frame[12:], 0x888e)
+	message := make([]byte, 12+24+8+2+len(frame))
+	binary.BigEndian.PutUint64(message, dpid)
+	binary.BigEndian.PutUint32(message[8:], port)
+	of := message[12:]
+	of[0], of[1] = 0x04, 10
+	binary.BigEndian.PutUint16(of[2:], uint16(len(of)))
+	of[14] = reason
+	binary.BigEndian.PutUint16(of[24:], 1)
+	binary.BigEndian.PutUint16(of[26:], 4)
+	copy(of[24+8+2:], frame)
+	return message
+}
+
+func decodeEnvelope(t *testing.T, encoded []byte) map[string]interface{} {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		t.Fatalf("Expected a JSON envelope, got '%s' (%v)", encoded, err)
+	}
+	return fields
+}
+
+func TestEnvelopePacketIn(t *testing.T) {
+	message := packetIn(1, 3, 1)
+	now := time.Date(2018, 3, 1, 12, 0, 0, 123456789, time.UTC)
+	encoded := envelope(message, metadataOf(message, false), now)
+
+	var wrapped Envelope
+	if err := json.Unmarshal(encoded, &wrapped); err != nil {
+		t.Fatalf("Expected a JSON envelope, got '%s' (%v)", encoded, err)
+	}
+	if wrapped.DPID != "of:0x0000000000000001" || wrapped.InPort == nil || *wrapped.InPort != 3 ||
+		wrapped.OFVersion != 4 || wrapped.Reason != "action" ||
+		wrapped.Timestamp != "2018-03-01T12:00:00.123456789Z" {
+		t.Errorf("Incorrect envelope, got '%s'", encoded)
+	}
+	if !bytes.Equal(wrapped.Payload, message[12:]) {
+		t.Errorf("Expected the full OpenFlow message as payload, got %x", wrapped.Payload)
+	}
+}
+
+func TestEnvelopeOmitsUnknown(t *testing.T) {
+	// The DPID isn't known until the handshake completes
+	message := packetIn(0, 3, 7)
+	fields := decodeEnvelope(t, envelope(message, metadataOf(message, false), time.Now()))
+	if _, ok := fields["dpid"]; ok || fields["reason"] != "7" || fields["in_port"] != 3.0 {
+		t.Errorf("Expected no DPID, and reason 7, got %v", fields)
+	}
+
+	// Only a packet in has a port, and a reason
+	echo := make([]byte, 12+8)
+	binary.BigEndian.PutUint64(echo, 1)
+	echo[12], echo[13] = 0x04, 2
+	fields = decodeEnvelope(t, envelope(echo, metadataOf(echo, false), time.Now()))
+	if _, ok := fields["in_port"]; ok || fields["reason"] != nil || fields["dpid"] != "of:0x0000000000000001" {
+		t.Errorf("Expected no port or reason, got %v", fields)
+	}
+
+	// A raw packet carries no context
+	frame := packetIn(1, 3, 0)[12+24+8+2:]
+	fields = decodeEnvelope(t, envelope(frame, metadataOf(frame, true), time.Now()))
+	if len(fields) != 2 || fields["timestamp"] == nil || fields["payload"] == nil {
+		t.Errorf("Expected only a timestamp and payload, got %v", fields)
+	}
+}
+
+func TestHTTPEnvelope(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	types := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		types <- req.Header.Get("Content-Type")
+		bodies <- body
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	c := (&HTTPConnection{Connection: *u, Envelope: true}).Initialize()
+	message := packetIn(1, 3, 0)
+	if err := c.Deliver(message); err != nil {
+		t.Fatalf("Expected the message delivered, got %v", err)
+	}
+	if contentType := <-types; contentType != "application/json" {
+		t.Errorf("Expected a JSON content type, got '%s'", contentType)
+	}
+	fields := decodeEnvelope(t, <-bodies)
+	if fields["dpid"] != "of:0x0000000000000001" || fields["reason"] != "no_match" {
+		t.Errorf("Incorrect envelope, got %v", fields)
+	}
+}
@@ -0,0 +1,379 @@
+package connections
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciena/oftee/api/pb"
+	"github.com/ciena/oftee/criteria"
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// SchemeGRPC URL scheme of a gRPC end point
+	SchemeGRPC = "grpc"
+
+	// SchemeGRPCS URL scheme of a gRPC end point over TLS
+	SchemeGRPCS = "grpcs"
+)
+
+const (
+	// GRPCDialTimeout maximum time to establish the connection to a gRPC
+	// end point that is not connected lazily
+	GRPCDialTimeout = 5 * time.Second
+
+	// GRPCReconnectBackoff delay before the second attempt to re-open the
+	// stream to a gRPC end point, doubled for each attempt that follows
+	GRPCReconnectBackoff = 250 * time.Millisecond
+
+	// GRPCReconnectMaxBackoff maximum delay between attempts to re-open the
+	// stream to a gRPC end point
+	GRPCReconnectMaxBackoff = 30 * time.Second
+)
+
+func init() {
+	RegisterScheme(SchemeGRPC, newGRPCScheme, "queue")
+	RegisterScheme(SchemeGRPCS, newGRPCScheme, "queue")
+}
+
+// GRPCConnection is a gRPC end point, of the form `grpc://host:port`, or
+// `grpcs://host:port` over TLS. Each matched message is sent on a client
+// streaming RPC, `oftee.Tee/Stream`, as a `PacketIn` carrying the DPID and
+// port from the message's context, the time it was sent and the OpenFlow
+// message, or the raw packet if `Raw` is set.
+//
+// The stream is opened when the first message is sent. When it breaks the
+// message being sent is dropped and the stream is re-opened, with an
+// exponential backoff, when a message is next sent. Messages sent before the
+// stream can be re-opened are dropped and counted. As gRPC flow control
+// blocks the stream while the consumer is slow, the oldest messages queued
+// are dropped once the queue is full.
+type GRPCConnection struct {
+	Address   string
+	Criteria  criteria.Criteria
+	TLSConfig *tls.Config
+	Raw       bool
+	QueueSize int
+	Budget    *Budget
+	secure    bool
+	queue     chan []byte
+	input     chan<- []byte
+	conn      *grpc.ClientConn
+	stream    pb.Tee_StreamClient
+	cancel    context.CancelFunc
+	retryAt   time.Time
+	backoff   time.Duration
+	opened    bool
+	matches   uint64
+	bytes     uint64
+	dropped   uint64
+	errors    uint64
+	reconnect uint64
+	sending   int32
+	stop      chan struct{}
+	closing   sync.Once
+
+	handshakes *handshakeMetrics
+}
+
+// newGRPCScheme creates the connection to a gRPC end point
+func newGRPCScheme(u *url.URL, match criteria.Criteria, options *EndpointOptions) (Connection, error) {
+	if _, port, err := net.SplitHostPort(u.Host); err != nil || port == "" {
+		return nil, fmt.Errorf("invalid address '%s', expected %s://host:port", u, u.Scheme)
+	}
+	if options == nil {
+		return nil, nil
+	}
+	c := (&GRPCConnection{
+		Address:   u.Host,
+		Criteria:  match,
+		TLSConfig: options.TLSConfig,
+		Raw:       options.Raw,
+		QueueSize: options.QueueSize,
+		Budget:    options.Budget,
+		secure:    u.Scheme == SchemeGRPCS,
+	}).Initialize()
+	if options.Durable {
+		// Not a `Deliverer`, so can't be durable
+		return c, nil
+	}
+	return c, c.Dial(!options.Lazy && !options.Background)
+}
+
+// Initialize makes sure private members, that can't function from zero
+// state, are set correctly
+func (c *GRPCConnection) Initialize() *GRPCConnection {
+	c.queue = queueOf(c.QueueSize)
+	c.input = c.queue
+	c.stop = make(chan struct{})
+	if c.Budget != nil {
+		c.input = c.Budget.Track(c.queue, 1)
+	}
+	c.backoff = GRPCReconnectBackoff
+	return c
+}
+
+// Dial creates the client connection to the end point, over TLS, verified
+// by `TLSConfig` if set, if the end point is `grpcs://`. As for an `https` end
+// point, up to `TLSSessionCacheSize` TLS sessions are cached, so that a
+// re-established connection resumes a session, and the handshakes are counted
+// by `Stats`. If `block` is set the connection must be established within
+// `GRPCDialTimeout`, otherwise it is established in the background.
+func (c *GRPCConnection) Dial(block bool) error {
+	options := []grpc.DialOption{grpc.WithBackoffMaxDelay(GRPCReconnectMaxBackoff), grpc.WithInsecure()}
+	if c.secure {
+		config := &tls.Config{}
+		if c.TLSConfig != nil {
+			config = c.TLSConfig.Clone()
+		}
+		if config.ClientSessionCache == nil {
+			config.ClientSessionCache = tls.NewLRUClientSessionCache(TLSSessionCacheSize)
+		}
+		c.handshakes = newHandshakeMetrics()
+		options[1] = grpc.WithTransportCredentials(&observedCredentials{credentials.NewTLS(config), c.handshakes})
+	}
+	ctx := context.Background()
+	if block {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, GRPCDialTimeout)
+		defer cancel()
+		options = append(options, grpc.WithBlock())
+	}
+	conn, err := grpc.DialContext(ctx, c.Address, options...)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	return nil
+}
+
+// GetQueue returns the channel used to queue messages up for delivery
+func (c *GRPCConnection) GetQueue() chan<- []byte {
+	return c.input
+}
+
+// ListenAndSend listens for and sends messages to the end point over the
+// stream, until the connection is closed
+func (c *GRPCConnection) ListenAndSend() error {
+	// If queue not created, error out
+	if c.queue == nil || c.conn == nil {
+		log.
+			WithError(ErrUninitialized).
+			Error("MUST initialize connection before use")
+		return ErrUninitialized
+	}
+
+	for {
+		select {
+		case <-c.stop:
+			c.closeStream()
+			c.conn.Close()
+			return nil
+		case message := <-c.queue:
+			atomic.StoreInt32(&c.sending, 1)
+			atomic.AddUint64(&c.matches, 1)
+			atomic.AddUint64(&c.bytes, uint64(len(message)))
+			if c.stream == nil && !c.open() {
+				atomic.AddUint64(&c.dropped, 1)
+			} else if err := c.stream.Send(c.packetIn(message)); err != nil {
+				atomic.AddUint64(&c.errors, 1)
+				log.
+					WithError(err).
+					WithFields(log.Fields{
+						"target": c.Address,
+					}).
+					Warn("failed sending queued message, re-opening stream")
+				c.broken()
+			}
+			atomic.StoreInt32(&c.sending, 0)
+			c.Budget.Done()
+		}
+	}
+}
+
+// open opens the stream to the end point, unless the last attempt failed
+// less than the backoff ago. Returns false if the stream is not open.
+func (c *GRPCConnection) open() bool {
+	now := time.Now()
+	if now.Before(c.retryAt) {
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := pb.NewTeeClient(c.conn).Stream(ctx)
+	if err != nil {
+		cancel()
+		c.retryAt = now.Add(c.backoff)
+		log.
+			WithError(err).
+			WithFields(log.Fields{
+				"target":   c.Address,
+				"retry-in": c.backoff,
+			}).
+			Warn("Unable to open stream to gRPC end point")
+		if c.backoff *= 2; c.backoff > GRPCReconnectMaxBackoff {
+			c.backoff = GRPCReconnectMaxBackoff
+		}
+		return false
+	}
+	if c.opened {
+		atomic.AddUint64(&c.reconnect, 1)
+	}
+	c.stream, c.cancel, c.opened = stream, cancel, true
+	c.backoff = GRPCReconnectBackoff
+	return true
+}
+
+// broken abandons a stream that failed, so that it is re-opened
+func (c *GRPCConnection) broken() {
+	c.cancel()
+	c.stream = nil
+}
+
+// closeStream closes the stream, once the end point has received what was
+// sent on it or after `CloseTimeout`
+func (c *GRPCConnection) closeStream() {
+	if c.stream == nil {
+		return
+	}
+	closed := make(chan struct{})
+	go func(stream pb.Tee_StreamClient) {
+		defer close(closed)
+		if _, err := stream.CloseAndRecv(); err != nil {
+			log.
+				WithError(err).
+				WithFields(log.Fields{
+					"target": c.Address,
+				}).
+				Debug("Error while closing stream to gRPC end point")
+		}
+	}(c.stream)
+	select {
+	case <-closed:
+	case <-time.After(CloseTimeout):
+	}
+	c.broken()
+}
+
+// packetIn describes a message to be sent on the stream
+func (c *GRPCConnection) packetIn(message []byte) *pb.PacketIn {
+	metadata := metadataOf(message, c.Raw)
+	packetIn := &pb.PacketIn{
+		Dpid:      metadata.DPID,
+		InPort:    metadata.InPort,
+		Timestamp: ptypes.TimestampNow(),
+		Payload:   message,
+	}
+	if !c.Raw && len(message) >= 12 {
+		packetIn.Payload = message[12:]
+	}
+	return packetIn
+}
+
+// dropOldest makes room in the full queue of the end point by dropping the
+// oldest message queued
+func (c *GRPCConnection) dropOldest() bool {
+	return dropOldest(c.queue, c.Budget, &c.dropped)
+}
+
+// Close stops the delivery of messages to the end point, once those queued
+// have been sent or after `CloseTimeout`, when `ErrUndelivered` is returned,
+// and closes its stream and connection. Nothing may be queued to the end
+// point once it is closed.
+func (c *GRPCConnection) Close() error {
+	var err error
+	c.closing.Do(func() {
+		err = drain(c, c.stop)
+	})
+	return err
+}
+
+// Pending returns the number of messages queued to the end point that are
+// yet to be sent, including the one being sent
+func (c *GRPCConnection) Pending() int {
+	return len(c.queue) + int(atomic.LoadInt32(&c.sending))
+}
+
+// State returns whether the client connection to the end point is
+// established, gRPC re-establishes it in the background when it breaks
+func (c *GRPCConnection) State() string {
+	if c.conn != nil && c.conn.GetState() == connectivity.Ready {
+		return StateConnected
+	}
+	return StateConnecting
+}
+
+// TLSStats returns the counts of the TLS handshakes with the end point, nil
+// unless it is a `grpcs` end point
+func (c *GRPCConnection) TLSStats() *TLSStats {
+	return c.handshakes.stats()
+}
+
+// Stats returns the number of messages, and bytes, queued for delivery to
+// the end point, those dropped while its stream couldn't be opened, the
+// failed sends, the times the stream was re-opened and, for a `grpcs` end
+// point, its TLS handshakes
+func (c *GRPCConnection) Stats() EndpointStats {
+	return EndpointStats{
+		Endpoint:   c.Address,
+		Matches:    atomic.LoadUint64(&c.matches),
+		Bytes:      atomic.LoadUint64(&c.bytes),
+		Dropped:    atomic.LoadUint64(&c.dropped),
+		Errors:     atomic.LoadUint64(&c.errors),
+		Reconnects: atomic.LoadUint64(&c.reconnect),
+		TLS:        c.TLSStats(),
+	}
+}
+
+// observedCredentials the TLS credentials of a `grpcs` end point, whose
+// handshakes are counted
+type observedCredentials struct {
+	credentials.TransportCredentials
+	handshakes *handshakeMetrics
+}
+
+// ClientHandshake completes the TLS handshake of a new connection to the end
+// point, and counts it
+func (c *observedCredentials) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	started := time.Now()
+	conn, info, err := c.TransportCredentials.ClientHandshake(ctx, authority, rawConn)
+	var state tls.ConnectionState
+	if tlsInfo, ok := info.(credentials.TLSInfo); ok {
+		state = tlsInfo.State
+	}
+	c.handshakes.observe(state, err, time.Since(started))
+	return conn, info, err
+}
+
+// Clone returns a copy of the credentials, whose handshakes are counted with
+// those of the original
+func (c *observedCredentials) Clone() credentials.TransportCredentials {
+	return &observedCredentials{c.TransportCredentials.Clone(), c.handshakes}
+}
+
+// Connection in string form
+func (c *GRPCConnection) String() string {
+	if c.queue == nil {
+		return fmt.Sprintf("(%s, %d)", c.Address, -1)
+	}
+	return fmt.Sprintf("(%s, %d)", c.Address, len(c.queue))
+}
+
+// Match returns true if the end point's criteria match the given state
+func (c *GRPCConnection) Match(state criteria.Criteria) bool {
+	return c.Criteria.Match(state)
+}
+
+// CriteriaBits returns the values the end point matches on
+func (c *GRPCConnection) CriteriaBits() uint64 {
+	return c.Criteria.Bits()
+}
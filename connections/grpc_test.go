@@ -0,0 +1,134 @@
+package connections
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/internal/harness"
+)
+
+// newGRPCConnection creates the connection to a gRPC end point, and starts
+// its delivery
+func newGRPCConnection(t *testing.T, address string, lazy bool) *GRPCConnection {
+	u, _ := url.Parse("grpc://" + address)
+	c, err := NewConnection(u, criteria.Criteria{}, &EndpointOptions{Lazy: lazy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.ListenAndSend()
+	return c.(*GRPCConnection)
+}
+
+func TestGRPCConnectionStreams(t *testing.T) {
+	endpoint := harness.NewGRPCEndpoint(t)
+	defer endpoint.Stop()
+	c := newGRPCConnection(t, endpoint.Addr(), false)
+	defer c.Close()
+
+	first, second := packetIn(0x1, 3, 0), packetIn(0x2, 7, 1)
+	c.GetQueue() <- first
+	c.GetQueue() <- second
+	endpoint.Frames.ExpectFrames(t,
+		harness.FrameOf(0x1, 3, harness.Message{Raw: first[12:]}),
+		harness.FrameOf(0x2, 7, harness.Message{Raw: second[12:]}))
+	if stats := c.Stats(); stats.Matches != 2 || stats.Dropped != 0 || c.State() != StateConnected || endpoint.Streams() != 1 {
+		t.Errorf("Expected 2 messages streamed on one stream, got %+v (%s, %d streams)", stats, c.State(), endpoint.Streams())
+	}
+}
+
+func TestGRPCConnectionDropsUntilConnected(t *testing.T) {
+	// Grab a free port and release it, so nothing is listening
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	c := newGRPCConnection(t, address, true)
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		c.GetQueue() <- packetIn(0x1, 3, 0)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Stats().Dropped != 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := c.Stats(); stats.Dropped != 3 || c.State() != StateConnecting {
+		t.Errorf("Expected 3 dropped messages while connecting, got %+v (%s)", stats, c.State())
+	}
+}
+
+func TestGRPCConnectionReopensStream(t *testing.T) {
+	endpoint := harness.NewGRPCEndpoint(t)
+	defer endpoint.Stop()
+	c := newGRPCConnection(t, endpoint.Addr(), false)
+	defer c.Close()
+	c.GetQueue() <- packetIn(0x1, 1, 0)
+	endpoint.Frames.WaitFrames(t, 1)
+
+	// Messages are dropped while the stream is broken, until it is
+	// re-opened once the end point is back
+	endpoint.Stop()
+	endpoint.Start()
+	deadline := time.Now().Add(harness.Timeout)
+	for port := uint32(2); len(endpoint.Frames.Frames()) < 2; port++ {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the stream re-opened, got %+v", c.Stats())
+		}
+		c.GetQueue() <- packetIn(0x1, port, 0)
+		time.Sleep(20 * time.Millisecond)
+	}
+	if stats := c.Stats(); stats.Reconnects != 1 || stats.Dropped+stats.Errors == 0 || endpoint.Streams() != 2 {
+		t.Errorf("Expected the stream re-opened once, after dropping messages, got %+v (%d streams)", stats, endpoint.Streams())
+	}
+}
+
+func TestGRPCSConnectionResumesSession(t *testing.T) {
+	// The server, with the certificate of a test server, completes TLS
+	// handshakes, but isn't a gRPC server, so the connection is
+	// re-established, with a backoff, after each
+	server := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: server.TLS.Certificates, NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	config := &tls.Config{RootCAs: roots, ServerName: "example.com"}
+
+	c := (&GRPCConnection{Address: listener.Addr().String(), TLSConfig: config, secure: true}).Initialize()
+	if err := c.Dial(false); err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.TLSStats().Resumed == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := c.Stats().TLS; stats == nil || stats.Full != 1 || stats.Resumed == 0 || stats.Failed != 0 {
+		t.Errorf("Expected a full handshake followed by resumed ones, got %+v", stats)
+	}
+	if config.ClientSessionCache != nil {
+		t.Error("Expected the TLS configuration of the end point left unchanged")
+	}
+}
@@ -2,32 +2,298 @@ package connections
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/journal"
 	log "github.com/sirupsen/logrus"
 )
 
+// DefaultHTTPTimeout the time within which a request to an HTTP end point
+// must complete, unless its `Timeout` is set
+const DefaultHTTPTimeout = 10 * time.Second
+
+// DefaultRetryBackoff the time an HTTP end point waits before retrying a
+// message, unless its `Backoff` is set, the time doubles with each retry
+const DefaultRetryBackoff = 100 * time.Millisecond
+
+// StatusError the response of an end point that didn't acknowledge a message
+// with a 2xx status
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("end point responded '%s'", e.Status)
+}
+
+// retryable returns true if a message whose delivery failed with the given
+// error may be delivered by retrying, i.e. unless the end point rejected it
+func retryable(err error) bool {
+	status, ok := err.(*StatusError)
+	return !ok || status.StatusCode >= 500 || status.StatusCode == http.StatusTooManyRequests
+}
+
 // HTTPConnection is the HTTP based connection implementation. The connection
 // is represented as a net.URL
+//
+// Unless a `Proxy` is set, requests are made via the proxy specified by the
+// standard `HTTP_PROXY`, `HTTPS_PROXY` and `NO_PROXY` environment variables,
+// as per `http.ProxyFromEnvironment`.
+//
+// Messages are delivered by `Workers` concurrent workers, each with at most
+// one request in flight. With more than one worker messages are NOT
+// guaranteed to be delivered in the order in which they were queued, a
+// single worker, the default, preserves the order. Each message is the body
+// of its own request, so messages posted concurrently, by the workers or via
+// `Write`, are never interleaved.
+//
+// If a `Budget` is set the latency budget is enforced on the messages queued
+// for delivery.
+//
+// Each end point has its own client, which keeps an idle connection per
+// worker so that connections are reused rather than established per
+// message. A request that doesn't complete within `Timeout` fails. A message
+// whose post fails, or is answered with a 5xx or 429 status, is retried up to
+// `Retries` times, waiting `Backoff`, doubling with each retry, in
+// between, after which it is dropped or, if `DeadLetters` is set, written to
+// its directory. `Headers`, if set, are sent with each request, i.e.
+// `Authorization`.
+//
+// An `https` end point caches TLS sessions, so that a connection that is
+// re-established, i.e. after the end point restarts, resumes a session rather
+// than completing a full handshake. `TLSConfig`, if set, is the base TLS
+// configuration, i.e. the trusted CAs and the client certificate. The
+// handshakes are counted by `Stats`.
+//
+// If a `Journal` is set each message posted to the end point is recorded to
+// it, as it is to the compare group of the end point if `Compare` is set.
+//
+// If `Envelope` is set each message is posted wrapped in a JSON envelope, see
+// `Envelope`, rather than as is. If `Protobuf` is set each message, a packet
+// in, is posted encoded as a `proto.PacketIn`. `Raw` is set if the messages
+// are raw packets, without a context. If an `Annotator` is set it adds to
+// the metadata of each message enveloped, or encoded.
 type HTTPConnection struct {
-	Connection url.URL
-	Criteria   criteria.Criteria
-	queue      chan []byte
+	Connection  url.URL
+	Criteria    criteria.Criteria
+	Proxy       *url.URL
+	Workers     int
+	QueueSize   int
+	Budget      *Budget
+	TLSConfig   *tls.Config
+	Headers     http.Header
+	Timeout     time.Duration
+	Retries     int
+	Backoff     time.Duration
+	DeadLetters *DeadLetters
+	Raw         bool
+	Envelope    bool
+	Protobuf    bool
+	Journal     *journal.Journal
+	Compare     *CompareMember
+	Annotator   *Annotator
+	queue       chan []byte
+	input       chan<- []byte
+	client      *http.Client
+	handshakes  *handshakeMetrics
+	matches     uint64
+	bytes       uint64
+	errors      uint64
+	dropped     uint64
+	retries     uint64
+	delivering  int32
+	stop        chan struct{}
+	closing     sync.Once
+}
+
+func init() {
+	RegisterScheme(SchemeHTTP, newHTTPScheme, "workers", "ordered", "queue", "header", "encode", "retries", "backoff", "deadletter")
+	RegisterScheme(SchemeHTTPS, newHTTPScheme, "workers", "ordered", "queue", "header", "encode", "retries", "backoff", "deadletter")
+}
+
+// httpTerms the options of an HTTP, or HTTPS, end point given by the terms
+// registered by its scheme
+type httpTerms struct {
+	workers     int
+	headers     http.Header
+	retries     int
+	backoff     time.Duration
+	deadLetters *DeadLetters
+}
+
+// parseHTTPTerms parses the terms of an HTTP, or HTTPS, end point, which only
+// has those its scheme registered. A `TermError` is returned for a term that
+// is invalid, or conflicts with the options of the end point.
+func parseHTTPTerms(options *EndpointOptions) (httpTerms, error) {
+	parsed := httpTerms{
+		workers: 1,
+		retries: options.Retries,
+		backoff: options.Backoff,
+	}
+	var err error
+	if value := options.Terms.Get("workers"); value != "" {
+		if parsed.workers, err = strconv.Atoi(value); err != nil || parsed.workers < 1 {
+			return parsed, &TermError{"workers", fmt.Errorf("Invalid number of workers '%s'", value)}
+		}
+	}
+	if value := options.Terms.Get("ordered"); value != "" {
+		ordered, err := strconv.ParseBool(value)
+		if err != nil {
+			return parsed, &TermError{"ordered", err}
+		}
+		if ordered && parsed.workers > 1 {
+			return parsed, &TermError{"ordered", errors.New("ordered delivery can't be used with multiple workers")}
+		}
+	}
+	for _, value := range options.Terms["header"] {
+		name, header, err := parseHeader(value)
+		if err != nil {
+			return parsed, &TermError{"header", err}
+		}
+		if parsed.headers == nil {
+			parsed.headers = make(http.Header)
+		}
+		parsed.headers.Add(name, header)
+	}
+	if value := options.Terms.Get("retries"); value != "" {
+		if parsed.retries, err = strconv.Atoi(value); err != nil || parsed.retries < 0 {
+			return parsed, &TermError{"retries", fmt.Errorf("Invalid number of retries '%s'", value)}
+		}
+	}
+	if value := options.Terms.Get("backoff"); value != "" {
+		if parsed.backoff, err = time.ParseDuration(value); err != nil || parsed.backoff <= 0 {
+			return parsed, &TermError{"backoff", fmt.Errorf("Invalid retry backoff '%s'", value)}
+		}
+	}
+
+	// A durable end point delivers messages in order, and never gives up
+	// delivering them, so has no dead letters
+	if options.Durable && parsed.workers > 1 {
+		log.Warn("Durable end points deliver messages in order with a single worker, ignoring workers")
+		parsed.workers = 1
+	}
+	if dir := options.Terms.Get("deadletter"); dir != "" && !options.Durable {
+		if parsed.deadLetters, err = NewDeadLetters(dir); err != nil {
+			return parsed, &TermError{"deadletter", err}
+		}
+	}
+	return parsed, nil
+}
+
+// parseHeader parses the value of a header term, `Name:Value`, whose value is
+// URL encoded, i.e. `Authorization:Bearer%20abc`
+func parseHeader(header string) (name string, value string, err error) {
+	colon := strings.Index(header, ":")
+	if colon < 1 || strings.ContainsAny(header[:colon], " \t") {
+		return "", "", errors.New("invalid header, expected Name:Value")
+	}
+	name = header[:colon]
+	if value, err = url.PathUnescape(header[colon+1:]); err != nil {
+		return "", "", fmt.Errorf("invalid value of header '%s': %s", name, err)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return "", "", fmt.Errorf("invalid value of header '%s', contains a line break", name)
+	}
+	return name, value, nil
+}
+
+// newHTTPScheme creates the connection to an HTTP, or HTTPS, end point
+func newHTTPScheme(u *url.URL, match criteria.Criteria, options *EndpointOptions) (Connection, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in URL '%s'", u)
+	}
+	if options == nil {
+		return nil, nil
+	}
+	terms, err := parseHTTPTerms(options)
+	if err != nil {
+		return nil, err
+	}
+	return (&HTTPConnection{
+		Connection:  *u,
+		Criteria:    match,
+		Proxy:       options.Proxy,
+		Workers:     terms.workers,
+		QueueSize:   options.QueueSize,
+		Budget:      options.Budget,
+		TLSConfig:   options.TLSConfig,
+		Headers:     terms.headers,
+		Timeout:     options.Timeout,
+		Retries:     terms.retries,
+		Backoff:     terms.backoff,
+		DeadLetters: terms.deadLetters,
+		Raw:         options.Raw,
+		Envelope:    options.Envelope,
+		Protobuf:    options.Protobuf,
+		Journal:     options.Journal,
+		Compare:     options.Compare,
+		Annotator:   options.Annotator,
+	}).Initialize(), nil
 }
 
 // Initialize makes sure priviate members, that can't function from
 // zero state, are set correctly
 func (c *HTTPConnection) Initialize() *HTTPConnection {
-	c.queue = make(chan []byte, 100)
+	c.queue = queueOf(c.QueueSize)
+	c.stop = make(chan struct{})
+	if c.Workers < 1 {
+		c.Workers = 1
+	}
+	c.input = c.queue
+	if c.Budget != nil {
+		c.input = c.Budget.Track(c.queue, c.Workers)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultHTTPTimeout
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = DefaultRetryBackoff
+	}
+
+	// Keep an idle connection per worker, so that connections are reused
+	// rather than re-established per request
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: c.Workers,
+	}
+	if c.Proxy != nil {
+		transport.Proxy = http.ProxyURL(c.Proxy)
+	}
+	if c.Connection.Scheme == "https" {
+		config := &tls.Config{}
+		if c.TLSConfig != nil {
+			config = c.TLSConfig.Clone()
+		}
+		if config.ClientSessionCache == nil {
+			config.ClientSessionCache = tls.NewLRUClientSessionCache(TLSSessionCacheSize)
+		}
+		transport.TLSClientConfig = config
+		transport.TLSHandshakeTimeout = TLSHandshakeTimeout
+		c.handshakes = newHandshakeMetrics()
+	}
+	c.client = &http.Client{
+		Transport: transport,
+		Timeout:   c.Timeout,
+	}
 	return c
 }
 
 // GetQueue returns the channel used to queue messages up for delivery
 func (c *HTTPConnection) GetQueue() chan<- []byte {
-	return c.queue
+	return c.input
 }
 
 // ListenAndSend istens for and processes messages to the target end point
@@ -40,9 +306,25 @@ func (c *HTTPConnection) ListenAndSend() error {
 			Error("MUST initialize connection before use")
 		return ErrUninitialized
 	}
+
+	// Start the additional workers, the calling go routine is the first
+	for i := 1; i < c.Workers; i++ {
+		go c.send()
+	}
+	c.send()
+	return nil
+}
+
+// send is the worker loop that delivers messages from the queue
+func (c *HTTPConnection) send() {
 	for {
 		select {
+		case <-c.stop:
+			return
 		case message := <-c.queue:
+			atomic.AddInt32(&c.delivering, 1)
+			atomic.AddUint64(&c.matches, 1)
+			atomic.AddUint64(&c.bytes, uint64(len(message)))
 			if log.GetLevel() >= log.DebugLevel {
 				log.
 					WithFields(log.Fields{
@@ -50,19 +332,119 @@ func (c *HTTPConnection) ListenAndSend() error {
 					}).
 					Debug("sending queued message")
 			}
-			_, err := c.Write(message)
-			if err != nil {
-				log.
-					WithError(err).
-					WithFields(log.Fields{
-						"target": c.Connection.String(),
-					}).
-					Error("failed sending queued message")
+			if attempts, err := c.post(message); err != nil {
+				atomic.AddUint64(&c.errors, 1)
+				c.giveUp(message, attempts, err)
 			}
+			atomic.AddInt32(&c.delivering, -1)
+			c.Budget.Done()
 		}
 	}
 }
 
+// post delivers a message to the end point, retrying up to `Retries` times
+// while its delivery fails and can be retried. Retries are abandoned if the
+// connection is closed. Returns the number of attempts made.
+func (c *HTTPConnection) post(message []byte) (int, error) {
+	backoff := c.Backoff
+	for retry := 1; ; retry++ {
+		err := c.Deliver(message)
+		if err == nil || retry > c.Retries || !retryable(err) {
+			return retry, err
+		}
+		atomic.AddUint64(&c.retries, 1)
+		log.
+			WithError(err).
+			WithFields(log.Fields{
+				"target":  c.Connection.String(),
+				"status":  statusOf(err),
+				"retry":   retry,
+				"backoff": backoff,
+			}).
+			Warn("failed sending queued message, retrying")
+		select {
+		case <-time.After(backoff):
+		case <-c.stop:
+			return retry, err
+		}
+		backoff *= 2
+	}
+}
+
+// giveUp drops a message whose delivery failed, after the given number of
+// attempts, or writes it to the dead letters of the end point, if set
+func (c *HTTPConnection) giveUp(message []byte, attempts int, err error) {
+	target := c.Connection
+	target.User = nil
+	if c.DeadLetters == nil {
+		log.
+			WithError(err).
+			WithFields(log.Fields{
+				"target": target.String(),
+				"status": statusOf(err),
+			}).
+			Error("failed sending queued message, dropping it")
+		return
+	}
+	letter := DeadLetter{
+		Time:     time.Now(),
+		Endpoint: target.String(),
+		Attempts: attempts,
+		Status:   statusOf(err),
+		Error:    err.Error(),
+	}
+	if werr := c.DeadLetters.Write(message, letter); werr != nil {
+		log.
+			WithError(werr).
+			WithFields(log.Fields{
+				"target":     target.String(),
+				"deadletter": c.DeadLetters.Dir,
+			}).
+			Error("failed writing undelivered message to the dead letters, dropping it")
+		return
+	}
+	log.
+		WithError(err).
+		WithFields(log.Fields{
+			"target":     target.String(),
+			"status":     statusOf(err),
+			"deadletter": c.DeadLetters.Dir,
+		}).
+		Warn("failed sending queued message, written to the dead letters")
+}
+
+// statusOf returns the status code of the response to a failed delivery, or 0
+// if there was no response
+func statusOf(err error) int {
+	if status, ok := err.(*StatusError); ok {
+		return status.StatusCode
+	}
+	return 0
+}
+
+// dropOldest makes room in the full queue of the end point by dropping the
+// oldest message queued
+func (c *HTTPConnection) dropOldest() bool {
+	return dropOldest(c.queue, c.Budget, &c.dropped)
+}
+
+// Close stops the delivery of messages to the end point, once those queued
+// have been delivered or after `CloseTimeout`, when `ErrUndelivered` is
+// returned. Nothing may be queued to the end point once it is closed.
+func (c *HTTPConnection) Close() error {
+	var err error
+	c.closing.Do(func() {
+		err = drain(c, c.stop)
+	})
+	return err
+}
+
+// Pending returns the number of messages queued to the end point that are
+// yet to be delivered, including those being posted by the workers
+func (c *HTTPConnection) Pending() int {
+	return len(c.queue) + int(atomic.LoadInt32(&c.delivering))
+}
+
 // Connection in string form
 func (c *HTTPConnection) String() string {
 	if c.queue == nil {
@@ -76,8 +458,125 @@ func (c *HTTPConnection) String() string {
 // the context of the OFTee that the entire packet will be represented in a
 // single `Write`, although this is not strictly required.
 func (c *HTTPConnection) Write(b []byte) (n int, err error) {
-	_, err = http.Post(c.Connection.String(), "application/octet-stream", bytes.NewReader(b))
-	return len(b), err
+	return c.WriteContext(context.Background(), b)
+}
+
+// WriteContext writes the specified bytes to the connection, as `Write`,
+// abandoning the request once the context is done
+func (c *HTTPConnection) WriteContext(ctx context.Context, b []byte) (n int, err error) {
+	resp, err := c.do(ctx, "POST", c.body(b))
+	if err != nil {
+		return 0, err
+	}
+	if err = resp.Body.Close(); err != nil {
+		log.
+			WithError(err).
+			Debug("Error while closing HTTP response body")
+	}
+	return len(b), nil
+}
+
+// Deliver delivers a message to the end point by performing a `HTTP POST`
+// to the connection `URL`, returning an error unless the end point
+// acknowledged it with a 2xx response. If the end point is enveloped the
+// message is wrapped each time it is delivered, so a retried message is
+// stamped with the time of the attempt.
+func (c *HTTPConnection) Deliver(message []byte) error {
+	resp, err := c.do(context.Background(), "POST", c.body(message))
+	if err != nil {
+		return err
+	}
+	if err = resp.Body.Close(); err != nil {
+		log.
+			WithError(err).
+			Debug("Error while closing HTTP response body")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	c.Journal.Record(message)
+	c.Compare.Record(message)
+	return nil
+}
+
+// body returns the body of the request that posts a message, the message
+// wrapped in an envelope, or encoded as a protocol buffer, if the end point is
+func (c *HTTPConnection) body(message []byte) []byte {
+	switch {
+	case c.Protobuf:
+		return packetInProto(message, c.Annotator.metadataOf(message, false), time.Now())
+	case c.Envelope:
+		return envelope(message, c.Annotator.metadataOf(message, c.Raw), time.Now())
+	}
+	return message
+}
+
+// Warmer is implemented by connections that can be established before the
+// first message is delivered
+type Warmer interface {
+	Warm() error
+}
+
+// Warm establishes a connection to the end point, by performing a
+// `HTTP HEAD` to the connection `URL`, and keeps it idle so that the first
+// message doesn't wait for the connection, or TLS handshake, to complete.
+// Any response, whatever its status, leaves a warm connection.
+func (c *HTTPConnection) Warm() error {
+	resp, err := c.do(context.Background(), "HEAD", nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// do performs a request to the connection `URL`, within the given context,
+// observing the TLS handshake if a new connection to an `https` end point is
+// established
+func (c *HTTPConnection) do(ctx context.Context, method string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.Connection.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range c.Headers {
+		req.Header[name] = values
+	}
+	if body != nil && c.Protobuf {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+	} else if body != nil && c.Envelope {
+		req.Header.Set("Content-Type", "application/json")
+	} else if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if c.handshakes != nil {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), c.handshakes.trace()))
+	}
+	return c.client.Do(req)
+}
+
+// TLSStats returns the counts of the TLS handshakes with the end point, nil
+// unless it is an `https` end point
+func (c *HTTPConnection) TLSStats() *TLSStats {
+	return c.handshakes.stats()
+}
+
+// Stats returns the number of messages, and bytes, queued for delivery to
+// the end point, those dropped, the messages dropped, or written to the dead
+// letters, once their posts failed, the posts retried and, for an `https` end
+// point, its TLS handshakes
+func (c *HTTPConnection) Stats() EndpointStats {
+	return EndpointStats{
+		Endpoint:     c.Connection.String(),
+		Matches:      atomic.LoadUint64(&c.matches),
+		Bytes:        atomic.LoadUint64(&c.bytes),
+		Dropped:      atomic.LoadUint64(&c.dropped),
+		Errors:       atomic.LoadUint64(&c.errors),
+		Retries:      atomic.LoadUint64(&c.retries),
+		DeadLettered: c.DeadLetters.Written(),
+		TLS:          c.TLSStats(),
+		Journal:      c.Journal.Stats(),
+		Compare:      c.Compare.Stats(),
+	}
 }
 
 // Match is the HTTP connection implementation of the Match method. Simply
@@ -85,3 +584,8 @@ func (c *HTTPConnection) Write(b []byte) (n int, err error) {
 func (c *HTTPConnection) Match(state criteria.Criteria) bool {
 	return c.Criteria.Match(state)
 }
+
+// CriteriaBits returns the values the end point matches on
+func (c *HTTPConnection) CriteriaBits() uint64 {
+	return c.Criteria.Bits()
+}
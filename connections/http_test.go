@@ -0,0 +1,203 @@
+package connections
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// collector is an HTTP server that counts the messages posted to it, each
+// request taking at least the given latency to complete
+func collector(latency time.Duration) (*httptest.Server, *uint64, *int64) {
+	var received uint64
+	var inFlight, maxInFlight int64
+	var lock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		current := atomic.AddInt64(&inFlight, 1)
+		lock.Lock()
+		if current > maxInFlight {
+			maxInFlight = current
+		}
+		lock.Unlock()
+		time.Sleep(latency)
+		atomic.AddInt64(&inFlight, -1)
+		atomic.AddUint64(&received, 1)
+	}))
+	return server, &received, &maxInFlight
+}
+
+func waitReceived(received *uint64, count uint64, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadUint64(received) < count {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+func TestHTTPWorkersConcurrentRequests(t *testing.T) {
+	server, received, maxInFlight := collector(20 * time.Millisecond)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	c := (&HTTPConnection{Connection: *u, Workers: 4}).Initialize()
+	go c.ListenAndSend()
+	for i := 0; i < 20; i++ {
+		c.GetQueue() <- []byte{byte(i)}
+	}
+	if !waitReceived(received, 20, 5*time.Second) {
+		t.Fatalf("Expected 20 messages, received %d", atomic.LoadUint64(received))
+	}
+	if *maxInFlight < 2 || *maxInFlight > 4 {
+		t.Errorf("Expected between 2 and 4 concurrent requests, got %d", *maxInFlight)
+	}
+}
+
+func TestHTTPSingleWorkerIsSerial(t *testing.T) {
+	server, received, maxInFlight := collector(5 * time.Millisecond)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	c := (&HTTPConnection{Connection: *u}).Initialize()
+	go c.ListenAndSend()
+	for i := 0; i < 10; i++ {
+		c.GetQueue() <- []byte{byte(i)}
+	}
+	if !waitReceived(received, 10, 5*time.Second) {
+		t.Fatalf("Expected 10 messages, received %d", atomic.LoadUint64(received))
+	}
+	if *maxInFlight != 1 {
+		t.Errorf("Expected a single request in flight, got %d", *maxInFlight)
+	}
+}
+
+func TestHTTPRetries(t *testing.T) {
+	// The collector fails the first two posts of each message, then
+	// accepts it, and rejects those that are malformed outright
+	var posts uint64
+	var authorization string
+	var lock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		authorization = req.Header.Get("Authorization")
+		lock.Unlock()
+		switch n := atomic.AddUint64(&posts, 1); {
+		case req.ContentLength == 0:
+			resp.WriteHeader(http.StatusBadRequest)
+		case n%3 != 0:
+			resp.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	c := (&HTTPConnection{
+		Connection: *u,
+		Retries:    2,
+		Backoff:    time.Millisecond,
+		Headers:    http.Header{"Authorization": []string{"Bearer abc"}},
+	}).Initialize()
+	go c.ListenAndSend()
+	c.GetQueue() <- []byte("retried")
+	if !waitReceived(&posts, 3, 5*time.Second) || c.Pending() != 0 {
+		t.Fatalf("Expected the message delivered by its third post, got %d posts", atomic.LoadUint64(&posts))
+	}
+	c.GetQueue() <- []byte{}
+	if err := (Endpoints{c}).Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := c.Stats(); stats.Retries != 2 || stats.Errors != 1 || atomic.LoadUint64(&posts) != 4 {
+		t.Errorf("Expected 2 retries and the rejected message dropped, got %+v after %d posts", stats, atomic.LoadUint64(&posts))
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if authorization != "Bearer abc" {
+		t.Errorf("Expected the authorization header sent, got '%s'", authorization)
+	}
+}
+
+func TestHTTPDeadLetters(t *testing.T) {
+	var posts uint64
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddUint64(&posts, 1)
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	deadLetters, err := NewDeadLetters(filepath.Join(dir, "dlq"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The message that exhausts its retries is written, rather than
+	// dropped, with its sidecar
+	u, _ := url.Parse(server.URL)
+	u.User = url.UserPassword("user", "secret")
+	c := (&HTTPConnection{Connection: *u, Retries: 1, Backoff: time.Millisecond, DeadLetters: deadLetters}).Initialize()
+	go c.ListenAndSend()
+	c.GetQueue() <- []byte("undelivered")
+	if err = (Endpoints{c}).Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := c.Stats(); stats.Errors != 1 || stats.DeadLettered != 1 || atomic.LoadUint64(&posts) != 2 {
+		t.Errorf("Expected the message dead lettered after 2 posts, got %+v after %d posts", stats, atomic.LoadUint64(&posts))
+	}
+	sidecars, _ := filepath.Glob(filepath.Join(dir, "dlq", "*.json"))
+	if len(sidecars) != 1 {
+		t.Fatalf("Expected a sidecar, got %v", sidecars)
+	}
+	message, err := ioutil.ReadFile(strings.TrimSuffix(sidecars[0], ".json") + ".msg")
+	if err != nil || string(message) != "undelivered" {
+		t.Errorf("Expected the message written, got '%s' (%v)", message, err)
+	}
+	var letter DeadLetter
+	raw, _ := ioutil.ReadFile(sidecars[0])
+	if err = json.Unmarshal(raw, &letter); err != nil {
+		t.Fatal(err)
+	}
+	if letter.Endpoint != server.URL || letter.Attempts != 2 || letter.Status != http.StatusServiceUnavailable || letter.Time.IsZero() {
+		t.Errorf("Incorrect sidecar, got %+v", letter)
+	}
+}
+
+// BenchmarkHTTPWorkers measures the delivery throughput to a collector with
+// 2ms of latency per request for increasing numbers of workers. Throughput
+// should scale close to linearly with the number of workers.
+func BenchmarkHTTPWorkers(b *testing.B) {
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			server, received, _ := collector(2 * time.Millisecond)
+			defer server.Close()
+
+			u, _ := url.Parse(server.URL)
+			c := (&HTTPConnection{Connection: *u, Workers: workers}).Initialize()
+			go c.ListenAndSend()
+
+			message := make([]byte, 128)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.GetQueue() <- message
+			}
+			waitReceived(received, uint64(b.N), time.Minute)
+			b.StopTimer()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package connections
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/datapath"
+	"github.com/ciena/oftee/journal"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// KafkaMaxBatch maximum number of queued messages produced by a
+	// single request
+	KafkaMaxBatch = 100
+
+	// KafkaTimeout time within which a broker must connect, and answer a
+	// request
+	KafkaTimeout = 10 * time.Second
+
+	// KafkaClientID the client ID with which requests are made
+	KafkaClientID = "oftee"
+
+	// KafkaKeyDPID value of the `kafka_key` term that keys records by the
+	// DPID of the device
+	KafkaKeyDPID = "dpid"
+
+	// KafkaKeyNone value of the `kafka_key` term with which records are
+	// not keyed
+	KafkaKeyNone = "none"
+)
+
+// kafkaTopic the valid names of a Kafka topic
+var kafkaTopic = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+// KafkaConnection is the Kafka based connection implementation. Each message
+// is produced as a record to `Topic`, by the leader of its partition, which
+// is learned from the first of the `Brokers` that answers.
+//
+// The producer speaks the Kafka protocol itself and requires brokers of
+// version 0.11 or later. Records are acknowledged by the leader of their
+// partition. The messages queued while a request is in flight are produced
+// together by the next, at most `KafkaMaxBatch`.
+//
+// If `KeyByDPID` is set each record is keyed by the DPID of the device, from
+// the context that precedes the message, so that the records of a device are
+// produced to the same partition, chosen as by the Java client's default
+// partitioner. Otherwise records are not keyed and are produced to each
+// partition in turn. Each record carries the metadata of its message as
+// headers, see `Metadata`. When `Raw` is set the messages are raw packets,
+// without a context, so only their Ethernet type and VLAN are known. When
+// `Envelope` is set the value of each record is the message wrapped in a JSON
+// envelope, see `Envelope`, rather than the message itself, and when
+// `Protobuf` is set the message, a packet in, encoded as a `proto.PacketIn`.
+// If an `Annotator` is set it adds to the metadata of each message, i.e. the
+// enrichment of the port on which a packet in was received.
+//
+// If producing fails the records are dropped and counted, the connections to
+// the brokers are closed and the metadata of the topic is forgotten, so that
+// the producer reconnects, at most once per `OnDemandRetryInterval`. Messages
+// queued in between attempts are also dropped.
+//
+// If a `Budget` is set the latency budget is enforced on the messages queued
+// for delivery. If a `Journal` is set each message produced is recorded to
+// it, as it is to the compare group of the end point if `Compare` is set.
+type KafkaConnection struct {
+	Brokers   []string
+	Topic     string
+	Criteria  criteria.Criteria
+	KeyByDPID bool
+	Raw       bool
+	Envelope  bool
+	Protobuf  bool
+	QueueSize int
+	Budget    *Budget
+	Journal   *journal.Journal
+	Compare   *CompareMember
+	Annotator *Annotator
+	queue     chan []byte
+	input     chan<- []byte
+	lock      sync.Mutex
+	producer  kafkaProducer
+	next      int
+	lastDial  time.Time
+	matches   uint64
+	bytes     uint64
+	dropped   uint64
+	sequence  uint64
+	errors    uint64
+	connects  uint64
+	producing int32
+	stop      chan struct{}
+	closing   sync.Once
+}
+
+// ParseKafkaURL parses the address of a Kafka end point, of the form
+// `kafka://broker:port[,broker:port...]/topic`, into its brokers and topic
+func ParseKafkaURL(u *url.URL) ([]string, string, error) {
+	var brokers []string
+	for _, broker := range strings.Split(u.Host, ",") {
+		if broker == "" {
+			continue
+		}
+		if !strings.Contains(broker, ":") {
+			return nil, "", fmt.Errorf("invalid broker '%s', expected host:port", broker)
+		}
+		brokers = append(brokers, broker)
+	}
+	if len(brokers) == 0 {
+		return nil, "", errors.New("missing brokers")
+	}
+	topic := strings.TrimPrefix(u.Path, "/")
+	if !kafkaTopic.MatchString(topic) || topic == "." || topic == ".." {
+		return nil, "", fmt.Errorf("invalid topic '%s'", topic)
+	}
+	return brokers, topic, nil
+}
+
+func init() {
+	RegisterScheme(SchemeKafka, newKafkaScheme, "kafka_key", "queue", "encode")
+}
+
+// newKafkaScheme creates the connection to a Kafka end point, whose leaders
+// are connected to when the first message is produced
+func newKafkaScheme(u *url.URL, match criteria.Criteria, options *EndpointOptions) (Connection, error) {
+	brokers, topic, err := ParseKafkaURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Kafka end point '%s', expected kafka://broker:port[,broker:port...]/topic: %s", u, err)
+	}
+	if options == nil {
+		return nil, nil
+	}
+	var keyByDPID bool
+	switch value := options.Terms.Get("kafka_key"); strings.ToLower(value) {
+	case "", KafkaKeyNone:
+	case KafkaKeyDPID:
+		// Raw packets carry no context, so no DPID to key by
+		if options.Raw {
+			return nil, &TermError{"kafka_key", errors.New("records can't be keyed by DPID with raw packets, TEE_RAW")}
+		}
+		keyByDPID = true
+	default:
+		return nil, &TermError{"kafka_key", fmt.Errorf("Unknown Kafka key '%s'", value)}
+	}
+	return (&KafkaConnection{
+		Brokers:   brokers,
+		Topic:     topic,
+		Criteria:  match,
+		KeyByDPID: keyByDPID,
+		Raw:       options.Raw,
+		Envelope:  options.Envelope,
+		Protobuf:  options.Protobuf,
+		QueueSize: options.QueueSize,
+		Budget:    options.Budget,
+		Journal:   options.Journal,
+		Compare:   options.Compare,
+		Annotator: options.Annotator,
+	}).Initialize(), nil
+}
+
+// Initialize makes sure priviate members, that can't function from
+// zero state, are set correctly
+func (c *KafkaConnection) Initialize() *KafkaConnection {
+	c.queue = queueOf(c.QueueSize)
+	c.input = c.queue
+	c.stop = make(chan struct{})
+	if c.Budget != nil {
+		c.input = c.Budget.Track(c.queue, 1)
+	}
+	c.producer = kafkaProducer{
+		brokers:  c.Brokers,
+		clientID: KafkaClientID,
+		timeout:  KafkaTimeout,
+	}
+	return c
+}
+
+// GetQueue returns the channel used to queue messages up for delivery
+func (c *KafkaConnection) GetQueue() chan<- []byte {
+	return c.input
+}
+
+// ListenAndSend listens for and processes messages to the target end point
+// over the connection
+func (c *KafkaConnection) ListenAndSend() error {
+	// If queue not created, error out
+	if c.queue == nil {
+		log.
+			WithError(ErrUninitialized).
+			Error("MUST initialize connection before use")
+		return ErrUninitialized
+	}
+
+	batch := make([][]byte, 0, KafkaMaxBatch)
+	for {
+		select {
+		case <-c.stop:
+			c.lock.Lock()
+			c.producer.close()
+			c.lock.Unlock()
+			return nil
+		case message := <-c.queue:
+			batch = append(batch[:0], message)
+		}
+	drain:
+		for len(batch) < KafkaMaxBatch {
+			select {
+			case message := <-c.queue:
+				batch = append(batch, message)
+			default:
+				break drain
+			}
+		}
+		atomic.StoreInt32(&c.producing, int32(len(batch)))
+		for _, message := range batch {
+			atomic.AddUint64(&c.matches, 1)
+			atomic.AddUint64(&c.bytes, uint64(len(message)))
+		}
+		if log.GetLevel() >= log.DebugLevel {
+			log.
+				WithFields(log.Fields{
+					"messages": len(batch),
+					"topic":    c.Topic,
+				}).
+				Debug("producing queued messages")
+		}
+		if err := c.produce(batch, false); err != nil {
+			atomic.AddUint64(&c.errors, 1)
+			log.
+				WithError(err).
+				WithFields(log.Fields{
+					"target":   c.address(),
+					"messages": len(batch),
+				}).
+				Error("failed producing queued messages")
+		}
+		atomic.StoreInt32(&c.producing, 0)
+		for range batch {
+			c.Budget.Done()
+		}
+	}
+}
+
+// dropOldest makes room in the full queue of the end point by dropping the
+// oldest message queued
+func (c *KafkaConnection) dropOldest() bool {
+	return dropOldest(c.queue, c.Budget, &c.dropped)
+}
+
+// Close stops the production of messages to the end point, once those
+// queued have been produced or after `CloseTimeout`, when `ErrUndelivered`
+// is returned, and closes its connections to the brokers. Nothing may be
+// queued to the end point once it is closed.
+func (c *KafkaConnection) Close() error {
+	var err error
+	c.closing.Do(func() {
+		err = drain(c, c.stop)
+	})
+	return err
+}
+
+// Pending returns the number of messages queued to the end point that are
+// yet to be produced, including the batch being produced
+func (c *KafkaConnection) Pending() int {
+	return len(c.queue) + int(atomic.LoadInt32(&c.producing))
+}
+
+// Deliver produces a message to the end point and returns an error unless it
+// was acknowledged by the leader of its partition, so that the message stays
+// in the spool of a durable end point until it is
+func (c *KafkaConnection) Deliver(message []byte) error {
+	return c.produce([][]byte{message}, true)
+}
+
+// produce produces the messages, connecting to the brokers if needed. If
+// producing fails the messages are dropped, and counted unless `retried`, as
+// the caller retries them.
+func (c *KafkaConnection) produce(messages [][]byte, retried bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.producer.ready() {
+		if !retried && time.Since(c.lastDial) < OnDemandRetryInterval {
+			atomic.AddUint64(&c.dropped, uint64(len(messages)))
+			return nil
+		}
+		c.lastDial = time.Now()
+		atomic.AddUint64(&c.connects, 1)
+		if err := c.producer.refresh(c.Topic); err != nil {
+			if !retried {
+				atomic.AddUint64(&c.dropped, uint64(len(messages)))
+			}
+			return err
+		}
+		log.
+			WithFields(log.Fields{
+				"target":     c.address(),
+				"partitions": c.producer.partitions,
+				"dropped":    atomic.LoadUint64(&c.dropped),
+			}).
+			Info("Connected Kafka end point")
+	}
+
+	records := make(map[int32][]kafkaRecord)
+	for _, message := range messages {
+		record, partition := c.record(message)
+		records[partition] = append(records[partition], record)
+	}
+	if err := c.producer.produce(c.Topic, records, time.Now()); err != nil {
+		c.producer.close()
+		if !retried {
+			atomic.AddUint64(&c.dropped, uint64(len(messages)))
+		}
+		return err
+	}
+	for _, message := range messages {
+		c.Journal.Record(message)
+		c.Compare.Record(message)
+	}
+	return nil
+}
+
+// record builds the record of a message, and chooses its partition
+func (c *KafkaConnection) record(message []byte) (kafkaRecord, int32) {
+	metadata := c.metadata(message)
+	record := kafkaRecord{value: message, headers: metadata.Headers()}
+	if c.Protobuf {
+		record.value = packetInProto(message, metadata, time.Now())
+	} else if c.Envelope {
+		record.value = envelope(message, metadata, time.Now())
+	}
+	partitions := uint32(c.producer.partitions)
+	if c.KeyByDPID && metadata.HasDPID {
+		record.key = []byte(datapath.Format(metadata.DPID))
+		return record, int32((murmur2(record.key) & 0x7fffffff) % partitions)
+	}
+	c.next = (c.next + 1) % int(partitions)
+	return record, int32(c.next)
+}
+
+// metadata describes a message, see `metadataOf`, numbered in the order in
+// which it is produced
+func (c *KafkaConnection) metadata(message []byte) *Metadata {
+	metadata := c.Annotator.metadataOf(message, c.Raw)
+	metadata.Sequence = atomic.AddUint64(&c.sequence, 1)
+	return metadata
+}
+
+// address returns the address of the end point
+func (c *KafkaConnection) address() string {
+	return "kafka://" + strings.Join(c.Brokers, ",") + "/" + c.Topic
+}
+
+// Stats returns the number of messages, and bytes, queued for delivery to
+// the end point, those dropped, the batches that failed to be produced and
+// the attempts to connect to the brokers after the first
+func (c *KafkaConnection) Stats() EndpointStats {
+	reconnects := atomic.LoadUint64(&c.connects)
+	if reconnects > 0 {
+		reconnects--
+	}
+	return EndpointStats{
+		Endpoint:   c.address(),
+		Matches:    atomic.LoadUint64(&c.matches),
+		Bytes:      atomic.LoadUint64(&c.bytes),
+		Dropped:    atomic.LoadUint64(&c.dropped),
+		Errors:     atomic.LoadUint64(&c.errors),
+		Reconnects: reconnects,
+		Journal:    c.Journal.Stats(),
+		Compare:    c.Compare.Stats(),
+	}
+}
+
+// Connection in string form
+func (c *KafkaConnection) String() string {
+	if c.queue == nil {
+		return fmt.Sprintf("(%s, %d)", c.address(), -1)
+	}
+	return fmt.Sprintf("(%s, %d)", c.address(), len(c.queue))
+}
+
+// Match is the Kafka connection implementation of the Match method. Simply
+// calls the `Match` method on the imbeded `Criteria` data.
+func (c *KafkaConnection) Match(state criteria.Criteria) bool {
+	return c.Criteria.Match(state)
+}
+
+// CriteriaBits returns the values the end point matches on
+func (c *KafkaConnection) CriteriaBits() uint64 {
+	return c.Criteria.Bits()
+}
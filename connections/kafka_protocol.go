@@ -0,0 +1,466 @@
+package connections
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"time"
+)
+
+// The Kafka protocol, as far as it is needed to produce records to a topic,
+// and no further. No Kafka client is vendored, so this is deliberately the
+// minimal subset below, whose wire format is tested against broker responses
+// in kafka_protocol_test.go. Brokers of version 0.11 or later are required, as
+// versions are not negotiated (ApiVersions).
+//
+//   - Metadata v1, for the topic alone, learns its partitions and the broker
+//     that leads each of them. A partition without a leader is counted, so
+//     that keyed records keep their partition, but can't be produced to.
+//   - Produce v3, with `acks=1` and no transactional ID, is sent to the
+//     leader of each partition, with a single record batch for each of its
+//     partitions.
+//   - Record batches (magic 2) are uncompressed, have no producer ID, so are
+//     neither idempotent nor transactional, and are timestamped with the
+//     create time. Record headers are supported.
+//
+// Neither TLS nor SASL is supported. Requests are not pipelined, a request is
+// sent once the response to the previous one is read. Errors, from the
+// network or a broker, are not retried here, the caller closes the producer,
+// which refreshes the metadata before producing again.
+
+const (
+	kafkaAPIProduce  = 0
+	kafkaAPIMetadata = 3
+
+	kafkaProduceVersion  = 3
+	kafkaMetadataVersion = 1
+
+	// kafkaAcksLeader records are acknowledged once written by the leader
+	kafkaAcksLeader = 1
+
+	kafkaMaxResponse = 16 << 20
+)
+
+// Kafka error codes reported by the producer itself, when the topic has no
+// partitions or a partition has no leader
+const (
+	kafkaErrUnknownTopicOrPartition = 3
+	kafkaErrLeaderNotAvailable      = 5
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// KafkaError an error code returned by a broker
+type KafkaError struct {
+	Code      int16
+	Topic     string
+	Partition int32
+}
+
+func (e *KafkaError) Error() string {
+	return fmt.Sprintf("kafka: error code %d for topic '%s' partition %d", e.Code, e.Topic, e.Partition)
+}
+
+// kafkaRecord a record to be produced
+type kafkaRecord struct {
+	key     []byte
+	value   []byte
+	headers []Header
+}
+
+// kafkaEncoder encodes the primitive types of the Kafka protocol
+type kafkaEncoder struct {
+	bytes.Buffer
+}
+
+func (e *kafkaEncoder) int8(v int8) {
+	e.WriteByte(byte(v))
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) string(v string) {
+	e.int16(int16(len(v)))
+	e.WriteString(v)
+}
+
+func (e *kafkaEncoder) bytes(v []byte) {
+	e.int32(int32(len(v)))
+	e.Write(v)
+}
+
+// varint encodes a zig-zag variable length integer, as used by records
+func (e *kafkaEncoder) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+// varbytes encodes a variable length byte array, nil as null
+func (e *kafkaEncoder) varbytes(v []byte) {
+	if v == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(v)))
+	e.Write(v)
+}
+
+// kafkaDecoder decodes the primitive types of the Kafka protocol, recording
+// the first error so that it need only be checked once decoding completes
+type kafkaDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.data) < n {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string decodes a, possibly null, string
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+// array decodes the length of an array, a null array is empty
+func (d *kafkaDecoder) array() int {
+	n := d.int32()
+	if n < 0 {
+		return 0
+	}
+	if int(n) > len(d.data) {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	return int(n)
+}
+
+// encodeRecordBatch encodes records as a record batch, magic 2, timestamped
+// with the given time
+func encodeRecordBatch(records []kafkaRecord, now time.Time) []byte {
+	var body kafkaEncoder
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	body.int16(0)
+	body.int32(int32(len(records) - 1))
+	body.int64(timestamp)
+	body.int64(timestamp)
+	body.int64(-1)
+	body.int16(-1)
+	body.int32(-1)
+	body.int32(int32(len(records)))
+	var record kafkaEncoder
+	for i, r := range records {
+		record.Reset()
+		record.int8(0)
+		record.varint(0)
+		record.varint(int64(i))
+		record.varbytes(r.key)
+		record.varbytes(r.value)
+		record.varint(int64(len(r.headers)))
+		for _, header := range r.headers {
+			record.varbytes([]byte(header.Key))
+			record.varbytes(header.Value)
+		}
+		body.varint(int64(record.Len()))
+		body.Write(record.Bytes())
+	}
+
+	var batch kafkaEncoder
+	batch.int64(0)
+	batch.int32(int32(4 + 1 + 4 + body.Len()))
+	batch.int32(-1)
+	batch.int8(2)
+	batch.int32(int32(crc32.Checksum(body.Bytes(), castagnoli)))
+	batch.Write(body.Bytes())
+	return batch.Bytes()
+}
+
+// murmur2 the hash by which the Java client's default partitioner chooses
+// the partition of a keyed record
+func murmur2(data []byte) uint32 {
+	const m = 0x5bd1e995
+	h := uint32(0x9747b28c) ^ uint32(len(data))
+	n := len(data) / 4 * 4
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h *= m
+		h ^= k
+	}
+	switch len(data) % 4 {
+	case 3:
+		h ^= uint32(data[n+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[n+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[n])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+// kafkaProducer produces records to the leaders of the partitions of a
+// topic, over a connection to each leader. It is not safe for concurrent use.
+type kafkaProducer struct {
+	brokers     []string
+	clientID    string
+	timeout     time.Duration
+	correlation int32
+	partitions  int
+	leaders     map[int32]string
+	conns       map[string]net.Conn
+}
+
+// ready returns true once the metadata of the topic is known
+func (p *kafkaProducer) ready() bool {
+	return p.partitions > 0
+}
+
+// close closes the connections to the brokers and forgets the metadata, so
+// that it is refreshed before the next records are produced
+func (p *kafkaProducer) close() {
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns, p.leaders, p.partitions = nil, nil, 0
+}
+
+// roundTrip sends a request to a broker, connecting to it if needed, and
+// returns the body of its response
+func (p *kafkaProducer) roundTrip(address string, key, version int16, body []byte) ([]byte, error) {
+	conn, ok := p.conns[address]
+	if !ok {
+		var err error
+		if conn, err = net.DialTimeout("tcp", address, p.timeout); err != nil {
+			return nil, err
+		}
+		if p.conns == nil {
+			p.conns = make(map[string]net.Conn)
+		}
+		p.conns[address] = conn
+	}
+	p.correlation++
+	var request kafkaEncoder
+	request.int32(0)
+	request.int16(key)
+	request.int16(version)
+	request.int32(p.correlation)
+	request.string(p.clientID)
+	request.Write(body)
+	message := request.Bytes()
+	binary.BigEndian.PutUint32(message, uint32(len(message)-4))
+
+	conn.SetDeadline(time.Now().Add(p.timeout))
+	if _, err := WriteFull(conn, message); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(size[:])
+	if length < 4 || length > kafkaMaxResponse {
+		return nil, fmt.Errorf("kafka: invalid response length %d", length)
+	}
+	response := make([]byte, length)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	if correlation := int32(binary.BigEndian.Uint32(response)); correlation != p.correlation {
+		return nil, fmt.Errorf("kafka: response %d to request %d", correlation, p.correlation)
+	}
+	return response[4:], nil
+}
+
+// refresh learns the partitions of the topic, and their leaders, from the
+// first of the brokers that answers
+func (p *kafkaProducer) refresh(topic string) error {
+	var request kafkaEncoder
+	request.int32(1)
+	request.string(topic)
+	err := errors.New("kafka: no brokers")
+	for _, broker := range p.brokers {
+		var response []byte
+		if response, err = p.roundTrip(broker, kafkaAPIMetadata, kafkaMetadataVersion, request.Bytes()); err == nil {
+			err = p.metadata(topic, response)
+		}
+		if err == nil {
+			return nil
+		}
+		p.close()
+	}
+	return err
+}
+
+// metadata decodes a metadata response
+func (p *kafkaProducer) metadata(topic string, response []byte) error {
+	d := &kafkaDecoder{data: response}
+	brokers := make(map[int32]string)
+	for i := d.array(); i > 0; i-- {
+		node := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string()
+		brokers[node] = net.JoinHostPort(host, fmt.Sprint(port))
+	}
+	d.int32()
+	leaders := make(map[int32]string)
+	partitions := 0
+	for i := d.array(); i > 0; i-- {
+		code := d.int16()
+		name := d.string()
+		d.int8()
+		if name == topic && code != 0 {
+			return &KafkaError{Code: code, Topic: topic, Partition: -1}
+		}
+		for j := d.array(); j > 0; j-- {
+			d.int16()
+			partition := d.int32()
+			leader := d.int32()
+			for k := d.array(); k > 0; k-- {
+				d.int32()
+			}
+			for k := d.array(); k > 0; k-- {
+				d.int32()
+			}
+			if name != topic {
+				continue
+			}
+			partitions++
+			if address, ok := brokers[leader]; ok {
+				leaders[partition] = address
+			}
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if partitions == 0 {
+		return &KafkaError{Code: kafkaErrUnknownTopicOrPartition, Topic: topic, Partition: -1}
+	}
+	p.partitions, p.leaders = partitions, leaders
+	return nil
+}
+
+// produce produces the records, by partition, each to the leader of its
+// partition, and returns once all are acknowledged or one fails
+func (p *kafkaProducer) produce(topic string, records map[int32][]kafkaRecord, now time.Time) error {
+	// Each leader is sent a single request for all of its partitions
+	byLeader := make(map[string][]int32)
+	for partition := range records {
+		leader, ok := p.leaders[partition]
+		if !ok {
+			return &KafkaError{Code: kafkaErrLeaderNotAvailable, Topic: topic, Partition: partition}
+		}
+		byLeader[leader] = append(byLeader[leader], partition)
+	}
+	leaders := make([]string, 0, len(byLeader))
+	for leader := range byLeader {
+		leaders = append(leaders, leader)
+	}
+	sort.Strings(leaders)
+
+	for _, leader := range leaders {
+		partitions := byLeader[leader]
+		var request kafkaEncoder
+		request.int16(-1)
+		request.int16(kafkaAcksLeader)
+		request.int32(int32(p.timeout / time.Millisecond))
+		request.int32(1)
+		request.string(topic)
+		request.int32(int32(len(partitions)))
+		for _, partition := range partitions {
+			request.int32(partition)
+			request.bytes(encodeRecordBatch(records[partition], now))
+		}
+		response, err := p.roundTrip(leader, kafkaAPIProduce, kafkaProduceVersion, request.Bytes())
+		if err != nil {
+			return err
+		}
+		d := &kafkaDecoder{data: response}
+		for i := d.array(); i > 0; i-- {
+			name := d.string()
+			for j := d.array(); j > 0; j-- {
+				partition := d.int32()
+				code := d.int16()
+				d.int64()
+				d.int64()
+				if d.err == nil && code != 0 {
+					return &KafkaError{Code: code, Topic: name, Partition: partition}
+				}
+			}
+		}
+		if d.err != nil {
+			return d.err
+		}
+	}
+	return nil
+}
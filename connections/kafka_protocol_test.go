@@ -0,0 +1,186 @@
+package connections
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The requests and responses below are in the wire format of a Kafka broker,
+// as specified by the protocol guide, for the versions the producer uses. Each
+// is written as hexadecimal, a field at a time, including its size.
+
+// metadataRequest a Metadata v1 request for the `packet-in` topic, by client
+// `oftee`
+const metadataRequest = "0000001e" + // size
+	"0003 0001 00000001 0005 6f66746565" + // metadata v1, correlation 1, client oftee
+	"00000001 0009 7061636b65742d696e" // [packet-in]
+
+// metadataResponse the response to `metadataRequest` of a cluster of two
+// brokers, one with a rack, that lead the partitions of `packet-in` but for
+// the third, which has no leader, and of another topic
+const metadataResponse = "000000d4" + // size
+	"00000001" + // correlation 1
+	"00000002" + // brokers
+	"00000001 0007 6b61666b612d31 00002384 0002 7231" + // 1 kafka-1:9092 rack r1
+	"00000002 0007 6b61666b612d32 00002385 ffff" + // 2 kafka-2:9093 no rack
+	"00000001" + // controller 1
+	"00000002" + // topics
+	"0000 0005 6f74686572 00 00000001" + // other, not internal, 1 partition
+	"0000 00000000 00000002 00000002 00000001 00000002 00000002 00000001 00000002" +
+	"0000 0009 7061636b65742d696e 00 00000003" + // packet-in, not internal, 3 partitions
+	"0000 00000000 00000001 00000002 00000001 00000002 00000002 00000001 00000002" + // 0 led by 1
+	"0000 00000001 00000002 00000002 00000002 00000001 00000002 00000002 00000001" + // 1 led by 2
+	"0005 00000002 ffffffff 00000001 00000001 00000000" // 2 leader not available
+
+// metadataUnknownTopic the response to `metadataRequest` of a broker that
+// doesn't know the topic
+const metadataUnknownTopic = "00000035" + // size
+	"00000001" + // correlation 1
+	"00000001 00000001 0007 6b61666b612d31 00002384 ffff" + // 1 kafka-1:9092
+	"00000001" + // controller 1
+	"00000001 0003 0009 7061636b65742d696e 00 00000000" // packet-in, unknown topic or partition
+
+// produceRequest a Produce v3 request of a single record, `k` = `v` with the
+// header `dpid` = `x`, to partition 0 of `packet-in`, created at 1500000000s.
+// The CRC-32C of the batch was computed independently of the producer.
+const produceRequest = "0000007f" + // size
+	"0000 0003 00000001 0005 6f66746565" + // produce v3, correlation 1, client oftee
+	"ffff 0001 00001388" + // no transactional ID, acks 1, timeout 5s
+	"00000001 0009 7061636b65742d696e" + // [packet-in]
+	"00000001 00000000 0000004d" + // [partition 0], batch of 77 bytes
+	"0000000000000000 00000041 ffffffff 02 8cacbd6c" + // base offset, length, epoch, magic 2, crc
+	"0000 00000000 0000015d3ef79800 0000015d3ef79800" + // attributes, last offset delta, timestamps
+	"ffffffffffffffff ffff ffffffff 00000001" + // no producer ID, epoch or sequence, 1 record
+	"1e 00 00 00 02 6b 02 76" + // length 15, attributes, deltas, key k, value v
+	"02 08 64706964 02 78" // [dpid = x]
+
+// produceResponse the response to `produceRequest` of a broker that wrote
+// the record at offset 42
+const produceResponse = "00000031" + // size
+	"00000001" + // correlation 1
+	"00000001 0009 7061636b65742d696e" + // [packet-in]
+	"00000001 00000000 0000 000000000000002a ffffffffffffffff" + // [0 no error, offset 42, no log append time]
+	"00000000" // not throttled
+
+// produceNotLeader the response to `produceRequest` of a broker that no
+// longer leads the partition
+const produceNotLeader = "00000031" + // size
+	"00000001" + // correlation 1
+	"00000001 0009 7061636b65742d696e" + // [packet-in]
+	"00000001 00000000 0006 ffffffffffffffff ffffffffffffffff" + // [0 not leader for partition]
+	"00000000" // not throttled
+
+// wire decodes a request or response written as hexadecimal, spaces ignored
+func wire(t *testing.T, message string) []byte {
+	raw, err := hex.DecodeString(strings.Replace(message, " ", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// exchange connects a producer to a broker that expects the given request and
+// answers it with the given response, returning the error of the exchange
+func exchange(t *testing.T, p *kafkaProducer, address string, request string, answer []byte) <-chan error {
+	client, server := net.Pipe()
+	p.conns = map[string]net.Conn{address: client}
+	expected := wire(t, request)
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		server.SetDeadline(time.Now().Add(2 * time.Second))
+		received := make([]byte, len(expected))
+		if _, err := io.ReadFull(server, received); err != nil {
+			done <- err
+			return
+		}
+		if !bytes.Equal(received, expected) {
+			done <- fmt.Errorf("expected request %02x, got %02x", expected, received)
+			return
+		}
+		_, err := server.Write(answer)
+		done <- err
+	}()
+	return done
+}
+
+func TestKafkaMetadataProtocol(t *testing.T) {
+	p := &kafkaProducer{brokers: []string{"kafka-1:9092"}, clientID: "oftee", timeout: 5 * time.Second}
+	done := exchange(t, p, "kafka-1:9092", metadataRequest, wire(t, metadataResponse))
+	if err := p.refresh("packet-in"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// The partition without a leader is counted, but has no leader
+	expected := map[int32]string{0: "kafka-1:9092", 1: "kafka-2:9093"}
+	if !p.ready() || p.partitions != 3 || !reflect.DeepEqual(p.leaders, expected) {
+		t.Errorf("Expected 3 partitions led by %v, got %d led by %v", expected, p.partitions, p.leaders)
+	}
+	err := p.produce("packet-in", map[int32][]kafkaRecord{2: {{value: []byte("v")}}}, time.Now())
+	if e, ok := err.(*KafkaError); !ok || e.Code != kafkaErrLeaderNotAvailable || e.Partition != 2 {
+		t.Errorf("Expected leader not available for partition 2, got %v", err)
+	}
+}
+
+func TestKafkaMetadataProtocolErrors(t *testing.T) {
+	p := &kafkaProducer{brokers: []string{"kafka-1:9092"}, clientID: "oftee", timeout: 5 * time.Second}
+	done := exchange(t, p, "kafka-1:9092", metadataRequest, wire(t, metadataUnknownTopic))
+	err := p.refresh("packet-in")
+	if e, ok := err.(*KafkaError); !ok || e.Code != kafkaErrUnknownTopicOrPartition || e.Topic != "packet-in" {
+		t.Errorf("Expected unknown topic, got %v", err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if p.ready() || p.conns != nil {
+		t.Error("Expected the producer closed after the error")
+	}
+
+	// A response cut short is an error, as is one to another request
+	truncated := wire(t, metadataResponse)[:4+32]
+	binary.BigEndian.PutUint32(truncated, 32)
+	other := wire(t, metadataResponse)
+	binary.BigEndian.PutUint32(other[4:], 2)
+	for _, response := range [][]byte{truncated, other} {
+		done = exchange(t, p, "kafka-1:9092", metadataRequest, response)
+		if err = p.refresh("packet-in"); err == nil {
+			t.Errorf("Expected error for response %02x", response)
+		}
+		<-done
+		p.correlation = 0
+	}
+}
+
+func TestKafkaProduceProtocol(t *testing.T) {
+	records := map[int32][]kafkaRecord{0: {{
+		key:     []byte("k"),
+		value:   []byte("v"),
+		headers: []Header{{"dpid", []byte("x")}},
+	}}}
+	now := time.Unix(1500000000, 0)
+	for response, code := range map[string]int16{produceResponse: 0, produceNotLeader: 6} {
+		p := &kafkaProducer{clientID: "oftee", timeout: 5 * time.Second, partitions: 1, leaders: map[int32]string{0: "kafka-1:9092"}}
+		done := exchange(t, p, "kafka-1:9092", produceRequest, wire(t, response))
+		err := p.produce("packet-in", records, now)
+		if exchanged := <-done; exchanged != nil {
+			t.Fatal(exchanged)
+		}
+		if code == 0 && err != nil {
+			t.Errorf("Expected record acknowledged, got %v", err)
+		}
+		if e, ok := err.(*KafkaError); code != 0 && (!ok || e.Code != code || e.Topic != "packet-in" || e.Partition != 0) {
+			t.Errorf("Expected error code %d for partition 0, got %v", code, err)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package connections
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/datapath"
+)
+
+// producedRecord a record received by the fake broker
+type producedRecord struct {
+	partition int32
+	key       []byte
+	value     []byte
+	headers   map[string]string
+}
+
+// kafkaBroker a fake Kafka broker, the leader of every partition of its
+// topics, that records the records produced to it. While `failing` produce
+// requests are answered with an error.
+type kafkaBroker struct {
+	listener   net.Listener
+	partitions int
+
+	lock    sync.Mutex
+	records []producedRecord
+	failing bool
+	conns   []net.Conn
+}
+
+func newKafkaBroker(t *testing.T, partitions int) *kafkaBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &kafkaBroker{listener: listener, partitions: partitions}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.lock.Lock()
+			b.conns = append(b.conns, conn)
+			b.lock.Unlock()
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+// drop closes the connections to the broker, as if it restarted
+func (b *kafkaBroker) drop() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+	b.conns = nil
+}
+
+func (b *kafkaBroker) close() {
+	b.listener.Close()
+	b.drop()
+}
+
+func (b *kafkaBroker) produced() []producedRecord {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]producedRecord(nil), b.records...)
+}
+
+func (b *kafkaBroker) serve(conn net.Conn) {
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		d := &kafkaDecoder{data: request}
+		key, _, correlation := d.int16(), d.int16(), d.int32()
+		d.string()
+		var response kafkaEncoder
+		response.int32(0)
+		response.int32(correlation)
+		switch key {
+		case kafkaAPIMetadata:
+			d.array()
+			topic := d.string()
+			host, port, _ := net.SplitHostPort(b.listener.Addr().String())
+			number, _ := strconv.Atoi(port)
+			response.int32(1)
+			response.int32(1)
+			response.string(host)
+			response.int32(int32(number))
+			response.int16(-1)
+			response.int32(1)
+			response.int32(1)
+			response.int16(0)
+			response.string(topic)
+			response.int8(0)
+			response.int32(int32(b.partitions))
+			for i := 0; i < b.partitions; i++ {
+				response.int16(0)
+				response.int32(int32(i))
+				response.int32(1)
+				response.int32(0)
+				response.int32(0)
+			}
+		case kafkaAPIProduce:
+			d.string()
+			d.int16()
+			d.int32()
+			d.array()
+			topic := d.string()
+			b.lock.Lock()
+			failing := b.failing
+			b.lock.Unlock()
+			partitions := d.array()
+			response.int32(1)
+			response.string(topic)
+			response.int32(int32(partitions))
+			for i := 0; i < partitions; i++ {
+				partition := d.int32()
+				batch := d.next(int(d.int32()))
+				code := int16(0)
+				if failing {
+					code = kafkaErrLeaderNotAvailable
+				} else if records, ok := decodeRecordBatch(partition, batch); ok {
+					b.lock.Lock()
+					b.records = append(b.records, records...)
+					b.lock.Unlock()
+				} else {
+					code = 2
+				}
+				response.int32(partition)
+				response.int16(code)
+				response.int64(0)
+				response.int64(-1)
+			}
+			response.int32(0)
+		}
+		message := response.Bytes()
+		binary.BigEndian.PutUint32(message, uint32(len(message)-4))
+		conn.Write(message)
+	}
+}
+
+// decodeRecordBatch decodes the records of a batch, checking its CRC
+func decodeRecordBatch(partition int32, batch []byte) ([]producedRecord, bool) {
+	if len(batch) < 61 || batch[16] != 2 ||
+		binary.BigEndian.Uint32(batch[17:]) != crc32.Checksum(batch[21:], castagnoli) {
+		return nil, false
+	}
+	count := int(binary.BigEndian.Uint32(batch[57:]))
+	data := batch[61:]
+	varint := func() int64 {
+		v, n := binary.Varint(data)
+		data = data[n:]
+		return v
+	}
+	varbytes := func() []byte {
+		n := varint()
+		if n < 0 {
+			return nil
+		}
+		b := data[:n]
+		data = data[n:]
+		return b
+	}
+	var records []producedRecord
+	for i := 0; i < count; i++ {
+		varint()
+		data = data[1:]
+		varint()
+		varint()
+		record := producedRecord{partition: partition, key: varbytes(), value: varbytes(), headers: map[string]string{}}
+		for h := varint(); h > 0; h-- {
+			name := string(varbytes())
+			record.headers[name] = string(varbytes())
+		}
+		records = append(records, record)
+	}
+	return records, len(data) == 0
+}
+
+// kafkaPacketIn an OpenFlow 1.3 packet in of a VLAN tagged EAPOL frame,
+// received on a port of a device, preceded by its context
+func kafkaPacketIn(dpid uint64, port uint32) []byte {
+	message := make([]byte, 12)
+	binary.BigEndian.PutUint64(message, dpid)
+	binary.BigEndian.PutUint32(message[8:], port)
+	packetIn := []byte{0x04, 0x0a, 0, 0, 0, 0, 0, 1,
+		0xff, 0xff, 0xff, 0xff, 0, 64, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 1, 0, 4, 0, 0, 0, 0, // empty match, padded
+		0, 0}
+	frame := make([]byte, 64)
+	copy(frame[12:], []byte{0x81, 0x00, 0x00, 0x64, 0x88, 0x8e})
+	packetIn = append(packetIn, frame...)
+	binary.BigEndian.PutUint16(packetIn[2:], uint16(len(packetIn)))
+	return append(message, packetIn...)
+}
+
+func waitRecords(t *testing.T, broker *kafkaBroker, count int) []producedRecord {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		records := broker.produced()
+		if len(records) >= count {
+			return records
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d records, got %d", count, len(records))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestKafkaProduceKeyedByDPID(t *testing.T) {
+	broker := newKafkaBroker(t, 4)
+	defer broker.close()
+
+	u, _ := url.Parse("kafka://" + broker.listener.Addr().String() + "/packet-in")
+	brokers, topic, err := ParseKafkaURL(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := (&KafkaConnection{Brokers: brokers, Topic: topic, KeyByDPID: true}).Initialize()
+	go c.ListenAndSend()
+	for i := 0; i < 20; i++ {
+		c.GetQueue() <- kafkaPacketIn(uint64(i%5), uint32(i))
+	}
+
+	// The records of a device share a key, and so a partition. Records are
+	// ordered by partition, so are identified by their port.
+	records := waitRecords(t, broker, 20)
+	partitions := make(map[string]int32)
+	var first producedRecord
+	for _, record := range records {
+		i, _ := strconv.Atoi(record.headers[HeaderInPort])
+		if i == 0 {
+			first = record
+		}
+		key := datapath.Format(uint64(i % 5))
+		if string(record.key) != key || string(record.value) != string(kafkaPacketIn(uint64(i%5), uint32(i))) {
+			t.Fatalf("Expected record %d keyed '%s', got '%s'", i, key, record.key)
+		}
+		if partition, ok := partitions[key]; ok && partition != record.partition {
+			t.Errorf("Expected the records of %s produced to partition %d, got %d", key, partition, record.partition)
+		}
+		partitions[key] = record.partition
+		if expected := int32(murmur2(record.key)&0x7fffffff) % 4; record.partition != expected {
+			t.Errorf("Expected %s produced to partition %d, got %d", key, expected, record.partition)
+		}
+	}
+
+	// The metadata of the message is carried as headers
+	expected := map[string]string{
+		HeaderDPID:      datapath.Format(0),
+		HeaderOFVersion: "4",
+		HeaderEthType:   "0x888e",
+		HeaderInPort:    "0",
+		HeaderVLAN:      "100",
+		HeaderSequence:  "1",
+	}
+	for name, value := range expected {
+		if first.headers[name] != value {
+			t.Errorf("Expected header %s '%s', got %v", name, value, first.headers)
+		}
+	}
+	if stats := c.Stats(); stats.Matches != 20 || stats.Dropped != 0 || stats.Endpoint != u.String() {
+		t.Errorf("Expected 20 messages produced, got %+v", stats)
+	}
+}
+
+func TestKafkaEnrichedHeaders(t *testing.T) {
+	broker := newKafkaBroker(t, 1)
+	defer broker.close()
+
+	// Only port 2 of the device is enriched
+	annotator := &Annotator{Enrich: func(dpid uint64, port uint32) map[string]string {
+		if dpid == 0x1 && port == 2 {
+			return map[string]string{"subscriber": "sub-2", "account": "42"}
+		}
+		return nil
+	}}
+	c := (&KafkaConnection{
+		Brokers:   []string{broker.listener.Addr().String()},
+		Topic:     "packet-in",
+		Envelope:  true,
+		Annotator: annotator,
+	}).Initialize()
+	go c.ListenAndSend()
+	c.GetQueue() <- kafkaPacketIn(0x1, 1)
+	c.GetQueue() <- kafkaPacketIn(0x1, 2)
+
+	// The fields of the enriched port are carried as headers, and in the
+	// envelope
+	for _, record := range waitRecords(t, broker, 2) {
+		var wrapped Envelope
+		if err := json.Unmarshal(record.value, &wrapped); err != nil {
+			t.Fatal(err)
+		}
+		switch record.headers[HeaderInPort] {
+		case "1":
+			for name := range record.headers {
+				if strings.HasPrefix(name, HeaderEnrichPrefix) {
+					t.Errorf("Expected port 1 not enriched, got header %s", name)
+				}
+			}
+			if wrapped.Enrichment != nil {
+				t.Errorf("Expected port 1 not enriched, got %v", wrapped.Enrichment)
+			}
+		case "2":
+			if record.headers["enrich_subscriber"] != "sub-2" || record.headers["enrich_account"] != "42" {
+				t.Errorf("Expected enrichment headers of port 2, got %v", record.headers)
+			}
+			if wrapped.Enrichment["subscriber"] != "sub-2" || wrapped.Enrichment["account"] != "42" {
+				t.Errorf("Expected enrichment of port 2 in the envelope, got %v", wrapped.Enrichment)
+			}
+		default:
+			t.Errorf("Unexpected record, got headers %v", record.headers)
+		}
+	}
+}
+
+func TestKafkaInstanceHeader(t *testing.T) {
+	broker := newKafkaBroker(t, 1)
+	defer broker.close()
+
+	c := (&KafkaConnection{
+		Brokers:   []string{broker.listener.Addr().String()},
+		Topic:     "packet-in",
+		Annotator: &Annotator{Instance: "oftee-1"},
+	}).Initialize()
+	go c.ListenAndSend()
+	c.GetQueue() <- kafkaPacketIn(0x1, 1)
+	c.GetQueue() <- kafkaPacketIn(0x2, 2)
+
+	// Every record carries the identity of the instance that produced it
+	for _, record := range waitRecords(t, broker, 2) {
+		if record.headers[HeaderInstance] != "oftee-1" {
+			t.Errorf("Expected the %s header of the instance, got %v", HeaderInstance, record.headers)
+		}
+	}
+}
+
+func TestKafkaReconnect(t *testing.T) {
+	broker := newKafkaBroker(t, 2)
+	defer broker.close()
+	c := (&KafkaConnection{Brokers: []string{"127.0.0.1:1", broker.listener.Addr().String()}, Topic: "packet-in"}).Initialize()
+
+	// The first broker that answers is used, and records that aren't keyed
+	// are spread across the partitions
+	if err := c.produce([][]byte{kafkaPacketIn(1, 1), kafkaPacketIn(1, 2)}, false); err != nil {
+		t.Fatal(err)
+	}
+	if records := waitRecords(t, broker, 2); records[0].partition == records[1].partition || records[0].key != nil {
+		t.Errorf("Expected records produced to each partition, got %+v", records)
+	}
+
+	// Records the leader fails are dropped, and the producer reconnects,
+	// but not before the retry interval
+	broker.lock.Lock()
+	broker.failing = true
+	broker.lock.Unlock()
+	if err := c.produce([][]byte{kafkaPacketIn(1, 3)}, false); err == nil {
+		t.Error("Expected producing to fail")
+	}
+	broker.lock.Lock()
+	broker.failing = false
+	broker.lock.Unlock()
+	if err := c.produce([][]byte{kafkaPacketIn(1, 4)}, false); err != nil || c.producer.ready() {
+		t.Errorf("Expected records dropped until the retry interval, got %v", err)
+	}
+	if dropped := c.Stats().Dropped; dropped != 2 {
+		t.Errorf("Expected 2 messages dropped, got %d", dropped)
+	}
+
+	// A broker that restarts is reconnected to
+	broker.drop()
+	c.lastDial = time.Time{}
+	if err := c.produce([][]byte{kafkaPacketIn(1, 5)}, false); err != nil {
+		t.Fatal(err)
+	}
+	if records := waitRecords(t, broker, 3); records[2].headers[HeaderInPort] != "5" {
+		t.Errorf("Expected the record produced once reconnected, got %+v", records[2])
+	}
+}
+
+func TestMurmur2(t *testing.T) {
+	// The hashes computed by the Java client
+	for data, expected := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		if hash := int32(murmur2([]byte(data))); hash != expected {
+			t.Errorf("Expected hash of '%s' %d, got %d", data, expected, hash)
+		}
+	}
+}
+
+func TestParseKafkaURL(t *testing.T) {
+	u, _ := url.Parse("kafka://a:9092,b:9093/packet-in")
+	if brokers, topic, err := ParseKafkaURL(u); err != nil || len(brokers) != 2 || brokers[1] != "b:9093" || topic != "packet-in" {
+		t.Errorf("Expected two brokers and topic, got %v %s %v", brokers, topic, err)
+	}
+	for _, invalid := range []string{"kafka://a:9092", "kafka://a:9092/bad/topic", "kafka://a/topic", "kafka:///topic"} {
+		u, _ = url.Parse(invalid)
+		if _, _, err := ParseKafkaURL(u); err == nil {
+			t.Errorf("Expected '%s' rejected", invalid)
+		}
+	}
+}
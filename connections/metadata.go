@@ -0,0 +1,166 @@
+package connections
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/datapath"
+	"github.com/ciena/oftee/packetin"
+)
+
+// Names of the record headers set on messages produced to Kafka end points.
+// These names are part of the interface to consumers and MUST NOT change.
+const (
+	HeaderDPID      = "dpid"
+	HeaderOFVersion = "of_version"
+	HeaderEthType   = "ethertype"
+	HeaderInPort    = "in_port"
+	HeaderVLAN      = "vlan"
+	HeaderInstance  = "oftee_instance"
+	HeaderSequence  = "sequence"
+	HeaderHops      = "oftee_hops"
+
+	// HeaderEnrichPrefix prefix of the headers that carry the fields
+	// looked up for the port on which a packet was received
+	HeaderEnrichPrefix = "enrich_"
+)
+
+// Metadata describes a message being tee-ed to an end point, independently of
+// how the message itself is encoded. It is intended to be the single source
+// of the per message information carried outside of the message payload, i.e.
+// as Kafka record headers.
+type Metadata struct {
+	DPID      uint64
+	HasDPID   bool
+	OFVersion uint8
+	EthType   uint16
+	InPort    uint32
+	HasInPort bool
+	VLAN      uint16
+	HasVLAN   bool
+	Instance  string
+	Sequence  uint64
+
+	// Hops number of chained oftee instances that tee-ed the message
+	// before this one, see `CHAIN_LISTEN_ON`
+	Hops uint32
+
+	// Enrichment fields looked up for the device port, if any
+	Enrichment map[string]string
+}
+
+// Header is a single key / value pair carried with a message
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Headers returns the metadata as a list of headers. All values are encoded as
+// strings so that consumers can route on them without decoding the payload.
+// Values that are not known, i.e. the DPID before the device handshake has
+// completed, are omitted, as is the hop count of a message that wasn't
+// received from a chained instance. Enrichment fields follow, ordered by
+// name.
+func (m *Metadata) Headers() []Header {
+	headers := make([]Header, 0, 7)
+	if m.HasDPID {
+		headers = append(headers, Header{HeaderDPID, []byte(datapath.Format(m.DPID))})
+	}
+	headers = append(headers,
+		Header{HeaderOFVersion, []byte(strconv.Itoa(int(m.OFVersion)))},
+		Header{HeaderEthType, []byte(fmt.Sprintf("0x%04x", m.EthType))})
+	if m.HasInPort {
+		headers = append(headers, Header{HeaderInPort, []byte(strconv.FormatUint(uint64(m.InPort), 10))})
+	}
+	if m.HasVLAN {
+		headers = append(headers, Header{HeaderVLAN, []byte(strconv.Itoa(int(m.VLAN)))})
+	}
+	if m.Instance != "" {
+		headers = append(headers, Header{HeaderInstance, []byte(m.Instance)})
+	}
+	headers = append(headers, Header{HeaderSequence, []byte(strconv.FormatUint(m.Sequence, 10))})
+	if m.Hops > 0 {
+		headers = append(headers, Header{HeaderHops, []byte(strconv.FormatUint(uint64(m.Hops), 10))})
+	}
+	names := make([]string, 0, len(m.Enrichment))
+	for name := range m.Enrichment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		headers = append(headers, Header{HeaderEnrichPrefix + name, []byte(m.Enrichment[name])})
+	}
+	return headers
+}
+
+// Annotator adds to the metadata of the messages tee-ed to an end point what
+// is known of them beyond what can be decoded from the messages themselves
+type Annotator struct {
+	// Enrich returns the fields looked up for the device port on which a
+	// packet in was received, nil if none are known. It is called as
+	// each message is delivered, so must not block.
+	Enrich func(dpid uint64, port uint32) map[string]string
+
+	// Hops number of chained oftee instances that tee-ed the messages
+	// before this one, 0 for messages received from devices
+	Hops uint32
+
+	// Instance identity of the oftee instance that tees the messages,
+	// i.e. its host name
+	Instance string
+}
+
+// metadataOf describes a message, see `metadataOf`, with the instance that
+// tees it, its hop count and the enrichment of the port on which it was
+// received, if it is a packet in. A nil annotator adds nothing.
+func (a *Annotator) metadataOf(message []byte, raw bool) *Metadata {
+	metadata := metadataOf(message, raw)
+	if a == nil {
+		return metadata
+	}
+	metadata.Instance = a.Instance
+	metadata.Hops = a.Hops
+	if a.Enrich != nil && metadata.HasDPID && metadata.HasInPort {
+		metadata.Enrichment = a.Enrich(metadata.DPID, metadata.InPort)
+	}
+	return metadata
+}
+
+// metadataOf describes a message, from its context, OpenFlow header and the
+// packet it carries. When `raw` is set the message is a raw packet, without a
+// context, so only its Ethernet type and VLAN are known.
+func metadataOf(message []byte, raw bool) *Metadata {
+	metadata := &Metadata{}
+	packet := message
+	if !raw {
+		if len(message) < 12+8 {
+			return metadata
+		}
+		metadata.DPID, metadata.HasDPID = binary.BigEndian.Uint64(message), true
+		metadata.OFVersion = message[12]
+		if packet = packetInData(message[12:]); packet != nil {
+			metadata.InPort, metadata.HasInPort = binary.BigEndian.Uint32(message[8:]), true
+		}
+	}
+	if len(packet) >= 14 {
+		inner, vlan, tagged, _ := criteria.Untag(binary.BigEndian.Uint16(packet[12:]), packet[14:])
+		metadata.EthType, metadata.VLAN, metadata.HasVLAN = inner, vlan, tagged
+	}
+	return metadata
+}
+
+// packetInData returns the packet carried by an OpenFlow 1.0, or 1.3 and
+// later, packet in, nil for other messages
+func packetInData(message []byte) []byte {
+	if len(message) < 8 {
+		return nil
+	}
+	packetIn, err := packetin.Decode(message[0], message)
+	if err != nil {
+		return nil
+	}
+	return packetIn.Data(message)
+}
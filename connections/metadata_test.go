@@ -0,0 +1,69 @@
+package connections
+
+import (
+	"testing"
+)
+
+func headerMap(headers []Header) map[string]string {
+	m := make(map[string]string)
+	for _, h := range headers {
+		m[h.Key] = string(h.Value)
+	}
+	return m
+}
+
+func TestMetadataHeaders(t *testing.T) {
+	md := Metadata{
+		DPID:      0x1,
+		HasDPID:   true,
+		OFVersion: 4,
+		EthType:   0x888e,
+		InPort:    32,
+		HasInPort: true,
+		VLAN:      1000,
+		HasVLAN:   true,
+		Instance:  "oftee-0",
+		Sequence:  42,
+	}
+	headers := headerMap(md.Headers())
+	for key, expected := range map[string]string{
+		HeaderDPID:      "of:0x0000000000000001",
+		HeaderOFVersion: "4",
+		HeaderEthType:   "0x888e",
+		HeaderInPort:    "32",
+		HeaderVLAN:      "1000",
+		HeaderInstance:  "oftee-0",
+		HeaderSequence:  "42",
+	} {
+		if headers[key] != expected {
+			t.Errorf("Incorrect value for header '%s', expected '%s', got '%s'", key, expected, headers[key])
+		}
+	}
+}
+
+func TestMetadataHeadersOmitUnknown(t *testing.T) {
+	md := Metadata{OFVersion: 4, EthType: 0x0806}
+	headers := headerMap(md.Headers())
+	for _, key := range []string{HeaderDPID, HeaderInPort, HeaderVLAN, HeaderInstance} {
+		if _, ok := headers[key]; ok {
+			t.Errorf("Expected header '%s' to be omitted", key)
+		}
+	}
+	if len(headers) != 3 {
+		t.Errorf("Expected 3 headers, got %d", len(headers))
+	}
+}
+
+func TestMetadataHeadersEnrichment(t *testing.T) {
+	md := Metadata{
+		OFVersion:  4,
+		Enrichment: map[string]string{"subscriber": "sub-1", "account": "42"},
+	}
+	headers := md.Headers()
+	if len(headers) != 5 {
+		t.Fatalf("Expected 5 headers, got %d", len(headers))
+	}
+	if headers[3].Key != "enrich_account" || headers[4].Key != "enrich_subscriber" || string(headers[4].Value) != "sub-1" {
+		t.Errorf("Incorrect enrichment headers, got %+v", headers[3:])
+	}
+}
@@ -0,0 +1,374 @@
+package connections
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciena/oftee/criteria"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// SchemePcap URL scheme of a pcap file end point
+const SchemePcap = "pcap"
+
+const (
+	// PcapSnaplen maximum number of bytes of each packet written to a pcap
+	// file, unless its `snaplen` is set
+	PcapSnaplen = 65535
+
+	// pcapHeaderSize the size of the file header of a pcap file
+	pcapHeaderSize = 24
+
+	// pcapRecordHeaderSize the size of the header of each packet of a pcap
+	// file
+	pcapRecordHeaderSize = 16
+
+	// pcapBackupTime the format of the time at which a pcap file was rotated,
+	// in the name of the backup
+	pcapBackupTime = "2006-01-02T15-04-05.000"
+)
+
+func init() {
+	RegisterScheme(SchemePcap, newPcapScheme, "rotate", "snaplen", "queue")
+}
+
+// PcapConnection is an end point that writes the packets of the matched
+// packet ins, decapsulated from their context, OpenFlow and packet in
+// headers, to a pcap file of Ethernet frames, of the form
+// `pcap:///path/to/file.pcap`, for offline analysis. Messages other than
+// packet ins are dropped.
+//
+// The directory of the file is created if missing, and an existing file is
+// kept as if it was rotated. Once the file reaches `Rotate` bytes, if set, it
+// is renamed with the time it was rotated, i.e.
+// `eapol-2018-07-01T12-00-00.000.pcap`, and a new file started. Each packet
+// is truncated to `Snaplen` bytes. The writes are buffered, and flushed as
+// the queue empties and when the connection is closed.
+type PcapConnection struct {
+	Path      string
+	Criteria  criteria.Criteria
+	Snaplen   int
+	Rotate    int64
+	Raw       bool
+	QueueSize int
+	Budget    *Budget
+	queue     chan []byte
+	input     chan<- []byte
+	file      *os.File
+	buffer    *bufio.Writer
+	writer    *pcapgo.Writer
+	size      int64
+	matches   uint64
+	bytes     uint64
+	dropped   uint64
+	errors    uint64
+	rotations uint64
+	sending   int32
+	listening int32
+	stop      chan struct{}
+	done      chan struct{}
+	closing   sync.Once
+}
+
+// newPcapScheme creates the connection to a pcap file end point
+func newPcapScheme(u *url.URL, match criteria.Criteria, options *EndpointOptions) (Connection, error) {
+	if u.Host != "" || u.Path == "" {
+		return nil, fmt.Errorf("invalid address '%s', expected pcap:///path/to/file.pcap", u)
+	}
+	if options == nil {
+		return nil, nil
+	}
+	c := &PcapConnection{
+		Path:      u.Path,
+		Criteria:  match,
+		Snaplen:   PcapSnaplen,
+		Raw:       options.Raw,
+		QueueSize: options.QueueSize,
+		Budget:    options.Budget,
+	}
+	if value := options.Terms.Get("snaplen"); value != "" {
+		snaplen, err := strconv.Atoi(value)
+		if err != nil || snaplen < 1 {
+			return nil, &TermError{"snaplen", fmt.Errorf("invalid snaplen '%s', expected a positive number of bytes", value)}
+		}
+		c.Snaplen = snaplen
+	}
+	if value := options.Terms.Get("rotate"); value != "" {
+		rotate, err := ParseByteSize(value)
+		if err != nil {
+			return nil, &TermError{"rotate", fmt.Errorf("invalid rotate '%s' : %s", value, err)}
+		}
+		c.Rotate = rotate
+	}
+	c.Initialize()
+	if options.Durable {
+		// Not a `Deliverer`, so can't be durable
+		return c, nil
+	}
+	if options.Lazy {
+		return c, nil
+	}
+	return c, c.open()
+}
+
+// ParseByteSize parses a number of bytes, optionally followed by the unit
+// `KB`, `MB` or `GB`, each 1024 of the one before, i.e. `100MB`
+func ParseByteSize(value string) (int64, error) {
+	number, multiplier := strings.ToUpper(strings.TrimSpace(value)), int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(number, unit.suffix) {
+			number, multiplier = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix)), unit.multiplier
+			break
+		}
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 1 {
+		return 0, fmt.Errorf("expected a positive size, i.e. 100MB")
+	}
+	return size * multiplier, nil
+}
+
+// Initialize makes sure private members, that can't function from zero
+// state, are set correctly
+func (c *PcapConnection) Initialize() *PcapConnection {
+	if c.Snaplen < 1 {
+		c.Snaplen = PcapSnaplen
+	}
+	c.queue = queueOf(c.QueueSize)
+	c.input = c.queue
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	if c.Budget != nil {
+		c.input = c.Budget.Track(c.queue, 1)
+	}
+	return c
+}
+
+// open creates the pcap file, and its directory if missing, and writes its
+// file header. An existing file is kept, renamed as if it was rotated when
+// last modified.
+func (c *PcapConnection) open() error {
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0755); err != nil {
+		return err
+	}
+	if info, err := os.Stat(c.Path); err == nil && info.Size() > 0 {
+		if err = os.Rename(c.Path, c.backup(info.ModTime())); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(c.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	c.file, c.buffer = file, bufio.NewWriter(file)
+	c.writer = pcapgo.NewWriter(c.buffer)
+	if err = c.writer.WriteFileHeader(uint32(c.Snaplen), layers.LinkTypeEthernet); err != nil {
+		c.closeFile()
+		return err
+	}
+	c.size = pcapHeaderSize
+	return nil
+}
+
+// closeFile flushes, and closes, the pcap file, if open
+func (c *PcapConnection) closeFile() error {
+	if c.file == nil {
+		return nil
+	}
+	err := c.buffer.Flush()
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	c.file, c.buffer, c.writer = nil, nil, nil
+	return err
+}
+
+// rotate renames the pcap file with the time it was rotated, and starts a
+// new one
+func (c *PcapConnection) rotate() error {
+	if err := c.closeFile(); err != nil {
+		return err
+	}
+	if err := os.Rename(c.Path, c.backup(time.Now())); err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.rotations, 1)
+	return c.open()
+}
+
+// backup returns the name of the pcap file once rotated at the given time
+func (c *PcapConnection) backup(rotated time.Time) string {
+	ext := filepath.Ext(c.Path)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(c.Path, ext), rotated.Format(pcapBackupTime), ext)
+}
+
+// write writes the packet of a message to the pcap file, opening it if it
+// isn't, and rotating it first if the packet would take it beyond its size
+func (c *PcapConnection) write(message []byte) error {
+	packet := message
+	if !c.Raw {
+		if len(message) < 12 {
+			packet = nil
+		} else {
+			packet = packetInData(message[12:])
+		}
+	}
+	if packet == nil {
+		atomic.AddUint64(&c.dropped, 1)
+		return nil
+	}
+	captured := packet
+	if len(captured) > c.Snaplen {
+		captured = captured[:c.Snaplen]
+	}
+	if c.file == nil {
+		if err := c.open(); err != nil {
+			return err
+		}
+	}
+	record := int64(pcapRecordHeaderSize + len(captured))
+	if c.Rotate > 0 && c.size > pcapHeaderSize && c.size+record > c.Rotate {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+	err := c.writer.WritePacket(gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(captured),
+		Length:        len(packet),
+	}, captured)
+	if err != nil {
+		return err
+	}
+	c.size += record
+	return nil
+}
+
+// GetQueue returns the channel used to queue messages up for delivery
+func (c *PcapConnection) GetQueue() chan<- []byte {
+	return c.input
+}
+
+// ListenAndSend listens for and writes messages to the pcap file, until the
+// connection is closed
+func (c *PcapConnection) ListenAndSend() error {
+	// If queue not created, error out
+	if c.queue == nil {
+		log.
+			WithError(ErrUninitialized).
+			Error("MUST initialize connection before use")
+		return ErrUninitialized
+	}
+	atomic.StoreInt32(&c.listening, 1)
+	defer close(c.done)
+
+	for {
+		select {
+		case <-c.stop:
+			if err := c.closeFile(); err != nil {
+				log.
+					WithError(err).
+					WithFields(log.Fields{
+						"target": c.Path,
+					}).
+					Error("Unable to flush pcap file")
+			}
+			return nil
+		case message := <-c.queue:
+			atomic.StoreInt32(&c.sending, 1)
+			atomic.AddUint64(&c.matches, 1)
+			atomic.AddUint64(&c.bytes, uint64(len(message)))
+			err := c.write(message)
+			if err == nil && len(c.queue) == 0 && c.buffer != nil {
+				err = c.buffer.Flush()
+			}
+			if err != nil {
+				atomic.AddUint64(&c.errors, 1)
+				log.
+					WithError(err).
+					WithFields(log.Fields{
+						"target": c.Path,
+					}).
+					Warn("failed writing queued message to pcap file")
+				c.closeFile()
+			}
+			atomic.StoreInt32(&c.sending, 0)
+			c.Budget.Done()
+		}
+	}
+}
+
+// dropOldest makes room in the full queue of the end point by dropping the
+// oldest message queued
+func (c *PcapConnection) dropOldest() bool {
+	return dropOldest(c.queue, c.Budget, &c.dropped)
+}
+
+// Close stops the delivery of messages to the end point, once those queued
+// have been written or after `CloseTimeout`, when `ErrUndelivered` is
+// returned, and flushes and closes the pcap file. Nothing may be queued to
+// the end point once it is closed.
+func (c *PcapConnection) Close() error {
+	var err error
+	c.closing.Do(func() {
+		err = drain(c, c.stop)
+		if atomic.LoadInt32(&c.listening) == 1 {
+			<-c.done
+		} else if closeErr := c.closeFile(); err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
+
+// Pending returns the number of messages queued to the end point that are
+// yet to be written, including the one being written
+func (c *PcapConnection) Pending() int {
+	return len(c.queue) + int(atomic.LoadInt32(&c.sending))
+}
+
+// Stats returns the number of messages, and bytes, queued for delivery to
+// the end point, those dropped, as they are not packet ins or the queue was
+// full, the failed writes and the times the file was rotated
+func (c *PcapConnection) Stats() EndpointStats {
+	return EndpointStats{
+		Endpoint:  SchemePcap + "://" + c.Path,
+		Matches:   atomic.LoadUint64(&c.matches),
+		Bytes:     atomic.LoadUint64(&c.bytes),
+		Dropped:   atomic.LoadUint64(&c.dropped),
+		Errors:    atomic.LoadUint64(&c.errors),
+		Rotations: atomic.LoadUint64(&c.rotations),
+	}
+}
+
+// Connection in string form
+func (c *PcapConnection) String() string {
+	if c.queue == nil {
+		return fmt.Sprintf("(%s, %d)", c.Path, -1)
+	}
+	return fmt.Sprintf("(%s, %d)", c.Path, len(c.queue))
+}
+
+// Match returns true if the end point's criteria match the given state
+func (c *PcapConnection) Match(state criteria.Criteria) bool {
+	return c.Criteria.Match(state)
+}
+
+// CriteriaBits returns the values the end point matches on
+func (c *PcapConnection) CriteriaBits() uint64 {
+	return c.Criteria.Bits()
+}
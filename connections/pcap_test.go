@@ -0,0 +1,162 @@
+package connections
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/criteria"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// newPcapConnection creates the connection to a pcap file end point, with
+// the given terms, and starts its delivery
+func newPcapConnection(t *testing.T, path string, terms url.Values) *PcapConnection {
+	u, _ := url.Parse("pcap://" + path)
+	c, err := NewConnection(u, criteria.Criteria{}, &EndpointOptions{Terms: terms})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.ListenAndSend()
+	return c.(*PcapConnection)
+}
+
+// readPcap reads the packets of a pcap file, failing unless it is of
+// Ethernet frames with the given snaplen
+func readPcap(t *testing.T, path string, snaplen uint32) [][]byte {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	r, err := pcapgo.NewReader(file)
+	if err != nil {
+		t.Fatalf("Unable to read pcap file '%s' : %v", path, err)
+	}
+	if r.LinkType() != layers.LinkTypeEthernet || r.Snaplen() != snaplen {
+		t.Errorf("Expected Ethernet frames with a snaplen of %d, got %s", snaplen, r)
+	}
+	var packets [][]byte
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			t.Fatalf("Unable to read packet from '%s' : %v", path, err)
+		}
+		if ci.Length < len(data) {
+			t.Errorf("Expected the original length recorded, got %+v", ci)
+		}
+		packets = append(packets, data)
+	}
+}
+
+func TestPcapConnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The directory is created, and each packet truncated to the snaplen
+	path := filepath.Join(dir, "captures", "eapol.pcap")
+	c := newPcapConnection(t, path, url.Values{"snaplen": {"32"}})
+	large, small := kafkaPacketIn(0x1, 3), packetIn(0x2, 7, 0)
+	flowRemoved := append(make([]byte, 12), 0x04, 11, 0, 8, 0, 0, 0, 1)
+	c.GetQueue() <- large
+	c.GetQueue() <- flowRemoved
+	c.GetQueue() <- small
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the packets of the packet ins are written, flushed once closed
+	packets := readPcap(t, path, 32)
+	if len(packets) != 2 || !bytes.Equal(packets[0], packetInData(large[12:])[:32]) || !bytes.Equal(packets[1], packetInData(small[12:])) {
+		t.Errorf("Expected the packets of the packet ins, got %02x", packets)
+	}
+	if stats := c.Stats(); stats.Matches != 3 || stats.Dropped != 1 || stats.Errors != 0 {
+		t.Errorf("Expected the flow removed dropped, got %+v", stats)
+	}
+}
+
+func TestPcapConnectionRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A file holds its header and two records of 30 bytes, so the third
+	// is written to a new file
+	path := filepath.Join(dir, "eapol.pcap")
+	c := newPcapConnection(t, path, url.Values{"rotate": {"100B"}})
+	for port := uint32(1); port <= 3; port++ {
+		c.GetQueue() <- packetIn(0x1, port, 0)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	backups, _ := filepath.Glob(filepath.Join(dir, "eapol-*.pcap"))
+	if len(backups) != 1 {
+		t.Fatalf("Expected one rotated file, got %v", backups)
+	}
+	if packets := readPcap(t, backups[0], PcapSnaplen); len(packets) != 2 {
+		t.Errorf("Expected two packets in the rotated file, got %d", len(packets))
+	}
+	if packets := readPcap(t, path, PcapSnaplen); len(packets) != 1 {
+		t.Errorf("Expected one packet in the current file, got %d", len(packets))
+	}
+	if stats := c.Stats(); stats.Rotations != 1 {
+		t.Errorf("Expected one rotation, got %+v", stats)
+	}
+
+	// The file written is kept once the end point is re-created
+	os.Chtimes(path, time.Now(), time.Now().Add(-time.Hour))
+	c = newPcapConnection(t, path, nil)
+	c.Close()
+	if backups, _ = filepath.Glob(filepath.Join(dir, "eapol-*.pcap")); len(backups) != 2 {
+		t.Errorf("Expected the existing file kept, got %v", backups)
+	}
+}
+
+func TestPcapScheme(t *testing.T) {
+	for _, tc := range []struct {
+		address string
+		terms   url.Values
+	}{
+		{"pcap://eapol.pcap", nil},
+		{"pcap:///tmp/eapol.pcap", url.Values{"snaplen": {"0"}}},
+		{"pcap:///tmp/eapol.pcap", url.Values{"rotate": {"lots"}}},
+	} {
+		u, _ := url.Parse(tc.address)
+		if _, err := NewConnection(u, criteria.Criteria{}, &EndpointOptions{Terms: tc.terms, Lazy: true}); err == nil {
+			t.Errorf("Expected '%s' with %v rejected", tc.address, tc.terms)
+		}
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"512":   512,
+		"100B":  100,
+		"64kb":  64 << 10,
+		"100MB": 100 << 20,
+		"2 GB":  2 << 30,
+		"MB":    0,
+		"-1MB":  0,
+		"1TB":   0,
+	} {
+		size, err := ParseByteSize(value)
+		if (err != nil) != (expected == 0) || size != expected {
+			t.Errorf("Incorrect size of '%s', expected %d, got %d (%v)", value, expected, size, err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package connections
+
+import (
+	"encoding/binary"
+	"encoding/json"
+)
+
+// Formats of the messages written to an end point, as identified by its
+// preamble
+const (
+	// FormatOpenFlow each message is an OpenFlow context followed by an
+	// OpenFlow message
+	FormatOpenFlow = "openflow"
+
+	// FormatRaw each message is a raw packet, see `TEE_RAW`
+	FormatRaw = "raw"
+)
+
+// Preamble identifies the oftee instance, and the end point, to the consumer
+// of a TCP end point, so that a consumer of the streams of many instances can
+// tell them apart without relying on their source address
+type Preamble struct {
+	Instance string `json:"instance"`
+	Version  string `json:"version"`
+	Endpoint string `json:"endpoint"`
+	Criteria string `json:"criteria"`
+	Format   string `json:"format"`
+}
+
+// Encode returns the preamble as a record, its JSON encoding preceded by its
+// length as a 4 byte, big endian, integer
+func (p *Preamble) Encode() ([]byte, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[4:], data)
+	return record, nil
+}
@@ -0,0 +1,57 @@
+package connections
+
+import (
+	"sync/atomic"
+)
+
+// The controls applied to the delivery to all end points while the process is
+// under memory pressure
+var (
+	// queueLimit the number of messages that may be queued to an end
+	// point, see `SetQueueLimit`
+	queueLimit int32
+
+	// forcedSampling end points with a latency budget are demoted to
+	// sampling, see `ForceSampling`
+	forcedSampling int32
+
+	// pressureDropped the messages not queued because of the queue limit
+	pressureDropped uint64
+)
+
+// SetQueueLimit shrinks the queues of the end points, to the given number of
+// messages, or restores them to their capacity if 0. A message that would be
+// queued to an end point whose queue already holds `limit` messages is
+// dropped, and counted, rather than queued, see `Endpoints.ConditionalWrite`.
+func SetQueueLimit(limit int) {
+	atomic.StoreInt32(&queueLimit, int32(limit))
+}
+
+// QueueLimit returns the number of messages that may be queued to an end
+// point, or 0 if limited by the capacity of its queue
+func QueueLimit() int {
+	return int(atomic.LoadInt32(&queueLimit))
+}
+
+// ForceSampling demotes all end points with a latency budget, which are those
+// whose messages may be dropped, to deliver only one in every `SampleRate`
+// messages, whatever their queue residency and strategy, or stops doing so
+func ForceSampling(force bool) {
+	var value int32
+	if force {
+		value = 1
+	}
+	atomic.StoreInt32(&forcedSampling, value)
+}
+
+// SamplingForced returns true while end points with a latency budget are
+// forced to sample
+func SamplingForced() bool {
+	return atomic.LoadInt32(&forcedSampling) == 1
+}
+
+// PressureDropped returns the number of messages dropped because the queue
+// of their end point was shrunk
+func PressureDropped() uint64 {
+	return atomic.LoadUint64(&pressureDropped)
+}
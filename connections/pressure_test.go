@@ -0,0 +1,61 @@
+package connections
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/criteria"
+)
+
+func TestQueueLimit(t *testing.T) {
+	defer SetQueueLimit(0)
+
+	// The end point is never delivered to, so its queue only fills
+	wedged := (&TCPConnection{}).Initialize()
+	eps := Endpoints{wedged}
+	SetQueueLimit(3)
+	dropped := PressureDropped()
+	for i := 0; i < 5; i++ {
+		eps.ConditionalWrite(context.Background(), []byte{byte(i)}, criteria.Criteria{})
+	}
+	if len(wedged.queue) != 3 || PressureDropped()-dropped != 2 {
+		t.Errorf("Expected 3 messages queued and 2 dropped, got %d and %d", len(wedged.queue), PressureDropped()-dropped)
+	}
+
+	// Restored to the capacity of the queue
+	SetQueueLimit(0)
+	if written, _ := eps.ConditionalWrite(context.Background(), []byte{5}, criteria.Criteria{}); written[0] != 1 || len(wedged.queue) != 4 {
+		t.Errorf("Expected the message queued once restored, got %v", written)
+	}
+}
+
+func TestForceSampling(t *testing.T) {
+	defer ForceSampling(false)
+
+	// Forced to sample, whatever its strategy, without being demoted
+	b := &Budget{Limit: time.Second, Strategy: DemotePause, SampleRate: 4, Window: time.Second}
+	queue := make(chan []byte, 100)
+	input := b.Track(queue, 1)
+	ForceSampling(true)
+	for i := 0; i < 20; i++ {
+		input <- []byte{byte(i)}
+	}
+	deadline := time.Now().Add(time.Second)
+	for uint64(len(queue))+b.Dropped() < 20 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if b.Demoted() || len(queue) != 5 || b.Dropped() != 15 {
+		t.Errorf("Expected 1 in 4 messages delivered, got %d delivered and %d dropped", len(queue), b.Dropped())
+	}
+
+	ForceSampling(false)
+	input <- []byte{20}
+	deadline = time.Now().Add(time.Second)
+	for len(queue) < 6 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if len(queue) != 6 {
+		t.Errorf("Expected every message delivered once no longer forced, got %d", len(queue))
+	}
+}
@@ -0,0 +1,51 @@
+package connections
+
+import (
+	"encoding/binary"
+	"time"
+
+	protobuf "github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	"github.com/ciena/oftee/packetin"
+	"github.com/ciena/oftee/proto"
+)
+
+// packetInProto encodes a packet in, prefixed by its context and described by
+// its metadata, as a `proto.PacketIn` stamped with the time at which it is
+// delivered. The fields of the packet in that can't be decoded are left 0,
+// and its frame empty.
+func packetInProto(message []byte, metadata *Metadata, now time.Time) []byte {
+	encoded := &proto.PacketIn{
+		Dpid:       metadata.DPID,
+		OfVersion:  uint32(metadata.OFVersion),
+		Enrichment: metadata.Enrichment,
+		Hops:       metadata.Hops,
+	}
+	if metadata.HasInPort {
+		encoded.InPort = metadata.InPort
+	}
+	encoded.Timestamp, _ = ptypes.TimestampProto(now)
+	if metadata.HasDPID {
+		if packetIn, err := packetin.Decode(message[12], message[12:]); err == nil {
+			encoded.TableId = uint32(packetIn.TableID)
+			encoded.Cookie = packetIn.Cookie
+			encoded.Reason = uint32(packetIn.Reason)
+			encoded.Frame = packetIn.Data(message[12:])
+		}
+	}
+
+	// Marshalling the packet in can't fail, its fields are all numbers or
+	// bytes, and its timestamp valid
+	marshalled, _ := protobuf.Marshal(encoded)
+	return marshalled
+}
+
+// lengthPrefixed prefixes an encoded message with its length, as 4 bytes in
+// network order, so that the messages written to a stream can be told apart
+func lengthPrefixed(encoded []byte) []byte {
+	framed := make([]byte, 4+len(encoded))
+	binary.BigEndian.PutUint32(framed, uint32(len(encoded)))
+	copy(framed[4:], encoded)
+	return framed
+}
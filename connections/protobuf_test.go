@@ -0,0 +1,117 @@
+package connections
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	protobuf "github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	"github.com/ciena/oftee/proto"
+)
+
+func decodePacketIn(t *testing.T, encoded []byte) *proto.PacketIn {
+	decoded := &proto.PacketIn{}
+	if err := protobuf.Unmarshal(encoded, decoded); err != nil {
+		t.Fatalf("Expected a protocol buffer, got %x (%v)", encoded, err)
+	}
+	return decoded
+}
+
+func TestPacketInProto(t *testing.T) {
+	message := packetIn(1, 3, 1)
+	message[12+15] = 2
+	binary.BigEndian.PutUint64(message[12+16:], 0xc0ffee)
+	now := time.Date(2018, 3, 1, 12, 0, 0, 123456789, time.UTC)
+
+	decoded := decodePacketIn(t, packetInProto(message, metadataOf(message, false), now))
+	if decoded.Dpid != 1 || decoded.InPort != 3 || decoded.TableId != 2 || decoded.Cookie != 0xc0ffee ||
+		decoded.Reason != 1 || decoded.OfVersion != 4 {
+		t.Errorf("Incorrect packet in, got %v", decoded)
+	}
+	if stamp, err := ptypes.Timestamp(decoded.Timestamp); err != nil || !stamp.Equal(now) {
+		t.Errorf("Expected timestamp %v, got %v (%v)", now, stamp, err)
+	}
+	if !bytes.Equal(decoded.Frame, message[12+24+8+2:]) {
+		t.Errorf("Expected the packet as frame, got %x", decoded.Frame)
+	}
+
+	// The DPID isn't known until the handshake completes, and a message
+	// that isn't a packet in has no frame
+	echo := make([]byte, 12+8)
+	echo[12], echo[13] = 0x04, 2
+	decoded = decodePacketIn(t, packetInProto(echo, metadataOf(echo, false), now))
+	if decoded.Dpid != 0 || decoded.InPort != 0 || decoded.OfVersion != 4 || len(decoded.Frame) != 0 {
+		t.Errorf("Expected only the version, got %v", decoded)
+	}
+}
+
+func TestHTTPProtobuf(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	types := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		types <- req.Header.Get("Content-Type")
+		bodies <- body
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	c := (&HTTPConnection{Connection: *u, Protobuf: true}).Initialize()
+	if err := c.Deliver(packetIn(1, 3, 0)); err != nil {
+		t.Fatalf("Expected the message delivered, got %v", err)
+	}
+	if contentType := <-types; contentType != "application/x-protobuf" {
+		t.Errorf("Expected a protocol buffer content type, got '%s'", contentType)
+	}
+	if decoded := decodePacketIn(t, <-bodies); decoded.Dpid != 1 || decoded.InPort != 3 {
+		t.Errorf("Incorrect packet in, got %v", decoded)
+	}
+}
+
+func TestTCPProtobufLengthPrefixed(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	c := (&TCPConnection{Protobuf: true}).Initialize()
+	if err = c.DialOnDemand(listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go c.ListenAndSend()
+	c.GetQueue() <- packetIn(1, 3, 0)
+	c.GetQueue() <- packetIn(2, 4, 0)
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	// Each packet in is read by its length
+	for _, dpid := range []uint64{1, 2} {
+		length := make([]byte, 4)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			t.Fatalf("Expected a length prefix, got %v", err)
+		}
+		encoded := make([]byte, binary.BigEndian.Uint32(length))
+		if _, err = io.ReadFull(conn, encoded); err != nil {
+			t.Fatalf("Expected a packet in of %d bytes, got %v", len(encoded), err)
+		}
+		if decoded := decodePacketIn(t, encoded); decoded.Dpid != dpid || decoded.InPort != uint32(dpid+2) {
+			t.Errorf("Incorrect packet in, got %v", decoded)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package connections
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// ResolveTimeout is the maximum time allowed for resolving the host name of
+// an end point
+const ResolveTimeout = 5 * time.Second
+
+// Resolver is the interface used to resolve the host name of an end point to
+// a list of addresses. It is satisfied by `*net.Resolver`, which allows a
+// custom resolver to be injected.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DefaultResolver is the resolver used by connections that do not specify
+// their own
+var DefaultResolver Resolver = net.DefaultResolver
+
+// resolve returns the list of addresses to which the given host resolves.
+// Addresses are returned in the order provided by the resolver, except that
+// the preferred address, if present, is moved to the front of the list. If
+// the host is an IP literal, or empty, no resolution is performed.
+func resolve(resolver Resolver, host string, preferred net.IP) ([]net.IP, error) {
+	if host == "" {
+		return []net.IP{nil}, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if resolver == nil {
+		resolver = DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ResolveTimeout)
+	defer cancel()
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if preferred != nil && addr.IP.Equal(preferred) {
+			ips = append([]net.IP{addr.IP}, ips...)
+		} else {
+			ips = append(ips, addr.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no addresses found", Name: host}
+	}
+	return ips, nil
+}
@@ -0,0 +1,153 @@
+package connections
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver returns a configurable set of addresses for any host name,
+// simulating DNS records that change over time
+type fakeResolver struct {
+	lock  sync.Mutex
+	addrs []net.IPAddr
+}
+
+func (r *fakeResolver) set(ips ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.addrs = nil
+	for _, ip := range ips {
+		r.addrs = append(r.addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]net.IPAddr(nil), r.addrs...), nil
+}
+
+// listenPair creates listeners on two loopback addresses using the same port,
+// so that both are valid resolutions of the same `host:port`
+func listenPair(t *testing.T) (net.Listener, net.Listener, string) {
+	first, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(first.Addr().(*net.TCPAddr).Port)
+	second, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", port))
+	if err != nil {
+		first.Close()
+		t.Skipf("Unable to listen on second loopback address: %s", err)
+	}
+	return first, second, port
+}
+
+func remoteIP(c *TCPConnection) string {
+	return c.Connection.RemoteAddr().(*net.TCPAddr).IP.String()
+}
+
+func TestDialTriesAllAddresses(t *testing.T) {
+	first, second, port := listenPair(t)
+	defer first.Close()
+	second.Close()
+
+	// Nothing is listening on the second address, so the dial should
+	// fail over to the next address
+	resolver := &fakeResolver{}
+	resolver.set("127.0.0.2", "127.0.0.1")
+	c := &TCPConnection{Resolver: resolver}
+	if err := c.Dial(net.JoinHostPort("collector.example.com", port)); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Connection.Close()
+	if remoteIP(c) != "127.0.0.1" {
+		t.Errorf("Expected connection to 127.0.0.1, got %s", remoteIP(c))
+	}
+}
+
+func TestReconnectReresolves(t *testing.T) {
+	first, second, port := listenPair(t)
+	defer second.Close()
+
+	resolver := &fakeResolver{}
+	resolver.set("127.0.0.1")
+	c := &TCPConnection{Resolver: resolver}
+	if err := c.Dial(net.JoinHostPort("collector.example.com", port)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail over the records to the second address and take down the
+	// first
+	first.Close()
+	resolver.set("127.0.0.2")
+	if err := c.reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Connection.Close()
+	if remoteIP(c) != "127.0.0.2" {
+		t.Errorf("Expected connection to 127.0.0.2, got %s", remoteIP(c))
+	}
+}
+
+func TestReconnectPrefersLastAddress(t *testing.T) {
+	first, second, port := listenPair(t)
+	defer first.Close()
+	defer second.Close()
+
+	resolver := &fakeResolver{}
+	resolver.set("127.0.0.2")
+	c := &TCPConnection{Resolver: resolver}
+	if err := c.Dial(net.JoinHostPort("collector.example.com", port)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both addresses are now valid, the last successful one should be
+	// preferred even though it is not first
+	resolver.set("127.0.0.1", "127.0.0.2")
+	if err := c.reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Connection.Close()
+	if remoteIP(c) != "127.0.0.2" {
+		t.Errorf("Expected connection to 127.0.0.2, got %s", remoteIP(c))
+	}
+}
+
+func TestResolveTTLReconnects(t *testing.T) {
+	first, second, port := listenPair(t)
+	defer first.Close()
+	defer second.Close()
+
+	resolver := &fakeResolver{}
+	resolver.set("127.0.0.1")
+	c := (&TCPConnection{
+		Resolver:   resolver,
+		ResolveTTL: 10 * time.Millisecond,
+	}).Initialize()
+	if err := c.Dial(net.JoinHostPort("collector.example.com", port)); err != nil {
+		t.Fatal(err)
+	}
+	resolver.set("127.0.0.2")
+	go c.ListenAndSend()
+
+	// The healthy connection should be moved to the new address once
+	// the TTL expires
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := second.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Error("Connection was not re-established to new address")
+	}
+}
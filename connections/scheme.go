@@ -0,0 +1,184 @@
+package connections
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/journal"
+)
+
+// The schemes of the end points that are built in
+const (
+	// SchemeTCP URL scheme of a TCP end point
+	SchemeTCP = "tcp"
+
+	// SchemeHTTP URL scheme of an HTTP end point
+	SchemeHTTP = "http"
+
+	// SchemeHTTPS URL scheme of an HTTPS end point
+	SchemeHTTPS = "https"
+
+	// SchemeKafka URL scheme of a Kafka end point
+	SchemeKafka = "kafka"
+
+	// SchemeUnix URL scheme of a unix domain socket end point
+	SchemeUnix = "unix"
+)
+
+// SchemeFactory creates the connection of an end point whose address has the
+// scheme for which the factory is registered. The connection is initialized,
+// but not listening, and connected unless `Lazy` is set.
+//
+// If `options` is nil the factory only validates the address, returning an
+// error if it is invalid.
+type SchemeFactory func(u *url.URL, match criteria.Criteria, options *EndpointOptions) (Connection, error)
+
+// EndpointOptions are the options of an end point, from the terms of its
+// specification that apply to every end point. A scheme uses those that apply
+// to it, and parses the terms it registered from `Terms`.
+type EndpointOptions struct {
+	Proxy     *url.URL
+	QueueSize int
+	Budget    *Budget
+	TLSConfig *tls.Config
+	Preamble  []byte
+	Raw       bool
+	Envelope  bool
+	Protobuf  bool
+	Journal   *journal.Journal
+	Compare   *CompareMember
+
+	// Timeout, Retries and Backoff of the requests to HTTP end points,
+	// unless given by their terms
+	Timeout time.Duration
+	Retries int
+	Backoff time.Duration
+
+	// Annotator adds to the metadata of the messages tee-ed to the end
+	// point, i.e. their enrichment
+	Annotator *Annotator
+
+	// Lazy the connection is established when the first message is
+	// delivered, rather than when it is created
+	Lazy bool
+
+	// Background connections that are always established when created,
+	// i.e. both of a standby pair, are established in the background
+	Background bool
+
+	// Durable the connection is the target of a durable end point, so must
+	// be a `Deliverer`, that connects when a message is first delivered,
+	// and need not be initialized
+	Durable bool
+
+	// Terms the terms of the specification registered by the scheme, by
+	// their name, with the values of a repeated term in order
+	Terms url.Values
+}
+
+// TermError is returned by the factory of a scheme for a term of the
+// specification of an end point that is invalid, or conflicts with its
+// options
+type TermError struct {
+	Term string
+	Err  error
+}
+
+func (e *TermError) Error() string {
+	return e.Err.Error()
+}
+
+// scheme a registered scheme
+type scheme struct {
+	factory SchemeFactory
+	terms   []string
+}
+
+var (
+	schemesLock sync.RWMutex
+	schemes     = make(map[string]scheme)
+)
+
+// RegisterScheme registers the factory of the connections of end points whose
+// address has the given scheme. The `terms` are the names of the terms, other
+// than those of every end point, that end points of the scheme accept, which
+// are given to the factory to parse, returning a `TermError` for one that is
+// invalid. Schemes are registered before end points are established, a scheme
+// registered twice panics.
+func RegisterScheme(name string, factory SchemeFactory, terms ...string) {
+	name = strings.ToLower(name)
+	schemesLock.Lock()
+	defer schemesLock.Unlock()
+	if factory == nil {
+		panic("connections: nil factory for scheme " + name)
+	}
+	if _, ok := schemes[name]; ok {
+		panic("connections: scheme " + name + " registered twice")
+	}
+	schemes[name] = scheme{factory: factory, terms: terms}
+}
+
+// Schemes returns the names of the registered schemes, in order
+func Schemes() []string {
+	schemesLock.RLock()
+	defer schemesLock.RUnlock()
+	names := make([]string, 0, len(schemes))
+	for name := range schemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupScheme returns the registered scheme of an address
+func lookupScheme(name string) (scheme, error) {
+	schemesLock.RLock()
+	s, ok := schemes[name]
+	schemesLock.RUnlock()
+	if !ok {
+		return s, fmt.Errorf("unsupported scheme '%s', expected one of '%s'", name, strings.Join(Schemes(), "', '"))
+	}
+	return s, nil
+}
+
+// ValidateAddress returns an error if the address of an end point has a
+// scheme that isn't registered, or is invalid for its scheme
+func ValidateAddress(u *url.URL) error {
+	s, err := lookupScheme(u.Scheme)
+	if err != nil {
+		return err
+	}
+	_, err = s.factory(u, criteria.Criteria{}, nil)
+	return err
+}
+
+// SchemeTerm returns true if end points whose address has the given scheme
+// accept the named term
+func SchemeTerm(name, term string) bool {
+	s, err := lookupScheme(name)
+	if err != nil {
+		return false
+	}
+	for _, t := range s.terms {
+		if t == term {
+			return true
+		}
+	}
+	return false
+}
+
+// NewConnection creates the connection of an end point, by the factory of
+// the scheme of its address
+func NewConnection(u *url.URL, match criteria.Criteria, options *EndpointOptions) (Connection, error) {
+	s, err := lookupScheme(u.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	return s.factory(u, match, options)
+}
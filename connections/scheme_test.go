@@ -0,0 +1,55 @@
+package connections
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/ciena/oftee/criteria"
+)
+
+func TestBuiltInSchemes(t *testing.T) {
+	for _, name := range []string{SchemeHTTP, SchemeHTTPS, SchemeKafka, SchemeTCP, SchemeUnix} {
+		found := false
+		for _, registered := range Schemes() {
+			found = found || registered == name
+		}
+		if !found {
+			t.Errorf("Expected scheme '%s' registered, got %v", name, Schemes())
+		}
+	}
+	if !SchemeTerm(SchemeTCP, "dscp") || SchemeTerm(SchemeKafka, "dscp") || SchemeTerm("udp", "dscp") {
+		t.Error("Expected the dscp term only accepted by TCP end points")
+	}
+}
+
+// The options given to the test scheme's factory
+var testOptions *EndpointOptions
+
+func init() {
+	RegisterScheme("Test", func(u *url.URL, match criteria.Criteria, options *EndpointOptions) (Connection, error) {
+		testOptions = options
+		return (&ShadowConnection{Target: u.String(), Criteria: match}).Initialize(), nil
+	}, "colour")
+}
+
+func TestRegisterScheme(t *testing.T) {
+	u, _ := url.Parse("test://host/path")
+	options := &EndpointOptions{Terms: url.Values{"colour": {"red"}}}
+	c, err := NewConnection(u, criteria.Criteria{}, options)
+	if err != nil || c == nil || testOptions != options {
+		t.Errorf("Expected the connection created with the options, got %v (%v)", c, err)
+	}
+	if err = ValidateAddress(u); err != nil || testOptions != nil {
+		t.Errorf("Expected the address only validated, got %v", err)
+	}
+	if !SchemeTerm("test", "colour") {
+		t.Error("Expected the colour term accepted")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected the scheme registered twice to panic")
+		}
+	}()
+	RegisterScheme("test", newTCPScheme)
+}
@@ -0,0 +1,122 @@
+package connections
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/journal"
+	"github.com/ciena/oftee/spool"
+)
+
+// EndpointStats statistics of the messages matched by an end point and, for
+// an end point with a standby, the state of its connections or, for a durable
+// end point, the state of its spool. For an `https` end point the TLS
+// handshakes are counted, for a `tcp` end point with acknowledged delivery
+// the state of its replay window is included, and for a member of a compare
+// group the state of the group.
+type EndpointStats struct {
+	Endpoint      string            `json:"endpoint"`
+	Shadow        bool              `json:"shadow"`
+	Matches       uint64            `json:"matches"`
+	Bytes         uint64            `json:"bytes"`
+	Dropped       uint64            `json:"dropped,omitempty"`
+	Errors        uint64            `json:"errors,omitempty"`
+	Reconnects    uint64            `json:"reconnects,omitempty"`
+	Retries       uint64            `json:"retries,omitempty"`
+	DeadLettered  uint64            `json:"dead_lettered,omitempty"`
+	Rotations     uint64            `json:"rotations,omitempty"`
+	Active        string            `json:"active,omitempty"`
+	Connections   []ConnectionState `json:"connections,omitempty"`
+	Spool         *spool.Stats      `json:"spool,omitempty"`
+	TLS           *TLSStats         `json:"tls,omitempty"`
+	Ack           *AckStats         `json:"ack,omitempty"`
+	TxnGroup      string            `json:"txn_group,omitempty"`
+	TxnDropped    uint64            `json:"txn_dropped,omitempty"`
+	SampleDropped uint64            `json:"sample_dropped,omitempty"`
+	RateDropped   uint64            `json:"rate_dropped,omitempty"`
+	Journal       *journal.Stats    `json:"journal,omitempty"`
+	Compare       *CompareStats     `json:"compare,omitempty"`
+}
+
+// StatsConnection is implemented by connections that count the messages they
+// match
+type StatsConnection interface {
+	Stats() EndpointStats
+}
+
+// ShadowConnection is an end point that participates in matching, and counts
+// the messages and bytes it matches, but never delivers anything, no
+// connection is ever established. It is used to measure how much traffic a
+// proposed end point would receive before it is pointed at a real consumer.
+type ShadowConnection struct {
+	Target   string
+	Criteria criteria.Criteria
+	queue    chan []byte
+	matches  uint64
+	bytes    uint64
+}
+
+// Initialize makes sure private members, that can't function from zero
+// state, are set correctly
+func (c *ShadowConnection) Initialize() *ShadowConnection {
+	c.queue = make(chan []byte, 100)
+	return c
+}
+
+// GetQueue returns the channel used to queue messages, which are counted
+// and discarded
+func (c *ShadowConnection) GetQueue() chan<- []byte {
+	return c.queue
+}
+
+// ListenAndSend counts and discards queued messages
+func (c *ShadowConnection) ListenAndSend() error {
+	if c.queue == nil {
+		return ErrUninitialized
+	}
+	for message := range c.queue {
+		atomic.AddUint64(&c.matches, 1)
+		atomic.AddUint64(&c.bytes, uint64(len(message)))
+	}
+	return nil
+}
+
+// Match compares the end point's criteria against the given criteria
+func (c *ShadowConnection) Match(state criteria.Criteria) bool {
+	return c.Criteria.Match(state)
+}
+
+// CriteriaBits returns the values the end point matches on
+func (c *ShadowConnection) CriteriaBits() uint64 {
+	return c.Criteria.Bits()
+}
+
+// Stats returns the number of messages, and bytes, matched by the end point
+func (c *ShadowConnection) Stats() EndpointStats {
+	return EndpointStats{
+		Endpoint: c.Target,
+		Shadow:   true,
+		Matches:  atomic.LoadUint64(&c.matches),
+		Bytes:    atomic.LoadUint64(&c.bytes),
+	}
+}
+
+func (c *ShadowConnection) String() string {
+	if c.queue == nil {
+		return fmt.Sprintf("(shadow %s, %d)", c.Target, -1)
+	}
+	return fmt.Sprintf("(shadow %s, %d)", c.Target, len(c.queue))
+}
+
+// Stats returns the statistics of the end points that count the messages
+// they match
+func (eps Endpoints) Stats() []EndpointStats {
+	stats := make([]EndpointStats, 0, len(eps))
+	for _, conn := range eps {
+		if counted, ok := conn.(StatsConnection); ok {
+			stats = append(stats, counted.Stats())
+		}
+	}
+	return stats
+}
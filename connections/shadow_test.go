@@ -0,0 +1,34 @@
+package connections
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/criteria"
+)
+
+func TestShadowConnectionCounts(t *testing.T) {
+	shadow := (&ShadowConnection{
+		Target:   "tcp://consumer:9000",
+		Criteria: criteria.Criteria{Set: criteria.BitDLType, DlType: 0x888e},
+	}).Initialize()
+	go shadow.ListenAndSend()
+
+	eps := Endpoints{shadow}
+	eps.ConditionalWrite(context.Background(), make([]byte, 100), criteria.Criteria{Set: criteria.BitDLType, DlType: 0x888e})
+	eps.ConditionalWrite(context.Background(), make([]byte, 50), criteria.Criteria{Set: criteria.BitDLType, DlType: 0x888e})
+	eps.ConditionalWrite(context.Background(), make([]byte, 70), criteria.Criteria{Set: criteria.BitDLType, DlType: 0x0806})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for shadow.Stats().Matches != 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	stats := eps.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("Expected stats for 1 end point, got %d", len(stats))
+	}
+	if !stats[0].Shadow || stats[0].Matches != 2 || stats[0].Bytes != 150 || stats[0].Endpoint != "tcp://consumer:9000" {
+		t.Errorf("Incorrect shadow end point stats, got %+v", stats[0])
+	}
+}
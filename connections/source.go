@@ -0,0 +1,35 @@
+package connections
+
+import (
+	"fmt"
+	"net"
+)
+
+// ParseSourceAddr converts a source address specification, an IP address,
+// into an address that can be used to bind the local side of an outbound
+// connection. The port is always left as 0 so that the kernel assigns an
+// ephemeral port. An error is returned if the value is not an IP address or
+// if the address is not assigned to any local interface.
+func ParseSourceAddr(value string) (net.Addr, error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source address '%s', expected an IP address", value)
+	}
+	if !ip.IsUnspecified() {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("source address '%s' is not assigned to a local interface", value)
+		}
+	}
+	return &net.TCPAddr{IP: ip}, nil
+}
@@ -0,0 +1,49 @@
+package connections
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseSourceAddr(t *testing.T) {
+	addr, err := ParseSourceAddr("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcp, ok := addr.(*net.TCPAddr); !ok || !tcp.IP.Equal(net.IPv4(127, 0, 0, 1)) || tcp.Port != 0 {
+		t.Errorf("Incorrect source address, expected 127.0.0.1:0, got %s", addr)
+	}
+}
+
+func TestParseBadSourceAddr(t *testing.T) {
+	// 192.0.2.0/24 is reserved for documentation, so should never be
+	// assigned to a local interface
+	for _, value := range []string{"", "localhost", "127.0.0.1:80", "192.0.2.1"} {
+		if _, err := ParseSourceAddr(value); err == nil {
+			t.Errorf("Expected error parsing '%s'", value)
+		}
+	}
+}
+
+func TestDialBindsSourceAddr(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	source, err := ParseSourceAddr("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &TCPConnection{LocalAddr: source}
+	if err = c.Dial(listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Connection.Close()
+
+	local := c.Connection.LocalAddr().(*net.TCPAddr)
+	if !local.IP.Equal(source.(*net.TCPAddr).IP) {
+		t.Errorf("Connection not bound to source address, expected %s, got %s", source, local)
+	}
+}
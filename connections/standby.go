@@ -0,0 +1,391 @@
+package connections
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/journal"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultFailback how long a primary connection must have been healthy before
+// delivery fails back to it from the standby
+const DefaultFailback = 30 * time.Second
+
+// Roles and states of the connections of a standby pair. An end point as a
+// whole is either connected or connecting, see `StateConnection`.
+const (
+	RolePrimary = "primary"
+	RoleStandby = "standby"
+
+	StateConnected    = "connected"
+	StateDisconnected = "disconnected"
+	StateConnecting   = "connecting"
+)
+
+// ConnectionState the state of one of the connections of an end point
+type ConnectionState struct {
+	Role     string    `json:"role"`
+	Address  string    `json:"address"`
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	Messages uint64    `json:"messages"`
+	Failures uint64    `json:"failures"`
+}
+
+// link is one of the connections of a standby pair. The connection is
+// replaced, under the lock, when it is re-established after a failure.
+type link struct {
+	role     string
+	address  string
+	dialer   *TCPConnection
+	lock     sync.Mutex
+	conn     net.Conn
+	since    time.Time
+	messages uint64
+	failures uint64
+}
+
+// dial establishes the connection, watching it so that a failure is noticed
+// even while it is idle
+func (l *link) dial() error {
+	if err := l.dialer.Dial(l.address); err != nil {
+		return err
+	}
+	l.lock.Lock()
+	l.conn = l.dialer.Connection
+	l.since = time.Now()
+	l.lock.Unlock()
+	go l.watch(l.dialer.Connection)
+	return nil
+}
+
+// redial re-establishes the connection, retrying every
+// `OnDemandRetryInterval` until it succeeds
+func (l *link) redial() {
+	for {
+		time.Sleep(OnDemandRetryInterval)
+		err := l.dial()
+		if err == nil {
+			log.
+				WithFields(log.Fields{
+					"role":    l.role,
+					"address": l.address,
+				}).
+				Info("Re-established end point connection")
+			return
+		}
+		log.
+			WithFields(log.Fields{
+				"role":    l.role,
+				"address": l.address,
+			}).
+			WithError(err).
+			Debug("Unable to re-establish end point connection")
+	}
+}
+
+// watch reads, and discards, anything sent by the end point so that the
+// connection being closed is noticed without waiting for a write to fail
+func (l *link) watch(conn net.Conn) {
+	buf := make([]byte, 512)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			l.fail(conn, err)
+			return
+		}
+	}
+}
+
+// fail marks the connection as failed, if it hasn't already been replaced,
+// and starts re-establishing it in the background
+func (l *link) fail(conn net.Conn, err error) {
+	l.lock.Lock()
+	if l.conn != conn {
+		l.lock.Unlock()
+		return
+	}
+	l.conn = nil
+	l.since = time.Now()
+	l.failures++
+	l.lock.Unlock()
+
+	if closeErr := conn.Close(); closeErr != nil {
+		log.
+			WithError(closeErr).
+			Debug("Error while closing failed end point connection")
+	}
+	log.
+		WithFields(log.Fields{
+			"role":    l.role,
+			"address": l.address,
+		}).
+		WithError(err).
+		Warn("End point connection failed, re-establishing")
+	go l.redial()
+}
+
+// current returns the connection and how long it has been established, or
+// nil if it is not
+func (l *link) current() (net.Conn, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.conn == nil {
+		return nil, 0
+	}
+	return l.conn, time.Since(l.since)
+}
+
+// write writes the message to the connection, if established
+func (l *link) write(message []byte) bool {
+	conn, _ := l.current()
+	if conn == nil {
+		return false
+	}
+	if _, err := WriteFull(conn, message); err != nil {
+		l.fail(conn, err)
+		return false
+	}
+	atomic.AddUint64(&l.messages, 1)
+	return true
+}
+
+// state returns the state of the connection
+func (l *link) state() ConnectionState {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	state := ConnectionState{
+		Role:     l.role,
+		Address:  l.address,
+		State:    StateDisconnected,
+		Since:    l.since,
+		Messages: atomic.LoadUint64(&l.messages),
+		Failures: l.failures,
+	}
+	if l.conn != nil {
+		state.State = StateConnected
+	}
+	return state
+}
+
+// StandbyConnection is a TCP end point with a warm standby. Both the primary
+// and the standby connections are kept established, the standby idle. When a
+// write to the primary fails the message, and those that follow, are written
+// to the standby without delay while the primary is re-established in the
+// background. Delivery fails back to the primary once it has been
+// established for `Failback`.
+//
+// `Primary` and `Standby` are used to dial their respective addresses, so
+// their `LocalAddr`, `DSCP`, `Proxy` and `Resolver` apply, but they are not
+// otherwise used, i.e. they should not be initialized.
+//
+// Messages written to a connection just before it failed, that the end point
+// never read, are lost. Messages are dropped and counted only while neither
+// connection is established.
+//
+// If a `Journal` is set each message written to either connection is
+// recorded to it, as it is to the compare group of the end point if
+// `Compare` is set.
+type StandbyConnection struct {
+	Criteria       criteria.Criteria
+	Primary        *TCPConnection
+	PrimaryAddress string
+	Standby        *TCPConnection
+	StandbyAddress string
+	Failback       time.Duration
+	QueueSize      int
+	Budget         *Budget
+	Journal        *journal.Journal
+	Compare        *CompareMember
+	queue          chan []byte
+	input          chan<- []byte
+	primary        *link
+	standby        *link
+	onStandby      int32
+	matches        uint64
+	bytes          uint64
+	dropped        uint64
+}
+
+// Initialize makes sure private members, that can't function from zero
+// state, are set correctly
+func (c *StandbyConnection) Initialize() *StandbyConnection {
+	if c.Failback <= 0 {
+		c.Failback = DefaultFailback
+	}
+	c.queue = queueOf(c.QueueSize)
+	c.input = c.queue
+	if c.Budget != nil {
+		c.input = c.Budget.Track(c.queue, 1)
+	}
+	c.primary = &link{role: RolePrimary, address: c.PrimaryAddress, dialer: c.Primary}
+	c.standby = &link{role: RoleStandby, address: c.StandbyAddress, dialer: c.Standby}
+	return c
+}
+
+// Dial establishes both connections. The end point is unusable without its
+// primary, so an error establishing it is returned, while the standby is
+// re-established in the background.
+func (c *StandbyConnection) Dial() error {
+	if err := c.primary.dial(); err != nil {
+		return err
+	}
+	if err := c.standby.dial(); err != nil {
+		log.
+			WithFields(log.Fields{
+				"address": c.StandbyAddress,
+			}).
+			WithError(err).
+			Warn("Unable to establish standby end point connection, retrying in the background")
+		go c.standby.redial()
+	}
+	return nil
+}
+
+// DialInBackground establishes both connections in the background, messages
+// are dropped, and counted, until one of them is established
+func (c *StandbyConnection) DialInBackground() {
+	go c.primary.redial()
+	go c.standby.redial()
+}
+
+// GetQueue returns the channel used to queue messages up for delivery
+func (c *StandbyConnection) GetQueue() chan<- []byte {
+	return c.input
+}
+
+// ListenAndSend listens for and processes messages to the target end point
+// over the active connection
+func (c *StandbyConnection) ListenAndSend() error {
+	if c.queue == nil {
+		log.
+			WithError(ErrUninitialized).
+			Error("MUST initialize connection before use")
+		return ErrUninitialized
+	}
+	for message := range c.queue {
+		atomic.AddUint64(&c.matches, 1)
+		atomic.AddUint64(&c.bytes, uint64(len(message)))
+		c.send(message)
+		c.Budget.Done()
+	}
+	return nil
+}
+
+// send writes a message to the active connection, failing over to the other
+// connection if the write fails
+func (c *StandbyConnection) send(message []byte) {
+	first, second := c.primary, c.standby
+	if atomic.LoadInt32(&c.onStandby) == 1 {
+		if conn, healthy := c.primary.current(); conn != nil && healthy >= c.Failback {
+			atomic.StoreInt32(&c.onStandby, 0)
+			log.
+				WithFields(log.Fields{
+					"primary": c.PrimaryAddress,
+				}).
+				Info("Primary end point connection healthy, failing back")
+		} else {
+			first, second = c.standby, c.primary
+		}
+	}
+
+	if first.write(message) {
+		c.Journal.Record(message)
+		c.Compare.Record(message)
+		return
+	}
+	if second.write(message) {
+		c.Journal.Record(message)
+		c.Compare.Record(message)
+		if second == c.primary {
+			atomic.StoreInt32(&c.onStandby, 0)
+			return
+		}
+		atomic.StoreInt32(&c.onStandby, 1)
+		log.
+			WithFields(log.Fields{
+				"primary": c.PrimaryAddress,
+				"standby": c.StandbyAddress,
+			}).
+			Warn("Primary end point connection unavailable, failed over to standby")
+		return
+	}
+	atomic.AddUint64(&c.dropped, 1)
+	log.
+		WithFields(log.Fields{
+			"primary": c.PrimaryAddress,
+			"standby": c.StandbyAddress,
+		}).
+		Debug("No end point connection established, dropping message")
+}
+
+// Healthy returns false while neither connection is established, when a
+// message queued now would be dropped
+func (c *StandbyConnection) Healthy() bool {
+	if conn, _ := c.primary.current(); conn != nil {
+		return true
+	}
+	conn, _ := c.standby.current()
+	return conn != nil
+}
+
+// dropOldest makes room in the full queue of the end point by dropping the
+// oldest message queued
+func (c *StandbyConnection) dropOldest() bool {
+	return dropOldest(c.queue, c.Budget, &c.dropped)
+}
+
+// Dropped returns the number of messages dropped because neither connection
+// was established, or to make room in its full queue
+func (c *StandbyConnection) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// Match compares the end point's criteria against the given criteria
+func (c *StandbyConnection) Match(state criteria.Criteria) bool {
+	return c.Criteria.Match(state)
+}
+
+// CriteriaBits returns the values the end point matches on
+func (c *StandbyConnection) CriteriaBits() uint64 {
+	return c.Criteria.Bits()
+}
+
+// Stats returns the number of messages, and bytes, matched by the end point
+// and the state of both of its connections
+func (c *StandbyConnection) Stats() EndpointStats {
+	active := RolePrimary
+	if atomic.LoadInt32(&c.onStandby) == 1 {
+		active = RoleStandby
+	}
+	return EndpointStats{
+		Endpoint:    c.PrimaryAddress,
+		Matches:     atomic.LoadUint64(&c.matches),
+		Bytes:       atomic.LoadUint64(&c.bytes),
+		Dropped:     c.Dropped(),
+		Active:      active,
+		Connections: []ConnectionState{c.primary.state(), c.standby.state()},
+		Journal:     c.Journal.Stats(),
+		Compare:     c.Compare.Stats(),
+	}
+}
+
+// State returns whether the end point is connected, which it is while
+// either of its connections is established
+func (c *StandbyConnection) State() string {
+	if c.primary.state().State == StateConnected || c.standby.state().State == StateConnected {
+		return StateConnected
+	}
+	return StateConnecting
+}
+
+func (c *StandbyConnection) String() string {
+	if c.queue == nil {
+		return fmt.Sprintf("(%s, standby %s, %d)", c.PrimaryAddress, c.StandbyAddress, -1)
+	}
+	return fmt.Sprintf("(%s, standby %s, %d)", c.PrimaryAddress, c.StandbyAddress, len(c.queue))
+}
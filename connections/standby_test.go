@@ -0,0 +1,147 @@
+package connections
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// collect reads 4 byte sequence numbers from each connection accepted by the
+// listener and sends them on the given channel. The first connection is
+// closed once `kill` sequence numbers have been read from it.
+func collect(listener net.Listener, kill int, received chan<- uint32) {
+	for first := true; ; first = false {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		limit := 0
+		if first {
+			limit = kill
+		}
+		go func(conn net.Conn, limit int) {
+			defer conn.Close()
+			buf := make([]byte, 4)
+			for n := 0; limit == 0 || n < limit; n++ {
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				received <- binary.BigEndian.Uint32(buf)
+			}
+		}(conn, limit)
+	}
+}
+
+func TestStandbyFailover(t *testing.T) {
+	primary, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	standby, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer standby.Close()
+
+	// The primary is killed after 10 messages
+	onPrimary := make(chan uint32, 1000)
+	onStandby := make(chan uint32, 1000)
+	go collect(primary, 10, onPrimary)
+	go collect(standby, 0, onStandby)
+
+	c := (&StandbyConnection{
+		Primary:        &TCPConnection{},
+		PrimaryAddress: primary.Addr().String(),
+		Standby:        &TCPConnection{},
+		StandbyAddress: standby.Addr().String(),
+		Failback:       200 * time.Millisecond,
+	}).Initialize()
+	if err = c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	go c.ListenAndSend()
+
+	send := func(from, to uint32) {
+		for seq := from; seq < to; seq++ {
+			message := make([]byte, 4)
+			binary.BigEndian.PutUint32(message, seq)
+			c.GetQueue() <- message
+			time.Sleep(2 * time.Millisecond)
+		}
+	}
+	send(0, 50)
+
+	// At most the message in flight when the primary was killed is lost
+	seen := make(map[uint32]bool)
+	timeout := time.After(2 * time.Second)
+receive:
+	for len(seen) < 50 {
+		select {
+		case seq := <-onPrimary:
+			seen[seq] = true
+		case seq := <-onStandby:
+			seen[seq] = true
+		case <-timeout:
+			break receive
+		}
+	}
+	if len(seen) < 49 {
+		t.Fatalf("Expected at least 49 of 50 messages delivered, got %d", len(seen))
+	}
+	stats := c.Stats()
+	if stats.Active != RoleStandby || len(stats.Connections) != 2 || stats.Connections[0].Failures != 1 ||
+		stats.Connections[1].State != StateConnected {
+		t.Errorf("Expected delivery failed over to standby, got %+v", stats)
+	}
+
+	// Once the primary is re-established, and healthy for the failback
+	// period, delivery fails back to it
+	time.Sleep(OnDemandRetryInterval + 2*c.Failback)
+	send(50, 60)
+	for i := 0; i < 10; i++ {
+		select {
+		case seq := <-onPrimary:
+			if seq < 50 {
+				i--
+			}
+		case seq := <-onStandby:
+			t.Fatalf("Expected delivery failed back to primary, got %d on standby", seq)
+		case <-time.After(2 * time.Second):
+			t.Fatal("Messages not delivered after failing back")
+		}
+	}
+	if stats = c.Stats(); stats.Active != RolePrimary || stats.Connections[0].State != StateConnected {
+		t.Errorf("Expected delivery failed back to primary, got %+v", stats)
+	}
+}
+
+func TestStandbyUnavailable(t *testing.T) {
+	primary, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+
+	// Nothing is listening on the standby address
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	c := (&StandbyConnection{
+		Primary:        &TCPConnection{},
+		PrimaryAddress: primary.Addr().String(),
+		Standby:        &TCPConnection{},
+		StandbyAddress: closed.Addr().String(),
+	}).Initialize()
+	if err = c.Dial(); err != nil {
+		t.Fatalf("Expected primary to be established without its standby, got %v", err)
+	}
+	if state := c.Stats().Connections[1]; state.State != StateDisconnected {
+		t.Errorf("Expected standby disconnected, got %+v", state)
+	}
+}
@@ -1,32 +1,651 @@
 package connections
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/journal"
 	log "github.com/sirupsen/logrus"
 )
 
 // TCPConnection is the TCP based connection implementation. The connection is
 // represented as a net.Conn
+//
+// The end point's host name is resolved each time the connection is dialed
+// and each of the resolved addresses is tried in turn, starting with the
+// address of the last successful connection. If `ResolveTTL` is set the host
+// name is also periodically re-resolved while the connection is healthy and
+// the connection is re-established if its address is no longer included in
+// the resolved addresses.
+//
+// If a `Proxy` is set the connection is established via that proxy, which is
+// then responsible for resolving the end point's host name.
+//
+// If a `Preamble` is set it is written each time the connection is
+// established, before any message, see `Preamble.Encode`. If it can't be
+// written the connection is closed and is not established.
+//
+// A connection created with `DialOnDemand` is not established until the first
+// message is queued for delivery. Until the connection is established, and
+// while it can't be re-established, messages are dropped and counted.
+//
+// If a write fails, and the connection can't be re-established at once, the
+// end point is unhealthy and its delivery loop re-establishes the connection
+// in the background, waiting `TCPReconnectBackoff`, with jitter, doubling up
+// to `TCPReconnectMaxBackoff` after each failed attempt. Messages queued in
+// between attempts are dropped and counted, and the count logged at most once
+// per `TCPDropLogInterval`.
+//
+// If a `Budget` is set the latency budget is enforced on the messages queued
+// for delivery.
+//
+// If `Ack` is set delivery is acknowledged by the consumer, see `AckConsumer`,
+// and up to `AckWindow` unacknowledged messages are retransmitted when the
+// connection is re-established.
+//
+// If `Protobuf` is set each message, a packet in, is written encoded as a
+// `proto.PacketIn`, prefixed by its length as 4 bytes in network order, and
+// if `Envelope` is set each message is written wrapped in a JSON envelope,
+// see `Envelope`, prefixed the same way. Neither can be combined with `Ack`.
+// `Raw` is set if the messages are raw packets, without a context. If an
+// `Annotator` is set it adds to the metadata of each message encoded.
+//
+// If a `Journal` is set each message written to the end point is recorded to
+// it, without the sequence number of acknowledged delivery. If `Compare` is
+// set each message is also recorded to the compare group of the end point,
+// but not again as it is retransmitted.
+//
+// The messages queued by the device connections sharing the end point are
+// written by its one delivery loop, `ListenAndSend`, in turn. Writes are also
+// serialized, so a message written via `Write` while another is being
+// written, even in more than one part after a short write, is not interleaved
+// with it on the stream.
 type TCPConnection struct {
 	Connection net.Conn
 	Criteria   criteria.Criteria
+	LocalAddr  net.Addr
+	DSCP       int
+	Proxy      *url.URL
+	Resolver   Resolver
+	ResolveTTL time.Duration
+	Budget     *Budget
+	Ack        bool
+	AckWindow  int
+	QueueSize  int
+	Preamble   []byte
+	Protobuf   bool
+	Envelope   bool
+	Raw        bool
+	Journal    *journal.Journal
+	Compare    *CompareMember
+	Annotator  *Annotator
+	network    string
 	queue      chan []byte
+	input      chan<- []byte
+	address    string
+	preferred  net.IP
+	lastDial   time.Time
+	failed     int64
+	connected  int32
+	dropped    uint64
+	matches    uint64
+	bytes      uint64
+	window     *replayWindow
+	broken     chan net.Conn
+	errors     uint64
+	reconnects uint64
+	delivering int32
+	retrying   int32
+	backoff    time.Duration
+	logged     time.Time
+	unlogged   uint64
+	stop       chan struct{}
+	closing    sync.Once
+	writing    sync.Mutex
+}
+
+// OnDemandRetryInterval is the minimum interval between attempts to establish
+// an on demand connection, messages queued in between attempts are dropped
+const OnDemandRetryInterval = time.Second
+
+const (
+	// TCPReconnectBackoff delay before the first attempt to re-establish
+	// a broken end point connection in the background
+	TCPReconnectBackoff = 250 * time.Millisecond
+
+	// TCPReconnectMaxBackoff maximum delay between attempts to
+	// re-establish a broken end point connection
+	TCPReconnectMaxBackoff = 30 * time.Second
+
+	// TCPDropLogInterval minimum interval between logs of the messages
+	// dropped while a broken end point connection is re-established
+	TCPDropLogInterval = 10 * time.Second
+)
+
+// Tracks the addresses for which a DSCP marking failure has been reported,
+// so that the warning is only logged once per address
+var dscpWarnings sync.Map
+
+func init() {
+	RegisterScheme(SchemeTCP, newTCPScheme,
+		"dscp", "source", "resolve_ttl", "ack", "ack_window", "preamble", "standby", "failback", "queue", "encode")
+}
+
+// tcpTerms the options of a TCP, or unix domain socket, end point given by
+// the terms registered by its scheme
+type tcpTerms struct {
+	localAddr  net.Addr
+	dscp       int
+	resolveTTL time.Duration
+	ack        bool
+	ackWindow  int
+	standby    string
+	failback   time.Duration
+}
+
+// parseTCPTerms parses the terms of a TCP, or unix domain socket, end point,
+// which only has those its scheme registered. A `TermError` is returned for a
+// term that is invalid, or conflicts with the options of the end point.
+func parseTCPTerms(options *EndpointOptions) (tcpTerms, error) {
+	var parsed tcpTerms
+	var err error
+	if value := options.Terms.Get("dscp"); value != "" {
+		if parsed.dscp, err = ParseDSCP(value); err != nil {
+			return parsed, &TermError{"dscp", err}
+		}
+	}
+	if value := options.Terms.Get("source"); value != "" {
+		if parsed.localAddr, err = ParseSourceAddr(value); err != nil {
+			return parsed, &TermError{"source", err}
+		}
+	}
+	if value := options.Terms.Get("resolve_ttl"); value != "" {
+		if parsed.resolveTTL, err = time.ParseDuration(value); err != nil {
+			return parsed, &TermError{"resolve_ttl", err}
+		}
+	}
+	if value := options.Terms.Get("ack"); value != "" {
+		if parsed.ack, err = strconv.ParseBool(value); err != nil {
+			return parsed, &TermError{"ack", err}
+		}
+	}
+	if value := options.Terms.Get("ack_window"); value != "" {
+		if parsed.ackWindow, err = strconv.Atoi(value); err != nil || parsed.ackWindow < 1 {
+			return parsed, &TermError{"ack_window", fmt.Errorf("Invalid acknowledgment window '%s'", value)}
+		}
+	}
+	if value := options.Terms.Get("standby"); value != "" {
+		if _, _, err = net.SplitHostPort(value); err != nil {
+			return parsed, &TermError{"standby", err}
+		}
+		parsed.standby = value
+	}
+	if value := options.Terms.Get("failback"); value != "" {
+		if parsed.failback, err = time.ParseDuration(value); err != nil || parsed.failback <= 0 {
+			return parsed, &TermError{"failback", fmt.Errorf("Invalid failback '%s'", value)}
+		}
+	}
+
+	// A durable end point delivers from its spool over a single
+	// connection, and an acknowledged one keeps its own replay window, and
+	// its consumer frames messages by their OpenFlow header
+	if parsed.standby != "" && options.Durable {
+		return parsed, &TermError{"standby", errors.New("a durable end point can't have a standby")}
+	}
+	if parsed.ack {
+		if options.Durable {
+			return parsed, &TermError{"ack", errors.New("a durable end point can't use acknowledgments")}
+		}
+		if parsed.standby != "" {
+			return parsed, &TermError{"ack", errors.New("an acknowledged end point can't have a standby")}
+		}
+		if options.Raw {
+			return parsed, &TermError{"ack", errors.New("acknowledgments can't be used with raw packets, TEE_RAW")}
+		}
+	}
+	return parsed, nil
+}
+
+// newTCPScheme creates the connection to a TCP end point, of the form
+// `tcp://host:port`, or the pair of connections if it has a standby
+func newTCPScheme(u *url.URL, match criteria.Criteria, options *EndpointOptions) (Connection, error) {
+	if _, port, err := net.SplitHostPort(u.Host); err != nil || port == "" {
+		return nil, fmt.Errorf("invalid address '%s', expected tcp://host:port", u)
+	}
+	if options == nil {
+		return nil, nil
+	}
+	terms, err := parseTCPTerms(options)
+	if err != nil {
+		return nil, err
+	}
+
+	// The end point frames its envelopes and protocol buffers itself, so
+	// neither acknowledges them nor shares its stream with a standby
+	if (options.Envelope || options.Protobuf) && (terms.ack || terms.standby != "") {
+		return nil, &TermError{"encode",
+			errors.New("a tcp end point encoded as json, or protocol buffers, can't be acknowledged, or have a standby")}
+	}
+	if options.Durable {
+		// Only ever delivered to, so connected on demand
+		c := &TCPConnection{
+			LocalAddr: terms.localAddr,
+			DSCP:      terms.dscp,
+			Proxy:     options.Proxy,
+			Preamble:  options.Preamble,
+			Protobuf:  options.Protobuf,
+			Envelope:  options.Envelope,
+			Raw:       options.Raw,
+			Journal:   options.Journal,
+			Compare:   options.Compare,
+			Annotator: options.Annotator,
+		}
+		return c, c.DialOnDemand(u.Host)
+	}
+	if terms.standby != "" {
+		pair := (&StandbyConnection{
+			Criteria: match,
+			Primary: &TCPConnection{
+				LocalAddr: terms.localAddr,
+				DSCP:      terms.dscp,
+				Proxy:     options.Proxy,
+				Preamble:  options.Preamble,
+			},
+			PrimaryAddress: u.Host,
+			Standby: &TCPConnection{
+				LocalAddr: terms.localAddr,
+				DSCP:      terms.dscp,
+				Proxy:     options.Proxy,
+				Preamble:  options.Preamble,
+			},
+			StandbyAddress: terms.standby,
+			Failback:       terms.failback,
+			QueueSize:      options.QueueSize,
+			Budget:         options.Budget,
+			Journal:        options.Journal,
+			Compare:        options.Compare,
+		}).Initialize()
+		if options.Background {
+			pair.DialInBackground()
+			return pair, nil
+		}
+		return pair, pair.Dial()
+	}
+	c := (&TCPConnection{
+		Criteria:   match,
+		LocalAddr:  terms.localAddr,
+		DSCP:       terms.dscp,
+		Proxy:      options.Proxy,
+		ResolveTTL: terms.resolveTTL,
+		Budget:     options.Budget,
+		Ack:        terms.ack,
+		AckWindow:  terms.ackWindow,
+		QueueSize:  options.QueueSize,
+		Preamble:   options.Preamble,
+		Protobuf:   options.Protobuf,
+		Envelope:   options.Envelope,
+		Raw:        options.Raw,
+		Journal:    options.Journal,
+		Compare:    options.Compare,
+		Annotator:  options.Annotator,
+	}).Initialize()
+	if options.Lazy {
+		return c, c.DialOnDemand(u.Host)
+	}
+	return c, c.Dial(u.Host)
 }
 
 // Initialize makes sure priviate members, that can't function from
 // zero state, are set correctly
 func (c *TCPConnection) Initialize() *TCPConnection {
-	c.queue = make(chan []byte, 100)
+	c.queue = queueOf(c.QueueSize)
+	c.input = c.queue
+	c.stop = make(chan struct{})
+	if c.Budget != nil {
+		c.input = c.Budget.Track(c.queue, 1)
+	}
+	if c.Ack {
+		if c.AckWindow < 1 {
+			c.AckWindow = DefaultAckWindow
+		}
+		c.window = newReplayWindow(c.AckWindow)
+		c.broken = make(chan net.Conn)
+	}
 	return c
 }
 
+// Dial establishes the connection to the given address, of the form
+// `host:port`, or the path of the socket of a `UnixConnection`. If a `LocalAddr` is set then the local side of the connection
+// is bound to that address, so that the traffic leaves via the associated
+// interface.
+func (c *TCPConnection) Dial(address string) error {
+	err := c.dial(address)
+	if err != nil {
+		atomic.StoreInt64(&c.failed, time.Now().UnixNano())
+		atomic.StoreInt32(&c.connected, 0)
+	} else {
+		atomic.StoreInt64(&c.failed, 0)
+	}
+	return err
+}
+
+// dial establishes the connection, see `Dial`
+func (c *TCPConnection) dial(address string) error {
+	if c.network == networkUnix {
+		c.address = address
+		conn, err := net.Dial(networkUnix, address)
+		if err != nil {
+			return err
+		}
+		return c.established(conn)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	c.address = address
+	if c.Proxy != nil {
+		conn, err := dialProxy(c.Proxy, c.LocalAddr, address)
+		if err != nil {
+			return err
+		}
+		return c.established(conn)
+	}
+	ips, err := resolve(c.Resolver, host, c.preferred)
+	if err != nil {
+		return err
+	}
+
+	// Try each address in turn, the first to connect wins
+	dialer := net.Dialer{LocalAddr: c.LocalAddr}
+	for _, ip := range ips {
+		target := address
+		if ip != nil {
+			target = net.JoinHostPort(ip.String(), port)
+		}
+		var conn net.Conn
+		if conn, err = dialer.Dial("tcp", target); err == nil {
+			c.preferred = ip
+			return c.established(conn)
+		}
+		log.
+			WithFields(log.Fields{
+				"address": address,
+				"target":  target,
+			}).
+			WithError(err).
+			Debug("Unable to connect to resolved address")
+	}
+	return err
+}
+
+// established makes a newly established connection the connection of the
+// end point, after writing the preamble, if any
+func (c *TCPConnection) established(conn net.Conn) error {
+	if len(c.Preamble) > 0 {
+		if _, err := WriteFull(conn, c.Preamble); err != nil {
+			if closeErr := conn.Close(); closeErr != nil {
+				log.
+					WithError(closeErr).
+					Debug("Error while closing connection after failing to write preamble")
+			}
+			return err
+		}
+	}
+	c.Connection = conn
+	atomic.StoreInt32(&c.connected, 1)
+	c.markDSCP()
+	c.watchAcks()
+	return nil
+}
+
+// DialOnDemand records the address, of the form `host:port`, or the path of
+// a socket, of the end point without establishing the connection. The connection is established
+// by `ListenAndSend` when the first message is queued for delivery.
+func (c *TCPConnection) DialOnDemand(address string) error {
+	if c.network != networkUnix {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return err
+		}
+	}
+	c.address = address
+	return nil
+}
+
+// Dropped returns the number of messages dropped because the connection
+// could not be established or, with acknowledged delivery, because the
+// replay window was full
+func (c *TCPConnection) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// Healthy returns false if a message queued now would be dropped, i.e. with
+// acknowledged delivery while the replay window is full, otherwise while a
+// broken connection is re-established in the background or the last attempt
+// to establish the connection failed less than `OnDemandRetryInterval` ago
+func (c *TCPConnection) Healthy() bool {
+	if c.window != nil {
+		return !c.window.full()
+	}
+	if atomic.LoadInt32(&c.retrying) == 1 {
+		return false
+	}
+	failed := atomic.LoadInt64(&c.failed)
+	return failed == 0 || time.Since(time.Unix(0, failed)) >= OnDemandRetryInterval
+}
+
+// State returns whether the connection of the end point is established, an
+// end point connected on demand is connecting until it is first needed
+func (c *TCPConnection) State() string {
+	if atomic.LoadInt32(&c.connected) == 1 {
+		return StateConnected
+	}
+	return StateConnecting
+}
+
+// watchAcks starts reading the acknowledgments from a newly established
+// connection of an end point with acknowledged delivery
+func (c *TCPConnection) watchAcks() {
+	if c.window != nil {
+		go c.readAcks(c.Connection)
+	}
+}
+
+// markDSCP applies the configured DSCP marking to the connection. As the
+// marking is an optimization a failure is logged, once per address, and
+// otherwise ignored.
+func (c *TCPConnection) markDSCP() {
+	if c.DSCP == 0 {
+		return
+	}
+	if err := MarkDSCP(c.Connection, c.DSCP); err != nil {
+		if _, warned := dscpWarnings.LoadOrStore(c.address, true); !warned {
+			log.
+				WithFields(log.Fields{
+					"address": c.address,
+					"dscp":    c.DSCP,
+				}).
+				WithError(err).
+				Warn("Unable to set DSCP marking on connection, continuing unmarked")
+		}
+	}
+}
+
+// reconnect closes the current connection, if any, and dials the end point
+// again, re-resolving its host name. With acknowledged delivery the
+// unacknowledged messages are retransmitted.
+func (c *TCPConnection) reconnect() error {
+	atomic.AddUint64(&c.reconnects, 1)
+	if c.Connection != nil {
+		if err := c.Connection.Close(); err != nil {
+			log.
+				WithError(err).
+				Debug("Error while closing connection before reconnect")
+		}
+	}
+	if err := c.Dial(c.address); err != nil {
+		return err
+	}
+	if c.window != nil {
+		return c.replay()
+	}
+	return nil
+}
+
+// retryAfter marks the end point unhealthy and returns when the next attempt
+// to re-establish its connection is due, after the current backoff less up to
+// half of it, so that the end points broken together don't retry together
+func (c *TCPConnection) retryAfter() <-chan time.Time {
+	if c.backoff == 0 {
+		c.backoff = TCPReconnectBackoff
+	}
+	delay := c.backoff - time.Duration(rand.Int63n(int64(c.backoff/2)+1))
+	if c.backoff *= 2; c.backoff > TCPReconnectMaxBackoff {
+		c.backoff = TCPReconnectMaxBackoff
+	}
+	atomic.StoreInt32(&c.retrying, 1)
+	return time.After(delay)
+}
+
+// recovered resets the backoff once the connection of the end point is
+// re-established, and marks the end point healthy
+func (c *TCPConnection) recovered() {
+	c.backoff = 0
+	atomic.StoreInt32(&c.retrying, 0)
+}
+
+// broke closes the broken connection of the end point and returns when the
+// first attempt to re-establish it is due
+func (c *TCPConnection) broke() <-chan time.Time {
+	if c.Connection != nil {
+		if err := c.Connection.Close(); err != nil {
+			log.
+				WithError(err).
+				Debug("Error while closing broken connection")
+		}
+	}
+	c.Connection = nil
+	atomic.StoreInt32(&c.connected, 0)
+	c.logged = time.Now()
+	c.unlogged = 0
+	retry := c.retryAfter()
+	log.
+		WithFields(log.Fields{
+			"address": c.address,
+		}).
+		Warn("End point connection broken, re-establishing in the background")
+	return retry
+}
+
+// retryConnect attempts to re-establish the broken connection of the end
+// point, returning when the next attempt is due if it fails
+func (c *TCPConnection) retryConnect() <-chan time.Time {
+	atomic.AddUint64(&c.reconnects, 1)
+	if err := c.Dial(c.address); err != nil {
+		c.Connection = nil
+		log.
+			WithFields(log.Fields{
+				"address":  c.address,
+				"retry-in": c.backoff,
+			}).
+			WithError(err).
+			Debug("Unable to re-establish end point connection")
+		c.logDropped()
+		return c.retryAfter()
+	}
+	c.recovered()
+	log.
+		WithFields(log.Fields{
+			"address": c.address,
+			"remote":  c.Connection.RemoteAddr().String(),
+			"dropped": c.unlogged,
+		}).
+		Info("Re-established end point connection")
+	c.unlogged = 0
+	return nil
+}
+
+// dropRetrying drops a message queued while the broken connection of the end
+// point is re-established
+func (c *TCPConnection) dropRetrying() {
+	atomic.AddUint64(&c.dropped, 1)
+	c.unlogged++
+	c.logDropped()
+}
+
+// logDropped logs the messages dropped since they were last logged, at most
+// once per `TCPDropLogInterval`
+func (c *TCPConnection) logDropped() {
+	if c.unlogged == 0 || time.Since(c.logged) < TCPDropLogInterval {
+		return
+	}
+	log.
+		WithFields(log.Fields{
+			"address": c.address,
+			"dropped": c.unlogged,
+			"total":   c.Dropped(),
+		}).
+		Warn("Dropped messages while re-establishing end point connection")
+	c.logged = time.Now()
+	c.unlogged = 0
+}
+
+// refresh re-resolves the host name of the end point and reconnects if the
+// address of the current connection is no longer included in the result
+func (c *TCPConnection) refresh() {
+	host, _, err := net.SplitHostPort(c.address)
+	if err != nil || c.Proxy != nil {
+		return
+	}
+	ips, err := resolve(c.Resolver, host, nil)
+	if err != nil {
+		log.
+			WithFields(log.Fields{
+				"address": c.address,
+			}).
+			WithError(err).
+			Warn("Unable to re-resolve end point address, keeping current connection")
+		return
+	}
+	if c.Connection != nil {
+		if remote, ok := c.Connection.RemoteAddr().(*net.TCPAddr); ok {
+			for _, ip := range ips {
+				if ip == nil || ip.Equal(remote.IP) {
+					return
+				}
+			}
+		}
+	}
+	log.
+		WithFields(log.Fields{
+			"address":   c.address,
+			"resolved":  ips,
+			"preferred": c.preferred,
+		}).
+		Info("End point address changed, reconnecting")
+	c.preferred = nil
+	if err := c.reconnect(); err != nil {
+		log.
+			WithFields(log.Fields{
+				"address": c.address,
+			}).
+			WithError(err).
+			Error("Unable to reconnect to end point")
+	}
+}
+
 // GetQueue returns the channel used to queue messages up for delivery
 func (c *TCPConnection) GetQueue() chan<- []byte {
-	return c.queue
+	return c.input
 }
 
 // ListenAndSend listens for and processes messages to the target end point
@@ -41,9 +660,48 @@ func (c *TCPConnection) ListenAndSend() error {
 		return ErrUninitialized
 
 	}
+
+	// If configured, periodically re-resolve the end point's address
+	var refresh <-chan time.Time
+	if c.ResolveTTL > 0 {
+		ticker := time.NewTicker(c.ResolveTTL)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
+
+	if c.window != nil {
+		c.sendAcknowledged(refresh)
+		return nil
+	}
+
+	// Set while a broken connection is re-established in the background
+	var retry <-chan time.Time
 	for {
 		select {
+		case <-c.stop:
+			c.closeConnection()
+			return nil
+		case <-refresh:
+			if retry == nil {
+				c.refresh()
+			}
+		case <-retry:
+			retry = c.retryConnect()
 		case message := <-c.queue:
+			atomic.StoreInt32(&c.delivering, 1)
+			atomic.AddUint64(&c.matches, 1)
+			atomic.AddUint64(&c.bytes, uint64(len(message)))
+			if retry != nil {
+				c.dropRetrying()
+				atomic.StoreInt32(&c.delivering, 0)
+				c.Budget.Done()
+				continue
+			}
+			if c.Connection == nil && !c.connectOnDemand() {
+				atomic.StoreInt32(&c.delivering, 0)
+				c.Budget.Done()
+				continue
+			}
 			if log.GetLevel() >= log.DebugLevel {
 				log.
 					WithFields(log.Fields{
@@ -51,29 +709,142 @@ func (c *TCPConnection) ListenAndSend() error {
 					}).
 					Debug("send queued message")
 			}
-			_, err := c.Write(message)
+			_, err := c.Write(c.encode(message))
+			if err != nil && c.address != "" {
+				// Re-establish the connection and attempt to
+				// resend the message, once
+				log.
+					WithError(err).
+					WithFields(log.Fields{
+						"target": c.address,
+					}).
+					Warn("failed sending queued message, reconnecting")
+				if err = c.reconnect(); err == nil {
+					_, err = c.Write(c.encode(message))
+				}
+			}
 			if err != nil {
+				atomic.AddUint64(&c.errors, 1)
 				log.
 					WithError(err).
 					WithFields(log.Fields{
 						"target": c.Connection,
 					}).
 					Error("failed sending queued message")
+				if c.address != "" {
+					retry = c.broke()
+				}
+			} else {
+				c.Journal.Record(message)
+				c.Compare.Record(message)
 			}
+			atomic.StoreInt32(&c.delivering, 0)
+			c.Budget.Done()
+		}
+	}
+}
+
+// closeConnection closes the connection to the end point, once its delivery
+// has stopped
+func (c *TCPConnection) closeConnection() {
+	atomic.StoreInt32(&c.connected, 0)
+	if c.Connection != nil {
+		c.Connection.Close()
+	}
+}
+
+// dropOldest makes room in the full queue of the end point by dropping the
+// oldest message queued
+func (c *TCPConnection) dropOldest() bool {
+	return dropOldest(c.queue, c.Budget, &c.dropped)
+}
+
+// Close stops the delivery of messages to the end point, once those queued
+// have been delivered or after `CloseTimeout`, when `ErrUndelivered` is
+// returned, and closes its connection. Nothing may be queued to the end
+// point once it is closed.
+func (c *TCPConnection) Close() error {
+	var err error
+	c.closing.Do(func() {
+		err = drain(c, c.stop)
+	})
+	return err
+}
+
+// Pending returns the number of messages queued to the end point that are
+// yet to be delivered, including the one being written and, with
+// acknowledged delivery, those not yet acknowledged
+func (c *TCPConnection) Pending() int {
+	pending := len(c.queue) + int(atomic.LoadInt32(&c.delivering))
+	if stats := c.window.stats(); stats != nil {
+		pending += stats.Lag
+	}
+	return pending
+}
+
+// connectOnDemand establishes a connection that was created with
+// `DialOnDemand`. Attempts are limited to one per `OnDemandRetryInterval`. If
+// the connection is not established the message being processed is dropped
+// and `false` is returned.
+func (c *TCPConnection) connectOnDemand() bool {
+	if c.address != "" && time.Since(c.lastDial) >= OnDemandRetryInterval {
+		c.lastDial = time.Now()
+		err := c.Dial(c.address)
+		if err == nil {
+			log.
+				WithFields(log.Fields{
+					"address": c.address,
+					"remote":  c.Connection.RemoteAddr().String(),
+					"dropped": c.Dropped(),
+				}).
+				Info("Connected on demand outbound end point connection")
+			return true
 		}
+		c.Connection = nil
+		log.
+			WithFields(log.Fields{
+				"address": c.address,
+			}).
+			WithError(err).
+			Warn("Unable to establish on demand outbound end point connection")
+	}
+	atomic.AddUint64(&c.dropped, 1)
+	return false
+}
+
+// Stats returns the number of messages, and bytes, queued for delivery to
+// the end point, those dropped, the failed writes and attempts to
+// re-establish its connection and, with acknowledged delivery, the state of
+// its replay window
+func (c *TCPConnection) Stats() EndpointStats {
+	return EndpointStats{
+		Endpoint:   c.address,
+		Matches:    atomic.LoadUint64(&c.matches),
+		Bytes:      atomic.LoadUint64(&c.bytes),
+		Dropped:    c.Dropped(),
+		Errors:     atomic.LoadUint64(&c.errors),
+		Reconnects: atomic.LoadUint64(&c.reconnects),
+		Ack:        c.window.stats(),
+		Journal:    c.Journal.Stats(),
+		Compare:    c.Compare.Stats(),
 	}
 }
 
 // Connection in string form
 func (c *TCPConnection) String() string {
+	remote := c.address
+	if c.Connection != nil {
+		remote = c.Connection.RemoteAddr().String()
+	}
 	if c.queue == nil {
-		return fmt.Sprintf("(%s, %d)", c.Connection.RemoteAddr().String(), -1)
+		return fmt.Sprintf("(%s, %d)", remote, -1)
 	}
-	return fmt.Sprintf("(%s, %d)", c.Connection.RemoteAddr().String(), len(c.queue))
+	return fmt.Sprintf("(%s, %d)", remote, len(c.queue))
 }
 
 // Writes the specified bytes to the connection by performing a
-// `net.Conn.Write` to the connection.
+// `net.Conn.Write` to the connection, again after a short write, so that the
+// bytes are written in full unless the connection fails, see `WriteFull`.
 //
 // It is expected that when using this method for a `tee` end point that the
 // entire packet will be represented in a single `Write`, although this is not
@@ -82,14 +853,73 @@ func (c *TCPConnection) String() string {
 // When using this method to communicate to the SDN controller, it is not
 // expected to include the entire packet in a single `Write`.
 func (c *TCPConnection) Write(b []byte) (n int, err error) {
+	return c.WriteContext(context.Background(), b)
+}
+
+// WriteContext writes the specified bytes to the connection, as `Write`,
+// abandoning the write once the context is done, see `WriteContext`.
+func (c *TCPConnection) WriteContext(ctx context.Context, b []byte) (n int, err error) {
 	if c.Connection != nil {
-		return c.Connection.Write(b)
+		c.writing.Lock()
+		defer c.writing.Unlock()
+		return WriteContext(ctx, c.Connection, b)
 	}
 	return 0, errors.New("No connection established")
 }
 
+// encode returns the bytes written to the end point for a message, the
+// message itself unless it is encoded as a protocol buffer, or wrapped in an
+// envelope
+func (c *TCPConnection) encode(message []byte) []byte {
+	switch {
+	case c.Protobuf:
+		return lengthPrefixed(packetInProto(message, c.Annotator.metadataOf(message, false), time.Now()))
+	case c.Envelope:
+		return lengthPrefixed(envelope(message, c.Annotator.metadataOf(message, c.Raw), time.Now()))
+	}
+	return message
+}
+
+// Deliver writes a message to the end point, establishing the connection if
+// it isn't, and returns an error if it could not be written. A TCP end point
+// has no acknowledgments, so a message is delivered once written. If the
+// write fails the connection is closed, so the next delivery re-establishes
+// it.
+func (c *TCPConnection) Deliver(message []byte) error {
+	if c.Connection == nil {
+		if c.address == "" {
+			return errors.New("No connection established")
+		}
+		if err := c.Dial(c.address); err != nil {
+			c.Connection = nil
+			return err
+		}
+	}
+	c.writing.Lock()
+	_, err := WriteFull(c.Connection, c.encode(message))
+	c.writing.Unlock()
+	if err != nil {
+		if closeErr := c.Connection.Close(); closeErr != nil {
+			log.
+				WithError(closeErr).
+				Debug("Error while closing failed connection")
+		}
+		c.Connection = nil
+		atomic.StoreInt32(&c.connected, 0)
+		return err
+	}
+	c.Journal.Record(message)
+	c.Compare.Record(message)
+	return nil
+}
+
 // Match is the TCP connection implementation of the Match method. Simply
 // calls the `Match` method on the imbeded `Criteria` data.
 func (c *TCPConnection) Match(state criteria.Criteria) bool {
 	return c.Criteria.Match(state)
 }
+
+// CriteriaBits returns the values the end point matches on
+func (c *TCPConnection) CriteriaBits() uint64 {
+	return c.Criteria.Bits()
+}
@@ -0,0 +1,275 @@
+package connections
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDialOnDemandConnectsOnFirstMessage(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	c := (&TCPConnection{}).Initialize()
+	if err = c.DialOnDemand(listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if c.Connection != nil || c.State() != StateConnecting {
+		t.Fatal("Connection established before first message")
+	}
+	go c.ListenAndSend()
+	c.GetQueue() <- []byte("hello")
+
+	accepted := make(chan net.Conn)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		buf := make([]byte, 5)
+		if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("Expected first message to be delivered, got '%s' (%v)", buf, err)
+		}
+		if states := (Endpoints{c, &ShadowConnection{}}).States(); states[0] != StateConnected || states[1] != "" {
+			t.Errorf("Expected only the connection's state reported, connected, got %v", states)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Connection not established on first message")
+	}
+}
+
+func TestDialOnDemandDropsUntilConnected(t *testing.T) {
+	// Grab a free port and release it, so nothing is listening
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	c := (&TCPConnection{}).Initialize()
+	if err = c.DialOnDemand(address); err != nil {
+		t.Fatal(err)
+	}
+	go c.ListenAndSend()
+	for i := 0; i < 3; i++ {
+		c.GetQueue() <- []byte("hello")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Dropped() != 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c.Dropped() != 3 || c.State() != StateConnecting {
+		t.Errorf("Expected 3 dropped messages while connecting, got %d (%s)", c.Dropped(), c.State())
+	}
+}
+
+func TestReconnectInBackground(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+
+	c := (&TCPConnection{}).Initialize()
+	if err = c.Dial(address); err != nil {
+		t.Fatal(err)
+	}
+	go c.ListenAndSend()
+
+	// Break the connection, with nothing listening to reconnect to
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	listener.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Healthy() && time.Now().Before(deadline) {
+		c.GetQueue() <- []byte("hello")
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c.Healthy() {
+		t.Fatal("Expected the broken connection unhealthy")
+	}
+	dropped := c.Dropped()
+	c.GetQueue() <- []byte("hello")
+	for c.Dropped() == dropped && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c.Dropped() == dropped {
+		t.Error("Expected messages dropped while reconnecting")
+	}
+
+	// Delivery resumes once the end point is listening again
+	if listener, err = net.Listen("tcp", address); err != nil {
+		t.Skipf("Unable to listen again on %s: %v", address, err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	deadline = time.Now().Add(5 * time.Second)
+	for conn = nil; conn == nil && time.Now().Before(deadline); {
+		select {
+		case conn = <-accepted:
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if conn == nil {
+		t.Fatal("Connection not re-established in the background")
+	}
+	defer conn.Close()
+	c.GetQueue() <- []byte("hello")
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Expected delivery resumed, got '%s' (%v)", buf, err)
+	}
+	if !c.Healthy() {
+		t.Error("Expected the re-established connection healthy")
+	}
+}
+
+// readPreamble reads a preamble record from a connection
+func readPreamble(t *testing.T, conn net.Conn) Preamble {
+	var size [4]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	var preamble Preamble
+	if err := json.Unmarshal(data, &preamble); err != nil {
+		t.Fatalf("Expected a JSON preamble, got '%s' (%v)", data, err)
+	}
+	return preamble
+}
+
+func TestPreambleResentOnReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	expected := Preamble{
+		Instance: "oftee-1",
+		Version:  "1.0.0",
+		Endpoint: "tcp://" + listener.Addr().String(),
+		Criteria: "dl_type=0x888e",
+		Format:   FormatOpenFlow,
+	}
+	record, err := expected.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := (&TCPConnection{Preamble: record}).Initialize()
+	if err = c.Dial(listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The preamble precedes the packet data of each connection
+	for _, message := range []string{"before", "after"} {
+		if message == "after" {
+			if err = c.reconnect(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err = c.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		var conn net.Conn
+		select {
+		case conn = <-accepted:
+			defer conn.Close()
+		case <-time.After(2 * time.Second):
+			t.Fatal("Connection not established")
+		}
+		if preamble := readPreamble(t, conn); preamble != expected {
+			t.Errorf("Expected preamble %+v, got %+v", expected, preamble)
+		}
+		buf := make([]byte, len(message))
+		if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != message {
+			t.Errorf("Expected '%s' after the preamble, got '%s' (%v)", message, buf, err)
+		}
+	}
+}
+
+// yieldingConn a connection that yields to the other goroutines before each
+// write, so that concurrent writers take turns
+type yieldingConn struct {
+	net.Conn
+}
+
+func (c yieldingConn) Write(b []byte) (int, error) {
+	runtime.Gosched()
+	return c.Conn.Write(b)
+}
+
+func TestConcurrentWritesNotInterleaved(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	c := (&TCPConnection{Connection: &shortConn{Conn: yieldingConn{local}, limit: 7}}).Initialize()
+	defer local.Close()
+
+	// Each writer writes messages of its own byte, that must be read whole
+	const writers, messages, size = 4, 50, 64
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(b byte) {
+			defer wg.Done()
+			message := make([]byte, size)
+			for i := range message {
+				message[i] = b
+			}
+			for i := 0; i < messages; i++ {
+				if _, err := c.Write(message); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(byte('a' + w))
+	}
+
+	buf := make([]byte, size)
+	for i := 0; i < writers*messages; i++ {
+		if _, err := io.ReadFull(remote, buf); err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range buf {
+			if b != buf[0] {
+				t.Fatalf("Expected each message written whole, got '%s'", buf)
+			}
+		}
+	}
+	wg.Wait()
+}
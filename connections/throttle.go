@@ -0,0 +1,162 @@
+package connections
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ThrottleLogInterval minimum interval between the logs of the messages a
+// throttled end point has dropped
+const ThrottleLogInterval = 10 * time.Second
+
+// Throttle samples, and rate limits, the messages tee-ed to an end point.
+// Of the messages the end point matches only one in every `Sample` is
+// delivered, the first, and of those no more than `Rate` a second, by a token
+// bucket that holds a second's worth of tokens, so a burst of up to `Rate`
+// messages is delivered after a lull. The messages dropped by each are
+// counted, and periodically logged.
+//
+// Only the messages tee-ed to the end point are throttled, what is proxied to
+// the SDN controller never is.
+type Throttle struct {
+	Endpoint string
+
+	// Sample one in how many matching messages are delivered, all of them
+	// if less than 2
+	Sample int
+
+	// Rate maximum number of messages delivered a second, unlimited if
+	// not positive
+	Rate float64
+
+	lock    sync.Mutex
+	matched uint64
+	tokens  float64
+	last    time.Time
+	logged  time.Time
+	sampled uint64
+	limited uint64
+}
+
+// ParseSample parses the sample term of an end point, one in how many
+// matching messages are delivered
+func ParseSample(value string) (int, error) {
+	sample, err := strconv.Atoi(value)
+	if err != nil || sample < 1 {
+		return 0, fmt.Errorf("invalid sample '%s', must be a positive integer", value)
+	}
+	return sample, nil
+}
+
+// ParseRate parses the rate term of an end point, the maximum number of
+// messages delivered a second
+func ParseRate(value string) (float64, error) {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("invalid rate '%s', must be a positive number of messages a second", value)
+	}
+	return rate, nil
+}
+
+// Allow returns true if a message matched by the end point at the given time
+// is to be delivered, counting it as dropped if not
+func (t *Throttle) Allow(now time.Time) bool {
+	t.lock.Lock()
+	allow := t.sample() && t.take(now)
+	report := !allow && now.Sub(t.logged) >= ThrottleLogInterval
+	if report {
+		t.logged = now
+	}
+	t.lock.Unlock()
+
+	if report {
+		log.
+			WithFields(log.Fields{
+				"endpoint":       t.Endpoint,
+				"sample":         t.Sample,
+				"rate":           t.Rate,
+				"sample_dropped": t.SampleDropped(),
+				"rate_dropped":   t.RateDropped(),
+			}).
+			Warn("Messages to end point dropped by sampling, or its rate limit")
+	}
+	return allow
+}
+
+// sample returns true if the message is the one of its sample that is
+// delivered. Must be called with the lock held.
+func (t *Throttle) sample() bool {
+	if t.Sample < 2 {
+		return true
+	}
+	t.matched++
+	if (t.matched-1)%uint64(t.Sample) != 0 {
+		atomic.AddUint64(&t.sampled, 1)
+		return false
+	}
+	return true
+}
+
+// take takes a token from the bucket, which is refilled at the rate, returning
+// false if there is none. Must be called with the lock held.
+func (t *Throttle) take(now time.Time) bool {
+	if t.Rate <= 0 {
+		return true
+	}
+	burst := t.Rate
+	if burst < 1 {
+		burst = 1
+	}
+	if t.last.IsZero() {
+		t.tokens = burst
+	} else if elapsed := now.Sub(t.last); elapsed > 0 {
+		t.tokens += elapsed.Seconds() * t.Rate
+		if t.tokens > burst {
+			t.tokens = burst
+		}
+	}
+	t.last = now
+	if t.tokens < 1 {
+		atomic.AddUint64(&t.limited, 1)
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+// SampleDropped returns the number of messages dropped by sampling
+func (t *Throttle) SampleDropped() uint64 {
+	return atomic.LoadUint64(&t.sampled)
+}
+
+// RateDropped returns the number of messages dropped by the rate limit
+func (t *Throttle) RateDropped() uint64 {
+	return atomic.LoadUint64(&t.limited)
+}
+
+// Throttled an end point whose messages are sampled, and rate limited
+type Throttled struct {
+	Connection
+	Throttle *Throttle
+}
+
+// Stats returns the statistics of the end point, with the messages dropped
+// by sampling and the rate limit
+func (c *Throttled) Stats() EndpointStats {
+	stats := EndpointStats{Endpoint: c.Connection.String()}
+	if counted, ok := c.Connection.(StatsConnection); ok {
+		stats = counted.Stats()
+	}
+	stats.SampleDropped = c.Throttle.SampleDropped()
+	stats.RateDropped = c.Throttle.RateDropped()
+	return stats
+}
+
+func (c *Throttled) String() string {
+	return fmt.Sprintf("(sample %d, rate %g, %s)", c.Throttle.Sample, c.Throttle.Rate, c.Connection.String())
+}
@@ -0,0 +1,104 @@
+package connections
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/criteria"
+)
+
+func TestThrottleSample(t *testing.T) {
+	throttle := &Throttle{Endpoint: "tcp://collector:9000", Sample: 3}
+	now := time.Now()
+	var allowed []int
+	for i := 0; i < 9; i++ {
+		if throttle.Allow(now) {
+			allowed = append(allowed, i)
+		}
+	}
+	if len(allowed) != 3 || allowed[0] != 0 || allowed[1] != 3 || allowed[2] != 6 {
+		t.Errorf("Expected the first of every 3 messages allowed, got %v", allowed)
+	}
+	if throttle.SampleDropped() != 6 || throttle.RateDropped() != 0 {
+		t.Errorf("Expected 6 dropped by sampling, got %d, and %d by rate",
+			throttle.SampleDropped(), throttle.RateDropped())
+	}
+}
+
+func TestThrottleRate(t *testing.T) {
+	throttle := &Throttle{Endpoint: "tcp://collector:9000", Rate: 10}
+	now := time.Now()
+
+	// A second's worth is allowed in a burst
+	allowed := 0
+	for i := 0; i < 25; i++ {
+		if throttle.Allow(now) {
+			allowed++
+		}
+	}
+	if allowed != 10 || throttle.RateDropped() != 15 {
+		t.Errorf("Expected a burst of 10 allowed, got %d, %d dropped", allowed, throttle.RateDropped())
+	}
+
+	// Then one every tenth of a second
+	if !throttle.Allow(now.Add(100*time.Millisecond)) || throttle.Allow(now.Add(150*time.Millisecond)) {
+		t.Error("Expected one message allowed every 100ms")
+	}
+
+	// And never more than the burst
+	allowed = 0
+	for i := 0; i < 25; i++ {
+		if throttle.Allow(now.Add(time.Hour)) {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Errorf("Expected a burst of 10 allowed after a lull, got %d", allowed)
+	}
+}
+
+func TestThrottleSlowRate(t *testing.T) {
+	throttle := &Throttle{Rate: 0.5}
+	now := time.Now()
+	if !throttle.Allow(now) || throttle.Allow(now.Add(time.Second)) || !throttle.Allow(now.Add(2*time.Second)) {
+		t.Error("Expected one message allowed every 2s")
+	}
+}
+
+func TestThrottledConditionalWrite(t *testing.T) {
+	eapol := criteria.Criteria{Set: criteria.BitDLType, DlType: 0x888e}
+	sampled := (&ShadowConnection{Target: "tcp://sampled:9000", Criteria: eapol}).Initialize()
+	other := (&ShadowConnection{Target: "tcp://other:9000", Criteria: eapol}).Initialize()
+	eps := Endpoints{
+		&Throttled{Connection: sampled, Throttle: &Throttle{Sample: 2}},
+		other,
+	}
+	for i := 0; i < 4; i++ {
+		written, err := eps.ConditionalWrite(context.Background(), []byte("message"), eapol)
+		if err != nil || written[0] != (1-i%2)*len("message") || written[1] != len("message") {
+			t.Errorf("Expected message %d written to the sampled end point %v, got %v (%v)", i, i%2 == 0, written, err)
+		}
+	}
+	stats := eps.Stats()
+	if len(sampled.queue) != 2 || len(other.queue) != 4 || stats[0].SampleDropped != 2 || stats[0].Endpoint != "tcp://sampled:9000" {
+		t.Errorf("Expected 2 of 4 messages queued to the sampled end point, got %d, %+v", len(sampled.queue), stats[0])
+	}
+}
+
+func TestParseThrottle(t *testing.T) {
+	if sample, err := ParseSample("10"); sample != 10 || err != nil {
+		t.Errorf("Expected sample of 10, got %d (%v)", sample, err)
+	}
+	if rate, err := ParseRate("2.5"); rate != 2.5 || err != nil {
+		t.Errorf("Expected rate of 2.5, got %g (%v)", rate, err)
+	}
+	for _, value := range []string{"0", "-1", "many", ""} {
+		if _, err := ParseSample(value); err == nil {
+			t.Errorf("Expected sample '%s' rejected", value)
+		}
+		if _, err := ParseRate(value); err == nil {
+			t.Errorf("Expected rate '%s' rejected", value)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package connections
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// TLSSessionCacheSize is the number of TLS sessions cached by each `https`,
+// or `grpcs`, end point, so that re-established connections resume a session
+// rather than complete a full handshake
+const TLSSessionCacheSize = 64
+
+// TLSHandshakeTimeout is the maximum time allowed for a TLS handshake with
+// an `https` end point
+const TLSHandshakeTimeout = 10 * time.Second
+
+// HandshakeBuckets are the upper bounds of the buckets of the TLS handshake
+// duration histogram, handshakes that take longer are counted in a final
+// unbounded bucket
+var HandshakeBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// HandshakeBucket the number of TLS handshakes that took at most `LE`, and
+// longer than the bound of the previous bucket
+type HandshakeBucket struct {
+	LE    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+// TLSStats the TLS handshakes with an end point, those that resumed a cached
+// session and those that were full handshakes, and the histogram of their
+// durations
+type TLSStats struct {
+	Full       uint64            `json:"full"`
+	Resumed    uint64            `json:"resumed"`
+	Failed     uint64            `json:"failed"`
+	Handshakes []HandshakeBucket `json:"handshakes"`
+}
+
+// handshakeMetrics counts the TLS handshakes with an end point
+type handshakeMetrics struct {
+	full    uint64
+	resumed uint64
+	failed  uint64
+	buckets []uint64
+}
+
+// newHandshakeMetrics creates metrics with no handshakes counted
+func newHandshakeMetrics() *handshakeMetrics {
+	return &handshakeMetrics{buckets: make([]uint64, len(HandshakeBuckets)+1)}
+}
+
+// observe counts a completed TLS handshake
+func (m *handshakeMetrics) observe(state tls.ConnectionState, err error, elapsed time.Duration) {
+	switch {
+	case err != nil:
+		atomic.AddUint64(&m.failed, 1)
+		return
+	case state.DidResume:
+		atomic.AddUint64(&m.resumed, 1)
+	default:
+		atomic.AddUint64(&m.full, 1)
+	}
+	i := 0
+	for i < len(HandshakeBuckets) && elapsed > HandshakeBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&m.buckets[i], 1)
+}
+
+// trace returns a client trace that observes the TLS handshake of a new
+// connection established for a request. Requests that reuse an idle
+// connection don't handshake, so aren't counted.
+func (m *handshakeMetrics) trace() *httptrace.ClientTrace {
+	var started time.Time
+	return &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			started = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			m.observe(state, err, time.Since(started))
+		},
+	}
+}
+
+// stats returns the counts of the handshakes, nil if the end point doesn't
+// use TLS
+func (m *handshakeMetrics) stats() *TLSStats {
+	if m == nil {
+		return nil
+	}
+	stats := &TLSStats{
+		Full:       atomic.LoadUint64(&m.full),
+		Resumed:    atomic.LoadUint64(&m.resumed),
+		Failed:     atomic.LoadUint64(&m.failed),
+		Handshakes: make([]HandshakeBucket, len(m.buckets)),
+	}
+	for i := range m.buckets {
+		stats.Handshakes[i].LE = "+Inf"
+		if i < len(HandshakeBuckets) {
+			stats.Handshakes[i].LE = HandshakeBuckets[i].String()
+		}
+		stats.Handshakes[i].Count = atomic.LoadUint64(&m.buckets[i])
+	}
+	return stats
+}
@@ -0,0 +1,87 @@
+package connections
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTLSSessionResumption(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	u, _ := url.Parse(server.URL)
+	c := (&HTTPConnection{Connection: *u, TLSConfig: &tls.Config{RootCAs: roots}}).Initialize()
+
+	// Warming the connection completes a full handshake, the first message
+	// reuses the warm connection
+	if err := c.Warm(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Deliver([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if stats := c.TLSStats(); stats.Full != 1 || stats.Resumed != 0 {
+		t.Errorf("Expected a single full handshake, got %+v", stats)
+	}
+
+	// Each time the collector drops the connections, as if restarted, the
+	// session is resumed when the connection is warmed again
+	for i := 0; i < 3; i++ {
+		server.CloseClientConnections()
+		if err := c.Warm(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := c.TLSStats()
+	if stats.Full != 1 || stats.Resumed != 3 || stats.Failed != 0 {
+		t.Errorf("Expected 3 resumed handshakes, got %+v", stats)
+	}
+	var total uint64
+	for _, bucket := range stats.Handshakes {
+		total += bucket.Count
+	}
+	if total != 4 || len(stats.Handshakes) != len(HandshakeBuckets)+1 ||
+		stats.Handshakes[len(HandshakeBuckets)].LE != "+Inf" {
+		t.Errorf("Expected 4 handshakes in the histogram, got %+v", stats.Handshakes)
+	}
+}
+
+func TestTLSHandshakeFailure(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	// The server's certificate isn't trusted
+	u, _ := url.Parse(server.URL)
+	c := (&HTTPConnection{Connection: *u}).Initialize()
+	if err := c.Warm(); err == nil {
+		t.Fatal("Expected untrusted certificate to fail")
+	}
+	if stats := c.TLSStats(); stats.Failed != 1 || stats.Full != 0 {
+		t.Errorf("Expected a failed handshake, got %+v", stats)
+	}
+}
+
+func TestHandshakeBuckets(t *testing.T) {
+	m := newHandshakeMetrics()
+	for _, elapsed := range []time.Duration{time.Millisecond, 5 * time.Millisecond, 6 * time.Millisecond, time.Minute} {
+		m.observe(tls.ConnectionState{}, nil, elapsed)
+	}
+	stats := m.stats()
+	if stats.Handshakes[0] != (HandshakeBucket{"5ms", 2}) || stats.Handshakes[1] != (HandshakeBucket{"10ms", 1}) ||
+		stats.Handshakes[len(HandshakeBuckets)] != (HandshakeBucket{"+Inf", 1}) {
+		t.Errorf("Incorrect histogram %+v", stats.Handshakes)
+	}
+
+	// A plain HTTP end point has no TLS statistics
+	u, _ := url.Parse("http://127.0.0.1:1")
+	if stats := (&HTTPConnection{Connection: *u}).Initialize().Stats(); stats.TLS != nil {
+		t.Errorf("Expected no TLS statistics, got %+v", stats.TLS)
+	}
+}
@@ -0,0 +1,145 @@
+package connections
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ciena/oftee/criteria"
+	log "github.com/sirupsen/logrus"
+)
+
+// End points that share a transaction group, `txn_group=`, receive a message
+// all or nothing. Before a message is queued to the members of a group that
+// match it, each member is checked: its queue must have room and, if it
+// reports its health, see `HealthConnection`, it must be healthy, and while
+// the queues are shrunk, see `SetQueueLimit`, its queue must be below the
+// limit. If any member fails the check the message is queued to none of them,
+// and the drop is counted once against the group. Once the members accept a
+// message it is queued to each of them, waiting for room if a message queued
+// concurrently filled a queue, rather than dropping the oldest message of
+// that member alone. Members can't be throttled, nor have a latency budget,
+// as either drops messages on its own.
+//
+// The guarantee only covers the decision made when the message is queued. A
+// message queued to every member can still be lost by one of them if its
+// connection fails while the message is being written, or is reset before
+// the consumer reads it, e.g. while an end point is reconnecting. Use
+// acknowledged delivery, `ack=true`, where that matters.
+
+// HealthConnection is implemented by connections that can tell whether a
+// message queued now would be delivered, or dropped
+type HealthConnection interface {
+	Healthy() bool
+}
+
+// TxnGroup the state shared by the members of a transaction group
+type TxnGroup struct {
+	Name    string
+	dropped uint64
+}
+
+// Dropped returns the number of messages dropped by all the members of the
+// group because one of them could not accept it
+func (g *TxnGroup) Dropped() uint64 {
+	return atomic.LoadUint64(&g.dropped)
+}
+
+// TxnGroups the transaction groups, by name, so that end points established
+// at different times share the group, and its drop count
+type TxnGroups struct {
+	lock   sync.Mutex
+	groups map[string]*TxnGroup
+}
+
+// Get returns the named group, creating it if needed
+func (g *TxnGroups) Get(name string) *TxnGroup {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.groups == nil {
+		g.groups = make(map[string]*TxnGroup)
+	}
+	group, ok := g.groups[name]
+	if !ok {
+		group = &TxnGroup{Name: name}
+		g.groups[name] = group
+	}
+	return group
+}
+
+// TxnMember an end point that is a member of a transaction group
+type TxnMember struct {
+	Connection
+	Group *TxnGroup
+}
+
+// Ready returns true if a message queued to the end point now would not be
+// dropped
+func (m *TxnMember) Ready() bool {
+	queue := m.GetQueue()
+	if len(queue) >= cap(queue) {
+		return false
+	}
+	if limit := QueueLimit(); limit > 0 && len(queue) >= limit && !spooled(m.Connection) {
+		return false
+	}
+	if health, ok := m.Connection.(HealthConnection); ok {
+		return health.Healthy()
+	}
+	return true
+}
+
+// Stats returns the statistics of the member end point, with those of its
+// group
+func (m *TxnMember) Stats() EndpointStats {
+	stats := EndpointStats{Endpoint: m.Connection.String()}
+	if counted, ok := m.Connection.(StatsConnection); ok {
+		stats = counted.Stats()
+	}
+	stats.TxnGroup = m.Group.Name
+	stats.TxnDropped = m.Group.Dropped()
+	return stats
+}
+
+func (m *TxnMember) String() string {
+	return fmt.Sprintf("(txn_group %s, %s)", m.Group.Name, m.Connection.String())
+}
+
+// txnDecision whether the members of a group accept a message
+type txnDecision struct {
+	group *TxnGroup
+	ready bool
+}
+
+// txnReady returns true if every member of the group that matches the given
+// criteria can accept a message, the drop is counted against the group if
+// not
+func (eps Endpoints) txnReady(group *TxnGroup, state criteria.Criteria) bool {
+	for _, conn := range eps {
+		if member, ok := conn.(*TxnMember); ok && member.Group == group &&
+			member.Match(state) && !member.Ready() {
+			atomic.AddUint64(&group.dropped, 1)
+			log.
+				WithFields(log.Fields{
+					"txn_group":  group.Name,
+					"connection": member.String(),
+				}).
+				Debug("Transaction group member can't accept message, dropping for all members")
+			return false
+		}
+	}
+	return true
+}
+
+// txnAccepts returns true if the members of the group accept the message,
+// deciding once per message
+func (eps Endpoints) txnAccepts(decided *[]txnDecision, group *TxnGroup, state criteria.Criteria) bool {
+	for _, decision := range *decided {
+		if decision.group == group {
+			return decision.ready
+		}
+	}
+	ready := eps.txnReady(group, state)
+	*decided = append(*decided, txnDecision{group: group, ready: ready})
+	return ready
+}
@@ -0,0 +1,205 @@
+package connections
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/criteria"
+)
+
+// unhealthyConnection an end point that reports it can't deliver messages
+type unhealthyConnection struct {
+	*ShadowConnection
+}
+
+func (c unhealthyConnection) Healthy() bool {
+	return false
+}
+
+func TestTxnGroupMemberFull(t *testing.T) {
+	eapol := criteria.Criteria{Set: criteria.BitDLType, DlType: 0x888e}
+	group := &TxnGroup{Name: "audit"}
+
+	// Neither member delivers, so their queues fill
+	first := (&ShadowConnection{Target: "tcp://first:9000", Criteria: eapol}).Initialize()
+	second := (&ShadowConnection{Target: "tcp://second:9000", Criteria: eapol}).Initialize()
+	other := (&ShadowConnection{Target: "tcp://other:9000", Criteria: eapol}).Initialize()
+	eps := Endpoints{
+		&TxnMember{Connection: first, Group: group},
+		&TxnMember{Connection: second, Group: group},
+		other,
+	}
+	for i := 0; i < cap(first.queue)-1; i++ {
+		first.queue <- []byte("backlog")
+	}
+
+	// The first member has room for one more message
+	eps.ConditionalWrite(context.Background(), []byte("message"), eapol)
+	if len(first.queue) != cap(first.queue) || len(second.queue) != 1 || group.Dropped() != 0 {
+		t.Fatalf("Expected message queued to both members, got %d and %d, %d dropped",
+			len(first.queue), len(second.queue), group.Dropped())
+	}
+
+	// The first member is full, so neither member is written, but the
+	// end point outside the group is
+	eps.ConditionalWrite(context.Background(), []byte("message"), eapol)
+	if len(second.queue) != 1 || len(other.queue) != 2 || group.Dropped() != 1 {
+		t.Errorf("Expected message dropped by both members, got %d queued, %d dropped",
+			len(second.queue), group.Dropped())
+	}
+
+	// A message the full member doesn't match isn't held back by it
+	<-second.queue
+	first.Criteria = criteria.Criteria{Set: criteria.BitDLType, DlType: 0x0806}
+	eps.ConditionalWrite(context.Background(), []byte("message"), eapol)
+	if len(second.queue) != 1 || group.Dropped() != 1 {
+		t.Errorf("Expected message queued to the matching member, got %d queued, %d dropped",
+			len(second.queue), group.Dropped())
+	}
+
+	stats := eps.Stats()
+	if stats[0].TxnGroup != "audit" || stats[1].TxnDropped != 1 || stats[2].TxnGroup != "" {
+		t.Errorf("Incorrect transaction group stats, got %+v", stats)
+	}
+}
+
+func TestTxnGroupMemberUnhealthy(t *testing.T) {
+	eapol := criteria.Criteria{Set: criteria.BitDLType, DlType: 0x888e}
+	group := &TxnGroup{Name: "audit"}
+	healthy := (&ShadowConnection{Target: "tcp://healthy:9000", Criteria: eapol}).Initialize()
+	unhealthy := (&ShadowConnection{Target: "tcp://unhealthy:9000", Criteria: eapol}).Initialize()
+	eps := Endpoints{
+		&TxnMember{Connection: healthy, Group: group},
+		&TxnMember{Connection: unhealthyConnection{unhealthy}, Group: group},
+	}
+	eps.ConditionalWrite(context.Background(), []byte("message"), eapol)
+	if len(healthy.queue) != 0 || len(unhealthy.queue) != 0 || group.Dropped() != 1 {
+		t.Errorf("Expected message dropped by both members, got %d and %d queued, %d dropped",
+			len(healthy.queue), len(unhealthy.queue), group.Dropped())
+	}
+}
+
+// crowdedConnection an end point whose queue is filled by another writer
+// once a transaction group has decided it's ready
+type crowdedConnection struct {
+	*TCPConnection
+}
+
+func (c crowdedConnection) Healthy() bool {
+	for {
+		select {
+		case c.queue <- []byte("other"):
+		default:
+			return true
+		}
+	}
+}
+
+func TestTxnGroupConcurrentWriters(t *testing.T) {
+	eapol := criteria.Criteria{Set: criteria.BitDLType, DlType: 0x888e}
+	group := &TxnGroup{Name: "audit"}
+
+	// The queue of the first member is full by the time each message the
+	// group accepted is written to it, and is drained slowly
+	first := (&TCPConnection{Criteria: eapol, QueueSize: 4}).Initialize()
+	second := (&TCPConnection{Criteria: eapol, QueueSize: 1000}).Initialize()
+	eps := Endpoints{
+		&TxnMember{Connection: crowdedConnection{first}, Group: group},
+		&TxnMember{Connection: second, Group: group},
+	}
+	received := make(chan []string)
+	stop := make(chan struct{})
+	go func() {
+		var messages []string
+		keep := func(message []byte) {
+			if string(message) != "other" {
+				messages = append(messages, string(message))
+			}
+		}
+		for {
+			select {
+			case message := <-first.queue:
+				keep(message)
+				time.Sleep(time.Millisecond)
+			case <-stop:
+				for len(first.queue) > 0 {
+					keep(<-first.queue)
+				}
+				received <- messages
+				return
+			}
+		}
+	}()
+
+	var writers sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		writers.Add(1)
+		go func(i int) {
+			defer writers.Done()
+			eps.ConditionalWrite(context.Background(), []byte(fmt.Sprintf("message-%d", i)), eapol)
+		}(i)
+	}
+	writers.Wait()
+	close(stop)
+	delivered := <-received
+
+	// Each message was queued to both members or neither
+	sort.Strings(delivered)
+	var queued []string
+	for len(second.queue) > 0 {
+		queued = append(queued, string(<-second.queue))
+	}
+	sort.Strings(queued)
+	if first.Dropped() != 0 || fmt.Sprint(delivered) != fmt.Sprint(queued) {
+		t.Errorf("Expected the same messages queued to both members, got %d dropped, %v and %v",
+			first.Dropped(), delivered, queued)
+	}
+	if uint64(len(queued))+group.Dropped() != 20 {
+		t.Errorf("Expected each message queued or dropped by the group, got %d queued, %d dropped",
+			len(queued), group.Dropped())
+	}
+}
+
+func TestTxnGroupQueueLimit(t *testing.T) {
+	// A member whose queue is at the limit of memory pressure can't
+	// accept a message
+	member := &TxnMember{Connection: (&TCPConnection{}).Initialize(), Group: &TxnGroup{Name: "audit"}}
+	member.GetQueue() <- []byte("backlog")
+	SetQueueLimit(1)
+	defer SetQueueLimit(0)
+	if member.Ready() {
+		t.Error("Expected a member at the queue limit not to be ready")
+	}
+}
+
+func TestTCPConnectionHealthy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	c := (&TCPConnection{}).Initialize()
+	if !c.Healthy() {
+		t.Error("Expected a connection never dialed to be healthy")
+	}
+	if err = c.Dial(address); err == nil {
+		t.Fatal("Expected connection to a closed port to fail")
+	}
+	if c.Healthy() {
+		t.Error("Expected a connection that failed to be established to be unhealthy")
+	}
+
+	// A full replay window drops messages
+	acked := (&TCPConnection{Ack: true, AckWindow: 1}).Initialize()
+	acked.window.add([]byte("message"), time.Now())
+	if acked.Healthy() {
+		t.Error("Expected a connection with a full replay window to be unhealthy")
+	}
+}
@@ -0,0 +1,78 @@
+package connections
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/ciena/oftee/criteria"
+)
+
+// networkUnix the network of a connection to a unix domain socket
+const networkUnix = "unix"
+
+// UnixConnection is the connection to an end point listening on a unix
+// domain socket, i.e. a consumer in the same pod, or on the same host. It is
+// a `TCPConnection` whose address is the path of the socket, so messages are
+// queued, written and the connection re-established as they are for a TCP
+// end point. The options that only apply to TCP, i.e. a `LocalAddr`, `DSCP`,
+// `Proxy` or `ResolveTTL`, are ignored.
+type UnixConnection struct {
+	TCPConnection
+}
+
+func init() {
+	RegisterScheme(SchemeUnix, newUnixScheme, "ack", "ack_window", "preamble", "queue")
+}
+
+// newUnixScheme creates the connection to a unix domain socket end point, of
+// the form `unix:///path/to/socket`
+func newUnixScheme(u *url.URL, match criteria.Criteria, options *EndpointOptions) (Connection, error) {
+	if u.Host != "" || u.Path == "" {
+		return nil, fmt.Errorf("invalid address '%s', expected unix:///path/to/socket", u)
+	}
+	if options == nil {
+		return nil, nil
+	}
+	terms, err := parseTCPTerms(options)
+	if err != nil {
+		return nil, err
+	}
+	if options.Durable {
+		// Only ever delivered to, so connected on demand
+		c := &UnixConnection{TCPConnection{
+			Preamble: options.Preamble,
+			Journal:  options.Journal,
+			Compare:  options.Compare,
+			network:  networkUnix,
+		}}
+		return c, c.DialOnDemand(u.Path)
+	}
+	c := (&UnixConnection{TCPConnection{
+		Criteria:  match,
+		Budget:    options.Budget,
+		Ack:       terms.ack,
+		AckWindow: terms.ackWindow,
+		QueueSize: options.QueueSize,
+		Preamble:  options.Preamble,
+		Journal:   options.Journal,
+		Compare:   options.Compare,
+	}}).Initialize()
+	if options.Lazy {
+		return c, c.DialOnDemand(u.Path)
+	}
+	return c, c.Dial(u.Path)
+}
+
+// NewUnixConnection returns a connection to a unix domain socket, which must
+// be initialized before it is used as an end point
+func NewUnixConnection() *UnixConnection {
+	return &UnixConnection{TCPConnection{network: networkUnix}}
+}
+
+// Initialize makes sure priviate members, that can't function from zero
+// state, are set correctly
+func (c *UnixConnection) Initialize() *UnixConnection {
+	c.network = networkUnix
+	c.TCPConnection.Initialize()
+	return c
+}
@@ -0,0 +1,63 @@
+package connections
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/criteria"
+)
+
+func TestUnixEndpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oftee-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "packets.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	u, _ := url.Parse("unix://" + path)
+	if err = ValidateAddress(u); err != nil {
+		t.Fatalf("Unexpected error validating '%s': %v", u, err)
+	}
+	conn, err := NewConnection(u, criteria.Criteria{}, &EndpointOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.(*UnixConnection).Close()
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	go conn.ListenAndSend()
+	conn.GetQueue() <- []byte("hello")
+
+	accepted.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(accepted, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Expected message delivered over the socket, got '%s' (%v)", buf, err)
+	}
+	if stats := conn.(StatsConnection).Stats(); stats.Endpoint != path || stats.Matches != 1 {
+		t.Errorf("Expected the socket's path and a match in the stats, got %+v", stats)
+	}
+}
+
+func TestUnixEndpointAddress(t *testing.T) {
+	for _, address := range []string{"unix://host/packets.sock", "unix://"} {
+		u, _ := url.Parse(address)
+		if err := ValidateAddress(u); err == nil {
+			t.Errorf("Expected '%s' rejected", address)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package connections
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Window is a sliding window quantile estimator over durations. It keeps the
+// most recent `Size` samples and, when queried, considers only those
+// recorded within the last `Span`, so the estimate follows the recent
+// behavior of what is being measured while using bounded memory.
+type Window struct {
+	Span time.Duration
+	Size int
+
+	lock    sync.Mutex
+	samples []sample
+	next    int
+}
+
+// sample is a single measurement and when it was recorded
+type sample struct {
+	at    time.Time
+	value time.Duration
+}
+
+// NewWindow creates a window covering the given span that keeps at most size
+// samples
+func NewWindow(span time.Duration, size int) *Window {
+	if size < 1 {
+		size = 1
+	}
+	return &Window{
+		Span:    span,
+		Size:    size,
+		samples: make([]sample, 0, size),
+	}
+}
+
+// Add records a measurement taken at the given time, replacing the oldest
+// sample once the window is full
+func (w *Window) Add(at time.Time, value time.Duration) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.samples) < w.Size {
+		w.samples = append(w.samples, sample{at, value})
+		return
+	}
+	w.samples[w.next] = sample{at, value}
+	w.next = (w.next + 1) % w.Size
+}
+
+// Quantile returns the q quantile, 0 < q <= 1, of the samples recorded within
+// the span ending at the given time, using the nearest rank method, along
+// with the number of samples considered. If there are no such samples zero
+// is returned for both.
+func (w *Window) Quantile(q float64, now time.Time) (time.Duration, int) {
+	w.lock.Lock()
+	values := make([]time.Duration, 0, len(w.samples))
+	since := now.Add(-w.Span)
+	for _, s := range w.samples {
+		if s.at.After(since) {
+			values = append(values, s.value)
+		}
+	}
+	w.lock.Unlock()
+
+	if len(values) == 0 {
+		return 0, 0
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	rank := int(math.Ceil(q * float64(len(values))))
+	if rank < 1 {
+		rank = 1
+	} else if rank > len(values) {
+		rank = len(values)
+	}
+	return values[rank-1], len(values)
+}
@@ -0,0 +1,65 @@
+package connections
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowQuantile(t *testing.T) {
+	w := NewWindow(time.Minute, 1000)
+	now := time.Now()
+	for i := 1; i <= 100; i++ {
+		w.Add(now, time.Duration(i)*time.Millisecond)
+	}
+	for _, test := range []struct {
+		q        float64
+		expected time.Duration
+	}{
+		{0.5, 50 * time.Millisecond},
+		{0.99, 99 * time.Millisecond},
+		{1, 100 * time.Millisecond},
+		{0.001, time.Millisecond},
+	} {
+		value, samples := w.Quantile(test.q, now)
+		if value != test.expected || samples != 100 {
+			t.Errorf("Incorrect %v quantile, expected %v of 100 samples, got %v of %d", test.q, test.expected, value, samples)
+		}
+	}
+}
+
+func TestWindowSlides(t *testing.T) {
+	w := NewWindow(time.Second, 1000)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		w.Add(start, time.Second)
+	}
+	for i := 0; i < 10; i++ {
+		w.Add(start.Add(800*time.Millisecond), time.Millisecond)
+	}
+
+	// Old samples age out of the span
+	if value, samples := w.Quantile(0.99, start.Add(500*time.Millisecond)); value != time.Second || samples != 20 {
+		t.Errorf("Expected p99 of 1s over 20 samples, got %v over %d", value, samples)
+	}
+	if value, samples := w.Quantile(0.99, start.Add(1500*time.Millisecond)); value != time.Millisecond || samples != 10 {
+		t.Errorf("Expected p99 of 1ms over 10 samples, got %v over %d", value, samples)
+	}
+	if value, samples := w.Quantile(0.99, start.Add(time.Hour)); value != 0 || samples != 0 {
+		t.Errorf("Expected empty window, got %v over %d", value, samples)
+	}
+}
+
+func TestWindowBoundedSize(t *testing.T) {
+	w := NewWindow(time.Minute, 10)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		w.Add(now, time.Second)
+	}
+	// The oldest samples are replaced once full
+	for i := 0; i < 10; i++ {
+		w.Add(now, time.Millisecond)
+	}
+	if value, samples := w.Quantile(1, now); value != time.Millisecond || samples != 10 {
+		t.Errorf("Expected max of 1ms over 10 samples, got %v over %d", value, samples)
+	}
+}
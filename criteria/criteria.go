@@ -4,18 +4,586 @@
 // match criteria in the `ovs-ofctl` command.
 package criteria
 
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ciena/oftee/datapath"
+)
+
 // Defines the bit patterns used to indicate which values are set in the
 // match criteria structure.
 const (
-	BitEmpty  = 0x0
-	BitDLType = 1 << 0
+	BitEmpty      = 0x0
+	BitDLType     = 1 << 0
+	BitICMPv6Type = 1 << 1
+	BitPppoeCode  = 1 << 2
+	BitOFType     = 1 << 3
+	BitDLVlan     = 1 << 4
+	BitNwProto    = 1 << 5
+	BitNwSrc      = 1 << 6
+	BitNwDst      = 1 << 7
+	BitTpSrc      = 1 << 8
+	BitTpDst      = 1 << 9
+	BitInPort     = 1 << 10
+	BitDPID       = 1 << 11
+	BitDLSrc      = 1 << 12
+	BitDLDst      = 1 << 13
+
+	// BitsNetwork the values decoded from the IPv4 header of a packet
+	BitsNetwork = BitNwProto | BitNwSrc | BitNwDst
+
+	// BitsTransport the values decoded from the TCP or UDP header of an
+	// IPv4 packet
+	BitsTransport = BitTpSrc | BitTpDst
+
+	// BitsPacket the values decoded from the packet carried by a packet
+	// in
+	BitsPacket = BitDLType | BitDLSrc | BitDLDst | BitICMPv6Type | BitPppoeCode | BitDLVlan | BitsNetwork | BitsTransport
+)
+
+// Ethernet types and ICMPv6 types used by the presets and packet decoding
+const (
+	DlTypeIPv4           = 0x0800
+	DlTypeIPv6           = 0x86dd
+	DlTypePppoeDiscovery = 0x8863
+	DlTypePppoeSession   = 0x8864
+	DlTypeVlan           = 0x8100
+	DlTypeQinQ           = 0x88a8
+
+	ICMPv6TypeRouterSolicitation    = 133
+	ICMPv6TypeRouterAdvertisement   = 134
+	ICMPv6TypeNeighborSolicitation  = 135
+	ICMPv6TypeNeighborAdvertisement = 136
+)
+
+// OpenFlow message types that are delivered to end points. Criteria without
+// an OpenFlow type only match packet ins. The flow and group mods are those
+// sent by the controller to the device, which are only matched by criteria
+// that name them, see `OFTypesController`.
+const (
+	OFTypeError       = 1
+	OFTypePacketIn    = 10
+	OFTypeFlowRemoved = 11
+	OFTypePortStatus  = 12
+	OFTypeFlowMod     = 14
+	OFTypeGroupMod    = 15
+)
+
+// OFTypesController the set of the OpenFlow message types sent by the
+// controller to the device, as bits `1 << type`
+const OFTypesController = 1<<OFTypeFlowMod | 1<<OFTypeGroupMod
+
+// PPPoE discovery stage codes, session stage frames have a code of 0
+const (
+	PppoeCodePADI = 0x09
+	PppoeCodePADO = 0x07
+	PppoeCodePADR = 0x19
+	PppoeCodePADS = 0x65
+	PppoeCodePADT = 0xa7
 )
 
+// dlTypeNames the symbolic names by which Ethernet types may be specified
+var dlTypeNames = map[string]uint16{
+	"ipv4":            DlTypeIPv4,
+	"arp":             0x0806,
+	"vlan":            DlTypeVlan,
+	"ipv6":            DlTypeIPv6,
+	"pppoe_discovery": DlTypePppoeDiscovery,
+	"pppoe_session":   DlTypePppoeSession,
+	"eapol":           0x888e,
+	"lldp":            0x88cc,
+}
+
+// pppoeCodeNames the symbolic names by which PPPoE codes may be specified
+var pppoeCodeNames = map[string]uint8{
+	"padi": PppoeCodePADI,
+	"pado": PppoeCodePADO,
+	"padr": PppoeCodePADR,
+	"pads": PppoeCodePADS,
+	"padt": PppoeCodePADT,
+}
+
+// nwProtoNames the names by which IP protocols may be specified
+var nwProtoNames = map[string]uint8{
+	"icmp": 1,
+	"igmp": 2,
+	"tcp":  6,
+	"udp":  17,
+}
+
+// ofTypeNames the names by which OpenFlow message types may be specified
+var ofTypeNames = map[string]uint8{
+	"error":        OFTypeError,
+	"packet_in":    OFTypePacketIn,
+	"flow_removed": OFTypeFlowRemoved,
+	"port_status":  OFTypePortStatus,
+	"flow_mod":     OFTypeFlowMod,
+	"group_mod":    OFTypeGroupMod,
+}
+
+// namesOf returns the sorted, comma separated, keys of a table of names
+func namesOf(table interface{}) string {
+	var names []string
+	switch table := table.(type) {
+	case map[string]uint16:
+		for name := range table {
+			names = append(names, name)
+		}
+	case map[string]uint8:
+		for name := range table {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// ParseDlType parses an Ethernet type given either as a number, i.e. 0x8863,
+// or by name, i.e. `pppoe_discovery`
+func ParseDlType(value string) (uint16, error) {
+	if dlType, ok := dlTypeNames[strings.ToLower(value)]; ok {
+		return dlType, nil
+	}
+	dlType, err := strconv.ParseUint(value, 0, 16)
+	if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrSyntax {
+		return 0, fmt.Errorf("unknown Ethernet type '%s', expected a number or one of %s", value, namesOf(dlTypeNames))
+	}
+	if err != nil {
+		return 0, err
+	}
+	return uint16(dlType), nil
+}
+
+// ParseDlVlan parses a VLAN ID, a number between 0 and 4095
+func ParseDlVlan(value string) (uint16, error) {
+	vlan, err := strconv.ParseUint(value, 0, 12)
+	if err != nil {
+		return 0, fmt.Errorf("invalid VLAN ID '%s', expected a number between 0 and 4095", value)
+	}
+	return uint16(vlan), nil
+}
+
+// ParsePppoeCode parses a PPPoE code given either as a number or by the name
+// of a discovery stage packet, i.e. `padi`
+func ParsePppoeCode(value string) (uint8, error) {
+	if code, ok := pppoeCodeNames[strings.ToLower(value)]; ok {
+		return code, nil
+	}
+	code, err := strconv.ParseUint(value, 0, 8)
+	if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrSyntax {
+		return 0, fmt.Errorf("unknown PPPoE code '%s', expected a number or one of %s", value, namesOf(pppoeCodeNames))
+	}
+	if err != nil {
+		return 0, err
+	}
+	return uint8(code), nil
+}
+
+// ParseNwProto parses an IP protocol given either as a number, i.e. 17, or by
+// name, i.e. `udp`
+func ParseNwProto(value string) (uint8, error) {
+	if proto, ok := nwProtoNames[strings.ToLower(value)]; ok {
+		return proto, nil
+	}
+	proto, err := strconv.ParseUint(value, 0, 8)
+	if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrSyntax {
+		return 0, fmt.Errorf("unknown IP protocol '%s', expected a number or one of %s", value, namesOf(nwProtoNames))
+	}
+	if err != nil {
+		return 0, err
+	}
+	return uint8(proto), nil
+}
+
+// ParseDlAddr parses an Ethernet address, i.e. `01:80:c2:00:00:0e`, or an
+// address and the mask of the bits of it that are matched, i.e.
+// `01:80:c2:00:00:00/ff:ff:ff:ff:ff:f0`, as with `ovs-ofctl`. Returns the
+// address, under the mask, and the mask, which is all ones unless given.
+func ParseDlAddr(value string) ([6]byte, [6]byte, error) {
+	var addr, mask [6]byte
+	parts := strings.SplitN(value, "/", 2)
+	parsed, err := net.ParseMAC(parts[0])
+	if err != nil || len(parsed) != 6 {
+		return addr, mask, fmt.Errorf("invalid Ethernet address '%s', expected six colon separated hexadecimal bytes", value)
+	}
+	copy(addr[:], parsed)
+	mask = dlAddrAllOnes
+	if len(parts) == 2 {
+		parsed, err = net.ParseMAC(parts[1])
+		if err != nil || len(parsed) != 6 {
+			return addr, mask, fmt.Errorf("invalid Ethernet address mask '%s', expected six colon separated hexadecimal bytes", parts[1])
+		}
+		copy(mask[:], parsed)
+		if mask == ([6]byte{}) {
+			return addr, mask, fmt.Errorf("invalid Ethernet address mask '%s', expected a non zero mask", parts[1])
+		}
+	}
+	for i := range addr {
+		addr[i] &= mask[i]
+	}
+	return addr, mask, nil
+}
+
+// ParseNwAddr parses an IPv4 prefix, i.e. `10.0.0.0/8`, or address, which is
+// the prefix of that one address
+func ParseNwAddr(value string) (net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		ip, prefix, err := net.ParseCIDR(value)
+		if err != nil || ip.To4() == nil {
+			return net.IPNet{}, fmt.Errorf("invalid IPv4 prefix '%s'", value)
+		}
+		return *prefix, nil
+	}
+	ip := net.ParseIP(value).To4()
+	if ip == nil {
+		return net.IPNet{}, fmt.Errorf("invalid IPv4 address '%s'", value)
+	}
+	return net.IPNet{IP: ip, Mask: hostMask}, nil
+}
+
+// ParseTpPort parses a TCP or UDP port, a number between 0 and 65535
+func ParseTpPort(value string) (uint16, error) {
+	port, err := strconv.ParseUint(value, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port '%s', expected a number between 0 and 65535", value)
+	}
+	return uint16(port), nil
+}
+
+// ParseInPort parses the switch port on which a packet was received, a
+// number, i.e. `32`, or a range of ports, i.e. `1-16`, returning the first
+// and last port of the range, which are the same for a single port
+func ParseInPort(value string) (uint32, uint32, error) {
+	parts := strings.SplitN(value, "-", 2)
+	first, err := strconv.ParseUint(parts[0], 0, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port '%s', expected a number or a range of numbers, i.e. 1-16", value)
+	}
+	last := first
+	if len(parts) == 2 {
+		if last, err = strconv.ParseUint(parts[1], 0, 32); err != nil || last < first {
+			return 0, 0, fmt.Errorf("invalid port range '%s', expected the first port followed by the last, i.e. 1-16", value)
+		}
+	}
+	return uint32(first), uint32(last), nil
+}
+
+// ParseDPID parses the DPIDs of the devices from which messages are matched,
+// either a list of DPIDs separated by `,`, i.e. `0x1,0x2`, or a single DPID
+// and the mask of the bits of it that are matched, i.e.
+// `0x0000000100000000/0xffffffff00000000`. DPIDs are given in any of the
+// forms accepted by `datapath.Parse`. Returns the DPIDs and the mask, which
+// is all ones unless given.
+func ParseDPID(value string) ([]uint64, uint64, error) {
+	mask := ^uint64(0)
+	if parts := strings.SplitN(value, "/", 2); len(parts) == 2 {
+		dpid, err := datapath.Parse(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid DPID '%s': %s", parts[0], err)
+		}
+		if mask, err = datapath.Parse(strings.TrimSpace(parts[1])); err != nil || mask == 0 {
+			return nil, 0, fmt.Errorf("invalid DPID mask '%s', expected a non zero hexadecimal mask", parts[1])
+		}
+		return []uint64{dpid & mask}, mask, nil
+	}
+	var dpids []uint64
+	for _, item := range strings.Split(value, ",") {
+		dpid, err := datapath.Parse(strings.TrimSpace(item))
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid DPID '%s': %s", item, err)
+		}
+		dpids = append(dpids, dpid)
+	}
+	return dpids, mask, nil
+}
+
+// ParseOFType parses an OpenFlow message type given by name, i.e. `error`
+func ParseOFType(value string) (uint8, error) {
+	if ofType, ok := ofTypeNames[strings.ToLower(value)]; ok {
+		return ofType, nil
+	}
+	return 0, fmt.Errorf("unknown OpenFlow message type '%s', expected one of %s", value, namesOf(ofTypeNames))
+}
+
+// ParseOFTypes parses a list of OpenFlow message types given by name,
+// separated by `|` or `,`, i.e. `packet_in|port_status`, returning them as
+// the set of `OFTypes`
+func ParseOFTypes(value string) (uint32, error) {
+	var types uint32
+	for _, name := range strings.FieldsFunc(value, func(r rune) bool { return r == '|' || r == ',' }) {
+		ofType, err := ParseOFType(strings.TrimSpace(name))
+		if err != nil {
+			return 0, err
+		}
+		types |= 1 << ofType
+	}
+	if types == 0 {
+		return 0, fmt.Errorf("missing OpenFlow message type, expected one or more of %s", namesOf(ofTypeNames))
+	}
+	return types, nil
+}
+
+// OFTypeName returns the name of an OpenFlow message type that is delivered
+// to end points, or the empty string if it isn't one
+func OFTypeName(ofType uint8) string {
+	for name, t := range ofTypeNames {
+		if t == ofType {
+			return name
+		}
+	}
+	return ""
+}
+
+// ParseTerm parses a match term of an end point specification, i.e.
+// `dl_type=0x888e`, returning the criteria it matches. False is returned if
+// the name is not that of a match term. It is shared by everything that
+// parses match criteria, so that they all accept the same terms.
+//
+// A term negated with `!=`, i.e. `dl_type!=0x88cc`, is split at the `=` as
+// any other, so its name ends with `!`. It matches unless the value matches,
+// see `Criteria.Not`.
+func ParseTerm(name, value string) (Criteria, bool, error) {
+	if negated := strings.TrimSuffix(name, "!"); negated != name {
+		if strings.HasSuffix(negated, "!") {
+			return Criteria{}, false, nil
+		}
+		term, ok, err := ParseTerm(negated, value)
+		if !ok || err != nil {
+			return Criteria{}, ok, err
+		}
+		if len(term.Or) > 0 || term.Set&(term.Set-1) != 0 {
+			return Criteria{}, true, fmt.Errorf("%s can't be negated", strings.ToLower(negated))
+		}
+		return Criteria{Not: []Criteria{term}}, true, nil
+	}
+	switch strings.ToLower(name) {
+	case "dl_type":
+		dlType, err := ParseDlType(value)
+		return Criteria{Set: BitDLType, DlType: dlType}, true, err
+	case "dl_vlan":
+		vlan, err := ParseDlVlan(value)
+		return Criteria{Set: BitDLVlan, DlVlan: vlan}, true, err
+	case "dl_src":
+		addr, mask, err := ParseDlAddr(value)
+		return Criteria{Set: BitDLSrc, DlSrc: addr, DlSrcMask: mask}, true, err
+	case "dl_dst":
+		addr, mask, err := ParseDlAddr(value)
+		return Criteria{Set: BitDLDst, DlDst: addr, DlDstMask: mask}, true, err
+	case "icmpv6_type":
+		icmpType, err := strconv.ParseUint(value, 0, 8)
+		return Criteria{Set: BitICMPv6Type, ICMPv6Type: uint8(icmpType)}, true, err
+	case "pppoe_code":
+		code, err := ParsePppoeCode(value)
+		return Criteria{Set: BitPppoeCode, PppoeCode: code}, true, err
+	case "nw_proto":
+		proto, err := ParseNwProto(value)
+		return Criteria{Set: BitNwProto, NwProto: proto}, true, err
+	case "nw_src":
+		prefix, err := ParseNwAddr(value)
+		return Criteria{Set: BitNwSrc, NwSrc: prefix}, true, err
+	case "nw_dst":
+		prefix, err := ParseNwAddr(value)
+		return Criteria{Set: BitNwDst, NwDst: prefix}, true, err
+	case "tp_src":
+		port, err := ParseTpPort(value)
+		return Criteria{Set: BitTpSrc, TpSrc: port}, true, err
+	case "tp_dst":
+		port, err := ParseTpPort(value)
+		return Criteria{Set: BitTpDst, TpDst: port}, true, err
+	case "in_port":
+		first, last, err := ParseInPort(value)
+		return Criteria{Set: BitInPort, InPort: first, InPortMax: last}, true, err
+	case "dpid":
+		dpids, mask, err := ParseDPID(value)
+		return Criteria{Set: BitDPID, DPIDs: dpids, DPIDMask: mask}, true, err
+	case "of_type":
+		ofTypes, err := ParseOFTypes(value)
+		return Criteria{Set: BitOFType, OFTypes: ofTypes}, true, err
+	case "proto":
+		preset, err := Preset(value)
+		return preset, true, err
+	}
+	return Criteria{}, false, nil
+}
+
+// IsTerm returns true if the name is that of a match term, i.e. `dl_type`
+func IsTerm(name string) bool {
+	_, ok, _ := ParseTerm(name, "")
+	return ok
+}
+
+// ParseGroup parses a match term whose value may be followed by further terms,
+// separated by `,`, and alternatives, separated by `|`, i.e. the `dl_type`
+// term `dl_type=0x0806|dl_type=0x0800,nw_proto=17,tp_dst=67`, which matches
+// ARP packets or DHCP requests. A `,` or `|` only separates terms when it is
+// followed by the name of a match term and `=`, so either can still be used
+// within a value, i.e. `dpid=0x1,0x2|of_type=port_status`. Terms with more
+// than one alternative are returned as a group of alternatives, see
+// `Criteria.Or`, otherwise as the criteria of their single alternative, as
+// `ParseTerm` would.
+func ParseGroup(name, value string) (Criteria, bool, error) {
+	if !IsTerm(name) {
+		return Criteria{}, false, nil
+	}
+	var alternatives []Criteria
+	var alternative Criteria
+	text := name + "=" + value
+	for {
+		end, separator := len(text), byte('|')
+		for i := 0; i < len(text); i++ {
+			if (text[i] == ',' || text[i] == '|') && startsTerm(text[i+1:]) {
+				end, separator = i, text[i]
+				break
+			}
+		}
+		eq := strings.Index(text[:end], "=")
+		term, _, err := ParseTerm(text[:eq], text[eq+1:end])
+		if err == nil {
+			err = alternative.Merge(term)
+		}
+		if err != nil {
+			return Criteria{}, true, err
+		}
+		if separator == '|' {
+			alternatives = append(alternatives, alternative)
+			alternative = Criteria{}
+		}
+		if end == len(text) {
+			break
+		}
+		text = text[end+1:]
+	}
+	if len(alternatives) == 1 {
+		return alternatives[0], true, nil
+	}
+	return Criteria{Or: alternatives}, true, nil
+}
+
+// startsTerm returns true if the text starts with a match term, the name of
+// one followed by `=` or `!=`
+func startsTerm(text string) bool {
+	eq := strings.Index(text, "=")
+	return eq > 0 && IsTerm(text[:eq])
+}
+
+// termNames the names of the match terms, by the bit of the value they set
+var termNames = map[uint64]string{
+	BitDLType:     "dl_type",
+	BitICMPv6Type: "icmpv6_type",
+	BitPppoeCode:  "pppoe_code",
+	BitOFType:     "of_type",
+	BitDLVlan:     "dl_vlan",
+	BitNwProto:    "nw_proto",
+	BitNwSrc:      "nw_src",
+	BitNwDst:      "nw_dst",
+	BitTpSrc:      "tp_src",
+	BitTpDst:      "tp_dst",
+	BitInPort:     "in_port",
+	BitDPID:       "dpid",
+	BitDLSrc:      "dl_src",
+	BitDLDst:      "dl_dst",
+}
+
+// bitNames returns the names of the match terms of the values set in a
+// bit set, in the order of their bits, separated by `, `
+func bitNames(bits uint64) string {
+	var names []string
+	for bit := uint64(1); bit != 0 && bit <= bits; bit <<= 1 {
+		if bits&bit != 0 {
+			names = append(names, termNames[bit])
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
 // Criteria is used to maintain match criteria values along with a bit set to
 // indicate which values are set.
+//
+// `Or` is a group of alternative criteria, at least one of which must match
+// in addition to the values set, i.e. to match any of a number of ICMPv6
+// types. It is only used in target criteria, never in state criteria.
+//
+// `NwSrc` and `NwDst` are the IPv4 prefixes within which the addresses of a
+// packet must be in target criteria, and the addresses themselves, as
+// prefixes of one address, in state criteria.
+//
+// `OFTypes` is the set of OpenFlow message types, as bits `1 << type`, any
+// of which target criteria match. If not set, target criteria match the
+// single `OFType`, which is always that of the message in state criteria.
+//
+// `InPort` is the switch port on which a packet was received, from the match
+// of the packet in, in state criteria. Target criteria match the range of
+// ports from `InPort` to `InPortMax`, or only `InPort` if `InPortMax` is
+// less.
+//
+// `DPID` is that of the device from which a message was received, in state
+// criteria, once it is known. Target criteria match any of `DPIDs`, compared
+// under `DPIDMask`, a mask of all ones if not set.
+//
+// `DlSrc` and `DlDst` are the Ethernet addresses of a packet in state
+// criteria. Target criteria match them under `DlSrcMask` and `DlDstMask`,
+// masks of all ones if not set.
+//
+// `Not` are the negated terms, i.e. `dl_type!=0x88cc`, each criteria of a
+// single value, none of which may match for target criteria to match. A
+// value absent from the state, i.e. the `dl_type` of a message that is not a
+// packet in, never matches, so doesn't exclude it. A value can't be both set
+// and negated, but can be negated more than once. It is only used in target
+// criteria.
 type Criteria struct {
-	Set    uint64
-	DlType uint16
+	Set        uint64
+	DlType     uint16
+	DlSrc      [6]byte
+	DlSrcMask  [6]byte
+	DlDst      [6]byte
+	DlDstMask  [6]byte
+	ICMPv6Type uint8
+	PppoeCode  uint8
+	OFType     uint8
+	OFTypes    uint32
+	DlVlan     uint16
+	NwProto    uint8
+	NwSrc      net.IPNet
+	NwDst      net.IPNet
+	TpSrc      uint16
+	TpDst      uint16
+	InPort     uint32
+	InPortMax  uint32
+	DPID       uint64
+	DPIDs      []uint64
+	DPIDMask   uint64
+	Or         []Criteria
+	Not        []Criteria
+}
+
+// Bits returns the values set in the criteria, or in any of its alternatives
+// or negated terms, which are those that must be known to match it
+func (c *Criteria) Bits() uint64 {
+	return c.matchedBits() | c.negatedBits()
+}
+
+// matchedBits returns the values set in the criteria, or in any of its
+// alternatives
+func (c *Criteria) matchedBits() uint64 {
+	bits := c.Set
+	for i := range c.Or {
+		bits |= c.Or[i].Bits()
+	}
+	return bits
+}
+
+// negatedBits returns the values of the negated terms of the criteria
+func (c *Criteria) negatedBits() uint64 {
+	var bits uint64
+	for i := range c.Not {
+		bits |= c.Not[i].Set
+	}
+	return bits
 }
 
 // Match compares match criteria against a given criteria to determine if there
@@ -23,10 +591,433 @@ type Criteria struct {
 // as when all the values set in the target criteria are included in the the
 // state criteria and their values are equal. The state criteria may have
 // additional values that are not in the target criteria and the values will
-// still be considered matched.
+// still be considered matched. The addresses of the state criteria match if
+// they are within the prefixes of the target criteria.
+//
+// The OpenFlow message type is the exception, as other messages are only
+// delivered to end points that ask for them. Criteria, or state, without an
+// OpenFlow type is that of a packet in. Other messages carry no packet, so
+// only their type, and the device they are from, is matched. Criteria that
+// negate the OpenFlow type match any type sent by the device other than those
+// negated, and criteria with alternatives, but without a type, match the
+// types of their alternatives.
 func (c *Criteria) Match(state Criteria) bool {
+	ofTypes := c.ofTypes()
+	if c.negatedBits()&BitOFType > 0 {
+		ofTypes = ^uint32(OFTypesController)
+	} else if c.Set&BitOFType == 0 && len(c.Or) > 0 {
+		ofTypes = ^uint32(0)
+	}
+	if ofTypes&(1<<state.ofType()) == 0 {
+		return false
+	}
+	if !c.matchValues(state) {
+		return false
+	}
+	for i := range c.Not {
+		if c.Not[i].excludes(state) {
+			return false
+		}
+	}
+	if len(c.Or) == 0 {
+		return true
+	}
+	for i := range c.Or {
+		if c.Or[i].Match(state) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludes returns true if the value of a negated term matches the state, so
+// the criteria of which it is a negated term don't match
+func (c *Criteria) excludes(state Criteria) bool {
+	if c.Set&BitOFType > 0 {
+		return c.ofTypes()&(1<<state.ofType()) != 0
+	}
+	return (c.Set&BitDPID > 0 || state.ofType() == OFTypePacketIn) && c.matchValues(state)
+}
+
+// matchValues returns true if the values set in the criteria, other than the
+// OpenFlow type, match those of the state. Only the DPID is matched for a
+// message that is not a packet in.
+func (c *Criteria) matchValues(state Criteria) bool {
+	if c.Set&BitDPID > 0 && (state.Set&BitDPID == 0 || !c.matchDPID(state.DPID)) {
+		return false
+	}
+	if state.ofType() != OFTypePacketIn {
+		return true
+	}
 	if c.Set&BitDLType > 0 && (state.Set&BitDLType == 0 || c.DlType != state.DlType) {
 		return false
 	}
+	if c.Set&BitICMPv6Type > 0 && (state.Set&BitICMPv6Type == 0 || c.ICMPv6Type != state.ICMPv6Type) {
+		return false
+	}
+	if c.Set&BitPppoeCode > 0 && (state.Set&BitPppoeCode == 0 || c.PppoeCode != state.PppoeCode) {
+		return false
+	}
+	if c.Set&BitDLVlan > 0 && (state.Set&BitDLVlan == 0 || c.DlVlan != state.DlVlan) {
+		return false
+	}
+	if c.Set&BitDLSrc > 0 && (state.Set&BitDLSrc == 0 || !matchDlAddr(c.DlSrc, c.DlSrcMask, state.DlSrc)) {
+		return false
+	}
+	if c.Set&BitDLDst > 0 && (state.Set&BitDLDst == 0 || !matchDlAddr(c.DlDst, c.DlDstMask, state.DlDst)) {
+		return false
+	}
+	if c.Set&BitNwProto > 0 && (state.Set&BitNwProto == 0 || c.NwProto != state.NwProto) {
+		return false
+	}
+	if c.Set&BitNwSrc > 0 && (state.Set&BitNwSrc == 0 || !c.NwSrc.Contains(state.NwSrc.IP)) {
+		return false
+	}
+	if c.Set&BitNwDst > 0 && (state.Set&BitNwDst == 0 || !c.NwDst.Contains(state.NwDst.IP)) {
+		return false
+	}
+	if c.Set&BitTpSrc > 0 && (state.Set&BitTpSrc == 0 || c.TpSrc != state.TpSrc) {
+		return false
+	}
+	if c.Set&BitTpDst > 0 && (state.Set&BitTpDst == 0 || c.TpDst != state.TpDst) {
+		return false
+	}
+	if c.Set&BitInPort > 0 && (state.Set&BitInPort == 0 || state.InPort < c.InPort || state.InPort > c.inPortMax()) {
+		return false
+	}
 	return true
 }
+
+// dlAddrAllOnes the mask under which Ethernet addresses are matched unless
+// one is set
+var dlAddrAllOnes = [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// matchDlAddr returns true if an Ethernet address is that of the criteria,
+// under its mask, all ones if not set
+func matchDlAddr(match, mask, addr [6]byte) bool {
+	if mask == ([6]byte{}) {
+		mask = dlAddrAllOnes
+	}
+	for i := range addr {
+		if addr[i]&mask[i] != match[i]&mask[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// dlAddr returns an Ethernet address as the value of a `dl_src`, or
+// `dl_dst`, term, with its mask unless that is all ones, or not set
+func dlAddr(addr, mask [6]byte) string {
+	formatted := net.HardwareAddr(addr[:]).String()
+	if mask == ([6]byte{}) || mask == dlAddrAllOnes {
+		return formatted
+	}
+	return formatted + "/" + net.HardwareAddr(mask[:]).String()
+}
+
+// inPortMax returns the last port of the range of ports of the criteria
+func (c *Criteria) inPortMax() uint32 {
+	if c.InPortMax < c.InPort {
+		return c.InPort
+	}
+	return c.InPortMax
+}
+
+// inPorts returns the range of ports of the criteria, i.e. `1-16`, or the
+// single port
+func (c *Criteria) inPorts() string {
+	if last := c.inPortMax(); last != c.InPort {
+		return fmt.Sprintf("%d-%d", c.InPort, last)
+	}
+	return strconv.FormatUint(uint64(c.InPort), 10)
+}
+
+// matchDPID returns true if a DPID is any of those of the criteria, under its
+// mask
+func (c *Criteria) matchDPID(dpid uint64) bool {
+	mask := c.dpidMask()
+	for _, match := range c.DPIDs {
+		if dpid&mask == match&mask {
+			return true
+		}
+	}
+	return false
+}
+
+// dpidMask returns the mask under which DPIDs are matched, all ones unless
+// set
+func (c *Criteria) dpidMask() uint64 {
+	if c.DPIDMask == 0 {
+		return ^uint64(0)
+	}
+	return c.DPIDMask
+}
+
+// dpids returns the DPIDs of the criteria as the value of a `dpid` term, that
+// of state criteria if there are none
+func (c *Criteria) dpids() string {
+	if len(c.DPIDs) == 0 {
+		return datapath.Format(c.DPID)
+	}
+	if mask := c.dpidMask(); mask != ^uint64(0) && len(c.DPIDs) == 1 {
+		return fmt.Sprintf("%s/0x%016x", datapath.Format(c.DPIDs[0]), mask)
+	}
+	formatted := make([]string, len(c.DPIDs))
+	for i, dpid := range c.DPIDs {
+		formatted[i] = datapath.Format(dpid)
+	}
+	return strings.Join(formatted, ",")
+}
+
+// MatchedOFTypes returns the set of OpenFlow message types, as bits `1 << type`,
+// that the criteria may match, see `Match`
+func (c *Criteria) MatchedOFTypes() uint32 {
+	if c.Set&BitOFType == 0 && len(c.Or) > 0 {
+		var ofTypes uint32
+		for i := range c.Or {
+			ofTypes |= c.Or[i].MatchedOFTypes()
+		}
+		return ofTypes
+	}
+	ofTypes := c.ofTypes()
+	if c.negatedBits()&BitOFType > 0 {
+		ofTypes = ^uint32(OFTypesController)
+	}
+	for i := range c.Not {
+		if c.Not[i].Set&BitOFType > 0 {
+			ofTypes &^= c.Not[i].ofTypes()
+		}
+	}
+	return ofTypes
+}
+
+// ofType returns the OpenFlow message type of the criteria, a packet in
+// unless one is set
+func (c *Criteria) ofType() uint8 {
+	if c.Set&BitOFType == 0 {
+		return OFTypePacketIn
+	}
+	return c.OFType
+}
+
+// ofTypes returns the set of OpenFlow message types of the criteria, only
+// that of a packet in unless any are set
+func (c *Criteria) ofTypes() uint32 {
+	if c.Set&BitOFType != 0 && c.OFTypes != 0 {
+		return c.OFTypes
+	}
+	return 1 << c.ofType()
+}
+
+// ofTypeNames returns the OpenFlow message types of the criteria by name,
+// separated by `|`, in the order of their types
+func (c *Criteria) ofTypeNames() string {
+	var names []string
+	types := c.ofTypes()
+	for ofType := uint(0); ofType < 32; ofType++ {
+		if types&(1<<ofType) == 0 {
+			continue
+		}
+		name := OFTypeName(uint8(ofType))
+		if name == "" {
+			name = strconv.Itoa(int(ofType))
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, "|")
+}
+
+// presets the criteria to which the values of the `proto` term expand
+var presets = map[string]Criteria{
+	// IPv6 neighbor discovery, router and neighbor solicitations and
+	// advertisements
+	"nd": {
+		Set:    BitDLType,
+		DlType: DlTypeIPv6,
+		Or: []Criteria{
+			{Set: BitICMPv6Type, ICMPv6Type: ICMPv6TypeRouterSolicitation},
+			{Set: BitICMPv6Type, ICMPv6Type: ICMPv6TypeRouterAdvertisement},
+			{Set: BitICMPv6Type, ICMPv6Type: ICMPv6TypeNeighborSolicitation},
+			{Set: BitICMPv6Type, ICMPv6Type: ICMPv6TypeNeighborAdvertisement},
+		},
+	},
+}
+
+// Preset returns the criteria to which the named preset expands
+func Preset(name string) (Criteria, error) {
+	preset, ok := presets[strings.ToLower(name)]
+	if !ok {
+		names := make([]string, 0, len(presets))
+		for name := range presets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return Criteria{}, fmt.Errorf("unknown protocol preset '%s', expected one of %s", name, strings.Join(names, ", "))
+	}
+	return preset, nil
+}
+
+// Merge adds the values set in the given criteria to the criteria. A value
+// set in both to different values, or alternatives in both, can never match
+// and is an error, as is a value set in one and negated in the other.
+func (c *Criteria) Merge(other Criteria) error {
+	if both := c.matchedBits()&other.negatedBits() | c.negatedBits()&other.matchedBits(); both != 0 {
+		return fmt.Errorf("%s can't be both matched and negated", bitNames(both))
+	}
+	if c.Set&other.Set&BitDLType > 0 && c.DlType != other.DlType {
+		return fmt.Errorf("conflicting dl_type 0x%04x and 0x%04x", c.DlType, other.DlType)
+	}
+	if c.Set&other.Set&BitICMPv6Type > 0 && c.ICMPv6Type != other.ICMPv6Type {
+		return fmt.Errorf("conflicting icmpv6_type %d and %d", c.ICMPv6Type, other.ICMPv6Type)
+	}
+	if c.Set&other.Set&BitPppoeCode > 0 && c.PppoeCode != other.PppoeCode {
+		return fmt.Errorf("conflicting pppoe_code 0x%02x and 0x%02x", c.PppoeCode, other.PppoeCode)
+	}
+	if c.Set&other.Set&BitOFType > 0 && c.ofTypes() != other.ofTypes() {
+		return fmt.Errorf("conflicting of_type %s and %s", c.ofTypeNames(), other.ofTypeNames())
+	}
+	if c.Set&other.Set&BitDLVlan > 0 && c.DlVlan != other.DlVlan {
+		return fmt.Errorf("conflicting dl_vlan %d and %d", c.DlVlan, other.DlVlan)
+	}
+	if c.Set&other.Set&BitDLSrc > 0 && dlAddr(c.DlSrc, c.DlSrcMask) != dlAddr(other.DlSrc, other.DlSrcMask) {
+		return fmt.Errorf("conflicting dl_src %s and %s", dlAddr(c.DlSrc, c.DlSrcMask), dlAddr(other.DlSrc, other.DlSrcMask))
+	}
+	if c.Set&other.Set&BitDLDst > 0 && dlAddr(c.DlDst, c.DlDstMask) != dlAddr(other.DlDst, other.DlDstMask) {
+		return fmt.Errorf("conflicting dl_dst %s and %s", dlAddr(c.DlDst, c.DlDstMask), dlAddr(other.DlDst, other.DlDstMask))
+	}
+	if c.Set&other.Set&BitNwProto > 0 && c.NwProto != other.NwProto {
+		return fmt.Errorf("conflicting nw_proto %d and %d", c.NwProto, other.NwProto)
+	}
+	if c.Set&other.Set&BitNwSrc > 0 && c.NwSrc.String() != other.NwSrc.String() {
+		return fmt.Errorf("conflicting nw_src %s and %s", &c.NwSrc, &other.NwSrc)
+	}
+	if c.Set&other.Set&BitNwDst > 0 && c.NwDst.String() != other.NwDst.String() {
+		return fmt.Errorf("conflicting nw_dst %s and %s", &c.NwDst, &other.NwDst)
+	}
+	if c.Set&other.Set&BitTpSrc > 0 && c.TpSrc != other.TpSrc {
+		return fmt.Errorf("conflicting tp_src %d and %d", c.TpSrc, other.TpSrc)
+	}
+	if c.Set&other.Set&BitTpDst > 0 && c.TpDst != other.TpDst {
+		return fmt.Errorf("conflicting tp_dst %d and %d", c.TpDst, other.TpDst)
+	}
+	if c.Set&other.Set&BitInPort > 0 && c.inPorts() != other.inPorts() {
+		return fmt.Errorf("conflicting in_port %s and %s", c.inPorts(), other.inPorts())
+	}
+	if c.Set&other.Set&BitDPID > 0 && c.dpids() != other.dpids() {
+		return fmt.Errorf("conflicting dpid %s and %s", c.dpids(), other.dpids())
+	}
+	if len(c.Or) > 0 && len(other.Or) > 0 {
+		return errors.New("only one group of alternatives is supported")
+	}
+	if other.Set&BitDLType > 0 {
+		c.DlType = other.DlType
+	}
+	if other.Set&BitICMPv6Type > 0 {
+		c.ICMPv6Type = other.ICMPv6Type
+	}
+	if other.Set&BitPppoeCode > 0 {
+		c.PppoeCode = other.PppoeCode
+	}
+	if other.Set&BitOFType > 0 {
+		c.OFType = other.OFType
+		c.OFTypes = other.OFTypes
+	}
+	if other.Set&BitDLVlan > 0 {
+		c.DlVlan = other.DlVlan
+	}
+	if other.Set&BitDLSrc > 0 {
+		c.DlSrc, c.DlSrcMask = other.DlSrc, other.DlSrcMask
+	}
+	if other.Set&BitDLDst > 0 {
+		c.DlDst, c.DlDstMask = other.DlDst, other.DlDstMask
+	}
+	if other.Set&BitNwProto > 0 {
+		c.NwProto = other.NwProto
+	}
+	if other.Set&BitNwSrc > 0 {
+		c.NwSrc = other.NwSrc
+	}
+	if other.Set&BitNwDst > 0 {
+		c.NwDst = other.NwDst
+	}
+	if other.Set&BitTpSrc > 0 {
+		c.TpSrc = other.TpSrc
+	}
+	if other.Set&BitTpDst > 0 {
+		c.TpDst = other.TpDst
+	}
+	if other.Set&BitInPort > 0 {
+		c.InPort, c.InPortMax = other.InPort, other.InPortMax
+	}
+	if other.Set&BitDPID > 0 {
+		c.DPID, c.DPIDs, c.DPIDMask = other.DPID, other.DPIDs, other.DPIDMask
+	}
+	c.Set |= other.Set
+	if len(other.Or) > 0 {
+		c.Or = other.Or
+	}
+	c.Not = append(c.Not, other.Not...)
+	return nil
+}
+
+// String returns the criteria as the match terms of an end point
+// specification, i.e. `dl_type=0x86dd;icmpv6_type=135`. A group of
+// alternatives is written as `(a|b)`, which can't be used in a specification.
+// Negated terms follow the others, i.e. `dl_type!=0x88cc`.
+func (c Criteria) String() string {
+	var terms []string
+	if c.Set&BitDLType > 0 {
+		terms = append(terms, fmt.Sprintf("dl_type=0x%04x", c.DlType))
+	}
+	if c.Set&BitDLSrc > 0 {
+		terms = append(terms, "dl_src="+dlAddr(c.DlSrc, c.DlSrcMask))
+	}
+	if c.Set&BitDLDst > 0 {
+		terms = append(terms, "dl_dst="+dlAddr(c.DlDst, c.DlDstMask))
+	}
+	if c.Set&BitDLVlan > 0 {
+		terms = append(terms, fmt.Sprintf("dl_vlan=%d", c.DlVlan))
+	}
+	if c.Set&BitICMPv6Type > 0 {
+		terms = append(terms, fmt.Sprintf("icmpv6_type=%d", c.ICMPv6Type))
+	}
+	if c.Set&BitPppoeCode > 0 {
+		terms = append(terms, fmt.Sprintf("pppoe_code=0x%02x", c.PppoeCode))
+	}
+	if c.Set&BitNwProto > 0 {
+		terms = append(terms, fmt.Sprintf("nw_proto=%d", c.NwProto))
+	}
+	if c.Set&BitNwSrc > 0 {
+		terms = append(terms, "nw_src="+c.NwSrc.String())
+	}
+	if c.Set&BitNwDst > 0 {
+		terms = append(terms, "nw_dst="+c.NwDst.String())
+	}
+	if c.Set&BitTpSrc > 0 {
+		terms = append(terms, fmt.Sprintf("tp_src=%d", c.TpSrc))
+	}
+	if c.Set&BitTpDst > 0 {
+		terms = append(terms, fmt.Sprintf("tp_dst=%d", c.TpDst))
+	}
+	if c.Set&BitInPort > 0 {
+		terms = append(terms, "in_port="+c.inPorts())
+	}
+	if c.Set&BitDPID > 0 {
+		terms = append(terms, "dpid="+c.dpids())
+	}
+	if c.Set&BitOFType > 0 {
+		terms = append(terms, "of_type="+c.ofTypeNames())
+	}
+	if len(c.Or) > 0 {
+		alternatives := make([]string, len(c.Or))
+		for i, alternative := range c.Or {
+			alternatives[i] = alternative.String()
+		}
+		terms = append(terms, "("+strings.Join(alternatives, "|")+")")
+	}
+	for _, negated := range c.Not {
+		terms = append(terms, strings.Replace(negated.String(), "=", "!=", 1))
+	}
+	return strings.Join(terms, ";")
+}
@@ -1,6 +1,7 @@
 package criteria
 
 import (
+	"net"
 	"testing"
 )
 
@@ -61,3 +62,448 @@ func TestDiffDlTypeMatch(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestOrMatch(t *testing.T) {
+	c1 := Criteria{
+		Set:    BitDLType,
+		DlType: DlTypeIPv6,
+		Or: []Criteria{
+			{Set: BitICMPv6Type, ICMPv6Type: 133},
+			{Set: BitICMPv6Type, ICMPv6Type: 135},
+		},
+	}
+
+	if !c1.Match(Criteria{Set: BitDLType | BitICMPv6Type, DlType: DlTypeIPv6, ICMPv6Type: 135}) {
+		t.Error("Expected match of one of the alternatives")
+	}
+	if c1.Match(Criteria{Set: BitDLType | BitICMPv6Type, DlType: DlTypeIPv6, ICMPv6Type: 134}) {
+		t.Error("Expected no match of none of the alternatives")
+	}
+	if c1.Match(Criteria{Set: BitDLType | BitICMPv6Type, DlType: 0x0800, ICMPv6Type: 133}) {
+		t.Error("Expected no match when a value outside the group differs")
+	}
+}
+
+func TestBits(t *testing.T) {
+	c := Criteria{
+		Set:    BitDLType,
+		DlType: DlTypeIPv6,
+		Or: []Criteria{
+			{Set: BitICMPv6Type, ICMPv6Type: 133},
+			{Set: BitInPort, InPort: 1},
+		},
+	}
+	if bits := c.Bits(); bits != BitDLType|BitICMPv6Type|BitInPort {
+		t.Errorf("Expected the values of the criteria and its alternatives, got 0x%x", bits)
+	}
+	if bits := (&Criteria{}).Bits(); bits != BitEmpty {
+		t.Errorf("Expected no values, got 0x%x", bits)
+	}
+}
+
+func TestDLVlanMatch(t *testing.T) {
+	target := Criteria{Set: BitDLType | BitDLVlan, DlType: 0x8100, DlVlan: 1000}
+	tagged := Criteria{Set: BitDLType | BitDLVlan, DlType: 0x8100, DlVlan: 1000}
+	other := Criteria{Set: BitDLType | BitDLVlan, DlType: 0x8100, DlVlan: 2000}
+	untagged := Criteria{Set: BitDLType, DlType: 0x0800}
+	any := Criteria{}
+
+	if !target.Match(tagged) || target.Match(other) || target.Match(untagged) {
+		t.Error("Expected only packets tagged with VLAN 1000 to match")
+	}
+	if !any.Match(tagged) || !any.Match(untagged) {
+		t.Error("Expected criteria without dl_vlan to match tagged and untagged packets")
+	}
+	if _, err := ParseDlVlan("4096"); err == nil {
+		t.Error("Expected VLAN ID out of range rejected")
+	}
+	if err := target.Merge(Criteria{Set: BitDLVlan, DlVlan: 2000}); err == nil {
+		t.Error("Expected error merging conflicting dl_vlan")
+	}
+}
+
+func TestInPortMatch(t *testing.T) {
+	port, _, _ := ParseTerm("in_port", "32")
+	ports, _, _ := ParseTerm("in_port", "1-16")
+	for _, test := range []struct {
+		state         Criteria
+		port, inRange bool
+	}{
+		{Criteria{Set: BitDLType | BitInPort, DlType: 0x0800, InPort: 32}, true, false},
+		{Criteria{Set: BitDLType | BitInPort, DlType: 0x0800, InPort: 1}, false, true},
+		{Criteria{Set: BitDLType | BitInPort, DlType: 0x0800, InPort: 16}, false, true},
+		{Criteria{Set: BitDLType | BitInPort, DlType: 0x0800, InPort: 17}, false, false},
+		{Criteria{Set: BitDLType, DlType: 0x0800}, false, false},
+	} {
+		if port.Match(test.state) != test.port || ports.Match(test.state) != test.inRange {
+			t.Errorf("Expected %s to match in_port=32 %t and in_port=1-16 %t", test.state, test.port, test.inRange)
+		}
+	}
+	if err := port.Merge(ports); err == nil {
+		t.Error("Expected error merging conflicting in_port")
+	}
+	for _, value := range []string{"port", "16-1", "1-", "4294967296"} {
+		if _, _, err := ParseInPort(value); err == nil {
+			t.Errorf("Expected in_port '%s' rejected", value)
+		}
+	}
+}
+
+func TestDPIDMatch(t *testing.T) {
+	one, _, _ := ParseTerm("dpid", "0x0000000000000001")
+	list, _, _ := ParseTerm("dpid", "0x1, 0x2")
+	masked, _, _ := ParseTerm("dpid", "0x0000000100000000/0xffffffff00000000")
+	for _, test := range []struct {
+		state               Criteria
+		one, list, inMasked bool
+	}{
+		{Criteria{Set: BitDLType | BitDPID, DlType: 0x0800, DPID: 1}, true, true, false},
+		{Criteria{Set: BitDLType | BitDPID, DlType: 0x0800, DPID: 2}, false, true, false},
+		{Criteria{Set: BitDLType | BitDPID, DlType: 0x0800, DPID: 0x0000000100000003}, false, false, true},
+		{Criteria{Set: BitOFType | BitDPID, OFType: OFTypeError, DPID: 1}, false, false, false},
+		{Criteria{Set: BitDLType, DlType: 0x0800}, false, false, false},
+	} {
+		if one.Match(test.state) != test.one || list.Match(test.state) != test.list || masked.Match(test.state) != test.inMasked {
+			t.Errorf("Expected %s to match dpid=0x1 %t, dpid=0x1,0x2 %t and masked %t", test.state, test.one, test.list, test.inMasked)
+		}
+	}
+	errors, _, _ := ParseTerm("of_type", "error")
+	if err := errors.Merge(one); err != nil {
+		t.Fatalf("Unexpected error merging dpid: %s", err)
+	}
+	if !errors.Match(Criteria{Set: BitOFType | BitDPID, OFType: OFTypeError, DPID: 1}) ||
+		errors.Match(Criteria{Set: BitOFType | BitDPID, OFType: OFTypeError, DPID: 2}) {
+		t.Error("Expected messages other than packet ins matched by dpid")
+	}
+	if err := one.Merge(list); err == nil {
+		t.Error("Expected error merging conflicting dpid")
+	}
+	for _, value := range []string{"switch", "0x1,", "0x1/0x0", "0x1/mask"} {
+		if _, _, err := ParseDPID(value); err == nil {
+			t.Errorf("Expected dpid '%s' rejected", value)
+		}
+	}
+}
+
+func TestDLAddrMatch(t *testing.T) {
+	lldp, _, _ := ParseTerm("dl_dst", "01:80:C2:00:00:0e")
+	reserved, _, _ := ParseTerm("dl_dst", "01:80:c2:00:00:00/ff:ff:ff:ff:ff:f0")
+	source, _, _ := ParseTerm("dl_src", "00:11:22:33:44:55")
+	state := func(src, dst string) Criteria {
+		c := Criteria{Set: BitDLType | BitDLSrc | BitDLDst, DlType: 0x88cc}
+		s, _ := net.ParseMAC(src)
+		d, _ := net.ParseMAC(dst)
+		copy(c.DlSrc[:], s)
+		copy(c.DlDst[:], d)
+		return c
+	}
+	for _, test := range []struct {
+		state                    Criteria
+		lldp, reserved, inSource bool
+	}{
+		{state("00:11:22:33:44:55", "01:80:c2:00:00:0e"), true, true, true},
+		{state("00:11:22:33:44:56", "01:80:c2:00:00:02"), false, true, false},
+		{state("00:11:22:33:44:55", "01:80:c2:00:00:10"), false, false, true},
+		{Criteria{Set: BitDLType, DlType: 0x88cc}, false, false, false},
+	} {
+		if lldp.Match(test.state) != test.lldp || reserved.Match(test.state) != test.reserved || source.Match(test.state) != test.inSource {
+			t.Errorf("Expected %s to match LLDP %t, reserved %t and source %t", test.state, test.lldp, test.reserved, test.inSource)
+		}
+	}
+	if err := reserved.Merge(source); err != nil || !reserved.Match(state("00:11:22:33:44:55", "01:80:c2:00:00:01")) {
+		t.Errorf("Expected dl_src merged, got %s (%v)", reserved, err)
+	}
+	if err := reserved.Merge(lldp); err == nil {
+		t.Error("Expected error merging conflicting dl_dst")
+	}
+	for _, value := range []string{"00:11:22:33:44", "00:11:22:33:44:gg", "00:11:22:33:44:55/0", "00:11:22:33:44:55/00:00:00:00:00:00", "00:11:22:33:44:55:66:77"} {
+		if _, _, err := ParseDlAddr(value); err == nil {
+			t.Errorf("Expected Ethernet address '%s' rejected", value)
+		}
+	}
+}
+
+func TestOFTypeMatch(t *testing.T) {
+	packetIn := Criteria{Set: BitDLType, DlType: 0x888e}
+	deviceError := Criteria{Set: BitOFType, OFType: OFTypeError}
+
+	// Criteria without an OpenFlow type, even none at all, only match
+	// packet ins
+	for _, c := range []Criteria{{}, {Set: BitDLType, DlType: 0x888e}} {
+		if !c.Match(packetIn) || c.Match(deviceError) {
+			t.Errorf("Expected %+v to only match packet ins", c)
+		}
+	}
+
+	errors := Criteria{Set: BitOFType, OFType: OFTypeError}
+	if !errors.Match(deviceError) || errors.Match(packetIn) {
+		t.Error("Expected of_type=error to only match errors")
+	}
+	packetIns := Criteria{Set: BitOFType | BitDLType, OFType: OFTypePacketIn, DlType: 0x888e}
+	if !packetIns.Match(packetIn) || packetIns.Match(deviceError) {
+		t.Error("Expected of_type=packet_in to only match packet ins")
+	}
+
+	if ofType, err := ParseOFType("ERROR"); err != nil || ofType != OFTypeError {
+		t.Errorf("Expected error type, got %d, %v", ofType, err)
+	}
+	if _, err := ParseOFType("packet_out"); err == nil || err.Error() !=
+		"unknown OpenFlow message type 'packet_out', expected one of error, flow_mod, flow_removed, group_mod, packet_in, port_status" {
+		t.Errorf("Expected unknown type error, got %v", err)
+	}
+}
+
+func TestControllerOFTypesMatch(t *testing.T) {
+	flowMod := Criteria{Set: BitOFType | BitDPID, OFType: OFTypeFlowMod, DPID: 0x1}
+	deviceError := Criteria{Set: BitOFType | BitDPID, OFType: OFTypeError, DPID: 0x1}
+
+	// The messages of the controller are only matched by criteria that
+	// name them, not by those that negate other types
+	flowMods := Criteria{Set: BitOFType, OFType: OFTypeFlowMod}
+	for _, c := range []struct {
+		criteria Criteria
+		expected bool
+	}{
+		{Criteria{Set: BitOFType, OFTypes: 1<<OFTypeFlowMod | 1<<OFTypeGroupMod}, true},
+		{Criteria{Set: BitOFType | BitDPID, OFType: OFTypeFlowMod, DPIDs: []uint64{0x1}}, true},
+		{Criteria{Set: BitOFType | BitDPID, OFType: OFTypeFlowMod, DPIDs: []uint64{0x2}}, false},
+		{Criteria{Set: BitOFType, OFType: OFTypeGroupMod}, false},
+		{Criteria{Not: []Criteria{{Set: BitOFType, OFType: OFTypeError}}}, false},
+		{Criteria{Or: []Criteria{flowMods, {Set: BitOFType, OFType: OFTypeError}}}, true},
+		{Criteria{Or: []Criteria{{Set: BitDLType, DlType: 0x0806}, {Set: BitOFType, OFType: OFTypePortStatus}}}, false},
+	} {
+		if c.criteria.Match(flowMod) != c.expected {
+			t.Errorf("Expected %s to match a flow mod %t", c.criteria.String(), c.expected)
+		}
+	}
+	notErrors := Criteria{Not: []Criteria{{Set: BitOFType, OFType: OFTypeError}}}
+	if notErrors.Match(deviceError) || !notErrors.Match(Criteria{Set: BitOFType, OFType: OFTypePortStatus}) {
+		t.Error("Expected of_type!=error to match the other messages of the device")
+	}
+
+	of := func(types ...uint8) uint32 {
+		var set uint32
+		for _, t := range types {
+			set |= 1 << t
+		}
+		return set
+	}
+	for _, c := range []struct {
+		criteria Criteria
+		expected uint32
+	}{
+		{Criteria{}, of(OFTypePacketIn)},
+		{Criteria{Set: BitOFType, OFTypes: of(OFTypeFlowMod, OFTypeGroupMod)}, OFTypesController},
+		{Criteria{Not: []Criteria{{Set: BitOFType, OFType: OFTypeError}}}, ^uint32(OFTypesController) &^ of(OFTypeError)},
+		{Criteria{Or: []Criteria{{Set: BitOFType, OFType: OFTypeFlowMod}, {Set: BitDLType, DlType: 0x0806}}}, of(OFTypeFlowMod, OFTypePacketIn)},
+	} {
+		if types := c.criteria.MatchedOFTypes(); types != c.expected {
+			t.Errorf("Expected %+v to match types %x, got %x", c.criteria, c.expected, types)
+		}
+	}
+}
+
+func TestOFTypesMatch(t *testing.T) {
+	packetIn := Criteria{Set: BitDLType, DlType: 0x888e}
+	flowRemoved := Criteria{Set: BitOFType, OFType: OFTypeFlowRemoved}
+	portStatus := Criteria{Set: BitOFType, OFType: OFTypePortStatus}
+
+	// Match terms other than the OpenFlow type only apply to packet ins
+	c, _, err := ParseTerm("of_type", "packet_in|flow_removed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Merge(Criteria{Set: BitDLType, DlType: 0x888e}); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Match(packetIn) || c.Match(Criteria{Set: BitDLType, DlType: 0x0806}) ||
+		!c.Match(flowRemoved) || c.Match(portStatus) {
+		t.Errorf("Expected %s to match EAPOL packet ins and flow removed messages", c)
+	}
+	if s := c.String(); s != "dl_type=0x888e;of_type=packet_in|flow_removed" {
+		t.Errorf("Incorrect criteria, got %s", s)
+	}
+
+	// Types may be separated by commas, where a specification isn't
+	if c, _, err = ParseTerm("of_type", "port_status,packet_in"); err != nil || c.OFTypes != 1<<OFTypePacketIn|1<<OFTypePortStatus {
+		t.Errorf("Expected packet ins and port status messages, got %s (%v)", c, err)
+	}
+	for _, value := range []string{"", "|", "packet_in|packet_out"} {
+		if _, _, err = ParseTerm("of_type", value); err == nil {
+			t.Errorf("Expected of_type '%s' rejected", value)
+		}
+	}
+	other, _, _ := ParseTerm("of_type", "port_status")
+	if err = c.Merge(other); err == nil {
+		t.Error("Expected error merging conflicting of_type")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	nd, _ := Preset("nd")
+	c1 := Criteria{Set: BitDLType, DlType: DlTypeIPv6}
+	if err := c1.Merge(nd); err != nil || len(c1.Or) != 4 {
+		t.Errorf("Expected preset merged, got %+v, %v", c1, err)
+	}
+	if err := c1.Merge(Criteria{Set: BitICMPv6Type, ICMPv6Type: 135}); err != nil ||
+		c1.Set != BitDLType|BitICMPv6Type {
+		t.Errorf("Expected ICMPv6 type merged, got %+v, %v", c1, err)
+	}
+
+	c2 := Criteria{Set: BitDLType, DlType: 0x0800}
+	if err := c2.Merge(nd); err == nil {
+		t.Error("Expected error merging conflicting dl_type")
+	}
+	if err := c1.Merge(nd); err == nil {
+		t.Error("Expected error merging a second group of alternatives")
+	}
+
+	c3, _, _ := ParseTerm("nw_src", "10.0.0.0/8")
+	if err := c3.Merge(Criteria{Set: BitNwSrc, NwSrc: c3.NwSrc}); err != nil {
+		t.Errorf("Expected the same nw_src merged, got %v", err)
+	}
+	other, _, _ := ParseTerm("nw_src", "10.0.0.0/16")
+	if err := c3.Merge(other); err == nil {
+		t.Error("Expected error merging conflicting nw_src")
+	}
+}
+
+func TestNegatedMatch(t *testing.T) {
+	// Everything except LLDP and EAPOL
+	var c Criteria
+	for _, value := range []string{"lldp", "0x888e"} {
+		term, ok, err := ParseTerm("dl_type!", value)
+		if !ok || err != nil {
+			t.Fatalf("Expected dl_type!=%s parsed, got %v", value, err)
+		}
+		if err = c.Merge(term); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.Not) != 2 || c.Bits() != BitDLType {
+		t.Errorf("Expected two negated dl_type terms, got %+v", c)
+	}
+	for dlType, expected := range map[uint16]bool{0x0806: true, 0x0800: true, 0x88cc: false, 0x888e: false} {
+		if c.Match(Criteria{Set: BitDLType, DlType: dlType}) != expected {
+			t.Errorf("Expected dl_type 0x%04x matched %t", dlType, expected)
+		}
+	}
+	if !c.Match(Criteria{}) {
+		t.Error("Expected a packet without a dl_type not excluded")
+	}
+	if s := c.String(); s != "dl_type!=0x88cc;dl_type!=0x888e" {
+		t.Errorf("Incorrect criteria, got %s", s)
+	}
+
+	// Negated terms combine with the others, and apply to messages other
+	// than packet ins only for their type and DPID
+	c, _, _ = ParseTerm("of_type", "packet_in|port_status")
+	for name, value := range map[string]string{"in_port!": "1-8", "dpid!": "0x2"} {
+		term, _, err := ParseTerm(name, value)
+		if err == nil {
+			err = c.Merge(term)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	portStatus := Criteria{Set: BitOFType | BitDPID, OFType: OFTypePortStatus, DPID: 0x1}
+	if !c.Match(portStatus) || c.Match(Criteria{Set: BitInPort | BitDPID, InPort: 3, DPID: 0x1}) {
+		t.Errorf("Expected %s to match port status messages, not packets in on excluded ports", c)
+	}
+	portStatus.DPID = 0x2
+	if c.Match(portStatus) {
+		t.Errorf("Expected %s not to match the port status of the negated DPID", c)
+	}
+	c, _, _ = ParseTerm("of_type!", "packet_in")
+	if c.Match(Criteria{Set: BitOFType, OFType: OFTypePacketIn}) || !c.Match(portStatus) {
+		t.Errorf("Expected %s to match everything but packet ins", c)
+	}
+
+	// A value can't be both matched and negated, in either order, and a
+	// preset can't be negated
+	positive, _, _ := ParseTerm("dl_type", "ipv4")
+	negative, _, _ := ParseTerm("dl_type!", "arp")
+	if err := positive.Merge(negative); err == nil || err.Error() != "dl_type can't be both matched and negated" {
+		t.Errorf("Expected matched and negated dl_type rejected, got %v", err)
+	}
+	nd, _ := Preset("nd")
+	icmpv6, _, _ := ParseTerm("icmpv6_type!", "135")
+	if err := icmpv6.Merge(nd); err == nil {
+		t.Error("Expected negated icmpv6_type rejected with a preset that matches it")
+	}
+	if _, ok, err := ParseTerm("proto!", "nd"); !ok || err == nil {
+		t.Errorf("Expected negated preset rejected, got %v", err)
+	}
+	if _, ok, _ := ParseTerm("dl_type!!", "lldp"); ok || IsTerm("colour") || !IsTerm("dl_type") {
+		t.Error("Expected only the names of match terms recognized")
+	}
+}
+
+func TestParseGroup(t *testing.T) {
+	// ARP packets or DHCP requests
+	c, ok, err := ParseGroup("dl_type", "0x0806|dl_type=0x0800,nw_proto=17,tp_dst=67")
+	if !ok || err != nil {
+		t.Fatalf("Expected group parsed, got %v", err)
+	}
+	if len(c.Or) != 2 || c.Or[1].Set != BitDLType|BitNwProto|BitTpDst {
+		t.Fatalf("Expected two alternatives, got %s", c)
+	}
+	arp := Criteria{Set: BitDLType, DlType: 0x0806}
+	dhcp := Criteria{Set: BitDLType | BitNwProto | BitTpDst, DlType: 0x0800, NwProto: 17, TpDst: 67}
+	dns := Criteria{Set: BitDLType | BitNwProto | BitTpDst, DlType: 0x0800, NwProto: 17, TpDst: 53}
+	if !c.Match(arp) || !c.Match(dhcp) || c.Match(dns) {
+		t.Errorf("Expected %s to match ARP and DHCP alone", c)
+	}
+
+	// The separators within values, and the types of the alternatives
+	c, _, err = ParseGroup("dpid", "0x1,0x2|of_type=packet_in|port_status,dpid=0x3")
+	if err != nil || len(c.Or) != 2 {
+		t.Fatalf("Expected two alternatives, got %s, %v", c, err)
+	}
+	portStatus := Criteria{Set: BitOFType | BitDPID, OFType: OFTypePortStatus, DPID: 0x3}
+	if !c.Match(Criteria{Set: BitDPID, DPID: 0x2}) || !c.Match(portStatus) {
+		t.Errorf("Expected %s to match the port status of 0x3", c)
+	}
+	portStatus.DPID = 0x1
+	if c.Match(portStatus) {
+		t.Errorf("Expected %s not to match the port status of 0x1", c)
+	}
+
+	// A single alternative is that of the term alone
+	c, _, err = ParseGroup("dl_type", "ipv4,nw_proto!=tcp")
+	if err != nil || len(c.Or) != 0 || c.String() != "dl_type=0x0800;nw_proto!=6" {
+		t.Errorf("Expected a single alternative, got %s, %v", c, err)
+	}
+	if _, ok, _ := ParseGroup("workers", "2"); ok {
+		t.Error("Expected a term other than a match term not parsed")
+	}
+	if _, _, err := ParseGroup("dl_type", "arp|dl_type=ipv4,dl_type=ipv6"); err == nil {
+		t.Error("Expected an alternative that can never match rejected")
+	}
+}
+
+func TestString(t *testing.T) {
+	nd, _ := Preset("nd")
+	for expected, c := range map[string]Criteria{
+		"":                                {},
+		"dl_type=0x888e":                  {Set: BitDLType, DlType: 0x888e},
+		"dl_type=0x8863;pppoe_code=0x09":  {Set: BitDLType | BitPppoeCode, DlType: 0x8863, PppoeCode: 0x09},
+		"dl_type=0x86dd;icmpv6_type=135":  {Set: BitDLType | BitICMPv6Type, DlType: DlTypeIPv6, ICMPv6Type: 135},
+		"of_type=error":                   {Set: BitOFType, OFType: OFTypeError},
+		"dl_type=0x8100;dl_vlan=1000":     {Set: BitDLType | BitDLVlan, DlType: 0x8100, DlVlan: 1000},
+		"nw_proto=17;tp_src=68;tp_dst=67": {Set: BitNwProto | BitTpSrc | BitTpDst, NwProto: 17, TpSrc: 68, TpDst: 67},
+		"in_port=32":                      {Set: BitInPort, InPort: 32},
+		"dl_src=00:11:22:33:44:55":        {Set: BitDLSrc, DlSrc: [6]byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}},
+		"dl_dst=01:80:c2:00:00:00/ff:ff:ff:ff:ff:f0": {Set: BitDLDst, DlDst: [6]byte{0x01, 0x80, 0xc2}, DlDstMask: [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xf0}},
+		"in_port=1-16": {Set: BitInPort, InPort: 1, InPortMax: 16},
+		"dpid=of:0x0000000000000001,of:0x0000000000000002":                                 {Set: BitDPID, DPIDs: []uint64{1, 2}, DPIDMask: ^uint64(0)},
+		"dpid=of:0x0000000100000000/0xffffffff00000000":                                    {Set: BitDPID, DPIDs: []uint64{0x0000000100000000}, DPIDMask: 0xffffffff00000000},
+		"nw_proto=17;nw_dst=10.0.0.0/8":                                                    {Set: BitNwProto | BitNwDst, NwProto: 17, NwDst: net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}},
+		"dl_type=0x86dd;(icmpv6_type=133|icmpv6_type=134|icmpv6_type=135|icmpv6_type=136)": nd,
+	} {
+		if s := c.String(); s != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, s)
+		}
+	}
+}
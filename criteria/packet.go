@@ -0,0 +1,110 @@
+package criteria
+
+import (
+	"net"
+)
+
+// IPv6 next header values
+const (
+	ipv6HopByHop    = 0
+	ipv6Routing     = 43
+	ipv6DestOptions = 60
+	ipv6ICMPv6      = 58
+
+	ipv6HeaderLen = 40
+	ipv4HeaderLen = 20
+	ipv4TCP       = 6
+	ipv4UDP       = 17
+
+	pppoeHeaderLen   = 6
+	pppoeVersionType = 0x11
+
+	vlanTagLen = 4
+)
+
+// Untag returns the Ethernet type encapsulated by the VLAN tags, 802.1Q or
+// 802.1ad (QinQ), at the start of a frame payload of the given type, along
+// with the VLAN ID of the outermost tag and the payload that follows the
+// tags. A payload that isn't tagged is returned as is, and one whose tag is
+// incomplete as far as it can be unwrapped.
+func Untag(dlType uint16, payload []byte) (inner uint16, vlan uint16, tagged bool, rest []byte) {
+	for (dlType == DlTypeVlan || dlType == DlTypeQinQ) && len(payload) >= vlanTagLen {
+		if !tagged {
+			vlan, tagged = (uint16(payload[0])<<8|uint16(payload[1]))&0x0fff, true
+		}
+		dlType, payload = uint16(payload[2])<<8|uint16(payload[3]), payload[vlanTagLen:]
+	}
+	return dlType, vlan, tagged, payload
+}
+
+// hostMask the mask of an IPv4 prefix of one address
+var hostMask = net.CIDRMask(32, 32)
+
+// IPv4 returns the protocol, and the source and destination addresses as
+// prefixes of one address, of the given IPv4 packet, i.e. the payload of an
+// Ethernet frame, or false if it isn't one. The addresses are copied, so they
+// don't reference the packet.
+func IPv4(packet []byte) (proto uint8, src, dst net.IPNet, ok bool) {
+	if len(packet) < ipv4HeaderLen || packet[0]>>4 != 4 {
+		return 0, src, dst, false
+	}
+	src = net.IPNet{IP: net.IP(append([]byte(nil), packet[12:16]...)), Mask: hostMask}
+	dst = net.IPNet{IP: net.IP(append([]byte(nil), packet[16:20]...)), Mask: hostMask}
+	return packet[9], src, dst, true
+}
+
+// TransportPorts returns the source and destination ports of the TCP or UDP
+// segment carried by the given IPv4 packet, or false if it doesn't carry one,
+// it is a fragment other than the first or the packet is truncated, i.e. by
+// the `miss_send_len` of a switch, before the ports.
+func TransportPorts(packet []byte) (src, dst uint16, ok bool) {
+	if len(packet) < ipv4HeaderLen || packet[0]>>4 != 4 {
+		return 0, 0, false
+	}
+	if packet[9] != ipv4TCP && packet[9] != ipv4UDP {
+		return 0, 0, false
+	}
+	if (uint16(packet[6])<<8|uint16(packet[7]))&0x1fff != 0 {
+		return 0, 0, false
+	}
+	offset := int(packet[0]&0x0f) * 4
+	if offset < ipv4HeaderLen || len(packet) < offset+4 {
+		return 0, 0, false
+	}
+	src = uint16(packet[offset])<<8 | uint16(packet[offset+1])
+	dst = uint16(packet[offset+2])<<8 | uint16(packet[offset+3])
+	return src, dst, true
+}
+
+// ICMPv6Type returns the type of the ICMPv6 message carried by the given IPv6
+// packet, i.e. the payload of an Ethernet frame, or false if it doesn't carry
+// one. Hop-by-hop, routing and destination options extension headers, such
+// as the router alert option of MLD messages, are skipped to locate the
+// ICMPv6 header.
+func ICMPv6Type(packet []byte) (uint8, bool) {
+	if len(packet) < ipv6HeaderLen || packet[0]>>4 != 6 {
+		return 0, false
+	}
+	next, offset := packet[6], ipv6HeaderLen
+	for next == ipv6HopByHop || next == ipv6Routing || next == ipv6DestOptions {
+		if len(packet) < offset+2 {
+			return 0, false
+		}
+		next, offset = packet[offset], offset+(int(packet[offset+1])+1)*8
+	}
+	if next != ipv6ICMPv6 || len(packet) <= offset {
+		return 0, false
+	}
+	return packet[offset], true
+}
+
+// PppoeCode returns the code of the PPPoE packet carried by the given frame
+// payload, i.e. the payload of an Ethernet frame whose type is PPPoE
+// discovery or session, or false if it isn't a version 1, type 1, PPPoE
+// header. Session stage packets have a code of 0.
+func PppoeCode(packet []byte) (uint8, bool) {
+	if len(packet) < pppoeHeaderLen || packet[0] != pppoeVersionType {
+		return 0, false
+	}
+	return packet[1], true
+}
@@ -0,0 +1,366 @@
+package criteria
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// Frames captured from a lab network, Ethernet header included
+const (
+	// Router advertisement with source link-layer address, MTU and prefix
+	// information options
+	captureRA = "33330000000100112233445586dd6000000000403afffe800000000000000211" +
+		"22fffe334455ff020000000000000000000000000001860021b9400007080000" +
+		"000000000000010100112233445505010000000005dc030440c000278d000009" +
+		"3a800000000020010db8000000000000000000000000"
+
+	// Neighbor solicitation with source link-layer address option
+	captureNS = "3333ff00000100112233445586dd6000000000203afffe800000000000000211" +
+		"22fffe334455ff0200000000000000000001ff00000187007f30000000002001" +
+		"0db80000000000000000000000010101001122334455"
+
+	// MLDv2 report behind a hop-by-hop header with the router alert option
+	captureMLD = "33330000001600112233445586dd6000000000240001fe800000000000000211" +
+		"22fffe334455ff0200000000000000000000000000163a000502000001008f00" +
+		"096f0000000104000000ff0200000000000000000001ff000001"
+
+	// PPPoE active discovery initiation with service name and host uniq
+	// tags
+	capturePADI = "ffffffffffff0019cb123456886311090000000c01010000010300045a3c0001" +
+		"00000000000000000000000000000000000000000000000000000000"
+
+	// PPPoE active discovery offer with service name, AC name, AC cookie
+	// and host uniq tags
+	capturePADO = "0019cb12345600e0fc0a0b0c88631107000000290101000001020005424e472d" +
+		"31010400108d7e0b5c2f1a94e6d3c7b2a18f0e4d21010300045a3c0001"
+
+	// PPPoE session stage LCP echo request
+	capturePppoeSession = "00e0fc0a0b0c0019cb123456886411000001000ac021090100081a2b3c4d0000" +
+		"00000000000000000000000000000000000000000000000000000000"
+
+	// DHCP discover, broadcast from 0.0.0.0, truncated after the start of
+	// the BOOTP header
+	captureDHCP = "ffffffffffff0019cb1234560800450000280000000040117ac600000000ffff" +
+		"ffff0044004300140000010106003c2a1b0d00000000"
+
+	// IGMPv2 membership report for 224.0.0.251, with the router alert
+	// option
+	captureIGMP = "01005e0000fb0019cb123456080046c00020000000000102816ac0a8010ae000" +
+		"00fb9404000016000904e00000fb"
+)
+
+// stateOf returns the state criteria of a captured frame, as derived when a
+// packet in is tee-ed
+func stateOf(t *testing.T, capture string) Criteria {
+	frame, err := hex.DecodeString(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dlType, vlan, tagged, payload := Untag(uint16(frame[12])<<8|uint16(frame[13]), frame[14:])
+	state := Criteria{Set: BitDLType, DlType: dlType}
+	if tagged {
+		state.Set |= BitDLVlan
+		state.DlVlan = vlan
+	}
+	switch state.DlType {
+	case DlTypeIPv6:
+		if icmpType, ok := ICMPv6Type(payload); ok {
+			state.Set |= BitICMPv6Type
+			state.ICMPv6Type = icmpType
+		}
+	case DlTypePppoeDiscovery, DlTypePppoeSession:
+		if code, ok := PppoeCode(payload); ok {
+			state.Set |= BitPppoeCode
+			state.PppoeCode = code
+		}
+	case DlTypeIPv4:
+		if proto, src, dst, ok := IPv4(payload); ok {
+			state.Set |= BitsNetwork
+			state.NwProto, state.NwSrc, state.NwDst = proto, src, dst
+		}
+		if src, dst, ok := TransportPorts(payload); ok {
+			state.Set |= BitsTransport
+			state.TpSrc, state.TpDst = src, dst
+		}
+	}
+	return state
+}
+
+func TestICMPv6Type(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		capture  string
+		expected uint8
+	}{
+		{"router advertisement", captureRA, ICMPv6TypeRouterAdvertisement},
+		{"neighbor solicitation", captureNS, ICMPv6TypeNeighborSolicitation},
+		{"MLD report", captureMLD, 143},
+	} {
+		state := stateOf(t, tc.capture)
+		if state.Set&BitICMPv6Type == 0 || state.ICMPv6Type != tc.expected {
+			t.Errorf("Expected ICMPv6 type %d for %s, got %+v", tc.expected, tc.name, state)
+		}
+	}
+
+	// Truncated packets, including within the hop-by-hop header, and
+	// packets that are not IPv6 carry no ICMPv6 type
+	frame, _ := hex.DecodeString(captureMLD)
+	for _, packet := range [][]byte{frame[14:50], frame[14:55], frame[14:62], make([]byte, 60)} {
+		if icmpType, ok := ICMPv6Type(packet); ok {
+			t.Errorf("Expected no ICMPv6 type for %x, got %d", packet, icmpType)
+		}
+	}
+}
+
+func TestUntag(t *testing.T) {
+	for name, test := range map[string]struct {
+		capture string
+		dlType  uint16
+		vlan    uint16
+		tagged  bool
+		rest    int
+	}{
+		"untagged":     {"888e0100", 0x888e, 0, false, 2},
+		"eapol":        {"8100a3e8888e0100", 0x888e, 1000, true, 2},
+		"qinq eapol":   {"88a80064810003e8888e0100", 0x888e, 100, true, 2},
+		"double arp":   {"81000064810003e808060001", 0x0806, 100, true, 2},
+		"truncated":    {"88a80064810003", 0x8100, 100, true, 1},
+		"tagged empty": {"8100000a0806", 0x0806, 10, true, 0},
+	} {
+		frame, err := hex.DecodeString(test.capture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dlType, vlan, tagged, rest := Untag(uint16(frame[0])<<8|uint16(frame[1]), frame[2:])
+		if dlType != test.dlType || vlan != test.vlan || tagged != test.tagged || len(rest) != test.rest {
+			t.Errorf("Expected %s to be 0x%04x vlan %d %t with %d bytes, got 0x%04x vlan %d %t with %d bytes",
+				name, test.dlType, test.vlan, test.tagged, test.rest, dlType, vlan, tagged, len(rest))
+		}
+	}
+
+	// Tagged packets match end points by their inner Ethernet type
+	eapol := Criteria{Set: BitDLType, DlType: 0x888e}
+	if state := stateOf(t, "0180c200000300112233445588a80064810003e8888e0100"); !eapol.Match(state) ||
+		state.DlVlan != 100 {
+		t.Errorf("Expected QinQ EAPOL to match, got %s", state)
+	}
+}
+
+func TestPresetND(t *testing.T) {
+	nd, err := Preset("ND")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd.Match(stateOf(t, captureRA)) || !nd.Match(stateOf(t, captureNS)) {
+		t.Error("Expected neighbor discovery to match router advertisement and neighbor solicitation")
+	}
+	if nd.Match(stateOf(t, captureMLD)) {
+		t.Error("Expected neighbor discovery not to match MLD report")
+	}
+	if nd.Match(Criteria{Set: BitDLType, DlType: 0x0800}) || nd.Match(Criteria{Set: BitDLType, DlType: DlTypeIPv6}) {
+		t.Error("Expected neighbor discovery not to match packets without an ND ICMPv6 type")
+	}
+
+	if _, err = Preset("bogus"); err == nil {
+		t.Error("Expected error for unknown preset")
+	}
+}
+
+func TestPppoeCode(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		capture  string
+		dlType   uint16
+		expected uint8
+	}{
+		{"PADI", capturePADI, DlTypePppoeDiscovery, PppoeCodePADI},
+		{"PADO", capturePADO, DlTypePppoeDiscovery, PppoeCodePADO},
+		{"session", capturePppoeSession, DlTypePppoeSession, 0},
+	} {
+		state := stateOf(t, tc.capture)
+		if state.DlType != tc.dlType || state.Set&BitPppoeCode == 0 || state.PppoeCode != tc.expected {
+			t.Errorf("Expected PPPoE code 0x%02x for %s, got %+v", tc.expected, tc.name, state)
+		}
+	}
+
+	// Truncated packets and other versions carry no code
+	frame, _ := hex.DecodeString(capturePADI)
+	frame[14] = 0x21
+	for _, packet := range [][]byte{frame[14:18], frame[14:]} {
+		if code, ok := PppoeCode(packet); ok {
+			t.Errorf("Expected no PPPoE code for %x, got 0x%02x", packet, code)
+		}
+	}
+}
+
+func TestPppoeCodeMatch(t *testing.T) {
+	dlType, _ := ParseDlType("pppoe_discovery")
+	padi, _ := ParsePppoeCode("PADI")
+	discovery := Criteria{Set: BitDLType, DlType: dlType}
+	initiation := Criteria{Set: BitPppoeCode, PppoeCode: padi}
+
+	if !discovery.Match(stateOf(t, capturePADI)) || !discovery.Match(stateOf(t, capturePADO)) {
+		t.Error("Expected discovery stage to match PADI and PADO")
+	}
+	if discovery.Match(stateOf(t, capturePppoeSession)) {
+		t.Error("Expected discovery stage not to match session frame")
+	}
+	if !initiation.Match(stateOf(t, capturePADI)) || initiation.Match(stateOf(t, capturePADO)) {
+		t.Error("Expected pppoe_code=padi to match only PADI")
+	}
+	for _, code := range []string{"padi", "pado", "padr", "pads", "padt"} {
+		c, _ := ParsePppoeCode(code)
+		criteria := Criteria{Set: BitPppoeCode, PppoeCode: c}
+		if criteria.Match(stateOf(t, capturePppoeSession)) {
+			t.Errorf("Expected pppoe_code=%s not to match session frame", code)
+		}
+	}
+}
+
+func TestIPv4(t *testing.T) {
+	dhcp := stateOf(t, captureDHCP)
+	if dhcp.Set&BitsNetwork != BitsNetwork || dhcp.NwProto != 17 ||
+		dhcp.NwSrc.String() != "0.0.0.0/32" || dhcp.NwDst.String() != "255.255.255.255/32" {
+		t.Errorf("Expected UDP from 0.0.0.0 to 255.255.255.255, got %s", dhcp)
+	}
+	igmp := stateOf(t, captureIGMP)
+	if igmp.NwProto != 2 || !igmp.NwDst.IP.Equal(net.IPv4(224, 0, 0, 251)) {
+		t.Errorf("Expected IGMP to 224.0.0.251, got %s", igmp)
+	}
+	if _, _, _, ok := IPv4(make([]byte, 19)); ok {
+		t.Error("Expected a truncated IPv4 header not decoded")
+	}
+}
+
+func TestNwMatch(t *testing.T) {
+	dhcp := stateOf(t, captureDHCP)
+	igmp := stateOf(t, captureIGMP)
+	for _, test := range []struct {
+		spec []string
+		dhcp bool
+		igmp bool
+	}{
+		{[]string{"nw_proto", "udp", "nw_dst", "255.255.255.255/32"}, true, false},
+		{[]string{"nw_proto", "igmp"}, false, true},
+		{[]string{"nw_dst", "224.0.0.0/4"}, false, true},
+		{[]string{"nw_src", "192.168.0.0/16"}, false, true},
+		{[]string{"nw_src", "0.0.0.0"}, true, false},
+		{[]string{"nw_dst", "255.255.255.255", "nw_src", "10.0.0.0/8"}, false, false},
+	} {
+		var target Criteria
+		for i := 0; i < len(test.spec); i += 2 {
+			condition, _, err := ParseTerm(test.spec[i], test.spec[i+1])
+			if err == nil {
+				err = target.Merge(condition)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if target.Match(dhcp) != test.dhcp || target.Match(igmp) != test.igmp {
+			t.Errorf("Expected %s to match DHCP %t and IGMP %t", target, test.dhcp, test.igmp)
+		}
+	}
+
+	// Packets whose IPv4 header isn't decoded never match
+	target, _, _ := ParseTerm("nw_proto", "17")
+	if target.Match(Criteria{Set: BitDLType, DlType: DlTypeIPv4}) {
+		t.Error("Expected nw_proto not to match without the IPv4 header decoded")
+	}
+}
+
+func TestTransportPorts(t *testing.T) {
+	dhcp := stateOf(t, captureDHCP)
+	if dhcp.Set&BitsTransport != BitsTransport || dhcp.TpSrc != 68 || dhcp.TpDst != 67 {
+		t.Errorf("Expected UDP from port 68 to 67, got %s", dhcp)
+	}
+	if igmp := stateOf(t, captureIGMP); igmp.Set&BitsTransport != 0 {
+		t.Errorf("Expected no ports for IGMP, got %s", igmp)
+	}
+
+	// Truncated by the switch before the ports, or a later fragment,
+	// whose ports are in the first
+	packet, _ := hex.DecodeString(captureDHCP[28:])
+	if _, _, ok := TransportPorts(packet[:ipv4HeaderLen+2]); ok {
+		t.Error("Expected no ports for a truncated packet")
+	}
+	packet[7] = 0x10
+	if _, _, ok := TransportPorts(packet); ok {
+		t.Error("Expected no ports for a later fragment")
+	}
+
+	dhcpServer, _, _ := ParseTerm("tp_dst", "67")
+	truncated := stateOf(t, captureDHCP[:(14+ipv4HeaderLen)*2])
+	if !dhcpServer.Match(dhcp) || dhcpServer.Match(truncated) {
+		t.Error("Expected tp_dst=67 to only match the complete DHCP discover")
+	}
+	if _, err := ParseTpPort("65536"); err == nil {
+		t.Error("Expected port out of range rejected")
+	}
+}
+
+func TestParseNames(t *testing.T) {
+	for value, expected := range map[string]uint16{
+		"pppoe_discovery": 0x8863,
+		"PPPoE_Session":   0x8864,
+		"ipv6":            0x86dd,
+		"0x888e":          0x888e,
+	} {
+		if dlType, err := ParseDlType(value); err != nil || dlType != expected {
+			t.Errorf("Expected 0x%04x for '%s', got 0x%04x, %v", expected, value, dlType, err)
+		}
+	}
+	if _, err := ParseDlType("pppoe"); err == nil {
+		t.Error("Expected error for unknown Ethernet type name")
+	}
+	if code, err := ParsePppoeCode("0xa7"); err != nil || code != PppoeCodePADT {
+		t.Errorf("Expected PADT code, got 0x%02x, %v", code, err)
+	}
+	if _, err := ParsePppoeCode("padx"); err == nil {
+		t.Error("Expected error for unknown PPPoE code name")
+	}
+	if proto, err := ParseNwProto("UDP"); err != nil || proto != 17 {
+		t.Errorf("Expected UDP protocol, got %d, %v", proto, err)
+	}
+	if _, err := ParseNwProto("sctp"); err == nil || err.Error() !=
+		"unknown IP protocol 'sctp', expected a number or one of icmp, igmp, tcp, udp" {
+		t.Errorf("Expected unknown protocol error, got %v", err)
+	}
+	for _, value := range []string{"10.0.0.256", "10.0.0.0/33", "2001:db8::/32", "host"} {
+		if _, err := ParseNwAddr(value); err == nil {
+			t.Errorf("Expected '%s' rejected", value)
+		}
+	}
+}
+
+func TestParseTerm(t *testing.T) {
+	for _, test := range []struct {
+		name, value string
+		expected    Criteria
+	}{
+		{"dl_type", "eapol", Criteria{Set: BitDLType, DlType: 0x888e}},
+		{"ICMPv6_Type", "135", Criteria{Set: BitICMPv6Type, ICMPv6Type: 135}},
+		{"pppoe_code", "padi", Criteria{Set: BitPppoeCode, PppoeCode: PppoeCodePADI}},
+		{"of_type", "error", Criteria{Set: BitOFType, OFType: OFTypeError}},
+		{"nw_proto", "igmp", Criteria{Set: BitNwProto, NwProto: 2}},
+		{"tp_dst", "53", Criteria{Set: BitTpDst, TpDst: 53}},
+		{"in_port", "0x20", Criteria{Set: BitInPort, InPort: 32}},
+		{"nw_src", "10.1.2.3/8", Criteria{Set: BitNwSrc, NwSrc: net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}},
+		{"nw_dst", "255.255.255.255", Criteria{Set: BitNwDst, NwDst: net.IPNet{IP: net.IPv4bcast, Mask: net.CIDRMask(32, 32)}}},
+	} {
+		c, ok, err := ParseTerm(test.name, test.value)
+		if !ok || err != nil || c.String() != test.expected.String() {
+			t.Errorf("Expected %s for %s=%s, got %s, %t, %v", test.expected, test.name, test.value, c, ok, err)
+		}
+	}
+	if c, ok, err := ParseTerm("proto", "nd"); !ok || err != nil || len(c.Or) != 4 {
+		t.Errorf("Expected preset expanded, got %s, %t, %v", c, ok, err)
+	}
+	if _, ok, err := ParseTerm("icmpv6_type", "256"); !ok || err == nil {
+		t.Errorf("Expected out of range ICMPv6 type rejected, got %t, %v", ok, err)
+	}
+	if _, ok, _ := ParseTerm("action", "tcp://host:9000"); ok {
+		t.Error("Expected action not to be a match term")
+	}
+}
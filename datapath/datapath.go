@@ -0,0 +1,54 @@
+// Package datapath formats and parses OpenFlow datapath IDs (DPIDs), so that
+// they are presented the same way everywhere, i.e. in the API, in logs and in
+// message metadata.
+package datapath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Prefix of the canonical form of a DPID
+const Prefix = "of:"
+
+// Format returns the canonical form of a DPID, `of:0x` followed by 16
+// hexadecimal digits, i.e. `of:0x0000000000000001`
+func Format(dpid uint64) string {
+	return fmt.Sprintf("of:0x%016x", dpid)
+}
+
+// Parse parses a DPID in any of the forms
+//   - of:0x0000000000000001, the canonical form, or of:0000000000000001
+//   - 0x1
+//   - 1, bare hexadecimal
+//   - 00:00:00:00:00:00:00:01, eight colon separated octets
+//
+// The value is always hexadecimal, `10` is 16 not 10.
+func Parse(value string) (uint64, error) {
+	s := strings.ToLower(strings.TrimSpace(value))
+	s = strings.TrimPrefix(s, Prefix)
+	if strings.Contains(s, ":") {
+		octets := strings.Split(s, ":")
+		if len(octets) != 8 {
+			return 0, fmt.Errorf("invalid DPID '%s', expected 8 colon separated octets", value)
+		}
+		for i, octet := range octets {
+			switch len(octet) {
+			case 1:
+				octets[i] = "0" + octet
+			case 2:
+			default:
+				return 0, fmt.Errorf("invalid DPID '%s', invalid octet '%s'", value, octet)
+			}
+		}
+		s = strings.Join(octets, "")
+	} else {
+		s = strings.TrimPrefix(s, "0x")
+	}
+	dpid, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid DPID '%s' : %s", value, err.(*strconv.NumError).Err)
+	}
+	return dpid, nil
+}
@@ -0,0 +1,113 @@
+package datapath
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestFormat(t *testing.T) {
+	if s := Format(0x1); s != "of:0x0000000000000001" {
+		t.Errorf("Incorrect format, expected 'of:0x0000000000000001', got '%s'", s)
+	}
+	if s := Format(0xfedcba9876543210); s != "of:0xfedcba9876543210" {
+		t.Errorf("Incorrect format, expected 'of:0xfedcba9876543210', got '%s'", s)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		dpid  uint64
+	}{
+		{"of:0x0000000000000001", 0x1},
+		{"of:0000000000000001", 0x1},
+		{"OF:0X00000000000000AB", 0xab},
+		{"0x1", 0x1},
+		{"1", 0x1},
+		{"10", 0x10},
+		{"fedcba9876543210", 0xfedcba9876543210},
+		{"00:00:00:00:00:00:00:01", 0x1},
+		{"0:0:0:0:0:0:a:1", 0x0a01},
+		{"of:ff:ff:ff:ff:ff:ff:ff:ff", 0xffffffffffffffff},
+		{" 0x2 ", 0x2},
+	} {
+		dpid, err := Parse(test.value)
+		if err != nil || dpid != test.dpid {
+			t.Errorf("Incorrect parse of '%s', expected 0x%x, got 0x%x (%v)", test.value, test.dpid, dpid, err)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"of:",
+		"0x",
+		"xyz",
+		"-1",
+		"+1",
+		"1_000",
+		"0x10000000000000000",
+		"00:00:00:00:00:00:01",
+		"00:00:00:00:00:00:00:00:01",
+		"00:00:00:00:00:00:00:001",
+		"00:00:00:00:00:00::01",
+		"0x00:00:00:00:00:00:00:01",
+	} {
+		if dpid, err := Parse(value); err == nil {
+			t.Errorf("Expected error parsing '%s', got 0x%x", value, dpid)
+		}
+	}
+}
+
+// colons formats a DPID as colon separated octets
+func colons(dpid uint64) string {
+	octets := make([]string, 8)
+	for i := range octets {
+		octets[i] = fmt.Sprintf("%02x", byte(dpid>>uint(56-8*i)))
+	}
+	return strings.Join(octets, ":")
+}
+
+// TestParseRoundTrip checks, for random DPIDs, that every form parses back to
+// the DPID and that the canonical form is stable
+func TestParseRoundTrip(t *testing.T) {
+	roundTrip := func(dpid uint64) bool {
+		for _, form := range []string{
+			Format(dpid),
+			fmt.Sprintf("of:%016x", dpid),
+			fmt.Sprintf("0x%x", dpid),
+			fmt.Sprintf("%x", dpid),
+			strings.ToUpper(fmt.Sprintf("%x", dpid)),
+			colons(dpid),
+		} {
+			parsed, err := Parse(form)
+			if err != nil || parsed != dpid || Format(parsed) != Format(dpid) {
+				t.Logf("Round trip of '%s' failed, got 0x%x (%v)", form, parsed, err)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestParseArbitrary checks, for random input, that whatever parses formats
+// to a canonical form that parses back to the same DPID
+func TestParseArbitrary(t *testing.T) {
+	stable := func(value string) bool {
+		dpid, err := Parse(value)
+		if err != nil {
+			return true
+		}
+		again, err := Parse(Format(dpid))
+		return err == nil && again == dpid
+	}
+	if err := quick.Check(stable, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+}
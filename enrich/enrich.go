@@ -0,0 +1,271 @@
+// Package enrich supports enriching the metadata of tee-ed messages with
+// fields, i.e. a subscriber ID, looked up from an external HTTP service by
+// the DPID and port on which a packet was received.
+package enrich
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciena/oftee/datapath"
+	log "github.com/sirupsen/logrus"
+)
+
+// Enricher defaults
+const (
+	// DefaultTTL time for which looked up fields are cached
+	DefaultTTL = 5 * time.Minute
+
+	// DefaultFailureTTL time for which a failed lookup is cached, so that
+	// a failing service isn't queried for every message
+	DefaultFailureTTL = 30 * time.Second
+
+	// DefaultMaxEntries maximum number of cached lookups
+	DefaultMaxEntries = 10000
+
+	// DefaultWorkers number of concurrent lookups
+	DefaultWorkers = 4
+
+	// DefaultQueueSize maximum number of lookups waiting for a worker,
+	// further lookups are dropped and retried on a later message
+	DefaultQueueSize = 1000
+
+	// DefaultTimeout timeout for a single lookup
+	DefaultTimeout = 5 * time.Second
+)
+
+// key identifies a device port
+type key struct {
+	dpid uint64
+	port uint32
+}
+
+// entry is a cached lookup, which is pending until the lookup completes
+type entry struct {
+	fields  map[string]string
+	expires time.Time
+	pending bool
+}
+
+// Stats statistics of an enricher
+type Stats struct {
+	Entries   int    `json:"entries"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Lookups   uint64 `json:"lookups"`
+	Failures  uint64 `json:"failures"`
+	Dropped   uint64 `json:"dropped"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// Enricher looks up the fields for a device port from an HTTP service, which
+// is sent a `GET` with `dpid` and `port` query parameters and responds with a
+// JSON object. Lookups are cached and made asynchronously, so a message for
+// a port that is not cached is not enriched, but those that follow the
+// completion of the lookup are.
+type Enricher struct {
+	URL        string
+	TTL        time.Duration
+	FailureTTL time.Duration
+	MaxEntries int
+	Workers    int
+
+	client    *http.Client
+	queue     chan key
+	lock      sync.Mutex
+	entries   map[key]*entry
+	hits      uint64
+	misses    uint64
+	lookups   uint64
+	failures  uint64
+	dropped   uint64
+	evictions uint64
+}
+
+// Initialize makes sure private members, that can't function from zero
+// state, are set correctly
+func (e *Enricher) Initialize() *Enricher {
+	if e.TTL <= 0 {
+		e.TTL = DefaultTTL
+	}
+	if e.FailureTTL <= 0 {
+		e.FailureTTL = DefaultFailureTTL
+	}
+	if e.MaxEntries <= 0 {
+		e.MaxEntries = DefaultMaxEntries
+	}
+	if e.Workers <= 0 {
+		e.Workers = DefaultWorkers
+	}
+	e.client = &http.Client{Timeout: DefaultTimeout}
+	e.queue = make(chan key, DefaultQueueSize)
+	e.entries = make(map[key]*entry)
+	return e
+}
+
+// ListenAndLookup processes queued lookups until the queue is closed
+func (e *Enricher) ListenAndLookup() error {
+	for i := 1; i < e.Workers; i++ {
+		go e.worker()
+	}
+	e.worker()
+	return nil
+}
+
+func (e *Enricher) worker() {
+	for k := range e.queue {
+		fields, err := e.lookup(k)
+		atomic.AddUint64(&e.lookups, 1)
+		ttl := e.TTL
+		if err != nil {
+			atomic.AddUint64(&e.failures, 1)
+			ttl = e.FailureTTL
+			log.
+				WithFields(log.Fields{
+					"dpid": datapath.Format(k.dpid),
+					"port": k.port,
+				}).
+				WithError(err).
+				Warn("Unable to look up enrichment for device port")
+		}
+		e.store(k, &entry{fields: fields, expires: time.Now().Add(ttl)})
+	}
+}
+
+// lookup queries the service for the fields of a device port
+func (e *Enricher) lookup(k key) (map[string]string, error) {
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Set("dpid", datapath.Format(k.dpid))
+	query.Set("port", strconv.FormatUint(uint64(k.port), 10))
+	u.RawQuery = query.Encode()
+
+	resp, err := e.client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// Nothing known about the port, which is cached like any
+		// other answer
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	var values map[string]interface{}
+	if err = json.NewDecoder(resp.Body).Decode(&values); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string, len(values))
+	for name, value := range values {
+		fields[name] = fmt.Sprint(value)
+	}
+	return fields, nil
+}
+
+// store caches an entry
+func (e *Enricher) store(k key, value *entry) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.storeLocked(k, value)
+}
+
+// storeLocked caches an entry, evicting the entry closest to expiry if the
+// cache is full. The lock must be held.
+func (e *Enricher) storeLocked(k key, value *entry) {
+	if _, ok := e.entries[k]; !ok && len(e.entries) >= e.MaxEntries {
+		var (
+			oldest  key
+			expires time.Time
+		)
+		for candidate, cached := range e.entries {
+			if !cached.pending && (expires.IsZero() || cached.expires.Before(expires)) {
+				oldest, expires = candidate, cached.expires
+			}
+		}
+		if expires.IsZero() {
+			// Everything cached is pending a lookup
+			return
+		}
+		delete(e.entries, oldest)
+		atomic.AddUint64(&e.evictions, 1)
+	}
+	e.entries[k] = value
+}
+
+// Lookup returns the cached fields for a device port. If the fields are not
+// cached, or have expired, a lookup is queued and nil, or the expired fields
+// while they are refreshed, is returned. It never blocks, so it can be called
+// from the data path.
+func (e *Enricher) Lookup(dpid uint64, port uint32) map[string]string {
+	if e == nil {
+		return nil
+	}
+	k := key{dpid, port}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	cached, ok := e.entries[k]
+	if ok && !cached.pending && time.Now().Before(cached.expires) {
+		atomic.AddUint64(&e.hits, 1)
+		return cached.fields
+	}
+	atomic.AddUint64(&e.misses, 1)
+	if ok && cached.pending {
+		return cached.fields
+	}
+
+	// Mark the lookup as pending, so that it is only queued once
+	var stale map[string]string
+	if ok {
+		stale = cached.fields
+	}
+	select {
+	case e.queue <- k:
+		e.storeLocked(k, &entry{fields: stale, pending: true})
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+	}
+	return stale
+}
+
+// Cached returns the cached fields for a device port, whether or not they
+// have expired, nil if none are. Unlike `Lookup` it neither counts nor queues
+// a lookup, so that the fields of a message, looked up as it is tee-ed, are
+// read as it is delivered.
+func (e *Enricher) Cached(dpid uint64, port uint32) map[string]string {
+	if e == nil {
+		return nil
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if cached, ok := e.entries[key{dpid, port}]; ok {
+		return cached.fields
+	}
+	return nil
+}
+
+// Stats returns the statistics of the enricher
+func (e *Enricher) Stats() Stats {
+	e.lock.Lock()
+	entries := len(e.entries)
+	e.lock.Unlock()
+	return Stats{
+		Entries:   entries,
+		Hits:      atomic.LoadUint64(&e.hits),
+		Misses:    atomic.LoadUint64(&e.misses),
+		Lookups:   atomic.LoadUint64(&e.lookups),
+		Failures:  atomic.LoadUint64(&e.failures),
+		Dropped:   atomic.LoadUint64(&e.dropped),
+		Evictions: atomic.LoadUint64(&e.evictions),
+	}
+}
@@ -0,0 +1,125 @@
+package enrich
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// service is an enrichment service that answers with the subscriber of a
+// port, or fails if the port is 0
+func service(t *testing.T, requests *uint64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddUint64(requests, 1)
+		query := req.URL.Query()
+		switch query.Get("port") {
+		case "0":
+			resp.WriteHeader(http.StatusInternalServerError)
+		case "404":
+			resp.WriteHeader(http.StatusNotFound)
+		default:
+			json.NewEncoder(resp).Encode(map[string]interface{}{
+				"subscriber": query.Get("dpid") + "/" + query.Get("port"),
+				"vlan":       100,
+			})
+		}
+	}))
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !cond() {
+		t.Fatal("Timed out waiting for lookup")
+	}
+}
+
+func TestLookupAsynchronous(t *testing.T) {
+	var requests uint64
+	server := service(t, &requests)
+	defer server.Close()
+	e := (&Enricher{URL: server.URL}).Initialize()
+	go e.ListenAndLookup()
+
+	// The first lookup is a miss, those that follow before the lookup
+	// completes don't query the service again
+	if fields := e.Lookup(0x1, 3); fields != nil {
+		t.Errorf("Expected first lookup to miss, got %v", fields)
+	}
+	e.Lookup(0x1, 3)
+	var fields map[string]string
+	waitFor(t, func() bool {
+		fields = e.Lookup(0x1, 3)
+		return fields != nil
+	})
+	if fields["subscriber"] != "of:0x0000000000000001/3" || fields["vlan"] != "100" {
+		t.Errorf("Incorrect enrichment fields, got %v", fields)
+	}
+	if n := atomic.LoadUint64(&requests); n != 1 {
+		t.Errorf("Expected a single lookup, got %d", n)
+	}
+	if stats := e.Stats(); stats.Hits == 0 || stats.Lookups != 1 || stats.Entries != 1 {
+		t.Errorf("Incorrect statistics, got %+v", stats)
+	}
+}
+
+func TestLookupFailureCached(t *testing.T) {
+	var requests uint64
+	server := service(t, &requests)
+	defer server.Close()
+	e := (&Enricher{URL: server.URL, FailureTTL: time.Hour}).Initialize()
+	go e.ListenAndLookup()
+
+	e.Lookup(0x1, 0)
+	waitFor(t, func() bool { return e.Stats().Failures == 1 })
+	for i := 0; i < 10; i++ {
+		if fields := e.Lookup(0x1, 0); fields != nil {
+			t.Errorf("Expected no fields for failed lookup, got %v", fields)
+		}
+	}
+	if n := atomic.LoadUint64(&requests); n != 1 {
+		t.Errorf("Expected failed lookup to be cached, got %d requests", n)
+	}
+
+	// Unknown ports are not failures
+	e.Lookup(0x1, 404)
+	waitFor(t, func() bool { return e.Stats().Lookups == 2 })
+	if stats := e.Stats(); stats.Failures != 1 {
+		t.Errorf("Expected unknown port not to be a failure, got %+v", stats)
+	}
+}
+
+func TestLookupExpiryAndEviction(t *testing.T) {
+	var requests uint64
+	server := service(t, &requests)
+	defer server.Close()
+	e := (&Enricher{URL: server.URL, TTL: 50 * time.Millisecond, MaxEntries: 2}).Initialize()
+	go e.ListenAndLookup()
+
+	for port := uint32(1); port <= 3; port++ {
+		e.Lookup(0x1, port)
+		waitFor(t, func() bool { return e.Stats().Lookups == uint64(port) })
+	}
+	if stats := e.Stats(); stats.Entries != 2 || stats.Evictions != 1 {
+		t.Errorf("Expected cache to be bounded, got %+v", stats)
+	}
+
+	// Expired fields are returned while they are refreshed
+	time.Sleep(60 * time.Millisecond)
+	if fields := e.Lookup(0x1, 3); fields == nil {
+		t.Error("Expected expired fields while refreshing")
+	}
+	waitFor(t, func() bool { return e.Stats().Lookups == 4 })
+}
+
+func TestLookupNil(t *testing.T) {
+	var e *Enricher
+	if fields := e.Lookup(0x1, 1); fields != nil {
+		t.Errorf("Expected nil enricher to return no fields, got %v", fields)
+	}
+}
@@ -0,0 +1,84 @@
+// Package events supports notifying external systems of events, such as
+// devices connecting to and disconnecting from oftee, their ports changing or
+// end points being demoted for exceeding their latency budget.
+package events
+
+import (
+	"time"
+)
+
+// Event types
+const (
+	// TypeDeviceConnected a device connected and its DPID was learned
+	TypeDeviceConnected = "device_connected"
+
+	// TypeDeviceDisconnected a device, whose DPID was learned, disconnected
+	TypeDeviceDisconnected = "device_disconnected"
+
+	// TypeEndpointDemoted an end point exceeded its latency budget and was
+	// demoted
+	TypeEndpointDemoted = "endpoint_demoted"
+
+	// TypeEndpointRestored a demoted end point's latency recovered and it
+	// was restored
+	TypeEndpointRestored = "endpoint_restored"
+
+	// TypeControllerFailover the connection of a device to its SDN
+	// controller failed and was re-established to the next controller
+	TypeControllerFailover = "controller_failover"
+
+	// TypePortAdded a device reported a port that wasn't known
+	TypePortAdded = "port_added"
+
+	// TypePortModified a device reported a change to a known port
+	TypePortModified = "port_modified"
+
+	// TypePortDeleted a device reported a known port was removed
+	TypePortDeleted = "port_deleted"
+)
+
+// Event is a notification of something that happened within oftee
+type Event struct {
+	Type         string      `json:"type"`
+	DPID         string      `json:"dpid,omitempty"`
+	RemoteAddr   string      `json:"remote_addr,omitempty"`
+	Timestamp    time.Time   `json:"timestamp"`
+	SessionStats interface{} `json:"session_stats,omitempty"`
+	Endpoint     interface{} `json:"endpoint,omitempty"`
+	Port         interface{} `json:"port,omitempty"`
+
+	// The SDN controller failed over to, and from
+	Controller         string `json:"controller,omitempty"`
+	PreviousController string `json:"previous_controller,omitempty"`
+}
+
+// Target is something to which events are delivered
+type Target interface {
+	// Accepts returns true if the target is interested in events of the
+	// given type
+	Accepts(eventType string) bool
+
+	// Offer queues an event for delivery, it must not block
+	Offer(event Event)
+}
+
+// Notifier delivers events to the targets interested in them
+type Notifier struct {
+	Targets []Target
+}
+
+// Notify offers an event to each interested target. It never blocks, so it
+// can be called from the data path.
+func (n *Notifier) Notify(event Event) {
+	if n == nil {
+		return
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	for _, target := range n.Targets {
+		if target.Accepts(event.Type) {
+			target.Offer(event)
+		}
+	}
+}
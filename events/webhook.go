@@ -0,0 +1,235 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Terms used in a webhook specification
+const (
+	// TermTypes term used to specify the event types delivered to a
+	// webhook, separated by `|`
+	TermTypes = "types"
+
+	// TermAuth term used to specify the value of the Authorization header
+	// sent to a webhook
+	TermAuth = "auth"
+
+	// TermAction term used to specify the webhook URL
+	TermAction = "action"
+)
+
+// Webhook defaults
+const (
+	// DefaultQueueSize maximum number of events pending delivery to a
+	// webhook, further events are dropped
+	DefaultQueueSize = 100
+
+	// DefaultMaxAttempts maximum number of attempts to deliver an event
+	DefaultMaxAttempts = 5
+
+	// DefaultBackoff delay before the first retry, doubled for each
+	// subsequent retry
+	DefaultBackoff = 500 * time.Millisecond
+
+	// DefaultMaxBackoff maximum delay between retries
+	DefaultMaxBackoff = 30 * time.Second
+
+	// DefaultTimeout timeout for a single delivery attempt
+	DefaultTimeout = 10 * time.Second
+)
+
+// Webhook delivers events by POSTing them, as JSON, to a URL. Events are
+// queued and delivered, with retries, by a separate go routine so that
+// delivery never affects the caller.
+type Webhook struct {
+	URL         string
+	Auth        string
+	Types       map[string]bool
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+
+	client    *http.Client
+	queue     chan Event
+	delivered uint64
+	failed    uint64
+	dropped   uint64
+}
+
+// WebhookStats delivery statistics for a webhook
+type WebhookStats struct {
+	Delivered uint64
+	Failed    uint64
+	Dropped   uint64
+}
+
+// ParseWebhook parses a webhook specification, of the form
+// `[types=device_connected|device_disconnected;][auth=value;]action=url`,
+// where the URL may also be given alone. If no types are specified all events
+// are delivered. If no auth value is given the default, if any, is used.
+func ParseWebhook(spec, defaultAuth string) (*Webhook, error) {
+	w := &Webhook{Auth: defaultAuth}
+	for _, part := range strings.Split(spec, ";") {
+		terms := strings.SplitN(part, "=", 2)
+		if len(terms) == 1 {
+			w.URL = terms[0]
+			continue
+		}
+		switch strings.ToLower(terms[0]) {
+		case TermTypes:
+			w.Types = make(map[string]bool)
+			for _, t := range strings.Split(terms[1], "|") {
+				switch t {
+				case TypeDeviceConnected, TypeDeviceDisconnected, TypeControllerFailover:
+					w.Types[t] = true
+				default:
+					return nil, fmt.Errorf("unknown event type '%s' for webhook '%s'", t, spec)
+				}
+			}
+		case TermAuth:
+			w.Auth = terms[1]
+		case TermAction:
+			w.URL = terms[1]
+		default:
+			return nil, fmt.Errorf("unknown term '%s' for webhook '%s'", terms[0], spec)
+		}
+	}
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("webhook URL '%s' must be http or https", w.URL)
+	}
+	return w, nil
+}
+
+// Initialize creates the delivery queue and sets the defaults for values that
+// are not set
+func (w *Webhook) Initialize() *Webhook {
+	if w.MaxAttempts <= 0 {
+		w.MaxAttempts = DefaultMaxAttempts
+	}
+	if w.Backoff <= 0 {
+		w.Backoff = DefaultBackoff
+	}
+	if w.MaxBackoff <= 0 {
+		w.MaxBackoff = DefaultMaxBackoff
+	}
+	w.client = &http.Client{Timeout: DefaultTimeout}
+	w.queue = make(chan Event, DefaultQueueSize)
+	return w
+}
+
+// Accepts returns true if the webhook is interested in the event type
+func (w *Webhook) Accepts(eventType string) bool {
+	return len(w.Types) == 0 || w.Types[eventType]
+}
+
+// Offer queues an event for delivery, if the queue is full the event is
+// dropped
+func (w *Webhook) Offer(event Event) {
+	select {
+	case w.queue <- event:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+		log.
+			WithFields(log.Fields{
+				"webhook": w.URL,
+				"event":   event.Type,
+				"dpid":    event.DPID,
+			}).
+			Warn("Webhook queue full, dropping event")
+	}
+}
+
+// Stats returns the delivery statistics of the webhook
+func (w *Webhook) Stats() WebhookStats {
+	return WebhookStats{
+		Delivered: atomic.LoadUint64(&w.delivered),
+		Failed:    atomic.LoadUint64(&w.failed),
+		Dropped:   atomic.LoadUint64(&w.dropped),
+	}
+}
+
+// post makes a single attempt to deliver an event
+func (w *Webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.Auth != "" {
+		req.Header.Set("Authorization", w.Auth)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+// deliver delivers an event, retrying with an exponential backoff
+func (w *Webhook) deliver(event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		atomic.AddUint64(&w.failed, 1)
+		log.
+			WithError(err).
+			Error("Unable to marshal event for webhook")
+		return
+	}
+	backoff := w.Backoff
+	for attempt := 1; ; attempt++ {
+		if err = w.post(body); err == nil {
+			atomic.AddUint64(&w.delivered, 1)
+			return
+		}
+		if attempt >= w.MaxAttempts {
+			break
+		}
+		log.
+			WithFields(log.Fields{
+				"webhook": w.URL,
+				"event":   event.Type,
+				"attempt": attempt,
+			}).
+			WithError(err).
+			Debug("Webhook delivery failed, retrying")
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > w.MaxBackoff {
+			backoff = w.MaxBackoff
+		}
+	}
+	atomic.AddUint64(&w.failed, 1)
+	log.
+		WithFields(log.Fields{
+			"webhook":  w.URL,
+			"event":    event.Type,
+			"dpid":     event.DPID,
+			"attempts": w.MaxAttempts,
+		}).
+		WithError(err).
+		Error("Unable to deliver event to webhook")
+}
+
+// ListenAndSend delivers queued events, in order, until the queue is closed
+func (w *Webhook) ListenAndSend() error {
+	for event := range w.queue {
+		w.deliver(event)
+	}
+	return nil
+}
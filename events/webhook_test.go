@@ -0,0 +1,152 @@
+package events
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a webhook server that fails the first `failures` requests and
+// records the events it accepts
+type recorder struct {
+	lock     sync.Mutex
+	failures int
+	requests int
+	auth     []string
+	events   []map[string]interface{}
+}
+
+func (r *recorder) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.requests++
+	if r.requests <= r.failures {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var event map[string]interface{}
+	if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.auth = append(r.auth, req.Header.Get("Authorization"))
+	r.events = append(r.events, event)
+}
+
+func (r *recorder) received() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.events)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !cond() {
+		t.Fatal("Timed out waiting for webhook delivery")
+	}
+}
+
+func TestWebhookPayloadAndRetry(t *testing.T) {
+	r := &recorder{failures: 2}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	w, err := ParseWebhook("auth=Bearer abc=;action="+server.URL, "Bearer default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Backoff = time.Millisecond
+	w.Initialize()
+	go w.ListenAndSend()
+
+	notifier := &Notifier{Targets: []Target{w}}
+	notifier.Notify(Event{
+		Type:         TypeDeviceDisconnected,
+		DPID:         "0x0000000000000001",
+		RemoteAddr:   "127.0.0.1:1234",
+		SessionStats: map[string]int{"messages": 3},
+	})
+	waitFor(t, func() bool { return r.received() == 1 })
+
+	event := r.events[0]
+	if event["type"] != TypeDeviceDisconnected || event["dpid"] != "0x0000000000000001" ||
+		event["remote_addr"] != "127.0.0.1:1234" || event["timestamp"] == "" {
+		t.Errorf("Incorrect event payload, got %+v", event)
+	}
+	if stats, ok := event["session_stats"].(map[string]interface{}); !ok || stats["messages"] != float64(3) {
+		t.Errorf("Incorrect session statistics, got %+v", event["session_stats"])
+	}
+	if r.auth[0] != "Bearer abc=" {
+		t.Errorf("Incorrect Authorization header, got '%s'", r.auth[0])
+	}
+	if r.requests != 3 {
+		t.Errorf("Expected 3 delivery attempts, got %d", r.requests)
+	}
+	if stats := w.Stats(); stats.Delivered != 1 || stats.Failed != 0 {
+		t.Errorf("Incorrect webhook statistics, got %+v", stats)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	r := &recorder{failures: 100}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	w, err := ParseWebhook(server.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.MaxAttempts = 3
+	w.Backoff = time.Millisecond
+	w.Initialize()
+	go w.ListenAndSend()
+	w.Offer(Event{Type: TypeDeviceConnected})
+	waitFor(t, func() bool { return w.Stats().Failed == 1 })
+	if r.requests != 3 {
+		t.Errorf("Expected 3 delivery attempts, got %d", r.requests)
+	}
+}
+
+func TestWebhookTypeFilter(t *testing.T) {
+	w, err := ParseWebhook("types=device_connected;http://127.0.0.1:1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.Accepts(TypeDeviceConnected) || w.Accepts(TypeDeviceDisconnected) {
+		t.Errorf("Incorrect type filter, got %v", w.Types)
+	}
+	if w, _ = ParseWebhook("types=controller_failover;http://127.0.0.1:1", ""); w == nil || !w.Accepts(TypeControllerFailover) {
+		t.Error("Expected webhook to accept controller failovers")
+	}
+	if w, _ = ParseWebhook("http://127.0.0.1:1", ""); !w.Accepts(TypeDeviceDisconnected) {
+		t.Error("Expected webhook without filter to accept all events")
+	}
+	for _, spec := range []string{
+		"types=device_rebooted;http://127.0.0.1:1",
+		"color=red;http://127.0.0.1:1",
+		"tcp://127.0.0.1:1",
+	} {
+		if _, err = ParseWebhook(spec, ""); err == nil {
+			t.Errorf("Expected error parsing webhook '%s'", spec)
+		}
+	}
+}
+
+func TestWebhookQueueBounded(t *testing.T) {
+	w, _ := ParseWebhook("http://127.0.0.1:1", "")
+	w.Initialize()
+
+	// Nothing is delivering, so events beyond the queue size are dropped
+	for i := 0; i < DefaultQueueSize+5; i++ {
+		w.Offer(Event{Type: TypeDeviceConnected})
+	}
+	if stats := w.Stats(); stats.Dropped != 5 {
+		t.Errorf("Expected 5 dropped events, got %d", stats.Dropped)
+	}
+}
@@ -0,0 +1,161 @@
+// Package hooks lets code that embeds oftee run its own code as devices
+// connect, are identified by their DPID, send packet ins and disconnect,
+// without forking oftee.
+//
+// Each hook is optional, a nil hook, and a nil or zero `Hooks`, does nothing.
+// Hooks are called synchronously on the goroutine that reads the device's
+// connection, so the hooks for a single device are never called
+// concurrently and are called in the order the events happen, but the hooks
+// for different devices are called concurrently. A hook that blocks stops
+// the device's messages from being read, and proxied to the SDN controller,
+// so a hook that does anything slow should hand the work off to its own
+// goroutine.
+//
+// A hook that panics is recovered, the panic is logged and counted, see
+// `Stats`, and processing continues as if the hook was not set.
+package hooks
+
+import (
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciena/oftee/datapath"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConnInfo describes the connection from a device
+type ConnInfo struct {
+	RemoteAddr string
+	LocalAddr  string
+	Connected  time.Time
+}
+
+// PacketInMeta describes a packet in received from a device. `Length` is the
+// length of the OpenFlow message, the payload is the packet.
+type PacketInMeta struct {
+	ConnInfo
+	DPID     uint64
+	Port     uint32
+	Length   uint16
+	Received time.Time
+}
+
+// DisconnectStats the statistics of the connection from a device when it is
+// disconnected. `DPID` is zero if it was never learned and `Reason` is only
+// set if the device was forcibly disconnected via the API.
+type DisconnectStats struct {
+	DPID      uint64
+	Duration  time.Duration
+	Messages  uint64
+	PacketIns uint64
+	Bytes     uint64
+	Reason    string
+}
+
+// Hooks the callbacks made as devices connect, are identified, send packet
+// ins and disconnect
+type Hooks struct {
+	// OnConnect is called when a device connects, before the connection
+	// to the SDN controller is established
+	OnConnect func(info ConnInfo)
+
+	// OnDPID is called when the DPID of a device is first learned, from
+	// its features reply
+	OnDPID func(dpid uint64, info ConnInfo)
+
+	// OnPacketIn is called for each packet in, once it has been proxied
+	// to the SDN controller and before it is tee-ed. The packet in is
+	// only tee-ed if it returns true. The payload is reused once the hook
+	// returns, so it must be copied to be kept.
+	OnPacketIn func(meta PacketInMeta, payload []byte) (allowTee bool)
+
+	// OnDisconnect is called once the messages from a device are no
+	// longer read, its connection to the SDN controller is closed and it
+	// is no longer known to the API
+	OnDisconnect func(info ConnInfo, stats DisconnectStats)
+
+	panics [hookCount]uint64
+}
+
+// Indexes of the hooks, for counting their panics
+const (
+	hookConnect = iota
+	hookDPID
+	hookPacketIn
+	hookDisconnect
+	hookCount
+)
+
+// hookNames the names of the hooks, by index
+var hookNames = [hookCount]string{"on_connect", "on_dpid", "on_packet_in", "on_disconnect"}
+
+// Stats the number of times each hook panicked
+type Stats struct {
+	Panics map[string]uint64 `json:"panics"`
+}
+
+// recovered recovers a panic in a hook, logging and counting it
+func (h *Hooks) recovered(hook int, dpid uint64) {
+	if r := recover(); r != nil {
+		atomic.AddUint64(&h.panics[hook], 1)
+		log.
+			WithFields(log.Fields{
+				"hook":  hookNames[hook],
+				"dpid":  datapath.Format(dpid),
+				"panic": r,
+				"stack": string(debug.Stack()),
+			}).
+			Error("Hook panicked, recovered")
+	}
+}
+
+// Connect calls the `OnConnect` hook, if set
+func (h *Hooks) Connect(info ConnInfo) {
+	if h == nil || h.OnConnect == nil {
+		return
+	}
+	defer h.recovered(hookConnect, 0)
+	h.OnConnect(info)
+}
+
+// DPID calls the `OnDPID` hook, if set
+func (h *Hooks) DPID(dpid uint64, info ConnInfo) {
+	if h == nil || h.OnDPID == nil {
+		return
+	}
+	defer h.recovered(hookDPID, dpid)
+	h.OnDPID(dpid, info)
+}
+
+// PacketIn calls the `OnPacketIn` hook, if set, and returns whether the
+// packet in is tee-ed. It is if the hook is not set, or panics.
+func (h *Hooks) PacketIn(meta PacketInMeta, payload []byte) (allowTee bool) {
+	if h == nil || h.OnPacketIn == nil {
+		return true
+	}
+	allowTee = true
+	defer h.recovered(hookPacketIn, meta.DPID)
+	return h.OnPacketIn(meta, payload)
+}
+
+// Disconnect calls the `OnDisconnect` hook, if set
+func (h *Hooks) Disconnect(info ConnInfo, stats DisconnectStats) {
+	if h == nil || h.OnDisconnect == nil {
+		return
+	}
+	defer h.recovered(hookDisconnect, stats.DPID)
+	h.OnDisconnect(info, stats)
+}
+
+// Stats returns the number of times each hook panicked
+func (h *Hooks) Stats() Stats {
+	stats := Stats{Panics: make(map[string]uint64, hookCount)}
+	if h == nil {
+		return stats
+	}
+	for i := range h.panics {
+		stats.Panics[hookNames[i]] = atomic.LoadUint64(&h.panics[i])
+	}
+	return stats
+}
@@ -0,0 +1,47 @@
+package hooks
+
+import (
+	"testing"
+)
+
+func TestNoHooks(t *testing.T) {
+	// Neither a nil nor a zero value runs anything, and both tee
+	var none *Hooks
+	for _, h := range []*Hooks{none, {}} {
+		h.Connect(ConnInfo{})
+		h.DPID(0x1, ConnInfo{})
+		h.Disconnect(ConnInfo{}, DisconnectStats{})
+		if !h.PacketIn(PacketInMeta{}, nil) {
+			t.Error("Expected packet in tee-ed without a hook")
+		}
+		if panics := h.Stats().Panics; panics["on_packet_in"] != 0 {
+			t.Errorf("Expected no panics, got %v", panics)
+		}
+	}
+}
+
+func TestHookPanicsRecovered(t *testing.T) {
+	h := &Hooks{
+		OnConnect: func(info ConnInfo) {
+			panic("connect")
+		},
+		OnPacketIn: func(meta PacketInMeta, payload []byte) bool {
+			if meta.Port == 2 {
+				return false
+			}
+			panic("packet in")
+		},
+	}
+	h.Connect(ConnInfo{RemoteAddr: "10.0.0.1:5000"})
+	h.Connect(ConnInfo{RemoteAddr: "10.0.0.1:5001"})
+	if !h.PacketIn(PacketInMeta{DPID: 0x1, Port: 1}, nil) {
+		t.Error("Expected packet in tee-ed when the hook panics")
+	}
+	if h.PacketIn(PacketInMeta{DPID: 0x1, Port: 2}, nil) {
+		t.Error("Expected packet in vetoed by the hook")
+	}
+	panics := h.Stats().Panics
+	if panics["on_connect"] != 2 || panics["on_packet_in"] != 1 || panics["on_disconnect"] != 0 {
+		t.Errorf("Incorrect panic counts, got %v", panics)
+	}
+}
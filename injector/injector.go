@@ -7,9 +7,15 @@
 package injector
 
 import (
-	"fmt"
+	"bytes"
+	"context"
 	"io"
+	"net"
+	"sync/atomic"
+	"time"
 
+	"github.com/ciena/oftee/connections"
+	"github.com/ciena/oftee/datapath"
 	of "github.com/netrack/openflow"
 	log "github.com/sirupsen/logrus"
 )
@@ -21,18 +27,64 @@ type tlvHeader struct {
 	header of.Header
 }
 
+// Batching controls how injected messages are coalesced into a single write
+// to the device. Messages are never split across writes and controller
+// messages are never interleaved with a batch, as a pending batch is flushed
+// before a controller message is written.
+type Batching struct {
+	// MaxBytes a batch is written once it reaches this size. Batching is
+	// disabled if zero.
+	MaxBytes int
+
+	// MaxMessages a batch is written once it contains this many messages
+	MaxMessages int
+
+	// Delay maximum time a message waits for others to be batched with it
+	Delay time.Duration
+}
+
+// DefaultBatching batching used by injectors unless otherwise specified
+var DefaultBatching = Batching{
+	MaxBytes:    64 * 1024,
+	MaxMessages: 100,
+	Delay:       time.Millisecond,
+}
+
 // Injector type
 type Injector interface {
 	SetDPID(uint64)
 	GetDPID() uint64
-	Inject([]byte)
+	Inject(context.Context, []byte)
 	Stop()
 	Copy(io.Writer, io.Reader) (int64, error)
+	Healthy() bool
+	SetLog(*log.Entry)
 }
 
+// MaxSnoopLength messages from the controller longer than this are never
+// snooped, but copied as they are read
+const MaxSnoopLength = 1024
+
 // OFDeviceInjector implementation of Injector for OpenFlow devices
 type OFDeviceInjector struct {
-	DPID            uint64
+	DPID     uint64
+	Batching Batching
+
+	// Snoop if set is given each hello and set config message, header
+	// included, from the controller before it is written to the device.
+	// The message must not be modified or retained.
+	Snoop func(message []byte)
+
+	// Mirrored if set is asked, by its header, whether a message from the
+	// controller is to be mirrored, in which case it is read whole,
+	// written to the device and then given to Mirror, header included.
+	// Other messages are copied as they are read. The message must not be
+	// modified or retained.
+	Mirrored func(header of.Header) bool
+	Mirror   func(message []byte)
+
+	healthy         int32
+	entry           atomic.Value
 	dpid            chan uint64
 	controller      chan tlvHeader
 	controllerError chan error
@@ -42,9 +94,18 @@ type OFDeviceInjector struct {
 	mainStop        chan bool
 }
 
-// NewOFDeviceInjector creates an Injector instance.
+// NewOFDeviceInjector creates an Injector instance, using the default
+// batching.
 func NewOFDeviceInjector() Injector {
+	return NewOFDeviceInjectorWithBatching(DefaultBatching)
+}
+
+// NewOFDeviceInjectorWithBatching creates an Injector instance that batches
+// injected messages as specified.
+func NewOFDeviceInjectorWithBatching(batching Batching) Injector {
 	return &OFDeviceInjector{
+		Batching:        batching,
+		healthy:         1,
 		dpid:            make(chan uint64, 10),
 		controller:      make(chan tlvHeader),
 		controllerError: make(chan error),
@@ -72,10 +133,17 @@ func (i *OFDeviceInjector) readHeaders(src io.Reader) {
 		default:
 			tlv.size, err = tlv.header.ReadFrom(src)
 			if err != nil && err != io.EOF {
-				i.controllerError <- err
+				select {
+				case <-i.headerStop:
+				case i.controllerError <- err:
+				}
 				return
 			}
-			i.controller <- tlv
+			select {
+			case <-i.headerStop:
+				return
+			case i.controller <- tlv:
+			}
 
 			// Pause reading from controller, until rest of packet message
 			// is copied from the controller to the device
@@ -88,9 +156,22 @@ func (i *OFDeviceInjector) readHeaders(src io.Reader) {
 	}
 }
 
-// Inject injects a packet to the managed device (packet out)
-func (i *OFDeviceInjector) Inject(message []byte) {
-	i.injector <- message
+// Inject injects a packet to the managed device (packet out). Once the
+// injector is stopped, or the context is done while waiting for the packet
+// to be accepted, the packet is dropped.
+func (i *OFDeviceInjector) Inject(ctx context.Context, message []byte) {
+	select {
+	case i.injector <- message:
+	case <-i.mainStop:
+	case <-ctx.Done():
+	}
+}
+
+// Healthy returns true while the connections between the device and the
+// SDN controller are being serviced, i.e. until the copy fails or the
+// injector is stopped
+func (i *OFDeviceInjector) Healthy() bool {
+	return atomic.LoadInt32(&i.healthy) == 1
 }
 
 // SetDPID associates a DPID with an injector
@@ -98,15 +179,177 @@ func (i *OFDeviceInjector) SetDPID(dpid uint64) {
 	i.dpid <- dpid
 }
 
+// SetLog sets the log entry, carrying the fields of the device connection,
+// used for the lines logged by the injector
+func (i *OFDeviceInjector) SetLog(entry *log.Entry) {
+	i.entry.Store(entry)
+}
+
+// logger returns the log entry for the device connection, if set, else one
+// carrying the DPID
+func (i *OFDeviceInjector) logger() *log.Entry {
+	if entry, ok := i.entry.Load().(*log.Entry); ok {
+		return entry
+	}
+	return log.WithFields(log.Fields{
+		"dpid": datapath.Format(i.DPID),
+	})
+}
+
 // GetDPID returns the associated DPID
 func (i *OFDeviceInjector) GetDPID() uint64 {
 	return i.DPID
 }
 
-// Stop sends stop messages to the go routines
+// Stop signals the go routines to stop. It does not block, as the header
+// reader may be blocked reading from the controller until its connection is
+// closed.
 func (i *OFDeviceInjector) Stop() {
-	i.headerStop <- true
-	i.mainStop <- true
+	atomic.StoreInt32(&i.healthy, 0)
+	close(i.headerStop)
+	close(i.mainStop)
+}
+
+// batch is a set of injected messages to be written to a device as a single
+// write
+type batch struct {
+	buffers net.Buffers
+	size    int
+	flush   <-chan time.Time
+}
+
+// add adds a message to the batch
+func (b *batch) add(message []byte) {
+	b.buffers = append(b.buffers, message)
+	b.size += len(message)
+}
+
+// full returns true if the batch should be written
+func (b *batch) full(batching Batching) bool {
+	return batching.MaxBytes <= 0 || b.size >= batching.MaxBytes ||
+		(batching.MaxMessages > 0 && len(b.buffers) >= batching.MaxMessages)
+}
+
+// writeBatch writes the pending injected messages to the device, as a single
+// write (writev) when the device is a network connection
+func (i *OFDeviceInjector) writeBatch(dst io.Writer, b *batch) error {
+	if len(b.buffers) == 0 {
+		return nil
+	}
+	i.logger().WithFields(log.Fields{
+		"messages": len(b.buffers),
+		"bytes":    b.size,
+	}).Debug("Writing packet outs to device")
+	buffers := b.buffers
+	b.buffers, b.size, b.flush = b.buffers[:0], 0, nil
+	if _, err := buffers.WriteTo(dst); err != nil && err != io.EOF {
+		i.logger().
+			WithError(err).
+			Error("Error while attempting to write packet to device")
+		return err
+	}
+	return nil
+}
+
+// snooped returns true if a message from the controller is to be snooped
+func (i *OFDeviceInjector) snooped(header of.Header) bool {
+	return i.Snoop != nil && header.Length <= MaxSnoopLength &&
+		(header.Type == of.TypeHello || header.Type == of.TypeSetConfig)
+}
+
+// fullWriter writes each buffer to the device in full, see
+// `connections.WriteFull`
+type fullWriter struct {
+	io.Writer
+}
+
+// Write writes all of the given bytes
+func (w fullWriter) Write(b []byte) (int, error) {
+	return connections.WriteFull(w.Writer, b)
+}
+
+// copyMessage copies the rest of a message from the controller to the
+// device, as it is read. A message cut short by the controller is an error,
+// as the device's framing of the stream is lost.
+func (i *OFDeviceInjector) copyMessage(dst io.Writer, src io.Reader, tlv tlvHeader) error {
+	if _, err := tlv.header.WriteTo(fullWriter{dst}); err != nil {
+		i.logger().
+			WithError(err).
+			Error("Error while attempting to write header to device")
+		return err
+	}
+	if _, err := io.CopyN(fullWriter{dst}, src, int64(tlv.header.Length)-tlv.size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		i.logger().
+			WithError(err).
+			Error("Error while attempting to write packet to device")
+		return err
+	}
+	return nil
+}
+
+// mirrored returns true if a message from the controller is to be mirrored
+func (i *OFDeviceInjector) mirrored(header of.Header) bool {
+	return i.Mirror != nil && i.Mirrored != nil && i.Mirrored(header)
+}
+
+// readMessage reads the rest of a message from the controller, returning it
+// with its header
+func (i *OFDeviceInjector) readMessage(src io.Reader, tlv tlvHeader) ([]byte, error) {
+	var buffer bytes.Buffer
+	if _, err := tlv.header.WriteTo(&buffer); err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(&buffer, src, int64(tlv.header.Length)-tlv.size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		i.logger().
+			WithError(err).
+			Error("Error while attempting to read message from controller")
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// writeMessage writes a message from the controller, read whole, to the
+// device
+func (i *OFDeviceInjector) writeMessage(dst io.Writer, message []byte) error {
+	if _, err := connections.WriteFull(dst, message); err != nil && err != io.EOF {
+		i.logger().
+			WithError(err).
+			Error("Error while attempting to write packet to device")
+		return err
+	}
+	return nil
+}
+
+// snoop reads the rest of a message from the controller, so that it can be
+// snooped, and then writes it, unchanged, to the device
+func (i *OFDeviceInjector) snoop(dst io.Writer, src io.Reader, tlv tlvHeader) error {
+	message, err := i.readMessage(src, tlv)
+	if err != nil {
+		return err
+	}
+	i.Snoop(message)
+	return i.writeMessage(dst, message)
+}
+
+// mirror reads the rest of a message from the controller, writes it,
+// unchanged, to the device and then mirrors it, so that the message isn't
+// delayed by mirroring
+func (i *OFDeviceInjector) mirror(dst io.Writer, src io.Reader, tlv tlvHeader) error {
+	message, err := i.readMessage(src, tlv)
+	if err != nil {
+		return err
+	}
+	if err = i.writeMessage(dst, message); err != nil {
+		return err
+	}
+	i.Mirror(message)
+	return nil
 }
 
 // Copy copies OpenFlow messages from the source (`src`) to the destination (`dest`).
@@ -116,6 +359,10 @@ func (i *OFDeviceInjector) Copy(dst io.Writer, src io.Reader) (int64, error) {
 	var err error
 	var tlv tlvHeader
 	var message []byte
+	var pending batch
+
+	// Once the copy ends, the device can no longer be serviced
+	defer atomic.StoreInt32(&i.healthy, 0)
 
 	// Start the header reader
 	go i.readHeaders(src)
@@ -128,26 +375,27 @@ func (i *OFDeviceInjector) Copy(dst io.Writer, src io.Reader) (int64, error) {
 			return 0, nil
 		case i.DPID = <-i.dpid:
 		case tlv = <-i.controller:
-			_, err = tlv.header.WriteTo(dst)
-			if err != nil && err != io.EOF {
-				log.
-					WithError(err).
-					Error("Error while attempting to write header to device")
+			// Injected messages that are pending are written first,
+			// so they are not interleaved with the controller
+			// message
+			if err = i.writeBatch(dst, &pending); err != nil {
 				return 0, err
 			}
-			_, err = io.CopyN(dst, src, int64(tlv.header.Length)-tlv.size)
-			if err != nil && err != io.EOF {
-				log.
-					WithError(err).
-					Error("Error while attempting to write packet to device")
+			switch {
+			case i.snooped(tlv.header):
+				err = i.snoop(dst, src, tlv)
+			case i.mirrored(tlv.header):
+				err = i.mirror(dst, src, tlv)
+			default:
+				err = i.copyMessage(dst, src, tlv)
+			}
+			if err != nil {
 				return 0, err
-
 			}
 			i.headerReadWait <- true
-			// TODO handle case where not all the bytes were copied
 
 		case err = <-i.controllerError:
-			log.
+			i.logger().
 				WithError(err).
 				Debug("Failed to read OpenFlow message header")
 			return 0, err
@@ -155,20 +403,31 @@ func (i *OFDeviceInjector) Copy(dst io.Writer, src io.Reader) (int64, error) {
 			// TODO Validate the the frame is legal, at least
 			// that the length of the Frame is the same as the
 			// size of the message array
-			log.WithFields(log.Fields{
-				"dpid":    fmt.Sprintf("0x%016x", i.DPID),
-				"message": fmt.Sprintf("%02x", message),
-			}).Debug("Writing packet out to device")
-			_, err = dst.Write(message)
-			if err != nil && err != io.EOF {
-				log.
-					WithFields(log.Fields{
-						"dpid": fmt.Sprintf("0x%016x", i.DPID),
-					}).
-					WithError(err).
-					Error("Error while attempting to write packet to device")
-				return 0, err
+			pending.add(message)
 
+			// Add any other messages that are already queued
+		drain:
+			for !pending.full(i.Batching) {
+				select {
+				case message = <-i.injector:
+					pending.add(message)
+				default:
+					break drain
+				}
+			}
+
+			// Write the batch if it is full, else wait a short time
+			// for more messages
+			if pending.full(i.Batching) || i.Batching.Delay <= 0 {
+				if err = i.writeBatch(dst, &pending); err != nil {
+					return 0, err
+				}
+			} else if pending.flush == nil {
+				pending.flush = time.After(i.Batching.Delay)
+			}
+		case <-pending.flush:
+			if err = i.writeBatch(dst, &pending); err != nil {
+				return 0, err
 			}
 		}
 	}
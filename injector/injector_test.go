@@ -0,0 +1,256 @@
+package injector
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	of "github.com/netrack/openflow"
+)
+
+// message creates an OpenFlow packet out message, of the given size, whose
+// transaction ID is the given sequence number
+func message(seq uint32, size int) []byte {
+	m := make([]byte, size)
+	m[0] = 0x04
+	m[1] = byte(of.TypePacketOut)
+	binary.BigEndian.PutUint16(m[2:], uint16(size))
+	binary.BigEndian.PutUint32(m[4:], seq)
+	return m
+}
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// readMessages reads OpenFlow messages from the device side of the
+// connection and returns their transaction IDs
+func readMessages(t *testing.T, r io.Reader, count int) []uint32 {
+	var xids []uint32
+	header := make([]byte, 8)
+	for len(xids) < count {
+		if _, err := io.ReadFull(r, header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, int64(binary.BigEndian.Uint16(header[2:]))-8); err != nil {
+			t.Fatal(err)
+		}
+		xids = append(xids, binary.BigEndian.Uint32(header[4:]))
+	}
+	return xids
+}
+
+func TestBatchedInjectPreservesOrder(t *testing.T) {
+	device, dst := tcpPair(t)
+	defer device.Close()
+	defer dst.Close()
+	controller, src := net.Pipe()
+	defer controller.Close()
+
+	inject := NewOFDeviceInjectorWithBatching(Batching{MaxBytes: 1000, MaxMessages: 10, Delay: time.Millisecond})
+	go inject.Copy(dst, src)
+	defer inject.Stop()
+
+	// Messages of varying size, so batches are flushed on both limits
+	for i := 0; i < 200; i++ {
+		inject.Inject(context.Background(), message(uint32(i), 8+(i%7)*50))
+	}
+	for i, xid := range readMessages(t, device, 200) {
+		if xid != uint32(i) {
+			t.Fatalf("Expected message %d, got %d", i, xid)
+		}
+	}
+}
+
+func TestBatchFlushedBeforeControllerMessage(t *testing.T) {
+	device, dst := tcpPair(t)
+	defer device.Close()
+	defer dst.Close()
+	controller, src := net.Pipe()
+	defer controller.Close()
+
+	// A long delay, so only the controller message flushes the batch
+	inject := NewOFDeviceInjectorWithBatching(Batching{MaxBytes: 1 << 20, MaxMessages: 1000, Delay: time.Hour})
+	go inject.Copy(dst, src)
+	defer inject.Stop()
+
+	for i := 0; i < 3; i++ {
+		inject.Inject(context.Background(), message(uint32(i), 64))
+	}
+	time.Sleep(10 * time.Millisecond)
+	go controller.Write(message(100, 64))
+	xids := readMessages(t, device, 4)
+	if !reflect.DeepEqual(xids, []uint32{0, 1, 2, 100}) {
+		t.Errorf("Expected injected messages before controller message, got %v", xids)
+	}
+}
+
+func TestInjectAfterStopDoesNotBlock(t *testing.T) {
+	inject := NewOFDeviceInjector()
+	inject.Stop()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			inject.Inject(context.Background(), message(uint32(i), 64))
+		}
+		done <- struct{}{}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("Inject blocked after injector stopped")
+	}
+	if inject.Healthy() {
+		t.Error("Expected stopped injector to be unhealthy")
+	}
+}
+
+func TestInjectCancelled(t *testing.T) {
+	// Never copying, so once its buffer is full injecting blocks until the
+	// context is done
+	inject := NewOFDeviceInjector()
+	defer inject.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			inject.Inject(ctx, message(uint32(i), 64))
+		}
+		done <- struct{}{}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("Inject blocked after context cancelled")
+	}
+}
+
+func benchmarkInject(b *testing.B, batching Batching) {
+	device, dst := tcpPair(b)
+	defer device.Close()
+	defer dst.Close()
+	controller, src := net.Pipe()
+	defer controller.Close()
+
+	inject := NewOFDeviceInjectorWithBatching(batching)
+	go inject.Copy(dst, src)
+	defer inject.Stop()
+
+	m := message(0, 128)
+	b.SetBytes(int64(len(m)))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			inject.Inject(context.Background(), m)
+		}
+	}()
+	if _, err := io.CopyN(ioutil.Discard, device, int64(b.N*len(m))); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkInjectUnbatched(b *testing.B) {
+	benchmarkInject(b, Batching{})
+}
+
+func BenchmarkInjectBatched(b *testing.B) {
+	benchmarkInject(b, DefaultBatching)
+}
+
+func TestMirrorControllerMessages(t *testing.T) {
+	device, dst := tcpPair(t)
+	defer device.Close()
+	defer dst.Close()
+	controller, src := net.Pipe()
+	defer controller.Close()
+
+	// Only the flow mods are mirrored, once written to the device, and
+	// every message reaches the device unchanged
+	mirrored := make(chan []byte, 10)
+	inject := NewOFDeviceInjector().(*OFDeviceInjector)
+	inject.Mirrored = func(header of.Header) bool { return header.Type == of.TypeFlowMod }
+	inject.Mirror = func(message []byte) { mirrored <- append([]byte(nil), message...) }
+	go inject.Copy(dst, src)
+	defer inject.Stop()
+
+	flowMod := message(1, 2000)
+	flowMod[1] = byte(of.TypeFlowMod)
+	for i := 8; i < len(flowMod); i++ {
+		flowMod[i] = byte(i)
+	}
+	go func() {
+		controller.Write(message(0, 64))
+		controller.Write(flowMod)
+		controller.Write(message(2, 64))
+	}()
+	received := make([]byte, 64+len(flowMod)+64)
+	if _, err := io.ReadFull(device, received); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(received[64:64+len(flowMod)], flowMod) {
+		t.Error("Expected the flow mod written to the device unchanged")
+	}
+	select {
+	case m := <-mirrored:
+		if !reflect.DeepEqual(m, flowMod) {
+			t.Error("Expected the flow mod mirrored whole")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the flow mod mirrored")
+	}
+	if len(mirrored) != 0 {
+		t.Errorf("Expected only the flow mod mirrored, got %d more", len(mirrored))
+	}
+}
+
+// trickleWriter writes at most a few bytes of each buffer, as a congested
+// device connection may
+type trickleWriter struct {
+	bytes.Buffer
+}
+
+func (w *trickleWriter) Write(b []byte) (int, error) {
+	if len(b) > 3 {
+		b = b[:3]
+	}
+	return w.Buffer.Write(b)
+}
+
+func TestCopyShortWritesAndTruncatedMessage(t *testing.T) {
+	// The first message is written whole despite the short writes and the
+	// second, cut short by the controller, fails the copy
+	first := message(1, 100)
+	src := bytes.NewReader(append(append([]byte(nil), first...), message(2, 100)[:50]...))
+	dst := &trickleWriter{}
+	inject := NewOFDeviceInjector()
+	defer inject.Stop()
+
+	if _, err := inject.Copy(dst, src); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected the truncated message to fail the copy, got %v", err)
+	}
+	if written := dst.Bytes(); len(written) < len(first) || !reflect.DeepEqual(written[:len(first)], first) {
+		t.Error("Expected the first message written to the device whole")
+	}
+}
@@ -0,0 +1,88 @@
+package harness
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Controller a fake SDN controller, listening on the loopback interface, that
+// records the messages it receives on each connection
+type Controller struct {
+	listener net.Listener
+	t        testing.TB
+
+	lock    sync.Mutex
+	changed chan struct{}
+	conns   []*Recorder
+}
+
+// NewController creates a controller that is listening
+func NewController(t testing.TB) *Controller {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Controller{listener: listener, t: t, changed: make(chan struct{})}
+	go c.accept()
+	return c
+}
+
+// accept records each connection, until the controller is closed
+func (c *Controller) accept() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+		r := newRecorder(conn)
+		go r.record(readMessage)
+		c.lock.Lock()
+		c.conns = append(c.conns, r)
+		close(c.changed)
+		c.changed = make(chan struct{})
+		c.lock.Unlock()
+	}
+}
+
+// Addr returns the address on which the controller is listening
+func (c *Controller) Addr() string {
+	return c.listener.Addr().String()
+}
+
+// Conn waits for the i-th connection, from 0, to be accepted and returns its
+// recorder. Messages are written to the device via its `Conn`.
+func (c *Controller) Conn(i int) *Recorder {
+	deadline := time.After(Timeout)
+	for {
+		c.lock.Lock()
+		conns, changed := c.conns, c.changed
+		c.lock.Unlock()
+		if len(conns) > i {
+			return conns[i]
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			c.t.Fatalf("Expected connection %d to the controller, only %d accepted within %s", i, len(conns), Timeout)
+		}
+	}
+}
+
+// Connections returns the number of connections accepted
+func (c *Controller) Connections() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.conns)
+}
+
+// Close stops listening and closes every connection
+func (c *Controller) Close() {
+	c.listener.Close()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, r := range c.conns {
+		r.Conn.Close()
+	}
+}
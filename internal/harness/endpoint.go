@@ -0,0 +1,331 @@
+package harness
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/api/pb"
+	"google.golang.org/grpc"
+)
+
+// TCPEndpoint a fake TCP end point that records the frames tee-ed to it, over
+// all the connections it accepts. It can be made slow to read, can drop its
+// connections and can stop, and restart, listening on the same address.
+type TCPEndpoint struct {
+	Frames *Recorder
+
+	t       testing.TB
+	address string
+
+	lock        sync.Mutex
+	listener    net.Listener
+	conns       []net.Conn
+	connections int
+	open        int
+	readDelay   time.Duration
+}
+
+// NewTCPEndpoint creates an end point that is listening
+func NewTCPEndpoint(t testing.TB) *TCPEndpoint {
+	e := &TCPEndpoint{Frames: newRecorder(nil), t: t, address: "127.0.0.1:0"}
+	e.Start()
+	return e
+}
+
+// Start listens on the address of the end point, the same address once it
+// has been stopped
+func (e *TCPEndpoint) Start() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	listener, err := net.Listen("tcp", e.address)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	e.listener = listener
+	e.address = listener.Addr().String()
+	go e.accept(listener)
+}
+
+// accept records the frames read from each connection, until the listener
+// is closed
+func (e *TCPEndpoint) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		e.lock.Lock()
+		e.conns = append(e.conns, conn)
+		e.connections++
+		e.open++
+		e.lock.Unlock()
+		go e.read(conn)
+	}
+}
+
+// read records the frames read from a connection, waiting the read delay
+// before each
+func (e *TCPEndpoint) read(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		e.lock.Lock()
+		e.open--
+		e.lock.Unlock()
+	}()
+	for {
+		e.lock.Lock()
+		delay := e.readDelay
+		e.lock.Unlock()
+		time.Sleep(delay)
+		frame, err := ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		e.Frames.add(frame)
+	}
+}
+
+// Addr returns the address of the end point
+func (e *TCPEndpoint) Addr() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.address
+}
+
+// Spec returns an end point specification, with the given terms, that tees
+// to the end point
+func (e *TCPEndpoint) Spec(terms ...string) string {
+	return strings.Join(append(terms, "action=tcp://"+e.Addr()), ";")
+}
+
+// SetReadDelay delays each frame read by the given duration, so that oftee
+// sees a slow consumer
+func (e *TCPEndpoint) SetReadDelay(delay time.Duration) {
+	e.lock.Lock()
+	e.readDelay = delay
+	e.lock.Unlock()
+}
+
+// Connections returns the number of connections accepted
+func (e *TCPEndpoint) Connections() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.connections
+}
+
+// WaitConnections waits for at least n connections to have been accepted
+func (e *TCPEndpoint) WaitConnections(t testing.TB, n int) {
+	deadline := time.Now().Add(Timeout)
+	for e.Connections() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d connections to the end point, only %d accepted within %s", n, e.Connections(), Timeout)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// WaitDisconnected waits for the connections accepted to have been closed by
+// oftee
+func (e *TCPEndpoint) WaitDisconnected(t testing.TB) {
+	deadline := time.Now().Add(Timeout)
+	for {
+		e.lock.Lock()
+		open := e.open
+		e.lock.Unlock()
+		if open == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the connections to the end point closed, %d still open after %s", open, Timeout)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// DropConnections closes the connections accepted, the end point is still
+// listening
+func (e *TCPEndpoint) DropConnections() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, conn := range e.conns {
+		conn.Close()
+	}
+	e.conns = nil
+}
+
+// Stop stops listening and closes the connections accepted
+func (e *TCPEndpoint) Stop() {
+	e.lock.Lock()
+	e.listener.Close()
+	e.lock.Unlock()
+	e.DropConnections()
+}
+
+// HTTPEndpoint a fake HTTP end point that records the frames posted to it. It
+// can be made slow to respond, and can respond with a failure.
+type HTTPEndpoint struct {
+	Frames *Recorder
+	Server *httptest.Server
+
+	t       testing.TB
+	lock    sync.Mutex
+	status  int
+	latency time.Duration
+}
+
+// NewHTTPEndpoint creates an end point that is serving
+func NewHTTPEndpoint(t testing.TB) *HTTPEndpoint {
+	e := &HTTPEndpoint{Frames: newRecorder(nil), t: t, status: http.StatusOK}
+	e.Server = httptest.NewServer(http.HandlerFunc(e.serve))
+	return e
+}
+
+// serve records the frame posted, responding with the configured status
+// once the latency has elapsed. A failed request is not recorded.
+func (e *HTTPEndpoint) serve(w http.ResponseWriter, r *http.Request) {
+	e.lock.Lock()
+	status, latency := e.status, e.latency
+	e.lock.Unlock()
+	time.Sleep(latency)
+	if r.Method == "POST" && status >= 200 && status <= 299 {
+		body := &bytes.Buffer{}
+		if _, err := body.ReadFrom(r.Body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		frame, err := ReadFrame(body)
+		if err != nil {
+			e.t.Errorf("Invalid frame posted to HTTP end point: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		e.Frames.add(frame)
+	}
+	w.WriteHeader(status)
+}
+
+// SetStatus sets the status of the responses
+func (e *HTTPEndpoint) SetStatus(status int) {
+	e.lock.Lock()
+	e.status = status
+	e.lock.Unlock()
+}
+
+// SetLatency delays each response by the given duration
+func (e *HTTPEndpoint) SetLatency(latency time.Duration) {
+	e.lock.Lock()
+	e.latency = latency
+	e.lock.Unlock()
+}
+
+// URL returns the URL of the end point
+func (e *HTTPEndpoint) URL() string {
+	return e.Server.URL
+}
+
+// Spec returns an end point specification, with the given terms, that tees
+// to the end point
+func (e *HTTPEndpoint) Spec(terms ...string) string {
+	return strings.Join(append(terms, "action="+e.URL()), ";")
+}
+
+// Close stops the end point
+func (e *HTTPEndpoint) Close() {
+	e.Server.Close()
+}
+
+// GRPCEndpoint a fake gRPC end point that records the frames streamed to it,
+// over all the streams it accepts. It can stop, and restart, serving on the
+// same address.
+type GRPCEndpoint struct {
+	Frames *Recorder
+
+	t       testing.TB
+	address string
+
+	lock    sync.Mutex
+	server  *grpc.Server
+	streams int
+}
+
+// NewGRPCEndpoint creates an end point that is serving
+func NewGRPCEndpoint(t testing.TB) *GRPCEndpoint {
+	e := &GRPCEndpoint{Frames: newRecorder(nil), t: t, address: "127.0.0.1:0"}
+	e.Start()
+	return e
+}
+
+// Start serves on the address of the end point, the same address once it
+// has been stopped
+func (e *GRPCEndpoint) Start() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	listener, err := net.Listen("tcp", e.address)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	e.address = listener.Addr().String()
+	e.server = grpc.NewServer()
+	pb.RegisterTeeServer(e.server, e)
+	go e.server.Serve(listener)
+}
+
+// Stream records the frames received on a stream, whose DPID and port are
+// those of the packet in
+func (e *GRPCEndpoint) Stream(stream pb.Tee_StreamServer) error {
+	e.lock.Lock()
+	e.streams++
+	e.lock.Unlock()
+	var received uint64
+	for {
+		packetIn, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&pb.StreamSummary{Received: received})
+		}
+		if err != nil {
+			return err
+		}
+		m, err := ReadMessage(bytes.NewReader(packetIn.Payload))
+		if err != nil {
+			e.t.Errorf("Invalid message streamed to gRPC end point: %v", err)
+			return err
+		}
+		received++
+		e.Frames.add(FrameOf(packetIn.Dpid, packetIn.InPort, m))
+	}
+}
+
+// Addr returns the address of the end point
+func (e *GRPCEndpoint) Addr() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.address
+}
+
+// Spec returns an end point specification, with the given terms, that tees
+// to the end point
+func (e *GRPCEndpoint) Spec(terms ...string) string {
+	return strings.Join(append(terms, "action=grpc://"+e.Addr()), ";")
+}
+
+// Streams returns the number of streams accepted
+func (e *GRPCEndpoint) Streams() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.streams
+}
+
+// Stop stops serving, breaking the streams accepted
+func (e *GRPCEndpoint) Stop() {
+	e.lock.Lock()
+	server := e.server
+	e.lock.Unlock()
+	server.Stop()
+}
@@ -0,0 +1,267 @@
+// Package harness provides fakes of the switches, SDN controller and end
+// points that oftee connects to, so that tests can drive the real device
+// handling, end point and API code end to end.
+//
+// A `Switch` writes scripted OpenFlow messages to oftee over an in-memory
+// connection, optionally in fragments, and records the messages oftee
+// writes back to it. A `Controller` listens on the loopback interface and
+// records the messages proxied to it, one `Recorder` per connection. A
+// `TCPEndpoint` and an `HTTPEndpoint` record the frames tee-ed to them and
+// can be made slow, or fail, on demand. Each recorder provides assertions
+// that wait for the expected messages or frames to arrive.
+package harness
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	of "github.com/netrack/openflow"
+)
+
+// Timeout is how long an assertion waits for what it expects to arrive
+var Timeout = 5 * time.Second
+
+// ContextLen the length of the OpenFlow context, the DPID and port, that
+// precedes each message tee-ed to an end point
+const ContextLen = 12
+
+// Message an OpenFlow message, as it was written
+type Message struct {
+	Type of.Type
+	XID  uint32
+	Raw  []byte
+}
+
+func (m Message) String() string {
+	return fmt.Sprintf("%s(xid=%d, %d bytes)", m.Type, m.XID, len(m.Raw))
+}
+
+// NewMessage builds an OpenFlow message of the given type and body
+func NewMessage(t testing.TB, msgType of.Type, xid uint32, body io.WriterTo) Message {
+	if body == nil {
+		body = &bytes.Buffer{}
+	}
+	request := of.NewRequest(msgType, body)
+	request.Header.Transaction = xid
+	raw := &bytes.Buffer{}
+	if _, err := request.WriteTo(raw); err != nil {
+		t.Fatal(err)
+	}
+	return Message{Type: msgType, XID: xid, Raw: raw.Bytes()}
+}
+
+// ReadMessage reads a complete OpenFlow message
+func ReadMessage(r io.Reader) (Message, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Message{}, err
+	}
+	length := int(binary.BigEndian.Uint16(header[2:]))
+	if length < len(header) {
+		return Message{}, fmt.Errorf("invalid OpenFlow message length %d", length)
+	}
+	raw := make([]byte, length)
+	copy(raw, header)
+	if _, err := io.ReadFull(r, raw[len(header):]); err != nil {
+		return Message{}, err
+	}
+	return Message{Type: of.Type(header[1]), XID: binary.BigEndian.Uint32(header[4:]), Raw: raw}, nil
+}
+
+// Frame a message tee-ed to an end point, with its OpenFlow context
+type Frame struct {
+	DPID    uint64
+	Port    uint32
+	Message Message
+}
+
+func (f Frame) String() string {
+	return fmt.Sprintf("[0x%x, %d] %s", f.DPID, f.Port, f.Message)
+}
+
+// FrameOf returns the frame expected for a message from the given DPID and
+// port
+func FrameOf(dpid uint64, port uint32, m Message) Frame {
+	return Frame{DPID: dpid, Port: port, Message: m}
+}
+
+// ReadFrame reads a complete frame, the context followed by the message
+func ReadFrame(r io.Reader) (Frame, error) {
+	context := make([]byte, ContextLen)
+	if _, err := io.ReadFull(r, context); err != nil {
+		return Frame{}, err
+	}
+	m, err := ReadMessage(r)
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{
+		DPID:    binary.BigEndian.Uint64(context),
+		Port:    binary.BigEndian.Uint32(context[8:]),
+		Message: m,
+	}, nil
+}
+
+// Recorder records the messages, or frames, read from a connection, in the
+// order they were read
+type Recorder struct {
+	Conn net.Conn
+
+	lock    sync.Mutex
+	changed chan struct{}
+	items   []interface{}
+	err     error
+}
+
+// newRecorder creates a recorder that is empty
+func newRecorder(conn net.Conn) *Recorder {
+	return &Recorder{Conn: conn, changed: make(chan struct{})}
+}
+
+// record reads from the connection until it fails, recording what is read,
+// and then closes it
+func (r *Recorder) record(read func(io.Reader) (interface{}, error)) {
+	defer r.Conn.Close()
+	for {
+		item, err := read(r.Conn)
+		r.lock.Lock()
+		if err != nil {
+			r.err = err
+		} else {
+			r.items = append(r.items, item)
+		}
+		close(r.changed)
+		r.changed = make(chan struct{})
+		r.lock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// add records an item read other than from the connection
+func (r *Recorder) add(item interface{}) {
+	r.lock.Lock()
+	r.items = append(r.items, item)
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.lock.Unlock()
+}
+
+// wait waits for at least n items to be recorded, returning them, or fails
+// the test once the timeout expires
+func (r *Recorder) wait(t testing.TB, n int) []interface{} {
+	deadline := time.After(Timeout)
+	for {
+		r.lock.Lock()
+		items, changed, err := r.items, r.changed, r.err
+		r.lock.Unlock()
+		if len(items) >= n {
+			return items
+		}
+		if err != nil {
+			t.Fatalf("Expected %d, only %d received before the connection failed: %v", n, len(items), err)
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			t.Fatalf("Expected %d, only %d received within %s", n, len(items), Timeout)
+		}
+	}
+}
+
+// Err returns the error that ended the recording, if it has ended
+func (r *Recorder) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+// Messages returns the messages recorded so far
+func (r *Recorder) Messages() []Message {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	messages := make([]Message, 0, len(r.items))
+	for _, item := range r.items {
+		if m, ok := item.(Message); ok {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+// WaitMessages waits for at least n messages, returning them
+func (r *Recorder) WaitMessages(t testing.TB, n int) []Message {
+	r.wait(t, n)
+	return r.Messages()
+}
+
+// ExpectMessages asserts that exactly the given messages were received, in
+// order, waiting for them to arrive
+func (r *Recorder) ExpectMessages(t testing.TB, expected ...Message) {
+	got := r.WaitMessages(t, len(expected))
+	if len(got) != len(expected) {
+		t.Errorf("Expected %d messages, got %d: %v", len(expected), len(got), got)
+	}
+	for i := range expected {
+		if i >= len(got) || !bytes.Equal(got[i].Raw, expected[i].Raw) {
+			t.Errorf("Expected messages %v in order, got %v", expected, got)
+			return
+		}
+	}
+}
+
+// Frames returns the frames recorded so far
+func (r *Recorder) Frames() []Frame {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	frames := make([]Frame, 0, len(r.items))
+	for _, item := range r.items {
+		if f, ok := item.(Frame); ok {
+			frames = append(frames, f)
+		}
+	}
+	return frames
+}
+
+// WaitFrames waits for at least n frames, returning them
+func (r *Recorder) WaitFrames(t testing.TB, n int) []Frame {
+	r.wait(t, n)
+	return r.Frames()
+}
+
+// ExpectFrames asserts that exactly the given frames were received, in
+// order, waiting for them to arrive
+func (r *Recorder) ExpectFrames(t testing.TB, expected ...Frame) {
+	expectFrames(t, r.WaitFrames(t, len(expected)), expected)
+}
+
+// expectFrames compares the frames received with those expected
+func expectFrames(t testing.TB, got, expected []Frame) {
+	if len(got) != len(expected) {
+		t.Errorf("Expected %d frames, got %d: %v", len(expected), len(got), got)
+	}
+	for i := range expected {
+		if i >= len(got) || got[i].DPID != expected[i].DPID || got[i].Port != expected[i].Port ||
+			!bytes.Equal(got[i].Message.Raw, expected[i].Message.Raw) {
+			t.Errorf("Expected frames %v in order, got %v", expected, got)
+			return
+		}
+	}
+}
+
+// readMessage reads a message, for recording
+func readMessage(r io.Reader) (interface{}, error) {
+	return ReadMessage(r)
+}
+
+// readFrame reads a frame, for recording
+func readFrame(r io.Reader) (interface{}, error) {
+	return ReadFrame(r)
+}
@@ -0,0 +1,109 @@
+package harness
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	of "github.com/netrack/openflow"
+	"github.com/netrack/openflow/ofp"
+)
+
+// Switch a fake OpenFlow switch, connected to oftee over an in-memory
+// connection. The messages oftee writes to the switch, i.e. those from the
+// SDN controller, are recorded by `Received`.
+//
+// If `Fragment` is set each message is written in pieces of that many bytes,
+// so that oftee reads partial messages.
+type Switch struct {
+	Conn     net.Conn
+	Received *Recorder
+	Fragment int
+
+	t   testing.TB
+	xid uint32
+}
+
+// NewSwitch creates a switch, returning it and the connection oftee reads
+func NewSwitch(t testing.TB) (*Switch, net.Conn) {
+	device, conn := net.Pipe()
+	s := &Switch{Conn: device, Received: newRecorder(device), t: t}
+	go s.Received.record(readMessage)
+	return s, conn
+}
+
+// nextXID returns the next transaction ID
+func (s *Switch) nextXID() uint32 {
+	return atomic.AddUint32(&s.xid, 1)
+}
+
+// Write writes a message to oftee
+func (s *Switch) Write(m Message) Message {
+	raw := m.Raw
+	for len(raw) > 0 {
+		n := len(raw)
+		if s.Fragment > 0 && n > s.Fragment {
+			n = s.Fragment
+		}
+		if _, err := s.Conn.Write(raw[:n]); err != nil {
+			s.t.Fatalf("Unable to write %s to oftee: %v", m, err)
+		}
+		raw = raw[n:]
+	}
+	return m
+}
+
+// Send writes a message of the given type and body to oftee, returning it
+func (s *Switch) Send(msgType of.Type, body io.WriterTo) Message {
+	return s.Write(NewMessage(s.t, msgType, s.nextXID(), body))
+}
+
+// SendFeatures writes the features reply that identifies the switch
+func (s *Switch) SendFeatures(dpid uint64) Message {
+	return s.Send(of.TypeFeaturesReply, &ofp.SwitchFeatures{DatapathID: dpid})
+}
+
+// SendPacketIn writes a packet in of the given frame, received on the given
+// port
+func (s *Switch) SendPacketIn(port uint32, frame []byte) Message {
+	return s.Write(PacketIn(s.t, s.nextXID(), port, frame))
+}
+
+// Close closes the connection to oftee
+func (s *Switch) Close() {
+	s.Conn.Close()
+}
+
+// PacketIn builds a packet in message of the given frame, received on the
+// given port
+func PacketIn(t testing.TB, xid uint32, port uint32, frame []byte) Message {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, port)
+	return NewMessage(t, of.TypePacketIn, xid, &ofp.PacketIn{
+		Buffer: ofp.NoBuffer,
+		Length: uint16(len(frame)),
+		Match: ofp.Match{
+			Type: ofp.MatchTypeXM,
+			Fields: []ofp.XM{{
+				Class: ofp.XMClassOpenflowBasic,
+				Type:  ofp.XMTypeInPort,
+				Value: ofp.XMValue(value),
+			}},
+		},
+		Data: frame,
+	})
+}
+
+// EthernetFrame builds a minimal Ethernet frame of the given type, padded
+// with zeros to the given length
+func EthernetFrame(ethType uint16, length int) []byte {
+	if length < 14 {
+		length = 14
+	}
+	frame := make([]byte, length)
+	copy(frame, []byte{0x01, 0x80, 0xc2, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})
+	binary.BigEndian.PutUint16(frame[12:], ethType)
+	return frame
+}
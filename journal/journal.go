@@ -0,0 +1,276 @@
+// Package journal provides a record, on disk, of the messages delivered to an
+// end point. Each message is appended to the journal file, as a record
+// protected by a CRC and stamped with the time it was delivered, and the file
+// is rotated as it grows. A journal is written in the background, so that
+// delivery never waits for the disk: a message that can't be recorded, i.e.
+// while the disk is full, is counted and otherwise ignored.
+package journal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	// DefaultMaxSize size, in megabytes, at which a journal file is
+	// rotated
+	DefaultMaxSize = 100
+
+	// DefaultMaxBackups number of rotated journal files kept
+	DefaultMaxBackups = 5
+
+	// QueueSize number of messages waiting to be recorded at which further
+	// messages are dropped from the journal
+	QueueSize = 1024
+
+	// MaxMessageLen size of the largest message that can be recorded
+	MaxMessageLen = 1 << 20
+
+	// Each record is the length of the message, the CRC of the time and
+	// the message, and the time, in nanoseconds since the epoch, followed
+	// by the message
+	recordHeaderLen = 16
+)
+
+var (
+	// ErrChecksum is returned when reading a record that is damaged
+	ErrChecksum = errors.New("journal: record CRC mismatch")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Options the rotation of a journal, `MaxSize` in megabytes
+type Options struct {
+	MaxSize    int
+	MaxBackups int
+}
+
+// Stats the messages recorded in a journal, and those that were not, either
+// `Dropped` because too many were waiting to be recorded or `Failed` to be
+// written
+type Stats struct {
+	Path     string `json:"path"`
+	Recorded uint64 `json:"recorded"`
+	Dropped  uint64 `json:"dropped,omitempty"`
+	Failed   uint64 `json:"failed,omitempty"`
+}
+
+// Journal is a rotating journal file to which delivered messages are
+// recorded. A nil journal records nothing, so that connections without one
+// need not check.
+type Journal struct {
+	path     string
+	out      io.WriteCloser
+	lock     sync.RWMutex
+	queue    chan []byte
+	done     chan struct{}
+	closed   bool
+	failing  bool
+	recorded uint64
+	dropped  uint64
+	failed   uint64
+}
+
+// Open starts a journal to the given file. The file, and its directory, are
+// created when the first message is recorded.
+func Open(path string, opts Options) *Journal {
+	return start(path, &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    opts.MaxSize,
+		MaxBackups: opts.MaxBackups,
+		LocalTime:  true,
+	})
+}
+
+// start starts a journal that writes its records to out
+func start(path string, out io.WriteCloser) *Journal {
+	j := &Journal{
+		path:  path,
+		out:   out,
+		queue: make(chan []byte, QueueSize),
+		done:  make(chan struct{}),
+	}
+	go j.write()
+	return j
+}
+
+// Record queues a copy of a delivered message to be recorded, stamped with
+// the current time. The message is dropped, and counted, if too many are
+// already waiting.
+func (j *Journal) Record(message []byte) {
+	if j == nil {
+		return
+	}
+	if len(message) > MaxMessageLen {
+		atomic.AddUint64(&j.failed, 1)
+		return
+	}
+	record := make([]byte, recordHeaderLen+len(message))
+	binary.BigEndian.PutUint32(record, uint32(len(message)))
+	binary.BigEndian.PutUint64(record[8:], uint64(time.Now().UnixNano()))
+	copy(record[recordHeaderLen:], message)
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(record[8:], crcTable))
+
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	if j.closed {
+		atomic.AddUint64(&j.dropped, 1)
+		return
+	}
+	select {
+	case j.queue <- record:
+	default:
+		atomic.AddUint64(&j.dropped, 1)
+	}
+}
+
+// write writes the queued records to the journal file until it is closed.
+// Failures are logged when they start and when they end.
+func (j *Journal) write() {
+	defer close(j.done)
+	for record := range j.queue {
+		_, err := j.out.Write(record)
+		if err != nil {
+			atomic.AddUint64(&j.failed, 1)
+			if !j.failing {
+				log.
+					WithFields(log.Fields{
+						"journal": j.path,
+					}).
+					WithError(err).
+					Error("Unable to write to journal, messages are delivered but not recorded")
+			}
+			j.failing = true
+			continue
+		}
+		atomic.AddUint64(&j.recorded, 1)
+		if j.failing {
+			log.
+				WithFields(log.Fields{
+					"journal": j.path,
+					"failed":  atomic.LoadUint64(&j.failed),
+				}).
+				Info("Resumed writing to journal")
+			j.failing = false
+		}
+	}
+}
+
+// Path returns the path of the journal file
+func (j *Journal) Path() string {
+	return j.path
+}
+
+// Stats returns the number of messages recorded, dropped and that failed to
+// be written, nil for a nil journal
+func (j *Journal) Stats() *Stats {
+	if j == nil {
+		return nil
+	}
+	return &Stats{
+		Path:     j.path,
+		Recorded: atomic.LoadUint64(&j.recorded),
+		Dropped:  atomic.LoadUint64(&j.dropped),
+		Failed:   atomic.LoadUint64(&j.failed),
+	}
+}
+
+// Close records the messages already queued and closes the journal file,
+// messages recorded after it is closed are dropped
+func (j *Journal) Close() error {
+	j.lock.Lock()
+	if j.closed {
+		j.lock.Unlock()
+		return nil
+	}
+	j.closed = true
+	close(j.queue)
+	j.lock.Unlock()
+	<-j.done
+	return j.out.Close()
+}
+
+// Journals the open journals, by path, so that the end points established
+// for each device connection, when connections are not shared, record to the
+// same journal
+type Journals struct {
+	lock     sync.Mutex
+	journals map[string]*Journal
+}
+
+// Get returns the journal to the given file, opening it if needed
+func (j *Journals) Get(path string, opts Options) *Journal {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.journals == nil {
+		j.journals = make(map[string]*Journal)
+	}
+	journal, ok := j.journals[path]
+	if !ok {
+		journal = Open(path, opts)
+		j.journals[path] = journal
+	}
+	return journal
+}
+
+// Entry a message read from a journal, with the time it was delivered
+type Entry struct {
+	Time    time.Time
+	Message []byte
+}
+
+// Reader reads the entries of a journal file
+type Reader struct {
+	in     *bufio.Reader
+	offset int64
+}
+
+// NewReader creates a reader of the journal file read from in
+func NewReader(in io.Reader) *Reader {
+	return &Reader{in: bufio.NewReader(in)}
+}
+
+// Offset returns the offset in the file of the next entry
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// Next returns the next entry. `io.EOF` is returned at the end of the file
+// and `io.ErrUnexpectedEOF` if the last record is incomplete, i.e. it was
+// being written when the process stopped.
+func (r *Reader) Next() (Entry, error) {
+	header := make([]byte, recordHeaderLen)
+	if _, err := io.ReadFull(r.in, header); err != nil {
+		return Entry{}, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > MaxMessageLen {
+		return Entry{}, fmt.Errorf("journal: invalid record length %d", length)
+	}
+	record := make([]byte, 8+length)
+	copy(record, header[8:])
+	if _, err := io.ReadFull(r.in, record[8:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Entry{}, err
+	}
+	if crc32.Checksum(record, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return Entry{}, ErrChecksum
+	}
+	r.offset += int64(recordHeaderLen + length)
+	return Entry{
+		Time:    time.Unix(0, int64(binary.BigEndian.Uint64(record))),
+		Message: record[8:],
+	}, nil
+}
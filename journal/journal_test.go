@@ -0,0 +1,142 @@
+package journal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// failingFile a journal file to which every write fails, optionally blocking
+// until released
+type failingFile struct {
+	release chan struct{}
+}
+
+func (f *failingFile) Write(b []byte) (int, error) {
+	if f.release != nil {
+		<-f.release
+	}
+	return 0, errors.New("no space left on device")
+}
+
+func (f *failingFile) Close() error {
+	return nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tee", "collector.journal")
+
+	started := time.Now()
+	j := Open(path, Options{MaxSize: 1, MaxBackups: 1})
+	messages := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{0xab}, 1500)}
+	for _, message := range messages {
+		j.Record(message)
+	}
+	if err = j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := j.Stats(); stats.Recorded != 3 || stats.Dropped != 0 || stats.Failed != 0 {
+		t.Errorf("Expected 3 messages recorded, got %+v", stats)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	r := NewReader(file)
+	for i, message := range messages {
+		entry, err := r.Next()
+		if err != nil {
+			t.Fatalf("Expected entry %d, got %v", i, err)
+		}
+		if !bytes.Equal(entry.Message, message) || entry.Time.Before(started) || entry.Time.After(time.Now()) {
+			t.Errorf("Expected entry %d to be %x, got %x at %s", i, message, entry.Message, entry.Time)
+		}
+	}
+	if _, err = r.Next(); err != io.EOF {
+		t.Errorf("Expected end of journal, got %v", err)
+	}
+}
+
+func TestDamagedRecords(t *testing.T) {
+	out := &bytes.Buffer{}
+	j := start("buffer", nopCloser{out})
+	j.Record([]byte("first"))
+	j.Record([]byte("second"))
+	j.Close()
+	data := out.Bytes()
+
+	// A damaged message is detected by its CRC
+	damaged := append([]byte(nil), data...)
+	damaged[len(damaged)-1] ^= 0xff
+	r := NewReader(bytes.NewReader(damaged))
+	if _, err := r.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Next(); err != ErrChecksum {
+		t.Errorf("Expected damaged record detected, got %v", err)
+	}
+
+	// As is a record that was not completely written
+	r = NewReader(bytes.NewReader(data[:len(data)-3]))
+	if _, err := r.Next(); err != nil {
+		t.Fatal(err)
+	}
+	offset := r.Offset()
+	if _, err := r.Next(); err != io.ErrUnexpectedEOF || offset != int64(recordHeaderLen+len("first")) {
+		t.Errorf("Expected incomplete record at %d, got %v at %d", recordHeaderLen+len("first"), err, offset)
+	}
+}
+
+func TestFailuresCounted(t *testing.T) {
+	file := &failingFile{release: make(chan struct{})}
+	j := start("failing", file)
+
+	// While the file is blocked the queue fills and messages are dropped,
+	// recording never blocks
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < QueueSize+10; i++ {
+			j.Record([]byte("message"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected recording not to block")
+	}
+	close(file.release)
+	j.Close()
+	stats := j.Stats()
+	if stats.Recorded != 0 || stats.Dropped < 9 || stats.Dropped+stats.Failed != QueueSize+10 {
+		t.Errorf("Expected messages dropped and failed, got %+v", stats)
+	}
+
+	// A nil journal records nothing
+	var none *Journal
+	none.Record([]byte("message"))
+	if none.Stats() != nil {
+		t.Error("Expected no stats for a nil journal")
+	}
+}
+
+// nopCloser a journal file that is a buffer
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
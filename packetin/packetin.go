@@ -0,0 +1,179 @@
+// Package packetin decodes OpenFlow packet ins by the layout of their version,
+// so that the port on which a packet was received, the reason it was sent and
+// the packet itself are found the same way everywhere, i.e. to match the
+// packet against end point criteria and to describe it in message metadata.
+// The packet ins of OpenFlow 1.0, and of 1.3 and later, whose layouts are
+// those of 1.3, can be decoded.
+package packetin
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	// Version10 wire version of OpenFlow 1.0
+	Version10 = 0x01
+
+	// Version13 wire version of OpenFlow 1.3, the first of the versions
+	// whose packet ins share its layout
+	Version13 = 0x04
+
+	// TypePacketIn the type of a packet in, the same in every version
+	TypePacketIn = 10
+
+	// length10 the length of an OpenFlow 1.0 packet in that precedes the
+	// packet, the header, buffer ID, total length, in port, reason and
+	// padding
+	length10 = 18
+
+	// length13 the length of an OpenFlow 1.3 packet in that precedes its
+	// match, the header, buffer ID, total length, reason, table ID and
+	// cookie
+	length13 = 24
+
+	// oxmInPort the header of the in_port field of an OpenFlow extensible
+	// match, its class, field and mask bit, less its length
+	oxmInPort = 0x80000000
+)
+
+// reasons the names of the reasons for which a packet in is sent
+var reasons = []string{"no_match", "action", "invalid_ttl"}
+
+// PacketIn what is decoded of a packet in, whatever the layout of its
+// version. `Offset` is that of the packet within the message, header
+// included. The in port of an OpenFlow 1.0 packet in is that of later
+// versions, its reserved ports extended to 32 bits, i.e. 0xfffe to
+// 0xfffffffe, while that of a later version is set only if its match has one.
+// The table ID and cookie of the flow that sent the packet are only those of
+// 1.3 and later, 0 for 1.0.
+type PacketIn struct {
+	Version   uint8
+	BufferID  uint32
+	TotalLen  uint16
+	Reason    uint8
+	TableID   uint8
+	Cookie    uint64
+	InPort    uint32
+	HasInPort bool
+	Offset    int
+}
+
+// Decodable returns true if the packet ins of the given version can be
+// decoded
+func Decodable(version uint8) bool {
+	return version == Version10 || version >= Version13
+}
+
+// Decode decodes a complete packet in, header included, by the layout of the
+// given version, usually that of its header. The packet it carries is
+// whatever follows its fixed length fields, and match, if any.
+func Decode(version uint8, message []byte) (PacketIn, error) {
+	p := PacketIn{Version: version}
+	switch {
+	case len(message) < 8 || message[1] != TypePacketIn:
+		return p, errors.New("not a packet in")
+	case !Decodable(version):
+		return p, fmt.Errorf("packet ins of OpenFlow version 0x%02x can't be decoded", version)
+	case version == Version10:
+		if len(message) < length10 {
+			return p, fmt.Errorf("OpenFlow 1.0 packet in of %d bytes, expected at least %d", len(message), length10)
+		}
+		p.BufferID = binary.BigEndian.Uint32(message[8:])
+		p.TotalLen = binary.BigEndian.Uint16(message[12:])
+		p.InPort, p.HasInPort = uint32(binary.BigEndian.Uint16(message[14:])), true
+		if p.InPort >= 0xff00 {
+			p.InPort |= 0xffff0000
+		}
+		p.Reason = message[16]
+		p.Offset = length10
+		return p, nil
+	}
+
+	// The match is padded to a multiple of 8 bytes, and followed by 2
+	// bytes of padding that align the IP header of the packet
+	if len(message) < length13+4 {
+		return p, fmt.Errorf("packet in of %d bytes, expected at least %d", len(message), length13+4)
+	}
+	p.BufferID = binary.BigEndian.Uint32(message[8:])
+	p.TotalLen = binary.BigEndian.Uint16(message[12:])
+	p.Reason = message[14]
+	p.TableID = message[15]
+	p.Cookie = binary.BigEndian.Uint64(message[16:])
+	length := int(binary.BigEndian.Uint16(message[length13+2:]))
+	p.Offset = length13 + (length+7)/8*8 + 2
+	if length < 4 || p.Offset > len(message) {
+		return p, fmt.Errorf("invalid packet in match of %d bytes in a message of %d bytes", length, len(message))
+	}
+	for fields := message[length13+4 : length13+length]; len(fields) > 0; {
+		if len(fields) < 4 || 4+int(fields[3]) > len(fields) {
+			return p, fmt.Errorf("invalid packet in match field of %d bytes", len(fields))
+		}
+		header, value := binary.BigEndian.Uint32(fields), fields[4:4+int(fields[3])]
+		if header&^0xff == oxmInPort && len(value) == 4 {
+			p.InPort, p.HasInPort = binary.BigEndian.Uint32(value), true
+		}
+		fields = fields[4+len(value):]
+	}
+	return p, nil
+}
+
+// Data returns the packet carried by the decoded packet in message
+func (p *PacketIn) Data(message []byte) []byte {
+	return message[p.Offset:]
+}
+
+// ReasonName returns the name, or number, of the reason for which the packet
+// in was sent, i.e. `no_match`
+func (p *PacketIn) ReasonName() string {
+	if int(p.Reason) < len(reasons) {
+		return reasons[p.Reason]
+	}
+	return strconv.Itoa(int(p.Reason))
+}
+
+// Encode builds a complete packet in, header included, of the layout of its
+// version, carrying the given packet, i.e. to reconstruct a packet in from
+// what was decoded of it. The match of a packet in of 1.3 and later holds
+// only its in port, if it has one. `Offset` is ignored.
+func Encode(p PacketIn, data []byte) ([]byte, error) {
+	var message []byte
+	switch {
+	case !Decodable(p.Version):
+		return nil, fmt.Errorf("packet ins of OpenFlow version 0x%02x can't be encoded", p.Version)
+	case p.Version == Version10:
+		message = make([]byte, length10, length10+len(data))
+		binary.BigEndian.PutUint16(message[14:], uint16(p.InPort))
+		message[16] = p.Reason
+	default:
+		// The match is the OXM type, its length, and the in port field
+		// if any, padded to a multiple of 8 bytes
+		length := 4
+		if p.HasInPort {
+			length += 8
+		}
+		offset := length13 + (length+7)/8*8 + 2
+		message = make([]byte, offset, offset+len(data))
+		message[14] = p.Reason
+		message[15] = p.TableID
+		binary.BigEndian.PutUint64(message[16:], p.Cookie)
+		binary.BigEndian.PutUint16(message[length13:], 1)
+		binary.BigEndian.PutUint16(message[length13+2:], uint16(length))
+		if p.HasInPort {
+			binary.BigEndian.PutUint32(message[length13+4:], oxmInPort|4)
+			binary.BigEndian.PutUint32(message[length13+8:], p.InPort)
+		}
+	}
+	message[0] = p.Version
+	message[1] = TypePacketIn
+	binary.BigEndian.PutUint32(message[8:], p.BufferID)
+	binary.BigEndian.PutUint16(message[12:], p.TotalLen)
+	message = append(message, data...)
+	if len(message) > 0xffff {
+		return nil, fmt.Errorf("packet in of %d bytes is too long", len(message))
+	}
+	binary.BigEndian.PutUint16(message[2:], uint16(len(message)))
+	return message, nil
+}
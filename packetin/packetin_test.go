@@ -0,0 +1,136 @@
+package packetin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// frame a minimal ARP frame, broadcast, carried by the packet ins
+const frame = "ffffffffffff0000000000010806"
+
+// golden decodes a message written as hexadecimal, spaces ignored
+func golden(t *testing.T, message string) []byte {
+	raw, err := hex.DecodeString(strings.Replace(message, " ", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestDecode(t *testing.T) {
+	for name, test := range map[string]struct {
+		message  string
+		expected PacketIn
+		reason   string
+	}{
+		"OpenFlow 1.0": {
+			"010a0020 00000001 ffffffff 000e 0003 01 00" + frame,
+			PacketIn{Version: Version10, BufferID: 0xffffffff, TotalLen: 14, Reason: 1, InPort: 3, HasInPort: true, Offset: 18},
+			"action",
+		},
+		"OpenFlow 1.0 reserved port": {
+			"010a0020 00000001 00000100 0040 fffe 00 00" + frame,
+			PacketIn{Version: Version10, BufferID: 0x100, TotalLen: 64, InPort: 0xfffffffe, HasInPort: true, Offset: 18},
+			"no_match",
+		},
+		"OpenFlow 1.3": {
+			"040a0038 00000002 ffffffff 000e 00 03 0102030405060708 " +
+				"0001000c 80000004 00000005 00000000 0000" + frame,
+			PacketIn{Version: Version13, BufferID: 0xffffffff, TotalLen: 14, TableID: 3, Cookie: 0x0102030405060708, InPort: 5, HasInPort: true, Offset: 42},
+			"no_match",
+		},
+		"OpenFlow 1.3 without in_port": {
+			"040a0038 00000003 ffffffff 000e 02 01 00000000000000ff " +
+				"0001000c 80000204 00000005 00000000 0000" + frame,
+			PacketIn{Version: Version13, BufferID: 0xffffffff, TotalLen: 14, Reason: 2, TableID: 1, Cookie: 0xff, Offset: 42},
+			"invalid_ttl",
+		},
+		"OpenFlow 1.3 empty match": {
+			"040a0030 00000004 ffffffff 000e 07 00 0000000000000000 " +
+				"00010004 00000000 0000" + frame,
+			PacketIn{Version: Version13, BufferID: 0xffffffff, TotalLen: 14, Reason: 7, Offset: 34},
+			"7",
+		},
+		"OpenFlow 1.5": {
+			"060a0030 00000005 ffffffff 000e 00 00 0000000000000000 " +
+				"00010004 00000000 0000" + frame,
+			PacketIn{Version: 0x06, BufferID: 0xffffffff, TotalLen: 14, Offset: 34},
+			"no_match",
+		},
+	} {
+		message := golden(t, test.message)
+		packetIn, err := Decode(message[0], message)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if packetIn != test.expected {
+			t.Errorf("%s: expected %+v, got %+v", name, test.expected, packetIn)
+		}
+		if !bytes.Equal(packetIn.Data(message), golden(t, frame)) {
+			t.Errorf("%s: expected the frame, got %02x", name, packetIn.Data(message))
+		}
+		if reason := packetIn.ReasonName(); reason != test.reason {
+			t.Errorf("%s: expected reason %s, got %s", name, test.reason, reason)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for name, test := range map[string]struct {
+		version uint8
+		message string
+		err     string
+	}{
+		"not a packet in":          {Version13, "04060008 00000001", "not a packet in"},
+		"OpenFlow 1.2":             {0x03, "030a0020 00000001 ffffffff 000e 00 00 0001000400000000", "can't be decoded"},
+		"short OpenFlow 1.0":       {Version10, "010a0010 00000001 ffffffff 000e", "expected at least 18"},
+		"short OpenFlow 1.3":       {Version13, "040a0018 00000001 ffffffff 000e 00 00 0000000000000000", "expected at least 28"},
+		"match beyond the message": {Version13, "040a0020 00000001 ffffffff 000e 00 00 0000000000000000 00010010 80000004", "invalid packet in match"},
+		"field beyond the match":   {Version13, "040a0028 00000001 ffffffff 000e 00 00 0000000000000000 0001000a 80000004 0000 000000000000 0000", "invalid packet in match field"},
+
+		// The layout is that of the version given, not of the header
+		"OpenFlow 1.0 as 1.3": {Version13, "010a0020 00000001 ffffffff 000e 0003 01 00" + frame, "invalid packet in match"},
+	} {
+		if _, err := Decode(test.version, golden(t, test.message)); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error '%s', got %v", name, test.err, err)
+		}
+	}
+}
+
+func TestDecodable(t *testing.T) {
+	for version, expected := range map[uint8]bool{0x01: true, 0x02: false, 0x03: false, 0x04: true, 0x05: true, 0x06: true} {
+		if Decodable(version) != expected {
+			t.Errorf("Expected version 0x%02x decodable %t", version, expected)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	// The packet ins are those decoded, without a transaction ID
+	for name, message := range map[string]string{
+		"OpenFlow 1.0":               "010a0020 00000000 ffffffff 000e 0003 01 00" + frame,
+		"OpenFlow 1.0 reserved port": "010a0020 00000000 00000100 0040 fffe 00 00" + frame,
+		"OpenFlow 1.3":               "040a0038 00000000 ffffffff 000e 00 03 0102030405060708 0001000c 80000004 00000005 00000000 0000" + frame,
+		"OpenFlow 1.3 empty match":   "040a0030 00000000 ffffffff 000e 07 00 0000000000000000 00010004 00000000 0000" + frame,
+	} {
+		expected := golden(t, message)
+		packetIn, err := Decode(expected[0], expected)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+		encoded, err := Encode(packetIn, packetIn.Data(expected))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if !bytes.Equal(encoded, expected) {
+			t.Errorf("%s: expected %02x, got %02x", name, expected, encoded)
+		}
+	}
+	if _, err := Encode(PacketIn{Version: 0x03}, nil); err == nil {
+		t.Error("Expected error encoding an OpenFlow 1.2 packet in")
+	}
+}
@@ -0,0 +1,6 @@
+// Package proto contains the protocol buffer definition of the packet ins
+// tee-ed to the end points with encode=proto, and the code generated from
+// it.
+package proto
+
+//go:generate protoc --go_out=. packetin.proto
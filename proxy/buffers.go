@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciena/oftee/api"
+)
+
+const (
+	// MinReadBufferSize size of the read buffer of a device connection
+	// until it receives a message that doesn't fit
+	MinReadBufferSize = 256
+
+	// ReadBufferIdle time after which the read buffer of a device
+	// connection that has not received a large message is shrunk back to
+	// `MinReadBufferSize`
+	ReadBufferIdle = time.Minute
+)
+
+// BufferStats the memory held by the buffers of the device connections
+type BufferStats struct {
+	Connections       int64 `json:"connections"`
+	GrownReaders      int64 `json:"grown_readers"`
+	ReadBufferBytes   int64 `json:"read_buffer_bytes"`
+	PacketBufferBytes int64 `json:"packet_buffer_bytes"`
+	TotalBytes        int64 `json:"total_bytes"`
+}
+
+// bufferGauge totals the buffers of all device connections. Each connection
+// only updates the totals when the size of one of its buffers changes, so the
+// accounting costs nothing per message.
+type bufferGauge struct {
+	connections int64
+	grown       int64
+	read        int64
+	packet      int64
+}
+
+// buffers the buffers of the device connections of the process
+var buffers bufferGauge
+
+// bufferPool pools the buffers in which messages are assembled, so that a
+// connection only holds one while it handles a message rather than each
+// holding a buffer as large as the largest message it has received. A buffer
+// grown for a large message is returned to the pool as is, so the next large
+// message doesn't grow another.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+// messageBuffers the buffers in which the messages of the device, and
+// chained, connections of the process are assembled
+var messageBuffers bufferPool
+
+// get returns an empty buffer from the pool, a new one of the given size if
+// the pool is empty
+func (p *bufferPool) get(size int) *bytes.Buffer {
+	if buffer, ok := p.pool.Get().(*bytes.Buffer); ok {
+		buffer.Reset()
+		return buffer
+	}
+	return bytes.NewBuffer(make([]byte, 0, size))
+}
+
+// put returns a buffer to the pool, which must no longer be referenced
+func (p *bufferPool) put(buffer *bytes.Buffer) {
+	p.pool.Put(buffer)
+}
+
+// Stats returns the current totals
+func (g *bufferGauge) Stats() BufferStats {
+	stats := BufferStats{
+		Connections:       atomic.LoadInt64(&g.connections),
+		GrownReaders:      atomic.LoadInt64(&g.grown),
+		ReadBufferBytes:   atomic.LoadInt64(&g.read),
+		PacketBufferBytes: atomic.LoadInt64(&g.packet),
+	}
+	stats.TotalBytes = stats.ReadBufferBytes + stats.PacketBufferBytes
+	return stats
+}
+
+// Gauges returns the current totals, in bytes, as the metrics exposed in the
+// Prometheus text format
+func (g *bufferGauge) Gauges() []api.Gauge {
+	stats := g.Stats()
+	return []api.Gauge{
+		{Name: "oftee_read_buffer_bytes", Help: "bytes of the read buffers of the device connections", Value: float64(stats.ReadBufferBytes)},
+		{Name: "oftee_packet_buffer_bytes", Help: "bytes of the message buffers taken by the device connections", Value: float64(stats.PacketBufferBytes)},
+		{Name: "oftee_total_buffer_bytes", Help: "bytes of all the buffers of the device connections", Value: float64(stats.TotalBytes)},
+	}
+}
+
+// connBuffers the buffers of a single connection, as accounted for in the
+// process totals
+type connBuffers struct {
+	gauge  *bufferGauge
+	read   int64
+	packet int64
+	grown  bool
+}
+
+// newConnBuffers adds a connection to the given totals
+func newConnBuffers(gauge *bufferGauge) *connBuffers {
+	atomic.AddInt64(&gauge.connections, 1)
+	return &connBuffers{gauge: gauge}
+}
+
+// setRead records the size of the connection's read buffer and whether it
+// has been grown beyond the minimum
+func (c *connBuffers) setRead(size int, grown bool) {
+	if delta := int64(size) - c.read; delta != 0 {
+		atomic.AddInt64(&c.gauge.read, delta)
+		c.read = int64(size)
+	}
+	if grown != c.grown {
+		if grown {
+			atomic.AddInt64(&c.gauge.grown, 1)
+		} else {
+			atomic.AddInt64(&c.gauge.grown, -1)
+		}
+		c.grown = grown
+	}
+}
+
+// setPacket records the capacity of the buffer into which the connection's
+// current message is copied, 0 once the buffer is returned to the pool
+func (c *connBuffers) setPacket(size int) {
+	if delta := int64(size) - c.packet; delta != 0 {
+		atomic.AddInt64(&c.gauge.packet, delta)
+		c.packet = int64(size)
+	}
+}
+
+// release removes the connection, and its buffers, from the totals
+func (c *connBuffers) release() {
+	c.setRead(0, false)
+	c.setPacket(0)
+	atomic.AddInt64(&c.gauge.connections, -1)
+}
+
+// adaptiveReader is a buffered reader whose buffer starts small and is only
+// grown, up to a maximum, for connections that receive messages that don't
+// fit. It is shrunk back once no such message has been received for
+// `ReadBufferIdle`. The buffer is only replaced when it is empty, so that no
+// data is lost, i.e. between messages.
+type adaptiveReader struct {
+	*bufio.Reader
+	src       io.Reader
+	size      int
+	min       int
+	max       int
+	lastLarge time.Time
+	acct      *connBuffers
+}
+
+// newAdaptiveReader creates a reader of the given source whose buffer size is
+// between `min` and `max`
+func newAdaptiveReader(src io.Reader, min, max int, acct *connBuffers) *adaptiveReader {
+	if max < min {
+		max = min
+	}
+	r := &adaptiveReader{src: src, min: min, max: max, acct: acct}
+	r.resize(min)
+	return r
+}
+
+// resize replaces the buffer with one of the given size
+func (r *adaptiveReader) resize(size int) {
+	r.Reader = bufio.NewReaderSize(r.src, size)
+	r.size = size
+	r.acct.setRead(r.size, r.size > r.min)
+}
+
+// fit sizes the buffer for a message of the given length having just been
+// read, growing it to the next power of two that holds the message, or
+// shrinking it if the connection has been idle
+func (r *adaptiveReader) fit(length int, now time.Time) {
+	if length > r.min {
+		r.lastLarge = now
+	}
+	if r.Reader.Buffered() != 0 {
+		return
+	}
+	switch {
+	case length > r.size && r.size < r.max:
+		size := r.size
+		for size < length && size < r.max {
+			size *= 2
+		}
+		if size > r.max {
+			size = r.max
+		}
+		r.resize(size)
+	case r.size > r.min && now.Sub(r.lastLarge) >= ReadBufferIdle:
+		r.resize(r.min)
+	}
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveReaderResize(t *testing.T) {
+	var gauge bufferGauge
+	acct := newConnBuffers(&gauge)
+	reader := newAdaptiveReader(bytes.NewReader(nil), MinReadBufferSize, 2048, acct)
+	now := time.Now()
+
+	// Small messages leave the buffer at its minimum
+	reader.fit(100, now)
+	if stats := gauge.Stats(); reader.size != MinReadBufferSize || stats.ReadBufferBytes != MinReadBufferSize ||
+		stats.GrownReaders != 0 {
+		t.Errorf("Expected %d byte buffer, got %d, %+v", MinReadBufferSize, reader.size, stats)
+	}
+
+	// A large packet in grows it to fit, but never beyond the maximum
+	reader.fit(900, now)
+	if stats := gauge.Stats(); reader.size != 1024 || stats.ReadBufferBytes != 1024 || stats.GrownReaders != 1 {
+		t.Errorf("Expected 1024 byte buffer, got %d, %+v", reader.size, stats)
+	}
+	reader.fit(9000, now)
+	if reader.size != 2048 {
+		t.Errorf("Expected buffer limited to 2048 bytes, got %d", reader.size)
+	}
+
+	// It is only shrunk once the connection has been idle
+	reader.fit(100, now.Add(ReadBufferIdle/2))
+	if reader.size != 2048 {
+		t.Errorf("Expected buffer kept while busy, got %d", reader.size)
+	}
+	reader.fit(100, now.Add(ReadBufferIdle))
+	if stats := gauge.Stats(); reader.size != MinReadBufferSize || stats.ReadBufferBytes != MinReadBufferSize ||
+		stats.GrownReaders != 0 {
+		t.Errorf("Expected buffer shrunk after idle, got %d, %+v", reader.size, stats)
+	}
+
+	acct.setPacket(4096)
+	if stats := gauge.Stats(); stats.Connections != 1 || stats.TotalBytes != MinReadBufferSize+4096 {
+		t.Errorf("Incorrect totals %+v", stats)
+	}
+	for i, value := range []float64{MinReadBufferSize, 4096, MinReadBufferSize + 4096} {
+		if gauges := gauge.Gauges(); gauges[i].Value != value {
+			t.Errorf("Expected %s %v, got %v", gauges[i].Name, value, gauges[i].Value)
+		}
+	}
+	acct.release()
+	if stats := gauge.Stats(); stats != (BufferStats{}) {
+		t.Errorf("Expected nothing accounted after release, got %+v", stats)
+	}
+}
+
+func TestAdaptiveReaderKeepsBufferedData(t *testing.T) {
+	var gauge bufferGauge
+	reader := newAdaptiveReader(bytes.NewReader([]byte("0123456789")), MinReadBufferSize, 2048, newConnBuffers(&gauge))
+
+	// Data already buffered must not be discarded by a resize
+	first := make([]byte, 4)
+	if _, err := io.ReadFull(reader, first); err != nil {
+		t.Fatal(err)
+	}
+	reader.fit(1000, time.Now())
+	rest := make([]byte, 6)
+	if _, err := io.ReadFull(reader, rest); err != nil {
+		t.Fatal(err)
+	}
+	if string(first)+string(rest) != "0123456789" || reader.size != MinReadBufferSize {
+		t.Errorf("Expected data kept and buffer unchanged, got '%s%s', %d", first, rest, reader.size)
+	}
+}
+
+// idleConnections establishes the given number of connections, each with a
+// reader created by `newReader`, and reads a hello from each as a device
+// connection would before going idle
+func idleConnections(b *testing.B, count int, newReader func(net.Conn) io.Reader) {
+	hello := []byte{0x04, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x01}
+	readers := make([]io.Reader, count)
+	conns := make([]net.Conn, 0, 2*count)
+	buf := make([]byte, len(hello))
+	for i := range readers {
+		device, conn := net.Pipe()
+		conns = append(conns, device, conn)
+		readers[i] = newReader(conn)
+		go device.Write(hello)
+		if _, err := io.ReadFull(readers[i], buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// BenchmarkIdleConnectionsFixed the memory used by 1,000 idle connections
+// with a fixed size read buffer, the previous behavior
+func BenchmarkIdleConnectionsFixed(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		idleConnections(b, 1000, func(conn net.Conn) io.Reader {
+			return bufio.NewReaderSize(conn, ReadBufferSize)
+		})
+	}
+}
+
+// BenchmarkIdleConnectionsAdaptive the memory used by 1,000 idle connections
+// with an adaptive read buffer
+func BenchmarkIdleConnectionsAdaptive(b *testing.B) {
+	var gauge bufferGauge
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		idleConnections(b, 1000, func(conn net.Conn) io.Reader {
+			return newAdaptiveReader(conn, MinReadBufferSize, ReadBufferSize, newConnBuffers(&gauge))
+		})
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	var pool bufferPool
+	buffer := pool.get(512)
+	if buffer.Len() != 0 || buffer.Cap() < 512 {
+		t.Fatalf("Expected an empty 512 byte buffer, got %d of %d", buffer.Len(), buffer.Cap())
+	}
+
+	// A grown buffer is reused as is, empty
+	buffer.Write(make([]byte, 9000))
+	pool.put(buffer)
+	if reused := pool.get(512); reused.Len() != 0 || reused.Cap() < 512 {
+		t.Errorf("Expected an empty buffer, got %d of %d", reused.Len(), reused.Cap())
+	}
+}
+
+// assemblePacketIns copies a 9,000 byte packet in into the buffer returned for
+// each message, as the device connections do
+func assemblePacketIns(b *testing.B, get func() *bytes.Buffer, put func(*bytes.Buffer)) {
+	context := make([]byte, 12)
+	packetIn := make([]byte, 9000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buffer := get()
+		buffer.Write(context)
+		buffer.Write(packetIn)
+		put(buffer)
+	}
+}
+
+// BenchmarkPacketInBufferFresh a buffer per message, grown for each jumbo
+// packet in
+func BenchmarkPacketInBufferFresh(b *testing.B) {
+	assemblePacketIns(b, func() *bytes.Buffer {
+		return bytes.NewBuffer(make([]byte, 0, ReadBufferSize))
+	}, func(*bytes.Buffer) {})
+}
+
+// BenchmarkPacketInBufferPooled a buffer from the pool, grown only once
+func BenchmarkPacketInBufferPooled(b *testing.B) {
+	var pool bufferPool
+	assemblePacketIns(b, func() *bytes.Buffer {
+		return pool.get(ReadBufferSize)
+	}, pool.put)
+}
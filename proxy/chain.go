@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	protobuf "github.com/golang/protobuf/proto"
+
+	"github.com/ciena/oftee/connections"
+	"github.com/ciena/oftee/datapath"
+	"github.com/ciena/oftee/packetin"
+	"github.com/ciena/oftee/proto"
+	of "github.com/netrack/openflow"
+)
+
+const (
+	// DefaultChainMaxHops number of chained instances by which a message
+	// may have been tee-ed if `CHAIN_MAX_HOPS` is not set
+	DefaultChainMaxHops = 4
+
+	// maxChainedFrame the largest envelope, or protocol buffer, accepted
+	// from a chained instance. A packet in is at most 64KiB, which neither
+	// its base64 encoding nor the fields of its envelope grow past this.
+	maxChainedFrame = 1 << 20
+)
+
+// chainReader reads the messages of a tee stream from a chained instance,
+// framed as written to a `tcp` end point of the given encoding, see
+// `CHAIN_ENCODE`. Each message is returned as tee-ed from a device, its
+// OpenFlow context followed by the complete OpenFlow message.
+type chainReader struct {
+	reader  *bufio.Reader
+	encode  string
+	scratch *bytes.Buffer
+}
+
+// buffer returns the first n bytes of the scratch buffer, growing it, and
+// keeping the first `keep` bytes, if it is too small
+func (r *chainReader) buffer(keep, n int) []byte {
+	if r.scratch.Cap() < n {
+		kept := r.scratch.Bytes()[:keep]
+		r.scratch.Reset()
+		r.scratch.Write(kept)
+		r.scratch.Grow(n - keep)
+	}
+	return r.scratch.Bytes()[:n]
+}
+
+// next returns the next message of the stream, valid until the next call, and
+// the number of chained instances by which it was tee-ed before the one that
+// sent it. A raw stream carries no hop count, so its messages have 0. `io.EOF`
+// is returned once the stream ends between messages.
+func (r *chainReader) next() ([]byte, uint32, error) {
+	if r.encode == EncodeRaw {
+		message, err := r.nextRaw()
+		return message, 0, err
+	}
+
+	// Envelopes and protocol buffers are prefixed by their length
+	prefix := r.buffer(0, 4)
+	if _, err := io.ReadFull(r.reader, prefix); err != nil {
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(prefix)
+	if length > maxChainedFrame {
+		return nil, 0, fmt.Errorf("chained %s message of %d bytes is too long", r.encode, length)
+	}
+	frame := r.buffer(0, int(length))
+	if _, err := io.ReadFull(r.reader, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if r.encode == EncodeJSON {
+		return unwrapEnvelope(frame)
+	}
+	return unwrapPacketIn(frame)
+}
+
+// nextRaw returns the next message of a raw stream, a sequence of OpenFlow
+// contexts each followed by a complete OpenFlow message
+func (r *chainReader) nextRaw() ([]byte, error) {
+	var context OpenFlowContext
+	var header of.Header
+	ctxLen := int(context.Len())
+
+	// Read the context and the OpenFlow header, which holds the length of
+	// the rest of the message
+	message := r.buffer(0, ctxLen+8)
+	if _, err := io.ReadFull(r.reader, message); err != nil {
+		return nil, err
+	}
+	if _, err := header.ReadFrom(bytes.NewReader(message[ctxLen:])); err != nil {
+		return nil, err
+	}
+	if header.Length < 8 {
+		return nil, fmt.Errorf("invalid OpenFlow message length %d in chained stream", header.Length)
+	}
+	message = r.buffer(ctxLen+8, ctxLen+int(header.Length))
+	if _, err := io.ReadFull(r.reader, message[ctxLen+8:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return message, nil
+}
+
+// contextualize prefixes an OpenFlow message with its context
+func contextualize(dpid uint64, port uint32, message []byte) []byte {
+	var context OpenFlowContext
+	contextualized := make([]byte, int(context.Len())+len(message))
+	binary.BigEndian.PutUint64(contextualized, dpid)
+	binary.BigEndian.PutUint32(contextualized[8:], port)
+	copy(contextualized[context.Len():], message)
+	return contextualized
+}
+
+// unwrapEnvelope returns the OpenFlow message wrapped in a JSON envelope,
+// prefixed by its context, and its hop count. The DPID of the context is 0 if
+// the envelope has none, as is the port.
+func unwrapEnvelope(frame []byte) ([]byte, uint32, error) {
+	var wrapped connections.Envelope
+	if err := json.Unmarshal(frame, &wrapped); err != nil {
+		return nil, 0, err
+	}
+
+	// The payload of a raw end point is a packet, which can't be told
+	// from an OpenFlow message but by its length
+	payload := wrapped.Payload
+	if len(payload) < 8 || int(binary.BigEndian.Uint16(payload[2:])) != len(payload) {
+		return nil, 0, errors.New("chained envelope doesn't carry an OpenFlow message")
+	}
+	var dpid uint64
+	if wrapped.DPID != "" {
+		var err error
+		if dpid, err = datapath.Parse(wrapped.DPID); err != nil {
+			return nil, 0, err
+		}
+	}
+	var port uint32
+	if wrapped.InPort != nil {
+		port = *wrapped.InPort
+	}
+	return contextualize(dpid, port, payload), wrapped.Hops, nil
+}
+
+// unwrapPacketIn returns the packet in encoded as a protocol buffer, rebuilt
+// as an unbuffered OpenFlow packet in prefixed by its context, and its hop
+// count. The port of the protocol buffer is 0 if the packet in had none.
+func unwrapPacketIn(frame []byte) ([]byte, uint32, error) {
+	var decoded proto.PacketIn
+	if err := protobuf.Unmarshal(frame, &decoded); err != nil {
+		return nil, 0, err
+	}
+	message, err := packetin.Encode(packetin.PacketIn{
+		Version:   uint8(decoded.OfVersion),
+		BufferID:  0xffffffff,
+		TotalLen:  uint16(len(decoded.Frame)),
+		Reason:    uint8(decoded.Reason),
+		TableID:   uint8(decoded.TableId),
+		Cookie:    decoded.Cookie,
+		InPort:    decoded.InPort,
+		HasInPort: decoded.InPort != 0,
+	}, decoded.Frame)
+	if err != nil {
+		return nil, 0, err
+	}
+	return contextualize(decoded.Dpid, decoded.InPort, message), decoded.Hops, nil
+}
+
+// chainedEndpoints the end points to which the messages of a chained
+// connection are tee-ed, one set for each hop count with which they are
+// tee-ed, established as it is first needed. Messages are queued to the end
+// points as they are, so the hop count is that of the end points that
+// annotate them, see `connections.Annotator`.
+type chainedEndpoints struct {
+	establish func(hops uint32) (connections.Endpoints, error)
+	sets      map[uint32]connections.Endpoints
+}
+
+// get returns the end points to which messages are tee-ed with the given hop
+// count, establishing them if they aren't
+func (c *chainedEndpoints) get(hops uint32) (connections.Endpoints, error) {
+	if endpoints, ok := c.sets[hops]; ok {
+		return endpoints, nil
+	}
+	endpoints, err := c.establish(hops)
+	if err != nil {
+		return nil, err
+	}
+	if c.sets == nil {
+		c.sets = make(map[uint32]connections.Endpoints)
+	}
+	c.sets[hops] = endpoints
+	return endpoints, nil
+}
+
+// Close closes the end points that were established, returning the first
+// error
+func (c *chainedEndpoints) Close() error {
+	var first error
+	for _, endpoints := range c.sets {
+		if err := endpoints.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// establishChained establishes the configured end points for a chained
+// connection, whose messages are annotated with the given hop count, and
+// otherwise as those of the devices are
+func (app *App) establishChained(hops uint32) (connections.Endpoints, error) {
+	annotator := &connections.Annotator{}
+	if app.annotator != nil {
+		*annotator = *app.annotator
+	}
+	annotator.Hops = hops
+	return app.establishAnnotated(annotator)
+}
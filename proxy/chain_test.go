@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	protobuf "github.com/golang/protobuf/proto"
+
+	"github.com/ciena/oftee/connections"
+	"github.com/ciena/oftee/datapath"
+	"github.com/ciena/oftee/packetin"
+	"github.com/ciena/oftee/proto"
+	log "github.com/sirupsen/logrus"
+)
+
+// lengthFramed prefixes an envelope, or protocol buffer, with its length, as it is
+// written to a `tcp` end point
+func lengthFramed(encoded []byte) []byte {
+	prefixed := make([]byte, 4, 4+len(encoded))
+	binary.BigEndian.PutUint32(prefixed, uint32(len(encoded)))
+	return append(prefixed, encoded...)
+}
+
+// chainedEnvelope wraps the packet in of a tee stream entry in an envelope
+// of the given hop count
+func chainedEnvelope(t *testing.T, entry []byte, hops uint32) []byte {
+	encoded, err := json.Marshal(&connections.Envelope{
+		DPID:      datapath.Format(binary.BigEndian.Uint64(entry)),
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		OFVersion: entry[12],
+		Hops:      hops,
+		Payload:   entry[12:],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lengthFramed(encoded)
+}
+
+// chainedProto encodes the packet in of a tee stream entry as a protocol
+// buffer of the given hop count
+func chainedProto(t *testing.T, entry []byte, hops uint32) []byte {
+	packetIn, err := packetin.Decode(entry[12], entry[12:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := protobuf.Marshal(&proto.PacketIn{
+		Dpid:      binary.BigEndian.Uint64(entry),
+		OfVersion: uint32(packetIn.Version),
+		Reason:    uint32(packetIn.Reason),
+		Frame:     packetIn.Data(entry[12:]),
+		Hops:      hops,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lengthFramed(encoded)
+}
+
+func TestHandleChainEncodings(t *testing.T) {
+	for _, encode := range []string{EncodeJSON, EncodeProto} {
+		collector, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer collector.Close()
+		endpoint := (&connections.TCPConnection{}).Initialize()
+		if err = endpoint.Dial(collector.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+		go endpoint.ListenAndSend()
+		received, err := collector.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer received.Close()
+
+		// The looping message is rejected, the other is tee-ed with its
+		// hop count incremented
+		encoded := chainedEnvelope
+		if encode == EncodeProto {
+			encoded = chainedProto
+		}
+		looping := chainedPacketIn(t, 0x1, 0x888e)
+		eapol := chainedPacketIn(t, 0x2, 0x888e)
+		var hops []uint32
+		endpoints := &chainedEndpoints{establish: func(h uint32) (connections.Endpoints, error) {
+			hops = append(hops, h)
+			return connections.Endpoints{endpoint}, nil
+		}}
+		upstream, downstream := net.Pipe()
+		app := &App{Config: Config{ChainEncode: encode, ChainMaxHops: 3}}
+		done := make(chan error)
+		go func() {
+			done <- app.handleChain(context.Background(), downstream, endpoints)
+		}()
+		for _, message := range [][]byte{encoded(t, looping, 3), encoded(t, eapol, 1)} {
+			if _, err = upstream.Write(message); err != nil {
+				t.Fatal(err)
+			}
+		}
+		upstream.Close()
+		if err = <-done; err != nil {
+			t.Errorf("%s: unexpected error processing chained stream: %v", encode, err)
+		}
+		if len(hops) != 1 || hops[0] != 2 {
+			t.Errorf("%s: expected end points established for 2 hops, got %v", encode, hops)
+		}
+
+		// The packet in is tee-ed as received from the device, but for
+		// its port, which the chained instance doesn't know
+		buf := make([]byte, len(eapol))
+		received.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err = io.ReadFull(received, buf); err != nil {
+			t.Fatalf("%s: %v", encode, err)
+		}
+		if dpid := binary.BigEndian.Uint64(buf); dpid != 0x2 {
+			t.Errorf("%s: expected the packet in of DPID 0x2, got 0x%x", encode, dpid)
+		}
+		packetIn, err := packetin.Decode(buf[12], buf[12:])
+		if err != nil {
+			t.Fatalf("%s: %v", encode, err)
+		}
+		if data := packetIn.Data(buf[12:]); !bytes.Equal(data, eapol[len(eapol)-60:]) {
+			t.Errorf("%s: expected packet %02x, got %02x", encode, eapol[len(eapol)-60:], data)
+		}
+	}
+}
+
+func TestHandleChainRawEnvelope(t *testing.T) {
+	// The envelope of a raw end point carries a packet, not a packet in
+	entry := chainedPacketIn(t, 0x1, 0x888e)
+	encoded, _ := json.Marshal(&connections.Envelope{Payload: entry[len(entry)-60:]})
+
+	upstream, downstream := net.Pipe()
+	go upstream.Write(lengthFramed(encoded))
+	defer upstream.Close()
+	app := &App{Config: Config{ChainEncode: EncodeJSON}}
+	if err := app.handleChain(context.Background(), downstream, chainedTo()); err == nil {
+		t.Error("Expected error for envelope without an OpenFlow message")
+	}
+}
+
+func TestChainLoop(t *testing.T) {
+	// The instance tees everything back to itself, so the packet in loops
+	// until its hop count reaches the limit
+	chain, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Close()
+	app := &App{Config: Config{ChainEncode: EncodeJSON, ChainMaxHops: 2, TeeTo: []string{
+		"encode=json;action=tcp://" + chain.Addr().String(),
+	}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recorder := &logRecorder{}
+	log.AddHook(recorder)
+	defer recorder.stop()
+	go app.chainServe(ctx, chain)
+
+	endpoints, err := app.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer endpoints.Close()
+	message := chainedPacketIn(t, 0x1, 0x888e)
+	packetIn, _ := packetin.Decode(message[12], message[12:])
+	if err = app.teePacketIn(ctx, log.NewEntry(log.StandardLogger()), endpoints, message, &packetIn, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The packet in is tee-ed by the instance as received from the
+	// device, then twice more, as received from itself, and rejected the
+	// third time
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		recorder.lock.Lock()
+		var rejected uint32
+		found := false
+		for _, entry := range recorder.entries {
+			if entry.Message == "Rejecting looping packet in from chained instance, see CHAIN_MAX_HOPS" {
+				rejected, found = entry.Data["hops"].(uint32), true
+			}
+		}
+		recorder.lock.Unlock()
+		if found {
+			if rejected != 2 {
+				t.Errorf("Expected the packet in rejected after 2 hops, got %d", rejected)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the looping packet in to be rejected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
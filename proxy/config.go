@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"reflect"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Redacted replaces secret values in the effective configuration
+const Redacted = "********"
+
+var (
+	// secretName matches the names of configuration values that are
+	// secret in their entirety
+	secretName = regexp.MustCompile(`(?i)(PASSWORD|PASSWD|SECRET|TOKEN|AUTH|CREDENTIAL|PRIVATE_KEY|API_KEY)`)
+
+	// secretTerm matches the `term=value` pairs of end point and webhook
+	// specifications whose values are secret
+	secretTerm = regexp.MustCompile(`(?i)\b(auth|password|passwd|secret|token)=[^;,]*`)
+
+	// secretHeader matches the `header=Name:Value` terms of end point
+	// specifications, whose values, i.e. `Authorization`, are secret
+	secretHeader = regexp.MustCompile(`(?i)\b(header=[^:;,]*):[^;,]*`)
+
+	// userPassword matches the user information of a URL embedded in a
+	// specification
+	userPassword = regexp.MustCompile(`://([^:@/;]*):([^@/;]*)@`)
+)
+
+// redact returns a configuration value with any secrets masked. Values whose
+// names look secret are masked in their entirety, otherwise passwords in URLs,
+// secret specification terms and the values of headers are masked. Every configuration value goes
+// through here, so a new secret value is masked as long as its name or
+// format follows these rules.
+func redact(name string, value string) string {
+	if value == "" {
+		return value
+	}
+	if secretName.MatchString(name) {
+		return Redacted
+	}
+	value = userPassword.ReplaceAllString(value, "://$1:"+Redacted+"@")
+	value = secretHeader.ReplaceAllString(value, "$1:"+Redacted)
+	return secretTerm.ReplaceAllString(value, "$1="+Redacted)
+}
+
+// EffectiveConfig returns the configuration, as resolved from the
+// environment, keyed by environment variable name with secrets redacted
+func (c *Config) EffectiveConfig() map[string]interface{} {
+	config := make(map[string]interface{})
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("envconfig")
+		if name == "" || field.PkgPath != "" {
+			continue
+		}
+		switch value := v.Field(i).Interface().(type) {
+		case string:
+			config[name] = redact(name, value)
+		case []string:
+			values := make([]string, len(value))
+			for j := range value {
+				values[j] = redact(name, value[j])
+			}
+			config[name] = values
+		case time.Duration:
+			config[name] = value.String()
+		default:
+			config[name] = value
+		}
+	}
+	return config
+}
+
+// DefaultConfig returns the configuration with the default of each setting,
+// as if none were set in the environment
+func DefaultConfig() Config {
+	var config Config
+	t := reflect.TypeOf(config)
+	for i := 0; i < t.NumField(); i++ {
+		if value, ok := t.Field(i).Tag.Lookup("default"); ok {
+			setConfigValue(&config, t.Field(i).Tag.Get("envconfig"), value)
+		}
+	}
+	return config
+}
+
+// logEffectiveConfig logs the effective configuration as a single entry
+func (app *App) logEffectiveConfig() {
+	log.
+		WithFields(log.Fields(app.EffectiveConfig())).
+		Info("Effective configuration")
+}
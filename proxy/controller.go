@@ -0,0 +1,384 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ciena/oftee/connections"
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/injector"
+	of "github.com/netrack/openflow"
+	"github.com/netrack/openflow/ofp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Transaction IDs of the requests sent to a device by the local controller
+const (
+	localFeaturesXID = 1
+	localPortDescXID = 2
+)
+
+// Modes in which the messages of a device are proxied, given more than one
+// SDN controller
+const (
+	// ProxyModeAll proxy to every controller at once
+	ProxyModeAll = "all"
+
+	// ProxyModeFailover proxy to the first controller that can be
+	// connected, failing over to the next once its connection fails
+	ProxyModeFailover = "failover"
+)
+
+// controllerTargets returns the SDN controllers to which the messages from
+// each device are proxied, `PROXY_TO` being a list of them separated by `,`
+func (app *App) controllerTargets() []string {
+	var targets []string
+	for _, target := range strings.Split(app.ProxyTo, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// dialController establishes the connection to an SDN controller to which
+// the messages from a device are proxied, over TCP, TLS, given a `tls://`
+// address, or, given a `unix://` address, the controller's unix domain socket
+func (app *App) dialController(target string) (*connections.TCPConnection, error) {
+	var (
+		proxyTarget string
+		unix        bool
+		tlsConfig   *tls.Config
+	)
+
+	// Parse URL to proxy
+	if strings.Index(target, "://") == -1 {
+		proxyTarget = target
+	} else {
+		proxyURL, err := url.Parse(target)
+		if err != nil {
+			log.
+				WithFields(log.Fields{"proxy": target}).
+				WithError(err).
+				Error("Unable to parse URL to SDN controller")
+			return nil, err
+		}
+		switch proxyURL.Scheme {
+		case SchemeTCP:
+			proxyTarget = proxyURL.Host
+		case SchemeTLS:
+			proxyTarget = proxyURL.Host
+			if tlsConfig, err = app.controllerTLSConfig(proxyURL.Hostname()); err != nil {
+				log.
+					WithFields(log.Fields{"proxy": target}).
+					WithError(err).
+					Error("Unable to load the TLS configuration of the SDN controller connection")
+				app.controllerDialed(target, err)
+				return nil, err
+			}
+		case SchemeUnix:
+			proxyTarget = proxyURL.Path
+			unix = true
+		default:
+			log.
+				WithFields(log.Fields{
+					"scheme": proxyURL.Scheme,
+					"proxy":  target,
+				}).
+				Error("Only TCP, TLS and unix domain socket connections are supported to SDN controller")
+			return nil, fmt.Errorf("unsupported SDN controller scheme '%s'", proxyURL.Scheme)
+		}
+	}
+
+	// Create connection to SDN controller
+	proxy := &connections.TCPConnection{
+		LocalAddr: app.controllerSource,
+		DSCP:      app.controllerDSCP,
+		Proxy:     app.controllerProxy,
+	}
+	if unix {
+		proxy = &connections.NewUnixConnection().TCPConnection
+	}
+	err := proxy.Dial(proxyTarget)
+	if err == nil && tlsConfig != nil {
+		err = handshakeController(proxy, tlsConfig)
+	}
+	app.controllerDialed(target, err)
+	if err != nil {
+		if _, ok := err.(*connections.ProxyError); ok {
+			log.
+				WithFields(log.Fields{"proxy": target}).
+				WithError(err).
+				Error("Unable to connect to proxy for SDN controller")
+			return nil, err
+		}
+		log.
+			WithFields(log.Fields{"proxy": target}).
+			WithError(err).
+			Error("Unable to connect to SDN controller")
+		return nil, err
+	}
+	proxy.Criteria = criteria.Criteria{}
+	return proxy, nil
+}
+
+// linkControllers establishes the link to the SDN controller to which the
+// messages of a device are proxied or, given more than one, the group of
+// links to all of them. Then a controller that can't be dialed is linked
+// as its connection is re-established, so that it doesn't hold up the
+// others, as long as one of them can be.
+func (app *App) linkControllers(ctx context.Context, sess *session) (controllerProxy, error) {
+	targets := app.controllerTargets()
+	if len(targets) > 1 && app.ProxyMode == ProxyModeFailover {
+		return app.failoverControllers(ctx, sess, targets)
+	}
+	if len(targets) <= 1 {
+		upstream, err := app.dialController(app.ProxyTo)
+		if err != nil {
+			return nil, err
+		}
+		return app.linkController(ctx, sess, app.ProxyTo, upstream.Connection), nil
+	}
+
+	// The first controller connected is that whose hello is read for the
+	// device
+	var (
+		links   = make([]*controllerLink, len(targets))
+		primary *controllerLink
+		failure error
+	)
+	for i, target := range targets {
+		var conn net.Conn
+		if upstream, err := app.dialController(target); err != nil {
+			failure = err
+		} else {
+			conn = upstream.Connection
+		}
+		links[i] = app.linkController(ctx, sess, target, conn)
+		if conn != nil && primary == nil {
+			primary = links[i]
+			continue
+		}
+		links[i].secondary()
+	}
+	if primary == nil {
+		for _, link := range links {
+			link.Close()
+		}
+		return nil, failure
+	}
+	return newControllerGroup(links, ControllerWriteTimeout), nil
+}
+
+// linkController creates the link to an SDN controller over the established
+// connection, or that establishes it if nil, which records whether the
+// controller is up as its connection fails
+func (app *App) linkController(ctx context.Context, sess *session, target string, conn net.Conn) *controllerLink {
+	link := newControllerLink(ctx, conn, app.redialController(target), app.ProxyBufferSize, sess.Snoop, sess.Log)
+	link.failed = func(err error) {
+		app.controllerDialed(target, err)
+	}
+	return link
+}
+
+// failoverControllers establishes the link to the first of the SDN
+// controllers that can be connected, whose connection is re-established to
+// the next of them, in order, once it fails
+func (app *App) failoverControllers(ctx context.Context, sess *session, targets []string) (controllerProxy, error) {
+	f := &controllerFailover{app: app, sess: sess, targets: targets}
+	conn, err := f.dial()
+	if err != nil {
+		return nil, err
+	}
+	link := newControllerLink(ctx, conn, f.dial, app.ProxyBufferSize, sess.Snoop, sess.Log)
+	link.failed = func(err error) {
+		app.controllerDialed(f.Active(), err)
+	}
+	return failoverLink{link, f}, nil
+}
+
+// controllerFailover dials the SDN controllers of a device in failover mode,
+// in the order they are listed, starting with the first and, once connected,
+// with the one after that whose connection failed. The device's hello is
+// written to the controller failed over to by the link, which resumes the
+// session, so the controller completes its handshake with the device.
+type controllerFailover struct {
+	app     *App
+	sess    *session
+	targets []string
+
+	lock      sync.Mutex
+	active    int
+	connected bool
+}
+
+// dial establishes the connection to the next SDN controller that can be
+// connected, returning the error of the last if none can
+func (f *controllerFailover) dial() (net.Conn, error) {
+	f.lock.Lock()
+	previous, connected := f.active, f.connected
+	f.lock.Unlock()
+	start := 0
+	if connected {
+		start = previous + 1
+	}
+	var failure error
+	for i := range f.targets {
+		next := (start + i) % len(f.targets)
+		proxy, err := f.app.dialController(f.targets[next])
+		if err != nil {
+			failure = err
+			continue
+		}
+		f.lock.Lock()
+		f.active, f.connected = next, true
+		f.lock.Unlock()
+		if connected && next != previous {
+			f.sess.Log().
+				WithFields(log.Fields{
+					"from": f.targets[previous],
+					"to":   f.targets[next],
+				}).
+				Warn("Failed over to SDN controller")
+			f.app.notifyFailover(f.sess, f.targets[previous], f.targets[next])
+		}
+		return proxy.Connection, nil
+	}
+	return nil, failure
+}
+
+// Active returns the SDN controller to which the device is proxied, or was
+// last while the connection is re-established
+func (f *controllerFailover) Active() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.targets[f.active]
+}
+
+// failoverLink the link to the SDN controller of a device in failover mode,
+// which reports the controller that is active
+type failoverLink struct {
+	*controllerLink
+	failover *controllerFailover
+}
+
+// Active returns the SDN controller to which the device is proxied
+func (l failoverLink) Active() string {
+	return l.failover.Active()
+}
+
+// handshakeController completes the TLS handshake with the SDN controller
+// over the established connection, which is closed if the handshake fails
+func handshakeController(proxy *connections.TCPConnection, config *tls.Config) error {
+	conn := tls.Client(proxy.Connection, config)
+	conn.SetDeadline(time.Now().Add(connections.TLSHandshakeTimeout))
+	err := conn.Handshake()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	proxy.Connection = conn
+	return nil
+}
+
+// redialController returns the function that re-establishes the connection
+// to an SDN controller of a device whose connection to it failed
+func (app *App) redialController(target string) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		proxy, err := app.dialController(target)
+		if err != nil {
+			return nil, err
+		}
+		return proxy.Connection, nil
+	}
+}
+
+// snoopedInjector an injector whose injected messages are snooped first, so
+// that the handshake completed by the local controller is recorded as that of
+// the controller
+type snoopedInjector struct {
+	injector.Injector
+	snoop func(message []byte)
+}
+
+// Inject snoops the message and then injects it to the device
+func (i snoopedInjector) Inject(ctx context.Context, message []byte) {
+	i.snoop(message)
+	i.Injector.Inject(ctx, message)
+}
+
+// injectRequest builds an OpenFlow message and injects it to the device
+func injectRequest(ctx context.Context, inject injector.Injector, t of.Type, xid uint32, body io.WriterTo) error {
+	request := of.NewRequest(t, body)
+	request.Header.Transaction = xid
+	message := &bytes.Buffer{}
+	if _, err := request.WriteTo(message); err != nil {
+		return err
+	}
+	inject.Inject(ctx, message.Bytes())
+	return nil
+}
+
+// localController stands in for the SDN controller when proxying is
+// disabled. It reads the messages that would otherwise be proxied from the
+// given connection and completes the OpenFlow handshake with the device,
+// answering its echo requests to keep it connected, by injecting the
+// requests and replies. Once the features reply is received the device's
+// port descriptions are requested, so its ports are tracked. All other
+// messages are discarded. Injecting is abandoned once the context is done.
+func localController(ctx context.Context, conn net.Conn, inject injector.Injector) error {
+	var (
+		header of.Header
+		body   = new(bytes.Buffer)
+	)
+
+	if err := injectRequest(ctx, inject, of.TypeHello, 0, &bytes.Buffer{}); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		hCount, err := header.ReadFrom(reader)
+		if err != nil {
+			return err
+		}
+		body.Reset()
+		if _, err = io.CopyN(body, reader, int64(header.Length)-hCount); err != nil {
+			return err
+		}
+
+		switch header.Type {
+		case of.TypeHello:
+			log.WithFields(log.Fields{
+				"of_version": header.Version,
+			}).Debug("Device hello, requesting features")
+			err = injectRequest(ctx, inject, of.TypeFeaturesRequest, localFeaturesXID, &bytes.Buffer{})
+		case of.TypeEchoRequest:
+			err = injectRequest(ctx, inject, of.TypeEchoReply, header.Transaction, body)
+		case of.TypeFeaturesReply:
+			if header.Version == OFVersion13 {
+				err = injectRequest(ctx, inject, of.TypeMultipartRequest, localPortDescXID,
+					&ofp.MultipartRequest{Type: ofp.MultipartTypePortDescription, Body: &bytes.Buffer{}})
+			}
+		case of.TypeError:
+			log.WithFields(log.Fields{
+				"of_version":     header.Version,
+				"of_transaction": header.Transaction,
+				"data":           fmt.Sprintf("%02x", body.Bytes()),
+			}).Warn("Device reported an error")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/api"
+	"github.com/ciena/oftee/connections"
+	of "github.com/netrack/openflow"
+	"github.com/netrack/openflow/ofp"
+)
+
+// readMessage reads a complete OpenFlow message, returning its header and
+// body
+func readMessage(t *testing.T, r io.Reader) (of.Header, []byte) {
+	var header of.Header
+	if _, err := header.ReadFrom(r); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(header.Length)-8)
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatal(err)
+	}
+	return header, body
+}
+
+// writeMessage writes an OpenFlow message with the given transaction ID
+func writeMessage(t *testing.T, w io.Writer, msgType of.Type, xid uint32, body io.WriterTo) {
+	request := of.NewRequest(msgType, body)
+	request.Header.Transaction = xid
+	if _, err := request.WriteTo(w); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProxyDisabled(t *testing.T) {
+	// Nothing is listening, the SDN controller is never dialed
+	app := &App{Config: Config{ProxyDisabled: true, ProxyTo: "127.0.0.1:1"}}
+	app.api = api.NewAPI(":0", "", "")
+	go app.api.ListenAndServe()
+
+	device, conn := net.Pipe()
+	defer device.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- app.handle(context.Background(), conn, connections.Endpoints{})
+	}()
+	device.SetDeadline(time.Now().Add(5 * time.Second))
+
+	expect := func(expected of.Type) (of.Header, []byte) {
+		header, body := readMessage(t, device)
+		if header.Type != expected {
+			t.Fatalf("Expected %s from oftee, got %s", expected, header.Type)
+		}
+		return header, body
+	}
+
+	// Hello exchange, followed by the features and port description
+	// requests
+	expect(of.TypeHello)
+	writeMessage(t, device, of.TypeHello, 1, &bytes.Buffer{})
+	header, _ := expect(of.TypeFeaturesRequest)
+	writeMessage(t, device, of.TypeFeaturesReply, header.Transaction, &ofp.SwitchFeatures{DatapathID: 0x1})
+	if _, body := expect(of.TypeMultipartRequest); body[1] != byte(ofp.MultipartTypePortDescription) {
+		t.Errorf("Expected port description request, got %02x", body)
+	}
+
+	// Echo requests are answered locally
+	writeMessage(t, device, of.TypeEchoRequest, 42, bytes.NewBufferString("keepalive"))
+	if header, body := expect(of.TypeEchoReply); header.Transaction != 42 || string(body) != "keepalive" {
+		t.Errorf("Incorrect echo reply, transaction %d, body '%s'", header.Transaction, body)
+	}
+
+	// The device is registered, so packet outs are injected to it
+	packetOut := buildPacketOut(t, 1)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/oftee/0x1", bytes.NewReader(packetOut))
+		req.Header.Set("Content-type", "application/octet-stream")
+		app.api.ServeHTTP(recorder, req)
+		if recorder.Code == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Packet out not accepted, got %d", recorder.Code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expect(of.TypePacketOut)
+
+	device.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("Device connection not cleaned up after disconnect")
+	}
+}
+
+// buildPacketOut builds a packet out message that outputs an empty frame to
+// the given port
+func buildPacketOut(t *testing.T, port ofp.PortNo) []byte {
+	body := &bytes.Buffer{}
+	out := ofp.PacketOut{
+		Buffer:  ofp.NoBuffer,
+		InPort:  ofp.PortController,
+		Actions: ofp.Actions{&ofp.ActionOutput{Port: port, MaxLen: ofp.ContentLenNoBuffer}},
+	}
+	if _, err := out.WriteTo(body); err != nil {
+		t.Fatal(err)
+	}
+	body.Write(make([]byte, 60))
+	message := &bytes.Buffer{}
+	writeMessage(t, message, of.TypePacketOut, 0, body)
+	return message.Bytes()
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/ciena/oftee/connections"
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/spool"
+	log "github.com/sirupsen/logrus"
+)
+
+// spoolName returns the name of the directory, within `SPOOL_DIR`, of the
+// spool of the end point at the given address, unless one is specified.
+// Characters that can't be used in a file name are replaced, i.e.
+// `http://collector:8080/leases` is spooled in `http_collector_8080_leases`.
+func spoolName(addr string) string {
+	return strings.Trim(strings.Map(func(r rune) rune {
+		if r == '-' || r == '.' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.Replace(addr, "://", "_", 1)), "_")
+}
+
+// durableConnection returns the durable connection for the end point whose
+// spool has the given name, creating it, and opening its spool, the first
+// time. As a spool can only be opened once a durable connection is shared
+// by all the device connections, even when `SHARE_CONNECTIONS` is false, so
+// `true` is returned if it already existed and is delivering messages.
+func (app *App) durableConnection(addr, name string, match criteria.Criteria, sync spool.SyncPolicy,
+	target connections.Deliverer) (*connections.DurableConnection, bool, error) {
+
+	app.durablesLock.Lock()
+	defer app.durablesLock.Unlock()
+	if c, ok := app.durables[name]; ok {
+		return c, true, nil
+	}
+	dir := filepath.Join(app.SpoolDir, name)
+	s, err := spool.Open(dir, spool.Options{
+		SegmentSize: app.SpoolSegmentSize,
+		MaxSize:     app.SpoolMaxSize,
+		Sync:        sync,
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to open spool '%s': %s", dir, err)
+	}
+	log.
+		WithFields(log.Fields{
+			"connection": addr,
+			"spool":      dir,
+			"fsync":      sync.String(),
+		}).
+		Info("Opened spool for durable end point")
+	c := (&connections.DurableConnection{
+		Criteria: match,
+		Target:   target,
+		Address:  addr,
+		Spool:    s,
+	}).Initialize()
+	if app.durables == nil {
+		app.durables = make(map[string]*connections.DurableConnection)
+	}
+	app.durables[name] = c
+	return c, false, nil
+}
@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ciena/oftee/config"
+	"github.com/ciena/oftee/connections"
+	log "github.com/sirupsen/logrus"
+)
+
+// The shared end points can be added, removed, and promoted from shadows, at
+// runtime via the API.
+// The running end points are replaced, under the lock, by a copy that
+// includes, or excludes, the end point, so that the device connections,
+// which tee to the running end points, see `liveEndpoints`, pick up the
+// change with their next message without reconnecting. Each end point is
+// assigned an ID when it is established, which it keeps across reloads while
+// its specification is unchanged.
+
+// EndpointInfo a running end point, its ID, its specification, redacted, and
+// its statistics
+type EndpointInfo struct {
+	ID   string `json:"id"`
+	Spec string `json:"spec"`
+	connections.EndpointStats
+}
+
+// newEndpointIDs assigns IDs to the given number of end points being
+// established. Must be called with the end points lock held.
+func (app *App) newEndpointIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		app.lastEndpointID++
+		ids[i] = strconv.FormatUint(app.lastEndpointID, 10)
+	}
+	return ids
+}
+
+// endpointList returns the running shared end points
+func (app *App) endpointList() []EndpointInfo {
+	app.endpointsLock.RLock()
+	defer app.endpointsLock.RUnlock()
+	list := make([]EndpointInfo, 0, len(app.endpoints))
+	for i, conn := range app.endpoints {
+		list = append(list, app.endpointInfo(i, conn))
+	}
+	return list
+}
+
+// endpointStates returns the connection state of each running shared end
+// point that reports it, by its action. Of end points that share an action
+// the state is only connected if all of them are.
+func (app *App) endpointStates() map[string]string {
+	app.endpointsLock.RLock()
+	defer app.endpointsLock.RUnlock()
+	states := make(map[string]string)
+	for i, state := range app.endpoints.States() {
+		if state == "" {
+			continue
+		}
+		action := actionOf(redact("TEE_TO", app.TeeTo[i]))
+		if current, ok := states[action]; !ok || current == connections.StateConnected {
+			states[action] = state
+		}
+	}
+	return states
+}
+
+// endpointInfo describes the i'th running end point. Must be called with the
+// end points lock held.
+func (app *App) endpointInfo(i int, conn connections.Connection) EndpointInfo {
+	info := EndpointInfo{
+		ID:            app.endpointIDs[i],
+		Spec:          redact("TEE_TO", app.TeeTo[i]),
+		EndpointStats: connections.EndpointStats{Endpoint: conn.String()},
+	}
+	if counted, ok := conn.(connections.StatsConnection); ok {
+		info.EndpointStats = counted.Stats()
+	}
+	return info
+}
+
+// specOf returns the specification of an end point given its terms, by name.
+// The match terms, and options, are ordered by name, followed by the action.
+func specOf(terms map[string]string) (string, error) {
+	action, ok := terms[TermAction]
+	if !ok || action == "" {
+		return "", errors.New("missing action")
+	}
+	names := make([]string, 0, len(terms))
+	for name, value := range terms {
+		if name == "" || strings.ContainsAny(name, ";=") || strings.Contains(value, ";") {
+			return "", fmt.Errorf("invalid term '%s=%s'", name, value)
+		}
+		if name != TermAction {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	spec := make([]string, 0, len(terms))
+	for _, name := range names {
+		spec = append(spec, name+"="+terms[name])
+	}
+	return strings.Join(append(spec, TermAction+"="+action), ";"), nil
+}
+
+// addEndpoint establishes a shared end point from the terms of its
+// specification and adds it to the running end points, returning it with the
+// ID it is assigned
+func (app *App) addEndpoint(terms map[string]string) (*EndpointInfo, error) {
+	spec, err := specOf(terms)
+	if err != nil {
+		return nil, err
+	}
+
+	app.endpointsLock.Lock()
+	defer app.endpointsLock.Unlock()
+	established, err := app.establishEndpoints([]string{spec}, app.annotator)
+	if err != nil {
+		return nil, err
+	}
+	n := len(app.endpoints)
+	app.endpoints = append(append(make(connections.Endpoints, 0, n+1), app.endpoints...), established[0])
+	app.endpointIDs = append(append(make([]string, 0, n+1), app.endpointIDs...), app.newEndpointIDs(1)...)
+	app.TeeTo = append(append(make([]string, 0, n+1), app.TeeTo...), spec)
+	if app.Endpoints != nil {
+		app.Endpoints = append(append(make([]config.Endpoint, 0, n+1), app.Endpoints...), configuredOf(terms))
+	}
+	app.endpointsChanged()
+	info := app.endpointInfo(n, established[0])
+	log.
+		WithFields(log.Fields{
+			"id":   info.ID,
+			"spec": info.Spec,
+		}).
+		Info("Added end point")
+	return &info, nil
+}
+
+// removeEndpoint removes the shared end point with the given ID from the
+// running end points, returning it, or nil if there is no such end point. Its
+// connection is closed once the messages queued to it are delivered.
+func (app *App) removeEndpoint(id string) *EndpointInfo {
+	app.endpointsLock.Lock()
+	defer app.endpointsLock.Unlock()
+	i := 0
+	for i < len(app.endpointIDs) && app.endpointIDs[i] != id {
+		i++
+	}
+	if i == len(app.endpointIDs) {
+		return nil
+	}
+	removed := app.endpoints[i]
+	info := app.endpointInfo(i, removed)
+	app.endpoints = append(append(connections.Endpoints{}, app.endpoints[:i]...), app.endpoints[i+1:]...)
+	app.endpointIDs = append(append([]string{}, app.endpointIDs[:i]...), app.endpointIDs[i+1:]...)
+	app.TeeTo = append(append([]string{}, app.TeeTo[:i]...), app.TeeTo[i+1:]...)
+	if app.Endpoints != nil {
+		app.Endpoints = append(append([]config.Endpoint{}, app.Endpoints[:i]...), app.Endpoints[i+1:]...)
+	}
+	app.endpointsChanged()
+	log.
+		WithFields(log.Fields{
+			"id":   info.ID,
+			"spec": info.Spec,
+		}).
+		Info("Removed end point")
+
+	closeRemoved(connections.Endpoints{removed}, []string{info.ID})
+	return &info
+}
+
+// promoteEndpoint replaces the shadow end point with the given ID by one that
+// delivers the messages it matches, established from its specification
+// without the `shadow` term, so that it keeps its criteria and its ID. It
+// returns the end point, or nil if there is no such end point. The shadow end
+// point's counts are not carried over.
+func (app *App) promoteEndpoint(id string) (*EndpointInfo, error) {
+	app.endpointsLock.Lock()
+	defer app.endpointsLock.Unlock()
+	i := 0
+	for i < len(app.endpointIDs) && app.endpointIDs[i] != id {
+		i++
+	}
+	if i == len(app.endpointIDs) {
+		return nil, nil
+	}
+	spec, err := unshadowed(app.TeeTo[i])
+	if err != nil {
+		return nil, err
+	}
+	established, err := app.establishEndpoints([]string{spec}, app.annotator)
+	if err != nil {
+		return nil, err
+	}
+	shadow := app.endpoints[i]
+	app.endpoints = append(connections.Endpoints{}, app.endpoints...)
+	app.endpoints[i] = established[0]
+	app.TeeTo = append([]string{}, app.TeeTo...)
+	app.TeeTo[i] = spec
+	if app.Endpoints != nil {
+		app.Endpoints = append([]config.Endpoint{}, app.Endpoints...)
+		endpoint := config.Endpoint{URL: app.Endpoints[i].URL}
+		for _, term := range app.Endpoints[i].Options {
+			if strings.ToLower(term.Name) != TermShadow {
+				endpoint.Options = append(endpoint.Options, term)
+			}
+		}
+		app.Endpoints[i] = endpoint
+	}
+	app.endpointsChanged()
+	info := app.endpointInfo(i, established[0])
+	log.
+		WithFields(log.Fields{
+			"id":   info.ID,
+			"spec": info.Spec,
+		}).
+		Info("Promoted shadow end point")
+
+	closeRemoved(connections.Endpoints{shadow}, []string{info.ID})
+	return &info, nil
+}
+
+// unshadowed returns the specification of a shadow end point without its
+// `shadow` term, or an error if the end point isn't a shadow
+func unshadowed(spec string) (string, error) {
+	terms, err := splitSpec(spec)
+	if err != nil {
+		return "", err
+	}
+	shadow := false
+	for _, term := range terms {
+		if term.name == TermShadow {
+			shadow, _ = strconv.ParseBool(term.value)
+		}
+	}
+	if !shadow {
+		return "", errors.New("end point is not a shadow")
+	}
+	parts := strings.Split(spec, ";")
+	kept := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if eq := strings.Index(part, "="); eq == -1 || strings.ToLower(part[:eq]) != TermShadow {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, ";"), nil
+}
+
+// closeRemoved closes end points removed from the running end points, with
+// the given IDs, once the messages queued to them are delivered. A device
+// connection may still be queuing to them, from the running end points it
+// read before the removal, so they are closed in the background.
+func closeRemoved(removed connections.Endpoints, ids []string) {
+	for i := range removed {
+		go func(conn connections.Connection, id string) {
+			if err := (connections.Endpoints{conn}).Close(); err != nil {
+				log.
+					WithFields(log.Fields{
+						"id": id,
+					}).
+					WithError(err).
+					Warn("Removed end point closed with messages undelivered")
+			}
+		}(removed[i], ids[i])
+	}
+}
+
+// configuredOf returns an end point added at runtime, given the terms of its
+// specification by name, as one of a structured configuration file, its terms
+// other than its action ordered by name as options
+func configuredOf(terms map[string]string) config.Endpoint {
+	endpoint := config.Endpoint{URL: terms[TermAction]}
+	names := make([]string, 0, len(terms))
+	for name := range terms {
+		if name != TermAction {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		endpoint.Options = append(endpoint.Options, config.Term{Name: name, Value: terms[name]})
+	}
+	return endpoint
+}
+
+// endpointsChanged applies a change to the running end point specifications.
+// Must be called with the end points lock held.
+func (app *App) endpointsChanged() {
+	if app.api != nil {
+		app.api.SetConfig(app.EffectiveConfig())
+	}
+}
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/internal/harness"
+)
+
+func TestSpecOf(t *testing.T) {
+	spec, err := specOf(map[string]string{
+		"action":  "http://host/tee?a=b",
+		"workers": "2",
+		"dl_type": "0x888e",
+	})
+	if err != nil || spec != "dl_type=0x888e;workers=2;action=http://host/tee?a=b" {
+		t.Errorf("Expected the terms ordered by name, action last, got '%s' (%v)", spec, err)
+	}
+	for _, terms := range []map[string]string{
+		{"dl_type": "0x888e"},
+		{"action": ""},
+		{"dl_type": "0x888e;workers=2", "action": "tcp://host:9000"},
+		{"dl_type=0x888e": "", "action": "tcp://host:9000"},
+	} {
+		if spec, err := specOf(terms); err == nil {
+			t.Errorf("Expected the terms %v rejected, got '%s'", terms, spec)
+		}
+	}
+}
+
+func TestIntegrationRuntimeEndpoints(t *testing.T) {
+	kept := harness.NewTCPEndpoint(t)
+	defer kept.Stop()
+	added := harness.NewTCPEndpoint(t)
+	defer added.Stop()
+	r := newRig(t, kept.Spec())
+	defer r.close()
+	r.app.api.AddEndpoint = func(terms map[string]string) (interface{}, error) {
+		return r.app.addEndpoint(terms)
+	}
+	r.app.api.RemoveEndpoint = func(id string) (interface{}, bool) {
+		info := r.app.removeEndpoint(id)
+		return info, info != nil
+	}
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		r.app.api.ServeHTTP(resp, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return resp
+	}
+	device, _, _ := r.connect(0x1, 0)
+	defer device.Close()
+	first := device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64))
+	kept.Frames.ExpectFrames(t, harness.FrameOf(0x1, 1, first))
+
+	// The added end point receives the packet ins it matches from the
+	// connected device, without it reconnecting
+	resp := serve("POST", "/oftee/endpoints", `{"action": "tcp://`+added.Addr()+`", "dl_type": "0x888e", "queue": 10}`)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Incorrect response code, expected 201, got %d: %s", resp.Code, resp.Body.String())
+	}
+	var info EndpointInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != "2" || info.Spec != "dl_type=0x888e;queue=10;action=tcp://"+added.Addr() {
+		t.Errorf("Expected the end point added as 2, got %+v", info)
+	}
+	second := device.SendPacketIn(2, harness.EthernetFrame(0x888e, 64))
+	device.SendPacketIn(3, harness.EthernetFrame(0x0806, 64))
+	added.Frames.ExpectFrames(t, harness.FrameOf(0x1, 2, second))
+	if list := r.app.endpointList(); len(list) != 2 || list[0].ID != "1" || list[1].ID != "2" {
+		t.Errorf("Expected both end points listed, got %+v", list)
+	}
+
+	// The removed end point no longer receives packet ins
+	kept.Frames.WaitFrames(t, 3)
+	if resp := serve("DELETE", "/oftee/endpoints/1", ""); resp.Code != http.StatusOK {
+		t.Fatalf("Incorrect response code, expected 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	third := device.SendPacketIn(4, harness.EthernetFrame(0x888e, 64))
+	added.Frames.ExpectFrames(t, harness.FrameOf(0x1, 2, second), harness.FrameOf(0x1, 4, third))
+	if frames := kept.Frames.Frames(); len(frames) != 3 {
+		t.Errorf("Expected the removed end point to receive nothing more, got %d frames", len(frames))
+	}
+	if teeTo := r.app.teeTo(); len(teeTo) != 1 || teeTo[0] != info.Spec {
+		t.Errorf("Expected only the added end point running, got %v", teeTo)
+	}
+
+	// Unknown end points and invalid specifications are rejected
+	if resp := serve("DELETE", "/oftee/endpoints/1", ""); resp.Code != http.StatusNotFound {
+		t.Errorf("Incorrect response code, expected 404, got %d", resp.Code)
+	}
+	for _, body := range []string{
+		`{"dl_type": "0x888e"}`,
+		`{"action": "ftp://host/tee"}`,
+		`{"action": "tcp://host:9000", "dl_type": ["0x888e"]}`,
+		`not json`,
+	} {
+		if resp := serve("POST", "/oftee/endpoints", body); resp.Code != http.StatusBadRequest {
+			t.Errorf("Incorrect response code for %s, expected 400, got %d", body, resp.Code)
+		}
+	}
+}
+
+func TestIntegrationPromoteShadowEndpoint(t *testing.T) {
+	consumer := harness.NewTCPEndpoint(t)
+	defer consumer.Stop()
+	r := newRig(t, consumer.Spec("shadow=true", "dl_type=0x888e"))
+	defer r.close()
+	r.app.api.PromoteEndpoint = func(id string) (interface{}, bool, error) {
+		info, err := r.app.promoteEndpoint(id)
+		return info, info != nil, err
+	}
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		r.app.api.ServeHTTP(resp, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return resp
+	}
+	device, _, _ := r.connect(0x1, 0)
+	defer device.Close()
+
+	// The shadow end point counts the packet in, but delivers nothing
+	device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64))
+	deadline := time.Now().Add(harness.Timeout)
+	for r.app.endpointList()[0].Matches != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if list := r.app.endpointList(); list[0].Matches != 1 || consumer.Connections() != 0 {
+		t.Fatalf("Expected the packet in counted by the shadow, got %+v, %d connections", list, consumer.Connections())
+	}
+
+	// Once promoted it keeps its ID and criteria, and delivers
+	resp := serve("PATCH", "/oftee/endpoints/1", `{"shadow": false}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Incorrect response code, expected 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	var info EndpointInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != "1" || info.Spec != "dl_type=0x888e;action=tcp://"+consumer.Addr() {
+		t.Errorf("Expected the end point promoted as 1, got %+v", info)
+	}
+	device.SendPacketIn(2, harness.EthernetFrame(0x0806, 64))
+	delivered := device.SendPacketIn(3, harness.EthernetFrame(0x888e, 64))
+	consumer.Frames.ExpectFrames(t, harness.FrameOf(0x1, 3, delivered))
+
+	// Only a shadow end point, that exists, can be promoted, and only the
+	// shadow term can be changed
+	for _, test := range []struct {
+		path, body string
+		code       int
+	}{
+		{"/oftee/endpoints/1", `{"shadow": false}`, http.StatusBadRequest},
+		{"/oftee/endpoints/2", `{"shadow": false}`, http.StatusNotFound},
+		{"/oftee/endpoints/1", `{"shadow": true}`, http.StatusBadRequest},
+		{"/oftee/endpoints/1", `{"shadow": false, "dl_type": "arp"}`, http.StatusBadRequest},
+	} {
+		if resp := serve("PATCH", test.path, test.body); resp.Code != test.code {
+			t.Errorf("Incorrect response code for %s %s, expected %d, got %d", test.path, test.body, test.code, resp.Code)
+		}
+	}
+}
+
+func TestHTTPSEndpointClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oftee-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = generateCertificates([]string{"127.0.0.1"}, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	caPEM, err := ioutil.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The collector only accepts clients with a certificate signed by the
+	// CA, and posts with the authorization header
+	authorized := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		authorized <- req.Header.Get("Authorization")
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	app := &App{Config: Config{
+		LazyEndpoints: true,
+		TeeTo:         []string{"header=Authorization:Bearer%20abc;action=" + server.URL + "/pkt"},
+		HTTPCAFile:    filepath.Join(dir, "ca.crt"),
+		HTTPCertFile:  filepath.Join(dir, "controller-client.crt"),
+		HTTPKeyFile:   filepath.Join(dir, "controller-client.key"),
+	}}
+	endpoints, err := app.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go endpoints[0].ListenAndSend()
+	defer endpoints.Close()
+	endpoints[0].GetQueue() <- []byte("packet in")
+	select {
+	case header := <-authorized:
+		if header != "Bearer abc" {
+			t.Errorf("Expected the authorization header sent, got '%s'", header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the message posted to the collector")
+	}
+
+	// A client certificate without its key is rejected
+	app.HTTPKeyFile = ""
+	if _, err = app.EstablishEndpointConnections(); err == nil {
+		t.Error("Expected a client certificate without a key to be rejected")
+	}
+}
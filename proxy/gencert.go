@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Validity of generated certificates
+const (
+	// GenCertCAValidity validity of the generated certificate authority
+	GenCertCAValidity = 10 * 365 * 24 * time.Hour
+
+	// GenCertValidity validity of the generated server and client
+	// certificates
+	GenCertValidity = 365 * 24 * time.Hour
+)
+
+// certificate is a generated certificate and its private key
+type certificate struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+// certUse describes a certificate generated, signed by the CA, for lab TLS
+type certUse struct {
+	name  string
+	usage x509.ExtKeyUsage
+}
+
+// certUses the certificates generated, in addition to the CA
+var certUses = []certUse{
+	// Presented to devices by the device listener, LISTEN_ON
+	{"server", x509.ExtKeyUsageServerAuth},
+
+	// For the APIs, API_ON and GRPC_LISTEN_ON, which oftee serves without
+	// TLS, so that no setting uses it
+	{"api", x509.ExtKeyUsageServerAuth},
+
+	// Presented to the SDN controller and HTTPS end points
+	{"controller-client", x509.ExtKeyUsageClientAuth},
+}
+
+// newCertificate generates a key and a certificate for it, signed by the
+// given parent or self signed if the parent is nil
+func newCertificate(template *x509.Certificate, parent *certificate) (*certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128)); err != nil {
+		return nil, err
+	}
+	signer, signerCert := key, template
+	if parent != nil {
+		signer, signerCert = parent.key, parent.cert
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &certificate{cert: cert, der: der, key: key}, nil
+}
+
+// writePEM writes the certificate to `name.crt` and its key to `name.key`,
+// which is only readable by the owner. Existing files are not overwritten
+// unless force is set.
+func (c *certificate) writePEM(dir, name string, force bool) error {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		return err
+	}
+	for _, file := range []struct {
+		name  string
+		mode  os.FileMode
+		block *pem.Block
+	}{
+		{name + ".crt", 0644, &pem.Block{Type: "CERTIFICATE", Bytes: c.der}},
+		{name + ".key", 0600, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}},
+	} {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if force {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+		f, err := os.OpenFile(filepath.Join(dir, file.name), flags, file.mode)
+		if err != nil {
+			return err
+		}
+		if err = pem.Encode(f, file.block); err != nil {
+			f.Close()
+			return err
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateCertificates generates a CA and the certificates, signed by the CA,
+// for the given hosts, which may be DNS names or IP addresses, into a
+// directory
+func generateCertificates(hosts []string, dir string, force bool) error {
+	if len(hosts) == 0 {
+		return errors.New("at least one host must be specified")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	now := time.Now().Add(-time.Hour)
+	ca, err := newCertificate(&x509.Certificate{
+		Subject:               pkix.Name{Organization: []string{"oftee lab"}, CommonName: "oftee lab CA"},
+		NotBefore:             now,
+		NotAfter:              now.Add(GenCertCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if err = ca.writePEM(dir, "ca", force); err != nil {
+		return err
+	}
+
+	for _, use := range certUses {
+		template := &x509.Certificate{
+			Subject:     pkix.Name{Organization: []string{"oftee lab"}, CommonName: hosts[0]},
+			NotBefore:   now,
+			NotAfter:    now.Add(GenCertValidity),
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{use.usage},
+		}
+		if use.usage == x509.ExtKeyUsageClientAuth {
+			template.Subject.CommonName = "oftee"
+		}
+		for _, host := range hosts {
+			if ip := net.ParseIP(host); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, host)
+			}
+		}
+		cert, err := newCertificate(template, ca)
+		if err != nil {
+			return err
+		}
+		if err = cert.writePEM(dir, use.name, force); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GenCert implements the `gencert` sub-command, which generates the
+// certificates for a lab TLS setup, and returns the exit code
+func GenCert(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("gencert", flag.ContinueOnError)
+	flags.SetOutput(out)
+	hosts := flags.String("host", "localhost,127.0.0.1", "comma separated DNS names and IP addresses of the oftee host")
+	dir := flags.String("out-dir", "certs", "directory into which to write the certificates and keys")
+	force := flags.Bool("force", false, "overwrite existing certificates and keys")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var names []string
+	for _, host := range strings.Split(*hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			names = append(names, host)
+		}
+	}
+	if err := generateCertificates(names, *dir, *force); err != nil {
+		fmt.Fprintf(out, "Unable to generate certificates: %s\n", err)
+		return 1
+	}
+
+	abs, err := filepath.Abs(*dir)
+	if err != nil {
+		fmt.Fprintf(out, "Unable to resolve the certificate directory: %s\n", err)
+		return 1
+	}
+	path := func(name string) string {
+		return shellQuote(filepath.Join(abs, name))
+	}
+	fmt.Fprintf(out, "Generated lab certificates for %s, valid for %d days, in %s, used by the settings:\n",
+		strings.Join(names, ", "), int(GenCertValidity.Hours()/24), abs)
+	for _, setting := range []struct{ name, value string }{
+		{"LISTEN_CERT_FILE", path("server.crt")},
+		{"LISTEN_KEY_FILE", path("server.key")},
+		{"LISTEN_CA_FILE", path("ca.crt")},
+		{"LISTEN_CLIENT_AUTH", "true"},
+		{"CONTROLLER_CA_FILE", path("ca.crt")},
+		{"CONTROLLER_CERT_FILE", path("controller-client.crt")},
+		{"CONTROLLER_KEY_FILE", path("controller-client.key")},
+		{"HTTP_CA_FILE", path("ca.crt")},
+		{"HTTP_CERT_FILE", path("controller-client.crt")},
+		{"HTTP_KEY_FILE", path("controller-client.key")},
+	} {
+		fmt.Fprintf(out, "%s=%s\n", setting.name, setting.value)
+	}
+	return 0
+}
+
+// shellQuote quotes a value for a shell, or an environment file, if it has
+// characters that need to be
+func shellQuote(value string) string {
+	if value != "" && strings.Trim(value, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-./:,@+=") == "" {
+		return value
+	}
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oftee-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if code := GenCert([]string{"--host", "oftee.lab,10.0.0.1", "--out-dir", dir}, ioutil.Discard); code != 0 {
+		t.Fatalf("Expected gencert to succeed, got exit code %d", code)
+	}
+
+	caPEM, err := ioutil.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatal("Unable to parse generated CA certificate")
+	}
+	load := func(name string) tls.Certificate {
+		pair, err := tls.LoadX509KeyPair(filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			t.Fatal(err)
+		}
+		return pair
+	}
+
+	// The server certificates verify for each host
+	for _, name := range []string{"server", "api"} {
+		leaf := load(name).Leaf
+		for _, host := range []string{"oftee.lab", "10.0.0.1"} {
+			if _, err = leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+				t.Errorf("Certificate '%s' does not verify for '%s': %v", name, host, err)
+			}
+		}
+	}
+	client := load("controller-client")
+	if _, err = client.Leaf.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		t.Errorf("Client certificate does not verify: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "server.key")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected key to only be readable by its owner, got %v", info.Mode())
+	}
+
+	// A mutually authenticated TLS connection can be established
+	serverConn, clientConn := net.Pipe()
+	server := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{load("server")},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Handshake()
+	}()
+	if err = tls.Client(clientConn, &tls.Config{
+		Certificates: []tls.Certificate{client},
+		RootCAs:      roots,
+		ServerName:   "oftee.lab",
+	}).Handshake(); err != nil {
+		t.Errorf("Client handshake failed: %v", err)
+	}
+	if err = <-done; err != nil {
+		t.Errorf("Server handshake failed: %v", err)
+	}
+
+	// Existing certificates are only overwritten when forced
+	if code := GenCert([]string{"--host", "oftee.lab", "--out-dir", dir}, ioutil.Discard); code == 0 {
+		t.Error("Expected gencert to refuse to overwrite certificates")
+	}
+	out := &bytes.Buffer{}
+	if code := GenCert([]string{"--host", "oftee.lab", "--out-dir", dir, "--force"}, out); code != 0 {
+		t.Errorf("Expected forced gencert to succeed, got exit code %d", code)
+	}
+
+	// The settings that use the certificates are printed as assignments
+	settings := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n")[1:] {
+		if equals := strings.Index(line, "="); equals > 0 {
+			settings[line[:equals]] = line[equals+1:]
+		}
+	}
+	for name, file := range map[string]string{
+		"LISTEN_CERT_FILE":     "server.crt",
+		"LISTEN_KEY_FILE":      "server.key",
+		"LISTEN_CA_FILE":       "ca.crt",
+		"CONTROLLER_CA_FILE":   "ca.crt",
+		"CONTROLLER_CERT_FILE": "controller-client.crt",
+		"CONTROLLER_KEY_FILE":  "controller-client.key",
+		"HTTP_CA_FILE":         "ca.crt",
+		"HTTP_CERT_FILE":       "controller-client.crt",
+		"HTTP_KEY_FILE":        "controller-client.key",
+	} {
+		if settings[name] != filepath.Join(dir, file) {
+			t.Errorf("Expected %s=%s, got '%s'", name, filepath.Join(dir, file), settings[name])
+		}
+	}
+	if len(settings) != 10 || settings["LISTEN_CLIENT_AUTH"] != "true" {
+		t.Errorf("Expected 10 settings, with LISTEN_CLIENT_AUTH=true, got %v", settings)
+	}
+	if quoted := shellQuote("/tmp/lab certs/it's.crt"); quoted != `'/tmp/lab certs/it'\''s.crt'` {
+		t.Errorf("Expected the path quoted, got %s", quoted)
+	}
+}
@@ -0,0 +1,1185 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/api"
+	"github.com/ciena/oftee/connections"
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/datapath"
+	"github.com/ciena/oftee/events"
+	"github.com/ciena/oftee/internal/harness"
+	"github.com/google/gopacket/pcapgo"
+	of "github.com/netrack/openflow"
+	"github.com/netrack/openflow/ofp"
+	"golang.org/x/net/websocket"
+)
+
+// rig an oftee instance, proxying to a fake SDN controller and tee-ing to the
+// given end points, to which fake switches connect
+type rig struct {
+	t          *testing.T
+	app        *App
+	controller *harness.Controller
+}
+
+// newRig starts an instance that tees to the end points with the given
+// specifications, the connections to which are shared by the devices
+func newRig(t *testing.T, teeTo ...string) *rig {
+	controller := harness.NewController(t)
+	app := &App{Config: Config{ProxyTo: controller.Addr(), TeeTo: teeTo, ShareConnections: true}}
+	app.api = api.NewAPI(":0", "", "")
+	app.api.Start()
+	endpoints, err := app.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatalf("Unable to establish end points: %v", err)
+	}
+	app.setEndpoints(endpoints)
+	return &rig{t: t, app: app, controller: controller}
+}
+
+// connect connects a switch, with the given DPID, and completes the
+// handshake, returning the switch and the controller's recorder for its
+// connection, which is the n-th accepted
+func (r *rig) connect(dpid uint64, n int) (*harness.Switch, *harness.Recorder, chan error) {
+	return r.connectContext(context.Background(), dpid, n)
+}
+
+// connectContext connects a switch as `connect` does, whose connection is
+// handled within the given context
+func (r *rig) connectContext(ctx context.Context, dpid uint64, n int) (*harness.Switch, *harness.Recorder, chan error) {
+	device, conn := harness.NewSwitch(r.t)
+	done := make(chan error, 1)
+	go func() {
+		done <- r.app.handle(ctx, conn, r.app.sharedEndpoints())
+	}()
+	controller := r.controller.Conn(n)
+	features := device.SendFeatures(dpid)
+	controller.ExpectMessages(r.t, features)
+	return device, controller, done
+}
+
+// close stops the instance's fakes
+func (r *rig) close() {
+	r.controller.Close()
+}
+
+func TestIntegrationPacketInMatching(t *testing.T) {
+	eapol := harness.NewTCPEndpoint(t)
+	defer eapol.Stop()
+	arp := harness.NewHTTPEndpoint(t)
+	defer arp.Close()
+	r := newRig(t, eapol.Spec("dl_type=0x888e"), arp.Spec("dl_type=0x0806"))
+	defer r.close()
+	device, controller, _ := r.connect(0x1, 0)
+	defer device.Close()
+
+	features := controller.Messages()[0]
+	sent := []harness.Message{
+		device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64)),
+		device.SendPacketIn(2, harness.EthernetFrame(0x0806, 64)),
+		device.SendPacketIn(3, harness.EthernetFrame(0x88cc, 64)),
+		device.SendPacketIn(4, harness.EthernetFrame(0x888e, 64)),
+	}
+
+	// Every packet in is proxied to the controller, in order, and only
+	// those that match are tee-ed
+	controller.ExpectMessages(t, append([]harness.Message{features}, sent...)...)
+	eapol.Frames.ExpectFrames(t, harness.FrameOf(0x1, 1, sent[0]), harness.FrameOf(0x1, 4, sent[3]))
+	arp.Frames.ExpectFrames(t, harness.FrameOf(0x1, 2, sent[1]))
+}
+
+func TestIntegrationJumboPacketIns(t *testing.T) {
+	eapol := harness.NewTCPEndpoint(t)
+	defer eapol.Stop()
+	r := newRig(t, eapol.Spec("dl_type=0x888e"))
+	defer r.close()
+	r.app.BufferSize = MinReadBufferSize
+	device, controller, _ := r.connect(0x1, 0)
+	defer device.Close()
+
+	// Packet ins larger than the pooled buffers are neither truncated
+	// nor corrupted by those that follow them
+	features := controller.Messages()[0]
+	sent := []harness.Message{
+		device.SendPacketIn(1, harness.EthernetFrame(0x888e, 9000)),
+		device.SendPacketIn(2, harness.EthernetFrame(0x888e, 64)),
+		device.SendPacketIn(3, harness.EthernetFrame(0x888e, 9000)),
+	}
+	controller.ExpectMessages(t, append([]harness.Message{features}, sent...)...)
+	eapol.Frames.ExpectFrames(t,
+		harness.FrameOf(0x1, 1, sent[0]),
+		harness.FrameOf(0x1, 2, sent[1]),
+		harness.FrameOf(0x1, 3, sent[2]))
+	waitFor(t, "message buffers returned to the pool", func() bool {
+		return buffers.Stats().PacketBufferBytes == 0
+	})
+}
+
+func TestIntegrationInPortMatching(t *testing.T) {
+	nni := harness.NewTCPEndpoint(t)
+	defer nni.Stop()
+	uni := harness.NewTCPEndpoint(t)
+	defer uni.Stop()
+	r := newRig(t, nni.Spec("in_port=32"), uni.Spec("in_port=1-16"))
+	defer r.close()
+	device, controller, _ := r.connect(0x1, 0)
+	defer device.Close()
+
+	features := controller.Messages()[0]
+	sent := []harness.Message{
+		device.SendPacketIn(32, harness.EthernetFrame(0x888e, 64)),
+		device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64)),
+		device.SendPacketIn(17, harness.EthernetFrame(0x888e, 64)),
+		device.SendPacketIn(16, harness.EthernetFrame(0x888e, 64)),
+	}
+
+	// Each packet in is tee-ed by the port on which it was received
+	controller.ExpectMessages(t, append([]harness.Message{features}, sent...)...)
+	nni.Frames.ExpectFrames(t, harness.FrameOf(0x1, 32, sent[0]))
+	uni.Frames.ExpectFrames(t, harness.FrameOf(0x1, 1, sent[1]), harness.FrameOf(0x1, 16, sent[3]))
+}
+
+func TestIntegrationDPIDMatching(t *testing.T) {
+	scoped := harness.NewTCPEndpoint(t)
+	defer scoped.Stop()
+	all := harness.NewTCPEndpoint(t)
+	defer all.Stop()
+	r := newRig(t, scoped.Spec("dpid=0x2"), all.Spec())
+	defer r.close()
+	first, firstController, _ := r.connect(0x1, 0)
+	defer first.Close()
+	second, secondController, _ := r.connect(0x2, 1)
+	defer second.Close()
+
+	fromFirst := first.SendPacketIn(1, harness.EthernetFrame(0x888e, 64))
+	firstController.ExpectMessages(t, firstController.Messages()[0], fromFirst)
+	fromSecond := second.SendPacketIn(1, harness.EthernetFrame(0x888e, 64))
+	secondController.ExpectMessages(t, secondController.Messages()[0], fromSecond)
+
+	// Only the packet in from the device with the DPID of the end point is
+	// tee-ed to it, while both are tee-ed to the end point without one
+	scoped.Frames.ExpectFrames(t, harness.FrameOf(0x2, 1, fromSecond))
+	all.Frames.ExpectFrames(t, harness.FrameOf(0x1, 1, fromFirst), harness.FrameOf(0x2, 1, fromSecond))
+}
+
+func TestIntegrationGRPCEndpoint(t *testing.T) {
+	endpoint := harness.NewGRPCEndpoint(t)
+	defer endpoint.Stop()
+	r := newRig(t, endpoint.Spec("dl_type=0x888e"))
+	defer r.close()
+	device, controller, _ := r.connect(0x1, 0)
+	defer device.Close()
+
+	features := controller.Messages()[0]
+	sent := []harness.Message{
+		device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64)),
+		device.SendPacketIn(2, harness.EthernetFrame(0x0806, 64)),
+		device.SendPacketIn(3, harness.EthernetFrame(0x888e, 64)),
+	}
+
+	// The matched packet ins are streamed, each with its DPID and port
+	controller.ExpectMessages(t, append([]harness.Message{features}, sent...)...)
+	endpoint.Frames.ExpectFrames(t, harness.FrameOf(0x1, 1, sent[0]), harness.FrameOf(0x1, 3, sent[2]))
+}
+
+func TestIntegrationPcapEndpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "oftee", "eapol.pcap")
+	r := newRig(t, "pcap://"+path+";dl_type=0x888e")
+	defer r.close()
+	device, controller, _ := r.connect(0x1, 0)
+	defer device.Close()
+
+	features := controller.Messages()[0]
+	eapol := harness.EthernetFrame(0x888e, 64)
+	sent := []harness.Message{
+		device.SendPacketIn(1, eapol),
+		device.SendPacketIn(2, harness.EthernetFrame(0x0806, 64)),
+	}
+	controller.ExpectMessages(t, append([]harness.Message{features}, sent...)...)
+
+	// Only the frame of the matched packet in is written, once flushed
+	waitFor(t, "the packet in written", func() bool {
+		stats, ok := r.app.sharedEndpoints()[0].(connections.StatsConnection)
+		return ok && stats.Stats().Matches == 1
+	})
+	if err = r.app.sharedEndpoints().Close(); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := pcapgo.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _, err := reader.ReadPacketData(); err != nil || !bytes.Equal(data, eapol) {
+		t.Errorf("Expected the EAPOL frame written, got %02x (%v)", data, err)
+	}
+	if _, _, err = reader.ReadPacketData(); err != io.EOF {
+		t.Errorf("Expected only the EAPOL frame written, got %v", err)
+	}
+}
+
+func TestIntegrationStream(t *testing.T) {
+	r := newRig(t)
+	defer r.close()
+	device, controller, _ := r.connect(0x1, 0)
+	defer device.Close()
+	waitFor(t, "the device to be known to the API", func() bool {
+		return httpGet(t, r.app.api, "/oftee/0x1").Code == http.StatusOK
+	})
+
+	server := httptest.NewServer(r.app.api)
+	defer server.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/oftee/0x1/stream?dl_type=0x888e", "", server.URL)
+	if err != nil {
+		t.Fatalf("Unable to stream packet ins: %v", err)
+	}
+	defer ws.Close()
+	waitFor(t, "the stream to be subscribed", r.app.api.Streaming)
+
+	features := controller.Messages()[0]
+	sent := []harness.Message{
+		device.SendPacketIn(1, harness.EthernetFrame(0x0806, 64)),
+		device.SendPacketIn(2, harness.EthernetFrame(0x888e, 64)),
+	}
+
+	// Only the matched packet in is streamed, with its context, without
+	// any end point
+	controller.ExpectMessages(t, append([]harness.Message{features}, sent...)...)
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var message []byte
+	if err = websocket.Message.Receive(ws, &message); err != nil {
+		t.Fatalf("Unable to receive streamed packet in: %v", err)
+	}
+	frame, err := harness.ReadFrame(bytes.NewReader(message))
+	if err != nil || frame.DPID != 0x1 || frame.Port != 2 || !bytes.Equal(frame.Message.Raw, sent[1].Raw) {
+		t.Errorf("Expected %s streamed, got %s (%v)", harness.FrameOf(0x1, 2, sent[1]), frame, err)
+	}
+}
+
+func TestIntegrationThrottledEndpoints(t *testing.T) {
+	sampled := harness.NewTCPEndpoint(t)
+	defer sampled.Stop()
+	limited := harness.NewTCPEndpoint(t)
+	defer limited.Stop()
+	r := newRig(t, sampled.Spec("sample=2"), limited.Spec("rate=1"))
+	defer r.close()
+	device, controller, _ := r.connect(0x1, 0)
+	defer device.Close()
+
+	features := controller.Messages()[0]
+	sent := []harness.Message{
+		device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64)),
+		device.SendPacketIn(2, harness.EthernetFrame(0x888e, 64)),
+		device.SendPacketIn(3, harness.EthernetFrame(0x888e, 64)),
+		device.SendPacketIn(4, harness.EthernetFrame(0x888e, 64)),
+	}
+
+	// Every packet in is proxied to the controller, only the tee-ed
+	// copies are sampled and rate limited
+	controller.ExpectMessages(t, append([]harness.Message{features}, sent...)...)
+	sampled.Frames.ExpectFrames(t, harness.FrameOf(0x1, 1, sent[0]), harness.FrameOf(0x1, 3, sent[2]))
+	limited.Frames.ExpectFrames(t, harness.FrameOf(0x1, 1, sent[0]))
+	waitFor(t, "2 packet ins dropped by sampling and 3 by rate", func() bool {
+		stats := r.app.sharedEndpoints().Stats()
+		return stats[0].SampleDropped == 2 && stats[1].RateDropped == 3
+	})
+}
+
+// vlanFrame builds an 802.1Q tagged IPv4 frame with the given VLAN ID
+func vlanFrame(vlan uint16) []byte {
+	return taggedFrame(0x0800, 0x8100, vlan)
+}
+
+// taggedFrame builds an Ethernet frame of the given type behind VLAN tags,
+// the outermost first, each a tag protocol identifier followed by a VLAN ID
+func taggedFrame(dlType uint16, tags ...uint16) []byte {
+	frame := harness.EthernetFrame(tags[0], 64)
+	offset := 14
+	for i := 1; i < len(tags); i += 2 {
+		binary.BigEndian.PutUint16(frame[offset:], tags[i])
+		next := dlType
+		if i+1 < len(tags) {
+			next = tags[i+1]
+		}
+		binary.BigEndian.PutUint16(frame[offset+2:], next)
+		offset += 4
+	}
+	return frame
+}
+
+func TestIntegrationVlanMatching(t *testing.T) {
+	tagged := harness.NewTCPEndpoint(t)
+	defer tagged.Stop()
+	all := harness.NewTCPEndpoint(t)
+	defer all.Stop()
+	r := newRig(t, tagged.Spec("dl_type=ipv4", "dl_vlan=1000"), all.Spec())
+	defer r.close()
+	device, _, _ := r.connect(0x1, 0)
+	defer device.Close()
+
+	sent := []harness.Message{
+		device.SendPacketIn(1, vlanFrame(1000)),
+		device.SendPacketIn(2, vlanFrame(2000)),
+		device.SendPacketIn(3, harness.EthernetFrame(0x0800, 64)),
+	}
+
+	// Only the packet in tagged with the VLAN ID matches, untagged packets
+	// only match end points without a dl_vlan condition
+	all.Frames.ExpectFrames(t, harness.FrameOf(0x1, 1, sent[0]), harness.FrameOf(0x1, 2, sent[1]),
+		harness.FrameOf(0x1, 3, sent[2]))
+	tagged.Frames.ExpectFrames(t, harness.FrameOf(0x1, 1, sent[0]))
+}
+
+// ipv4Frame builds an IPv4 frame carrying the given protocol between the
+// given addresses
+func ipv4Frame(proto uint8, src, dst string) []byte {
+	frame := harness.EthernetFrame(0x0800, 64)
+	frame[14], frame[23] = 0x45, proto
+	copy(frame[26:], net.ParseIP(src).To4())
+	copy(frame[30:], net.ParseIP(dst).To4())
+	return frame
+}
+
+func TestIntegrationDLAddrMatching(t *testing.T) {
+	reserved := harness.NewTCPEndpoint(t)
+	defer reserved.Stop()
+	host := harness.NewTCPEndpoint(t)
+	defer host.Stop()
+	r := newRig(t, reserved.Spec("dl_dst=01:80:c2:00:00:00/ff:ff:ff:ff:ff:f0"),
+		host.Spec("dl_src=00:00:00:00:00:02"))
+	defer r.close()
+	device, _, _ := r.connect(0x1, 0)
+	defer device.Close()
+
+	lldp := harness.EthernetFrame(0x88cc, 64)
+	lldp[5] = 0x0e
+	unicast := harness.EthernetFrame(0x0800, 64)
+	copy(unicast, []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02})
+	sent := []harness.Message{
+		device.SendPacketIn(1, lldp),
+		device.SendPacketIn(2, unicast),
+	}
+
+	// The reserved multicast addresses match under the mask
+	reserved.Frames.ExpectFrames(t, harness.FrameOf(0x1, 1, sent[0]))
+	host.Frames.ExpectFrames(t, harness.FrameOf(0x1, 2, sent[1]))
+}
+
+func TestIntegrationNetworkMatching(t *testing.T) {
+	dhcp := harness.NewTCPEndpoint(t)
+	defer dhcp.Stop()
+	igmp := harness.NewTCPEndpoint(t)
+	defer igmp.Stop()
+	r := newRig(t, dhcp.Spec("dl_type=ipv4", "nw_proto=udp", "nw_dst=255.255.255.255/32"),
+		igmp.Spec("nw_proto=igmp", "nw_src=192.168.0.0/16"))
+	defer r.close()
+	device, _, _ := r.connect(0x1, 0)
+	defer device.Close()
+
+	sent := []harness.Message{
+		device.SendPacketIn(1, ipv4Frame(17, "0.0.0.0", "255.255.255.255")),
+		device.SendPacketIn(2, ipv4Frame(17, "0.0.0.0", "10.0.0.1")),
+		device.SendPacketIn(3, ipv4Frame(2, "192.168.1.10", "224.0.0.251")),
+		device.SendPacketIn(4, ipv4Frame(2, "10.0.0.2", "224.0.0.251")),
+		device.SendPacketIn(5, ipv4Frame(6, "192.168.1.10", "255.255.255.255")),
+	}
+
+	// Only the protocols and addresses within the prefixes match
+	dhcp.Frames.ExpectFrames(t, harness.FrameOf(0x1, 1, sent[0]))
+	igmp.Frames.ExpectFrames(t, harness.FrameOf(0x1, 3, sent[2]))
+}
+
+func TestIntegrationTransportMatching(t *testing.T) {
+	dns := harness.NewTCPEndpoint(t)
+	defer dns.Stop()
+	r := newRig(t, dns.Spec("nw_proto=udp", "tp_dst=53"))
+	defer r.close()
+	device, _, _ := r.connect(0x1, 0)
+	defer device.Close()
+
+	query := ipv4Frame(17, "10.0.0.2", "10.0.0.1")
+	binary.BigEndian.PutUint16(query[34:], 33000)
+	binary.BigEndian.PutUint16(query[36:], 53)
+	reply := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(reply[34:], 53)
+	binary.BigEndian.PutUint16(reply[36:], 33000)
+	sent := []harness.Message{
+		device.SendPacketIn(1, reply),
+		device.SendPacketIn(2, query[:36]),
+		device.SendPacketIn(3, query),
+	}
+
+	// A query truncated by the switch before its ports never matches
+	dns.Frames.ExpectFrames(t, harness.FrameOf(0x1, 3, sent[2]))
+}
+
+func TestIntegrationAlternativeMatching(t *testing.T) {
+	collector := harness.NewTCPEndpoint(t)
+	defer collector.Stop()
+	r := newRig(t, collector.Spec("dl_type=arp|dl_type=ipv4,nw_proto=udp,tp_dst=67"))
+	defer r.close()
+	device, _, _ := r.connect(0x1, 0)
+	defer device.Close()
+
+	request := ipv4Frame(17, "0.0.0.0", "255.255.255.255")
+	binary.BigEndian.PutUint16(request[34:], 68)
+	binary.BigEndian.PutUint16(request[36:], 67)
+	query := append([]byte(nil), request...)
+	binary.BigEndian.PutUint16(query[36:], 53)
+	sent := []harness.Message{
+		device.SendPacketIn(1, harness.EthernetFrame(0x0806, 64)),
+		device.SendPacketIn(2, query),
+		device.SendPacketIn(3, request),
+		device.SendPacketIn(4, harness.EthernetFrame(0x88cc, 64)),
+	}
+
+	// A single connection receives the packets of either alternative
+	collector.Frames.ExpectFrames(t, harness.FrameOf(0x1, 1, sent[0]), harness.FrameOf(0x1, 3, sent[2]))
+}
+
+func TestIntegrationTaggedEthernetType(t *testing.T) {
+	eapol := harness.NewTCPEndpoint(t)
+	defer eapol.Stop()
+	arp := harness.NewTCPEndpoint(t)
+	defer arp.Stop()
+	vlan := harness.NewTCPEndpoint(t)
+	defer vlan.Stop()
+	r := newRig(t, eapol.Spec("dl_type=eapol"), arp.Spec("dl_type=arp"), vlan.Spec("dl_type=vlan"))
+	defer r.close()
+	device, _, _ := r.connect(0x1, 0)
+	defer device.Close()
+
+	sent := []harness.Message{
+		device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64)),
+		device.SendPacketIn(2, taggedFrame(0x888e, 0x8100, 100)),
+		device.SendPacketIn(3, taggedFrame(0x888e, 0x88a8, 10, 0x8100, 100)),
+		device.SendPacketIn(4, taggedFrame(0x0806, 0x8100, 100)),
+		device.SendPacketIn(5, taggedFrame(0x0806, 0x8100, 10, 0x8100, 100)),
+	}
+
+	// Single and double tagged packets are matched by the Ethernet type
+	// they encapsulate, never by that of their tags
+	eapol.Frames.ExpectFrames(t, harness.FrameOf(0x1, 1, sent[0]), harness.FrameOf(0x1, 2, sent[1]),
+		harness.FrameOf(0x1, 3, sent[2]))
+	arp.Frames.ExpectFrames(t, harness.FrameOf(0x1, 4, sent[3]), harness.FrameOf(0x1, 5, sent[4]))
+	vlan.Frames.ExpectFrames(t)
+}
+
+func TestIntegrationCompareGroup(t *testing.T) {
+	old := harness.NewTCPEndpoint(t)
+	defer old.Stop()
+	replacement := harness.NewTCPEndpoint(t)
+	defer replacement.Stop()
+
+	// The replacement deliberately drops ARP packets
+	r := newRig(t, old.Spec("compare_group=migration"), replacement.Spec("compare_group=migration", "dl_type=eapol"))
+	defer r.close()
+	device, _, _ := r.connect(0x1, 0)
+	defer device.Close()
+	for i := uint32(1); i <= 10; i++ {
+		dlType := uint16(0x888e)
+		if i%4 == 0 {
+			dlType = 0x0806
+		}
+		device.SendPacketIn(i, harness.EthernetFrame(dlType, 64))
+	}
+	old.Frames.WaitFrames(t, 10)
+	replacement.Frames.WaitFrames(t, 8)
+
+	// Once the tolerance expires, the dropped packets are divergent
+	waitFor(t, "messages to be compared", func() bool {
+		stats := r.app.compareGroups.Stats()
+		return len(stats) == 1 && stats[0].Waiting == 0
+	})
+	if stats := r.app.compareGroups.Stats()[0]; stats.Matched != 8 || stats.Divergent != 2 || stats.Members != 2 {
+		t.Errorf("Expected 8 messages matched and 2 divergent, got %+v", stats)
+	}
+	if stats := r.app.sharedEndpoints().Stats(); len(stats) != 2 || stats[1].Compare == nil || stats[1].Compare.Missed != 2 {
+		t.Errorf("Expected the replacement to have missed 2 messages, got %+v", stats)
+	}
+	gauges := r.app.compareGauges()
+	if len(gauges) != 3 || gauges[1].Name != "oftee_compare_divergent_messages" || gauges[1].Value != 2 ||
+		gauges[1].Labels["group"] != "migration" {
+		t.Errorf("Expected divergent messages metric, got %+v", gauges)
+	}
+}
+
+func TestIntegrationShortWrites(t *testing.T) {
+	consumer := harness.NewTCPEndpoint(t)
+	defer consumer.Stop()
+	r := newRig(t, consumer.Spec())
+	defer r.close()
+	device, controller, _ := r.connect(0x2, 0)
+	defer device.Close()
+
+	// Messages written in fragments, smaller than the OpenFlow header and
+	// larger than the minimum read buffer, are reassembled
+	var sent []harness.Message
+	for i, fragment := range []int{1, 7, 1000} {
+		device.Fragment = fragment
+		sent = append(sent, device.SendPacketIn(uint32(i+1), harness.EthernetFrame(0x0800, 1500)))
+	}
+	controller.WaitMessages(t, 1+len(sent))
+	controller.ExpectMessages(t, append(controller.Messages()[:1], sent...)...)
+	consumer.Frames.ExpectFrames(t,
+		harness.FrameOf(0x2, 1, sent[0]),
+		harness.FrameOf(0x2, 2, sent[1]),
+		harness.FrameOf(0x2, 3, sent[2]))
+}
+
+func TestIntegrationSharedEndpointFraming(t *testing.T) {
+	// The queue of the end point holds every message sent, so none is
+	// dropped while the end point falls behind
+	const count = 100
+	consumer := harness.NewTCPEndpoint(t)
+	defer consumer.Stop()
+	r := newRig(t, consumer.Spec(fmt.Sprintf("queue=%d", 2*count)))
+	defer r.close()
+
+	// Two device handlers tee packet ins, of differing sizes, to the end
+	// point they share at once, as `handle` does
+	dpids := []uint64{0x1, 0x2}
+	sent := make([][]harness.Message, len(dpids))
+	var wg sync.WaitGroup
+	for i, dpid := range dpids {
+		wg.Add(1)
+		go func(i int, dpid uint64) {
+			defer wg.Done()
+			endpoints := r.app.sharedEndpoints()
+			for n := 0; n < count; n++ {
+				m := harness.PacketIn(t, uint32(n+1), uint32(n), harness.EthernetFrame(0x0800, 64+(n*97)%1400))
+				buffer := &bytes.Buffer{}
+				ofContext := OpenFlowContext{DatapathID: dpid, Port: uint32(n)}
+				ofContext.WriteTo(buffer)
+				buffer.Write(m.Raw)
+				if _, err := endpoints.ConditionalWrite(context.Background(), buffer.Bytes(), criteria.Criteria{}); err != nil {
+					t.Error(err)
+					return
+				}
+				sent[i] = append(sent[i], m)
+			}
+		}(i, dpid)
+	}
+
+	// Each frame the end point receives is whole, and those of each device
+	// are in the order it sent them
+	frames := consumer.Frames.WaitFrames(t, len(dpids)*count)
+	wg.Wait()
+	received := make(map[uint64][]harness.Frame)
+	for _, frame := range frames {
+		received[frame.DPID] = append(received[frame.DPID], frame)
+	}
+	for i, messages := range sent {
+		dpid := dpids[i]
+		if len(received[dpid]) != len(messages) {
+			t.Fatalf("Expected %d frames from 0x%x, got %d", len(messages), dpid, len(received[dpid]))
+		}
+		for n, m := range messages {
+			if frame := received[dpid][n]; frame.Port != uint32(n) || !bytes.Equal(frame.Message.Raw, m.Raw) {
+				t.Errorf("Expected frame %s, got %s", harness.FrameOf(dpid, uint32(n), m), frame)
+			}
+		}
+	}
+}
+
+func TestIntegrationEndpointReconnect(t *testing.T) {
+	consumer := harness.NewTCPEndpoint(t)
+	defer consumer.Stop()
+	r := newRig(t, consumer.Spec())
+	defer r.close()
+	device, controller, _ := r.connect(0x3, 0)
+	defer device.Close()
+
+	first := device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64))
+	consumer.Frames.ExpectFrames(t, harness.FrameOf(0x3, 1, first))
+
+	// The end point drops its connection, the first write after may still
+	// succeed, so packet ins are sent until one is delivered over a new
+	// connection
+	consumer.DropConnections()
+	deadline := time.Now().Add(harness.Timeout)
+	sent := 1
+	for consumer.Connections() < 2 || len(consumer.Frames.Frames()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected end point reconnected, got %d connections, frames %v",
+				consumer.Connections(), consumer.Frames.Frames())
+		}
+		device.SendPacketIn(2, harness.EthernetFrame(0x888e, 64))
+		sent++
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// None of the packet ins are held back from the controller
+	messages := controller.WaitMessages(t, 1+sent)
+	for _, m := range messages[1:] {
+		if m.Type != of.TypePacketIn {
+			t.Errorf("Expected only packet ins proxied, got %v", messages)
+			break
+		}
+	}
+	frames := consumer.Frames.Frames()
+	if last := frames[len(frames)-1]; last.DPID != 0x3 || last.Port != 2 {
+		t.Errorf("Expected packet in delivered after reconnecting, got %v", frames)
+	}
+}
+
+func TestIntegrationControllerReconnect(t *testing.T) {
+	r := newRig(t)
+	r.app.ProxyBufferSize = 64 * 1024
+	defer r.close()
+	device, conn := harness.NewSwitch(t)
+	defer device.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- r.app.handle(context.Background(), conn, r.app.sharedEndpoints())
+	}()
+	controller := r.controller.Conn(0)
+	hello := device.Send(of.TypeHello, nil)
+	controller.ExpectMessages(t, hello, device.SendFeatures(0x4))
+
+	// Losing the controller doesn't disconnect the device, the connection
+	// to the controller is re-established and the device's hello written
+	// to it before the messages that follow
+	controller.Conn.Close()
+	controller = r.controller.Conn(1)
+	packetIn := device.SendPacketIn(1, harness.EthernetFrame(0x0806, 64))
+	controller.ExpectMessages(t, hello, packetIn)
+
+	// The controller's hello isn't written to the device, which completed
+	// its handshake, but the requests that follow are
+	request := harness.NewMessage(t, of.TypeFeaturesRequest, 7, nil)
+	controller.Conn.Write(append(harness.NewMessage(t, of.TypeHello, 6, nil).Raw, request.Raw...))
+	device.Received.ExpectMessages(t, request)
+	select {
+	case err := <-done:
+		t.Fatalf("Expected device to stay connected, disconnected: %v", err)
+	default:
+	}
+
+	// The reconnect is counted by the statistics of the session
+	waitFor(t, "the device to be known by the API", func() bool {
+		var device4 api.DeviceResponse
+		resp := httpGet(t, r.app.api, "/oftee/0x4")
+		return json.Unmarshal(resp.Body.Bytes(), &device4) == nil && device4.Connections == 1
+	})
+	r.app.api.Auth = "secret"
+	req := httptest.NewRequest("DELETE", "/oftee/0x4/connection", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp := httptest.NewRecorder()
+	r.app.api.ServeHTTP(resp, req)
+	var disconnected api.DisconnectResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &disconnected); err != nil || len(disconnected.Sessions) != 1 ||
+		disconnected.Sessions[0].ControllerReconnects != 1 || disconnected.Sessions[0].ControllerDropped != 0 {
+		t.Errorf("Expected a reconnect counted, got %s", resp.Body)
+	}
+}
+
+func TestIntegrationEchoLocal(t *testing.T) {
+	r := newRig(t)
+	r.app.EchoLocal = true
+	defer r.close()
+	device, conn := harness.NewSwitch(t)
+	defer device.Close()
+	go r.app.handle(context.Background(), conn, r.app.sharedEndpoints())
+	controller := r.controller.Conn(0)
+	hello := device.Send(of.TypeHello, nil)
+	features := device.SendFeatures(0x8)
+	controller.ExpectMessages(t, hello, features)
+
+	// While the controller is unreachable the device's echo requests are
+	// answered locally, with their transaction ID and payload
+	address := r.controller.Addr()
+	r.controller.Close()
+	waitFor(t, "the controller to be down", func() bool {
+		return !subsystemStatus(r.app, SubsystemController).Ready
+	})
+	device.Write(harness.NewMessage(t, of.TypeEchoRequest, 9, bytes.NewBufferString("ping")))
+	device.Received.ExpectMessages(t, harness.NewMessage(t, of.TypeEchoReply, 9, bytes.NewBufferString("ping")))
+
+	// Once the controller returns they are proxied to it again
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	returned, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer returned.Close()
+	if m, err := harness.ReadMessage(returned); err != nil || !bytes.Equal(m.Raw, hello.Raw) {
+		t.Fatalf("Expected the device's hello written to the returned controller, got %v (%v)", m, err)
+	}
+	waitFor(t, "the connection to the controller re-established", func() bool {
+		sessions := r.app.sessions.list()
+		return len(sessions) == 1 && sessions[0].Stats().ControllerReconnects == 1
+	})
+	echo := device.Write(harness.NewMessage(t, of.TypeEchoRequest, 10, bytes.NewBufferString("pong")))
+	returned.SetReadDeadline(time.Now().Add(harness.Timeout))
+	if m, err := harness.ReadMessage(returned); err != nil || !bytes.Equal(m.Raw, echo.Raw) {
+		t.Errorf("Expected the echo request proxied to the controller, got %v (%v)", m, err)
+	}
+	if n := len(device.Received.Messages()); n != 1 {
+		t.Errorf("Expected only the first echo answered locally, got %d messages", n)
+	}
+}
+
+func TestIntegrationMultipleControllers(t *testing.T) {
+	r := newRig(t)
+	defer r.close()
+	other := harness.NewController(t)
+	defer other.Close()
+	r.app.ProxyTo = r.controller.Addr() + ", " + other.Addr()
+	r.app.api.Readiness = r.app.readiness
+	device, conn := harness.NewSwitch(t)
+	defer device.Close()
+	go r.app.handle(context.Background(), conn, r.app.sharedEndpoints())
+
+	// Every message from the device is proxied to every controller
+	first, second := r.controller.Conn(0), other.Conn(0)
+	hello := device.Send(of.TypeHello, nil)
+	features := device.SendFeatures(0x6)
+	packetIn := device.SendPacketIn(1, harness.EthernetFrame(0x0806, 64))
+	first.ExpectMessages(t, hello, features, packetIn)
+	second.ExpectMessages(t, hello, features, packetIn)
+
+	// Only the first controller's hello is written to the device, the
+	// messages that follow from each are
+	firstHello := harness.NewMessage(t, of.TypeHello, 6, nil)
+	first.Conn.Write(firstHello.Raw)
+	device.Received.ExpectMessages(t, firstHello)
+	request := harness.NewMessage(t, of.TypeFeaturesRequest, 7, nil)
+	second.Conn.Write(append(harness.NewMessage(t, of.TypeHello, 8, nil).Raw, request.Raw...))
+	device.Received.ExpectMessages(t, firstHello, request)
+
+	// Losing one controller doesn't affect the other, and is reported by
+	// the readiness of each
+	second.Conn.Close()
+	first.ExpectMessages(t, hello, features, packetIn, device.SendPacketIn(2, harness.EthernetFrame(0x0806, 64)))
+	waitFor(t, "the lost controller reconnected", func() bool {
+		return other.Connections() == 2
+	})
+	other.Conn(1).ExpectMessages(t, hello)
+	var readiness Readiness
+	resp := httpGet(t, r.app.api, "/readyz")
+	if err := json.NewDecoder(resp.Body).Decode(&readiness); err != nil {
+		t.Fatal(err)
+	}
+	if len(readiness.Controllers) != 2 || readiness.Controllers[r.controller.Addr()] != StateUp {
+		t.Errorf("Expected the state of each controller, got %+v", readiness)
+	}
+}
+
+// failoverEvents an events target that records the controller failovers
+// offered to it
+type failoverEvents chan events.Event
+
+func (e failoverEvents) Accepts(eventType string) bool {
+	return eventType == events.TypeControllerFailover
+}
+
+func (e failoverEvents) Offer(event events.Event) {
+	e <- event
+}
+
+func TestIntegrationControllerFailover(t *testing.T) {
+	r := newRig(t)
+	defer r.close()
+	backup := harness.NewController(t)
+	defer backup.Close()
+	primaryAddr := r.controller.Addr()
+	r.app.ProxyTo, r.app.ProxyMode = primaryAddr+","+backup.Addr(), ProxyModeFailover
+	r.app.ProxyBufferSize = 64 * 1024
+	failovers := make(failoverEvents, 1)
+	r.app.notifier = &events.Notifier{Targets: []events.Target{failovers}}
+	device, conn := harness.NewSwitch(t)
+	defer device.Close()
+	go r.app.handle(context.Background(), conn, r.app.sharedEndpoints())
+
+	// Only the first controller is connected
+	hello := device.Send(of.TypeHello, nil)
+	features := device.SendFeatures(0x7)
+	r.controller.Conn(0).ExpectMessages(t, hello, features)
+	if n := backup.Connections(); n != 0 {
+		t.Errorf("Expected only the first controller connected, got %d connections to the backup", n)
+	}
+
+	// Once the first controller is lost the device fails over to the
+	// backup, to which its hello is written before the messages that follow
+	r.controller.Close()
+	controller := backup.Conn(0)
+	packetIn := device.SendPacketIn(1, harness.EthernetFrame(0x0806, 64))
+	controller.ExpectMessages(t, hello, packetIn)
+
+	// The backup's hello isn't written to the device, but the requests that
+	// follow, with which it completes its handshake, are
+	request := harness.NewMessage(t, of.TypeFeaturesRequest, 7, nil)
+	controller.Conn.Write(append(harness.NewMessage(t, of.TypeHello, 6, nil).Raw, request.Raw...))
+	device.Received.ExpectMessages(t, request)
+	reply := device.SendFeatures(0x7)
+	controller.ExpectMessages(t, hello, packetIn, reply)
+
+	// The failover is notified, and the controller that is active reported
+	// by the API
+	select {
+	case event := <-failovers:
+		if event.DPID != datapath.Format(0x7) || event.PreviousController != primaryAddr || event.Controller != backup.Addr() {
+			t.Errorf("Incorrect failover event, got %+v", event)
+		}
+	case <-time.After(harness.Timeout):
+		t.Fatal("Expected the failover notified")
+	}
+	var device7 api.DeviceResponse
+	resp := httpGet(t, r.app.api, "/oftee/0x7")
+	if err := json.Unmarshal(resp.Body.Bytes(), &device7); err != nil || device7.Controller != backup.Addr() {
+		t.Errorf("Expected the backup controller active, got %s", resp.Body)
+	}
+	if ready, _ := r.app.subsystems.Readiness(); !ready {
+		t.Errorf("Expected process ready while the backup controller is up, got %+v", subsystemStatus(r.app, SubsystemController))
+	}
+}
+
+func TestIntegrationSlowHTTPEndpoint(t *testing.T) {
+	slow := harness.NewHTTPEndpoint(t)
+	defer slow.Close()
+	slow.SetLatency(500 * time.Millisecond)
+	failing := harness.NewHTTPEndpoint(t)
+	defer failing.Close()
+	failing.SetStatus(http.StatusServiceUnavailable)
+	r := newRig(t, slow.Spec(), failing.Spec())
+	defer r.close()
+	device, controller, _ := r.connect(0x5, 0)
+	defer device.Close()
+
+	// Packet ins are proxied without waiting for the end points
+	start := time.Now()
+	var sent []harness.Message
+	for port := uint32(1); port <= 3; port++ {
+		sent = append(sent, device.SendPacketIn(port, harness.EthernetFrame(0x888e, 64)))
+	}
+	controller.WaitMessages(t, 1+len(sent))
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Errorf("Expected packet ins proxied without waiting for a slow end point, took %s", elapsed)
+	}
+	slow.Frames.ExpectFrames(t,
+		harness.FrameOf(0x5, 1, sent[0]),
+		harness.FrameOf(0x5, 2, sent[1]),
+		harness.FrameOf(0x5, 3, sent[2]))
+	if frames := failing.Frames.Frames(); len(frames) != 0 {
+		t.Errorf("Expected failed requests not recorded, got %v", frames)
+	}
+}
+
+func TestIntegrationMessageAPI(t *testing.T) {
+	r := newRig(t)
+	defer r.close()
+	r.app.api.MessageTypes, _ = api.ParseMessageTypes([]string{"meter_mod"})
+	device, controller, _ := r.connect(0x6, 0)
+	defer device.Close()
+	waitFor(t, "the device to be known by the API", func() bool {
+		return httpGet(t, r.app.api, "/oftee/0x6").Code == http.StatusOK
+	})
+
+	// A meter mod injected by the API, the device replies with an error
+	// and then to the barrier request that follows it
+	meterMod := harness.NewMessage(t, of.TypeMeterMod, 0, bytes.NewReader(make([]byte, 8)))
+	responses := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		resp := httptest.NewRecorder()
+		r.app.api.ServeHTTP(resp, httptest.NewRequest("POST", "/oftee/0x6/message?wait=true", bytes.NewReader(meterMod.Raw)))
+		responses <- resp
+	}()
+	injected := device.Received.WaitMessages(t, 2)
+	if injected[0].Type != of.TypeMeterMod || injected[1].Type != of.TypeBarrierRequest {
+		t.Fatalf("Expected meter mod and barrier request injected, got %v", injected)
+	}
+	device.Write(harness.NewMessage(t, of.TypeError, injected[0].XID, &ofp.Error{
+		Type: ofp.ErrTypeMeterModFailed,
+		Code: ofp.ErrCodeMeterModFailedUnknownMeter,
+		Data: injected[0].Raw[:8],
+	}))
+	device.Write(harness.NewMessage(t, of.TypeBarrierReply, injected[1].XID, nil))
+
+	var resp *httptest.ResponseRecorder
+	select {
+	case resp = <-responses:
+	case <-time.After(harness.Timeout):
+		t.Fatal("Expected the replies to the meter mod returned")
+	}
+	var result api.MessageResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != http.StatusOK || !result.Complete || len(result.Replies) != 1 ||
+		result.Replies[0].Error != "ErrCodeMeterModFailedUnknownMeter" {
+		t.Errorf("Expected meter mod error returned, got %d %+v", resp.Code, result)
+	}
+
+	// The replies are not proxied to the controller
+	packetIn := device.SendPacketIn(1, harness.EthernetFrame(0x0806, 64))
+	controller.ExpectMessages(t, controller.Messages()[0], packetIn)
+}
+
+func TestIntegrationHandshake(t *testing.T) {
+	r := newRig(t)
+	defer r.close()
+	device, conn := harness.NewSwitch(t)
+	defer device.Close()
+	go r.app.handle(context.Background(), conn, r.app.sharedEndpoints())
+	controller := r.controller.Conn(0)
+
+	// The hellos and set config are passed through unchanged, while the
+	// versions and config are snooped
+	hello := harness.Message{Type: of.TypeHello, XID: 1, Raw: []byte{0x04, 0x00, 0x00, 0x10, 0, 0, 0, 1, 0x00, 0x01, 0x00, 0x08, 0x00, 0x00, 0x00, 0x12}}
+	device.Write(hello)
+	controller.ExpectMessages(t, hello)
+	controllerHello := harness.Message{Type: of.TypeHello, XID: 2, Raw: []byte{0x04, 0x00, 0x00, 0x08, 0, 0, 0, 2}}
+	config := harness.Message{Type: of.TypeSetConfig, XID: 3, Raw: []byte{0x04, 0x09, 0x00, 0x0c, 0, 0, 0, 3, 0x00, 0x00, 0x00, 0x80}}
+	controller.Conn.Write(append(append([]byte(nil), controllerHello.Raw...), config.Raw...))
+	device.Received.ExpectMessages(t, controllerHello, config)
+	controller.ExpectMessages(t, hello, device.Write(harness.NewMessage(t, of.TypeFeaturesReply, 4, &ofp.SwitchFeatures{
+		DatapathID:   0x7,
+		NumTables:    4,
+		Capabilities: ofp.CapabilityFlowStats | ofp.CapabilityPortBlocked,
+	})))
+
+	var device7 api.DeviceResponse
+	waitFor(t, "the handshake to be known by the API", func() bool {
+		resp := httpGet(t, r.app.api, "/oftee/0x7")
+		return json.Unmarshal(resp.Body.Bytes(), &device7) == nil && device7.Handshake != nil
+	})
+	if h := device7.Handshake; h.Version != "1.3" || h.ControllerVersion != "1.3" || *h.Tables != 4 ||
+		*h.MissSendLen != 128 || len(h.Capabilities) != 2 || h.Capabilities[1] != "port_blocked" {
+		t.Errorf("Expected the 1.3 handshake snooped, got %+v", h)
+	}
+	if gauges := r.app.api.HandshakeGauges(); len(gauges) != 1 || gauges[0].Labels["of_version"] != "1.3" || gauges[0].Value != 1 {
+		t.Errorf("Expected the device counted by its version, got %+v", gauges)
+	}
+}
+
+func TestIntegrationCancelUnwindsSession(t *testing.T) {
+	wedged := &wedgedEndpoint{queue: make(chan []byte, 1)}
+	r := newRig(t)
+	defer r.close()
+	r.app.setEndpoints(connections.Endpoints{wedged})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	device, controller, done := r.connectContext(ctx, 0x1, 0)
+	defer device.Close()
+
+	// The second packet in is proxied, but its tee is blocked by the full
+	// queue of the wedged end point
+	device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64))
+	device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64))
+	controller.WaitMessages(t, 3)
+	waitFor(t, "the queue to fill", func() bool { return len(wedged.queue) == 1 })
+
+	// Once cancelled the write in flight is abandoned and the session
+	// unwinds, closing the connection to the controller
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Expected the session cancelled, got %v", err)
+		}
+	case <-time.After(harness.Timeout):
+		t.Fatal("Expected the session to unwind once cancelled")
+	}
+	waitFor(t, "the controller disconnected", func() bool { return controller.Err() != nil })
+}
+
+func TestIntegrationDevicesListed(t *testing.T) {
+	r := newRig(t)
+	defer r.close()
+	devices := func() []string {
+		var list api.DevicesResponse
+		json.NewDecoder(httpGet(t, r.app.api, "/oftee").Body).Decode(&list)
+		return list.Devices
+	}
+
+	// Listed once its DPID is learned from its features reply, until it
+	// disconnects
+	device, _, done := r.connect(0x1, 0)
+	dpid := datapath.Format(0x1)
+	waitFor(t, "the device listed", func() bool {
+		list := devices()
+		return len(list) == 1 && list[0] == dpid
+	})
+	device.Close()
+	<-done
+	waitFor(t, "the device no longer listed", func() bool { return len(devices()) == 0 })
+}
+
+func TestIntegrationTruncatedMessage(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		ofType of.Type
+	}{
+		{"proxied", of.TypeEchoRequest},
+		{"buffered", of.TypeHello},
+		{"packet in", of.TypePacketIn},
+	} {
+		r := newRig(t)
+		device, controller, done := r.connect(0x1, 0)
+
+		// A header claiming 100 bytes, followed by only 40 of them
+		// before the device disconnects
+		message := harness.NewMessage(t, test.ofType, 9, bytes.NewReader(make([]byte, 92)))
+		binary.BigEndian.PutUint16(message.Raw[2:], 100)
+		message.Raw = message.Raw[:48]
+		device.Write(message)
+		device.Close()
+		select {
+		case err := <-done:
+			truncated, ok := err.(*TruncatedError)
+			if !ok || truncated.Type != test.ofType || truncated.Expected != 100 || truncated.Actual != 48 {
+				t.Errorf("Expected the %s message truncated at 48 of 100 bytes, got %v", test.name, err)
+			}
+		case <-time.After(harness.Timeout):
+			t.Errorf("Expected the handler to terminate on the truncated %s message", test.name)
+		}
+
+		// Nothing is read past the truncated message, and the
+		// controller is disconnected
+		waitFor(t, "the controller disconnected", func() bool { return controller.Err() != nil })
+		for _, m := range controller.Messages()[1:] {
+			if m.Type != test.ofType || len(m.Raw) != 100 {
+				t.Errorf("Expected nothing but the truncated %s message proxied, got %v", test.name, m)
+			}
+		}
+		r.close()
+	}
+}
+
+func TestIntegrationDeviceClosesBetweenMessages(t *testing.T) {
+	r := newRig(t)
+	defer r.close()
+	device, controller, done := r.connect(0x1, 0)
+	echo := device.Send(of.TypeEchoRequest, nil)
+	controller.WaitMessages(t, 2)
+
+	// The handler ends without error, and the last message is not
+	// proxied again
+	device.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected the handler to end without error, got %v", err)
+		}
+	case <-time.After(harness.Timeout):
+		t.Fatal("Expected the handler to end once the device disconnected")
+	}
+	waitFor(t, "the controller disconnected", func() bool { return controller.Err() != nil })
+	if messages := controller.Messages(); len(messages) != 2 || messages[1].XID != echo.XID {
+		t.Errorf("Expected the echo request proxied once, got %v", messages)
+	}
+}
+
+// openFiles returns the number of files the process has open, or -1 if they
+// can't be counted
+func openFiles() int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+func TestIntegrationMirrorControllerMessages(t *testing.T) {
+	audit := harness.NewTCPEndpoint(t)
+	defer audit.Stop()
+	other := harness.NewTCPEndpoint(t)
+	defer other.Stop()
+	r := newRig(t, audit.Spec("of_type=flow_mod,group_mod", "direction=controller"), other.Spec("of_type!=error"))
+	defer r.close()
+	device, controller, _ := r.connect(0x1, 0)
+	defer device.Close()
+
+	// The flow and group mods of the controller reach the device
+	// unchanged, in order with the other messages, and are tee-ed only to
+	// the end point that asks for them
+	flowMod := harness.NewMessage(t, of.TypeFlowMod, 7, bytes.NewBuffer(bytes.Repeat([]byte{0xa5}, 48)))
+	echo := harness.NewMessage(t, of.TypeEchoRequest, 8, nil)
+	groupMod := harness.NewMessage(t, of.TypeGroupMod, 9, bytes.NewBuffer(bytes.Repeat([]byte{0x5a}, 16)))
+	controller.Conn.Write(append(append(append([]byte(nil), flowMod.Raw...), echo.Raw...), groupMod.Raw...))
+	device.Received.ExpectMessages(t, flowMod, echo, groupMod)
+	audit.Frames.ExpectFrames(t, harness.FrameOf(0x1, 0, flowMod), harness.FrameOf(0x1, 0, groupMod))
+
+	// The packet ins of the device are not
+	packetIn := device.SendPacketIn(3, harness.EthernetFrame(0x0806, 64))
+	other.Frames.ExpectFrames(t, harness.FrameOf(0x1, 3, packetIn))
+	if frames := audit.Frames.Frames(); len(frames) != 2 {
+		t.Errorf("Expected only the flow and group mods tee-ed, got %v", frames)
+	}
+}
+
+func TestIntegrationDeviceFlaps(t *testing.T) {
+	controller := harness.NewController(t)
+	defer controller.Close()
+	consumer := harness.NewTCPEndpoint(t)
+	defer consumer.Stop()
+	app := &App{Config: Config{ListenOn: "127.0.0.1:0", ProxyTo: controller.Addr(), TeeTo: []string{consumer.Spec()}}}
+	app.api = api.NewAPI(":0", "", "")
+	app.api.Start()
+	ctx, cancel := context.WithCancel(context.Background())
+	listening := make(chan struct{}, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- app.serveDevices(ctx, func() { listening <- struct{}{} })
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	<-listening
+
+	// A device connects, is proxied to the controller and tees to its own
+	// end point, and disconnects
+	flap := func(i int) {
+		device, err := net.Dial("tcp", app.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		features := harness.NewMessage(t, of.TypeFeaturesReply, 1, &ofp.SwitchFeatures{DatapathID: 0x1})
+		packetIn := harness.PacketIn(t, 2, 1, harness.EthernetFrame(0x0800, 64))
+		device.Write(append(append([]byte(nil), features.Raw...), packetIn.Raw...))
+		controller.Conn(i).WaitMessages(t, 2)
+		consumer.Frames.WaitFrames(t, i+1)
+		device.Close()
+	}
+
+	// Once the devices have gone, so has everything that handled them
+	goroutines, files := runtime.NumGoroutine(), openFiles()
+	for i := 0; i < 100; i++ {
+		flap(i)
+	}
+	waitFor(t, "the goroutines and files of the devices to be released", func() bool {
+		return runtime.NumGoroutine() <= goroutines && openFiles() <= files
+	})
+}
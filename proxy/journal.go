@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/datapath"
+	"github.com/ciena/oftee/journal"
+	"github.com/ciena/oftee/packetin"
+	of "github.com/netrack/openflow"
+)
+
+// journalUsage describes the `journal` sub-command
+const journalUsage = `usage: oftee journal dump [--filter terms] [--raw] [--hex] file...
+
+Prints the messages recorded in the journal files of an end point, those that
+match the filter, a ';' separated list of match terms as used in TEE_TO, i.e.
+'dl_type=0x888e;of_type=packet_in'. Without a filter every message is printed.
+`
+
+// parseFilter parses the match terms of a journal filter
+func parseFilter(filter string) (criteria.Criteria, error) {
+	var match criteria.Criteria
+	terms, err := splitSpec(filter)
+	if err != nil {
+		return match, err
+	}
+	for _, term := range terms {
+		condition, ok, err := criteria.ParseGroup(term.name, term.value)
+		if err == nil && !ok {
+			err = fmt.Errorf("term '%s' is not a match term", term.name)
+		}
+		if err == nil {
+			err = match.Merge(condition)
+		}
+		if err != nil {
+			return match, &SpecError{filter, term.offset, err}
+		}
+	}
+	return match, nil
+}
+
+// journalEntry describes a message recorded to a journal, as it was tee-ed
+// to the end point
+type journalEntry struct {
+	context OpenFlowContext
+	ofType  string
+	state   criteria.Criteria
+	known   bool
+}
+
+// describeEntry decodes a message recorded to a journal, the OpenFlow context
+// followed by the OpenFlow message or, if raw, the packet alone. A message
+// whose criteria can't be decoded is only matched by an empty filter.
+func describeEntry(message []byte, raw bool) journalEntry {
+	var entry journalEntry
+	if raw {
+		entry.ofType = "packet"
+		entry.state, entry.known = packetState(message, criteria.BitsPacket)
+		return entry
+	}
+	ctxLen := int(entry.context.Len())
+	if len(message) < ctxLen+8 {
+		entry.ofType = "truncated"
+		return entry
+	}
+	entry.context.DatapathID = binary.BigEndian.Uint64(message)
+	entry.context.Port = binary.BigEndian.Uint32(message[8:])
+	ofType := of.Type(message[ctxLen+1])
+	entry.ofType = ofType.String()
+	switch ofType {
+	case of.TypePacketIn:
+		entry.ofType = "packet_in"
+		if packetIn, err := packetin.Decode(message[ctxLen], message[ctxLen:]); err == nil {
+			entry.state, entry.known = packetState(packetIn.Data(message[ctxLen:]), criteria.BitsPacket)
+		}
+	case of.TypeError, of.TypeFlowRemoved, of.TypePortStatus:
+		entry.ofType = criteria.OFTypeName(uint8(ofType))
+		entry.state = criteria.Criteria{Set: criteria.BitOFType, OFType: uint8(ofType)}
+		entry.known = true
+	}
+
+	// A DPID of 0 is that of a device whose handshake hadn't completed
+	if entry.known && entry.context.DatapathID != 0 {
+		entry.state.Set |= criteria.BitDPID
+		entry.state.DPID = entry.context.DatapathID
+	}
+	return entry
+}
+
+// dumpJournal prints the entries of a journal file that match the filter,
+// returning an error if the file can't be read completely
+func dumpJournal(path string, filter *criteria.Criteria, raw, hex bool, out io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := journal.NewReader(file)
+	for {
+		offset := r.Offset()
+		entry, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read entry at offset %d: %s", offset, err)
+		}
+		described := describeEntry(entry.Message, raw)
+		if filter != nil && (!described.known || !filter.Match(described.state)) {
+			continue
+		}
+		source := "-"
+		if !raw && described.ofType != "truncated" {
+			source = fmt.Sprintf("%s port=%d", datapath.Format(described.context.DatapathID), described.context.Port)
+		}
+		fmt.Fprintf(out, "%s %s %s %s %d bytes\n", entry.Time.UTC().Format("2006-01-02T15:04:05.000000000Z"),
+			source, described.ofType, described.state.String(), len(entry.Message))
+		if hex {
+			fmt.Fprintf(out, "  %02x\n", entry.Message)
+		}
+	}
+}
+
+// JournalTool implements the `journal` sub-command, which reads the journal
+// files of end points, and returns the exit code
+func JournalTool(args []string, out io.Writer) int {
+	if len(args) == 0 || args[0] != "dump" {
+		fmt.Fprint(out, journalUsage)
+		return 2
+	}
+	flags := flag.NewFlagSet("journal dump", flag.ContinueOnError)
+	flags.SetOutput(out)
+	filterTerms := flags.String("filter", "", "match terms, i.e. dl_type=0x888e, of the messages to print")
+	raw := flags.Bool("raw", false, "the end point was tee-ed raw packets, TEE_RAW, without OpenFlow headers")
+	hex := flags.Bool("hex", false, "print the bytes of each message, in hexadecimal")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprint(out, journalUsage)
+		return 2
+	}
+
+	var filter *criteria.Criteria
+	if *filterTerms != "" {
+		match, err := parseFilter(*filterTerms)
+		if err != nil {
+			fmt.Fprintf(out, "Invalid filter: %s\n", err)
+			return 2
+		}
+		filter = &match
+	}
+
+	code := 0
+	for _, path := range flags.Args() {
+		if err := dumpJournal(path, filter, *raw, *hex, out); err != nil {
+			fmt.Fprintf(out, "%s: %s\n", path, err)
+			code = 1
+		}
+	}
+	return code
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ciena/oftee/internal/harness"
+	"github.com/ciena/oftee/journal"
+)
+
+// journaled returns the messages recorded to a journal file, once the journal
+// has recorded the given number of messages and is closed
+func journaled(t *testing.T, app *App, path string, n uint64) [][]byte {
+	j := app.journals.Get(path, journal.Options{})
+	waitFor(t, "messages to be journaled", func() bool {
+		return j.Stats().Recorded >= n
+	})
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var messages [][]byte
+	r := journal.NewReader(file)
+	for {
+		entry, err := r.Next()
+		if err == io.EOF {
+			return messages
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, entry.Message)
+	}
+}
+
+// framed returns the bytes tee-ed to an end point for a frame
+func framed(f harness.Frame) []byte {
+	context := make([]byte, harness.ContextLen)
+	binary.BigEndian.PutUint64(context, f.DPID)
+	binary.BigEndian.PutUint32(context[8:], f.Port)
+	return append(context, f.Message.Raw...)
+}
+
+func TestJournalRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oftee-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tcpJournal := filepath.Join(dir, "tcp.journal")
+	httpJournal := filepath.Join(dir, "http.journal")
+
+	consumer := harness.NewTCPEndpoint(t)
+	defer consumer.Stop()
+	collector := harness.NewHTTPEndpoint(t)
+	defer collector.Close()
+	r := newRig(t, consumer.Spec("journal="+tcpJournal), collector.Spec("dl_type=arp", "journal="+httpJournal))
+	defer r.close()
+	device, _, _ := r.connect(0x1, 0)
+	defer device.Close()
+
+	sent := []harness.Message{
+		device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64)),
+		device.SendPacketIn(2, harness.EthernetFrame(0x0806, 64)),
+		device.SendPacketIn(3, harness.EthernetFrame(0x888e, 128)),
+	}
+	frames := consumer.Frames.WaitFrames(t, 3)
+	collector.Frames.ExpectFrames(t, harness.FrameOf(0x1, 2, sent[1]))
+
+	// The journal records exactly the bytes delivered to each end point
+	recorded := journaled(t, r.app, tcpJournal, 3)
+	if len(recorded) != 3 {
+		t.Fatalf("Expected 3 messages journaled, got %d", len(recorded))
+	}
+	for i, frame := range frames {
+		if !bytes.Equal(recorded[i], framed(frame)) {
+			t.Errorf("Expected journaled message %d to be %x, got %x", i, framed(frame), recorded[i])
+		}
+	}
+	if recorded = journaled(t, r.app, httpJournal, 1); len(recorded) != 1 ||
+		!bytes.Equal(recorded[0], framed(harness.FrameOf(0x1, 2, sent[1]))) {
+		t.Errorf("Expected the ARP packet in journaled, got %x", recorded)
+	}
+
+	// Dumping the journal filters it with the end point match terms
+	out := &bytes.Buffer{}
+	if code := JournalTool([]string{"dump", "--filter", "dl_type=eapol", tcpJournal}, out); code != 0 {
+		t.Fatalf("Expected dump to succeed, got %d: %s", code, out)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "of:0x0000000000000001 port=1 packet_in dl_type=0x888e") ||
+		!strings.Contains(lines[1], "port=3") || !strings.HasSuffix(lines[1], fmt.Sprintf(" %d bytes", len(framed(frames[2])))) {
+		t.Errorf("Expected the EAPOL packet ins dumped, got %q", lines)
+	}
+	out.Reset()
+	if code := JournalTool([]string{"dump", "--hex", tcpJournal}, out); code != 0 || strings.Count(out.String(), "\n") != 6 {
+		t.Errorf("Expected every message dumped with its bytes, got %d: %s", code, out)
+	}
+}
+
+func TestJournalDumpErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oftee-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "damaged.journal")
+	j := journal.Open(path, journal.Options{})
+	j.Record(framed(harness.FrameOf(0x1, 1, harness.PacketIn(t, 1, 1, harness.EthernetFrame(0x888e, 64)))))
+	j.Record(framed(harness.FrameOf(0x1, 2, harness.PacketIn(t, 2, 2, harness.EthernetFrame(0x888e, 64)))))
+	j.Close()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The entries before a damaged record are dumped
+	out := &bytes.Buffer{}
+	if code := JournalTool([]string{"dump", path}, out); code != 1 ||
+		!strings.Contains(out.String(), "port=1 packet_in") || !strings.Contains(out.String(), "CRC mismatch") {
+		t.Errorf("Expected damaged record reported, got %d: %s", code, out)
+	}
+
+	for _, filter := range []string{"action=tcp://host:9000", "dl_type=0x888e;dl_type=0x0806", "dl_type=bogus"} {
+		out.Reset()
+		if code := JournalTool([]string{"dump", "--filter", filter, path}, out); code != 2 {
+			t.Errorf("Expected filter '%s' rejected, got %d: %s", filter, code, out)
+		}
+	}
+	if code := JournalTool([]string{"list"}, ioutil.Discard); code != 2 {
+		t.Errorf("Expected unknown journal command rejected, got %d", code)
+	}
+}
+
+func TestJournalShadowRejected(t *testing.T) {
+	app := &App{Config: Config{TeeTo: []string{"shadow=true;journal=/tmp/shadow.journal;action=tcp://127.0.0.1:9000"}}}
+	if _, err := app.EstablishEndpointConnections(); err == nil || !strings.Contains(err.Error(), "delivers nothing to journal") {
+		t.Errorf("Expected journal of a shadow end point rejected, got %v", err)
+	}
+}
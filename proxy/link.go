@@ -0,0 +1,565 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciena/oftee/connections"
+	of "github.com/netrack/openflow"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ControllerReconnectBackoff delay before the second attempt to
+	// re-establish the connection to the SDN controller, doubled for each
+	// attempt that follows
+	ControllerReconnectBackoff = 250 * time.Millisecond
+
+	// ControllerReconnectMaxBackoff maximum delay between attempts to
+	// re-establish the connection to the SDN controller
+	ControllerReconnectMaxBackoff = 30 * time.Second
+
+	// ControllerWriteTimeout maximum time a write to one of the SDN
+	// controllers of a device proxied to several may take, after which
+	// its connection is failed and re-established, so that a stalled
+	// controller doesn't hold up the others
+	ControllerWriteTimeout = 5 * time.Second
+)
+
+// What is done with a message written to the link, decided as its header is
+// written
+const (
+	routeSend = iota
+	routeBuffer
+	routeDrop
+)
+
+// controllerProxy the link, or group of links, over which the messages of a
+// device are proxied to, and from, the SDN controller
+type controllerProxy interface {
+	io.ReadWriteCloser
+	Stats() (uint64, uint64)
+	Connected() bool
+}
+
+// controllerLink is the connection to the SDN controller on behalf of a
+// device. It is written the messages from the device, and read by the
+// injector for the messages to the device, and re-establishes the connection
+// when it fails, so that the device connection outlives the controller's.
+//
+// The connection is re-established with an exponential backoff. The messages
+// from the device written while it is, are buffered up to `limit` bytes, and
+// written once it is re-established, or dropped and counted. A message is
+// buffered, or dropped, whole, so the controller only ever receives complete
+// messages. Once re-established the device's hello is written to the
+// controller before any buffered messages, and the controller's hello is
+// snooped rather than written to the device, which has completed its
+// handshake, so the controller resumes the session by requesting the
+// device's features.
+//
+// The messages from the controller are read whole, so a connection that fails
+// mid message never leaves a partial message for the device. If `dial` is
+// nil the connection is never re-established and failures are returned, as
+// for the local controller.
+//
+// If `failed` is set it is called with the error of each connection that
+// fails while the link is open.
+//
+// A link created without a connection starts re-establishing it, and one to
+// a controller other than the first, see `controllerGroup`, snoops the hello
+// of its first connection as well, so the device only ever receives one.
+//
+// If `writeTimeout` is set, each write to the connection must complete
+// within it, otherwise the connection is failed and re-established, while the
+// messages written are buffered, or dropped.
+//
+// Once the context of the link is done the reads and writes of the
+// connection in flight are abandoned, by expiring its deadline, and the link
+// closes rather than re-establishing it.
+type controllerLink struct {
+	dial         func() (net.Conn, error)
+	limit        int
+	snoop        func(message []byte)
+	logger       func() *log.Entry
+	failed       func(err error)
+	writeTimeout time.Duration
+
+	lock       sync.Mutex
+	ready      *sync.Cond
+	conn       net.Conn
+	generation int
+	closed     bool
+	current    atomic.Value
+	done       context.Context
+	cancel     context.CancelFunc
+	hello      []byte
+	pending    bytes.Buffer
+	header     []byte
+	left       int
+	route      int
+	capture    bool
+	reconnects uint64
+	dropped    uint64
+
+	// Only used by the reader
+	reader  *bufio.Reader
+	read    int
+	inbound bytes.Buffer
+}
+
+// newControllerLink creates a link over the established connection, or that
+// establishes it if nil, within the given context
+func newControllerLink(ctx context.Context, conn net.Conn, dial func() (net.Conn, error), limit int, snoop func([]byte), logger func() *log.Entry) *controllerLink {
+	l := &controllerLink{
+		dial:   dial,
+		limit:  limit,
+		snoop:  snoop,
+		logger: logger,
+		conn:   conn,
+		header: make([]byte, 0, 4),
+	}
+	l.done, l.cancel = context.WithCancel(ctx)
+	l.ready = sync.NewCond(&l.lock)
+	l.current.Store(linkConn{conn})
+	go l.interrupt()
+	if conn == nil {
+		go l.reconnect()
+	}
+	return l
+}
+
+// Connected returns true while the connection to the controller is
+// established, rather than being re-established
+func (l *controllerLink) Connected() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.conn != nil
+}
+
+// secondary marks the link as that to a controller other than the first, so
+// that the hello of its first connection is snooped rather than read, as is
+// that of a re-established connection. It must be called before the link is
+// read.
+func (l *controllerLink) secondary() {
+	l.read = -1
+}
+
+// interrupt expires the deadline of the connection once the link is done, so
+// that the reads and writes in flight fail, without waiting for the lock held
+// by a blocked write. A connection that is re-established concurrently is
+// closed by `resume`.
+func (l *controllerLink) interrupt() {
+	<-l.done.Done()
+	if current := l.current.Load().(linkConn); current.Conn != nil {
+		current.SetDeadline(time.Unix(1, 0))
+	}
+}
+
+// linkConn holds the current connection of a link, whose concrete type may
+// change as it is re-established
+type linkConn struct {
+	net.Conn
+}
+
+// Write writes messages from the device to the controller. Messages may be
+// written in pieces, but must be written in order and whole.
+func (l *controllerLink) Write(b []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n := len(b)
+	for len(b) > 0 {
+		if l.left == 0 {
+			// The start of a message, whose length is in its
+			// header
+			take := min(cap(l.header)-len(l.header), len(b))
+			l.header = append(l.header, b[:take]...)
+			b = b[take:]
+			if len(l.header) < cap(l.header) {
+				break
+			}
+			l.left = int(binary.BigEndian.Uint16(l.header[2:]))
+			if l.left < len(l.header) {
+				l.left = len(l.header)
+			}
+			l.start(of.Type(l.header[1]))
+			header := l.header
+			l.header = l.header[:0]
+			if err := l.forward(header); err != nil {
+				return n - len(b), err
+			}
+			continue
+		}
+		take := min(l.left, len(b))
+		if err := l.forward(b[:take]); err != nil {
+			return n - len(b), err
+		}
+		b = b[take:]
+	}
+	return n, nil
+}
+
+// start decides what is done with a message, of `l.left` bytes, sent while
+// connected, buffered while not, if it fits, or else dropped
+func (l *controllerLink) start(messageType of.Type) {
+	switch {
+	case l.conn != nil:
+		l.route = routeSend
+	case l.pending.Len()+l.left <= l.limit:
+		l.route = routeBuffer
+	default:
+		l.route = routeDrop
+		atomic.AddUint64(&l.dropped, 1)
+	}
+	l.capture = messageType == of.TypeHello
+	if l.capture {
+		l.hello = l.hello[:0]
+	}
+}
+
+// forward sends, buffers or drops a piece of the current message
+func (l *controllerLink) forward(b []byte) error {
+	l.left -= len(b)
+	if l.capture {
+		l.hello = append(l.hello, b...)
+	}
+	switch l.route {
+	case routeSend:
+		conn := l.conn
+		l.deadline(conn)
+		if _, err := connections.WriteFull(conn, b); err != nil {
+			if l.dial == nil {
+				return err
+			}
+			// The rest of the message is lost with the
+			// connection
+			l.route = routeDrop
+			atomic.AddUint64(&l.dropped, 1)
+			l.fail(conn, err)
+		}
+	case routeBuffer:
+		l.pending.Write(b)
+	}
+	return nil
+}
+
+// deadline sets the deadline of a write to the connection, if the link has a
+// write timeout, unless the link is done, when its deadline has expired. The
+// lock must be held.
+func (l *controllerLink) deadline(conn net.Conn) {
+	if l.writeTimeout > 0 && l.done.Err() == nil {
+		conn.SetWriteDeadline(time.Now().Add(l.writeTimeout))
+	}
+}
+
+// fail closes a connection that failed, unless it has already been
+// replaced, and starts to re-establish it. The lock must be held.
+func (l *controllerLink) fail(conn net.Conn, err error) {
+	if l.conn != conn || l.closed {
+		return
+	}
+	l.conn = nil
+	conn.Close()
+	if l.done.Err() != nil {
+		l.closed = true
+		l.ready.Broadcast()
+		return
+	}
+	l.logger().
+		WithError(err).
+		WithFields(log.Fields{
+			"proxy": conn.RemoteAddr().String(),
+		}).
+		Warn("Connection to SDN controller lost, reconnecting")
+	if l.failed != nil {
+		l.failed(err)
+	}
+	go l.reconnect()
+}
+
+// reconnect re-establishes the connection, until it is or the link is closed
+func (l *controllerLink) reconnect() {
+	backoff := ControllerReconnectBackoff
+	for {
+		conn, err := l.dial()
+		if err == nil {
+			if err = l.resume(conn); err == nil {
+				return
+			}
+			l.logger().
+				WithError(err).
+				Warn("Unable to resume session with SDN controller")
+		}
+		select {
+		case <-l.done.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > ControllerReconnectMaxBackoff {
+			backoff = ControllerReconnectMaxBackoff
+		}
+	}
+}
+
+// resume makes a re-established connection that of the link, once the
+// device's hello, and the messages buffered, are written to it
+func (l *controllerLink) resume(conn net.Conn) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.current.Store(linkConn{conn})
+	if l.closed || l.done.Err() != nil {
+		conn.Close()
+		return nil
+	}
+	for _, b := range [][]byte{l.hello, l.pending.Bytes()} {
+		l.deadline(conn)
+		if _, err := connections.WriteFull(conn, b); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	l.logger().
+		WithFields(log.Fields{
+			"proxy":    conn.RemoteAddr().String(),
+			"buffered": l.pending.Len(),
+			"dropped":  atomic.LoadUint64(&l.dropped),
+		}).
+		Info("Reconnected to SDN controller")
+
+	// The rest of a message being buffered follows what was buffered
+	if l.route == routeBuffer {
+		l.route = routeSend
+	}
+	l.pending.Reset()
+	l.conn = conn
+	l.generation++
+	atomic.AddUint64(&l.reconnects, 1)
+	l.ready.Broadcast()
+	return nil
+}
+
+// Read reads the messages from the controller to the device, waiting for the
+// connection to be re-established when it fails. Once the link is closed
+// `io.EOF` is returned.
+func (l *controllerLink) Read(p []byte) (int, error) {
+	for l.inbound.Len() == 0 {
+		if err := l.receive(); err != nil {
+			return 0, err
+		}
+	}
+	return l.inbound.Read(p)
+}
+
+// receive reads the next message from the controller, unless it is the
+// hello of a re-established connection
+func (l *controllerLink) receive() error {
+	l.lock.Lock()
+	for l.conn == nil && !l.closed {
+		l.ready.Wait()
+	}
+	conn, generation, closed := l.conn, l.generation, l.closed
+	l.lock.Unlock()
+	if closed {
+		return io.EOF
+	}
+	resumed := generation != l.read
+	if resumed || l.reader == nil {
+		l.reader = bufio.NewReader(conn)
+		l.read = generation
+	}
+
+	var header of.Header
+	l.inbound.Reset()
+	_, err := header.ReadFrom(io.TeeReader(l.reader, &l.inbound))
+	if err == nil {
+		_, err = io.CopyN(&l.inbound, l.reader, int64(header.Length)-int64(l.inbound.Len()))
+	}
+	if err != nil {
+		l.inbound.Reset()
+		if l.dial == nil {
+			return err
+		}
+		l.lock.Lock()
+		l.fail(conn, err)
+		l.lock.Unlock()
+		return nil
+	}
+	if resumed && header.Type == of.TypeHello {
+		l.snoop(l.inbound.Bytes())
+		l.inbound.Reset()
+	}
+	return nil
+}
+
+// Stats returns the number of times the connection was re-established, and
+// the number of messages from the device dropped
+func (l *controllerLink) Stats() (uint64, uint64) {
+	return atomic.LoadUint64(&l.reconnects), atomic.LoadUint64(&l.dropped)
+}
+
+// Close closes the link and its connection, it is no longer re-established
+func (l *controllerLink) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	l.cancel()
+	l.ready.Broadcast()
+	if l.conn != nil {
+		return l.conn.Close()
+	}
+	return nil
+}
+
+// controllerGroup is the links to each of the SDN controllers to which the
+// messages of a device are proxied, i.e. the instances of a cluster, much as
+// the device would connect to each itself. Every message from the device is
+// written to every link, each of which buffers, or drops, it while its
+// connection is re-established independently of the others. A write to a
+// link that doesn't complete within the write timeout fails its connection,
+// so a stalled controller holds up the others for at most the timeout. The
+// messages from the controllers, role requests included, are merged whole
+// for the device, in the order each is read.
+type controllerGroup struct {
+	links    []*controllerLink
+	messages chan []byte
+	ctx      context.Context
+	cancel   context.CancelFunc
+	current  []byte
+
+	// readers the number of links still being read, each sends a nil
+	// message as it ends
+	readers int
+}
+
+// newControllerGroup creates the group of the given links, whose writes
+// must complete within the given timeout, reading the messages from each of
+// them until it is closed
+func newControllerGroup(links []*controllerLink, writeTimeout time.Duration) *controllerGroup {
+	for _, link := range links {
+		link.lock.Lock()
+		link.writeTimeout = writeTimeout
+		link.lock.Unlock()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &controllerGroup{
+		links:    links,
+		messages: make(chan []byte),
+		ctx:      ctx,
+		cancel:   cancel,
+		readers:  len(links),
+	}
+	for _, link := range links {
+		go g.receive(link)
+	}
+	return g
+}
+
+// receive reads the messages from a link, whole, until it is closed
+func (g *controllerGroup) receive(link *controllerLink) {
+	defer func() {
+		select {
+		case g.messages <- nil:
+		case <-g.ctx.Done():
+		}
+	}()
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(link, header); err != nil {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(header[2:]))
+		if length < len(header) {
+			length = len(header)
+		}
+		message := make([]byte, length)
+		copy(message, header)
+		if _, err := io.ReadFull(link, message[len(header):]); err != nil {
+			return
+		}
+		select {
+		case g.messages <- message:
+		case <-g.ctx.Done():
+			return
+		}
+	}
+}
+
+// Write writes messages from the device to every controller. Messages may be
+// written in pieces, but must be written in order and whole.
+func (g *controllerGroup) Write(b []byte) (int, error) {
+	for _, link := range g.links {
+		if n, err := link.Write(b); err != nil {
+			return n, err
+		}
+	}
+	return len(b), nil
+}
+
+// Read reads the messages from the controllers to the device. Once the group
+// is closed, or every link is, `io.EOF` is returned.
+func (g *controllerGroup) Read(p []byte) (int, error) {
+	for len(g.current) == 0 {
+		if g.readers == 0 {
+			return 0, io.EOF
+		}
+		select {
+		case message := <-g.messages:
+			if message == nil {
+				g.readers--
+			}
+			g.current = message
+		case <-g.ctx.Done():
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, g.current)
+	g.current = g.current[n:]
+	return n, nil
+}
+
+// Stats returns the number of times the connections were re-established, and
+// the number of messages from the device dropped, over all the controllers
+func (g *controllerGroup) Stats() (uint64, uint64) {
+	var reconnects, dropped uint64
+	for _, link := range g.links {
+		r, d := link.Stats()
+		reconnects += r
+		dropped += d
+	}
+	return reconnects, dropped
+}
+
+// Connected returns true while the connection to any of the controllers is
+// established
+func (g *controllerGroup) Connected() bool {
+	for _, link := range g.links {
+		if link.Connected() {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes the links to all the controllers
+func (g *controllerGroup) Close() error {
+	g.cancel()
+	var err error
+	for _, link := range g.links {
+		if closeErr := link.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
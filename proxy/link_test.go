@@ -0,0 +1,364 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/internal/harness"
+	of "github.com/netrack/openflow"
+	log "github.com/sirupsen/logrus"
+)
+
+// linkMessage an OpenFlow 1.3 message of the given type with a body of the
+// given length
+func linkMessage(messageType of.Type, xid uint32, body int) []byte {
+	message := make([]byte, 8+body)
+	message[0], message[1] = 0x04, byte(messageType)
+	binary.BigEndian.PutUint16(message[2:], uint16(len(message)))
+	binary.BigEndian.PutUint32(message[4:], xid)
+	return message
+}
+
+// linkRig a link whose connection is re-established with the connections
+// given to `next`, and whose controller side messages are read to `received`
+type linkRig struct {
+	link       *controllerLink
+	controller net.Conn
+	next       chan net.Conn
+	received   chan harness.Message
+	snooped    chan []byte
+}
+
+func newLinkRig(t *testing.T, limit int) *linkRig {
+	local, controller := net.Pipe()
+	r := &linkRig{
+		controller: controller,
+		next:       make(chan net.Conn, 1),
+		received:   make(chan harness.Message, 10),
+		snooped:    make(chan []byte, 10),
+	}
+	dial := func() (net.Conn, error) {
+		select {
+		case conn := <-r.next:
+			return conn, nil
+		default:
+			return nil, errors.New("connection refused")
+		}
+	}
+	r.link = newControllerLink(context.Background(), local, dial, limit, func(message []byte) {
+		r.snooped <- append([]byte(nil), message...)
+	}, func() *log.Entry { return log.WithField("test", t.Name()) })
+	r.receive(controller)
+	return r
+}
+
+// receive reads the messages the link writes to a controller connection
+func (r *linkRig) receive(conn net.Conn) {
+	go func() {
+		for {
+			m, err := harness.ReadMessage(conn)
+			if err != nil {
+				return
+			}
+			r.received <- m
+		}
+	}()
+}
+
+// drop closes the controller's side of the connection, and waits for the
+// link to notice
+func (r *linkRig) drop(t *testing.T) {
+	r.controller.Close()
+	waitFor(t, "the link to be disconnected", func() bool {
+		r.link.lock.Lock()
+		defer r.link.lock.Unlock()
+		return r.link.conn == nil
+	})
+}
+
+// reconnect provides the link a new connection, returning the controller's
+// side of it
+func (r *linkRig) reconnect() net.Conn {
+	local, controller := net.Pipe()
+	r.receive(controller)
+	r.controller = controller
+	r.next <- local
+	return controller
+}
+
+func (r *linkRig) expect(t *testing.T, expected ...[]byte) {
+	for _, raw := range expected {
+		select {
+		case m := <-r.received:
+			if !bytes.Equal(m.Raw, raw) {
+				t.Errorf("Expected %02x written to the controller, got %02x", raw, m.Raw)
+			}
+		case <-time.After(harness.Timeout):
+			t.Fatalf("Expected %02x written to the controller", raw)
+		}
+	}
+}
+
+func TestControllerLinkCancelled(t *testing.T) {
+	// The controller doesn't read, so the write blocks until the context
+	// of the link is done
+	local, controller := net.Pipe()
+	defer controller.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	dial := func() (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	link := newControllerLink(ctx, local, dial, 0, func([]byte) {}, func() *log.Entry { return log.WithField("test", t.Name()) })
+	defer link.Close()
+	written := make(chan struct{})
+	go func() {
+		link.Write(linkMessage(of.TypePacketIn, 1, 32))
+		written <- struct{}{}
+	}()
+	time.AfterFunc(10*time.Millisecond, cancel)
+	select {
+	case <-written:
+	case <-time.After(harness.Timeout):
+		t.Fatal("Expected the write abandoned once the context is done")
+	}
+
+	// Closed, rather than re-established
+	if _, err := link.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the link closed, got %v", err)
+	}
+}
+
+func TestControllerLinkDropsWhileDisconnected(t *testing.T) {
+	r := newLinkRig(t, 0)
+	defer r.link.Close()
+	failed := make(chan error, 1)
+	r.link.failed = func(err error) {
+		failed <- err
+	}
+	go r.link.Read(make([]byte, 1))
+
+	hello := linkMessage(of.TypeHello, 1, 0)
+	r.link.Write(hello)
+	r.expect(t, hello)
+	r.drop(t)
+	select {
+	case <-failed:
+	default:
+		t.Error("Expected the failure of the connection reported")
+	}
+
+	// Messages written while disconnected are dropped whole
+	dropped := linkMessage(of.TypePacketIn, 2, 32)
+	for _, piece := range [][]byte{dropped[:3], dropped[3:10], dropped[10:]} {
+		if n, err := r.link.Write(piece); err != nil || n != len(piece) {
+			t.Fatalf("Expected the write to succeed, got %d (%v)", n, err)
+		}
+	}
+	if reconnects, count := r.link.Stats(); reconnects != 0 || count != 1 {
+		t.Errorf("Expected 1 message dropped, got %d (%d reconnects)", count, reconnects)
+	}
+
+	// The device's hello is written to the new connection first
+	r.reconnect()
+	r.expect(t, hello)
+	packetIn := linkMessage(of.TypePacketIn, 3, 16)
+	r.link.Write(packetIn)
+	r.expect(t, packetIn)
+	if reconnects, _ := r.link.Stats(); reconnects != 1 {
+		t.Errorf("Expected 1 reconnect, got %d", reconnects)
+	}
+}
+
+func TestControllerLinkBuffersWhileDisconnected(t *testing.T) {
+	r := newLinkRig(t, 40)
+	defer r.link.Close()
+	go r.link.Read(make([]byte, 1))
+	r.drop(t)
+
+	// Messages are buffered until the limit, those that don't fit are
+	// dropped, and a message buffered when the connection is
+	// re-established is completed over it
+	first := linkMessage(of.TypePacketIn, 1, 16)
+	second := linkMessage(of.TypePacketIn, 2, 16)
+	third := linkMessage(of.TypeEchoRequest, 3, 4)
+	r.link.Write(first)
+	r.link.Write(second)
+	r.link.Write(third[:10])
+	r.reconnect()
+	r.expect(t, first)
+	r.link.Write(third[10:])
+	r.expect(t, third)
+	if _, dropped := r.link.Stats(); dropped != 1 {
+		t.Errorf("Expected 1 message dropped, got %d", dropped)
+	}
+}
+
+func TestControllerLinkReadsResumedSession(t *testing.T) {
+	r := newLinkRig(t, 0)
+	defer r.link.Close()
+	read := make(chan []byte, 10)
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			m, err := harness.ReadMessage(r.link)
+			if err != nil {
+				failed <- err
+				return
+			}
+			read <- m.Raw
+		}
+	}()
+
+	// The controller's first hello is read, that of a re-established
+	// connection is only snooped
+	hello := linkMessage(of.TypeHello, 1, 0)
+	r.controller.Write(hello)
+	if m := <-read; !bytes.Equal(m, hello) {
+		t.Errorf("Expected the hello read, got %02x", m)
+	}
+	r.drop(t)
+	controller := r.reconnect()
+	resumed := linkMessage(of.TypeHello, 2, 0)
+	request := linkMessage(of.TypeFeaturesRequest, 3, 0)
+	controller.Write(append(append([]byte(nil), resumed...), request...))
+	select {
+	case m := <-read:
+		if !bytes.Equal(m, request) {
+			t.Errorf("Expected the features request read, got %02x", m)
+		}
+	case <-time.After(harness.Timeout):
+		t.Fatal("Expected the features request read")
+	}
+	if snooped := <-r.snooped; !bytes.Equal(snooped, resumed) {
+		t.Errorf("Expected the resumed hello snooped, got %02x", snooped)
+	}
+
+	// Once closed the link reads no more
+	r.link.Close()
+	select {
+	case err := <-failed:
+		if err != io.EOF {
+			t.Errorf("Expected the end of the messages once closed, got %v", err)
+		}
+	case <-time.After(harness.Timeout):
+		t.Fatal("Expected the read to end once closed")
+	}
+}
+
+func TestControllerGroup(t *testing.T) {
+	primary, other := newLinkRig(t, 0), newLinkRig(t, 0)
+	other.link.secondary()
+	group := newControllerGroup([]*controllerLink{primary.link, other.link}, ControllerWriteTimeout)
+	defer group.Close()
+	read := make(chan []byte, 10)
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			m, err := harness.ReadMessage(group)
+			if err != nil {
+				failed <- err
+				return
+			}
+			read <- m.Raw
+		}
+	}()
+
+	// Messages from the device are written to every controller
+	hello := linkMessage(of.TypeHello, 1, 0)
+	group.Write(hello)
+	primary.expect(t, hello)
+	other.expect(t, hello)
+
+	// Only the hello of the primary is read, the messages from both are
+	// merged whole
+	primaryHello, otherHello := linkMessage(of.TypeHello, 2, 0), linkMessage(of.TypeHello, 3, 0)
+	primary.controller.Write(primaryHello)
+	other.controller.Write(otherHello)
+	if m := <-read; !bytes.Equal(m, primaryHello) {
+		t.Errorf("Expected the primary's hello read, got %02x", m)
+	}
+	if snooped := <-other.snooped; !bytes.Equal(snooped, otherHello) {
+		t.Errorf("Expected the other hello snooped, got %02x", snooped)
+	}
+	request := linkMessage(of.TypeRoleRequest, 4, 16)
+	go other.controller.Write(request)
+	select {
+	case m := <-read:
+		if !bytes.Equal(m, request) {
+			t.Errorf("Expected the role request read, got %02x", m)
+		}
+	case <-time.After(harness.Timeout):
+		t.Fatal("Expected the role request read")
+	}
+
+	// While one controller is disconnected the other is still written to,
+	// and the first resumes, with the device's hello, once re-established
+	other.drop(t)
+	dropped := linkMessage(of.TypePacketIn, 5, 32)
+	group.Write(dropped)
+	primary.expect(t, dropped)
+	if reconnects, drops := group.Stats(); reconnects != 0 || drops != 1 {
+		t.Errorf("Expected one message dropped, got %d reconnects and %d dropped", reconnects, drops)
+	}
+	other.reconnect()
+	waitFor(t, "the link to be re-established", func() bool {
+		reconnects, _ := group.Stats()
+		return reconnects == 1
+	})
+	resumed := linkMessage(of.TypePacketIn, 6, 32)
+	group.Write(resumed)
+	primary.expect(t, resumed)
+	other.expect(t, hello, resumed)
+
+	// Once closed the group reads no more
+	group.Close()
+	select {
+	case err := <-failed:
+		if err != io.EOF {
+			t.Errorf("Expected the end of the messages once closed, got %v", err)
+		}
+	case <-time.After(harness.Timeout):
+		t.Fatal("Expected the read to end once closed")
+	}
+}
+
+func TestControllerGroupStalled(t *testing.T) {
+	// The other controller never reads, so each write to it blocks until
+	// its write timeout
+	primary := newLinkRig(t, 0)
+	local, controller := net.Pipe()
+	defer controller.Close()
+	dial := func() (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	stalled := newControllerLink(context.Background(), local, dial, 0, func([]byte) {}, func() *log.Entry { return log.WithField("test", t.Name()) })
+	stalled.secondary()
+	group := newControllerGroup([]*controllerLink{primary.link, stalled}, 20*time.Millisecond)
+	defer group.Close()
+
+	// The stalled controller holds up the first message for the timeout,
+	// and is then disconnected, so the next is written to the primary at
+	// once
+	first, second := linkMessage(of.TypePacketIn, 1, 32), linkMessage(of.TypePacketIn, 2, 32)
+	written := make(chan struct{}, 1)
+	go func() {
+		group.Write(first)
+		group.Write(second)
+		written <- struct{}{}
+	}()
+	select {
+	case <-written:
+	case <-time.After(harness.Timeout):
+		t.Fatal("Expected the writes not held up by the stalled controller")
+	}
+	primary.expect(t, first, second)
+	if _, drops := group.Stats(); stalled.Connected() || drops != 2 {
+		t.Errorf("Expected the stalled controller disconnected, and both messages dropped, got %d dropped", drops)
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// newLogFile creates a writer to the given file that rotates the file once it
+// reaches maxSize megabytes, keeping at most maxBackups rotated files for at
+// most maxAge days. Writes are serialized, so the writer can be shared by all
+// go routines.
+func newLogFile(filename string, maxSize, maxBackups, maxAge int) *lumberjack.Logger {
+	return &lumberjack.Logger{
+		Filename:   filename,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+		MaxAge:     maxAge,
+		LocalTime:  true,
+	}
+}
+
+// rotateOnUser1 forces the rotation of the log files each time a SIGUSR1 is
+// received, for compatibility with logrotate. SIGHUP isn't used as it
+// reloads the configuration. The returned function stops the rotation.
+func rotateOnUser1(files ...*lumberjack.Logger) func() {
+	user1 := make(chan os.Signal, 1)
+	signal.Notify(user1, syscall.SIGUSR1)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-user1:
+			case <-stop:
+				return
+			}
+			for _, file := range files {
+				if err := file.Rotate(); err != nil {
+					log.
+						WithFields(log.Fields{
+							"log-file": file.Filename,
+						}).
+						WithError(err).
+						Error("Unable to rotate log file")
+				}
+			}
+			log.Info("Rotated log files on SIGUSR1")
+		}
+	}()
+	return func() {
+		signal.Stop(user1)
+		stop <- struct{}{}
+	}
+}
+
+// ConfigureLogFile directs the log output to the LOG_FILE, if set, and to
+// stderr as well if LOG_ALSO_STDERR is set. The log output is that of the
+// process, so it is left to the program that runs the proxy to configure.
+func (c *Config) ConfigureLogFile() {
+	if c.LogFile == "" {
+		return
+	}
+	file := newLogFile(c.LogFile, c.LogMaxSize, c.LogMaxBackups, c.LogMaxAge)
+	var out io.Writer = file
+	if c.LogAlsoStderr {
+		out = io.MultiWriter(os.Stderr, file)
+	}
+	log.SetOutput(out)
+	rotateOnUser1(file)
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestLogFileRotateOnUser1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oftee-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := newLogFile(filepath.Join(dir, "oftee.log"), 1, 2, 0)
+	defer file.Close()
+	logger := log.New()
+	logger.Out = file
+	stop := rotateOnUser1(file)
+	defer stop()
+	logger.Info("Before rotation")
+
+	// Log from several go routines while the file is rotated
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				logger.WithField("writer", i).Info("Logging while rotating")
+			}
+		}(i)
+	}
+	if err = syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(2 * time.Second)
+	var files []string
+	for len(files) < 2 && time.Now().Before(deadline) {
+		files, _ = filepath.Glob(filepath.Join(dir, "oftee*.log"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(files) != 2 {
+		t.Errorf("Expected the current and one rotated log file, got %v", files)
+	}
+}
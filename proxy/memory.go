@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciena/oftee/api"
+	"github.com/ciena/oftee/connections"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MemorySampleInterval interval at which the memory in use is
+	// compared against the `MEMORY_CEILING`
+	MemorySampleInterval = time.Second
+
+	// MemoryRecovery fraction of the threshold of a step of the
+	// degradation ladder under which the memory in use must fall before
+	// the step is reverted
+	MemoryRecovery = 0.9
+
+	// PressureQueueLimit number of messages that may be queued to an end
+	// point while the queues are shrunk
+	PressureQueueLimit = 10
+)
+
+// The steps of the degradation ladder, in the order in which they are taken
+const (
+	memoryNormal = iota
+	memoryShrinkQueues
+	memoryNoHistory
+	memorySampling
+	memoryProxyOnly
+)
+
+// memorySteps the name of each step of the degradation ladder, and the
+// fraction of the ceiling at which it is taken
+var memorySteps = []struct {
+	name      string
+	threshold float64
+}{
+	{"normal", 0},
+	{"shrink_queues", 0.7},
+	{"no_history", 0.8},
+	{"sampling", 0.9},
+	{"proxy_only", 1},
+}
+
+// memoryLadder degrades the process predictably as the memory in use
+// approaches its ceiling, rather than have it killed for running out of
+// memory. Each step is taken once the memory in use reaches its threshold,
+// in order, and reverted, in reverse order, once it falls below
+// `MemoryRecovery` of it.
+type memoryLadder struct {
+	ceiling uint64
+	used    uint64
+	sample  func() uint64
+	engage  func(step int, engaged bool)
+	step    int32
+}
+
+// newMemoryLadder creates a ladder that samples the memory in use with
+// `sample` and takes, or reverts, each step with `engage`
+func newMemoryLadder(ceiling uint64, sample func() uint64, engage func(int, bool)) *memoryLadder {
+	return &memoryLadder{
+		ceiling: ceiling,
+		sample:  sample,
+		engage:  engage,
+	}
+}
+
+// heapInUse returns the bytes of the heap in use
+func heapInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+// run evaluates the ladder at the given interval, until the context is done
+func (l *memoryLadder) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.evaluate()
+		}
+	}
+}
+
+// evaluate samples the memory in use, and takes the steps whose thresholds it
+// has reached, or reverts those it has fallen below
+func (l *memoryLadder) evaluate() {
+	used := l.sample()
+	atomic.StoreUint64(&l.used, used)
+	step := int(atomic.LoadInt32(&l.step))
+	for step+1 < len(memorySteps) && float64(used) >= memorySteps[step+1].threshold*float64(l.ceiling) {
+		step++
+		l.transition(step, true, used)
+	}
+	for step > memoryNormal && float64(used) < memorySteps[step].threshold*MemoryRecovery*float64(l.ceiling) {
+		l.transition(step, false, used)
+		step--
+	}
+}
+
+// transition takes, or reverts, a step
+func (l *memoryLadder) transition(step int, engaged bool, used uint64) {
+	l.engage(step, engaged)
+	entry := log.WithFields(log.Fields{
+		"step":    memorySteps[step].name,
+		"used":    used,
+		"ceiling": l.ceiling,
+	})
+	if engaged {
+		atomic.StoreInt32(&l.step, int32(step))
+		entry.Warn("Memory in use approaching ceiling, degrading")
+	} else {
+		atomic.StoreInt32(&l.step, int32(step-1))
+		entry.Info("Memory in use recovered, restoring")
+	}
+}
+
+// Step returns the last step taken, `memoryNormal` if none
+func (l *memoryLadder) Step() int {
+	if l == nil {
+		return memoryNormal
+	}
+	return int(atomic.LoadInt32(&l.step))
+}
+
+// proxyOnly returns true while packet ins are only proxied to the SDN
+// controller, and not tee-ed
+func (l *memoryLadder) proxyOnly() bool {
+	return l.Step() >= memoryProxyOnly
+}
+
+// Gauges returns the step of the ladder, the memory in use and the messages
+// dropped as gauges
+func (l *memoryLadder) Gauges() []api.Gauge {
+	if l == nil {
+		return nil
+	}
+	return []api.Gauge{
+		{Name: "oftee_memory_degradation_step", Help: "step of the memory degradation ladder taken, 0 if none", Value: float64(l.Step())},
+		{Name: "oftee_memory_used_bytes", Help: "bytes of memory in use when last sampled", Value: float64(atomic.LoadUint64(&l.used))},
+		{Name: "oftee_memory_ceiling_bytes", Help: "bytes of memory at which packet ins are only proxied", Value: float64(l.ceiling)},
+		{Name: "oftee_memory_queue_dropped", Help: "messages dropped because the queues of the end points were shrunk", Value: float64(connections.PressureDropped())},
+	}
+}
+
+// engageMemoryStep takes, or reverts, a step of the degradation ladder via
+// the subsystem it degrades. Once proxy only, the last step, packet ins are
+// not tee-ed, see `handle`.
+func (app *App) engageMemoryStep(step int, engaged bool) {
+	switch step {
+	case memoryShrinkQueues:
+		limit := 0
+		if engaged {
+			limit = PressureQueueLimit
+		}
+		connections.SetQueueLimit(limit)
+	case memoryNoHistory:
+		app.api.SuspendObservations(engaged)
+	case memorySampling:
+		connections.ForceSampling(engaged)
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/ciena/oftee/connections"
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/internal/harness"
+)
+
+// wedgedEndpoint an end point that never delivers, so its queue only fills
+type wedgedEndpoint struct {
+	queue chan []byte
+}
+
+func (e *wedgedEndpoint) Match(state criteria.Criteria) bool { return true }
+func (e *wedgedEndpoint) GetQueue() chan<- []byte            { return e.queue }
+func (e *wedgedEndpoint) ListenAndSend() error               { return nil }
+func (e *wedgedEndpoint) String() string                     { return "wedged" }
+
+func TestMemoryLadder(t *testing.T) {
+	wedged := &wedgedEndpoint{queue: make(chan []byte, 100)}
+	r := newRig(t)
+	defer r.close()
+	r.app.setEndpoints(connections.Endpoints{wedged})
+
+	// The memory in use is that held by the wedged end point's queue, as
+	// 1000 bytes a message, and whatever else the process holds
+	var other uint64
+	sample := func() uint64 {
+		return uint64(len(wedged.queue))*1000 + other
+	}
+	var taken []string
+	r.app.pressure = newMemoryLadder(100000, sample, func(step int, engaged bool) {
+		taken = append(taken, fmt.Sprintf("%s %t", memorySteps[step].name, engaged))
+		r.app.engageMemoryStep(step, engaged)
+	})
+	defer func() {
+		connections.SetQueueLimit(0)
+		connections.ForceSampling(false)
+	}()
+	device, controller, _ := r.connect(0x1, 0)
+	defer device.Close()
+	packetIns := func(n int) {
+		for i := 0; i < n; i++ {
+			device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64))
+		}
+	}
+
+	// Driven to the first threshold by the wedged end point, its queue is
+	// shrunk, so the packet ins that follow are dropped
+	packetIns(70)
+	waitFor(t, "70 packet ins queued", func() bool { return len(wedged.queue) == 70 })
+	r.app.pressure.evaluate()
+	dropped := connections.PressureDropped()
+	packetIns(5)
+	waitFor(t, "5 packet ins dropped", func() bool { return connections.PressureDropped()-dropped == 5 })
+	if len(wedged.queue) != 70 || connections.QueueLimit() != PressureQueueLimit {
+		t.Errorf("Expected the queue shrunk to %d, holding 70 messages, got %d", PressureQueueLimit, len(wedged.queue))
+	}
+
+	// Then the observations are suspended, end points are forced to sample
+	// and finally packet ins are only proxied
+	for _, engaged := range []func() bool{
+		r.app.api.ObservationsSuspended,
+		connections.SamplingForced,
+		r.app.pressure.proxyOnly,
+	} {
+		other += 10000
+		r.app.pressure.evaluate()
+		if !engaged() {
+			t.Errorf("Expected step %d taken", r.app.pressure.Step()+1)
+		}
+	}
+	dropped = connections.PressureDropped()
+	proxied := len(controller.Messages())
+	packetIns(2)
+	controller.WaitMessages(t, proxied+2)
+	if connections.PressureDropped() != dropped {
+		t.Error("Expected the packet ins only proxied")
+	}
+
+	// Recovered in reverse order as memory falls
+	for len(wedged.queue) > 0 {
+		<-wedged.queue
+	}
+	other = 0
+	r.app.pressure.evaluate()
+	expected := []string{
+		"shrink_queues true", "no_history true", "sampling true", "proxy_only true",
+		"proxy_only false", "sampling false", "no_history false", "shrink_queues false",
+	}
+	if !reflect.DeepEqual(taken, expected) {
+		t.Errorf("Expected the ladder taken in order, and reverted in reverse, got %v", taken)
+	}
+	if connections.QueueLimit() != 0 || connections.SamplingForced() || r.app.api.ObservationsSuspended() || r.app.pressure.proxyOnly() {
+		t.Error("Expected every step reverted")
+	}
+}
+
+func TestMemoryLadderHysteresis(t *testing.T) {
+	var used uint64
+	var taken []int
+	l := newMemoryLadder(1000, func() uint64 { return used }, func(step int, engaged bool) {
+		if engaged {
+			taken = append(taken, step)
+		} else {
+			taken = append(taken, -step)
+		}
+	})
+
+	// A step is only reverted once well below its threshold, and steps
+	// are taken at once when memory jumps
+	for _, test := range []struct {
+		used uint64
+		step int
+	}{
+		{700, memoryShrinkQueues},
+		{650, memoryShrinkQueues},
+		{620, memoryNormal},
+		{950, memorySampling},
+		{0, memoryNormal},
+	} {
+		used = test.used
+		l.evaluate()
+		if l.Step() != test.step {
+			t.Errorf("Expected step %d at %d bytes, got %d", test.step, test.used, l.Step())
+		}
+	}
+	if expected := []int{1, -1, 1, 2, 3, -3, -2, -1}; !reflect.DeepEqual(taken, expected) {
+		t.Errorf("Expected steps %v, got %v", expected, taken)
+	}
+	if gauges := l.Gauges(); len(gauges) != 4 || gauges[0].Value != 0 {
+		t.Errorf("Expected the step gauged, got %v", gauges)
+	}
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"github.com/ciena/oftee/api"
+	"github.com/ciena/oftee/connections"
+	of "github.com/netrack/openflow"
+)
+
+// gauges returns the metrics exposed in the Prometheus text format
+func (app *App) gauges() []api.Gauge {
+	gauges := append(append(peaks.Gauges(), app.compareGauges()...), app.api.HandshakeGauges()...)
+	gauges = append(append(gauges, app.pressure.Gauges()...), buffers.Gauges()...)
+	gauges = append(gauges, app.deviceGauges()...)
+	return append(gauges, app.endpointGauges()...)
+}
+
+// messageTypeName returns the name of an OpenFlow message type by which its
+// metrics are labeled, i.e. `packet_in`
+func messageTypeName(ofType of.Type) string {
+	var name bytes.Buffer
+	for i, r := range strings.TrimPrefix(ofType.String(), "Type") {
+		if i > 0 && unicode.IsUpper(r) {
+			name.WriteByte('_')
+		}
+		name.WriteRune(unicode.ToLower(r))
+	}
+	return name.String()
+}
+
+// deviceGauges returns the number of connected devices and, as counters, the
+// messages received from each device by type, which are those proxied to the
+// SDN controller, and the bytes received from and sent to it. The counters
+// are labeled with the device, its DPID once known, otherwise its remote
+// address, and are no longer exposed once it disconnects.
+func (app *App) deviceGauges() []api.Gauge {
+	sessions := app.sessions.list()
+	gauges := []api.Gauge{{
+		Name:  "oftee_device_connections",
+		Help:  "number of connected devices",
+		Value: float64(len(sessions)),
+	}}
+	for _, sess := range sessions {
+		for ofType := range sess.types {
+			if count := atomic.LoadUint64(&sess.types[ofType]); count > 0 {
+				gauges = append(gauges, api.Gauge{
+					Name:    "oftee_device_messages_total",
+					Help:    "number of OpenFlow messages received from a device, by type",
+					Labels:  map[string]string{"device": sess.device(), "type": messageTypeName(of.Type(ofType))},
+					Value:   float64(count),
+					Counter: true,
+				})
+			}
+		}
+	}
+	for _, metric := range []struct {
+		name  string
+		help  string
+		value func(*session) uint64
+	}{
+		{"oftee_device_received_bytes_total", "number of bytes received from a device",
+			func(s *session) uint64 { return atomic.LoadUint64(&s.bytes) }},
+		{"oftee_device_sent_bytes_total", "number of bytes sent to a device, from the SDN controller or injected",
+			func(s *session) uint64 { return atomic.LoadUint64(&s.sent) }},
+	} {
+		for _, sess := range sessions {
+			gauges = append(gauges, api.Gauge{
+				Name:    metric.name,
+				Help:    metric.help,
+				Labels:  map[string]string{"device": sess.device()},
+				Value:   float64(metric.value(sess)),
+				Counter: true,
+			})
+		}
+	}
+	return gauges
+}
+
+// endpointGauges returns, as counters, the messages, and bytes, tee-ed to
+// each shared end point, those dropped, including by sampling and its rate
+// limit, the failed writes and the attempts to re-establish its connection,
+// labeled with the end point
+func (app *App) endpointGauges() []api.Gauge {
+	if !app.ShareConnections {
+		return nil
+	}
+	stats := app.sharedEndpoints().Stats()
+	var gauges []api.Gauge
+	for _, metric := range []struct {
+		name  string
+		help  string
+		value func(connections.EndpointStats) uint64
+	}{
+		{"oftee_endpoint_messages_total", "number of messages tee-ed to an end point",
+			func(s connections.EndpointStats) uint64 { return s.Matches }},
+		{"oftee_endpoint_bytes_total", "number of bytes tee-ed to an end point",
+			func(s connections.EndpointStats) uint64 { return s.Bytes }},
+		{"oftee_endpoint_dropped_total", "number of messages tee-ed to an end point that were dropped",
+			func(s connections.EndpointStats) uint64 { return s.Dropped }},
+		{"oftee_endpoint_sample_dropped_total", "number of messages matched by an end point that were dropped by sampling",
+			func(s connections.EndpointStats) uint64 { return s.SampleDropped }},
+		{"oftee_endpoint_rate_dropped_total", "number of messages matched by an end point that were dropped by its rate limit",
+			func(s connections.EndpointStats) uint64 { return s.RateDropped }},
+		{"oftee_endpoint_errors_total", "number of writes to an end point that failed",
+			func(s connections.EndpointStats) uint64 { return s.Errors }},
+		{"oftee_endpoint_reconnects_total", "number of attempts to re-establish the connection to an end point",
+			func(s connections.EndpointStats) uint64 { return s.Reconnects }},
+	} {
+		for _, endpoint := range stats {
+			gauges = append(gauges, api.Gauge{
+				Name:    metric.name,
+				Help:    metric.help,
+				Labels:  map[string]string{"endpoint": endpoint.Endpoint},
+				Value:   float64(metric.value(endpoint)),
+				Counter: true,
+			})
+		}
+	}
+	return gauges
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ciena/oftee/internal/harness"
+	of "github.com/netrack/openflow"
+)
+
+func TestMessageTypeName(t *testing.T) {
+	for ofType, expected := range map[of.Type]string{
+		of.TypePacketIn:            "packet_in",
+		of.TypeFeaturesReply:       "features_reply",
+		of.TypeMeterMod:            "meter_mod",
+		of.TypeMultipartReply:      "multipart_reply",
+		of.TypeEchoRequest:         "echo_request",
+		of.TypeBarrierRequest:      "barrier_request",
+		of.TypeQueueGetConfigReply: "queue_get_config_reply",
+	} {
+		if name := messageTypeName(ofType); name != expected {
+			t.Errorf("Expected %s, got %s", expected, name)
+		}
+	}
+}
+
+func TestMetricsMoveWithMessages(t *testing.T) {
+	eapol := harness.NewTCPEndpoint(t)
+	defer eapol.Stop()
+	r := newRig(t, eapol.Spec("dl_type=0x888e"))
+	defer r.close()
+	r.app.api.Gauges = r.app.gauges
+	device, controller, _ := r.connect(0x1, 0)
+	defer device.Close()
+	metrics := func() string {
+		return httpGet(t, r.app.api, "/metrics").Body.String()
+	}
+	expect := func(lines ...string) {
+		t.Helper()
+		got := metrics()
+		for _, line := range lines {
+			if !strings.Contains(got, line+"\n") {
+				t.Errorf("Expected metric %s, got\n%s", line, got)
+			}
+		}
+	}
+
+	// Labeled by DPID once learned from the features reply
+	features := controller.Messages()[0]
+	expect(
+		"oftee_device_connections 1",
+		`oftee_device_messages_total{device="of:0x0000000000000001",type="features_reply"} 1`,
+		fmt.Sprintf(`oftee_device_received_bytes_total{device="of:0x0000000000000001"} %d`, len(features.Raw)),
+		fmt.Sprintf(`oftee_endpoint_messages_total{endpoint="%s"} 0`, eapol.Addr()),
+		"# TYPE oftee_total_buffer_bytes gauge",
+	)
+
+	// Packet ins are counted as proxied, and as tee-ed to the end point
+	// that matches, and messages from the controller as sent
+	packetIns := []harness.Message{
+		device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64)),
+		device.SendPacketIn(1, harness.EthernetFrame(0x0806, 64)),
+	}
+	controller.WaitMessages(t, 3)
+	eapol.Frames.WaitFrames(t, 1)
+	echo := harness.NewMessage(t, of.TypeEchoRequest, 1, nil)
+	controller.Conn.Write(echo.Raw)
+	device.Received.WaitMessages(t, 1)
+	waitFor(t, "the echo request counted", func() bool {
+		return strings.Contains(metrics(), fmt.Sprintf(`oftee_device_sent_bytes_total{device="of:0x0000000000000001"} %d`, len(echo.Raw)))
+	})
+	expect(
+		`oftee_device_messages_total{device="of:0x0000000000000001",type="packet_in"} 2`,
+		fmt.Sprintf(`oftee_device_received_bytes_total{device="of:0x0000000000000001"} %d`, len(features.Raw)+len(packetIns[0].Raw)+len(packetIns[1].Raw)),
+		fmt.Sprintf(`oftee_endpoint_messages_total{endpoint="%s"} 1`, eapol.Addr()),
+		fmt.Sprintf(`oftee_endpoint_errors_total{endpoint="%s"} 0`, eapol.Addr()),
+		"# TYPE oftee_device_messages_total counter",
+	)
+
+	// No longer exposed once the device disconnects
+	device.Close()
+	waitFor(t, "the device disconnected", func() bool {
+		return strings.Contains(metrics(), "oftee_device_connections 0\n")
+	})
+	if strings.Contains(metrics(), "oftee_device_messages_total") {
+		t.Error("Expected the counters of the device no longer exposed")
+	}
+}
@@ -0,0 +1,2863 @@
+// Package proxy is the OpenFlow tee proxy, which proxies OpenFlow devices to
+// SDN controllers while tee-ing the messages that match to end points. It is
+// run by the oftee command, configured from the environment, and may be
+// embedded by other programs, see `New`.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciena/oftee/api"
+	"github.com/ciena/oftee/config"
+	"github.com/ciena/oftee/connections"
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/datapath"
+	"github.com/ciena/oftee/enrich"
+	"github.com/ciena/oftee/events"
+	"github.com/ciena/oftee/hooks"
+	"github.com/ciena/oftee/injector"
+	"github.com/ciena/oftee/journal"
+	"github.com/ciena/oftee/packetin"
+	"github.com/ciena/oftee/spool"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	of "github.com/netrack/openflow"
+	"github.com/netrack/openflow/ofp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ReadBufferSize size of the pooled buffers in which messages are
+	// assembled, and of the read buffer of a chained connection, unless
+	// configured, see `App.BufferSize`
+	ReadBufferSize = 2048
+
+	// OFVersion10 wire version of OpenFlow 1.0, whose packet ins are
+	// decoded by their own layout
+	OFVersion10 = 0x01
+
+	// OFVersion13 wire version of OpenFlow 1.3, the version whose message
+	// bodies are decoded
+	OFVersion13 = 0x04
+
+	// Built in URL schemes, others may be registered, see
+	// `connections.RegisterScheme`
+
+	// SchemeTCP prefex for TCP URI scheme
+	SchemeTCP = connections.SchemeTCP
+
+	// SchemeHTTP prefex for HTTP URI scheme
+	SchemeHTTP = connections.SchemeHTTP
+
+	// SchemeHTTPS prefex for HTTPS URI scheme
+	SchemeHTTPS = connections.SchemeHTTPS
+
+	// SchemeKafka prefex for Kafka URI scheme
+	SchemeKafka = connections.SchemeKafka
+
+	// SchemeGRPC prefex for gRPC URI scheme
+	SchemeGRPC = connections.SchemeGRPC
+
+	// SchemeGRPCS prefex for gRPC over TLS URI scheme
+	SchemeGRPCS = connections.SchemeGRPCS
+
+	// SchemeTLS prefex for the TLS URI scheme of the SDN controller
+	SchemeTLS = "tls"
+
+	// SchemeUnix prefex for unix domain socket URI scheme
+	SchemeUnix = connections.SchemeUnix
+
+	// SchemePcap prefex for pcap file URI scheme
+	SchemePcap = connections.SchemePcap
+
+	// Supported end point configuration terms
+
+	// TermAction term used in match / action to depict an action
+	TermAction = "action"
+
+	// TermDLType term use in match / action to depict a dl_type match
+	TermDLType = "dl_type"
+
+	// TermDLVlan term used in match to depict the VLAN ID of an 802.1Q
+	// tagged packet
+	TermDLVlan = "dl_vlan"
+
+	// TermDLSrc term used in match to depict the source Ethernet address,
+	// or masked address, of a packet
+	TermDLSrc = "dl_src"
+
+	// TermDLDst term used in match to depict the destination Ethernet
+	// address, or masked address, of a packet
+	TermDLDst = "dl_dst"
+
+	// TermICMPv6Type term used in match to depict the type of an ICMPv6
+	// message
+	TermICMPv6Type = "icmpv6_type"
+
+	// TermPppoeCode term used in match to depict the code of a PPPoE
+	// packet, i.e. `padi`
+	TermPppoeCode = "pppoe_code"
+
+	// TermNwProto term used in match to depict the protocol of an IPv4
+	// packet, i.e. `udp` or 17
+	TermNwProto = "nw_proto"
+
+	// TermNwSrc term used in match to depict the prefix, or address,
+	// within which the source address of an IPv4 packet must be
+	TermNwSrc = "nw_src"
+
+	// TermNwDst term used in match to depict the prefix, or address,
+	// within which the destination address of an IPv4 packet must be
+	TermNwDst = "nw_dst"
+
+	// TermTpSrc term used in match to depict the source port of a TCP or
+	// UDP segment carried by an IPv4 packet
+	TermTpSrc = "tp_src"
+
+	// TermTpDst term used in match to depict the destination port of a
+	// TCP or UDP segment carried by an IPv4 packet
+	TermTpDst = "tp_dst"
+
+	// TermInPort term used in match to depict the switch port, or range
+	// of ports, on which a packet in was received
+	TermInPort = "in_port"
+
+	// TermDPID term used in match to depict the DPID, list of DPIDs or
+	// masked DPID, of the devices from which messages are matched
+	TermDPID = "dpid"
+
+	// TermOFType term used in match to depict the type of OpenFlow message
+	// tee-ed, `packet_in`, the default, `error`, `flow_removed`,
+	// `port_status` or, from the controller, `flow_mod` or `group_mod`
+	TermOFType = "of_type"
+
+	// TermProto term used in match to depict a protocol preset, which
+	// expands to a set of match criteria, i.e. `nd`
+	TermProto = "proto"
+
+	// TermDSCP term used to specify the DSCP marking of an end point
+	// connection
+	TermDSCP = "dscp"
+
+	// TermSource term used to specify the local address to which an end
+	// point connection is bound
+	TermSource = "source"
+
+	// TermResolveTTL term used to specify the interval at which the host
+	// name of an end point is re-resolved
+	TermResolveTTL = "resolve_ttl"
+
+	// TermProxy term used to specify the proxy via which an end point
+	// connection is established
+	TermProxy = "proxy"
+
+	// TermConnect term used to specify when an end point connection is
+	// established, either `lazy` or `eager`
+	TermConnect = "connect"
+
+	// Values for the connect term
+
+	// ConnectLazy establish the connection when first used
+	ConnectLazy = "lazy"
+
+	// ConnectEager establish the connection at startup
+	ConnectEager = "eager"
+
+	// TermWorkers term used to specify the number of concurrent workers
+	// delivering messages to an HTTP end point
+	TermWorkers = "workers"
+
+	// TermOrdered term used to specify that messages must be delivered
+	// to an HTTP end point in order, i.e. by a single worker
+	TermOrdered = "ordered"
+
+	// TermQueue term used to specify the number of messages that may be
+	// queued to an end point, beyond which the oldest are dropped
+	TermQueue = "queue"
+
+	// TermShadow term used to specify that an end point only counts the
+	// messages it matches, nothing is delivered and no connection is
+	// established
+	TermShadow = "shadow"
+
+	// TermLatencyBudget term used to specify the latency budget of an end
+	// point, the 99th percentile of the time messages spend queued
+	TermLatencyBudget = "latency_budget"
+
+	// TermDemote term used to specify how an end point that exceeds its
+	// latency budget is demoted, either `sample[:N]` or `pause`
+	TermDemote = "demote"
+
+	// TermBudgetWindow term used to specify the span of the sliding window
+	// over which the latency budget is evaluated
+	TermBudgetWindow = "budget_window"
+
+	// TermSample term used to specify that only one in every N messages
+	// matched by an end point is tee-ed to it
+	TermSample = "sample"
+
+	// TermRate term used to specify the maximum number of messages a
+	// second tee-ed to an end point, beyond which they are dropped
+	TermRate = "rate"
+
+	// TermStandby term used to specify the address of the warm standby
+	// connection of a TCP end point
+	TermStandby = "standby"
+
+	// TermFailback term used to specify how long the primary connection
+	// of an end point with a standby must be healthy before delivery fails
+	// back to it
+	TermFailback = "failback"
+
+	// TermDurable term used to specify that messages to an end point are
+	// spooled to disk and delivered at least once
+	TermDurable = "durable"
+
+	// TermFsync term used to specify when the spool of a durable end point
+	// is flushed to disk, `always`, `never` or an interval
+	TermFsync = "fsync"
+
+	// TermSpool term used to specify the name of the directory, within
+	// `SPOOL_DIR`, of the spool of a durable end point
+	TermSpool = "spool"
+
+	// TermAck term used to specify that delivery to a TCP end point is
+	// acknowledged by the consumer
+	TermAck = "ack"
+
+	// TermAckWindow term used to specify the number of unacknowledged
+	// messages kept for retransmission to a TCP end point
+	TermAckWindow = "ack_window"
+
+	// TermTxnGroup term used to specify the transaction group of an end
+	// point, the members of a group are written all or nothing
+	TermTxnGroup = "txn_group"
+
+	// TermJournal term used to specify the file to which the messages
+	// delivered to an end point are recorded
+	TermJournal = "journal"
+
+	// TermCompareGroup term used to specify the compare group of an end
+	// point, the messages delivered by the members of a group are compared
+	TermCompareGroup = "compare_group"
+
+	// TermHeader term used to specify a header, `Name:Value` with the value
+	// URL encoded, sent with each request to an HTTP end point. May be
+	// repeated.
+	TermHeader = "header"
+
+	// TermKafkaKey term used to specify the key of the records produced to
+	// a Kafka end point, either `dpid` or `none`
+	TermKafkaKey = "kafka_key"
+
+	// Values for the Kafka key term
+
+	// KafkaKeyDPID key records by the DPID of the device
+	KafkaKeyDPID = connections.KafkaKeyDPID
+
+	// KafkaKeyNone records are not keyed
+	KafkaKeyNone = connections.KafkaKeyNone
+
+	// TermPreamble term used to specify the preamble written to a TCP end
+	// point each time it is connected, either `json` or `none`
+	TermPreamble = "preamble"
+
+	// Values for the preamble term
+
+	// PreambleJSON write a length prefixed JSON record identifying the
+	// instance and the end point
+	PreambleJSON = "json"
+
+	// PreambleNone write no preamble
+	PreambleNone = "none"
+
+	// TermEncode term used to specify how the messages tee-ed to an HTTP,
+	// Kafka, or TCP, end point are encoded, either `raw`, `json` or `proto`
+	TermEncode = "encode"
+
+	// Values for the encode term
+
+	// EncodeRaw deliver the messages as they are
+	EncodeRaw = "raw"
+
+	// EncodeJSON deliver each message wrapped in a JSON envelope
+	EncodeJSON = "json"
+
+	// EncodeProto deliver each packet in encoded as a protocol buffer
+	EncodeProto = "proto"
+
+	// TermRetries term used to specify the number of times a message whose
+	// post to an HTTP end point failed is retried, `HTTP_RETRIES` if not
+	// given
+	TermRetries = "retries"
+
+	// TermBackoff term used to specify the time before a message is first
+	// retried to an HTTP end point, doubled for each retry,
+	// `HTTP_RETRY_BACKOFF` if not given
+	TermBackoff = "backoff"
+
+	// TermDeadLetter term used to specify the directory to which the
+	// messages an HTTP end point gave up delivering are written, rather
+	// than dropped
+	TermDeadLetter = "deadletter"
+
+	// TermDirection term used to specify the direction of the OpenFlow
+	// messages tee-ed, those sent by the device, the default, or those
+	// sent by the controller to the device, `flow_mod` or `group_mod`
+	TermDirection = "direction"
+
+	// Values for the direction term
+
+	// DirectionDevice the messages sent by the device to the controller
+	DirectionDevice = "device"
+
+	// DirectionController the messages sent by the controller to the
+	// device
+	DirectionController = "controller"
+)
+
+// Version the version of oftee, identified to end points by their preamble,
+// set when built, i.e.
+// `-ldflags "-X github.com/ciena/oftee/proxy.Version=1.0.0"`
+var Version = "dev"
+
+// Config the configuration of the proxy, as resolved from the environment by
+// the oftee command, see `envconfig.Process`
+type Config struct {
+	ShowHelp         bool          `envconfig:"HELP" default:"false" desc:"show this message"`
+	ListenOn         string        `envconfig:"LISTEN_ON" default:":8000" required:"true" desc:"connection on which to listen for an open flow device, host:port or unix:///path"`
+	APIOn            string        `envconfig:"API_ON" default:":8002" required:"true" desc:"port on which to listen to accept API requests"`
+	ProxyTo          string        `envconfig:"PROXY_TO" default:":8001" required:"true" desc:"comma separated list of connections on which to attach to SDN controllers, host:port, tcp://host:port, tls://host:port or unix:///path"`
+	ProxyMode        string        `envconfig:"PROXY_MODE" default:"all" desc:"how devices are proxied given more than one SDN controller, to all of them or, with failover, to the first that can be connected, failing over to the next"`
+	ProxyDisabled    bool          `envconfig:"PROXY_DISABLED" default:"false" desc:"complete the OpenFlow handshake with devices locally rather than proxy to an SDN controller"`
+	TeeTo            []string      `envconfig:"TEE_TO" desc:"list of connections on which tee packet in messages"`
+	TeeRawPackets    bool          `envconfig:"TEE_RAW" default:"false" desc:"only tee raw packets to the client, openflow headers not included"`
+	LogLevel         string        `envconfig:"LOG_LEVEL" default:"debug" desc:"logging level"`
+	LogFile          string        `envconfig:"LOG_FILE" desc:"file to which to write log output, rotated as it grows, instead of stderr"`
+	LogMaxSize       int           `envconfig:"LOG_MAX_SIZE" default:"100" desc:"size, in megabytes, at which the log file is rotated"`
+	LogMaxBackups    int           `envconfig:"LOG_MAX_BACKUPS" default:"5" desc:"number of rotated log files to keep, 0 to keep all"`
+	LogMaxAge        int           `envconfig:"LOG_MAX_AGE" default:"28" desc:"days for which to keep rotated log files, 0 to keep all"`
+	LogAlsoStderr    bool          `envconfig:"LOG_ALSO_STDERR" default:"false" desc:"write log output to stderr as well as to the log file"`
+	ShareConnections bool          `envconfig:"SHARE_CONNECTIONS" default:"true" desc:"use shared connections to outbound end points"`
+	CPUProfile       string        `envconfig:"CPU_PROFILE" default:"cpu.pprof" desc:"file to which to write CPU profile data"`
+	MemProfile       string        `envconfig:"MEM_PROFILE" default:"mem.pprof" desc:"file to which to write MEM profile data"`
+	ControllerDSCP   string        `envconfig:"CONTROLLER_DSCP" desc:"DSCP marking, name or number, for connections to the SDN controller"`
+	ControllerSource string        `envconfig:"CONTROLLER_SOURCE_ADDR" desc:"local IP address to which connections to the SDN controller are bound"`
+	LazyEndpoints    bool          `envconfig:"LAZY_ENDPOINTS" default:"false" desc:"establish connections to outbound end points when first used, rather than at startup"`
+	ControllerProxy  string        `envconfig:"CONTROLLER_PROXY" desc:"proxy, socks5://[user:password@]host:port or http://host:port, via which to connect to the SDN controller"`
+	ChainListenOn    string        `envconfig:"CHAIN_LISTEN_ON" desc:"connection on which to listen for tee streams from other oftee instances"`
+	ChainEncode      string        `envconfig:"CHAIN_ENCODE" default:"raw" desc:"encoding, raw, json or proto, of the tee streams from chained instances, that of the tcp end points to which they tee"`
+	ChainMaxHops     uint32        `envconfig:"CHAIN_MAX_HOPS" default:"4" desc:"number of chained instances by which a message may have been tee-ed, past which it is rejected as looping"`
+	GRPCListenOn     string        `envconfig:"GRPC_LISTEN_ON" desc:"port on which to listen to accept gRPC API requests"`
+	StaleDeviceGrace time.Duration `envconfig:"STALE_DEVICE_GRACE" default:"30s" desc:"time after which a device that is no longer connected is removed, 0 to never remove"`
+	InjectBatchBytes int           `envconfig:"INJECT_BATCH_BYTES" default:"65536" desc:"maximum size of a batch of packet outs written to a device, 0 to disable batching"`
+	InjectFlushDelay time.Duration `envconfig:"INJECT_FLUSH_DELAY" default:"1ms" desc:"maximum time a packet out waits to be batched with others"`
+	EnrichURL        string        `envconfig:"ENRICH_URL" desc:"URL of the HTTP service from which to look up the enrichment of a device port"`
+	EnrichTTL        time.Duration `envconfig:"ENRICH_TTL" default:"5m" desc:"time for which the enrichment of a device port is cached"`
+	EnrichCacheSize  int           `envconfig:"ENRICH_CACHE_SIZE" default:"10000" desc:"maximum number of device ports for which the enrichment is cached"`
+	WebhookURL       []string      `envconfig:"WEBHOOK_URL" desc:"list of webhooks to notify of device and end point events"`
+	WebhookAuth      string        `envconfig:"WEBHOOK_AUTH" desc:"value of the Authorization header sent to webhooks that do not specify their own"`
+	ReadBufferMax    int           `envconfig:"READ_BUFFER_MAX" default:"2048" desc:"maximum size of the read buffer of a device connection, grown from 256 bytes only for devices that send large messages"`
+	BufferSize       int           `envconfig:"BUFFER_SIZE" default:"2048" desc:"size of the pooled buffers in which messages are assembled, and of the read buffer of a chained connection, grown for larger messages"`
+	SpoolDir         string        `envconfig:"SPOOL_DIR" default:"/var/spool/oftee" desc:"directory in which the spools of durable end points are kept"`
+	SpoolSegmentSize int64         `envconfig:"SPOOL_SEGMENT_SIZE" default:"67108864" desc:"size, in bytes, at which a new spool segment file is started"`
+	SpoolMaxSize     int64         `envconfig:"SPOOL_MAX_SIZE" default:"1073741824" desc:"size, in bytes, of the spool of a durable end point at which its oldest segment is evicted, losing messages"`
+	SpoolFsync       string        `envconfig:"SPOOL_FSYNC" default:"always" desc:"when spools are flushed to disk, always, never or an interval, i.e. 1s"`
+	StatsLogInterval time.Duration `envconfig:"STATS_LOG_INTERVAL" default:"0" desc:"interval at which a summary of the statistics and high-water marks is logged, 0 to disable"`
+	ConfigFile       string        `envconfig:"CONFIG_FILE" desc:"file of NAME=value lines that override the environment, or YAML or JSON file overridden by it, re-read when the configuration is reloaded"`
+	RequiredSubsys   []string      `envconfig:"SUBSYSTEM_REQUIRED" desc:"list of subsystems, api, listener, endpoints, grpc or chain, whose failure terminates the process rather than being retried"`
+	MessageAPITypes  []string      `envconfig:"MESSAGE_API_TYPES" desc:"list of controller-to-switch message types, i.e. meter_mod, that can be injected via the message API, none if empty"`
+	InjectXIDBase    int64         `envconfig:"INJECT_XID_BASE" default:"0xfff00000" desc:"first transaction ID of the range reserved for the messages injected via the API, which the SDN controller must not use"`
+	InjectXIDRange   int64         `envconfig:"INJECT_XID_RANGE" default:"1048576" desc:"number of transaction IDs in the range reserved for the messages injected via the API"`
+	JournalMaxSize   int           `envconfig:"JOURNAL_MAX_SIZE" default:"100" desc:"size, in megabytes, at which the journal of an end point is rotated"`
+	JournalBackups   int           `envconfig:"JOURNAL_MAX_BACKUPS" default:"5" desc:"number of rotated journal files of an end point to keep, 0 to keep all"`
+	APIAuth          string        `envconfig:"API_AUTH" desc:"bearer token required by the flow table, disconnect and drain APIs, which are disabled if empty, and by packet outs, injected messages and flows if set"`
+	CompareWindow    int           `envconfig:"COMPARE_WINDOW" default:"10000" desc:"number of messages a compare group keeps while waiting for every member to deliver them"`
+	CompareTolerance time.Duration `envconfig:"COMPARE_TOLERANCE" default:"1s" desc:"time within which every member of a compare group must deliver a message, or it is counted as divergent"`
+	EchoLocal        bool          `envconfig:"ECHO_LOCAL" default:"false" desc:"answer the echo requests of a device while its connection to the SDN controller is re-established, rather than drop them"`
+	ProxyBufferSize  int           `envconfig:"CONTROLLER_BUFFER_SIZE" default:"0" desc:"maximum size, in bytes, of the messages from a device buffered while its connection to the SDN controller is re-established, 0 to drop them"`
+	InstanceID       string        `envconfig:"INSTANCE_ID" desc:"identity of the instance written in the preamble of TCP end points and the oftee_instance header of Kafka records, the host name if empty"`
+	MemoryCeiling    int64         `envconfig:"MEMORY_CEILING" default:"0" desc:"bytes of heap in use as it approaches which the process degrades, until packet ins are only proxied at the ceiling, 0 to never degrade"`
+	DrainTimeout     time.Duration `envconfig:"DRAIN_TIMEOUT" default:"10s" desc:"time given to the device connections to finish the message being handled, and to the end points to deliver the messages queued to them, when terminated"`
+	HTTPTimeout      time.Duration `envconfig:"HTTP_TIMEOUT" default:"10s" desc:"time within which a request to an HTTP end point must complete"`
+	HTTPRetries      int           `envconfig:"HTTP_RETRIES" default:"2" desc:"number of times a message whose post to an HTTP end point failed is retried before it is dropped"`
+	HTTPRetryBackoff time.Duration `envconfig:"HTTP_RETRY_BACKOFF" default:"100ms" desc:"time before a message is first retried to an HTTP end point, doubled for each retry"`
+	HTTPCAFile       string        `envconfig:"HTTP_CA_FILE" desc:"file of PEM encoded CA certificates trusted by HTTPS end points, the system's if empty"`
+	HTTPCertFile     string        `envconfig:"HTTP_CERT_FILE" desc:"file of the PEM encoded client certificate presented to HTTPS end points, none if empty"`
+	HTTPKeyFile      string        `envconfig:"HTTP_KEY_FILE" desc:"file of the PEM encoded private key of the client certificate presented to HTTPS end points"`
+	ListenCert       string        `envconfig:"LISTEN_CERT_FILE" desc:"file of the PEM encoded server certificate presented to devices, which connect over TLS if set"`
+	ListenKey        string        `envconfig:"LISTEN_KEY_FILE" desc:"file of the PEM encoded private key of the server certificate presented to devices"`
+	ListenCA         string        `envconfig:"LISTEN_CA_FILE" desc:"file of PEM encoded CA certificates by which the client certificates of devices are verified"`
+	ListenClientAuth bool          `envconfig:"LISTEN_CLIENT_AUTH" default:"false" desc:"reject devices that don't present a client certificate verified by LISTEN_CA_FILE"`
+	ControllerCA     string        `envconfig:"CONTROLLER_CA_FILE" desc:"file of PEM encoded CA certificates trusted by tls:// SDN controller connections, the system's if empty"`
+	ControllerCert   string        `envconfig:"CONTROLLER_CERT_FILE" desc:"file of the PEM encoded client certificate presented to a tls:// SDN controller, none if empty"`
+	ControllerKey    string        `envconfig:"CONTROLLER_KEY_FILE" desc:"file of the PEM encoded private key of the client certificate presented to a tls:// SDN controller"`
+	OFVersions       []string      `envconfig:"OF_VERSIONS" default:"1.0,1.3,1.4,1.5" desc:"list of OpenFlow versions, i.e. 1.3, devices may use, those that use another are disconnected"`
+	Hooks            *hooks.Hooks  `ignored:"true"`
+
+	// Endpoints the end points of a structured configuration file, in the
+	// order of, and equivalent to, the specifications of `TeeTo`, nil if
+	// they are only given by specifications
+	Endpoints []config.Endpoint `ignored:"true"`
+}
+
+// App Maintains the application configuration and runtime state
+type App struct {
+	Config
+
+	listener         net.Listener
+	endpoints        connections.Endpoints
+	endpointIDs      []string
+	lastEndpointID   uint64
+	endpointsLock    sync.RWMutex
+	reloads          reloadStats
+	api              *api.API
+	controllerDSCP   int
+	controllerSource net.Addr
+	controllerProxy  *url.URL
+	notifier         *events.Notifier
+	enricher         *enrich.Enricher
+	annotator        *connections.Annotator
+	durables         map[string]*connections.DurableConnection
+	durablesLock     sync.Mutex
+	txnGroups        connections.TxnGroups
+	journals         journal.Journals
+	compareGroups    connections.CompareGroups
+	subsystems       subsystems
+	controllers      controllerStates
+	forceLazy        bool
+	pressure         *memoryLadder
+	handlers         sync.WaitGroup
+	sessions         sessionSet
+	draining         int32
+	drainRejected    uint64
+	messageTypes     map[of.Type]bool
+	ofVersions       uint32
+	stop             context.CancelFunc
+	failure          error
+	failureLock      sync.Mutex
+}
+
+// OpenFlowContext provides context for OF packet in messages
+type OpenFlowContext struct {
+	DatapathID uint64
+	Port       uint32
+}
+
+func (c *OpenFlowContext) String() string {
+	return fmt.Sprintf("[%s, 0x%04x]", datapath.Format(c.DatapathID), c.Port)
+}
+
+// Len returns the length of the OpenFlowContext
+func (c *OpenFlowContext) Len() uint16 {
+	return 12
+}
+
+// WriteTo writes the open flow context to the provided writer
+func (c *OpenFlowContext) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint64(buf, c.DatapathID)
+	binary.BigEndian.PutUint32(buf[8:], c.Port)
+	val, err := w.Write(buf)
+	return int64(val), err
+}
+
+// TruncatedError a message from a device whose connection ended before the
+// number of bytes given by the length in its header were read
+type TruncatedError struct {
+	Type     of.Type
+	Expected int64
+	Actual   int64
+}
+
+// Error returns the type of the message and its expected and actual lengths
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("truncated %s message, expected %d bytes, read %d", e.Type, e.Expected, e.Actual)
+}
+
+// truncation returns a `TruncatedError` if `err` shows that the connection
+// ended after `read` bytes of a message, otherwise `err`
+func truncation(header of.Header, read int64, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &TruncatedError{Type: header.Type, Expected: int64(header.Length), Actual: read}
+	}
+	return err
+}
+
+// readRemainder copies the remainder of a message from a device, those bytes
+// that follow the `read` bytes already read, to `dst`. Unless all of them are
+// copied an error is returned, a `TruncatedError` if the connection ended
+// first, so the next message is never read from the middle of this one.
+func readRemainder(dst io.Writer, src io.Reader, header of.Header, read int64) error {
+	n, err := io.CopyN(dst, src, int64(header.Length)-read)
+	return truncation(header, read+n, err)
+}
+
+// Why or why does Go not have a simply int minimum function, ok, i get it,
+// proverb A little copying is better than a little dependency, but this could
+// be part of a standard lib
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (app *App) cleanup() {
+}
+
+func (app *App) removeInjector(dpid uint64, inject injector.Injector, sess *session) {
+	app.api.DPIDMappingListener <- api.DPIDMapping{
+		Action:  api.MapActionDelete,
+		DPID:    dpid,
+		Inject:  inject,
+		Session: sess,
+	}
+}
+
+// notify sends a device event to the configured webhooks, if any
+func (app *App) notify(eventType string, dpid uint64, sess *session) {
+	if app.notifier == nil {
+		return
+	}
+	event := events.Event{
+		Type:       eventType,
+		DPID:       datapath.Format(dpid),
+		RemoteAddr: sess.conn.RemoteAddr().String(),
+		Timestamp:  time.Now(),
+	}
+	if eventType == events.TypeDeviceDisconnected {
+		event.SessionStats = sess.Stats()
+	}
+	app.notifier.Notify(event)
+}
+
+// notifyFailover sends a controller failover event, for the device of a
+// session, to the configured webhooks, if any
+func (app *App) notifyFailover(sess *session, from, to string) {
+	if app.notifier == nil {
+		return
+	}
+	app.notifier.Notify(events.Event{
+		Type:               events.TypeControllerFailover,
+		DPID:               datapath.Format(atomic.LoadUint64(&sess.dpid)),
+		RemoteAddr:         sess.conn.RemoteAddr().String(),
+		Controller:         to,
+		PreviousController: from,
+	})
+}
+
+// notifyBudget sends an end point demotion, or restoration, event to the
+// configured webhooks, if any
+func (app *App) notifyBudget(budget connections.BudgetEvent) {
+	eventType := events.TypeEndpointRestored
+	if budget.Demoted {
+		eventType = events.TypeEndpointDemoted
+	}
+	app.notifier.Notify(events.Event{
+		Type:     eventType,
+		Endpoint: budget,
+	})
+}
+
+// EstablishWebhooks creates the webhooks to which device events are sent and
+// starts their delivery
+func (app *App) EstablishWebhooks() (*events.Notifier, error) {
+	notifier := &events.Notifier{}
+	for _, spec := range app.WebhookURL {
+		webhook, err := events.ParseWebhook(spec, app.WebhookAuth)
+		if err != nil {
+			return nil, err
+		}
+		webhook.Initialize()
+		go webhook.ListenAndSend()
+		notifier.Targets = append(notifier.Targets, webhook)
+		log.
+			WithFields(log.Fields{
+				"webhook": webhook.URL,
+			}).
+			Debug("Established webhook")
+	}
+	return notifier, nil
+}
+
+// close wraps an io.Closer.Close call so that any error can be logged
+func close(c io.Closer) {
+	if err := c.Close(); err != nil {
+		log.
+			WithError(err).
+			Error("Error when attempting to close resource")
+	}
+}
+
+// Handle a single connection from a device
+//
+// Once the context is done the device is disconnected, once the message being
+// handled has been, or after the drain timeout, when the writes to the SDN
+// controller and the end points in flight are abandoned. Either way the
+// connection is cleaned up as if the device disconnected.
+func (app *App) handle(ctx context.Context, conn net.Conn, endpoints connections.Endpoints) error {
+
+	// Track the connection so that it can be forcibly disconnected, the
+	// session ends once all the cleanup below has completed
+	sess := newSession(conn)
+	logger := sess.Log()
+	info := hooks.ConnInfo{
+		RemoteAddr: conn.RemoteAddr().String(),
+		LocalAddr:  conn.LocalAddr().String(),
+		Connected:  sess.connected,
+	}
+	defer func() {
+		if reason := sess.Reason(); reason != "" {
+			logger.
+				WithFields(log.Fields{
+					"reason": reason,
+				}).
+				Info("Device forcibly disconnected")
+		}
+		sess.end()
+	}()
+	app.sessions.add(sess)
+	defer app.sessions.remove(sess)
+
+	// Once the context is done the connection is drained, so the message
+	// being handled is, but no further messages. Those still being
+	// delivered, to the SDN controller and the end points, are abandoned
+	// after the drain timeout.
+	abort, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-sess.done.Done():
+			return
+		}
+		sess.drain()
+		if app.DrainTimeout > 0 {
+			timer := time.NewTimer(app.DrainTimeout)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-sess.done.Done():
+				return
+			}
+		}
+		cancel()
+		sess.Disconnect(ctx.Err().Error())
+	}()
+
+	// Let the hooks know of the device
+	app.Hooks.Connect(info)
+
+	// Close the connection when we are no longer handling it
+	defer close(conn)
+
+	var (
+		err             error
+		buffer          *bytes.Buffer
+		header          of.Header
+		context         OpenFlowContext
+		hCount, piCount int64
+		packetIn        packetin.PacketIn
+		featuresReply   ofp.SwitchFeatures
+		learned         bool
+		versioned       bool
+	)
+
+	// Let the hooks know that the device has gone, once its connection
+	// has been cleaned up
+	defer func() {
+		stats := sess.Stats()
+		app.Hooks.Disconnect(info, hooks.DisconnectStats{
+			DPID:      context.DatapathID,
+			Duration:  time.Since(sess.connected),
+			Messages:  stats.Messages,
+			PacketIns: stats.PacketIns,
+			Bytes:     stats.Bytes,
+			Reason:    stats.Reason,
+		})
+	}()
+
+	// Notify any interested parties that the device has gone, once its
+	// connection has been cleaned up, if it was ever known by its DPID
+	defer func() {
+		if learned {
+			app.notify(events.TypeDeviceDisconnected, context.DatapathID, sess)
+		}
+	}()
+
+	// Create connection to SDN controller, or controllers, or when proxying
+	// is disabled to the local stand in that completes the handshake with
+	// the device. The connection to an SDN controller is re-established if
+	// it fails.
+	var proxy controllerProxy
+	var controller net.Conn
+	if app.ProxyDisabled {
+		var local net.Conn
+		local, controller = net.Pipe()
+		proxy = newControllerLink(abort, local, nil, 0, sess.Snoop, sess.Log)
+	} else {
+		if proxy, err = app.linkControllers(abort, sess); err != nil {
+			return err
+		}
+		sess.setController(proxy)
+	}
+
+	defer close(proxy)
+	inject := injector.NewOFDeviceInjectorWithBatching(injector.Batching{
+		MaxBytes:    app.InjectBatchBytes,
+		MaxMessages: injector.DefaultBatching.MaxMessages,
+		Delay:       app.InjectFlushDelay,
+	})
+	defer inject.Stop()
+	inject.SetLog(logger)
+	if device, ok := inject.(*injector.OFDeviceInjector); ok {
+		device.Snoop = sess.Snoop
+		device.Mirrored = func(header of.Header) bool {
+			return app.mirrored(endpoints, sess, header)
+		}
+		device.Mirror = func(message []byte) {
+			app.mirror(abort, endpoints, sess, message)
+		}
+	}
+	// The DPID is that learned by this handler, the injector only learns
+	// it asynchronously
+	defer func() {
+		app.removeInjector(context.DatapathID, sess.counting(inject), sess)
+	}()
+
+	// Complete the handshake with the device locally, the stand in stops
+	// once the connection to it is closed
+	if controller != nil {
+		go func() {
+			if err := localController(abort, controller, snoopedInjector{inject, sess.Snoop}); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF && err != io.ErrClosedPipe {
+				sess.Log().
+					WithError(err).
+					Error("Local controller failed")
+			}
+		}()
+	}
+
+	// Anything from the controller, just send to the device. The copy
+	// outlives the connection to the SDN controller, which is
+	// re-established when it fails.
+	go func(_conn net.Conn, _proxy controllerProxy, _inject injector.Injector) {
+		// If this fails, bad things are going to happen all over
+		// and we just need to drop the connection to device and
+		// have everything restart
+		if _, err := _inject.Copy(sess.counted(_conn), _proxy); err != nil && err != io.EOF {
+			sess.Log().
+				WithError(err).
+				WithFields(log.Fields{
+					"proxy": app.ProxyTo,
+				}).
+				Error("Communication from controller to device failed")
+
+			// Force the connection to close, which should
+			// cause the read loop below to fail out
+			if err = _conn.Close(); err != nil {
+				// Ignore
+			}
+		}
+	}(conn, proxy, inject)
+
+	// The read buffer is sized to the messages received, and accounted
+	// for along with the packet in buffer
+	acct := newConnBuffers(&buffers)
+	defer acct.release()
+	peaks.connected(atomic.LoadInt64(&buffers.connections), time.Now())
+	reader := newAdaptiveReader(conn, MinReadBufferSize, app.ReadBufferMax, acct)
+
+	// The message buffer is taken from the pool once a message's header
+	// has been read, and returned before the next is waited for
+	defer func() {
+		if buffer != nil {
+			messageBuffers.put(buffer)
+		}
+	}()
+	for {
+		if buffer != nil {
+			messageBuffers.put(buffer)
+			buffer = nil
+		}
+		acct.setPacket(0)
+
+		// Once drained the device is disconnected
+		if !sess.between() {
+			return nil
+		}
+		reader.fit(int(header.Length), time.Now())
+
+		// Read open flow header, if this does not work then we have
+		// a serious error, so fail fast and move on
+		hCount, err = header.ReadFrom(reader)
+		if sess.reading() && err != nil {
+			return nil
+		}
+		if err == io.EOF && hCount == 0 {
+			// The device closed its connection between messages
+			return nil
+		}
+		if err == nil && int64(header.Length) < hCount {
+			err = fmt.Errorf("invalid OpenFlow message length %d", header.Length)
+		}
+		if err != nil {
+			logger.
+				WithError(err).
+				Debug("Failed to read OpenFlow message header")
+			return err
+		}
+		buffer = messageBuffers.get(app.bufferSize())
+		acct.setPacket(buffer.Cap())
+		if !versioned {
+			versioned = true
+			logger = sess.learn(log.Fields{
+				"of_version": header.Version,
+			})
+			inject.SetLog(logger)
+		}
+
+		// Hellos offer the versions a device supports, every other
+		// message is of the version negotiated, which must be one
+		// that is allowed
+		if header.Type != of.TypeHello && !app.versionAllowed(header.Version) {
+			err = fmt.Errorf("OpenFlow version %s is not allowed", api.VersionName(header.Version))
+			logger.
+				WithFields(log.Fields{
+					"of_version": api.VersionName(header.Version),
+					"allowed":    strings.Join(app.OFVersions, ","),
+				}).
+				WithError(err).
+				Error("Disconnecting device of an OpenFlow version that is not allowed")
+			return err
+		}
+		sess.message(header.Type, header.Length)
+
+		// If we have a packet in message then this will be tee-ed
+		// to those end points that match, else we just proxy to
+		// the controller.
+		switch header.Type {
+		case of.TypePacketIn:
+			peaks.packetInReceived(int(header.Length), time.Now())
+			logger.
+				WithFields(log.Fields{
+					"of_message":     header.Type.String(),
+					"of_transaction": header.Transaction,
+					"length":         header.Length,
+					"header_length":  hCount,
+				}).
+				Debug("SENDING: all end-points")
+
+			// Reset the buffer to read the packet in message and
+			// write the headers to the buffer
+			buffer.Reset()
+			if _, err = context.WriteTo(buffer); err != nil {
+				logger.
+					WithError(err).
+					Error("Failed to write OpenFlow context to packet in buffer")
+				return err
+			}
+
+			if _, err = header.WriteTo(buffer); err != nil {
+				logger.
+					WithError(err).
+					Error("Failed to write OpenFlow header to packet in buffer")
+				return err
+			}
+
+			// The packet in is read completely, and then decoded
+			// by the layout of the OpenFlow version of the
+			// connection, as that of OpenFlow 1.0 differs from that
+			// of later versions. The packet is whatever remains of
+			// the message.
+			if err = readRemainder(buffer, reader, header, hCount); err != nil {
+				logger.
+					WithError(err).
+					Error("Failed to read OpenFlow Packet In message")
+				return err
+			}
+			version := sess.Version()
+			if version == 0 {
+				version = header.Version
+			}
+			message := buffer.Bytes()[context.Len():]
+			if packetIn, err = packetin.Decode(version, message); err != nil {
+				logger.
+					WithFields(log.Fields{
+						"of_version": version,
+					}).
+					WithError(err).
+					Error("Failed to decode OpenFlow Packet In message")
+				return err
+			}
+
+			// Look for the port in contained in the message, and
+			// set it in the context that precedes the message
+			context.Port = packetIn.InPort
+			binary.BigEndian.PutUint32(buffer.Bytes()[8:], context.Port)
+
+			// packet in to the SDN controller, unless proxying
+			// is disabled, and packet out to those end points
+			// that match the criteria
+			if !app.ProxyDisabled {
+				if _, err = proxy.Write(buffer.Bytes()[context.Len() : context.Len()+header.Length]); err != nil {
+					logger.
+						WithError(err).
+						Error("Unexpected error while writing packet to controller")
+					return err
+				}
+			}
+
+			logger.
+				WithFields(log.Fields{
+					"context":  context.String(),
+					"openflow": fmt.Sprintf("%02x", message[:packetIn.Offset]),
+					"packet":   fmt.Sprintf("%02x", packetIn.Data(message)),
+				}).
+				Debug("packet in")
+
+			// The hooks may suppress tee-ing the packet in
+			if !app.Hooks.PacketIn(hooks.PacketInMeta{
+				ConnInfo: info,
+				DPID:     context.DatapathID,
+				Port:     context.Port,
+				Length:   header.Length,
+				Received: time.Now(),
+			}, packetIn.Data(message)) {
+				logger.Debug("Tee suppressed by hook, not tee-ing packet in")
+				break
+			}
+
+			// Tee-ing may be disabled for the device, i.e. during
+			// maintenance, or for all devices as memory runs out
+			if !app.api.TeeEnabled(context.DatapathID) {
+				logger.Debug("Tee disabled for device, not tee-ing packet in")
+				break
+			}
+			if app.pressure.proxyOnly() {
+				logger.Debug("Memory ceiling reached, not tee-ing packet in")
+				break
+			}
+			if err = app.teePacketIn(abort, logger, app.liveEndpoints(endpoints), buffer.Bytes()[:context.Len()+header.Length], &packetIn, learned); err != nil {
+				logger.
+					WithError(err).
+					Error("Unexpected error while writing to TEE clients")
+				return err
+			}
+			sess.tee()
+		case of.TypeFeaturesReply:
+			logger.WithFields(log.Fields{
+				"of_message":     header.Type.String(),
+				"of_transaction": header.Transaction,
+				"length":         header.Length,
+			}).Debug("Sniffing for DPID")
+
+			piCount, err = featuresReply.ReadFrom(io.LimitReader(reader, int64(header.Length)-hCount))
+			if err = truncation(header, hCount+piCount, err); err != nil {
+				logger.
+					WithError(err).
+					Error("Failed to read OpenFlow features reply")
+				return err
+			}
+			sess.Features(header.Version, featuresReply)
+			app.api.DPIDMappingListener <- api.DPIDMapping{
+				Action:  api.MapActionAdd,
+				DPID:    featuresReply.DatapathID,
+				Inject:  sess.counting(inject),
+				Session: sess,
+				Version: header.Version,
+			}
+			inject.SetDPID(featuresReply.DatapathID)
+			context.DatapathID = featuresReply.DatapathID
+			sess.identify(context.DatapathID)
+			if !learned {
+				learned = true
+				logger = sess.learn(log.Fields{
+					"dpid": datapath.Format(context.DatapathID),
+				})
+				inject.SetLog(logger)
+				app.notify(events.TypeDeviceConnected, context.DatapathID, sess)
+				app.Hooks.DPID(context.DatapathID, info)
+			}
+			logger.Debug("Sniffed DPID")
+			if _, err = header.WriteTo(proxy); err != nil {
+				logger.
+					WithError(err).
+					Error("Unexpected error while writing features reply open flow header to controller")
+				return err
+			}
+			if _, err = featuresReply.WriteTo(proxy); err != nil {
+				logger.
+					WithError(err).
+					Error("Unexpected error while writing features reply header  to controller")
+				return err
+			}
+
+			if header.Version != OFVersion10 {
+				if err = readRemainder(proxy, reader, header, hCount+piCount); err != nil {
+					logger.
+						WithError(err).
+						Error("Unexpected error while writing features reply header  to controller")
+					return err
+				}
+				break
+			}
+
+			// The port descriptions of an OpenFlow 1.0 device follow
+			// the features reply, so are read completely to track
+			// them, and then proxied to the SDN controller
+			buffer.Reset()
+			if err = readRemainder(buffer, reader, header, hCount+piCount); err != nil {
+				logger.
+					WithError(err).
+					Error("Failed to read OpenFlow features reply ports")
+				return err
+			}
+			if _, err = proxy.Write(buffer.Bytes()); err != nil {
+				logger.
+					WithError(err).
+					Error("Unexpected error while writing features reply ports to controller")
+				return err
+			}
+			app.trackFeaturesPorts(context.DatapathID, buffer.Bytes())
+
+		case of.TypeHello:
+			// Hellos are read completely, so the versions offered
+			// by the device are known, and then proxied to the SDN
+			// controller
+			buffer.Reset()
+			if _, err = header.WriteTo(buffer); err != nil {
+				logger.
+					WithError(err).
+					Error("Failed to write OpenFlow header to hello buffer")
+				return err
+			}
+			if err = readRemainder(buffer, reader, header, hCount); err != nil {
+				logger.
+					WithError(err).
+					Error("Failed to read OpenFlow message body")
+				return err
+			}
+			sess.Hello(true, buffer.Bytes())
+			if _, err = proxy.Write(buffer.Bytes()); err != nil {
+				logger.
+					WithError(err).
+					Error("Unexpected error while writing hello to controller")
+				return err
+			}
+
+		case of.TypePortStatus, of.TypeMultipartReply:
+			// Port status and port description messages are read
+			// completely, so the ports of the device can be tracked,
+			// and then proxied to the SDN controller
+			logger.WithFields(log.Fields{
+				"of_message":     header.Type.String(),
+				"of_transaction": header.Transaction,
+				"length":         header.Length,
+			}).Debug("Sniffing for ports")
+			buffer.Reset()
+			if _, err = header.WriteTo(buffer); err != nil {
+				logger.
+					WithError(err).
+					Error("Failed to write OpenFlow header to port buffer")
+				return err
+			}
+			if err = readRemainder(buffer, reader, header, hCount); err != nil {
+				logger.
+					WithError(err).
+					Error("Failed to read OpenFlow message body")
+				return err
+			}
+			if !app.api.Reply(context.DatapathID, buffer.Bytes()) {
+				if _, err = proxy.Write(buffer.Bytes()); err != nil {
+					logger.
+						WithError(err).
+						Error("Unexpected error while writing open flow message to controller")
+					return err
+				}
+			}
+			app.trackPorts(logger, context.DatapathID, header.Version, header.Type, buffer.Bytes()[hCount:])
+			if header.Type == of.TypePortStatus {
+				if err = app.teeMessage(abort, endpoints, context, buffer.Bytes(), criteria.OFTypePortStatus, learned); err != nil {
+					logger.
+						WithError(err).
+						Error("Unexpected error while writing to TEE clients")
+					return err
+				}
+			}
+
+		case of.TypeError:
+			// Error messages are read completely so they can be
+			// classified and counted. Those for messages injected
+			// via the API are not proxied to the SDN controller,
+			// which never sent them.
+			buffer.Reset()
+			context.Port = 0
+			if _, err = context.WriteTo(buffer); err != nil {
+				logger.
+					WithError(err).
+					Error("Failed to write OpenFlow context to error buffer")
+				return err
+			}
+			if _, err = header.WriteTo(buffer); err != nil {
+				logger.
+					WithError(err).
+					Error("Failed to write OpenFlow header to error buffer")
+				return err
+			}
+			if err = readRemainder(buffer, reader, header, hCount); err != nil {
+				logger.
+					WithError(err).
+					Error("Failed to read OpenFlow message body")
+				return err
+			}
+			message := buffer.Bytes()[context.Len():]
+			app.api.Reply(context.DatapathID, message)
+			if !app.deviceError(logger, context.DatapathID, header, message[hCount:]) {
+				if _, err = proxy.Write(message); err != nil {
+					logger.
+						WithError(err).
+						Error("Unexpected error while writing open flow message to controller")
+					return err
+				}
+			}
+			if err = app.teeMessage(abort, endpoints, context, buffer.Bytes()[context.Len():], criteria.OFTypeError, learned); err != nil {
+				logger.
+					WithError(err).
+					Error("Unexpected error while writing to TEE clients")
+				return err
+			}
+
+		case of.TypeFlowRemoved:
+			// Flow removed messages are read completely, so they can
+			// be tee-ed to the end points that ask for them, and
+			// then proxied to the SDN controller
+			buffer.Reset()
+			if _, err = header.WriteTo(buffer); err != nil {
+				logger.
+					WithError(err).
+					Error("Failed to write OpenFlow header to flow removed buffer")
+				return err
+			}
+			if err = readRemainder(buffer, reader, header, hCount); err != nil {
+				logger.
+					WithError(err).
+					Error("Failed to read OpenFlow message body")
+				return err
+			}
+			if _, err = proxy.Write(buffer.Bytes()); err != nil {
+				logger.
+					WithError(err).
+					Error("Unexpected error while writing open flow message to controller")
+				return err
+			}
+			if err = app.teeMessage(abort, endpoints, context, buffer.Bytes(), criteria.OFTypeFlowRemoved, learned); err != nil {
+				logger.
+					WithError(err).
+					Error("Unexpected error while writing to TEE clients")
+				return err
+			}
+
+		default:
+			// Replies to messages injected via the API are read
+			// completely and returned to the API, the SDN
+			// controller never sent the requests
+			if app.api.IsInjectedXID(header.Transaction) && api.IsReply(header.Version, header.Type) {
+				buffer.Reset()
+				if _, err = header.WriteTo(buffer); err != nil {
+					logger.
+						WithError(err).
+						Error("Failed to write OpenFlow header to reply buffer")
+					return err
+				}
+				if err = readRemainder(buffer, reader, header, hCount); err != nil {
+					logger.
+						WithError(err).
+						Error("Failed to read OpenFlow message body")
+					return err
+				}
+				app.api.Reply(context.DatapathID, buffer.Bytes())
+				break
+			}
+
+			// Echo requests are answered locally, if configured, while
+			// the connection to the SDN controller is re-established,
+			// so the device doesn't disconnect as they time out
+			if header.Type == of.TypeEchoRequest && app.EchoLocal && !proxy.Connected() {
+				buffer.Reset()
+				if _, err = header.WriteTo(buffer); err != nil {
+					logger.
+						WithError(err).
+						Error("Failed to write OpenFlow header to echo buffer")
+					return err
+				}
+				if err = readRemainder(buffer, reader, header, hCount); err != nil {
+					logger.
+						WithError(err).
+						Error("Failed to read OpenFlow message body")
+					return err
+				}
+				reply := append([]byte(nil), buffer.Bytes()...)
+				reply[1] = byte(of.TypeEchoReply)
+				logger.WithFields(log.Fields{
+					"of_transaction": header.Transaction,
+				}).Debug("Answering echo request while SDN controller is unreachable")
+				inject.Inject(abort, reply)
+				break
+			}
+
+			// All messages that are not packet in messages are
+			// only proxied to the SDN controller. No buffering,
+			// just grab bits, push bits.
+			logger.WithFields(log.Fields{
+				"of_message":     header.Type.String(),
+				"of_transaction": header.Transaction,
+				"length":         header.Length,
+			}).Debug("SENDING: SDN controller")
+			if _, err = header.WriteTo(proxy); err != nil && err != io.EOF {
+				logger.
+					WithError(err).
+					Error("Unexpected error while writing generic open flow header to controller")
+				return err
+			}
+
+			if err = readRemainder(proxy, reader, header, hCount); err != nil {
+				logger.
+					WithError(err).
+					Error("Unexpected error while writting open flow message body to controller")
+				return err
+			}
+		}
+	}
+}
+
+// packetState decodes the packet carried by a packet in into the criteria
+// against which end points are matched, false if it isn't an Ethernet packet.
+// Only the values that are required, see `Endpoints.RequiredCriteriaBits`,
+// are decoded, so a packet is not decoded at all if none are, and only its
+// Ethernet header if only its Ethernet type, or VLAN, is.
+func packetState(data []byte, required uint64) (criteria.Criteria, bool) {
+	if required&criteria.BitsPacket == 0 {
+		return criteria.Criteria{}, len(data) >= 14
+	}
+	pkt := gopacket.NewPacket(data,
+		layers.LayerTypeEthernet,
+		gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	eth, ok := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok {
+		return criteria.Criteria{}, false
+	}
+	// Tagged packets are matched by the Ethernet type they encapsulate
+	dlType, vlan, tagged, payload := criteria.Untag(uint16(eth.EthernetType), eth.LayerPayload())
+	state := criteria.Criteria{
+		Set:    criteria.BitDLType | criteria.BitDLSrc | criteria.BitDLDst,
+		DlType: dlType,
+	}
+	copy(state.DlSrc[:], eth.SrcMAC)
+	copy(state.DlDst[:], eth.DstMAC)
+	if tagged {
+		state.Set |= criteria.BitDLVlan
+		state.DlVlan = vlan
+	}
+	switch state.DlType {
+	case criteria.DlTypeIPv6:
+		if required&criteria.BitICMPv6Type == 0 {
+			break
+		}
+		if icmpType, ok := criteria.ICMPv6Type(payload); ok {
+			state.Set |= criteria.BitICMPv6Type
+			state.ICMPv6Type = icmpType
+		}
+	case criteria.DlTypePppoeDiscovery, criteria.DlTypePppoeSession:
+		if required&criteria.BitPppoeCode == 0 {
+			break
+		}
+		if code, ok := criteria.PppoeCode(payload); ok {
+			state.Set |= criteria.BitPppoeCode
+			state.PppoeCode = code
+		}
+	case criteria.DlTypeIPv4:
+		if required&(criteria.BitsNetwork|criteria.BitsTransport) == 0 {
+			break
+		}
+		if proto, src, dst, ok := criteria.IPv4(payload); ok {
+			state.Set |= criteria.BitsNetwork
+			state.NwProto, state.NwSrc, state.NwDst = proto, src, dst
+		}
+		if src, dst, ok := criteria.TransportPorts(payload); ok {
+			state.Set |= criteria.BitsTransport
+			state.TpSrc, state.TpDst = src, dst
+		}
+	}
+	return state, true
+}
+
+// teePacketIn matches a packet in message against the end point criteria and
+// queues it to those end points that match. The message is the OpenFlow
+// context followed by the complete OpenFlow packet in message, which is
+// decoded as `packetIn`. The packet it carries is matched along with the port
+// on which it was received, if the packet in has one. Packets that are not
+// Ethernet can't be matched and are not tee-ed. The DPID of the context is
+// only matched if `learned`, from the handshake with the device. The end
+// points are those given, the caller resolving the running shared end points,
+// see `liveEndpoints`. Queuing to the end points is abandoned once the
+// context is done.
+func (app *App) teePacketIn(ctx context.Context, logger *log.Entry, endpoints connections.Endpoints, message []byte, packetIn *packetin.PacketIn, learned bool) error {
+	// Only what the end points, an observation, or the subscribers to
+	// streams match on is decoded from the packet
+	required := endpoints.RequiredCriteriaBits()
+	if app.api.Observing() {
+		required |= criteria.BitsPacket
+	}
+	required |= app.api.StreamCriteriaBits()
+	var context OpenFlowContext
+	data := packetIn.Data(message[context.Len():])
+	match, ok := packetState(data, required)
+	if !ok {
+		logger.
+			WithFields(log.Fields{
+				"packet":  fmt.Sprintf("%02x", data),
+				"message": fmt.Sprintf("%02x", message),
+			}).
+			Debug("Not ethernet packet, can't match")
+		return nil
+	}
+	if packetIn.HasInPort {
+		match.Set |= criteria.BitInPort
+		match.InPort = packetIn.InPort
+	}
+	if learned {
+		match.Set |= criteria.BitDPID
+		match.DPID = binary.BigEndian.Uint64(message)
+	}
+	logger.
+		WithFields(log.Fields{
+			"dl_type": fmt.Sprintf("0x%04x", match.DlType),
+		}).
+		Debug("match")
+
+	// Sample the packet for an observation of the device, if one is
+	// running
+	app.api.Observe(binary.BigEndian.Uint64(message), match, data)
+
+	// Look up the enrichment of the port on which the packet was
+	// received, from the context that precedes the OpenFlow message, so
+	// that the end points find it cached as they annotate the metadata of
+	// the message, see `connections.Annotator`. A port that is not yet
+	// cached is looked up asynchronously, so the message is not enriched.
+	if app.enricher != nil {
+		var context OpenFlowContext
+		context.DatapathID = binary.BigEndian.Uint64(message)
+		context.Port = binary.BigEndian.Uint32(message[8:])
+		if fields := app.enricher.Lookup(context.DatapathID, context.Port); fields != nil {
+			logger.
+				WithFields(log.Fields{
+					"context":    context.String(),
+					"enrichment": fields,
+				}).
+				Debug("enrich")
+		}
+	}
+
+	dpid := binary.BigEndian.Uint64(message)
+	if app.TeeRawPackets {
+		message = data
+	}
+
+	// Push the packet in to the subscribers streaming it from the API, if
+	// any, which copy it as they queue it
+	app.api.Publish(dpid, match, message)
+
+	// The message is queued to the end points and delivered
+	// asynchronously, so it can't reference the caller's buffer which
+	// will be reused for the next message
+	_, err := endpoints.ConditionalWrite(ctx, append([]byte(nil), message...), match)
+	peaks.queued(endpoints, time.Now())
+	return err
+}
+
+// deviceError classifies an error message received from a device, by its
+// type and code, counts it and logs it along with the type of the failed
+// request. Returns true if the error is for a message injected via the API,
+// so must not be proxied to the SDN controller.
+func (app *App) deviceError(logger *log.Entry, dpid uint64, header of.Header, body []byte) bool {
+	var e ofp.Error
+	if _, err := e.ReadFrom(bytes.NewReader(body)); err != nil {
+		logger.
+			WithFields(log.Fields{
+				"xid": header.Transaction,
+			}).
+			WithError(err).
+			Warn("Unable to decode error message from device")
+		return false
+	}
+	class := e.String()
+	injected := app.api.DeviceError(dpid, header.Transaction, class)
+	fields := log.Fields{
+		"xid":      header.Transaction,
+		"error":    class,
+		"injected": injected,
+	}
+	// The data holds at least the header of the failed request
+	if len(e.Data) >= 8 {
+		fields["failed_type"] = of.Type(e.Data[1]).String()
+	}
+	logger.
+		WithFields(fields).
+		Warn("Error received from device")
+	return injected
+}
+
+// trackPorts updates the ports of a device from a port status or a port
+// description message, of the given OpenFlow version. Messages that can't be
+// decoded are ignored, as they are still proxied to the SDN controller.
+func (app *App) trackPorts(logger *log.Entry, dpid uint64, version uint8, messageType of.Type, body []byte) {
+	if dpid == 0 {
+		return
+	}
+	if version == OFVersion10 {
+		// The port of an OpenFlow 1.0 port status follows its reason
+		// and padding, port descriptions are only sent in the
+		// features reply, see `trackFeaturesPorts`
+		if messageType != of.TypePortStatus || len(body) < 8+api.PortSize10 {
+			return
+		}
+		port := api.NewPortInfo10(body[8:])
+		if ofp.PortReason(body[0]) == ofp.PortReasonDelete {
+			app.deletePort(dpid, port)
+			return
+		}
+		app.updatePort(dpid, port)
+		return
+	}
+	reader := bytes.NewReader(body)
+	switch messageType {
+	case of.TypePortStatus:
+		var status ofp.PortStatus
+		if _, err := status.ReadFrom(reader); err != nil {
+			logger.
+				WithError(err).
+				Debug("Unable to decode port status")
+			return
+		}
+		if status.Reason == ofp.PortReasonDelete {
+			app.deletePort(dpid, api.NewPortInfo(&status.Port))
+			return
+		}
+		app.updatePort(dpid, api.NewPortInfo(&status.Port))
+	case of.TypeMultipartReply:
+		var reply ofp.MultipartReply
+		if _, err := reply.ReadFrom(reader); err != nil || reply.Type != ofp.MultipartTypePortDescription {
+			return
+		}
+		var ports ofp.Ports
+		if _, err := ports.ReadFrom(reader); err != nil {
+			logger.
+				WithError(err).
+				Debug("Unable to decode port descriptions")
+		}
+		for i := range ports {
+			app.updatePort(dpid, api.NewPortInfo(&ports[i]))
+		}
+	}
+}
+
+// trackFeaturesPorts updates the ports of an OpenFlow 1.0 device from the
+// port descriptions that follow the fixed part of its features reply
+func (app *App) trackFeaturesPorts(dpid uint64, ports []byte) {
+	for _, port := range api.NewPortInfos10(ports) {
+		app.updatePort(dpid, port)
+	}
+}
+
+// updatePort adds, or replaces, a port of a device, sending a port added, or
+// modified, event to the configured webhooks if the port wasn't known or has
+// changed
+func (app *App) updatePort(dpid uint64, port api.PortInfo) {
+	known, ok := app.api.Port(dpid, port.Number)
+	if !app.api.UpdatePort(dpid, port) || ok && known == port {
+		return
+	}
+	eventType := events.TypePortAdded
+	if ok {
+		eventType = events.TypePortModified
+	}
+	app.notifyPort(eventType, dpid, port)
+}
+
+// deletePort removes a port of a device, sending a port deleted event to the
+// configured webhooks if the port was known
+func (app *App) deletePort(dpid uint64, port api.PortInfo) {
+	if _, ok := app.api.Port(dpid, port.Number); !ok {
+		return
+	}
+	app.api.DeletePort(dpid, port.Number)
+	app.notifyPort(events.TypePortDeleted, dpid, port)
+}
+
+// notifyPort sends a port event, for a port of a device, to the configured
+// webhooks, if any
+func (app *App) notifyPort(eventType string, dpid uint64, port api.PortInfo) {
+	if app.notifier == nil {
+		return
+	}
+	app.notifier.Notify(events.Event{
+		Type: eventType,
+		DPID: datapath.Format(dpid),
+		Port: port,
+	})
+}
+
+// teeMessage writes an OpenFlow message other than a packet in, prefixed by
+// its OpenFlow context with the port set to 0, to the end points that ask for
+// messages of its type, unless tee-ing is disabled for the device. The DPID is
+// only matched if `learned`.
+func (app *App) teeMessage(ctx context.Context, endpoints connections.Endpoints, ofContext OpenFlowContext, message []byte, ofType uint8, learned bool) error {
+	if !app.api.TeeEnabled(ofContext.DatapathID) || app.pressure.proxyOnly() {
+		return nil
+	}
+	var buffer bytes.Buffer
+	ofContext.Port = 0
+	if _, err := ofContext.WriteTo(&buffer); err != nil {
+		return err
+	}
+	buffer.Write(message)
+	state := criteria.Criteria{
+		Set:    criteria.BitOFType,
+		OFType: ofType,
+	}
+	if learned {
+		state.Set |= criteria.BitDPID
+		state.DPID = ofContext.DatapathID
+	}
+	_, err := app.liveEndpoints(endpoints).ConditionalWrite(ctx, buffer.Bytes(), state)
+	return err
+}
+
+// mirroredType returns the type, as matched by the end points, of a message
+// from the controller that may be tee-ed, a flow or group mod. Type 15 is only
+// a group mod after OpenFlow 1.0, in which it is a port mod.
+func mirroredType(header of.Header) (uint8, bool) {
+	switch {
+	case header.Type == of.TypeFlowMod:
+		return criteria.OFTypeFlowMod, true
+	case header.Type == of.TypeGroupMod && header.Version > OFVersion10:
+		return criteria.OFTypeGroupMod, true
+	}
+	return 0, false
+}
+
+// mirrored returns true if a message from the controller to the device of a
+// session is to be tee-ed, by its header, as an end point asks for its type,
+// so that the other messages from the controller are copied to the device as
+// they are read
+func (app *App) mirrored(endpoints connections.Endpoints, sess *session, header of.Header) bool {
+	ofType, ok := mirroredType(header)
+	if !ok {
+		return false
+	}
+	state := criteria.Criteria{Set: criteria.BitOFType, OFType: ofType}
+	if dpid := atomic.LoadUint64(&sess.dpid); dpid != 0 {
+		state.Set |= criteria.BitDPID
+		state.DPID = dpid
+	}
+	for _, conn := range app.liveEndpoints(endpoints) {
+		if conn.Match(state) {
+			return true
+		}
+	}
+	return false
+}
+
+// mirror tees a message from the controller, once written to the device of a
+// session, see `mirrored`, as `teeMessage` does those from the device
+func (app *App) mirror(ctx context.Context, endpoints connections.Endpoints, sess *session, message []byte) {
+	ofType, _ := mirroredType(of.Header{Version: message[0], Type: of.Type(message[1])})
+	dpid := atomic.LoadUint64(&sess.dpid)
+	if err := app.teeMessage(ctx, endpoints, OpenFlowContext{DatapathID: dpid}, message, ofType, dpid != 0); err != nil {
+		sess.Log().
+			WithError(err).
+			Warn("Unable to tee message from controller")
+	}
+}
+
+// EstablishEndpointConnections creates connections entities to the configured
+// endpoints specified as configuration options, or, if given by a structured
+// configuration file, from their structure
+func (app *App) EstablishEndpointConnections() (connections.Endpoints, error) {
+	return app.establishAnnotated(app.annotator)
+}
+
+// establishAnnotated creates connection entities to the configured end points,
+// as `EstablishEndpointConnections`, whose messages are annotated by the
+// given annotator
+func (app *App) establishAnnotated(annotator *connections.Annotator) (connections.Endpoints, error) {
+	app.endpointsLock.RLock()
+	specs, configured := app.TeeTo, app.Endpoints
+	app.endpointsLock.RUnlock()
+	if configured != nil {
+		return app.establishConfigured(configured, annotator)
+	}
+	return app.establishEndpoints(specs, annotator)
+}
+
+// establishEndpoints creates connection entities to the end points given by
+// their specifications
+func (app *App) establishEndpoints(specs []string, annotator *connections.Annotator) (connections.Endpoints, error) {
+	parsed := make([]parsedSpec, len(specs))
+	for i, spec := range specs {
+		// The end point specification is a `;` separated list of
+		// terms, of the form
+		//    [match;][options;]action=url
+		// Where [match] is a list of match terms, one of which
+		// may be a group of alternatives, i.e.
+		//    dl_type=arp|dl_type=ipv4,nw_proto=udp
+		// see criteria.ParseGroup.
+		terms, err := splitSpec(spec)
+		if err != nil {
+			log.
+				WithFields(log.Fields{"spec": spec}).
+				WithError(err).
+				Error("Invalid end point specification")
+			return nil, err
+		}
+		parsed[i] = parsedSpec{spec, terms}
+	}
+	return app.establishTerms(parsed, annotator)
+}
+
+// establishConfigured creates connection entities to the end points of a
+// structured configuration file from their terms, rather than from their
+// specifications. An error in a term is returned as one in the field of the
+// file from which it was read.
+func (app *App) establishConfigured(configured []config.Endpoint, annotator *connections.Annotator) (connections.Endpoints, error) {
+	parsed := make([]parsedSpec, len(configured))
+	for i := range configured {
+		var err error
+		if parsed[i], err = parseConfigured(app.ConfigFile, &configured[i]); err != nil {
+			return nil, err
+		}
+	}
+	endpoints, err := app.establishTerms(parsed, annotator)
+	if specErr, ok := err.(*SpecError); ok {
+		return nil, fieldError(app.ConfigFile, configured, parsed, specErr)
+	}
+	return endpoints, err
+}
+
+// schemeTerms the terms registered by the built in schemes, which are given
+// to the factories of those that register them, see
+// `connections.RegisterScheme`, and ignored by end points of other schemes
+var schemeTerms = map[string]bool{
+	TermDSCP:       true,
+	TermSource:     true,
+	TermResolveTTL: true,
+	TermWorkers:    true,
+	TermOrdered:    true,
+	TermAck:        true,
+	TermAckWindow:  true,
+	TermKafkaKey:   true,
+	TermHeader:     true,
+	TermRetries:    true,
+	TermBackoff:    true,
+	TermDeadLetter: true,
+	TermStandby:    true,
+	TermFailback:   true,
+}
+
+// establishTerms creates connection entities to the end points given by the
+// terms of their specifications, whose messages are annotated by the given
+// annotator
+func (app *App) establishTerms(parsed []parsedSpec, annotator *connections.Annotator) (_ connections.Endpoints, err error) {
+	var u *url.URL
+	var c connections.Connection
+	var match criteria.Criteria
+	var addr string
+	var terms []specTerm
+	var proxyURL *url.URL
+	var lazy, shadow bool
+	var queueSize int
+	var budget *connections.Budget
+	var throttle *connections.Throttle
+	var scoped, ignored []string
+	var extra []specTerm
+	var options *connections.EndpointOptions
+	var envelope bool
+	var protobuf bool
+	var preamble bool
+	var identity []byte
+	var direction string
+	var durable, shared bool
+	var warm connections.Warmer
+	var sync spool.SyncPolicy
+	var spoolDirName string
+	var txnGroup string
+	var journalPath string
+	var recorder *journal.Journal
+	var compareGroup string
+	var comparer *connections.CompareMember
+
+	tlsConfig, err := app.endpointTLSConfig()
+	if err != nil {
+		log.
+			WithError(err).
+			Error("Unable to load the TLS configuration of HTTPS end points")
+		return nil, err
+	}
+
+	defaultSync := spool.SyncPolicy{Always: true}
+	if app.SpoolFsync != "" {
+		if defaultSync, err = spool.ParseSync(app.SpoolFsync); err != nil {
+			log.
+				WithFields(log.Fields{"spool-fsync": app.SpoolFsync}).
+				WithError(err).
+				Error("Invalid spool sync policy")
+			return nil, err
+		}
+	}
+
+	// The end points established before one that can't be are closed, so
+	// that neither their connections nor their goroutines leak
+	endpoints := make(connections.Endpoints, 0, len(parsed))
+	defer func() {
+		if err != nil {
+			endpoints.Close()
+		}
+	}()
+
+	for i := range parsed {
+		spec := parsed[i].spec
+		terms = parsed[i].terms
+		match = criteria.Criteria{}
+		proxyURL = nil
+		lazy = app.LazyEndpoints
+		shadow = false
+		queueSize = 0
+		direction = DirectionDevice
+		budget = &connections.Budget{}
+		throttle = &connections.Throttle{}
+		scoped = nil
+		extra = nil
+		envelope = false
+		protobuf = false
+		preamble = false
+		durable = false
+		shared = false
+		warm = nil
+		sync = defaultSync
+		spoolDirName = ""
+		txnGroup = ""
+		journalPath = ""
+		compareGroup = ""
+		addr = ""
+		for _, term := range terms {
+			// Only match terms can be negated, i.e. `dl_type!=0x88cc`
+			name := strings.TrimSuffix(term.name, "!")
+			if name != term.name && !criteria.IsTerm(name) {
+				log.
+					WithFields(log.Fields{
+						"term":  term.name,
+						"value": term.value,
+					}).
+					Error("Only match terms can be negated")
+				return nil, &SpecError{spec, term.offset, fmt.Errorf("term '%s' can't be negated", name)}
+			}
+			switch name {
+			case TermAction:
+				addr = term.value
+			case TermDLType, TermDLVlan, TermDLSrc, TermDLDst, TermICMPv6Type, TermPppoeCode, TermNwProto, TermNwSrc, TermNwDst, TermTpSrc, TermTpDst, TermInPort, TermDPID, TermOFType, TermProto:
+				condition, _, err := criteria.ParseGroup(term.name, term.value)
+				if err == nil {
+					err = match.Merge(condition)
+				}
+				if err != nil {
+					log.
+						WithFields(log.Fields{
+							"term":  term.name,
+							"value": term.value,
+						}).
+						WithError(err).
+						Error("Invalid match term")
+					return nil, &SpecError{spec, term.offset, err}
+				}
+				log.
+					WithFields(log.Fields{
+						"term":  term.name,
+						"value": term.value,
+					}).
+					Debug("Found condition")
+			case TermProxy:
+				if proxyURL, err = connections.ParseProxyURL(term.value); err != nil {
+					log.
+						WithFields(log.Fields{
+							"term": term.name,
+						}).
+						WithError(err).
+						Error("Unable to parse proxy for end point")
+					return nil, &SpecError{spec, term.offset, err}
+				}
+			case TermConnect:
+				switch strings.ToLower(term.value) {
+				case ConnectLazy:
+					lazy = true
+				case ConnectEager:
+					lazy = false
+				default:
+					log.
+						WithFields(log.Fields{
+							"term":  term.name,
+							"value": term.value,
+						}).
+						Error("Unknown connect value, expected 'lazy' or 'eager'")
+					return nil, &SpecError{spec, term.offset, fmt.Errorf("Unknown connect value '%s'", term.value)}
+				}
+			case TermQueue:
+				if queueSize, err = strconv.Atoi(term.value); err != nil || queueSize < 1 {
+					log.
+						WithFields(log.Fields{
+							"term":  term.name,
+							"value": term.value,
+						}).
+						Error("Queue size must be a positive integer")
+					return nil, &SpecError{spec, term.offset, fmt.Errorf("Invalid queue size '%s'", term.value)}
+				}
+				scoped = append(scoped, term.name)
+			case TermShadow:
+				if shadow, err = strconv.ParseBool(term.value); err != nil {
+					log.
+						WithFields(log.Fields{
+							"term":  term.name,
+							"value": term.value,
+						}).
+						WithError(err).
+						Error("Unable to parse shadow value")
+					return nil, &SpecError{spec, term.offset, err}
+				}
+			case TermDurable:
+				if durable, err = strconv.ParseBool(term.value); err != nil {
+					log.
+						WithFields(log.Fields{
+							"term":  term.name,
+							"value": term.value,
+						}).
+						WithError(err).
+						Error("Unable to parse durable value")
+					return nil, &SpecError{spec, term.offset, err}
+				}
+			case TermFsync:
+				if sync, err = spool.ParseSync(term.value); err != nil {
+					log.
+						WithFields(log.Fields{
+							"term":  term.name,
+							"value": term.value,
+						}).
+						WithError(err).
+						Error("Unable to parse spool sync policy")
+					return nil, &SpecError{spec, term.offset, err}
+				}
+			case TermSpool:
+				if spoolDirName = spoolName(term.value); spoolDirName == "" {
+					log.
+						WithFields(log.Fields{
+							"term":  term.name,
+							"value": term.value,
+						}).
+						Error("Invalid spool name")
+					return nil, &SpecError{spec, term.offset, fmt.Errorf("invalid spool name '%s'", term.value)}
+				}
+			case TermTxnGroup:
+				txnGroup = term.value
+			case TermJournal:
+				journalPath = term.value
+			case TermCompareGroup:
+				compareGroup = term.value
+			case TermDirection:
+				switch direction = strings.ToLower(term.value); direction {
+				case DirectionDevice, DirectionController:
+				default:
+					log.
+						WithFields(log.Fields{
+							"term":  term.name,
+							"value": term.value,
+						}).
+						Error("Unknown direction value, expected 'device' or 'controller'")
+					return nil, &SpecError{spec, term.offset, fmt.Errorf("Unknown direction value '%s'", term.value)}
+				}
+			case TermEncode:
+				switch strings.ToLower(term.value) {
+				case EncodeRaw:
+					envelope, protobuf = false, false
+				case EncodeJSON:
+					envelope, protobuf = true, false
+				case EncodeProto:
+					envelope, protobuf = false, true
+				default:
+					log.
+						WithFields(log.Fields{
+							"term":  term.name,
+							"value": term.value,
+						}).
+						Error("Unknown encoding, expected 'raw', 'json' or 'proto'")
+					return nil, &SpecError{spec, term.offset, fmt.Errorf("Unknown encoding '%s'", term.value)}
+				}
+				scoped = append(scoped, term.name)
+			case TermPreamble:
+				switch strings.ToLower(term.value) {
+				case PreambleJSON:
+					preamble = true
+				case PreambleNone:
+					preamble = false
+				default:
+					log.
+						WithFields(log.Fields{
+							"term":  term.name,
+							"value": term.value,
+						}).
+						Error("Unknown preamble, expected 'json' or 'none'")
+					return nil, &SpecError{spec, term.offset, fmt.Errorf("Unknown preamble '%s'", term.value)}
+				}
+				scoped = append(scoped, term.name)
+			case TermSample:
+				if throttle.Sample, err = connections.ParseSample(term.value); err != nil {
+					log.
+						WithFields(log.Fields{
+							"term":  term.name,
+							"value": term.value,
+						}).
+						WithError(err).
+						Error("Unable to parse sample")
+					return nil, &SpecError{spec, term.offset, err}
+				}
+			case TermRate:
+				if throttle.Rate, err = connections.ParseRate(term.value); err != nil {
+					log.
+						WithFields(log.Fields{
+							"term":  term.name,
+							"value": term.value,
+						}).
+						WithError(err).
+						Error("Unable to parse rate")
+					return nil, &SpecError{spec, term.offset, err}
+				}
+			case TermLatencyBudget:
+				if budget.Limit, err = time.ParseDuration(term.value); err != nil || budget.Limit <= 0 {
+					log.
+						WithFields(log.Fields{
+							"term":  term.name,
+							"value": term.value,
+						}).
+						Error("Latency budget must be a positive duration")
+					return nil, &SpecError{spec, term.offset, fmt.Errorf("Invalid latency budget '%s'", term.value)}
+				}
+			case TermDemote:
+				if budget.Strategy, budget.SampleRate, err = connections.ParseDemote(term.value); err != nil {
+					log.
+						WithFields(log.Fields{
+							"term":  term.name,
+							"value": term.value,
+						}).
+						WithError(err).
+						Error("Unable to parse demotion strategy")
+					return nil, &SpecError{spec, term.offset, err}
+				}
+			case TermBudgetWindow:
+				if budget.Window, err = time.ParseDuration(term.value); err != nil || budget.Window <= 0 {
+					log.
+						WithFields(log.Fields{
+							"term":  term.name,
+							"value": term.value,
+						}).
+						Error("Latency budget window must be a positive duration")
+					return nil, &SpecError{spec, term.offset, fmt.Errorf("Invalid latency budget window '%s'", term.value)}
+				}
+			default:
+				// Possibly a term of the scheme of the end point,
+				// parsed by its factory
+				extra = append(extra, term)
+			}
+		}
+
+		// End points that could not be connected at startup connect
+		// when first used, whatever their connect term
+		if app.forceLazy {
+			lazy = true
+		}
+
+		// A durable end point never drops messages, so it can't be
+		// demoted
+		if durable && budget.Limit != 0 {
+			return nil, &SpecError{spec, offsetOf(terms, TermLatencyBudget),
+				errors.New("a durable end point can't have a latency budget")}
+		}
+
+		// The preamble identifies the instance, and the end point, to
+		// the consumer each time the connection is established
+		identity = nil
+		if preamble {
+			if identity, err = app.preamble(addr, match); err != nil {
+				return nil, &SpecError{spec, offsetOf(terms, TermPreamble), err}
+			}
+		}
+
+		// A shadow end point delivers nothing, so has nothing to
+		// journal. End points that share a journal file share the
+		// journal.
+		recorder = nil
+		if journalPath != "" {
+			if shadow {
+				return nil, &SpecError{spec, offsetOf(terms, TermJournal),
+					errors.New("a shadow end point delivers nothing to journal")}
+			}
+			recorder = app.journals.Get(journalPath, journal.Options{
+				MaxSize:    app.JournalMaxSize,
+				MaxBackups: app.JournalBackups,
+			})
+		}
+
+		// Nor is there anything to compare. The end points of a
+		// compare group are members by their specification, so that
+		// those established for each device connection are one.
+		comparer = nil
+		if compareGroup != "" {
+			if shadow {
+				return nil, &SpecError{spec, offsetOf(terms, TermCompareGroup),
+					errors.New("a shadow end point delivers nothing to compare")}
+			}
+			if comparer, err = app.compareGroups.Get(compareGroup, app.CompareTolerance, app.CompareWindow).Join(spec); err != nil {
+				return nil, &SpecError{spec, offsetOf(terms, TermCompareGroup), err}
+			}
+		}
+
+		// A throttled end point drops messages on its own, so would
+		// break the all or nothing delivery of a transaction group
+		if throttle.Sample > 1 || throttle.Rate > 0 {
+			if txnGroup != "" {
+				return nil, &SpecError{spec, offsetOf(terms, TermTxnGroup),
+					errors.New("a member of a transaction group can't be sampled or rate limited")}
+			}
+			throttle.Endpoint = addr
+		} else {
+			throttle = nil
+		}
+
+		// The messages of the controller are only tee-ed to end points
+		// that ask for its direction, and only they are
+		ofTypes := match.MatchedOFTypes()
+		if direction == DirectionController && ofTypes&^criteria.OFTypesController != 0 {
+			return nil, &SpecError{spec, offsetOf(terms, TermDirection),
+				errors.New("only of_type flow_mod or group_mod are sent by the controller")}
+		}
+		if direction == DirectionDevice && ofTypes&criteria.OFTypesController != 0 {
+			return nil, &SpecError{spec, offsetOf(terms, TermOFType),
+				errors.New("of_type flow_mod and group_mod are sent by the controller, direction=controller")}
+		}
+
+		// Messages other than packet ins carry no packet, so can't be
+		// tee-ed raw
+		if match.Set&criteria.BitOFType != 0 && match.OFTypes&^(1<<criteria.OFTypePacketIn) != 0 && app.TeeRawPackets {
+			return nil, &SpecError{spec, offsetOf(terms, TermOFType),
+				errors.New("only packet ins can be tee-ed as raw packets, TEE_RAW")}
+		}
+
+		// Only packet ins, with their context, are encoded as protocol
+		// buffers
+		if protobuf && ofTypes&^(1<<criteria.OFTypePacketIn) != 0 {
+			return nil, &SpecError{spec, offsetOf(terms, TermOFType),
+				errors.New("only packet ins can be encoded as protocol buffers")}
+		}
+		if protobuf && app.TeeRawPackets {
+			return nil, &SpecError{spec, offsetOf(terms, TermEncode),
+				errors.New("raw packets can't be encoded as protocol buffers, TEE_RAW")}
+		}
+
+		// As does one demoted by its latency budget
+		if budget.Limit != 0 && txnGroup != "" {
+			return nil, &SpecError{spec, offsetOf(terms, TermTxnGroup),
+				errors.New("a member of a transaction group can't have a latency budget")}
+		}
+
+		// Only enforce a latency budget if one is given
+		if budget.Limit == 0 {
+			if budget.Strategy != "" || budget.Window != 0 {
+				log.
+					WithFields(log.Fields{
+						"spec": spec,
+					}).
+					Warn("Demotion terms require a latency budget, ignoring")
+			}
+			budget = nil
+		} else {
+			budget.Endpoint = addr
+			budget.Notify = app.notifyBudget
+		}
+
+		// Parse the action, the address of the end point
+		if u, err = parseAction(addr); err != nil {
+			err = &SpecError{spec, offsetOf(terms, TermAction), err}
+			log.
+				WithFields(log.Fields{"connect": addr}).
+				WithError(err).
+				Error("Unable to parse connection string")
+			return nil, err
+		}
+		// The terms registered by the scheme of the end point are
+		// given to its factory, and those of other schemes ignored
+		options = &connections.EndpointOptions{
+			Proxy:      proxyURL,
+			Lazy:       lazy,
+			Background: app.forceLazy,
+			QueueSize:  queueSize,
+			Budget:     budget,
+			TLSConfig:  tlsConfig,
+			Timeout:    app.HTTPTimeout,
+			Retries:    app.HTTPRetries,
+			Backoff:    app.HTTPRetryBackoff,
+			Preamble:   identity,
+			Raw:        app.TeeRawPackets,
+			Envelope:   envelope,
+			Protobuf:   protobuf,
+			Journal:    recorder,
+			Compare:    comparer,
+			Annotator:  annotator,
+		}
+		ignored = nil
+		for _, name := range scoped {
+			if !connections.SchemeTerm(u.Scheme, name) {
+				ignored = append(ignored, name)
+			}
+		}
+		for _, term := range extra {
+			if connections.SchemeTerm(u.Scheme, term.name) {
+				if options.Terms == nil {
+					options.Terms = make(url.Values)
+				}
+				options.Terms.Add(term.name, term.value)
+				continue
+			}
+			if !schemeTerms[term.name] {
+				log.
+					WithFields(log.Fields{
+						"term":  term.name,
+						"value": term.value,
+					}).
+					Error("Unknown end point term")
+				return nil, &SpecError{spec, term.offset, fmt.Errorf("Unknown end point term '%s'", term.name)}
+			}
+			ignored = append(ignored, term.name)
+		}
+		if len(ignored) > 0 && !shadow && !durable {
+			log.
+				WithFields(log.Fields{
+					"connection": addr,
+					"terms":      ignored,
+				}).
+				Warnf("Terms not supported on %s end points, ignoring", u.Scheme)
+		}
+
+		switch {
+		case shadow:
+			c = (&connections.ShadowConnection{
+				Target:   addr,
+				Criteria: match,
+			}).Initialize()
+			err = nil
+		case durable:
+			// The connection to the end point is established when
+			// the first message is delivered, and re-established
+			// after a failure
+			options.Durable = true
+			if c, err = connections.NewConnection(u, criteria.Criteria{}, options); err != nil {
+				break
+			}
+			target, ok := c.(connections.Deliverer)
+			if !ok {
+				return nil, &SpecError{spec, offsetOf(terms, TermDurable),
+					fmt.Errorf("a %s end point can't be durable", u.Scheme)}
+			}
+			if warmer, ok := c.(connections.Warmer); ok && !lazy {
+				warm = warmer
+			}
+			if spoolDirName == "" {
+				spoolDirName = spoolName(u.String())
+			}
+			c, shared, err = app.durableConnection(addr, spoolDirName, match, sync, target)
+		default:
+			c, err = connections.NewConnection(u, match, options)
+			if warmer, ok := c.(connections.Warmer); ok && !lazy {
+				warm = warmer
+			}
+		}
+		if termErr, ok := err.(*connections.TermError); ok {
+			log.
+				WithFields(log.Fields{
+					"term": termErr.Term,
+					"spec": spec,
+				}).
+				WithError(err).
+				Error("Invalid end point term")
+			return nil, &SpecError{spec, offsetOf(terms, termErr.Term), termErr.Err}
+		} else if _, ok := err.(*connections.ProxyError); ok {
+			log.
+				WithFields(log.Fields{"connection": addr}).
+				WithError(err).
+				Error("Unable to connect to proxy for outbound end point")
+			return nil, err
+		} else if err != nil {
+			log.
+				WithFields(log.Fields{"connection": addr}).
+				WithError(err).
+				Error("Unable to connect to outbound end point")
+			return nil, err
+		}
+		_, kafka := c.(*connections.KafkaConnection)
+		if tcp, ok := c.(*connections.TCPConnection); kafka || ok && tcp.Connection == nil {
+			log.WithFields(log.Fields{
+				"connection": addr,
+				"c":          c,
+				"host":       u.Host,
+			}).Info("Configured outbound end point connection, not yet connected")
+		} else {
+			log.WithFields(log.Fields{
+				"connection": addr,
+				"c":          c,
+				"host":       u.Host,
+			}).Info("Created outbound end point connection")
+		}
+
+		// A member of a transaction group is written all or nothing
+		// with the other members of the group, and a throttled end
+		// point only the messages its throttle allows
+		endpoint := c
+		if txnGroup != "" {
+			endpoint = &connections.TxnMember{
+				Connection: c,
+				Group:      app.txnGroups.Get(txnGroup),
+			}
+		}
+		if throttle != nil {
+			endpoint = &connections.Throttled{
+				Connection: c,
+				Throttle:   throttle,
+			}
+		}
+		endpoints = append(endpoints, endpoint)
+
+		// A durable connection shared with another device connection
+		// is already delivering messages, and warmed
+		if shared {
+			continue
+		}
+
+		// Establish the connection to an eager HTTP end point in the
+		// background, so that the first message doesn't wait for it
+		if warm != nil {
+			go warmConnection(addr, warm)
+		}
+
+		// Encapsulated call to ListenAndSend to enable error
+		// checking, it returns once the end point is closed
+		go func(_c connections.Connection) {
+			if err := _c.ListenAndSend(); err != nil {
+				if err == connections.ErrUninitialized {
+					log.
+						WithError(err).
+						Fatal("Attempt to use unitialized connection")
+				} else {
+					log.
+						WithError(err).
+						Fatal("Unexpected error")
+				}
+			}
+		}(c)
+	}
+	return endpoints, nil
+}
+
+// instance returns the identity of the instance, `INSTANCE_ID` or else its
+// host name
+func (app *App) instance() (string, error) {
+	if app.InstanceID != "" {
+		return app.InstanceID, nil
+	}
+	return os.Hostname()
+}
+
+// preamble returns the preamble written to a TCP end point, identifying the
+// instance, see `instance`, and the end point
+func (app *App) preamble(addr string, match criteria.Criteria) ([]byte, error) {
+	instance, err := app.instance()
+	if err != nil {
+		return nil, err
+	}
+	format := connections.FormatOpenFlow
+	if app.TeeRawPackets {
+		format = connections.FormatRaw
+	}
+	return (&connections.Preamble{
+		Instance: instance,
+		Version:  Version,
+		Endpoint: addr,
+		Criteria: match.String(),
+		Format:   format,
+	}).Encode()
+}
+
+// warmConnection establishes the connection to an HTTP end point, so that
+// it is idle and ready when the first message is delivered. A failure is
+// only logged, the connection is established when a message is delivered.
+func warmConnection(addr string, c connections.Warmer) {
+	started := time.Now()
+	if err := c.Warm(); err != nil {
+		log.
+			WithFields(log.Fields{"connection": addr}).
+			WithError(err).
+			Warn("Unable to warm connection to outbound end point")
+		return
+	}
+	log.
+		WithFields(log.Fields{
+			"connection": addr,
+			"elapsed":    time.Since(started),
+		}).
+		Debug("Warmed connection to outbound end point")
+}
+
+// compareGauges returns the messages matched, divergent and overflowed by
+// each compare group, as gauges labeled with the group
+func (app *App) compareGauges() []api.Gauge {
+	stats := app.compareGroups.Stats()
+	var gauges []api.Gauge
+	for _, metric := range []struct {
+		name  string
+		help  string
+		value func(connections.CompareStats) uint64
+	}{
+		{"oftee_compare_matched_messages", "number of messages delivered by every member of a compare group",
+			func(s connections.CompareStats) uint64 { return s.Matched }},
+		{"oftee_compare_divergent_messages", "number of messages not delivered by every member of a compare group within the tolerance",
+			func(s connections.CompareStats) uint64 { return s.Divergent }},
+		{"oftee_compare_overflowed_messages", "number of messages forgotten by a compare group, without being compared, as its window was full",
+			func(s connections.CompareStats) uint64 { return s.Overflowed }},
+	} {
+		for _, group := range stats {
+			gauges = append(gauges, api.Gauge{
+				Name:   metric.name,
+				Help:   metric.help,
+				Labels: map[string]string{"group": group.Group},
+				Value:  float64(metric.value(group)),
+			})
+		}
+	}
+	return gauges
+}
+
+// bufferSize returns the size of the pooled message buffers, see
+// `BufferSize`, at least `MinReadBufferSize`
+func (app *App) bufferSize() int {
+	switch {
+	case app.BufferSize <= 0:
+		return ReadBufferSize
+	case app.BufferSize < MinReadBufferSize:
+		return MinReadBufferSize
+	}
+	return app.BufferSize
+}
+
+// handleChain processes a tee stream from another oftee instance. The stream
+// is the format written to `tcp` end points of the `CHAIN_ENCODE` encoding,
+// i.e. a sequence of OpenFlow contexts each followed by a complete OpenFlow
+// message, or of length prefixed envelopes or protocol buffers. Packet ins
+// are tee-ed to the end points that match as if they had been received from
+// a device, with their hop count incremented, unless it exceeds
+// `CHAIN_MAX_HOPS`. Messages from a chained instance are never proxied to the
+// SDN controller. The connection is closed once the context is done.
+func (app *App) handleChain(ctx context.Context, conn net.Conn, endpoints *chainedEndpoints) error {
+	defer close(conn)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	logger := log.WithFields(log.Fields{
+		"chain": conn.RemoteAddr().String(),
+	})
+
+	var (
+		err      error
+		message  []byte
+		hops     uint32
+		looped   bool
+		context  OpenFlowContext
+		header   of.Header
+		packetIn packetin.PacketIn
+		teeTo    connections.Endpoints
+		scratch  = messageBuffers.get(app.bufferSize())
+		ctxLen   = int(context.Len())
+	)
+
+	// The scratch buffer is held for as long as the connection, chained
+	// instances being few, and grown for the messages that don't fit
+	defer messageBuffers.put(scratch)
+	reader := &chainReader{
+		reader:  bufio.NewReaderSize(conn, app.bufferSize()),
+		encode:  app.chainEncode(),
+		scratch: scratch,
+	}
+	for {
+		if message, hops, err = reader.next(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		context.DatapathID = binary.BigEndian.Uint64(message)
+		context.Port = binary.BigEndian.Uint32(message[8:])
+		if _, err = header.ReadFrom(bytes.NewReader(message[ctxLen : ctxLen+8])); err != nil {
+			return err
+		}
+
+		// Only packet in messages are tee-ed, so anything else is
+		// unexpected and ignored
+		if header.Type != of.TypePacketIn {
+			logger.
+				WithFields(log.Fields{
+					"of_message": header.Type.String(),
+				}).
+				Debug("Ignoring non packet in message from chained instance")
+			continue
+		}
+
+		// A message that has been tee-ed by too many instances is
+		// looping, and is rejected rather than tee-ed once more. The
+		// first rejection is logged as a warning, the others would
+		// flood the log.
+		if hops >= app.chainMaxHops() {
+			entry := logger.
+				WithFields(log.Fields{
+					"context": context.String(),
+					"hops":    hops,
+				})
+			if looped {
+				entry.Debug("Rejecting looping packet in from chained instance")
+			} else {
+				entry.Warn("Rejecting looping packet in from chained instance, see CHAIN_MAX_HOPS")
+			}
+			looped = true
+			continue
+		}
+		if packetIn, err = packetin.Decode(header.Version, message[ctxLen:]); err != nil {
+			return err
+		}
+		if teeTo, err = endpoints.get(hops + 1); err != nil {
+			return err
+		}
+
+		// The chained instance writes a DPID of 0 until it has
+		// learned that of the device
+		logger.
+			WithFields(log.Fields{
+				"context": context.String(),
+				"hops":    hops,
+			}).
+			Debug("chained packet in")
+		if err = app.teePacketIn(ctx, logger, teeTo, message, &packetIn, context.DatapathID != 0); err != nil {
+			return err
+		}
+	}
+}
+
+// chainMaxHops returns the number of chained instances by which a message may
+// have been tee-ed, see `ChainMaxHops`, `DefaultChainMaxHops` if not set
+func (app *App) chainMaxHops() uint32 {
+	if app.ChainMaxHops == 0 {
+		return DefaultChainMaxHops
+	}
+	return app.ChainMaxHops
+}
+
+// chainEncode returns the encoding of the tee streams from chained
+// instances, see `CHAIN_ENCODE`
+func (app *App) chainEncode() string {
+	if app.ChainEncode == "" {
+		return EncodeRaw
+	}
+	return app.ChainEncode
+}
+
+// ChainListenAndServe listens for connections from other oftee instances and
+// processes the tee streams they send, until the context is done
+func (app *App) ChainListenAndServe(ctx context.Context) error {
+	return app.serveChain(ctx, func() {})
+}
+
+// chainServe accepts connections from chained instances on the given
+// listener, until the context is done
+func (app *App) chainServe(ctx context.Context, listener net.Listener) error {
+	defer close(listener)
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.
+					WithError(err).
+					Error("Error while accepting chained connection")
+				continue
+			}
+			return err
+		}
+		log.WithFields(log.Fields{
+			"remote-connection": conn.RemoteAddr().String(),
+		}).Debug("Received chained connection")
+		// The end points are established for each chained connection,
+		// even if shared, as its messages are annotated with their hop
+		// count, and closed once it terminates
+		go func(_conn net.Conn) {
+			endpoints := &chainedEndpoints{establish: app.establishChained}
+			defer endpoints.Close()
+			if err := app.handleChain(ctx, _conn, endpoints); err != nil && ctx.Err() == nil {
+				log.
+					WithError(err).
+					WithFields(log.Fields{
+						"connection": _conn.RemoteAddr().String(),
+					}).
+					Error("Chained connection terminated with an error")
+			}
+		}(conn)
+	}
+}
+
+// ListenAndServe Listen for connections from open flow devices and process their
+// messages, until the context is done
+func (app *App) ListenAndServe(ctx context.Context) error {
+	return app.serveDevices(ctx, func() {})
+}
+
+// serveDevices listens for connections from open flow devices, calling ready
+// once it is listening, and processes their messages until the listener
+// fails or the context is done, which also disconnects the devices, see
+// `handle`
+func (app *App) serveDevices(ctx context.Context, ready func()) (err error) {
+	// Bind to connection for accepting connections
+	tlsConfig, err := app.listenerTLSConfig()
+	if err != nil {
+		log.
+			WithError(err).
+			Error("Unable to load the TLS configuration of the listener for OpenFlow devices")
+		return err
+	}
+	app.listener, err = listenOn(app.ListenOn)
+	if err != nil {
+		log.
+			WithFields(log.Fields{
+				"listen-port": app.ListenOn,
+			}).
+			WithError(err).
+			Error("Unable to establish the ability to listen on connection for OpenFlow devices")
+		return err
+	}
+	if tlsConfig != nil {
+		// Devices complete the TLS handshake as their first message
+		// is read, see `handle`
+		app.listener = tls.NewListener(app.listener, tlsConfig)
+	}
+	defer close(app.listener)
+	go func(listener net.Listener) {
+		<-ctx.Done()
+		listener.Close()
+	}(app.listener)
+	ready()
+
+	// Loop forever waiting for a connection and processing it
+	var endpoints connections.Endpoints
+	for {
+		conn, err := app.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// Not fatal if a connection fails, forget it and move on
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.
+					WithError(err).
+					Error("Error while accepting connection")
+				continue
+			}
+			return err
+		}
+		if app.rejectDraining(conn) {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"remote-connection": conn.RemoteAddr().String(),
+		}).Debug("Received connection")
+		endpoints = app.sharedEndpoints()
+		if !app.ShareConnections {
+			endpoints, err = app.EstablishEndpointConnections()
+			if err != nil {
+				log.
+					WithError(err).
+					Error("Unable to establish non-shared outbound endpoint connections")
+				continue
+			}
+		}
+		app.handlers.Add(1)
+		go func(_conn net.Conn, _endpoints connections.Endpoints) {
+			defer app.handlers.Done()
+			if err := app.handle(ctx, _conn, _endpoints); err != nil && ctx.Err() == nil {
+				log.
+					WithError(err).
+					WithFields(log.Fields{
+						"connection": _conn,
+					}).
+					Error("Connection to device terminated with an error")
+			}
+
+			// The end points of a device connection that are
+			// not shared are flushed as it is drained, see
+			// `shutdown` for those that are, and closed once it
+			// is gone
+			if app.ShareConnections {
+				return
+			}
+			if ctx.Err() != nil {
+				app.flush(_endpoints)
+			}
+			if err := _endpoints.Close(); err != nil {
+				log.
+					WithError(err).
+					WithFields(log.Fields{
+						"connection": _conn,
+					}).
+					Warn("End points of the device connection closed with messages undelivered")
+			}
+		}(conn, endpoints)
+	}
+}
+
+// New creates the proxy with the given configuration, which is validated
+// and parsed but nothing is started until the proxy is run, see `Run`. The
+// configuration is resolved from the environment by the oftee command, while
+// a program that embeds the proxy starts from the defaults, see
+// `DefaultConfig`. The proxy runs no hooks unless they are set, see
+// `hooks.Hooks`.
+func New(config Config) (*App, error) {
+	app := &App{Config: config}
+	if app.Hooks == nil {
+		app.Hooks = &hooks.Hooks{}
+	}
+
+	// Parse the DSCP marking for the SDN controller connections, if set
+	var err error
+	if app.ControllerDSCP != "" {
+		if app.controllerDSCP, err = connections.ParseDSCP(app.ControllerDSCP); err != nil {
+			return nil, fmt.Errorf("unable to parse DSCP marking '%s' for SDN controller connections: %s", app.ControllerDSCP, err)
+		}
+	}
+
+	// Parse the source address for the SDN controller connections, if set
+	if app.ControllerSource != "" {
+		if app.controllerSource, err = connections.ParseSourceAddr(app.ControllerSource); err != nil {
+			return nil, fmt.Errorf("unable to use source address '%s' for SDN controller connections: %s", app.ControllerSource, err)
+		}
+	}
+
+	// The mode in which devices are proxied to more than one SDN controller
+	if app.ProxyMode != ProxyModeAll && app.ProxyMode != ProxyModeFailover {
+		return nil, fmt.Errorf("invalid SDN controller proxy mode '%s', expected all or failover", app.ProxyMode)
+	}
+
+	// Parse the proxy for the SDN controller connections, if set. The
+	// controller connections are never made via the proxies specified by
+	// the standard proxy environment variables.
+	if app.ControllerProxy != "" {
+		if app.controllerProxy, err = connections.ParseProxyURL(app.ControllerProxy); err != nil {
+			return nil, fmt.Errorf("unable to parse proxy for SDN controller connections: %s", err)
+		}
+	}
+
+	// Each subsystem is started independently, and retried if it fails,
+	// unless it is required
+	if err = app.validateRequired(); err != nil {
+		return nil, fmt.Errorf("invalid list of required subsystems: %s", err)
+	}
+	if app.messageTypes, err = api.ParseMessageTypes(app.MessageAPITypes); err != nil {
+		return nil, fmt.Errorf("invalid list of message API types: %s", err)
+	}
+	if app.ofVersions, err = parseOFVersions(app.OFVersions); err != nil {
+		return nil, fmt.Errorf("invalid list of OpenFlow versions: %s", err)
+	}
+	if app.InjectXIDBase < 0 || app.InjectXIDRange < 2 || app.InjectXIDBase+app.InjectXIDRange > 1<<32 {
+		return nil, fmt.Errorf("invalid range of %d transaction IDs from 0x%x reserved for injected messages, expected at least 2 that end at 0xffffffff or before", app.InjectXIDRange, app.InjectXIDBase)
+	}
+	if app.EnrichURL != "" {
+		if _, err = url.Parse(app.EnrichURL); err != nil {
+			return nil, fmt.Errorf("unable to parse enrichment service URL '%s': %s", app.EnrichURL, err)
+		}
+	}
+	return app, nil
+}
+
+// Run starts the proxy and serves devices until the context is done, or a
+// required subsystem fails, and then drains the device connections and the
+// end points. The failure of a required subsystem, or of the proxy to start,
+// is returned. A proxy is run once.
+func (app *App) Run(ctx context.Context) error {
+	ctx, app.stop = context.WithCancel(ctx)
+	defer app.stop()
+
+	// Log the configuration, as resolved, to help troubleshoot mistakes
+	app.logEffectiveConfig()
+
+	// The end points annotate messages with the identity of the instance
+	// and, if requested, the enrichment of device ports, which is looked up
+	// before they are established
+	instance, err := app.instance()
+	if err != nil {
+		return fmt.Errorf("unable to identify the instance, see INSTANCE_ID: %s", err)
+	}
+	app.annotator = &connections.Annotator{Instance: instance}
+	if app.EnrichURL != "" {
+		app.enricher = (&enrich.Enricher{
+			URL:        app.EnrichURL,
+			TTL:        app.EnrichTTL,
+			MaxEntries: app.EnrichCacheSize,
+		}).Initialize()
+		go app.enricher.ListenAndLookup()
+		app.annotator.Enrich = app.enricher.Cached
+	}
+
+	// Connect to shared outbound end point connections, if requested
+	if app.ShareConnections {
+		if err := app.startEndpoints(); err != nil {
+			return err
+		}
+	}
+
+	// Create the webhooks notified of device events, if requested
+	if len(app.WebhookURL) > 0 {
+		var err error
+		if app.notifier, err = app.EstablishWebhooks(); err != nil {
+			return fmt.Errorf("unable to establish webhooks: %s", err)
+		}
+	}
+
+	// Create and invoke the API sub-system, which tracks the devices even
+	// while it can't serve requests
+	app.api = api.NewAPI(app.APIOn, app.CPUProfile, app.MemProfile)
+	app.api.StaleGracePeriod = app.StaleDeviceGrace
+	app.api.Config = app.EffectiveConfig()
+	if app.ShareConnections {
+		app.api.EndpointStats = func() interface{} {
+			return app.endpointList()
+		}
+		app.api.AddEndpoint = func(terms map[string]string) (interface{}, error) {
+			return app.addEndpoint(terms)
+		}
+		app.api.RemoveEndpoint = func(id string) (interface{}, bool) {
+			info := app.removeEndpoint(id)
+			return info, info != nil
+		}
+		app.api.PromoteEndpoint = func(id string) (interface{}, bool, error) {
+			info, err := app.promoteEndpoint(id)
+			return info, info != nil, err
+		}
+	}
+	app.api.BufferStats = func() interface{} {
+		return buffers.Stats()
+	}
+	app.api.Reload = func(dryRun bool) (interface{}, error) {
+		return app.Reload(dryRun)
+	}
+	app.api.ReloadStats = func() interface{} {
+		return app.reloads.get()
+	}
+	app.api.PeakStats = func() interface{} {
+		return peaks.Stats()
+	}
+	app.api.ResetPeaks = func() interface{} {
+		return peaks.Reset()
+	}
+	app.api.Gauges = app.gauges
+	app.api.Readiness = app.readiness
+	app.api.Envelope = func(message []byte) []byte {
+		return connections.Wrap(message, app.TeeRawPackets)
+	}
+	app.api.Health = app.health
+	app.api.Drain = app.drain
+	app.api.HookStats = func() interface{} {
+		return app.Hooks.Stats()
+	}
+	app.api.CompareStats = func() interface{} {
+		if stats := app.compareGroups.Stats(); len(stats) > 0 {
+			return stats
+		}
+		return nil
+	}
+	app.api.MessageTypes = app.messageTypes
+	if err := app.api.SetInjectXIDRange(uint32(app.InjectXIDBase), uint32(app.InjectXIDRange)); err != nil {
+		return err
+	}
+	app.api.Auth = app.APIAuth
+	app.api.Start()
+	go app.supervise(ctx, SubsystemAPI, func(ready func()) error {
+		return app.serveAPI(ctx, ready)
+	})
+
+	// Degrade predictably as the memory in use approaches its ceiling, if
+	// one is set, see `memoryLadder`
+	if app.MemoryCeiling > 0 {
+		app.pressure = newMemoryLadder(uint64(app.MemoryCeiling), heapInUse, app.engageMemoryStep)
+		go app.pressure.run(ctx, MemorySampleInterval)
+	}
+
+	// Periodically log a summary of the statistics, if requested
+	if app.StatsLogInterval > 0 {
+		go logStats(ctx, app.StatsLogInterval)
+	}
+
+	// Start the gRPC API, if requested, which shares the devices known to
+	// the API sub-system
+	if app.GRPCListenOn != "" {
+		go app.supervise(ctx, SubsystemGRPC, func(ready func()) error {
+			return app.serveGRPC(ctx, ready)
+		})
+	}
+
+	// Listen for tee streams from chained instances, if requested
+	if app.ChainListenOn != "" {
+		go app.supervise(ctx, SubsystemChain, func(ready func()) error {
+			return app.serveChain(ctx, ready)
+		})
+	}
+
+	// Listen and serve device requests, until told to terminate, and then
+	// drain the device connections and the end points
+	app.supervise(ctx, SubsystemListener, func(ready func()) error {
+		return app.serveDevices(ctx, ready)
+	})
+	app.shutdown()
+	return app.failed()
+}
@@ -0,0 +1,844 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/api"
+	"github.com/ciena/oftee/connections"
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/datapath"
+	"github.com/ciena/oftee/events"
+	"github.com/ciena/oftee/hooks"
+	"github.com/ciena/oftee/internal/harness"
+	"github.com/ciena/oftee/packetin"
+	of "github.com/netrack/openflow"
+	"github.com/netrack/openflow/ofp"
+	log "github.com/sirupsen/logrus"
+)
+
+// chainedPacketIn builds a tee stream entry, context followed by a packet in
+// message, carrying an Ethernet frame of the given type
+func chainedPacketIn(t *testing.T, dpid uint64, ethType uint16) []byte {
+	return chainedPacketInOf(t, dpid, ethType, 60)
+}
+
+// chainedPacketInOf builds a tee stream entry as `chainedPacketIn` does, of a
+// frame of the given length
+func chainedPacketInOf(t *testing.T, dpid uint64, ethType uint16, length int) []byte {
+	frame := make([]byte, length)
+	copy(frame, []byte{0x01, 0x80, 0xc2, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})
+	frame[12] = byte(ethType >> 8)
+	frame[13] = byte(ethType)
+
+	body := &bytes.Buffer{}
+	packetIn := ofp.PacketIn{
+		Buffer: ofp.NoBuffer,
+		Length: uint16(len(frame)),
+		Data:   frame,
+	}
+	if _, err := packetIn.WriteTo(body); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := &bytes.Buffer{}
+	context := OpenFlowContext{DatapathID: dpid, Port: 1}
+	if _, err := context.WriteTo(stream); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := of.NewRequest(of.TypePacketIn, body).WriteTo(stream); err != nil {
+		t.Fatal(err)
+	}
+	return stream.Bytes()
+}
+
+// decodedPacketIn builds the context, of the given DPID, followed by a packet
+// in of the given frame without an in_port, as it is tee-ed, and decodes the
+// packet in
+func decodedPacketIn(t *testing.T, dpid uint64, frame []byte) ([]byte, *packetin.PacketIn) {
+	m := harness.NewMessage(t, of.TypePacketIn, 1, &ofp.PacketIn{
+		Buffer: ofp.NoBuffer,
+		Length: uint16(len(frame)),
+		Data:   frame,
+	})
+	message := append(make([]byte, 12), m.Raw...)
+	binary.BigEndian.PutUint64(message, dpid)
+	packetIn, err := packetin.Decode(message[12], message[12:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message, &packetIn
+}
+
+// chainedTo returns the end points of a chained connection, those given
+// whatever the hop count
+func chainedTo(endpoints ...connections.Connection) *chainedEndpoints {
+	return &chainedEndpoints{establish: func(uint32) (connections.Endpoints, error) {
+		return connections.Endpoints(endpoints), nil
+	}}
+}
+
+func TestHandleChain(t *testing.T) {
+	collector, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	endpoint := (&connections.TCPConnection{
+		Criteria: criteria.Criteria{Set: criteria.BitDLType, DlType: 0x888e},
+	}).Initialize()
+	if err = endpoint.Dial(collector.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	go endpoint.ListenAndSend()
+	received, err := collector.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer received.Close()
+
+	// Only the EAPOL packet matches the end point criteria
+	eapol := chainedPacketIn(t, 0x1, 0x888e)
+	arp := chainedPacketIn(t, 0x2, 0x0806)
+	upstream, downstream := net.Pipe()
+	app := &App{}
+	done := make(chan error)
+	go func() {
+		done <- app.handleChain(context.Background(), downstream, chainedTo(endpoint))
+	}()
+	for _, message := range [][]byte{arp, eapol} {
+		if _, err = upstream.Write(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upstream.Close()
+	if err = <-done; err != nil {
+		t.Errorf("Unexpected error processing chained stream: %v", err)
+	}
+
+	buf := make([]byte, len(eapol))
+	received.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = io.ReadFull(received, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, eapol) {
+		t.Errorf("Chained message not tee-ed unchanged, expected %02x, got %02x", eapol, buf)
+	}
+}
+
+func TestHandleChainLargeMessages(t *testing.T) {
+	collector, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	endpoint := (&connections.TCPConnection{}).Initialize()
+	if err = endpoint.Dial(collector.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	go endpoint.ListenAndSend()
+	received, err := collector.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer received.Close()
+
+	// Messages larger than the buffer are read whole, not truncated,
+	// before and after a small one
+	stream := [][]byte{
+		chainedPacketInOf(t, 0x1, 0x888e, 9000),
+		chainedPacketIn(t, 0x2, 0x888e),
+		chainedPacketInOf(t, 0x3, 0x888e, 4000),
+	}
+	upstream, downstream := net.Pipe()
+	app := &App{Config: Config{BufferSize: MinReadBufferSize}}
+	done := make(chan error)
+	go func() {
+		done <- app.handleChain(context.Background(), downstream, chainedTo(endpoint))
+	}()
+	for _, message := range stream {
+		if _, err = upstream.Write(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upstream.Close()
+	if err = <-done; err != nil {
+		t.Errorf("Unexpected error processing chained stream: %v", err)
+	}
+
+	received.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for i, message := range stream {
+		buf := make([]byte, len(message))
+		if _, err = io.ReadFull(received, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, message) {
+			t.Errorf("Chained message %d of %d bytes not tee-ed unchanged", i, len(message))
+		}
+	}
+}
+
+func TestHandleChainInvalidLength(t *testing.T) {
+	message := chainedPacketIn(t, 0x1, 0x888e)
+	// Corrupt the OpenFlow header length, which follows the context
+	message[12+2] = 0
+	message[12+3] = 4
+
+	upstream, downstream := net.Pipe()
+	go upstream.Write(message)
+	defer upstream.Close()
+	if err := (&App{}).handleChain(context.Background(), downstream, chainedTo()); err == nil {
+		t.Error("Expected error for invalid OpenFlow message length")
+	}
+}
+
+func TestChainTwoInstances(t *testing.T) {
+	collector, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	// Regional instance, tees EAPOL packets it receives from the chain
+	// to the collector, connecting to it as the first is received
+	regional := &App{Config: Config{ShareConnections: true, TeeTo: []string{
+		"dl_type=0x888e;action=tcp://" + collector.Addr().String(),
+	}}}
+	chain, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Close()
+	go regional.chainServe(context.Background(), chain)
+
+	// Edge instance, tees everything to the regional instance
+	edge := &App{Config: Config{TeeTo: []string{"tcp://" + chain.Addr().String()}}}
+	endpoints, err := edge.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	eapol := chainedPacketIn(t, 0x1, 0x888e)
+	for _, message := range [][]byte{chainedPacketIn(t, 0x2, 0x0806), eapol} {
+		packetIn, _ := packetin.Decode(message[12], message[12:])
+		if err = edge.teePacketIn(context.Background(), log.NewEntry(log.StandardLogger()), endpoints, message, &packetIn, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	received, err := collector.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer received.Close()
+
+	buf := make([]byte, len(eapol))
+	received.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = io.ReadFull(received, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, eapol) {
+		t.Errorf("Message not tee-ed through chain unchanged, expected %02x, got %02x", eapol, buf)
+	}
+}
+
+// connectDevice starts handling a device connection, with a fake SDN
+// controller, and completes the handshake so that the device is known by the
+// given DPID. It returns the device and controller ends of the connections
+// and a channel on which the result of the handler is sent.
+func connectDevice(t *testing.T, dpid uint64, endpoints ...connections.Connection) (*App, net.Conn, net.Conn, chan error) {
+	return connectDeviceWith(t, &App{}, dpid, endpoints...)
+}
+
+// connectDeviceWith connects a device, with the given DPID, to the given
+// application, which proxies to a controller listening locally
+func connectDeviceWith(t *testing.T, app *App, dpid uint64, endpoints ...connections.Connection) (*App, net.Conn, net.Conn, chan error) {
+	controller, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer controller.Close()
+
+	app.ProxyTo = controller.Addr().String()
+	app.api = api.NewAPI(":0", "", "")
+	go app.api.ListenAndServe()
+
+	device, conn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- app.handle(context.Background(), conn, connections.Endpoints(endpoints))
+	}()
+	proxied, err := controller.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := &bytes.Buffer{}
+	features := ofp.SwitchFeatures{DatapathID: dpid}
+	if _, err = features.WriteTo(body); err != nil {
+		t.Fatal(err)
+	}
+	length := 8 + int64(body.Len())
+	if _, err = of.NewRequest(of.TypeFeaturesReply, body).WriteTo(device); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.CopyN(ioutil.Discard, proxied, length); err != nil {
+		t.Fatal(err)
+	}
+	return app, device, proxied, done
+}
+
+func TestForceDisconnect(t *testing.T) {
+	app, device, controller, done := connectDevice(t, 0x1)
+	defer device.Close()
+	defer controller.Close()
+	app.api.Auth = "secret"
+
+	var resp *http.Response
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		req := httptest.NewRequest("DELETE", "/oftee/0x1/connection?reason=test", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		app.api.ServeHTTP(recorder, req)
+		resp = recorder.Result()
+		if resp.StatusCode != http.StatusNotFound || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Incorrect response code, expected 202, got %d", resp.StatusCode)
+	}
+	var data api.DisconnectResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Sessions) != 1 || data.Sessions[0].Messages != 1 || data.Sessions[0].Reason != "test" {
+		t.Errorf("Incorrect session statistics, got %+v", data.Sessions)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("Device connection not cleaned up after disconnect")
+	}
+}
+
+// portEvents an events target that records the port events offered to it
+type portEvents chan events.Event
+
+func (e portEvents) Accepts(eventType string) bool {
+	return strings.HasPrefix(eventType, "port_")
+}
+
+func (e portEvents) Offer(event events.Event) {
+	e <- event
+}
+
+// expectPortEvents checks that the port events, of the given types and port
+// numbers, were offered in order
+func expectPortEvents(t *testing.T, offered portEvents, expected ...string) {
+	t.Helper()
+	for _, expect := range expected {
+		select {
+		case event := <-offered:
+			if got := fmt.Sprintf("%s %d", event.Type, event.Port.(api.PortInfo).Number); got != expect {
+				t.Errorf("Expected port event '%s', got '%s'", expect, got)
+			}
+		case <-time.After(harness.Timeout):
+			t.Fatalf("Expected port event '%s'", expect)
+		}
+	}
+	if len(offered) != 0 {
+		t.Errorf("Expected no more port events, got %d", len(offered))
+	}
+}
+
+func TestTrackPorts(t *testing.T) {
+	offered := make(portEvents, 10)
+	app, device, controller, done := connectDeviceWith(t, &App{notifier: &events.Notifier{Targets: []events.Target{offered}}}, 0x1)
+	defer controller.Close()
+
+	hwaddr, _ := net.ParseMAC("00:00:00:00:00:01")
+	port := func(no ofp.PortNo, name string) ofp.Port {
+		return ofp.Port{PortNo: no, HWAddr: hwaddr, Name: name, CurrSpeed: 1000000}
+	}
+
+	// Port descriptions, followed by a port being deleted and another
+	// modified
+	body := &bytes.Buffer{}
+	reply := ofp.MultipartReply{Type: ofp.MultipartTypePortDescription}
+	reply.WriteTo(body)
+	ports := []ofp.Port{port(1, "eth1"), port(2, "eth2"), port(3, "eth3")}
+	for i := range ports {
+		ports[i].WriteTo(body)
+	}
+	messages := []*of.Request{of.NewRequest(of.TypeMultipartReply, body)}
+	for _, status := range []ofp.PortStatus{
+		{Reason: ofp.PortReasonDelete, Port: port(2, "eth2")},
+		{Reason: ofp.PortReasonModify, Port: port(3, "uplink")},
+	} {
+		body := &bytes.Buffer{}
+		status.WriteTo(body)
+		messages = append(messages, of.NewRequest(of.TypePortStatus, body))
+	}
+	sent := &bytes.Buffer{}
+	for _, message := range messages {
+		message.WriteTo(sent)
+	}
+	go device.Write(sent.Bytes())
+
+	// The messages are proxied to the controller unchanged
+	received := make([]byte, sent.Len())
+	if _, err := io.ReadFull(controller, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, sent.Bytes()) {
+		t.Error("Port messages not proxied to controller unchanged")
+	}
+
+	if p, ok := app.api.Port(0x1, 1); !ok || p.Name != "eth1" || p.HWAddr != "00:00:00:00:00:01" {
+		t.Errorf("Incorrect port 1, got %+v", p)
+	}
+	if _, ok := app.api.Port(0x1, 2); ok {
+		t.Error("Expected port 2 to be deleted")
+	}
+	if p, _ := app.api.Port(0x1, 3); p.Name != "uplink" {
+		t.Errorf("Expected port 3 to be renamed, got %+v", p)
+	}
+
+	// Each change to the ports is sent as an event
+	expectPortEvents(t, offered, "port_added 1", "port_added 2", "port_added 3", "port_deleted 2", "port_modified 3")
+
+	// Ports are forgotten when the device disconnects
+	device.Close()
+	<-done
+	deadline := time.Now().Add(2 * time.Second)
+	for _, ok := app.api.Port(0x1, 1); ok && time.Now().Before(deadline); _, ok = app.api.Port(0x1, 1) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := app.api.Port(0x1, 1); ok {
+		t.Error("Expected ports to be cleared on disconnect")
+	}
+}
+
+func TestShadowEndpoint(t *testing.T) {
+	// Nothing is listening, a shadow end point never connects
+	closed := harness.NewTCPEndpoint(t)
+	closed.Stop()
+	consumer := harness.NewTCPEndpoint(t)
+	defer consumer.Stop()
+
+	r := newRig(t, closed.Spec("dl_type=0x888e", "shadow=true"), consumer.Spec("dl_type=0x888e"))
+	defer r.close()
+	device, controller, _ := r.connect(0x1, 0)
+	defer device.Close()
+	eapol := device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64))
+	arp := device.SendPacketIn(1, harness.EthernetFrame(0x0806, 64))
+
+	// The shadow end point doesn't affect the delivery to others
+	controller.ExpectMessages(t, controller.Messages()[0], eapol, arp)
+	consumer.Frames.ExpectFrames(t, harness.FrameOf(0x1, 1, eapol))
+	endpoints := r.app.sharedEndpoints()
+	deadline := time.Now().Add(2 * time.Second)
+	for endpoints.Stats()[0].Matches != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := endpoints.Stats(); len(stats) != 2 || !stats[0].Shadow || stats[0].Matches != 1 || closed.Connections() != 0 {
+		t.Errorf("Incorrect shadow end point stats, got %+v", stats)
+	}
+}
+
+func TestNeighborDiscoveryEndpoint(t *testing.T) {
+	app := &App{Config: Config{TeeTo: []string{"proto=nd;shadow=true;action=tcp://127.0.0.1:1"}}}
+	endpoints, err := app.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatalf("Unexpected error establishing end point: %v", err)
+	}
+
+	// A neighbor solicitation with a source link-layer address option
+	// matches, an ICMPv6 echo request and an IPv4 frame do not
+	solicitation, _ := hex.DecodeString("3333ff00000100112233445586dd6000000000203afffe800000000000000211" +
+		"22fffe334455ff0200000000000000000001ff00000187007f30000000002001" +
+		"0db80000000000000000000000010101001122334455")
+	echo := append([]byte(nil), solicitation...)
+	echo[54] = 128
+	ipv4 := append([]byte(nil), solicitation...)
+	ipv4[12], ipv4[13] = 0x08, 0x00
+	for _, frame := range [][]byte{solicitation, echo, ipv4} {
+		message, packetIn := decodedPacketIn(t, 0x1, frame)
+		if err = app.teePacketIn(context.Background(), log.NewEntry(log.StandardLogger()), endpoints, message, packetIn, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for endpoints.Stats()[0].Matches != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if stats := endpoints.Stats(); stats[0].Matches != 1 {
+		t.Errorf("Expected only the neighbor solicitation matched, got %+v", stats)
+	}
+}
+
+func TestPacketInWithoutInPort(t *testing.T) {
+	app := &App{Config: Config{TeeTo: []string{
+		"in_port=1;shadow=true;action=tcp://127.0.0.1:1",
+		"shadow=true;action=tcp://127.0.0.1:2",
+	}}}
+	endpoints, err := app.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatalf("Unexpected error establishing end points: %v", err)
+	}
+	message, packetIn := decodedPacketIn(t, 0x1, harness.EthernetFrame(0x888e, 64))
+	if packetIn.HasInPort {
+		t.Errorf("Expected no in_port, got %d", packetIn.InPort)
+	}
+	if err = app.teePacketIn(context.Background(), log.NewEntry(log.StandardLogger()), endpoints, message, packetIn, false); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for endpoints.Stats()[1].Matches != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := endpoints.Stats(); stats[0].Matches != 0 || stats[1].Matches != 1 {
+		t.Errorf("Expected the packet in only matched without an in_port condition, got %+v", stats)
+	}
+}
+
+func TestPacketInBeforeHandshake(t *testing.T) {
+	message, packetIn := decodedPacketIn(t, 0x1, harness.EthernetFrame(0x888e, 64))
+	app := &App{Config: Config{TeeTo: []string{
+		"dpid=0x1;shadow=true;action=tcp://127.0.0.1:1",
+		"shadow=true;action=tcp://127.0.0.1:2",
+	}}}
+	endpoints, err := app.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatalf("Unexpected error establishing end points: %v", err)
+	}
+
+	// Until the handshake completes the DPID isn't known, so the packet
+	// in only matches the end point without a dpid condition
+	for _, learned := range []bool{false, true} {
+		if err = app.teePacketIn(context.Background(), log.NewEntry(log.StandardLogger()), endpoints, message, packetIn, learned); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for endpoints.Stats()[1].Matches != 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := endpoints.Stats(); stats[0].Matches != 1 || stats[1].Matches != 2 {
+		t.Errorf("Expected the packet in only matched by dpid once learned, got %+v", stats)
+	}
+}
+
+func TestNetworkDecodedOnlyWhenMatched(t *testing.T) {
+	app := &App{Config: Config{LazyEndpoints: true, TeeTo: []string{"dl_type=ipv4;action=tcp://127.0.0.1:1"}}}
+	endpoints, err := app.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := ipv4Frame(17, "0.0.0.0", "255.255.255.255")
+	if state, _ := packetState(frame, endpoints.RequiredCriteriaBits()); state.Set != criteria.BitDLType|criteria.BitDLSrc|criteria.BitDLDst {
+		t.Errorf("Expected only the Ethernet header decoded, got %s", state)
+	}
+
+	// Decoded once any end point matches on it
+	app.TeeTo = append(app.TeeTo, "nw_proto=udp;action=tcp://127.0.0.1:1")
+	if endpoints, err = app.EstablishEndpointConnections(); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := packetState(frame, endpoints.RequiredCriteriaBits()); state.Set&criteria.BitsNetwork != criteria.BitsNetwork || state.NwProto != 17 {
+		t.Errorf("Expected the IPv4 header decoded, got %s", state)
+	}
+}
+
+func TestPacketNotDecodedWhenUnconditioned(t *testing.T) {
+	app := &App{Config: Config{LazyEndpoints: true, TeeTo: []string{"action=tcp://127.0.0.1:1", "in_port=1-8;action=tcp://127.0.0.1:2"}}}
+	endpoints, err := app.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if required := endpoints.RequiredCriteriaBits(); required&criteria.BitsPacket != 0 {
+		t.Fatalf("Expected nothing required from the packet, got 0x%x", required)
+	}
+	if state, ok := packetState(ipv4Frame(17, "0.0.0.0", "255.255.255.255"), criteria.BitEmpty); !ok || state.Set != criteria.BitEmpty {
+		t.Errorf("Expected nothing decoded, got %s (%t)", state, ok)
+	}
+	if _, ok := packetState(make([]byte, 13), criteria.BitEmpty); ok {
+		t.Error("Expected a frame shorter than an Ethernet header not matched")
+	}
+}
+
+// BenchmarkPacketStateUnconditioned the cost of matching a packet in when no
+// end point matches on the packet
+func BenchmarkPacketStateUnconditioned(b *testing.B) {
+	frame := ipv4Frame(17, "10.0.0.1", "10.0.0.2")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		packetState(frame, criteria.BitEmpty)
+	}
+}
+
+// BenchmarkPacketStateEthernetType the cost of matching a packet in when end
+// points match on its Ethernet type
+func BenchmarkPacketStateEthernetType(b *testing.B) {
+	frame := ipv4Frame(17, "10.0.0.1", "10.0.0.2")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		packetState(frame, criteria.BitDLType)
+	}
+}
+
+// BenchmarkPacketStateNetwork the cost of matching a packet in when end points
+// match on its IPv4 header
+func BenchmarkPacketStateNetwork(b *testing.B) {
+	frame := ipv4Frame(17, "10.0.0.1", "10.0.0.2")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		packetState(frame, criteria.BitsPacket)
+	}
+}
+
+func TestWarmEndpoint(t *testing.T) {
+	methods := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		methods <- req.Method + " " + req.URL.Path
+	}))
+	defer server.Close()
+
+	// Only the eager end point is warmed when it is established
+	app := &App{Config: Config{TeeTo: []string{
+		"dl_type=0x888e;action=" + server.URL + "/eager",
+		"dl_type=0x888e;connect=lazy;action=" + server.URL + "/lazy",
+	}}}
+	if _, err := app.EstablishEndpointConnections(); err != nil {
+		t.Fatalf("Unexpected error establishing end points: %v", err)
+	}
+	select {
+	case method := <-methods:
+		if method != "HEAD /eager" {
+			t.Errorf("Expected eager end point warmed, got '%s'", method)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected eager end point warmed")
+	}
+	select {
+	case method := <-methods:
+		t.Errorf("Expected lazy end point not warmed, got '%s'", method)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDeviceErrors(t *testing.T) {
+	shadow := &App{Config: Config{TeeTo: []string{
+		"of_type=error;shadow=true;action=tcp://127.0.0.1:1",
+		"shadow=true;action=tcp://127.0.0.1:1",
+	}}}
+	endpoints, err := shadow.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatalf("Unexpected error establishing end points: %v", err)
+	}
+	app, device, controller, done := connectDevice(t, 0x1, endpoints...)
+	defer controller.Close()
+
+	// An error for a packet out injected via the API, followed by one for
+	// a flow mod from the controller
+	message := func(messageType of.Type, xid uint32, body []byte) []byte {
+		buf := &bytes.Buffer{}
+		header := of.Header{Version: OFVersion13, Type: messageType, Length: uint16(8 + len(body)), Transaction: xid}
+		header.WriteTo(buf)
+		buf.Write(body)
+		return buf.Bytes()
+	}
+	errorBody := func(code ofp.ErrCode, failed of.Type, xid uint32) []byte {
+		buf := &bytes.Buffer{}
+		e := ofp.Error{Type: ofp.ErrTypeBadAction, Code: code, Data: message(failed, xid, nil)}
+		e.WriteTo(buf)
+		return buf.Bytes()
+	}
+	injectedError := message(of.TypeError, api.InjectXIDBase, errorBody(ofp.ErrCodeBadActionLen, of.TypePacketOut, api.InjectXIDBase))
+	controllerError := message(of.TypeError, 0x1234, errorBody(ofp.ErrCodeBadActionOutPort, of.TypeFlowMod, 0x1234))
+	go device.Write(append(append([]byte(nil), injectedError...), controllerError...))
+
+	// The error for the injected packet out is not proxied to the
+	// controller
+	received := make([]byte, len(controllerError))
+	if _, err = io.ReadFull(controller, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, controllerError) {
+		t.Errorf("Expected only the error for the controller proxied, got %02x", received)
+	}
+
+	resp := httptest.NewRecorder()
+	app.api.ServeHTTP(resp, httptest.NewRequest("GET", "/oftee/0x1", nil))
+	var data api.DeviceResponse
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Errors) != 2 || data.Errors["ErrCodeBadActionOutPort"] != 1 || data.Errors["ErrCodeBadActionLen"] != 1 {
+		t.Errorf("Incorrect device error counts, got %+v", data.Errors)
+	}
+
+	// Both errors are tee-ed to the end point subscribed to errors, not
+	// to that for packet ins
+	deadline := time.Now().Add(2 * time.Second)
+	for endpoints.Stats()[0].Matches != 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := endpoints.Stats(); stats[0].Matches != 2 || stats[1].Matches != 0 {
+		t.Errorf("Expected errors tee-ed only to the error end point, got %+v", stats)
+	}
+
+	device.Close()
+	<-done
+}
+
+func TestDeviceAsyncMessages(t *testing.T) {
+	shadow := &App{Config: Config{TeeTo: []string{
+		"of_type=flow_removed|port_status;shadow=true;action=tcp://127.0.0.1:1",
+		"of_type=port_status;shadow=true;action=tcp://127.0.0.1:1",
+		"shadow=true;action=tcp://127.0.0.1:1",
+	}}}
+	endpoints, err := shadow.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatalf("Unexpected error establishing end points: %v", err)
+	}
+	_, device, controller, done := connectDevice(t, 0x1, endpoints...)
+	defer controller.Close()
+
+	message := func(messageType of.Type, xid uint32, body []byte) []byte {
+		buf := &bytes.Buffer{}
+		header := of.Header{Version: OFVersion13, Type: messageType, Length: uint16(8 + len(body)), Transaction: xid}
+		header.WriteTo(buf)
+		buf.Write(body)
+		return buf.Bytes()
+	}
+	flowRemoved := message(of.TypeFlowRemoved, 0x1, make([]byte, 40))
+	portStatus := message(of.TypePortStatus, 0x2, make([]byte, 8))
+	sent := append(append([]byte(nil), flowRemoved...), portStatus...)
+	go device.Write(sent)
+
+	// Both messages are proxied to the controller
+	received := make([]byte, len(sent))
+	if _, err = io.ReadFull(controller, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, sent) {
+		t.Errorf("Expected flow removed and port status proxied, got %02x", received)
+	}
+
+	// And tee-ed only to the end points that ask for them
+	deadline := time.Now().Add(2 * time.Second)
+	for endpoints.Stats()[0].Matches != 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := endpoints.Stats(); stats[0].Matches != 2 || stats[1].Matches != 1 || stats[2].Matches != 0 {
+		t.Errorf("Expected flow removed and port status tee-ed by type, got %+v", stats)
+	}
+
+	device.Close()
+	<-done
+}
+
+func TestHooks(t *testing.T) {
+	var connected, learned []string
+	disconnected := make(chan hooks.DisconnectStats, 1)
+	app := &App{Config: Config{Hooks: &hooks.Hooks{
+		OnConnect: func(info hooks.ConnInfo) {
+			connected = append(connected, info.RemoteAddr)
+		},
+		OnDPID: func(dpid uint64, info hooks.ConnInfo) {
+			learned = append(learned, datapath.Format(dpid))
+		},
+		OnPacketIn: func(meta hooks.PacketInMeta, payload []byte) bool {
+			switch binary.BigEndian.Uint16(payload[12:]) {
+			case 0x88cc:
+				return false
+			case 0x0806:
+				panic("unexpected ARP")
+			}
+			return true
+		},
+		OnDisconnect: func(info hooks.ConnInfo, stats hooks.DisconnectStats) {
+			disconnected <- stats
+		},
+	}}}
+	shadow := (&connections.ShadowConnection{Target: "tcp://127.0.0.1:1"}).Initialize()
+	go shadow.ListenAndSend()
+	_, device, controller, done := connectDeviceWith(t, app, 0x1, shadow)
+	defer controller.Close()
+	if len(connected) != 1 || len(learned) != 1 || learned[0] != "of:0x0000000000000001" {
+		t.Errorf("Expected connect and DPID hooks called once, got %v and %v", connected, learned)
+	}
+
+	// The LLDP packet in is vetoed, the ARP packet in is tee-ed although
+	// the hook panics
+	for _, ethType := range []uint16{0x888e, 0x88cc, 0x0806} {
+		message := chainedPacketIn(t, 0x1, ethType)[12:]
+		if _, err := device.Write(message); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.CopyN(ioutil.Discard, controller, int64(len(message))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer device.Close()
+	app.api.Auth = "secret"
+	req := httptest.NewRequest("DELETE", "/oftee/0x1/connection?reason=test", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	app.api.ServeHTTP(httptest.NewRecorder(), req)
+	<-done
+
+	deadline := time.Now().Add(2 * time.Second)
+	for shadow.Stats().Matches < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := shadow.Stats(); stats.Matches != 2 {
+		t.Errorf("Expected 2 packet ins tee-ed, got %d", stats.Matches)
+	}
+	if panics := app.Hooks.Stats().Panics; panics["on_packet_in"] != 1 || panics["on_connect"] != 0 {
+		t.Errorf("Expected one packet in hook panic counted, got %v", panics)
+	}
+	select {
+	case stats := <-disconnected:
+		if stats.DPID != 0x1 || stats.PacketIns != 3 || stats.Messages != 4 || stats.Reason != "test" {
+			t.Errorf("Incorrect disconnect stats, got %+v", stats)
+		}
+	default:
+		t.Error("Expected disconnect hook called")
+	}
+}
+
+func TestInstance(t *testing.T) {
+	// The instance is identified by INSTANCE_ID, or else its host name
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, expected := range map[string]string{"": hostname, "oftee-7": "oftee-7"} {
+		app := &App{Config: Config{InstanceID: id}}
+		if instance, err := app.instance(); err != nil || instance != expected {
+			t.Errorf("Expected instance '%s' for INSTANCE_ID '%s', got '%s' %v", expected, id, instance, err)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciena/oftee/api"
+	"github.com/ciena/oftee/connections"
+	log "github.com/sirupsen/logrus"
+)
+
+// PeakBuckets number of per second buckets in the ring of a rate, a second's
+// count is folded into the high-water mark when its bucket is reused
+const PeakBuckets = 60
+
+// HighWater the highest value of a measure, and when it was seen
+type HighWater struct {
+	Value int64      `json:"value"`
+	At    *time.Time `json:"at,omitempty"`
+}
+
+// PeakStats the high-water marks of the process since they were last reset
+type PeakStats struct {
+	Since             time.Time `json:"since"`
+	PacketInsPerSec   HighWater `json:"packet_ins_per_second"`
+	EndpointQueue     HighWater `json:"endpoint_queue_depth"`
+	DeviceConnections HighWater `json:"device_connections"`
+	LargestPacketIn   HighWater `json:"largest_packet_in"`
+}
+
+// highWater tracks the highest value of a measure. Values that don't exceed
+// the mark, the common case, only cost an atomic load.
+type highWater struct {
+	value int64
+	lock  sync.Mutex
+	at    time.Time
+}
+
+// observe records a value, seen at the given time
+func (h *highWater) observe(value int64, at time.Time) {
+	if value <= atomic.LoadInt64(&h.value) {
+		return
+	}
+	h.lock.Lock()
+	if value > h.value {
+		atomic.StoreInt64(&h.value, value)
+		h.at = at
+	}
+	h.lock.Unlock()
+}
+
+// get returns the mark
+func (h *highWater) get() HighWater {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	mark := HighWater{Value: h.value}
+	if !h.at.IsZero() {
+		at := h.at
+		mark.At = &at
+	}
+	return mark
+}
+
+// reset clears the mark
+func (h *highWater) reset() {
+	h.lock.Lock()
+	atomic.StoreInt64(&h.value, 0)
+	h.at = time.Time{}
+	h.lock.Unlock()
+}
+
+// rateBucket the count of a single second
+type rateBucket struct {
+	second int64
+	count  int64
+}
+
+// rateRing counts events in per second buckets, so that a burst within a
+// single second is seen however briefly it lasts. Each second's count is
+// folded into the high-water mark when its bucket is reused, and the buckets
+// not yet folded are included when the mark is read.
+type rateRing struct {
+	buckets [PeakBuckets]rateBucket
+	peak    highWater
+	since   int64
+}
+
+// add counts an event at the given time
+func (r *rateRing) add(now time.Time) {
+	second := now.Unix()
+	b := &r.buckets[second%PeakBuckets]
+	if previous := atomic.LoadInt64(&b.second); previous != second &&
+		atomic.CompareAndSwapInt64(&b.second, previous, second) {
+		r.fold(previous, atomic.SwapInt64(&b.count, 0))
+	}
+	atomic.AddInt64(&b.count, 1)
+}
+
+// fold records the count of a second in the high-water mark, unless it was
+// before the mark was reset
+func (r *rateRing) fold(second, count int64) {
+	if second >= atomic.LoadInt64(&r.since) {
+		r.peak.observe(count, time.Unix(second, 0))
+	}
+}
+
+// get returns the high-water mark, including the seconds not yet folded
+func (r *rateRing) get() HighWater {
+	for i := range r.buckets {
+		r.fold(atomic.LoadInt64(&r.buckets[i].second), atomic.LoadInt64(&r.buckets[i].count))
+	}
+	return r.peak.get()
+}
+
+// reset clears the high-water mark, and ignores the counts before now
+func (r *rateRing) reset(now time.Time) {
+	atomic.StoreInt64(&r.since, now.Unix())
+	r.peak.reset()
+}
+
+// peakGauge the high-water marks of the process
+type peakGauge struct {
+	lock        sync.Mutex
+	since       time.Time
+	packetIns   rateRing
+	queue       highWater
+	connections highWater
+	packetIn    highWater
+}
+
+// peaks the high-water marks of the process
+var peaks = newPeakGauge(time.Now())
+
+// newPeakGauge creates high-water marks that start at the given time
+func newPeakGauge(now time.Time) *peakGauge {
+	g := &peakGauge{}
+	g.reset(now)
+	return g
+}
+
+// packetInReceived counts a packet in of the given length, in bytes
+func (g *peakGauge) packetInReceived(length int, now time.Time) {
+	g.packetIns.add(now)
+	g.packetIn.observe(int64(length), now)
+}
+
+// queued records the depth of the queues of end points once a message has
+// been queued to them
+func (g *peakGauge) queued(endpoints connections.Endpoints, now time.Time) {
+	for _, c := range endpoints {
+		if depth := int64(len(c.GetQueue())); depth > 0 {
+			g.queue.observe(depth, now)
+		}
+	}
+}
+
+// connected records the number of devices connected
+func (g *peakGauge) connected(count int64, now time.Time) {
+	g.connections.observe(count, now)
+}
+
+// Stats returns the high-water marks
+func (g *peakGauge) Stats() PeakStats {
+	g.lock.Lock()
+	since := g.since
+	g.lock.Unlock()
+	return PeakStats{
+		Since:             since,
+		PacketInsPerSec:   g.packetIns.get(),
+		EndpointQueue:     g.queue.get(),
+		DeviceConnections: g.connections.get(),
+		LargestPacketIn:   g.packetIn.get(),
+	}
+}
+
+// reset clears the high-water marks
+func (g *peakGauge) reset(now time.Time) {
+	g.lock.Lock()
+	g.since = now
+	g.lock.Unlock()
+	g.packetIns.reset(now)
+	g.queue.reset()
+	g.connections.reset()
+	g.packetIn.reset()
+}
+
+// Reset clears the high-water marks, returning them as they were
+func (g *peakGauge) Reset() PeakStats {
+	stats := g.Stats()
+	g.reset(time.Now())
+	return stats
+}
+
+// Gauges returns the high-water marks, and when each was seen, as gauges
+func (g *peakGauge) Gauges() []api.Gauge {
+	stats := g.Stats()
+	var gauges []api.Gauge
+	for _, mark := range []struct {
+		name string
+		help string
+		mark HighWater
+	}{
+		{"oftee_peak_packet_ins_per_second", "highest number of packet ins received in a second", stats.PacketInsPerSec},
+		{"oftee_peak_endpoint_queue_depth", "highest number of messages queued to an end point", stats.EndpointQueue},
+		{"oftee_peak_device_connections", "highest number of concurrent device connections", stats.DeviceConnections},
+		{"oftee_peak_packet_in_bytes", "length of the largest packet in received", stats.LargestPacketIn},
+	} {
+		var at float64
+		if mark.mark.At != nil {
+			at = float64(mark.mark.At.UnixNano()) / float64(time.Second)
+		}
+		gauges = append(gauges,
+			api.Gauge{Name: mark.name, Help: mark.help + " since the peaks were reset", Value: float64(mark.mark.Value)},
+			api.Gauge{Name: mark.name + "_timestamp_seconds", Help: "time at which the " + mark.help + " was seen", Value: at})
+	}
+	return gauges
+}
+
+// logStats logs a summary of the buffers and the high-water marks at the
+// given interval, until the context is done
+func logStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		buffer := buffers.Stats()
+		peak := peaks.Stats()
+		log.
+			WithFields(log.Fields{
+				"connections":                buffer.Connections,
+				"buffer_bytes":               buffer.TotalBytes,
+				"peak_packet_ins_per_second": peak.PacketInsPerSec.Value,
+				"peak_endpoint_queue_depth":  peak.EndpointQueue.Value,
+				"peak_device_connections":    peak.DeviceConnections.Value,
+				"peak_packet_in_bytes":       peak.LargestPacketIn.Value,
+				"peaks_since":                peak.Since.Format(time.RFC3339),
+			}).
+			Info("Statistics summary")
+	}
+}
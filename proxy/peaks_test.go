@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/api"
+	"github.com/ciena/oftee/connections"
+)
+
+func TestPeakPacketInRate(t *testing.T) {
+	start := time.Unix(1000, 0)
+	g := newPeakGauge(start)
+
+	// A burst of 50 packet ins within 100ms of a single second, among
+	// a steady 10 a second
+	for second := 0; second < 5; second++ {
+		for i := 0; i < 10; i++ {
+			g.packetInReceived(100, start.Add(time.Duration(second)*time.Second+time.Duration(i)*time.Millisecond))
+		}
+	}
+	for i := 0; i < 50; i++ {
+		g.packetInReceived(1500, start.Add(2*time.Second+500*time.Millisecond+time.Duration(i)*2*time.Millisecond))
+	}
+	stats := g.Stats()
+	if stats.PacketInsPerSec.Value != 60 || !stats.PacketInsPerSec.At.Equal(start.Add(2*time.Second)) {
+		t.Errorf("Expected peak of 60 packet ins at +2s, got %+v", stats.PacketInsPerSec)
+	}
+	if stats.LargestPacketIn.Value != 1500 {
+		t.Errorf("Expected largest packet in of 1500 bytes, got %+v", stats.LargestPacketIn)
+	}
+
+	// Once its bucket is reused the burst is still the peak
+	g.packetInReceived(100, start.Add((PeakBuckets+2)*time.Second))
+	if stats = g.Stats(); stats.PacketInsPerSec.Value != 60 {
+		t.Errorf("Expected peak kept when its bucket is reused, got %+v", stats.PacketInsPerSec)
+	}
+
+	// Counts from before a reset are ignored
+	g.reset(start.Add((PeakBuckets + 3) * time.Second))
+	g.packetInReceived(100, start.Add((PeakBuckets+3)*time.Second))
+	if stats = g.Stats(); stats.PacketInsPerSec.Value != 1 || stats.LargestPacketIn.Value != 100 {
+		t.Errorf("Expected peaks reset, got %+v", stats)
+	}
+}
+
+func TestPeakQueueDepth(t *testing.T) {
+	g := newPeakGauge(time.Now())
+
+	// A shadow end point that is not delivering, so its queue fills
+	c := (&connections.ShadowConnection{Target: "tcp://127.0.0.1:1"}).Initialize()
+	for i := 0; i < 3; i++ {
+		c.GetQueue() <- []byte("message")
+		g.queued(connections.Endpoints{c}, time.Now())
+	}
+	if stats := g.Stats(); stats.EndpointQueue.Value != 3 || stats.EndpointQueue.At == nil {
+		t.Errorf("Expected peak queue depth of 3, got %+v", stats.EndpointQueue)
+	}
+	g.connected(2, time.Now())
+	g.connected(1, time.Now())
+	if stats := g.Stats(); stats.DeviceConnections.Value != 2 {
+		t.Errorf("Expected peak of 2 device connections, got %+v", stats.DeviceConnections)
+	}
+}
+
+func TestPeakMetrics(t *testing.T) {
+	g := newPeakGauge(time.Unix(1000, 0))
+	g.packetInReceived(512, time.Unix(1001, 0))
+	a := api.NewAPI(":0", "", "")
+	a.Gauges = g.Gauges
+	resp := httptest.NewRecorder()
+	a.ServeHTTP(resp, httptest.NewRequest("GET", "/oftee/metrics", nil))
+	for _, expected := range []string{
+		"# TYPE oftee_peak_packet_ins_per_second gauge\noftee_peak_packet_ins_per_second 1\n",
+		"oftee_peak_packet_in_bytes 512\n",
+		"oftee_peak_packet_in_bytes_timestamp_seconds 1001\n",
+		"oftee_peak_endpoint_queue_depth 0\n",
+	} {
+		if !strings.Contains(resp.Body.String(), expected) {
+			t.Errorf("Expected '%s' in metrics, got %s", expected, resp.Body.String())
+		}
+	}
+
+	// Resetting returns the peaks as they were
+	a.ResetPeaks = func() interface{} {
+		return g.Reset()
+	}
+	resp = httptest.NewRecorder()
+	a.ServeHTTP(resp, httptest.NewRequest("DELETE", "/oftee/stats/peaks", nil))
+	var before PeakStats
+	if err := json.Unmarshal(resp.Body.Bytes(), &before); err != nil {
+		t.Fatal(err)
+	}
+	if before.LargestPacketIn.Value != 512 || g.Stats().LargestPacketIn.Value != 0 {
+		t.Errorf("Expected peaks reset, got %+v before and %+v after", before, g.Stats())
+	}
+}
@@ -0,0 +1,494 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ciena/oftee/config"
+	"github.com/ciena/oftee/connections"
+	"github.com/kelseyhightower/envconfig"
+	log "github.com/sirupsen/logrus"
+)
+
+// The configuration is reloaded from the environment and the CONFIG_FILE, see
+// `ReadConfigFile`, on a SIGHUP or via the API. As the environment of a running
+// process doesn't change it is, in effect, the configuration file that is
+// reloaded. Only the end points, TEE_TO, and the LOG_LEVEL are applied to the
+// running process, changes to any other setting are reported as requiring a
+// restart and are not applied.
+
+// liveSettings the settings that are applied when the configuration is
+// reloaded
+var liveSettings = map[string]bool{
+	"TEE_TO":    true,
+	"LOG_LEVEL": true,
+}
+
+// ErrNoConfigFile is returned when the configuration is reloaded without a
+// configuration file from which to reload it
+var ErrNoConfigFile = errors.New("no configuration file, CONFIG_FILE, from which to reload")
+
+// ReloadDiff the changes a reload makes, or would make if a dry run, to the
+// running configuration
+type ReloadDiff struct {
+	DryRun    bool            `json:"dry_run"`
+	Endpoints EndpointDiff    `json:"endpoints"`
+	Settings  []SettingChange `json:"settings,omitempty"`
+	Restart   []SettingChange `json:"restart,omitempty"`
+}
+
+// EndpointDiff the end points added, removed and modified by a reload. An end
+// point is identified by its action, so one whose action is unchanged but
+// whose other terms changed is modified. Specifications are redacted.
+type EndpointDiff struct {
+	Added     []string         `json:"added,omitempty"`
+	Removed   []string         `json:"removed,omitempty"`
+	Modified  []EndpointChange `json:"modified,omitempty"`
+	Unchanged int              `json:"unchanged"`
+}
+
+// EndpointChange an end point whose specification changed
+type EndpointChange struct {
+	Action string `json:"action"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+// SettingChange a setting, by environment variable name, whose value changed.
+// Values are redacted.
+type SettingChange struct {
+	Name string      `json:"name"`
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// ReloadStats the outcomes of the configuration reloads
+type ReloadStats struct {
+	Applied   uint64     `json:"applied"`
+	DryRuns   uint64     `json:"dry_runs"`
+	Failed    uint64     `json:"failed"`
+	Last      *time.Time `json:"last,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// reloadStats counts the outcomes of the configuration reloads
+type reloadStats struct {
+	lock  sync.Mutex
+	stats ReloadStats
+}
+
+// record counts the outcome of a reload
+func (r *reloadStats) record(dryRun bool, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	r.stats.Last = &now
+	switch {
+	case err != nil:
+		r.stats.Failed++
+		r.stats.LastError = err.Error()
+	case dryRun:
+		r.stats.DryRuns++
+	default:
+		r.stats.Applied++
+	}
+}
+
+// get returns a copy of the counts
+func (r *reloadStats) get() ReloadStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.stats
+}
+
+// ReadConfigFile overrides the configuration with the `NAME=value` lines of
+// a file, where the names are those of the environment variables and values
+// are given as they would be in the environment. Blank lines and those that
+// start with `#` are ignored. A structured, YAML or JSON, file is read by
+// `readStructured` instead.
+func ReadConfigFile(c *Config, path string) error {
+	if config.Structured(path) {
+		return readStructured(c, path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		eq := strings.Index(text, "=")
+		if eq == -1 {
+			return fmt.Errorf("%s:%d: missing '=' in '%s'", path, line, text)
+		}
+		if err = setConfigValue(c, strings.TrimSpace(text[:eq]), strings.TrimSpace(text[eq+1:])); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// readStructured sets the configuration from a structured configuration file,
+// see `config.Read`, whose settings, unlike those of a file of `NAME=value`
+// lines, are overridden by the environment. Its end points, if given, are
+// kept in their structure, and as specifications, unless `TEE_TO` is set.
+func readStructured(c *Config, path string) error {
+	file, err := config.Read(path)
+	if err != nil {
+		return err
+	}
+	for _, setting := range file.Settings {
+		if _, ok := os.LookupEnv(setting.Name); ok {
+			continue
+		}
+		if err = setConfigValue(c, setting.Name, setting.Value); err != nil {
+			return &config.FieldError{Path: path, Field: setting.Field, Err: err}
+		}
+	}
+	if _, ok := os.LookupEnv("TEE_TO"); ok || !file.HasEndpoints {
+		return nil
+	}
+	specs, err := configuredSpecs(path, file.Endpoints)
+	if err != nil {
+		return err
+	}
+	c.TeeTo, c.Endpoints = specs, file.Endpoints
+	return nil
+}
+
+// setConfigValue sets the setting with the given environment variable name
+// from its value as it would be given in the environment. Setting `TEE_TO`
+// drops the end points of a structured configuration file.
+func setConfigValue(c *Config, name, value string) error {
+	if name == "CONFIG_FILE" {
+		return errors.New("CONFIG_FILE can't be set in the configuration file")
+	}
+	if name == "TEE_TO" {
+		c.Endpoints = nil
+	}
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("envconfig") != name {
+			continue
+		}
+		field := v.Field(i)
+		var err error
+		switch field.Interface().(type) {
+		case string:
+			field.SetString(value)
+		case []string:
+			var values []string
+			if value != "" {
+				values = strings.Split(value, ",")
+			}
+			field.Set(reflect.ValueOf(values))
+		case bool:
+			var b bool
+			b, err = strconv.ParseBool(value)
+			field.SetBool(b)
+		case int, int64:
+			var n int64
+			n, err = strconv.ParseInt(value, 0, 64)
+			field.SetInt(n)
+		case time.Duration:
+			var d time.Duration
+			d, err = time.ParseDuration(value)
+			field.SetInt(int64(d))
+		default:
+			return fmt.Errorf("unsupported setting '%s'", name)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value '%s' for %s: %s", value, name, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown setting '%s'", name)
+}
+
+// loadConfig resolves the configuration from the environment overridden by
+// the configuration file
+func loadConfig(path string) (*Config, error) {
+	var next Config
+	if err := envconfig.Process("", &next); err != nil {
+		return nil, err
+	}
+	if err := ReadConfigFile(&next, path); err != nil {
+		return nil, err
+	}
+	next.ConfigFile = path
+	return &next, nil
+}
+
+// endpointSpec an end point specification, identified by its action and in
+// a canonical form with its terms sorted, so that specifications that only
+// differ by the order of their terms are the same
+type endpointSpec struct {
+	spec      string
+	action    string
+	canonical string
+}
+
+// parseEndpointSpecs parses end point specifications into their canonical
+// forms
+func parseEndpointSpecs(specs []string) ([]endpointSpec, error) {
+	parsed := make([]endpointSpec, len(specs))
+	for i, spec := range specs {
+		terms, err := splitSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		u, err := parseAction(termValue(terms, TermAction))
+		if err != nil {
+			return nil, &SpecError{spec, offsetOf(terms, TermAction), err}
+		}
+		names := make([]string, 0, len(terms))
+		for _, term := range terms {
+			if term.name != TermAction {
+				names = append(names, term.name+"="+term.value)
+			}
+		}
+		sort.Strings(names)
+		parsed[i] = endpointSpec{
+			spec:      spec,
+			action:    u.String(),
+			canonical: strings.Join(append(names, TermAction+"="+u.String()), ";"),
+		}
+	}
+	return parsed, nil
+}
+
+// termValue returns the value of a term, or the empty string if it is not
+// given
+func termValue(terms []specTerm, name string) string {
+	for _, term := range terms {
+		if term.name == name {
+			return term.value
+		}
+	}
+	return ""
+}
+
+// diffEndpoints compares the running end point specifications with those to
+// be reloaded. For each of the reloaded end points it returns the index of
+// the running end point that is unchanged, and so kept, or -1 if it must be
+// established. End points with the same action are paired in order, after
+// those whose specifications are unchanged.
+func diffEndpoints(running, next []string) (EndpointDiff, []int, error) {
+	var diff EndpointDiff
+	from, err := parseEndpointSpecs(running)
+	if err != nil {
+		return diff, nil, err
+	}
+	to, err := parseEndpointSpecs(next)
+	if err != nil {
+		return diff, nil, err
+	}
+
+	keep := make([]int, len(to))
+	paired := make([]bool, len(from))
+	for i := range to {
+		keep[i] = -1
+		for j := range from {
+			if !paired[j] && from[j].canonical == to[i].canonical {
+				keep[i], paired[j] = j, true
+				diff.Unchanged++
+				break
+			}
+		}
+	}
+	for i := range to {
+		if keep[i] != -1 {
+			continue
+		}
+		modified := false
+		for j := range from {
+			if !paired[j] && from[j].action == to[i].action {
+				paired[j], modified = true, true
+				diff.Modified = append(diff.Modified, EndpointChange{
+					Action: redact("TEE_TO", to[i].action),
+					From:   redact("TEE_TO", from[j].spec),
+					To:     redact("TEE_TO", to[i].spec),
+				})
+				break
+			}
+		}
+		if !modified {
+			diff.Added = append(diff.Added, redact("TEE_TO", to[i].spec))
+		}
+	}
+	for j := range from {
+		if !paired[j] {
+			diff.Removed = append(diff.Removed, redact("TEE_TO", from[j].spec))
+		}
+	}
+	return diff, keep, nil
+}
+
+// diffSettings compares the running settings, other than the end points, with
+// those to be reloaded, split into those that are applied and those that
+// require a restart
+func diffSettings(running, next *Config) (live, restart []SettingChange) {
+	from := reflect.ValueOf(running).Elem()
+	to := reflect.ValueOf(next).Elem()
+	fromConfig := running.EffectiveConfig()
+	toConfig := next.EffectiveConfig()
+	t := from.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("envconfig")
+		if name == "" || name == "TEE_TO" || t.Field(i).PkgPath != "" {
+			continue
+		}
+		if reflect.DeepEqual(from.Field(i).Interface(), to.Field(i).Interface()) {
+			continue
+		}
+		change := SettingChange{Name: name, From: fromConfig[name], To: toConfig[name]}
+		if liveSettings[name] {
+			live = append(live, change)
+		} else {
+			restart = append(restart, change)
+		}
+	}
+	return live, restart
+}
+
+// teeTo returns the running end point specifications
+func (app *App) teeTo() []string {
+	app.endpointsLock.RLock()
+	defer app.endpointsLock.RUnlock()
+	return app.TeeTo
+}
+
+// sharedEndpoints returns the running shared end points
+func (app *App) sharedEndpoints() connections.Endpoints {
+	app.endpointsLock.RLock()
+	defer app.endpointsLock.RUnlock()
+	return app.endpoints
+}
+
+// liveEndpoints returns the end points to which a message is tee-ed. The
+// shared end points are replaced when the configuration is reloaded, so the
+// running end points are used rather than those when the device connected.
+func (app *App) liveEndpoints(endpoints connections.Endpoints) connections.Endpoints {
+	if !app.ShareConnections {
+		return endpoints
+	}
+	return app.sharedEndpoints()
+}
+
+// Reload reloads the configuration file and applies the changes to the end
+// points and the log level, unless a dry run. The changes are returned in
+// either case.
+func (app *App) Reload(dryRun bool) (diff *ReloadDiff, err error) {
+	defer func() {
+		app.reloads.record(dryRun, err)
+	}()
+	if app.ConfigFile == "" {
+		return nil, ErrNoConfigFile
+	}
+	next, err := loadConfig(app.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	logLevel, err := log.ParseLevel(next.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	// Changes are applied under the lock so that concurrent reloads are
+	// diffed against the running configuration
+	app.endpointsLock.Lock()
+	defer app.endpointsLock.Unlock()
+	diff = &ReloadDiff{DryRun: dryRun}
+	var keep []int
+	if diff.Endpoints, keep, err = diffEndpoints(app.TeeTo, next.TeeTo); err != nil {
+		return nil, err
+	}
+	diff.Settings, diff.Restart = diffSettings(&app.Config, next)
+	if dryRun {
+		return diff, nil
+	}
+
+	// Only the new and modified shared end points are established, those
+	// that are unchanged keep their connections and the others are closed.
+	// End points that are not shared are established from TEE_TO when a
+	// device connects, so the reloaded end points apply to the devices that
+	// connect after the reload.
+	if app.ShareConnections {
+		var specs []string
+		var configured []config.Endpoint
+		for i := range keep {
+			if keep[i] == -1 {
+				specs = append(specs, next.TeeTo[i])
+				if next.Endpoints != nil {
+					configured = append(configured, next.Endpoints[i])
+				}
+			}
+		}
+		var established connections.Endpoints
+		if next.Endpoints != nil {
+			established, err = app.establishConfigured(configured, app.annotator)
+		} else {
+			established, err = app.establishEndpoints(specs, app.annotator)
+		}
+		if err != nil {
+			return nil, err
+		}
+		endpoints := make(connections.Endpoints, len(keep))
+		ids := make([]string, len(keep))
+		for i := range keep {
+			if keep[i] == -1 {
+				endpoints[i], established = established[0], established[1:]
+				ids[i] = app.newEndpointIDs(1)[0]
+			} else {
+				endpoints[i] = app.endpoints[keep[i]]
+				ids[i] = app.endpointIDs[keep[i]]
+			}
+		}
+		var removed connections.Endpoints
+		var removedIDs []string
+		for j := range app.endpoints {
+			kept := false
+			for i := range keep {
+				kept = kept || keep[i] == j
+			}
+			if !kept {
+				removed = append(removed, app.endpoints[j])
+				removedIDs = append(removedIDs, app.endpointIDs[j])
+			}
+		}
+		app.endpoints = endpoints
+		app.endpointIDs = ids
+		closeRemoved(removed, removedIDs)
+	}
+	app.TeeTo = next.TeeTo
+	app.Endpoints = next.Endpoints
+	app.LogLevel = next.LogLevel
+	log.SetLevel(logLevel)
+	if app.api != nil {
+		app.api.SetConfig(app.EffectiveConfig())
+	}
+	log.
+		WithFields(log.Fields{
+			"added":     len(diff.Endpoints.Added),
+			"removed":   len(diff.Endpoints.Removed),
+			"modified":  len(diff.Endpoints.Modified),
+			"unchanged": diff.Endpoints.Unchanged,
+			"restart":   len(diff.Restart),
+		}).
+		Info("Reloaded configuration")
+	return diff, nil
+}
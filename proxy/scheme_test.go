@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ciena/oftee/connections"
+	"github.com/ciena/oftee/criteria"
+)
+
+// fakeEndpoint the last end point created by the fake scheme
+type fakeEndpoint struct {
+	u       *url.URL
+	match   criteria.Criteria
+	options connections.EndpointOptions
+}
+
+var fakeCreated fakeEndpoint
+
+// As an embedder would, the fake scheme is registered before any end points
+// are established
+func init() {
+	connections.RegisterScheme("fake", func(u *url.URL, match criteria.Criteria, options *connections.EndpointOptions) (connections.Connection, error) {
+		if u.Host == "" {
+			return nil, errors.New("missing collector")
+		}
+		if options == nil {
+			return nil, nil
+		}
+		fakeCreated = fakeEndpoint{u, match, *options}
+		return (&connections.ShadowConnection{Target: u.String(), Criteria: match}).Initialize(), nil
+	}, "region")
+}
+
+func TestRegisteredSchemeOptions(t *testing.T) {
+	app := &App{Config: Config{LazyEndpoints: true, TeeTo: []string{
+		"dl_type=0x888e;dscp=af41;region=eu-west;connect=eager;action=FAKE://collector/stream",
+	}}}
+	endpoints, err := app.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 || endpoints[0] == nil {
+		t.Fatalf("Expected an end point, got %v", endpoints)
+	}
+
+	created := fakeCreated
+	if created.u.Scheme != "fake" || created.u.Host != "collector" || created.u.Path != "/stream" {
+		t.Errorf("Expected fake://collector/stream, got %s", created.u)
+	}
+	if created.match.DlType != 0x888e {
+		t.Errorf("Expected criteria dl_type 0x888e, got %04x", created.match.DlType)
+	}
+	if created.options.Lazy {
+		t.Error("Expected the end point connected eagerly")
+	}
+
+	// The dscp term is only given to the schemes that register it
+	if len(created.options.Terms) != 1 || created.options.Terms.Get("region") != "eu-west" {
+		t.Errorf("Expected only the region term, got %v", created.options.Terms)
+	}
+}
+
+func TestRegisteredSchemeErrors(t *testing.T) {
+	for _, test := range []struct {
+		spec   string
+		err    string
+		offset int
+	}{
+		{"fake:///stream", "missing collector", 0},
+		{"region=eu-west;action=tcp://host:9000", "Unknown end point term 'region'", 0},
+		{"durable=true;action=fake://collector/stream", "a fake end point can't be durable", 0},
+		{"action=udp://host:9000", "expected one of 'fake', 'grpc', 'grpcs', 'http', 'https', 'kafka', 'pcap', 'tcp'", 0},
+	} {
+		app := &App{Config: Config{LazyEndpoints: true, TeeTo: []string{test.spec}}}
+		_, err := app.EstablishEndpointConnections()
+		specErr, ok := err.(*SpecError)
+		if !ok {
+			t.Errorf("Expected specification error for '%s', got %v", test.spec, err)
+			continue
+		}
+		if !strings.Contains(specErr.Err.Error(), test.err) || specErr.Offset != test.offset {
+			t.Errorf("Incorrect error for '%s', expected '%s' at %d, got '%v' at %d",
+				test.spec, test.err, test.offset, specErr.Err, specErr.Offset)
+		}
+	}
+}
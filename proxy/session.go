@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciena/oftee/api"
+	"github.com/ciena/oftee/datapath"
+	"github.com/ciena/oftee/injector"
+	of "github.com/netrack/openflow"
+	log "github.com/sirupsen/logrus"
+)
+
+// DisconnectTimeout maximum time to wait for the cleanup of a device
+// connection that is forcibly disconnected
+const DisconnectTimeout = 5 * time.Second
+
+// session tracks a single connection from a device, so that it can be
+// forcibly disconnected via the API, along with the handshake snooped from it
+type session struct {
+	api.HandshakeTracker
+
+	conn      net.Conn
+	connected time.Time
+	messages  uint64
+	packetIns uint64
+	bytes     uint64
+	sent      uint64
+	teed      uint64
+	outs      uint64
+	dpid      uint64
+	types     [of.TypeMeterMod + 1]uint64
+	done      context.Context
+	cancel    context.CancelFunc
+
+	lock       sync.Mutex
+	reason     string
+	ended      time.Time
+	entry      *log.Entry
+	controller controllerStats
+	draining   bool
+	idle       bool
+}
+
+func newSession(conn net.Conn) *session {
+	s := &session{
+		conn:      conn,
+		connected: time.Now(),
+		entry: log.WithFields(log.Fields{
+			"remote_addr": conn.RemoteAddr().String(),
+			"listener":    conn.LocalAddr().String(),
+		}),
+	}
+	s.done, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// Log returns the log entry for the connection, carrying the fields learned
+// about the device so far
+func (s *session) Log() *log.Entry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.entry
+}
+
+// learn adds fields learned about the device, i.e. its DPID, to the log entry
+// for the connection, so that every line logged after carries them
+func (s *session) learn(fields log.Fields) *log.Entry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entry = s.entry.WithFields(fields)
+	return s.entry
+}
+
+// message counts a message received from the device, by its type
+func (s *session) message(ofType of.Type, length uint16) {
+	atomic.AddUint64(&s.messages, 1)
+	atomic.AddUint64(&s.bytes, uint64(length))
+	if ofType == of.TypePacketIn {
+		atomic.AddUint64(&s.packetIns, 1)
+	}
+	if int(ofType) < len(s.types) {
+		atomic.AddUint64(&s.types[ofType], 1)
+	}
+}
+
+// tee counts a packet in from the device tee-ed to the end points
+func (s *session) tee() {
+	atomic.AddUint64(&s.teed, 1)
+}
+
+// packetOutCounter an injector that counts the packet outs injected to the
+// device of a session
+type packetOutCounter struct {
+	injector.Injector
+	sess *session
+}
+
+// Inject counts the message, if a packet out, and then injects it
+func (i packetOutCounter) Inject(ctx context.Context, message []byte) {
+	if len(message) > 1 && of.Type(message[1]) == of.TypePacketOut {
+		atomic.AddUint64(&i.sess.outs, 1)
+	}
+	i.Injector.Inject(ctx, message)
+}
+
+// counting returns the injector to the device, mapped to its DPID for the
+// API, that counts the packet outs injected
+func (s *session) counting(inject injector.Injector) injector.Injector {
+	return packetOutCounter{inject, s}
+}
+
+// identify sets the DPID of the device, once learned, by which its metrics
+// are labeled
+func (s *session) identify(dpid uint64) {
+	atomic.StoreUint64(&s.dpid, dpid)
+}
+
+// device returns the label of the device in its metrics, its DPID once
+// known, otherwise its remote address
+func (s *session) device() string {
+	if dpid := atomic.LoadUint64(&s.dpid); dpid != 0 {
+		return datapath.Format(dpid)
+	}
+	return s.conn.RemoteAddr().String()
+}
+
+// sentCounter counts the bytes written to a device
+type sentCounter struct {
+	io.Writer
+	sess *session
+}
+
+func (w sentCounter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	atomic.AddUint64(&w.sess.sent, uint64(n))
+	return n, err
+}
+
+// counted returns the writer to the device that counts the bytes written
+func (s *session) counted(w io.Writer) io.Writer {
+	return sentCounter{w, s}
+}
+
+// controllerStats the statistics of the link, or group of links, to the SDN
+// controller, the times its connection was re-established and the messages
+// from the device dropped
+type controllerStats interface {
+	Stats() (uint64, uint64)
+}
+
+// setController sets the link to the SDN controller, whose reconnects are
+// counted by the statistics of the session
+func (s *session) setController(link controllerStats) {
+	s.lock.Lock()
+	s.controller = link
+	s.lock.Unlock()
+}
+
+// activeLink a link to one of several SDN controllers, that reports that to
+// which the device is proxied
+type activeLink interface {
+	Active() string
+}
+
+// Controller returns the SDN controller to which the device is proxied, when
+// failing over between controllers, otherwise ""
+func (s *session) Controller() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if link, ok := s.controller.(activeLink); ok {
+		return link.Active()
+	}
+	return ""
+}
+
+// end marks the session as complete, once the connection has been cleaned up
+func (s *session) end() {
+	s.lock.Lock()
+	s.ended = time.Now()
+	s.lock.Unlock()
+	s.cancel()
+}
+
+// Stats returns the current statistics of the session
+func (s *session) Stats() api.SessionStats {
+	var version string
+	if v := s.Version(); v != 0 {
+		version = api.VersionName(v)
+	}
+	types := make(map[string]uint64)
+	for ofType := range s.types {
+		if count := atomic.LoadUint64(&s.types[ofType]); count > 0 {
+			types[messageTypeName(of.Type(ofType))] = count
+		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	end := s.ended
+	if end.IsZero() {
+		end = time.Now()
+	}
+	stats := api.SessionStats{
+		RemoteAddr:    s.conn.RemoteAddr().String(),
+		Version:       version,
+		Connected:     s.connected,
+		Duration:      end.Sub(s.connected).String(),
+		Messages:      atomic.LoadUint64(&s.messages),
+		PacketIns:     atomic.LoadUint64(&s.packetIns),
+		Bytes:         atomic.LoadUint64(&s.bytes),
+		Reason:        s.reason,
+		MessageTypes:  types,
+		TeedPacketIns: atomic.LoadUint64(&s.teed),
+		PacketOuts:    atomic.LoadUint64(&s.outs),
+		BytesSent:     atomic.LoadUint64(&s.sent),
+	}
+	if s.controller != nil {
+		stats.ControllerReconnects, stats.ControllerDropped = s.controller.Stats()
+	}
+	return stats
+}
+
+// Reason returns the reason given when the session was forcibly
+// disconnected, if it was
+func (s *session) Reason() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.reason
+}
+
+// drain stops the handling of the connection once the message being handled,
+// if any, has been handled. If the handler is waiting for the next message
+// the read is interrupted.
+func (s *session) drain() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.draining = true
+	if s.idle {
+		s.conn.SetReadDeadline(time.Unix(1, 0))
+	}
+}
+
+// between marks the handler as waiting for the next message, and returns
+// false if the connection is draining, so no further messages are handled
+func (s *session) between() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.idle = !s.draining
+	return !s.draining
+}
+
+// reading marks the handler as handling a message, once its header has been
+// read, and returns true if the connection is draining, in which case the
+// read may have been interrupted
+func (s *session) reading() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.idle = false
+	if s.draining {
+		s.conn.SetReadDeadline(time.Time{})
+	}
+	return s.draining
+}
+
+// Disconnect closes the device connection, which causes the connection to be
+// cleaned up as if the device disconnected, and returns the final statistics
+func (s *session) Disconnect(reason string) api.SessionStats {
+	s.lock.Lock()
+	s.reason = reason
+	s.lock.Unlock()
+
+	// The connection may already be closing, so errors are expected
+	s.conn.Close()
+	select {
+	case <-s.done.Done():
+	case <-time.After(DisconnectTimeout):
+	}
+	return s.Stats()
+}
+
+// sessionSet the sessions of the connected devices, whose counters are
+// exposed as metrics
+type sessionSet struct {
+	lock     sync.Mutex
+	sessions map[*session]struct{}
+}
+
+// add adds the session of a device that has connected
+func (set *sessionSet) add(s *session) {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	if set.sessions == nil {
+		set.sessions = make(map[*session]struct{})
+	}
+	set.sessions[s] = struct{}{}
+}
+
+// remove removes the session of a device that has disconnected
+func (set *sessionSet) remove(s *session) {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	delete(set.sessions, s)
+}
+
+// list returns the sessions of the connected devices, ordered by device
+func (set *sessionSet) list() []*session {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	list := make([]*session, 0, len(set.sessions))
+	for s := range set.sessions {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].device() < list[j].device()
+	})
+	return list
+}
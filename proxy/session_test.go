@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/ciena/oftee/api"
+	"github.com/ciena/oftee/datapath"
+	"github.com/ciena/oftee/internal/harness"
+	of "github.com/netrack/openflow"
+	"github.com/netrack/openflow/ofp"
+	log "github.com/sirupsen/logrus"
+)
+
+// logRecorder a logrus hook that records the lines logged, until stopped, as
+// a hook can't be removed
+type logRecorder struct {
+	lock    sync.Mutex
+	stopped bool
+	entries []log.Entry
+}
+
+func (r *logRecorder) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (r *logRecorder) Fire(entry *log.Entry) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.stopped {
+		data := make(log.Fields, len(entry.Data))
+		for k, v := range entry.Data {
+			data[k] = v
+		}
+		r.entries = append(r.entries, log.Entry{Message: entry.Message, Data: data})
+	}
+	return nil
+}
+
+// mark returns the number of lines recorded so far
+func (r *logRecorder) mark() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.entries)
+}
+
+// stop stops recording, returning the lines recorded
+func (r *logRecorder) stop() []log.Entry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.stopped = true
+	return r.entries
+}
+
+func TestSessionLogFields(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	defer log.SetOutput(log.StandardLogger().Out)
+	log.SetLevel(log.DebugLevel)
+	log.SetOutput(ioutil.Discard)
+	recorder := &logRecorder{}
+	log.AddHook(recorder)
+
+	consumer := harness.NewTCPEndpoint(t)
+	defer consumer.Stop()
+	r := newRig(t, consumer.Spec())
+	defer r.close()
+	device, controller, _ := r.connect(0x1, 0)
+	defer device.Close()
+	learned := recorder.mark()
+
+	// A packet in that is tee-ed, and a packet out injected via the API
+	packetIn := device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64))
+	controller.ExpectMessages(t, controller.Messages()[0], packetIn)
+	consumer.Frames.ExpectFrames(t, harness.FrameOf(0x1, 1, packetIn))
+	packetOut := harness.NewMessage(t, of.TypePacketOut, 0, &ofp.PacketOut{Buffer: ofp.NoBuffer})
+	var resp *httptest.ResponseRecorder
+	waitFor(t, "the device to be known by the API", func() bool {
+		req := httptest.NewRequest("POST", "/oftee/0x1", bytes.NewReader(packetOut.Raw))
+		req.Header.Add("Content-type", "application/octet-stream")
+		resp = httptest.NewRecorder()
+		r.app.api.ServeHTTP(resp, req)
+		return resp.Code == 200
+	})
+	device.Received.WaitMessages(t, 1)
+	entries := recorder.stop()
+
+	// Every line logged for the connection, once the features reply has
+	// been read, carries the DPID and the fields of the connection
+	seen := make(map[string]bool)
+	for _, entry := range entries[learned:] {
+		if _, ok := entry.Data["remote_addr"]; !ok {
+			continue
+		}
+		seen[entry.Message] = true
+		if entry.Data["dpid"] != datapath.Format(0x1) || entry.Data["of_version"] == nil || entry.Data["listener"] == nil {
+			t.Errorf("Expected '%s' logged with the fields of the device, got %v", entry.Message, entry.Data)
+		}
+	}
+	for _, message := range []string{"SENDING: all end-points", "match", "Writing packet outs to device"} {
+		if !seen[message] {
+			t.Errorf("Expected '%s' logged with the fields of the device, got %v", message, entries[learned:])
+		}
+	}
+}
+
+func TestDeviceSessionStats(t *testing.T) {
+	eapol := harness.NewTCPEndpoint(t)
+	defer eapol.Stop()
+	r := newRig(t, eapol.Spec("dl_type=0x888e"))
+	defer r.close()
+	device, controller, _ := r.connect(0x1, 0)
+	defer device.Close()
+	stats := func() api.SessionStats {
+		t.Helper()
+		var response api.DeviceResponse
+		if err := json.Unmarshal(httpGet(t, r.app.api, "/oftee/0x1").Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Sessions) != 1 {
+			t.Fatalf("Expected the statistics of a single connection, got %+v", response.Sessions)
+		}
+		return response.Sessions[0]
+	}
+
+	// Packet ins are counted as received and tee-ed, unless tee-ing is
+	// disabled for the device
+	features := controller.Messages()[0]
+	packetIn := device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64))
+	eapol.Frames.WaitFrames(t, 1)
+	r.app.api.SetTee(0x1, false, 0)
+	device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64))
+	controller.WaitMessages(t, 3)
+
+	// Packet outs injected via the API are counted, as are the bytes sent
+	packetOut := harness.NewMessage(t, of.TypePacketOut, 1, nil)
+	req := httptest.NewRequest("POST", "/oftee/0x1", bytes.NewReader(packetOut.Raw))
+	req.Header.Set("Content-type", "application/octet-stream")
+	resp := httptest.NewRecorder()
+	r.app.api.ServeHTTP(resp, req)
+	if resp.Code != 200 {
+		t.Fatalf("Expected packet out injected, got %d %s", resp.Code, resp.Body)
+	}
+	device.Received.WaitMessages(t, 1)
+	waitFor(t, "the packet out counted", func() bool {
+		return stats().BytesSent == uint64(len(packetOut.Raw))
+	})
+
+	got := stats()
+	if got.RemoteAddr != device.Conn.LocalAddr().String() || got.Connected.IsZero() || got.Duration == "" {
+		t.Errorf("Expected the connection described, got %+v", got)
+	}
+	if got.Version == "" {
+		t.Errorf("Expected the negotiated version, got %+v", got)
+	}
+	expected := map[string]uint64{"features_reply": 1, "packet_in": 2}
+	if !reflect.DeepEqual(got.MessageTypes, expected) || got.Messages != 3 {
+		t.Errorf("Expected messages %v, got %d %v", expected, got.Messages, got.MessageTypes)
+	}
+	if got.PacketIns != 2 || got.TeedPacketIns != 1 || got.PacketOuts != 1 {
+		t.Errorf("Expected 2 packet ins, 1 tee-ed, and 1 packet out, got %+v", got)
+	}
+	if got.Bytes != uint64(len(features.Raw)+2*len(packetIn.Raw)) {
+		t.Errorf("Expected the bytes received counted, got %d", got.Bytes)
+	}
+
+	// Unknown devices are not found
+	if resp := httpGet(t, r.app.api, "/oftee/0x2"); resp.Code != 404 {
+		t.Errorf("Expected unknown device not found, got %d", resp.Code)
+	}
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/ciena/oftee/connections"
+	log "github.com/sirupsen/logrus"
+)
+
+// DrainState the state of a proxy that stops accepting connections from
+// devices, returned by `POST /oftee/drain`
+type DrainState struct {
+	Draining    bool   `json:"draining"`
+	Connections int    `json:"connections"`
+	Rejected    uint64 `json:"rejected"`
+}
+
+// drain stops accepting connections from devices, while those connected are
+// left alive, i.e. so that devices reconnect to another instance as they are
+// disconnected during maintenance. Returns the drain state, with the number of
+// the device connections left alive.
+func (app *App) drain() interface{} {
+	if atomic.CompareAndSwapInt32(&app.draining, 0, 1) {
+		log.
+			WithFields(log.Fields{
+				"connections": len(app.sessions.list()),
+			}).
+			Info("Draining, no longer accepting connections from devices")
+	}
+	return DrainState{
+		Draining:    true,
+		Connections: len(app.sessions.list()),
+		Rejected:    atomic.LoadUint64(&app.drainRejected),
+	}
+}
+
+// isDraining returns true if the proxy no longer accepts connections from
+// devices, see `drain`
+func (app *App) isDraining() bool {
+	return atomic.LoadInt32(&app.draining) != 0
+}
+
+// rejectDraining closes a connection from a device accepted while draining,
+// returning true if it was closed
+func (app *App) rejectDraining(conn net.Conn) bool {
+	if !app.isDraining() {
+		return false
+	}
+	atomic.AddUint64(&app.drainRejected, 1)
+	log.
+		WithFields(log.Fields{
+			"remote-connection": conn.RemoteAddr().String(),
+		}).
+		Debug("Draining, rejected connection")
+	close(conn)
+	return true
+}
+
+// shutdown waits for the device connections to drain, each within the drain
+// timeout and the time taken to clean it up, and then for the shared end
+// points to deliver the messages queued to them within what remains of the
+// drain timeout
+func (app *App) shutdown() {
+	start := time.Now()
+	drained := make(chan struct{}, 1)
+	go func() {
+		app.handlers.Wait()
+		drained <- struct{}{}
+	}()
+	select {
+	case <-drained:
+	case <-time.After(app.DrainTimeout + DisconnectTimeout):
+		log.
+			WithFields(log.Fields{
+				"drain-timeout": app.DrainTimeout,
+			}).
+			Warn("Device connections not drained, exiting")
+	}
+	if app.ShareConnections {
+		app.flushUntil(app.sharedEndpoints(), start.Add(app.DrainTimeout))
+	}
+	log.Info("Drained, exiting")
+}
+
+// flush waits for the end points to deliver the messages queued to them
+// within the drain timeout
+func (app *App) flush(endpoints connections.Endpoints) {
+	app.flushUntil(endpoints, time.Now().Add(app.DrainTimeout))
+}
+
+// flushUntil waits for the end points to deliver the messages queued to
+// them until the deadline, logging those lost if they don't. As flushing
+// checks the end points twice, see `Endpoints.Flush`, they are always given
+// the time to do so.
+func (app *App) flushUntil(endpoints connections.Endpoints, deadline time.Time) {
+	if settle := time.Now().Add(2 * connections.FlushInterval); deadline.Before(settle) {
+		deadline = settle
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := endpoints.Flush(ctx); err != nil {
+		log.
+			WithFields(log.Fields{
+				"endpoints": len(endpoints),
+			}).
+			WithError(err).
+			Warn("End points not flushed, the messages queued to them are lost")
+	}
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/api"
+	"github.com/ciena/oftee/connections"
+	"github.com/ciena/oftee/internal/harness"
+	of "github.com/netrack/openflow"
+	"github.com/netrack/openflow/ofp"
+)
+
+func TestDrainIdleDevice(t *testing.T) {
+	r := newRig(t)
+	defer r.close()
+	r.app.DrainTimeout = harness.Timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	device, controller, done := r.connectContext(ctx, 0x1, 0)
+	defer device.Close()
+
+	// Waiting for the next message, the device is disconnected at once
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected the device drained, got %v", err)
+		}
+	case <-time.After(harness.Timeout / 2):
+		t.Fatal("Expected the device drained without waiting for the drain timeout")
+	}
+	waitFor(t, "the controller disconnected", func() bool { return controller.Err() != nil })
+}
+
+func TestDrainFinishesMessage(t *testing.T) {
+	wedged := &wedgedEndpoint{queue: make(chan []byte, 1)}
+	r := newRig(t)
+	defer r.close()
+	r.app.DrainTimeout = harness.Timeout
+	r.app.setEndpoints(connections.Endpoints{wedged})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	device, controller, done := r.connectContext(ctx, 0x1, 0)
+	defer device.Close()
+
+	// The tee of the second packet in is blocked by the full queue of the
+	// wedged end point when the device is drained
+	device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64))
+	device.SendPacketIn(2, harness.EthernetFrame(0x888e, 64))
+	controller.WaitMessages(t, 3)
+	waitFor(t, "the queue to fill", func() bool { return len(wedged.queue) == 1 })
+	cancel()
+	select {
+	case err := <-done:
+		t.Fatalf("Expected the message being handled to be finished, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Once the end point is delivered to the message is tee-ed, and then
+	// the device disconnected
+	<-wedged.queue
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected the device drained, got %v", err)
+		}
+	case <-time.After(harness.Timeout):
+		t.Fatal("Expected the device drained once its message was handled")
+	}
+	if len(wedged.queue) != 1 {
+		t.Error("Expected the message being handled tee-ed")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	wedged := &wedgedEndpoint{queue: make(chan []byte, 1)}
+	r := newRig(t)
+	defer r.close()
+	r.app.DrainTimeout = 50 * time.Millisecond
+	r.app.setEndpoints(connections.Endpoints{wedged})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	device, controller, done := r.connectContext(ctx, 0x1, 0)
+	defer device.Close()
+
+	// The write in flight is abandoned once the drain times out
+	device.SendPacketIn(1, harness.EthernetFrame(0x888e, 64))
+	device.SendPacketIn(2, harness.EthernetFrame(0x888e, 64))
+	controller.WaitMessages(t, 3)
+	waitFor(t, "the queue to fill", func() bool { return len(wedged.queue) == 1 })
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Expected the write abandoned, got %v", err)
+		}
+	case <-time.After(harness.Timeout):
+		t.Fatal("Expected the device disconnected once the drain timed out")
+	}
+}
+
+func TestDrainRejectsNewDevices(t *testing.T) {
+	controller := harness.NewController(t)
+	defer controller.Close()
+	app := &App{Config: Config{ListenOn: "127.0.0.1:0", ProxyTo: controller.Addr(), ShareConnections: true}}
+	app.api = api.NewAPI(":0", "", "")
+	app.api.Drain = app.drain
+	app.api.Auth = "secret"
+	app.api.Start()
+	ctx, cancel := context.WithCancel(context.Background())
+	listening := make(chan struct{}, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- app.serveDevices(ctx, func() { listening <- struct{}{} })
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	<-listening
+
+	device, err := net.Dial("tcp", app.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	device.Write(harness.NewMessage(t, of.TypeFeaturesReply, 1, &ofp.SwitchFeatures{DatapathID: 0x1}).Raw)
+	controller.Conn(0).WaitMessages(t, 1)
+	known := func() bool {
+		resp := httptest.NewRecorder()
+		app.api.ServeHTTP(resp, httptest.NewRequest("GET", "/oftee/0x1", nil))
+		return resp.Code == 200
+	}
+	waitFor(t, "the device known", known)
+
+	// Draining, repeatedly, leaves the connected device alive
+	serve := func(method, path string, v interface{}) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp := httptest.NewRecorder()
+		app.api.ServeHTTP(resp, req)
+		if err := json.Unmarshal(resp.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		return resp.Code
+	}
+	for i := 0; i < 2; i++ {
+		var state DrainState
+		if code := serve("POST", "/oftee/drain", &state); code != 200 || !state.Draining || state.Connections != 1 {
+			t.Errorf("Expected draining with 1 connection, got %d %+v", code, state)
+		}
+	}
+	if ready, state := app.readiness(); ready || !state.(Readiness).Draining {
+		t.Errorf("Expected not ready while draining, got %+v", state)
+	}
+
+	// A new device is rejected, the connected one still proxied
+	rejected, err := net.Dial("tcp", app.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	rejected.SetReadDeadline(time.Now().Add(harness.Timeout))
+	if _, err = ioutil.ReadAll(rejected); err != nil {
+		t.Errorf("Expected the new device disconnected, got %v", err)
+	}
+	if app.drain().(DrainState).Rejected != 1 {
+		t.Errorf("Expected 1 connection rejected, got %+v", app.drain())
+	}
+	device.Write(harness.PacketIn(t, 2, 1, harness.EthernetFrame(0x0800, 64)).Raw)
+	controller.Conn(0).WaitMessages(t, 2)
+
+	// Disconnecting the device closes its connection, and then none
+	var disconnected api.DisconnectResponse
+	if code := serve("DELETE", "/oftee/0x1?reason=maintenance", &disconnected); code != 200 || disconnected.Disconnected != 1 ||
+		disconnected.Sessions[0].Reason != "maintenance" {
+		t.Errorf("Expected the device disconnected, got %d %+v", code, disconnected)
+	}
+	device.SetReadDeadline(time.Now().Add(harness.Timeout))
+	if _, err = ioutil.ReadAll(device); err != nil {
+		t.Errorf("Expected the device connection closed, got %v", err)
+	}
+	waitFor(t, "the device forgotten", func() bool { return !known() })
+	if code := serve("DELETE", "/oftee/0x1", &disconnected); code != 200 || disconnected.Disconnected != 0 {
+		t.Errorf("Expected no connections disconnected, got %d %+v", code, disconnected)
+	}
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/ciena/oftee/config"
+	"github.com/ciena/oftee/connections"
+)
+
+// SpecError is an error in an end point specification. It identifies the
+// offending term by its offset within the specification, so that it can be
+// pointed out.
+type SpecError struct {
+	Spec   string
+	Offset int
+	Err    error
+}
+
+// Error returns the error followed by the specification with a caret under
+// the offending term
+func (e *SpecError) Error() string {
+	return fmt.Sprintf("end point '%s': %s\n    %s\n    %s^",
+		e.Spec, e.Err, e.Spec, strings.Repeat(" ", e.Offset))
+}
+
+// specTerm is a single `name=value` term of an end point specification and
+// its offset within the specification, and, for an end point of a structured
+// configuration file, the field from which it was read
+type specTerm struct {
+	name   string
+	value  string
+	offset int
+	field  string
+}
+
+// parsedSpec an end point specification and its terms
+type parsedSpec struct {
+	spec  string
+	terms []specTerm
+}
+
+// isTermName returns true if the given string can be the name of a term, as
+// opposed to being part of a URL, i.e. a query parameter
+func isTermName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitSpec splits an end point specification, a `;` separated list of
+// `name=value` terms, into its terms. The `action=` prefix of the action may
+// be omitted, so a term that is not of the form `name=value` but is an
+// address, i.e. `tcp://host:port` or `host:port`, is the action. Term names
+// are returned in lower case, those of negated terms, `name!=value`, ending
+// with `!`. A term that is repeated with a different value is an error,
+// unless it is a header or negated.
+func splitSpec(spec string) ([]specTerm, error) {
+	var terms []specTerm
+	seen := make(map[string]string)
+	offset := 0
+	for _, part := range strings.Split(spec, ";") {
+		term := specTerm{offset: offset}
+		offset += len(part) + 1
+
+		eq := strings.Index(part, "=")
+		switch {
+		case strings.TrimSpace(part) == "":
+			return nil, &SpecError{spec, term.offset, errors.New("empty term")}
+		case eq != -1 && isTermName(strings.TrimSuffix(part[:eq], "!")):
+			term.name = strings.ToLower(part[:eq])
+			term.value = part[eq+1:]
+			if term.value == "" {
+				return nil, &SpecError{spec, term.offset, fmt.Errorf("missing value for term '%s'", term.name)}
+			}
+		case strings.Contains(part, ":"):
+			term.name = TermAction
+			term.value = part
+		default:
+			return nil, &SpecError{spec, term.offset, fmt.Errorf("missing '=' in term '%s'", part)}
+		}
+
+		if previous, ok := seen[term.name]; ok && term.name != TermHeader && !strings.HasSuffix(term.name, "!") {
+			if previous != term.value {
+				return nil, &SpecError{spec, term.offset,
+					fmt.Errorf("conflicting values for term '%s', '%s' and '%s'", term.name, previous, term.value)}
+			}
+			continue
+		}
+		seen[term.name] = term.value
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+// parseConfigured returns the terms of an end point of a structured
+// configuration file, see `config.Endpoint`, and the specification they make
+// up, by which the end point is identified as those of `TEE_TO` are. Only the
+// header term may be repeated.
+func parseConfigured(path string, endpoint *config.Endpoint) (parsedSpec, error) {
+	var parsed parsedSpec
+	parts := []string{}
+	seen := make(map[string]bool)
+	offset := 0
+	for _, term := range endpoint.Terms() {
+		if seen[term.Name] && term.Name != TermHeader {
+			return parsed, &config.FieldError{Path: path, Field: term.Field, Err: fmt.Errorf("term '%s' can't be repeated", term.Name)}
+		}
+		seen[term.Name] = true
+		parsed.terms = append(parsed.terms, specTerm{name: term.Name, value: term.Value, offset: offset, field: term.Field})
+		parts = append(parts, term.Name+"="+term.Value)
+		offset += len(parts[len(parts)-1]) + 1
+	}
+	parsed.spec = strings.Join(parts, ";")
+	return parsed, nil
+}
+
+// configuredSpecs returns the specifications of the end points of a
+// structured configuration file
+func configuredSpecs(path string, endpoints []config.Endpoint) ([]string, error) {
+	specs := make([]string, len(endpoints))
+	for i := range endpoints {
+		parsed, err := parseConfigured(path, &endpoints[i])
+		if err != nil {
+			return nil, err
+		}
+		specs[i] = parsed.spec
+	}
+	return specs, nil
+}
+
+// fieldError returns an error in a term of the specification of an end point
+// of a structured configuration file as an error in the field from which the
+// term was read
+func fieldError(path string, endpoints []config.Endpoint, parsed []parsedSpec, err *SpecError) error {
+	for i := range parsed {
+		if parsed[i].spec != err.Spec {
+			continue
+		}
+		field := endpoints[i].Field
+		for _, term := range parsed[i].terms {
+			if term.offset == err.Offset {
+				field = term.field
+			}
+		}
+		if endpoints[i].Name != "" {
+			return &config.FieldError{Path: path, Field: field, Err: fmt.Errorf("end point '%s': %s", endpoints[i].Name, err.Err)}
+		}
+		return &config.FieldError{Path: path, Field: field, Err: err.Err}
+	}
+	return err
+}
+
+// actionOf returns the action of an end point specification, or the whole
+// specification if it has none
+func actionOf(spec string) string {
+	if terms, err := splitSpec(spec); err == nil {
+		for _, term := range terms {
+			if term.name == TermAction {
+				return term.value
+			}
+		}
+	}
+	return spec
+}
+
+// parseAction parses the action of an end point specification, the address
+// of the end point. An address without a scheme, `host:port`, is a TCP end
+// point, IPv6 literals must be enclosed in brackets, i.e. `[::1]:9000`. The
+// returned URL's scheme is in lower case and, for TCP end points, its host is
+// the `host:port` to which to connect. Otherwise the address is validated by
+// the registered scheme, see `connections.RegisterScheme`.
+func parseAction(action string) (*url.URL, error) {
+	if action == "" {
+		return nil, errors.New("missing action")
+	}
+	if !strings.Contains(action, "://") {
+		if _, _, err := net.SplitHostPort(action); err != nil {
+			return nil, fmt.Errorf("invalid address '%s', expected scheme://host:port or host:port, with IPv6 literals in brackets: %s", action, err)
+		}
+		return &url.URL{Scheme: SchemeTCP, Host: action}, nil
+	}
+
+	u, err := url.Parse(action)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL '%s': %s", action, err)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if err := connections.ValidateAddress(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// offsetOf returns the offset of the named term, or 0 if the specification
+// doesn't include it
+func offsetOf(terms []specTerm, name string) int {
+	for _, term := range terms {
+		if term.name == name {
+			return term.offset
+		}
+	}
+	return 0
+}
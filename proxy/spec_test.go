@@ -0,0 +1,359 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/connections"
+)
+
+func TestEndpointSpecs(t *testing.T) {
+	for _, spec := range []string{
+		"127.0.0.1:9000",
+		"[::1]:9000",
+		"tcp://[::1]:9000",
+		"TCP://127.0.0.1:9000",
+		"action=tcp://127.0.0.1:9000",
+		"dl_type=0x888e;action=tcp://127.0.0.1:9000",
+		"dl_type=0x888e;tcp://127.0.0.1:9000",
+		"dl_type=0x888e;dl_type=0x888e;action=tcp://127.0.0.1:9000",
+		"http://127.0.0.1:8080/tee?source=oftee",
+		"dl_type=0x888e;workers=2;action=https://collector.example.com/tee?a=b",
+		"proto=nd;action=tcp://127.0.0.1:9000",
+		"dl_type=pppoe_discovery;pppoe_code=padi;action=tcp://127.0.0.1:9000",
+		"dl_type=0x86dd;proto=ND;icmpv6_type=134;action=tcp://127.0.0.1:9000",
+		"dl_type=0x888e;ack=true;ack_window=64;action=tcp://127.0.0.1:9000",
+		"of_type=error;action=tcp://127.0.0.1:9000",
+		"of_type=packet_in|flow_removed|port_status;action=tcp://127.0.0.1:9000",
+		"txn_group=audit;action=tcp://127.0.0.1:9000",
+		"preamble=json;action=tcp://127.0.0.1:9000",
+		"queue=1024;action=http://127.0.0.1:8080/tee",
+		"encode=json;action=http://127.0.0.1:8080/tee",
+		"dl_type=eapol;encode=json;kafka_key=dpid;action=kafka://broker:9092/packet-in",
+		"dl_type=eapol;encode=proto;action=kafka://broker:9092/packet-in",
+		"encode=proto;action=http://127.0.0.1:8080/tee",
+		"of_type=packet_in;encode=proto;action=tcp://127.0.0.1:9000",
+		"sample=100;rate=0.5;action=http://127.0.0.1:8080/tee",
+		"in_port=32;action=tcp://127.0.0.1:9000",
+		"in_port=1-16;dl_type=eapol;action=tcp://127.0.0.1:9000",
+		"dpid=0x0000000000000001;dl_type=eapol;action=tcp://127.0.0.1:9000",
+		"dpid=0x1,0x2;of_type=error;action=tcp://127.0.0.1:9000",
+		"dpid=0x0000000100000000/0xffffffff00000000;action=tcp://127.0.0.1:9000",
+		"dl_type=eapol;queue=1024;action=grpc://127.0.0.1:9000",
+		"dl_dst=01:80:c2:00:00:00/ff:ff:ff:ff:ff:f0;action=tcp://127.0.0.1:9000",
+		"dl_src=00:11:22:33:44:55;dl_type=eapol;action=tcp://127.0.0.1:9000",
+		"action=grpcs://collector:9443",
+		"header=Authorization:Bearer%20abc;header=X-Source:oftee;action=https://collector/pkt",
+		"retries=5;backoff=200ms;action=http://127.0.0.1:8080/tee",
+		"of_type=flow_mod,group_mod;direction=controller;action=tcp://127.0.0.1:9000",
+		"of_type!=error;direction=device;action=tcp://127.0.0.1:9000",
+		"dl_type!=0x88cc;dl_type!=0x888e;action=tcp://127.0.0.1:9000",
+		"in_port!=1-8;of_type=packet_in;action=tcp://127.0.0.1:9000",
+		"dl_type=0x0806|dl_type=0x0800,nw_proto=17,tp_dst=67;action=tcp://127.0.0.1:9000",
+		"dpid=0x1;dl_type=arp|of_type=port_status;action=tcp://127.0.0.1:9000",
+	} {
+		app := &App{Config: Config{LazyEndpoints: true, TeeTo: []string{spec}}}
+		endpoints, err := app.EstablishEndpointConnections()
+		if err != nil {
+			t.Errorf("Unexpected error for end point '%s': %v", spec, err)
+			continue
+		}
+		if len(endpoints) != 1 || endpoints[0] == nil {
+			t.Errorf("Expected an end point for '%s', got %v", spec, endpoints)
+		}
+	}
+}
+
+func TestEndpointSpecDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	app := &App{Config: Config{LazyEndpoints: true, HTTPRetries: 2, HTTPRetryBackoff: time.Second, TeeTo: []string{
+		"retries=5;backoff=200ms;deadletter=" + filepath.Join(dir, "dlq") + ";action=http://127.0.0.1:8080/tee",
+		"action=http://127.0.0.1:8080/other",
+		"deadletter=" + filepath.Join(dir, "tcp") + ";action=tcp://127.0.0.1:9000",
+	}}}
+	endpoints, err := app.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The retries of the end point override the defaults, and the dead
+	// letter directory is created only for an HTTP end point
+	web, ok := endpoints[0].(*connections.HTTPConnection)
+	if !ok || web.Retries != 5 || web.Backoff != 200*time.Millisecond || web.DeadLetters == nil ||
+		web.DeadLetters.Dir != filepath.Join(dir, "dlq") {
+		t.Errorf("Expected the retries and dead letters of the end point, got %+v", endpoints[0])
+	}
+	if other := endpoints[1].(*connections.HTTPConnection); other.Retries != 2 || other.Backoff != time.Second || other.DeadLetters != nil {
+		t.Errorf("Expected the default retries and no dead letters, got %+v", other)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "dlq")); err != nil || !info.IsDir() {
+		t.Errorf("Expected the dead letter directory created, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tcp")); !os.IsNotExist(err) {
+		t.Errorf("Expected no dead letter directory for a TCP end point, got %v", err)
+	}
+}
+
+func TestEndpointSpecTxnGroup(t *testing.T) {
+	app := &App{Config: Config{LazyEndpoints: true, TeeTo: []string{
+		"txn_group=audit;action=tcp://127.0.0.1:9000",
+		"txn_group=audit;action=http://127.0.0.1:8080/tee",
+		"action=tcp://127.0.0.1:9001",
+	}}}
+	endpoints, err := app.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, ok := endpoints[0].(*connections.TxnMember)
+	second, _ := endpoints[1].(*connections.TxnMember)
+	if !ok || second == nil || first.Group != second.Group || first.Group.Name != "audit" {
+		t.Errorf("Expected end points to share transaction group 'audit', got %v", endpoints)
+	}
+	if _, ok = endpoints[2].(*connections.TxnMember); ok {
+		t.Errorf("Expected end point outside of any transaction group, got %v", endpoints[2])
+	}
+}
+
+func TestEndpointSpecThrottle(t *testing.T) {
+	app := &App{Config: Config{LazyEndpoints: true, TeeTo: []string{
+		"sample=10;rate=100;action=tcp://127.0.0.1:9000",
+		"sample=1;action=tcp://127.0.0.1:9001",
+	}}}
+	endpoints, err := app.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	throttled, ok := endpoints[0].(*connections.Throttled)
+	if !ok || throttled.Throttle.Sample != 10 || throttled.Throttle.Rate != 100 {
+		t.Errorf("Expected end point sampled 1 in 10 and limited to 100/s, got %v", endpoints[0])
+	}
+	if _, ok = endpoints[1].(*connections.Throttled); ok {
+		t.Errorf("Expected end point that samples every message unthrottled, got %v", endpoints[1])
+	}
+}
+
+func TestEndpointSpecQueue(t *testing.T) {
+	app := &App{Config: Config{LazyEndpoints: true, TeeTo: []string{
+		"queue=1024;action=tcp://127.0.0.1:9000",
+		"action=tcp://127.0.0.1:9001",
+	}}}
+	endpoints, err := app.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := cap(endpoints[0].GetQueue()); size != 1024 {
+		t.Errorf("Expected a queue of 1024 messages, got %d", size)
+	}
+	if size := cap(endpoints[1].GetQueue()); size != connections.DefaultQueueSize {
+		t.Errorf("Expected a queue of %d messages, got %d", connections.DefaultQueueSize, size)
+	}
+}
+
+func TestEndpointSpecIPv6(t *testing.T) {
+	app := &App{Config: Config{LazyEndpoints: true, TeeTo: []string{"[::1]:9000"}}}
+	endpoints, err := app.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := endpoints[0].String(); !strings.Contains(s, "[::1]:9000") {
+		t.Errorf("Expected IPv6 end point address to be kept intact, got %s", s)
+	}
+}
+
+func TestEndpointSpecErrors(t *testing.T) {
+	for _, test := range []struct {
+		spec   string
+		err    string
+		offset int
+	}{
+		{"", "empty term", 0},
+		{"dl_type=0x888e", "missing action", 0},
+		{"dl_type=0x888e;action=", "missing value for term 'action'", 15},
+		{"dl_type0x888e;action=tcp://host:9000", "missing '=' in term 'dl_type0x888e'", 0},
+		{"dl_type=0x888e;;action=tcp://host:9000", "empty term", 15},
+		{"dl_type=0x888e;dl_type=0x0806;action=tcp://host:9000", "conflicting values for term 'dl_type'", 15},
+		{"tcp://host:9000;action=tcp://other:9000", "conflicting values for term 'action'", 16},
+		{"kafka://broker:9092", "invalid topic ''", 0},
+		{"kafka://broker/packet-in", "invalid broker 'broker'", 0},
+		{"kafka_key=port;action=kafka://broker:9092/packet-in", "Unknown Kafka key", 0},
+		{"preamble=xml;action=tcp://host:9000", "Unknown preamble 'xml'", 0},
+		{"dl_type=eapol;encode=xml;action=http://host/tee", "Unknown encoding 'xml'", 14},
+		{"of_type=error;encode=proto;action=tcp://host:9000", "only packet ins can be encoded as protocol buffers", 0},
+		{"ack=true;encode=json;action=tcp://host:9000", "can't be acknowledged, or have a standby", 9},
+		{"ack=true;encode=proto;action=tcp://host:9000", "can't be acknowledged, or have a standby", 9},
+		{"dl_type=0x888e;action=udp://host:9000", "unsupported scheme 'udp'", 15},
+		{"::1:9000", "invalid address '::1:9000'", 0},
+		{"dl_type=0x888e;tcp://host", "invalid address 'tcp://host'", 15},
+		{"http:///tee", "missing host", 0},
+		{"colour=red;action=tcp://host:9000", "Unknown end point term 'colour'", 0},
+		{"workers!=2;action=tcp://host:9000", "term 'workers' can't be negated", 0},
+		{"dl_type=arp|nw_proto=tcp,nw_proto=udp;action=tcp://host:9000", "conflicting nw_proto 6 and 17", 0},
+		{"proto=nd;dl_type=arp|dl_type=ipv4;action=tcp://host:9000", "only one group of alternatives is supported", 9},
+		{"dl_type=ipv4;dl_type!=arp;action=tcp://host:9000", "dl_type can't be both matched and negated", 13},
+		{"dl_type=0xfffff;action=tcp://host:9000", "out of range", 0},
+		{"workers=2;ordered=true;action=http://host/tee", "ordered delivery", 10},
+		{"proto=arp;action=tcp://host:9000", "unknown protocol preset 'arp'", 0},
+		{"dl_type=0x0800;proto=nd;action=tcp://host:9000", "conflicting dl_type", 15},
+		{"icmpv6_type=256;action=tcp://host:9000", "out of range", 0},
+		{"dl_type=pppoe;action=tcp://host:9000", "unknown Ethernet type 'pppoe'", 0},
+		{"pppoe_code=padx;action=tcp://host:9000", "unknown PPPoE code 'padx'", 0},
+		{"durable=true;latency_budget=5ms;action=http://host/tee", "can't have a latency budget", 13},
+		{"durable=true;standby=other:9000;action=tcp://host:9000", "can't have a standby", 13},
+		{"durable=true;fsync=sometimes;action=http://host/tee", "invalid sync policy 'sometimes'", 13},
+		{"durable=maybe;action=http://host/tee", "invalid syntax", 0},
+		{"durable=true;ack=true;action=tcp://host:9000", "can't use acknowledgments", 13},
+		{"standby=other:9000;ack=true;action=tcp://host:9000", "can't have a standby", 19},
+		{"ack=true;ack_window=0;action=tcp://host:9000", "Invalid acknowledgment window '0'", 9},
+		{"queue=0;action=tcp://host:9000", "Invalid queue size '0'", 0},
+		{"header=Authorization;action=http://host/tee", "invalid header", 0},
+		{"header=Authorization:Bearer%zz;action=http://host/tee", "invalid value of header 'Authorization'", 0},
+		{"header=X-Evil:a%0d%0aHost:%20other;action=http://host/tee", "contains a line break", 0},
+		{"queue=many;action=http://host/tee", "Invalid queue size 'many'", 0},
+		{"retries=-1;action=http://host/tee", "Invalid number of retries '-1'", 0},
+		{"retries=5;backoff=0s;action=http://host/tee", "Invalid retry backoff '0s'", 10},
+		{"deadletter=/dev/null/dlq;action=http://host/tee", "not a directory", 0},
+		{"of_type=barrier_reply;action=tcp://host:9000", "unknown OpenFlow message type 'barrier_reply'", 0},
+		{"of_type=|;action=tcp://host:9000", "missing OpenFlow message type", 0},
+		{"direction=up;action=tcp://host:9000", "Unknown direction value 'up'", 0},
+		{"of_type=flow_mod;action=tcp://host:9000", "sent by the controller, direction=controller", 0},
+		{"dl_type=arp;direction=controller;action=tcp://host:9000", "only of_type flow_mod or group_mod", 12},
+		{"of_type=flow_mod|of_type=error;direction=controller;action=tcp://host:9000", "only of_type flow_mod or group_mod", 31},
+		{"of_type=error;of_type=packet_in;action=tcp://host:9000", "conflicting values for term 'of_type'", 14},
+		{"in_port=16-1;action=tcp://host:9000", "invalid port range '16-1'", 0},
+		{"dpid=0x1/0x0;action=tcp://host:9000", "invalid DPID mask '0x0'", 0},
+		{"dl_dst=01:80:c2:00:00;action=tcp://host:9000", "invalid Ethernet address '01:80:c2:00:00'", 0},
+		{"dl_src=00:11:22:33:44:55/ff:ff;action=tcp://host:9000", "invalid Ethernet address mask 'ff:ff'", 0},
+		{"action=grpc://host", "expected grpc://host:port", 0},
+		{"durable=true;action=grpc://host:9000", "a grpc end point can't be durable", 0},
+		{"sample=0;action=tcp://host:9000", "invalid sample '0'", 0},
+		{"rate=fast;action=tcp://host:9000", "invalid rate 'fast'", 0},
+		{"txn_group=audit;rate=100;action=tcp://host:9000", "can't be sampled or rate limited", 0},
+		{"txn_group=audit;latency_budget=5ms;action=tcp://host:9000", "can't have a latency budget", 0},
+	} {
+		app := &App{Config: Config{LazyEndpoints: true, TeeTo: []string{test.spec}}}
+		_, err := app.EstablishEndpointConnections()
+		specErr, ok := err.(*SpecError)
+		if !ok {
+			t.Errorf("Expected specification error for '%s', got %v", test.spec, err)
+			continue
+		}
+		if !strings.Contains(specErr.Err.Error(), test.err) || specErr.Offset != test.offset {
+			t.Errorf("Incorrect error for '%s', expected '%s' at %d, got '%v' at %d",
+				test.spec, test.err, test.offset, specErr.Err, specErr.Offset)
+		}
+	}
+}
+
+func TestSpecErrorCaret(t *testing.T) {
+	err := &SpecError{
+		Spec:   "dl_type=0x888e;colour=red;action=tcp://host:9000",
+		Offset: 15,
+		Err:    errors.New("Unknown end point term 'colour'"),
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines, got %q", lines)
+	}
+	if caret := strings.Index(lines[2], "^"); caret != strings.Index(lines[1], "colour") {
+		t.Errorf("Caret not under offending term:\n%s", err)
+	}
+}
+
+func TestDurableEndpointSpec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	app := &App{Config: Config{LazyEndpoints: true, SpoolDir: dir, TeeTo: []string{
+		"dl_type=0x0800;durable=true;fsync=1s;action=http://127.0.0.1:1/leases",
+		"durable=true;spool=leases;action=tcp://127.0.0.1:1",
+		"durable=true;kafka_key=dpid;action=kafka://127.0.0.1:1/leases",
+	}}}
+	first, err := app.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"http_127.0.0.1_1_leases", "leases", "kafka_127.0.0.1_1_leases"} {
+		if _, err = os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected spool directory '%s', got %v", name, err)
+		}
+	}
+
+	// Each spool is only opened once, so durable connections are shared
+	// when the end points are established per device connection
+	second, err := app.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first[0] != second[0] || first[1] != second[1] || first[2] != second[2] {
+		t.Error("Expected durable end points to be shared")
+	}
+}
+
+func TestOFTypeRawPackets(t *testing.T) {
+	// Only packet ins carry a packet to tee raw
+	app := &App{Config: Config{LazyEndpoints: true, TeeRawPackets: true, TeeTo: []string{"of_type=packet_in|port_status;action=tcp://127.0.0.1:9000"}}}
+	if _, err := app.EstablishEndpointConnections(); err == nil || !strings.Contains(err.Error(), "TEE_RAW") {
+		t.Errorf("Expected port status messages rejected with raw packets, got %v", err)
+	}
+	app = &App{Config: Config{LazyEndpoints: true, TeeRawPackets: true, TeeTo: []string{"of_type=packet_in;action=tcp://127.0.0.1:9000"}}}
+	if _, err := app.EstablishEndpointConnections(); err != nil {
+		t.Errorf("Unexpected error for packet ins with raw packets: %v", err)
+	}
+}
+
+func TestProtobufRawPackets(t *testing.T) {
+	// A raw packet has no context from which to encode the packet in
+	app := &App{Config: Config{LazyEndpoints: true, TeeRawPackets: true, TeeTo: []string{"encode=proto;action=http://127.0.0.1:8080/tee"}}}
+	if _, err := app.EstablishEndpointConnections(); err == nil || !strings.Contains(err.Error(), "TEE_RAW") {
+		t.Errorf("Expected protocol buffers rejected with raw packets, got %v", err)
+	}
+}
+
+func TestAckEndpointRawPackets(t *testing.T) {
+	// Without the OpenFlow header the consumer can't frame messages
+	app := &App{Config: Config{LazyEndpoints: true, TeeRawPackets: true, TeeTo: []string{"ack=true;action=tcp://127.0.0.1:9000"}}}
+	if _, err := app.EstablishEndpointConnections(); err == nil || !strings.Contains(err.Error(), "TEE_RAW") {
+		t.Errorf("Expected acknowledgments rejected with raw packets, got %v", err)
+	}
+}
+
+func TestEndpointsClosedOnError(t *testing.T) {
+	collector, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	// The end point established before the invalid one is closed, and
+	// with it its connection
+	app := &App{Config: Config{TeeTo: []string{
+		"action=tcp://" + collector.Addr().String(),
+		"workers=none;action=http://127.0.0.1:8080/tee",
+	}}}
+	if _, err = app.EstablishEndpointConnections(); err == nil || !strings.Contains(err.Error(), "Invalid number of workers 'none'") {
+		t.Fatalf("Expected the invalid number of workers rejected, got %v", err)
+	}
+	received, err := collector.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer received.Close()
+	received.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = received.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the established end point closed, got %v", err)
+	}
+}
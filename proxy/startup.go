@@ -0,0 +1,486 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ciena/oftee/connections"
+	log "github.com/sirupsen/logrus"
+)
+
+// Subsystems of the process, each is started, and restarted after a failure,
+// independently of the others
+const (
+	// SubsystemAPI the REST API server
+	SubsystemAPI = "api"
+
+	// SubsystemListener the listener for OpenFlow devices
+	SubsystemListener = "listener"
+
+	// SubsystemEndpoints the shared connections to the outbound end points
+	SubsystemEndpoints = "endpoints"
+
+	// SubsystemGRPC the gRPC API server
+	SubsystemGRPC = "grpc"
+
+	// SubsystemChain the listener for tee streams from chained instances
+	SubsystemChain = "chain"
+
+	// SubsystemController the connections to the SDN controller, only
+	// reported once a device has connected, it can't be required
+	SubsystemController = "controller"
+)
+
+// requirableSubsystems the subsystems that can be listed in
+// `SUBSYSTEM_REQUIRED`
+var requirableSubsystems = []string{
+	SubsystemAPI,
+	SubsystemListener,
+	SubsystemEndpoints,
+	SubsystemGRPC,
+	SubsystemChain,
+}
+
+// Bounds of the interval between attempts to start a subsystem, which is
+// doubled after each failure
+var (
+	subsystemRetryMin = time.Second
+	subsystemRetryMax = 30 * time.Second
+)
+
+// errSubsystemStopped returned for a subsystem that stopped without an error
+var errSubsystemStopped = errors.New("stopped unexpectedly")
+
+// SubsystemStatus the state of a subsystem. A subsystem is `Degraded` if it
+// started, but not as configured, i.e. end points that connect lazily
+// because they could not be connected at startup.
+type SubsystemStatus struct {
+	Ready    bool      `json:"ready"`
+	Required bool      `json:"required,omitempty"`
+	Degraded bool      `json:"degraded,omitempty"`
+	Failures uint64    `json:"failures"`
+	Since    time.Time `json:"since"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// States of the dependencies of the process, as reported by its readiness
+// and health
+const (
+	StateUp      = "up"
+	StateDown    = "down"
+	StateBound   = "bound"
+	StateUnbound = "unbound"
+)
+
+// Readiness the state of the process, it is ready when all of its subsystems
+// are ready. With `app.readiness` it also requires that the SDN controllers
+// are up, as last dialed or written to, whose states are given by address
+// when proxying to more than one, and that the shared end points are
+// connected, whose states are given by the action of each.
+type Readiness struct {
+	Ready       bool                       `json:"ready"`
+	Subsystems  map[string]SubsystemStatus `json:"subsystems"`
+	Controller  string                     `json:"controller,omitempty"`
+	Controllers map[string]string          `json:"controllers,omitempty"`
+	Endpoints   map[string]string          `json:"endpoints,omitempty"`
+	Draining    bool                       `json:"draining,omitempty"`
+}
+
+// Health the liveness of the process, it is alive once its listener for
+// devices is bound
+type Health struct {
+	Alive    bool   `json:"alive"`
+	Listener string `json:"listener"`
+}
+
+// subsystems tracks the state of the subsystems of the process
+type subsystems struct {
+	lock   sync.Mutex
+	status map[string]*SubsystemStatus
+}
+
+// update changes the state of the named subsystem, adding it if needed
+func (s *subsystems) update(name string, change func(*SubsystemStatus)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.status == nil {
+		s.status = make(map[string]*SubsystemStatus)
+	}
+	status, ok := s.status[name]
+	if !ok {
+		status = &SubsystemStatus{Since: time.Now()}
+		s.status[name] = status
+	}
+	change(status)
+}
+
+// register adds a subsystem that is starting
+func (s *subsystems) register(name string, required bool) {
+	s.update(name, func(status *SubsystemStatus) {
+		status.Required = required
+	})
+}
+
+// ready marks a subsystem as started, degraded by the given error if set
+func (s *subsystems) ready(name string, degraded error) {
+	s.update(name, func(status *SubsystemStatus) {
+		if !status.Ready {
+			status.Since = time.Now()
+		}
+		status.Ready = true
+		status.Degraded = degraded != nil
+		status.Error = ""
+		if degraded != nil {
+			status.Error = degraded.Error()
+		}
+	})
+}
+
+// failed marks a subsystem as failed with the given error
+func (s *subsystems) failed(name string, err error) {
+	s.update(name, func(status *SubsystemStatus) {
+		if status.Ready {
+			status.Since = time.Now()
+		}
+		status.Ready = false
+		status.Degraded = false
+		status.Failures++
+		status.Error = err.Error()
+	})
+}
+
+// Readiness returns whether all the subsystems are ready, and their states
+func (s *subsystems) Readiness() (bool, interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	readiness := Readiness{Ready: true, Subsystems: make(map[string]SubsystemStatus, len(s.status))}
+	for name, status := range s.status {
+		readiness.Subsystems[name] = *status
+		readiness.Ready = readiness.Ready && status.Ready
+	}
+	return readiness.Ready, readiness
+}
+
+// readiness returns whether the process is ready, and its state. Beyond its
+// subsystems the SDN controller must be up and, with shared connections, the
+// end points that keep a connection established must be connected, unless
+// they connect lazily, on demand. The controller is only reported once a
+// device has connected. A draining process is never ready, so that no new
+// devices are sent to it.
+func (app *App) readiness() (bool, interface{}) {
+	_, state := app.subsystems.Readiness()
+	readiness := state.(Readiness)
+	if status, ok := readiness.Subsystems[SubsystemController]; ok {
+		readiness.Controller = StateUp
+		if !status.Ready {
+			readiness.Controller = StateDown
+		}
+		if len(app.controllerTargets()) > 1 {
+			readiness.Controllers = app.controllers.states()
+		}
+	}
+	if app.ShareConnections {
+		readiness.Endpoints = app.endpointStates()
+		for _, state := range readiness.Endpoints {
+			if state != connections.StateConnected && !app.LazyEndpoints {
+				readiness.Ready = false
+			}
+		}
+	}
+	if app.isDraining() {
+		readiness.Ready = false
+		readiness.Draining = true
+	}
+	return readiness.Ready, readiness
+}
+
+// health returns whether the process is alive, once its listener for
+// devices is bound, and its state
+func (app *App) health() (bool, interface{}) {
+	_, state := app.subsystems.Readiness()
+	health := Health{Listener: StateUnbound}
+	if state.(Readiness).Subsystems[SubsystemListener].Ready {
+		health.Alive = true
+		health.Listener = StateBound
+	}
+	return health.Alive, health
+}
+
+// validateRequired checks that `SUBSYSTEM_REQUIRED` only lists subsystems
+// that can be required
+func (app *App) validateRequired() error {
+	for _, name := range app.RequiredSubsys {
+		known := false
+		for _, subsystem := range requirableSubsystems {
+			known = known || strings.ToLower(name) == subsystem
+		}
+		if !known {
+			sorted := append([]string(nil), requirableSubsystems...)
+			sort.Strings(sorted)
+			return fmt.Errorf("unknown subsystem '%s', expected one of %s", name, strings.Join(sorted, ", "))
+		}
+	}
+	return nil
+}
+
+// required returns true if the failure of the named subsystem terminates
+// the process
+func (app *App) required(name string) bool {
+	for _, required := range app.RequiredSubsys {
+		if strings.ToLower(required) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// supervise runs a subsystem, which calls ready once it is serving, and
+// restarts it each time it fails with an increasing delay. The failure of a
+// required subsystem stops the proxy, see `fail`. Once the context is done the
+// subsystem is no longer restarted, and supervise returns once it stops.
+func (app *App) supervise(ctx context.Context, name string, run func(ready func()) error) {
+	required := app.required(name)
+	app.subsystems.register(name, required)
+	delay := subsystemRetryMin
+	for {
+		err := run(func() {
+			delay = subsystemRetryMin
+			app.subsystems.ready(name, nil)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errSubsystemStopped
+		}
+		app.subsystems.failed(name, err)
+		if required {
+			log.
+				WithFields(log.Fields{
+					"subsystem": name,
+				}).
+				WithError(err).
+				Error("Required subsystem failed, terminating")
+			app.fail(fmt.Errorf("required subsystem %s failed: %s", name, err))
+			return
+		}
+		log.
+			WithFields(log.Fields{
+				"subsystem": name,
+				"retry-in":  delay,
+			}).
+			WithError(err).
+			Error("Subsystem failed, retrying")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > subsystemRetryMax {
+			delay = subsystemRetryMax
+		}
+	}
+}
+
+// fail records the failure of a required subsystem and stops the proxy,
+// whose run returns the first such failure, see `Run`
+func (app *App) fail(err error) {
+	app.failureLock.Lock()
+	if app.failure == nil {
+		app.failure = err
+	}
+	app.failureLock.Unlock()
+	if app.stop != nil {
+		app.stop()
+	}
+}
+
+// failed returns the failure of a required subsystem that stopped the proxy,
+// if any
+func (app *App) failed() error {
+	app.failureLock.Lock()
+	defer app.failureLock.Unlock()
+	return app.failure
+}
+
+// startEndpoints establishes the shared connections to the outbound end
+// points. If they can't be established, and they are not required, they are
+// established lazily instead, so that each connects when a message is first
+// delivered to it. A configuration error is always returned.
+func (app *App) startEndpoints() error {
+	required := app.required(SubsystemEndpoints)
+	app.subsystems.register(SubsystemEndpoints, required)
+	endpoints, err := app.EstablishEndpointConnections()
+	if err == nil {
+		app.setEndpoints(endpoints)
+		app.subsystems.ready(SubsystemEndpoints, nil)
+		return nil
+	}
+	app.subsystems.failed(SubsystemEndpoints, err)
+	if required {
+		return fmt.Errorf("unable to establish connections to outbound end points: %s", err)
+	}
+	log.
+		WithError(err).
+		Warn("Unable to establish connections to outbound end points, connecting lazily")
+	app.forceLazy = true
+	endpoints, lazyErr := app.EstablishEndpointConnections()
+	app.forceLazy = false
+	if lazyErr != nil {
+		return fmt.Errorf("unable to configure outbound end points: %s", lazyErr)
+	}
+	app.setEndpoints(endpoints)
+	app.subsystems.ready(SubsystemEndpoints, err)
+	return nil
+}
+
+// setEndpoints replaces the shared end points, assigning them IDs
+func (app *App) setEndpoints(endpoints connections.Endpoints) {
+	app.endpointsLock.Lock()
+	app.endpoints = endpoints
+	app.endpointIDs = app.newEndpointIDs(len(endpoints))
+	app.endpointsLock.Unlock()
+}
+
+// listenOn listens for connections on the given address, either `host:port`
+// or the path of a unix domain socket, `unix:///path/to/socket`. A socket
+// left behind by an instance that didn't shut down cleanly, on which nothing
+// is listening, is removed first. The socket is removed once the listener is
+// closed.
+func listenOn(address string) (net.Listener, error) {
+	if !strings.HasPrefix(strings.ToLower(address), SchemeUnix+"://") {
+		return net.Listen("tcp", address)
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host != "" || u.Path == "" {
+		return nil, fmt.Errorf("invalid address '%s', expected unix:///path/to/socket", address)
+	}
+	if info, err := os.Lstat(u.Path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", u.Path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen unix %s: address already in use", u.Path)
+		}
+		if err = os.Remove(u.Path); err != nil {
+			return nil, err
+		}
+		log.
+			WithFields(log.Fields{
+				"path": u.Path,
+			}).
+			Warn("Removed stale unix domain socket")
+	}
+	return net.Listen("unix", u.Path)
+}
+
+// serveAPI serves REST API requests, until the context is done
+func (app *App) serveAPI(ctx context.Context, ready func()) error {
+	listener, err := net.Listen("tcp", app.APIOn)
+	if err != nil {
+		return err
+	}
+	go closeWhenDone(ctx, listener)
+	ready()
+	return app.api.Serve(listener)
+}
+
+// serveGRPC serves gRPC API requests, until the context is done
+func (app *App) serveGRPC(ctx context.Context, ready func()) error {
+	listener, err := net.Listen("tcp", app.GRPCListenOn)
+	if err != nil {
+		return err
+	}
+	go closeWhenDone(ctx, listener)
+	ready()
+	return app.api.GRPCServe(listener)
+}
+
+// closeWhenDone closes a listener once the context is done, so that the
+// subsystem serving it returns
+func closeWhenDone(ctx context.Context, listener net.Listener) {
+	<-ctx.Done()
+	listener.Close()
+}
+
+// serveChain accepts tee streams from chained instances, until the context is
+// done
+func (app *App) serveChain(ctx context.Context, ready func()) error {
+	switch app.chainEncode() {
+	case EncodeRaw, EncodeJSON, EncodeProto:
+	default:
+		return fmt.Errorf("Unknown chain encoding '%s'", app.ChainEncode)
+	}
+	listener, err := net.Listen("tcp", app.ChainListenOn)
+	if err != nil {
+		return err
+	}
+	log.
+		WithFields(log.Fields{
+			"chain-listen-on": app.ChainListenOn,
+		}).
+		Info("Listening for tee streams from chained instances")
+	ready()
+	return app.chainServe(ctx, listener)
+}
+
+// controllerStates tracks whether each SDN controller is up, from the
+// outcome of the last attempt to connect, or write, to it
+type controllerStates struct {
+	lock sync.Mutex
+	down map[string]bool
+}
+
+// set records whether an SDN controller is up, returning true if all of
+// those recorded are, or if any is given `any`
+func (c *controllerStates) set(target string, up, any bool) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.down == nil {
+		c.down = make(map[string]bool)
+	}
+	c.down[target] = !up
+	for _, down := range c.down {
+		if down != any {
+			return any
+		}
+	}
+	return !any
+}
+
+// states returns the state of each SDN controller recorded, up or down
+func (c *controllerStates) states() map[string]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	states := make(map[string]string, len(c.down))
+	for target, down := range c.down {
+		states[target] = StateUp
+		if down {
+			states[target] = StateDown
+		}
+	}
+	return states
+}
+
+// controllerDialed records the outcome of an attempt to connect to an SDN
+// controller, or the failure of a write to it. The controller subsystem is
+// only ready while all the controllers are up, so that one down is reported
+// even as the others are written to, or in failover mode while any is.
+func (app *App) controllerDialed(target string, err error) {
+	if !app.controllers.set(target, err == nil, app.ProxyMode == ProxyModeFailover) {
+		if err != nil {
+			app.subsystems.failed(SubsystemController, err)
+		}
+		return
+	}
+	app.subsystems.ready(SubsystemController, nil)
+}
@@ -0,0 +1,475 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/api"
+	"github.com/ciena/oftee/criteria"
+	"github.com/ciena/oftee/internal/harness"
+)
+
+// fastRetries shortens the interval between attempts to start a subsystem,
+// returning a function that restores it
+func fastRetries() func() {
+	min, max := subsystemRetryMin, subsystemRetryMax
+	subsystemRetryMin, subsystemRetryMax = 10*time.Millisecond, 50*time.Millisecond
+	return func() {
+		subsystemRetryMin, subsystemRetryMax = min, max
+	}
+}
+
+// busyAddress returns an address on which something is already listening
+func busyAddress(t *testing.T) (string, net.Listener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener.Addr().String(), listener
+}
+
+// subsystemStatus returns the state of the named subsystem
+func subsystemStatus(app *App, name string) SubsystemStatus {
+	_, state := app.subsystems.Readiness()
+	return state.(Readiness).Subsystems[name]
+}
+
+// httpGet serves a GET request of the given path by the API
+func httpGet(t *testing.T, a *api.API, path string) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	a.ServeHTTP(resp, httptest.NewRequest("GET", path, nil))
+	return resp
+}
+
+// waitFor waits for the condition to hold
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAPIStartsOncePortFree(t *testing.T) {
+	defer fastRetries()()
+	address, busy := busyAddress(t)
+	app := &App{Config: Config{APIOn: address}}
+	app.api = api.NewAPI(address, "", "")
+	app.api.Readiness = app.subsystems.Readiness
+	go app.supervise(context.Background(), SubsystemAPI, func(ready func()) error {
+		return app.serveAPI(context.Background(), ready)
+	})
+
+	waitFor(t, "the API to fail to start", func() bool {
+		return subsystemStatus(app, SubsystemAPI).Failures >= 2
+	})
+	if ready, _ := app.subsystems.Readiness(); ready {
+		t.Error("Expected process not ready while the API port is in use")
+	}
+
+	// Once the port is free the API starts and reports itself ready
+	busy.Close()
+	waitFor(t, "the API to start", func() bool {
+		return subsystemStatus(app, SubsystemAPI).Ready
+	})
+	resp, err := http.Get("http://" + address + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var readiness Readiness
+	if err = json.NewDecoder(resp.Body).Decode(&readiness); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !readiness.Ready || readiness.Subsystems[SubsystemAPI].Failures < 2 {
+		t.Errorf("Expected process ready, got %d %+v", resp.StatusCode, readiness)
+	}
+}
+
+func TestListenerStartsOncePortFree(t *testing.T) {
+	defer fastRetries()()
+	address, busy := busyAddress(t)
+	app := &App{Config: Config{ListenOn: address, ShareConnections: true}}
+	app.api = api.NewAPI(":0", "", "")
+	app.api.Readiness = app.subsystems.Readiness
+	go app.supervise(context.Background(), SubsystemListener, func(ready func()) error {
+		return app.serveDevices(context.Background(), ready)
+	})
+
+	waitFor(t, "the listener to fail to start", func() bool {
+		return subsystemStatus(app, SubsystemListener).Failures >= 1
+	})
+	status := subsystemStatus(app, SubsystemListener)
+	if status.Ready || !strings.Contains(status.Error, "address already in use") {
+		t.Errorf("Expected listener to report the port in use, got %+v", status)
+	}
+	resp := httpGet(t, app.api, "/readyz")
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected process not ready, got %d", resp.Code)
+	}
+
+	busy.Close()
+	waitFor(t, "the listener to start", func() bool {
+		return subsystemStatus(app, SubsystemListener).Ready
+	})
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Expected listener to accept device connections, got %v", err)
+	}
+	conn.Close()
+	if resp = httpGet(t, app.api, "/readyz"); resp.Code != http.StatusOK {
+		t.Errorf("Expected process ready, got %d", resp.Code)
+	}
+}
+
+func TestListenerStopsWhenCancelled(t *testing.T) {
+	app := &App{Config: Config{ListenOn: "127.0.0.1:0", ShareConnections: true}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- app.serveDevices(ctx, cancel)
+	}()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Expected the listener stopped by the context, got %v", err)
+		}
+	case <-time.After(harness.Timeout):
+		t.Fatal("Expected the listener to stop once cancelled")
+	}
+}
+
+func TestEndpointsConnectLazilyWhenDown(t *testing.T) {
+	address, busy := busyAddress(t)
+	busy.Close()
+	app := &App{Config: Config{TeeTo: []string{"action=tcp://" + address}}}
+	app.startEndpoints()
+
+	status := subsystemStatus(app, SubsystemEndpoints)
+	if !status.Ready || !status.Degraded || status.Failures != 1 || status.Error == "" {
+		t.Errorf("Expected end points established lazily, got %+v", status)
+	}
+	if app.forceLazy {
+		t.Error("Expected lazy connections to only be forced at startup")
+	}
+
+	// Once the end point is listening the next message is delivered
+	consumer, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	app.sharedEndpoints().ConditionalWrite(context.Background(), []byte("message\n"), criteria.Criteria{})
+	consumer.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := consumer.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "message\n" {
+		t.Errorf("Expected message delivered once the end point is listening, got '%s', %v", line, err)
+	}
+}
+
+func TestEndpointsInvalidSpecRejectedLazily(t *testing.T) {
+	// A configuration error is returned whether or not the end points are
+	// established lazily, so it still terminates the process
+	app := &App{Config: Config{TeeTo: []string{"shadow=maybe;action=tcp://127.0.0.1:9000"}}, forceLazy: true}
+	if _, err := app.EstablishEndpointConnections(); err == nil {
+		t.Error("Expected invalid specification to be rejected")
+	}
+}
+
+func TestControllerReadiness(t *testing.T) {
+	address, busy := busyAddress(t)
+	busy.Close()
+	app := &App{Config: Config{ProxyTo: address}}
+	if _, err := app.dialController(address); err == nil {
+		t.Fatal("Expected SDN controller connection to fail")
+	}
+	if ready, _ := app.subsystems.Readiness(); ready {
+		t.Error("Expected process not ready while the SDN controller is down")
+	}
+
+	controller, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer controller.Close()
+	proxy, err := app.dialController(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Connection.Close()
+	if ready, _ := app.subsystems.Readiness(); !ready {
+		t.Errorf("Expected process ready once the SDN controller is up, got %+v", subsystemStatus(app, SubsystemController))
+	}
+}
+
+func TestReadinessOfDependencies(t *testing.T) {
+	endpoint, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer endpoint.Close()
+	address, busy := busyAddress(t)
+	busy.Close()
+	connected, down := "tcp://"+endpoint.Addr().String(), "tcp://"+address
+	app := &App{Config: Config{TeeTo: []string{connected}, ShareConnections: true}}
+	app.api = api.NewAPI(":0", "", "")
+	app.api.Readiness = app.readiness
+	endpoints, err := app.EstablishEndpointConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer endpoints.Close()
+	app.setEndpoints(endpoints)
+	if resp := httpGet(t, app.api, "/readyz"); resp.Code != http.StatusOK {
+		t.Errorf("Expected process ready, got %d %s", resp.Code, resp.Body)
+	}
+
+	// The SDN controller is down until it is next dialed, or written to,
+	// successfully
+	app.controllerDialed(app.ProxyTo, errors.New("connection refused"))
+	resp := httpGet(t, app.api, "/readyz")
+	var readiness Readiness
+	if err = json.NewDecoder(resp.Body).Decode(&readiness); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != http.StatusServiceUnavailable || readiness.Controller != StateDown || readiness.Endpoints[connected] != "connected" {
+		t.Errorf("Expected process not ready while the SDN controller is down, got %d %+v", resp.Code, readiness)
+	}
+	app.controllerDialed(app.ProxyTo, nil)
+
+	// An end point that isn't connected makes the process not ready,
+	// unless it connects on demand
+	app.TeeTo, app.LazyEndpoints = []string{connected, down}, true
+	if endpoints, err = app.EstablishEndpointConnections(); err != nil {
+		t.Fatal(err)
+	}
+	defer endpoints.Close()
+	app.setEndpoints(endpoints)
+	if resp = httpGet(t, app.api, "/readyz"); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), `"`+down+`":"connecting"`) {
+		t.Errorf("Expected process ready with end points connecting on demand, got %d %s", resp.Code, resp.Body)
+	}
+	app.LazyEndpoints = false
+	if resp = httpGet(t, app.api, "/readyz"); resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected process not ready while end points are connecting, got %d %s", resp.Code, resp.Body)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	app := &App{}
+	app.api = api.NewAPI(":0", "", "")
+	app.api.Health = app.health
+	app.subsystems.register(SubsystemListener, false)
+	if resp := httpGet(t, app.api, "/healthz"); resp.Code != http.StatusServiceUnavailable || !strings.Contains(resp.Body.String(), StateUnbound) {
+		t.Errorf("Expected process not alive until the listener is bound, got %d %s", resp.Code, resp.Body)
+	}
+
+	// The SDN controller being down doesn't affect health
+	app.subsystems.ready(SubsystemListener, nil)
+	app.controllerDialed(app.ProxyTo, errors.New("connection refused"))
+	if resp := httpGet(t, app.api, "/healthz"); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), StateBound) {
+		t.Errorf("Expected process alive once the listener is bound, got %d %s", resp.Code, resp.Body)
+	}
+}
+
+func TestUnixSockets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oftee-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A socket left behind, on which nothing is listening, is replaced
+	path := filepath.Join(dir, "of.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	app := &App{Config: Config{ListenOn: "unix://" + path, ProxyTo: "unix://" + filepath.Join(dir, "controller.sock"), ShareConnections: true}}
+	app.api = api.NewAPI(":0", "", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	listening := make(chan struct{}, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- app.serveDevices(ctx, func() { listening <- struct{}{} })
+	}()
+	select {
+	case <-listening:
+	case err = <-done:
+		t.Fatalf("Expected the listener to replace the stale socket, got %v", err)
+	}
+	if _, err = listenOn(app.ListenOn); err == nil || !strings.Contains(err.Error(), "address already in use") {
+		t.Errorf("Expected a socket in use not replaced, got %v", err)
+	}
+
+	// Devices connect via the socket, and are proxied to the SDN
+	// controller via its socket
+	controller, err := net.Listen("unix", filepath.Join(dir, "controller.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer controller.Close()
+	device, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Expected listener to accept device connections, got %v", err)
+	}
+	defer device.Close()
+	accepted, err := controller.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+
+	// The socket is removed once the listener is closed
+	cancel()
+	<-done
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket removed on shutdown, got %v", err)
+	}
+}
+
+func TestValidateRequired(t *testing.T) {
+	app := &App{Config: Config{RequiredSubsys: []string{"API", "endpoints"}}}
+	if err := app.validateRequired(); err != nil || !app.required(SubsystemAPI) || app.required(SubsystemListener) {
+		t.Errorf("Expected api and endpoints required, got %v", err)
+	}
+	app.RequiredSubsys = []string{"controller"}
+	if err := app.validateRequired(); err == nil || !strings.Contains(err.Error(), "unknown subsystem 'controller'") {
+		t.Errorf("Expected controller not to be requirable, got %v", err)
+	}
+}
+
+func TestSuperviseStopsWhenCancelled(t *testing.T) {
+	defer fastRetries()()
+	var app App
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	runs := 0
+	go func() {
+		app.supervise(ctx, SubsystemChain, func(ready func()) error {
+			if runs++; runs == 2 {
+				cancel()
+			}
+			return errors.New("failed")
+		})
+		stopped <- struct{}{}
+	}()
+
+	// Restarted until cancelled, and then no more
+	select {
+	case <-stopped:
+	case <-time.After(harness.Timeout):
+		t.Fatal("Expected supervision to stop once cancelled")
+	}
+	if runs != 2 {
+		t.Errorf("Expected the subsystem run twice, got %d", runs)
+	}
+}
+
+// runConfig returns the configuration of a proxy, that completes the
+// handshake with devices itself, listening on ephemeral ports
+func runConfig() Config {
+	config := DefaultConfig()
+	config.ListenOn = "127.0.0.1:0"
+	config.APIOn = "127.0.0.1:0"
+	config.ProxyDisabled = true
+	config.DrainTimeout = 100 * time.Millisecond
+	return config
+}
+
+func TestDefaultConfig(t *testing.T) {
+	config := DefaultConfig()
+	if config.ListenOn != ":8000" || config.ProxyMode != ProxyModeAll || !config.ShareConnections ||
+		config.DrainTimeout != 10*time.Second || config.SpoolMaxSize != 1<<30 || config.ProxyDisabled {
+		t.Errorf("Incorrect defaults, got %+v", config)
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	for setting, set := range map[string]func(*Config){
+		"CONTROLLER_DSCP":    func(c *Config) { c.ControllerDSCP = "loud" },
+		"PROXY_MODE":         func(c *Config) { c.ProxyMode = "some" },
+		"SUBSYSTEM_REQUIRED": func(c *Config) { c.RequiredSubsys = []string{"controller"} },
+		"MESSAGE_API_TYPES":  func(c *Config) { c.MessageAPITypes = []string{"hello"} },
+		"INJECT_XID_RANGE":   func(c *Config) { c.InjectXIDRange = 1 },
+		"INJECT_XID_BASE":    func(c *Config) { c.InjectXIDBase = 0xffffff00 },
+	} {
+		config := runConfig()
+		set(&config)
+		if _, err := New(config); err == nil {
+			t.Errorf("Expected invalid %s rejected", setting)
+		}
+	}
+}
+
+func TestRunUntilDone(t *testing.T) {
+	app, err := New(runConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- app.Run(ctx)
+	}()
+	waitFor(t, "the proxy to serve devices", func() bool {
+		return subsystemStatus(app, SubsystemListener).Ready
+	})
+
+	// Drained, and no error returned, once told to stop
+	cancel()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("Expected no error once done, got %v", err)
+		}
+	case <-time.After(harness.Timeout):
+		t.Fatal("Expected the proxy to stop once done")
+	}
+}
+
+func TestRunRequiredSubsystemFails(t *testing.T) {
+	address, busy := busyAddress(t)
+	defer busy.Close()
+	config := runConfig()
+	config.APIOn = address
+	config.RequiredSubsys = []string{SubsystemAPI}
+	app, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The failure of the API stops the proxy, rather than the process
+	done := make(chan error, 1)
+	go func() {
+		done <- app.Run(context.Background())
+	}()
+	select {
+	case err = <-done:
+		if err == nil || !strings.Contains(err.Error(), "required subsystem api failed") {
+			t.Errorf("Expected the failure of the API returned, got %v", err)
+		}
+	case <-time.After(harness.Timeout):
+		t.Fatal("Expected the proxy to stop once a required subsystem failed")
+	}
+}
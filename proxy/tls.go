@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// readCertPool reads the PEM encoded CA certificates of a file
+func readCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no CA certificates in '%s'", path)
+	}
+	return pool, nil
+}
+
+// loadTLSConfig returns a TLS configuration with the certificate, and its
+// key, of the given files, if either is set, and the CAs of the given file,
+// nil if it isn't set
+func loadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, *x509.CertPool, error) {
+	config := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile == "" {
+		return config, nil, nil
+	}
+	pool, err := readCertPool(caFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, pool, nil
+}
+
+// endpointTLSConfig returns the TLS configuration of HTTPS end points, the
+// trusted CAs and the client certificate, or nil if neither is configured
+func (app *App) endpointTLSConfig() (*tls.Config, error) {
+	if app.HTTPCAFile == "" && app.HTTPCertFile == "" && app.HTTPKeyFile == "" {
+		return nil, nil
+	}
+	config, pool, err := loadTLSConfig(app.HTTPCAFile, app.HTTPCertFile, app.HTTPKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = pool
+	return config, nil
+}
+
+// listenerTLSConfig returns the TLS configuration of the device listener, the
+// server certificate and the CAs by which the client certificates of devices
+// are verified, or nil if devices don't connect over TLS. Devices that
+// present no certificate are only rejected if `ListenClientAuth` is set.
+func (app *App) listenerTLSConfig() (*tls.Config, error) {
+	if app.ListenCert == "" && app.ListenKey == "" {
+		if app.ListenCA != "" || app.ListenClientAuth {
+			return nil, errors.New("verifying the certificates of devices requires a server certificate, LISTEN_CERT_FILE and LISTEN_KEY_FILE")
+		}
+		return nil, nil
+	}
+	if app.ListenClientAuth && app.ListenCA == "" {
+		return nil, errors.New("requiring the certificates of devices requires the CAs by which they are verified, LISTEN_CA_FILE")
+	}
+	config, pool, err := loadTLSConfig(app.ListenCA, app.ListenCert, app.ListenKey)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = pool
+	switch {
+	case app.ListenClientAuth:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case pool != nil:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// controllerTLSConfig returns the TLS configuration of the connections to the
+// SDN controller, at the given host, the trusted CAs, the system's if not
+// set, and the client certificate, if set
+func (app *App) controllerTLSConfig(host string) (*tls.Config, error) {
+	config, pool, err := loadTLSConfig(app.ControllerCA, app.ControllerCert, app.ControllerKey)
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = pool
+	config.ServerName = host
+	return config, nil
+}
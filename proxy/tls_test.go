@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/api"
+	of "github.com/netrack/openflow"
+)
+
+func TestListenerTLSConfig(t *testing.T) {
+	for _, app := range []*App{
+		{ListenCA: "ca.crt"},
+		{ListenClientAuth: true},
+		{ListenCert: "server.crt", ListenKey: "server.key", ListenClientAuth: true},
+	} {
+		if _, err := app.listenerTLSConfig(); err == nil {
+			t.Errorf("Expected TLS configuration %+v rejected", app)
+		}
+	}
+	if config, err := (&App{}).listenerTLSConfig(); config != nil || err != nil {
+		t.Errorf("Expected no TLS without a server certificate, got %v, %v", config, err)
+	}
+}
+
+func TestDeviceAndControllerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oftee-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = generateCertificates([]string{"127.0.0.1"}, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	file := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	roots, err := readCertPool(file("ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := tls.LoadX509KeyPair(file("controller-client.crt"), file("controller-client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := tls.LoadX509KeyPair(file("server.crt"), file("server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The SDN controller only accepts oftee's client certificate
+	controller, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer controller.Close()
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := controller.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			accepted <- conn
+		}
+	}()
+
+	app := &App{Config: Config{
+		ListenOn:         "127.0.0.1:0",
+		ProxyTo:          "tls://" + controller.Addr().String(),
+		ShareConnections: true,
+		ListenCert:       file("server.crt"),
+		ListenKey:        file("server.key"),
+		ListenCA:         file("ca.crt"),
+		ListenClientAuth: true,
+		ControllerCA:     file("ca.crt"),
+		ControllerCert:   file("controller-client.crt"),
+		ControllerKey:    file("controller-client.key"),
+	}}
+	app.api = api.NewAPI(":0", "", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listening := make(chan struct{}, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- app.serveDevices(ctx, func() { listening <- struct{}{} })
+	}()
+	select {
+	case <-listening:
+	case err = <-done:
+		t.Fatalf("Expected the TLS listener to start, got %v", err)
+	}
+	address := app.listener.Addr().String()
+
+	// A device with a certificate connects, and its hello is proxied to
+	// the controller over TLS
+	device, err := tls.Dial("tcp", address, &tls.Config{
+		Certificates: []tls.Certificate{client},
+		RootCAs:      roots,
+	})
+	if err != nil {
+		t.Fatalf("Expected the device's TLS connection accepted, got %v", err)
+	}
+	defer device.Close()
+	hello := &bytes.Buffer{}
+	header := of.Header{Version: OFVersion13, Type: of.TypeHello, Length: 8, Transaction: 1}
+	header.WriteTo(hello)
+	if _, err = device.Write(hello.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	var proxied net.Conn
+	select {
+	case proxied = <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the device proxied to the controller")
+	}
+	defer proxied.Close()
+	proxied.SetReadDeadline(time.Now().Add(2 * time.Second))
+	received := make([]byte, hello.Len())
+	if _, err = io.ReadFull(proxied, received); err != nil || !bytes.Equal(received, hello.Bytes()) {
+		t.Errorf("Expected the device's hello proxied over TLS, got %02x (%v)", received, err)
+	}
+
+	// A device without a certificate is rejected
+	anonymous, err := tls.Dial("tcp", address, &tls.Config{RootCAs: roots})
+	if err == nil {
+		anonymous.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = anonymous.Read(make([]byte, 1))
+		anonymous.Close()
+	}
+	if err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("Expected a device without a certificate rejected, got %v", err)
+	}
+
+	// As is a controller that isn't trusted
+	untrusted := &App{Config: Config{ProxyTo: app.ProxyTo, ControllerCert: app.ControllerCert, ControllerKey: app.ControllerKey}}
+	if _, err = untrusted.dialController(untrusted.ProxyTo); err == nil {
+		t.Error("Expected a controller whose CA isn't trusted rejected")
+	}
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ciena/oftee/api"
+	"github.com/ciena/oftee/packetin"
+)
+
+// OpenFlow versions are negotiated by the hellos a device and its controller
+// exchange, see `api.HandshakeTracker`. Only the packet ins of OpenFlow 1.0,
+// and of 1.3 and later, whose layout is that of 1.3, can be decoded, see
+// `packetin.Decode`, so the devices allowed are restricted to those versions,
+// see `Config.OFVersions`.
+
+// parseOFVersions parses a list of OpenFlow versions by name, i.e. `1.3`,
+// into a set of wire versions, as bits `1 << version`. Only versions whose
+// packet ins can be decoded may be allowed.
+func parseOFVersions(names []string) (uint32, error) {
+	var versions uint32
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		var version uint8
+		for v := uint8(1); v <= 6; v++ {
+			if api.VersionName(v) == name {
+				version = v
+			}
+		}
+		switch {
+		case version == 0:
+			return 0, fmt.Errorf("unknown OpenFlow version '%s', expected i.e. 1.3", name)
+		case !packetin.Decodable(version):
+			return 0, fmt.Errorf("packet ins of OpenFlow version %s can't be decoded", name)
+		}
+		versions |= 1 << version
+	}
+	if versions == 0 {
+		return 0, errors.New("at least one OpenFlow version must be allowed")
+	}
+	return versions, nil
+}
+
+// versionAllowed returns true if devices may use the given OpenFlow version,
+// any may if the versions allowed are not set, as by `New`
+func (app *App) versionAllowed(version uint8) bool {
+	return app.ofVersions == 0 || version < 32 && app.ofVersions&(1<<version) != 0
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ciena/oftee/events"
+	"github.com/ciena/oftee/internal/harness"
+	of "github.com/netrack/openflow"
+	"github.com/netrack/openflow/ofp"
+)
+
+func TestParseOFVersions(t *testing.T) {
+	versions, err := parseOFVersions([]string{"1.0", " 1.3", "1.5"})
+	if err != nil || versions != 1<<0x01|1<<0x04|1<<0x06 {
+		t.Errorf("Expected 1.0, 1.3 and 1.5 parsed, got 0x%x, %v", versions, err)
+	}
+	for value, expected := range map[string]string{
+		"1.2": "packet ins of OpenFlow version 1.2 can't be decoded",
+		"2.0": "unknown OpenFlow version '2.0'",
+		"":    "unknown OpenFlow version ''",
+	} {
+		if _, err := parseOFVersions([]string{value}); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected '%s' rejected with '%s', got %v", value, expected, err)
+		}
+	}
+	if _, err := parseOFVersions(nil); err == nil {
+		t.Error("Expected an empty list of versions rejected")
+	}
+}
+
+// packetIn10 builds an OpenFlow 1.0 packet in of the given frame, received on
+// the given port
+func packetIn10(t *testing.T, xid uint32, port uint16, frame []byte) harness.Message {
+	body := make([]byte, 10, 10+len(frame))
+	binary.BigEndian.PutUint32(body, 0xffffffff)
+	binary.BigEndian.PutUint16(body[4:], uint16(len(frame)))
+	binary.BigEndian.PutUint16(body[6:], port)
+	m := harness.NewMessage(t, of.TypePacketIn, xid, bytes.NewBuffer(append(body, frame...)))
+	m.Raw[0] = OFVersion10
+	return m
+}
+
+func TestIntegrationPacketInVersion10(t *testing.T) {
+	collector := harness.NewTCPEndpoint(t)
+	defer collector.Stop()
+	r := newRig(t, collector.Spec("dl_type=arp", "in_port=3"))
+	defer r.close()
+	device, conn := harness.NewSwitch(t)
+	defer device.Close()
+	go r.app.handle(context.Background(), conn, r.app.sharedEndpoints())
+	controller := r.controller.Conn(0)
+
+	features := harness.NewMessage(t, of.TypeFeaturesReply, 1, &ofp.SwitchFeatures{DatapathID: 0x1})
+	features.Raw[0] = OFVersion10
+	device.Write(features)
+	sent := []harness.Message{
+		device.Write(packetIn10(t, 2, 3, harness.EthernetFrame(0x0806, 64))),
+		device.Write(packetIn10(t, 3, 4, harness.EthernetFrame(0x0806, 64))),
+	}
+
+	// The packet ins are proxied unmodified, and matched on the port of
+	// the OpenFlow 1.0 layout
+	controller.ExpectMessages(t, features, sent[0], sent[1])
+	collector.Frames.ExpectFrames(t, harness.FrameOf(0x1, 3, sent[0]))
+}
+
+// port10 builds an OpenFlow 1.0 port description
+func port10(no uint16, name string) []byte {
+	data := make([]byte, 48)
+	binary.BigEndian.PutUint16(data, no)
+	copy(data[2:], []byte{0, 0, 0, 0, 0, byte(no)})
+	copy(data[8:], name)
+	return data
+}
+
+func TestIntegrationPortsVersion10(t *testing.T) {
+	r := newRig(t)
+	defer r.close()
+	offered := make(portEvents, 10)
+	r.app.notifier = &events.Notifier{Targets: []events.Target{offered}}
+	device, conn := harness.NewSwitch(t)
+	defer device.Close()
+	go r.app.handle(context.Background(), conn, r.app.sharedEndpoints())
+	controller := r.controller.Conn(0)
+
+	// The ports of an OpenFlow 1.0 device follow its features reply, and
+	// a change is a port status of the OpenFlow 1.0 layout
+	body := &bytes.Buffer{}
+	(&ofp.SwitchFeatures{DatapathID: 0x1}).WriteTo(body)
+	body.Write(append(port10(1, "eth1"), port10(2, "eth2")...))
+	features := harness.NewMessage(t, of.TypeFeaturesReply, 1, body)
+	features.Raw[0] = OFVersion10
+	device.Write(features)
+	status := harness.NewMessage(t, of.TypePortStatus, 2, bytes.NewBuffer(append([]byte{2, 0, 0, 0, 0, 0, 0, 0}, port10(2, "uplink")...)))
+	status.Raw[0] = OFVersion10
+	device.Write(status)
+
+	// Both are proxied unmodified, and the ports tracked
+	controller.ExpectMessages(t, features, status)
+	expectPortEvents(t, offered, "port_added 1", "port_added 2", "port_modified 2")
+	if p, ok := r.app.api.Port(0x1, 2); !ok || p.Name != "uplink" || p.HWAddr != "00:00:00:00:00:02" {
+		t.Errorf("Expected port 2 renamed, got %+v", p)
+	}
+}
+
+func TestVersionNotAllowed(t *testing.T) {
+	r := newRig(t)
+	defer r.close()
+	r.app.ofVersions = 1 << 0x05
+	device, conn := harness.NewSwitch(t)
+	defer device.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- r.app.handle(context.Background(), conn, r.app.sharedEndpoints())
+	}()
+
+	// The hello offers the versions of the device, so only the messages
+	// that follow are of the version in use
+	hello := harness.NewMessage(t, of.TypeHello, 1, nil)
+	hello.Raw[0] = 0x05
+	device.Write(hello)
+	device.SendFeatures(0x1)
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "OpenFlow version 1.3 is not allowed" {
+			t.Errorf("Expected the device disconnected, got %v", err)
+		}
+	case <-time.After(harness.Timeout):
+		t.Fatal("Device of a version that is not allowed still connected")
+	}
+}
@@ -0,0 +1,629 @@
+// Package spool provides a write-ahead log of messages on disk, from which
+// they are delivered with at-least-once semantics. Messages are appended to
+// segment files, each record protected by a CRC, and remain in the spool
+// until they are acknowledged. When a spool is reopened, i.e. after a
+// restart, delivery resumes from the first message that was not
+// acknowledged.
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultSegmentSize size at which a new segment file is started
+	DefaultSegmentSize = 64 << 20
+
+	// DefaultMaxSize size of all segment files at which the oldest segment
+	// is evicted, whether or not its messages have been acknowledged
+	DefaultMaxSize = 1 << 30
+
+	// Sync policies, other than an interval
+	SyncAlways = "always"
+	SyncNever  = "never"
+
+	// Each record is the length of the message and the CRC of the message
+	// followed by the message
+	recordHeaderLen = 8
+
+	segmentSuffix = ".seg"
+	ackFileName   = "ack"
+)
+
+var (
+	// ErrClosed is returned by the operations of a closed spool
+	ErrClosed = errors.New("spool: closed")
+
+	// ErrTooLarge is returned when appending a message that can't fit in a
+	// segment
+	ErrTooLarge = errors.New("spool: message larger than segment size")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// SyncPolicy determines when appended messages are flushed to disk. Unless
+// `Always` is set messages are flushed every `Interval`, or when the
+// operating system chooses if it is zero.
+type SyncPolicy struct {
+	Always   bool
+	Interval time.Duration
+}
+
+// ParseSync parses a sync policy, one of `always`, `never` or an interval,
+// i.e. `1s`
+func ParseSync(value string) (SyncPolicy, error) {
+	switch strings.ToLower(value) {
+	case SyncAlways:
+		return SyncPolicy{Always: true}, nil
+	case SyncNever:
+		return SyncPolicy{}, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return SyncPolicy{}, fmt.Errorf("invalid sync policy '%s', expected '%s', '%s' or an interval", value, SyncAlways, SyncNever)
+	}
+	return SyncPolicy{Interval: interval}, nil
+}
+
+func (p SyncPolicy) String() string {
+	switch {
+	case p.Always:
+		return SyncAlways
+	case p.Interval > 0:
+		return p.Interval.String()
+	}
+	return SyncNever
+}
+
+// Options the configuration of a spool, zero values are replaced by the
+// defaults
+type Options struct {
+	SegmentSize int64
+	MaxSize     int64
+	Sync        SyncPolicy
+}
+
+// Stats the state of a spool
+type Stats struct {
+	Segments int    `json:"segments"`
+	Bytes    int64  `json:"bytes"`
+	Pending  uint64 `json:"pending"`
+	Evicted  uint64 `json:"evicted"`
+}
+
+// segment is a segment file, holding `count` records starting with sequence
+// number `base`
+type segment struct {
+	base  uint64
+	count uint64
+	size  int64
+	path  string
+}
+
+// cursor is the position of the next record to be read
+type cursor struct {
+	seq    uint64
+	seg    *segment
+	file   *os.File
+	offset int64
+}
+
+// Spool is a write-ahead log of messages in a directory. Messages are
+// appended by any number of writers and read, in order, by a single reader
+// which acknowledges them once delivered.
+type Spool struct {
+	dir      string
+	opts     Options
+	lock     sync.Mutex
+	segments []*segment
+	active   *os.File
+	next     uint64
+	acked    uint64
+	read     cursor
+	size     int64
+	evicted  uint64
+	dirty    bool
+	closed   bool
+	appended chan struct{}
+	done     chan struct{}
+}
+
+// segmentPath returns the path of the segment whose first record has the
+// given sequence number
+func (s *Spool) segmentPath(base uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", base, segmentSuffix))
+}
+
+// Open opens the spool in the given directory, creating it if it doesn't
+// exist. The segments are scanned and a record that is incomplete or whose
+// CRC doesn't match, i.e. one that was being written when the process
+// crashed, is truncated along with anything after it in its segment.
+func Open(dir string, opts Options) (*Spool, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		dir:      dir,
+		opts:     opts,
+		appended: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	if opts.Sync.Interval > 0 && !opts.Sync.Always {
+		go s.syncEvery(opts.Sync.Interval)
+	}
+	return s, nil
+}
+
+// recover loads the segments and the acknowledged position, and opens the
+// last segment for appending
+func (s *Spool) recover() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), segmentSuffix) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &segment{base: base, path: filepath.Join(s.dir, file.Name())})
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].base < s.segments[j].base
+	})
+	for _, seg := range s.segments {
+		if err = s.scan(seg); err != nil {
+			return err
+		}
+		s.size += seg.size
+	}
+
+	s.acked = s.loadAck()
+	if len(s.segments) == 0 {
+		s.next = s.acked
+	} else {
+		last := s.segments[len(s.segments)-1]
+		s.next = last.base + last.count
+		if first := s.segments[0].base; s.acked < first {
+			s.acked = first
+		}
+		if s.acked > s.next {
+			s.acked = s.next
+		}
+	}
+	s.removeAcked()
+	if len(s.segments) == 0 {
+		if err = s.roll(); err != nil {
+			return err
+		}
+	} else {
+		last := s.segments[len(s.segments)-1]
+		if s.active, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return err
+		}
+	}
+	s.read.seq = s.acked
+	if s.acked < s.next {
+		log.
+			WithFields(log.Fields{
+				"spool":   s.dir,
+				"pending": s.next - s.acked,
+			}).
+			Info("Recovered unacknowledged messages from spool")
+	}
+	return nil
+}
+
+// scan counts the valid records of a segment, truncating it after the last
+// one
+func (s *Spool) scan(seg *segment) error {
+	file, err := os.OpenFile(seg.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	for {
+		message, err := readRecord(file, offset, info.Size())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.
+				WithFields(log.Fields{
+					"segment":   seg.path,
+					"offset":    offset,
+					"truncated": info.Size() - offset,
+				}).
+				WithError(err).
+				Warn("Truncating damaged spool segment, i.e. a record written during a crash")
+			if err = file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		offset += recordHeaderLen + int64(len(message))
+		seg.count++
+	}
+	seg.size = offset
+	return nil
+}
+
+// readRecord reads the message of the record at the given offset of a file
+// of the given size. `io.EOF` is returned if there is no record at the
+// offset.
+func readRecord(file *os.File, offset, size int64) ([]byte, error) {
+	header := make([]byte, recordHeaderLen)
+	n, err := file.ReadAt(header, offset)
+	if n == 0 && err == io.EOF {
+		return nil, io.EOF
+	}
+	if n < recordHeaderLen {
+		return nil, fmt.Errorf("incomplete record header: %v", err)
+	}
+	length := int64(binary.BigEndian.Uint32(header))
+	if offset+recordHeaderLen+length > size {
+		return nil, errors.New("incomplete record")
+	}
+	message := make([]byte, length)
+	if n, err = file.ReadAt(message, offset+recordHeaderLen); n < len(message) {
+		return nil, fmt.Errorf("incomplete record: %v", err)
+	}
+	if crc32.Checksum(message, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errors.New("record CRC mismatch")
+	}
+	return message, nil
+}
+
+// loadAck returns the sequence number of the first message that has not been
+// acknowledged, or 0 if it can't be read, so that everything is redelivered
+func (s *Spool) loadAck() uint64 {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, ackFileName))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil || len(data) != 12 || crc32.Checksum(data[:8], crcTable) != binary.BigEndian.Uint32(data[8:]) {
+		log.
+			WithFields(log.Fields{
+				"spool": s.dir,
+			}).
+			WithError(err).
+			Warn("Unable to read spool acknowledgments, redelivering all spooled messages")
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
+
+// storeAck persists the acknowledged position, replacing the previous one
+// atomically
+func (s *Spool) storeAck() error {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint64(data, s.acked)
+	binary.BigEndian.PutUint32(data[8:], crc32.Checksum(data[:8], crcTable))
+	path := filepath.Join(s.dir, ackFileName)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil && s.opts.Sync.Always {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// roll starts a new segment for the records that follow
+func (s *Spool) roll() error {
+	if s.active != nil {
+		if err := s.active.Sync(); err != nil {
+			return err
+		}
+		if err := s.active.Close(); err != nil {
+			return err
+		}
+	}
+	seg := &segment{base: s.next, path: s.segmentPath(s.next)}
+	file, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	s.active = file
+	s.segments = append(s.segments, seg)
+	return nil
+}
+
+// removeAcked removes the segments, other than the one being appended to,
+// whose messages have all been acknowledged
+func (s *Spool) removeAcked() {
+	for len(s.segments) > 1 && s.segments[0].base+s.segments[0].count <= s.acked {
+		s.remove()
+	}
+}
+
+// remove removes the oldest segment
+func (s *Spool) remove() {
+	seg := s.segments[0]
+	if s.read.seg == seg {
+		s.read.file.Close()
+		s.read.seg, s.read.file = nil, nil
+	}
+	if err := os.Remove(seg.path); err != nil {
+		log.
+			WithFields(log.Fields{
+				"segment": seg.path,
+			}).
+			WithError(err).
+			Error("Unable to remove spool segment")
+	}
+	s.size -= seg.size
+	s.segments = s.segments[1:]
+}
+
+// Append appends a message to the spool, returning its sequence number. If
+// the spool is then larger than its maximum size the oldest segments are
+// evicted, losing any messages in them that were not acknowledged.
+func (s *Spool) Append(message []byte) (uint64, error) {
+	length := recordHeaderLen + int64(len(message))
+	if length > s.opts.SegmentSize {
+		return 0, ErrTooLarge
+	}
+	record := make([]byte, length)
+	binary.BigEndian.PutUint32(record, uint32(len(message)))
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(message, crcTable))
+	copy(record[recordHeaderLen:], message)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return 0, ErrClosed
+	}
+	seg := s.segments[len(s.segments)-1]
+	if seg.size > 0 && seg.size+length > s.opts.SegmentSize {
+		if err := s.roll(); err != nil {
+			return 0, err
+		}
+		seg = s.segments[len(s.segments)-1]
+	}
+	if _, err := s.active.Write(record); err != nil {
+		// Remove any part of the record that was written, so that
+		// the segment remains readable
+		s.active.Truncate(seg.size)
+		return 0, err
+	}
+	if s.opts.Sync.Always {
+		if err := s.active.Sync(); err != nil {
+			return 0, err
+		}
+	} else {
+		s.dirty = true
+	}
+	seq := s.next
+	seg.count++
+	seg.size += length
+	s.size += length
+	s.next++
+	s.evict()
+
+	select {
+	case s.appended <- struct{}{}:
+	default:
+	}
+	return seq, nil
+}
+
+// evict removes the oldest segments while the spool is larger than its
+// maximum size, the segment being appended to is never evicted
+func (s *Spool) evict() {
+	for s.size > s.opts.MaxSize && len(s.segments) > 1 {
+		seg := s.segments[0]
+		end := seg.base + seg.count
+		if end > s.acked {
+			lost := end - s.acked
+			if s.acked < seg.base {
+				lost = seg.count
+			}
+			s.evicted += lost
+			s.acked = end
+			if s.read.seq < end {
+				s.read.seq = end
+			}
+			log.
+				WithFields(log.Fields{
+					"spool":    s.dir,
+					"segment":  seg.path,
+					"lost":     lost,
+					"max-size": s.opts.MaxSize,
+				}).
+				Error("SPOOL FULL: evicted oldest segment with unacknowledged messages, messages LOST")
+		}
+		s.remove()
+	}
+}
+
+// Next returns the next message to deliver, waiting until one is appended
+// if there is none. It returns `ErrClosed` if the spool is closed, or the
+// given channel is closed, while waiting. Messages are returned in order,
+// each once, until the spool is reopened.
+func (s *Spool) Next(stop <-chan struct{}) (uint64, []byte, error) {
+	for {
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			return 0, nil, ErrClosed
+		}
+		if s.read.seq < s.next {
+			seq, message, err := s.readNext()
+			s.lock.Unlock()
+			return seq, message, err
+		}
+		s.lock.Unlock()
+
+		select {
+		case <-s.appended:
+		case <-s.done:
+		case <-stop:
+			return 0, nil, ErrClosed
+		}
+	}
+}
+
+// readNext reads the message at the read cursor and advances it
+func (s *Spool) readNext() (uint64, []byte, error) {
+	r := &s.read
+	if r.seg == nil || r.seq >= r.seg.base+r.seg.count {
+		if r.file != nil {
+			r.file.Close()
+		}
+		r.seg, r.file, r.offset = nil, nil, 0
+		for _, seg := range s.segments {
+			if r.seq < seg.base+seg.count {
+				r.seg = seg
+				break
+			}
+		}
+		if r.seg == nil {
+			return 0, nil, fmt.Errorf("spool: message %d not found", r.seq)
+		}
+		if r.seq < r.seg.base {
+			r.seq = r.seg.base
+		}
+		file, err := os.Open(r.seg.path)
+		if err != nil {
+			r.seg = nil
+			return 0, nil, err
+		}
+		r.file = file
+
+		// Skip the records before the cursor, which were delivered
+		// before the segment was last opened
+		for seq := r.seg.base; seq < r.seq; seq++ {
+			message, err := readRecord(r.file, r.offset, r.seg.size)
+			if err != nil {
+				return 0, nil, err
+			}
+			r.offset += recordHeaderLen + int64(len(message))
+		}
+	}
+
+	message, err := readRecord(r.file, r.offset, r.seg.size)
+	if err != nil {
+		return 0, nil, err
+	}
+	seq := r.seq
+	r.offset += recordHeaderLen + int64(len(message))
+	r.seq++
+	return seq, message, nil
+}
+
+// Ack acknowledges the delivery of the message with the given sequence
+// number, and all those before it. Segments whose messages have all been
+// acknowledged are removed.
+func (s *Spool) Ack(seq uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if seq < s.acked {
+		return nil
+	}
+	s.acked = seq + 1
+	if err := s.storeAck(); err != nil {
+		return err
+	}
+	s.removeAcked()
+	return nil
+}
+
+// syncEvery flushes appended messages to disk at the given interval
+func (s *Spool) syncEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			if s.dirty && !s.closed {
+				if err := s.active.Sync(); err != nil {
+					log.
+						WithFields(log.Fields{
+							"spool": s.dir,
+						}).
+						WithError(err).
+						Error("Unable to flush spool to disk")
+				}
+				s.dirty = false
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+// Stats returns the state of the spool
+func (s *Spool) Stats() Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return Stats{
+		Segments: len(s.segments),
+		Bytes:    s.size,
+		Pending:  s.next - s.acked,
+		Evicted:  s.evicted,
+	}
+}
+
+// Close flushes the spool to disk and closes it
+func (s *Spool) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	if s.read.file != nil {
+		s.read.file.Close()
+	}
+	err := s.active.Sync()
+	if closeErr := s.active.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
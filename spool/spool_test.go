@@ -0,0 +1,247 @@
+package spool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tempSpool opens a spool in a new temporary directory
+func tempSpool(t *testing.T, opts Options) (*Spool, string) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+// appendN appends the messages `message-from` to `message-to`, exclusive
+func appendN(t *testing.T, s *Spool, from, to int) {
+	for i := from; i < to; i++ {
+		if _, err := s.Append([]byte(fmt.Sprintf("message-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// expectNext reads the next message and verifies it is `message-i`
+func expectNext(t *testing.T, s *Spool, i int) uint64 {
+	stop := make(chan struct{})
+	timer := time.AfterFunc(time.Second, func() { close(stop) })
+	defer timer.Stop()
+	seq, message, err := s.Next(stop)
+	if err != nil {
+		t.Fatalf("Expected message-%d, got %v", i, err)
+	}
+	if string(message) != fmt.Sprintf("message-%d", i) || seq != uint64(i) {
+		t.Fatalf("Expected message-%d at %d, got '%s' at %d", i, i, message, seq)
+	}
+	return seq
+}
+
+// lastSegment returns the path of the newest segment file
+func lastSegment(t *testing.T, dir string) string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("No segment files in %s, %v", dir, err)
+	}
+	return files[len(files)-1]
+}
+
+func TestRedeliverUnacknowledged(t *testing.T) {
+	s, dir := tempSpool(t, Options{})
+	defer os.RemoveAll(dir)
+
+	appendN(t, s, 0, 10)
+	for i := 0; i < 4; i++ {
+		s.Ack(expectNext(t, s, i))
+	}
+	// Delivered but never acknowledged before the crash
+	expectNext(t, s, 4)
+
+	// The spool is abandoned, as if the process crashed, and reopened
+	s, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if stats := s.Stats(); stats.Pending != 6 {
+		t.Errorf("Expected 6 pending messages after restart, got %+v", stats)
+	}
+	for i := 4; i < 10; i++ {
+		s.Ack(expectNext(t, s, i))
+	}
+
+	// New messages follow the recovered ones
+	appendN(t, s, 10, 11)
+	expectNext(t, s, 10)
+}
+
+func TestTornWrite(t *testing.T) {
+	s, dir := tempSpool(t, Options{})
+	defer os.RemoveAll(dir)
+	appendN(t, s, 0, 5)
+	s.Close()
+
+	// A crash part way through writing a record leaves an incomplete
+	// record at the end of the segment
+	file, err := os.OpenFile(lastSegment(t, dir), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0x00, 0x00, 0x00, 0x20, 0xde, 0xad, 0xbe, 0xef, 'p', 'a', 'r'})
+	file.Close()
+
+	if s, err = Open(dir, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 5; i++ {
+		expectNext(t, s, i)
+	}
+	appendN(t, s, 5, 6)
+	expectNext(t, s, 5)
+}
+
+func TestCorruptRecord(t *testing.T) {
+	s, dir := tempSpool(t, Options{})
+	defer os.RemoveAll(dir)
+	appendN(t, s, 0, 5)
+	s.Close()
+
+	// Damage the fourth record, it and those after it are discarded
+	path := lastSegment(t, dir)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := recordHeaderLen + len("message-0")
+	data[3*record+recordHeaderLen] ^= 0xff
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err = Open(dir, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if stats := s.Stats(); stats.Pending != 3 || stats.Bytes != int64(3*record) {
+		t.Errorf("Expected 3 records recovered, got %+v", stats)
+	}
+	for i := 0; i < 3; i++ {
+		expectNext(t, s, i)
+	}
+	appendN(t, s, 3, 4)
+	expectNext(t, s, 3)
+}
+
+func TestCorruptAck(t *testing.T) {
+	s, dir := tempSpool(t, Options{})
+	defer os.RemoveAll(dir)
+	appendN(t, s, 0, 3)
+	s.Ack(expectNext(t, s, 0))
+	s.Close()
+
+	// Without a readable acknowledgment everything is redelivered
+	if err := ioutil.WriteFile(filepath.Join(dir, ackFileName), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	expectNext(t, s, 0)
+}
+
+func TestSegmentsRemovedOnceAcknowledged(t *testing.T) {
+	// Each segment holds two records
+	record := int64(recordHeaderLen + len("message-0"))
+	s, dir := tempSpool(t, Options{SegmentSize: 2 * record})
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	appendN(t, s, 0, 10)
+	if stats := s.Stats(); stats.Segments != 5 {
+		t.Errorf("Expected 5 segments, got %+v", stats)
+	}
+	for i := 0; i < 10; i++ {
+		s.Ack(expectNext(t, s, i))
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if stats := s.Stats(); stats.Segments != 1 || stats.Pending != 0 || len(files) != 1 {
+		t.Errorf("Expected only the active segment kept, got %+v, %v", stats, files)
+	}
+
+	// Sequence numbers continue across a restart with no pending messages
+	s.Close()
+	if s, _ = Open(dir, Options{SegmentSize: 2 * record}); s == nil {
+		t.Fatal("Unable to reopen spool")
+	}
+	appendN(t, s, 10, 11)
+	expectNext(t, s, 10)
+}
+
+func TestEvictOldest(t *testing.T) {
+	record := int64(recordHeaderLen + len("message-0"))
+	s, dir := tempSpool(t, Options{SegmentSize: 2 * record, MaxSize: 4 * record})
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	// Nothing is acknowledged, so the oldest segments are evicted along
+	// with their messages
+	appendN(t, s, 0, 8)
+	if stats := s.Stats(); stats.Evicted != 4 || stats.Pending != 4 || stats.Bytes != 4*record {
+		t.Errorf("Expected 4 messages evicted, got %+v", stats)
+	}
+	for i := 4; i < 8; i++ {
+		expectNext(t, s, i)
+	}
+}
+
+func TestNextWaits(t *testing.T) {
+	s, dir := tempSpool(t, Options{Sync: SyncPolicy{Interval: 10 * time.Millisecond}})
+	defer os.RemoveAll(dir)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		appendN(t, s, 0, 1)
+	}()
+	expectNext(t, s, 0)
+
+	// Closing the spool releases a waiting reader
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.Close()
+	}()
+	if _, _, err := s.Next(nil); err != ErrClosed {
+		t.Errorf("Expected closed spool, got %v", err)
+	}
+	if _, err := s.Append([]byte("late")); err != ErrClosed {
+		t.Errorf("Expected closed spool, got %v", err)
+	}
+}
+
+func TestParseSync(t *testing.T) {
+	for value, expected := range map[string]SyncPolicy{
+		"always": {Always: true},
+		"never":  {},
+		"250ms":  {Interval: 250 * time.Millisecond},
+	} {
+		if policy, err := ParseSync(value); err != nil || policy != expected || policy.String() != value {
+			t.Errorf("Expected %+v for '%s', got %+v, %v", expected, value, policy, err)
+		}
+	}
+	for _, value := range []string{"sometimes", "0s", "-1s"} {
+		if _, err := ParseSync(value); err == nil {
+			t.Errorf("Expected error for '%s'", value)
+		}
+	}
+}